@@ -0,0 +1,120 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// InTotoPayloadType is the DSSE payload type of in-toto
+	// statements.
+	InTotoPayloadType = "application/vnd.in-toto+json"
+
+	// inTotoStatementPrefix starts the _type of every version of
+	// the in-toto statement format.
+	inTotoStatementPrefix = "https://in-toto.io/Statement/"
+)
+
+type (
+	// AttestationSubject is an artifact an in-toto statement makes
+	// claims about, identified by its digests, e.g. {"sha256": hex}.
+	AttestationSubject struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	}
+
+	// AttestationStatement is the part of an in-toto statement
+	// needed to tell which artifacts it covers. The predicate
+	// isn't interpreted.
+	AttestationStatement struct {
+		Type          string               `json:"_type"`
+		Subject       []AttestationSubject `json:"subject"`
+		PredicateType string               `json:"predicateType"`
+	}
+
+	// dsseEnvelope wraps a signed payload. Signatures aren't
+	// checked here; that needs the signer's keys.
+	dsseEnvelope struct {
+		PayloadType string `json:"payloadType"`
+		Payload     string `json:"payload"`
+	}
+)
+
+// ParseAttestation reads an in-toto statement, either bare or in a
+// DSSE envelope.
+func ParseAttestation(data []byte) (*AttestationStatement, error) {
+	var envelope dsseEnvelope
+	err := json.Unmarshal(data, &envelope)
+	if err != nil {
+		return nil, MakeError(ErrorInvalidArgument, "Attestation isn't JSON: "+err.Error())
+	}
+	if len(envelope.PayloadType) > 0 {
+		if envelope.PayloadType != InTotoPayloadType {
+			return nil, MakeError(ErrorInvalidArgument, "Unsupported attestation payload type "+envelope.PayloadType)
+		}
+		data, err = base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			return nil, MakeError(ErrorInvalidArgument, "Invalid attestation payload: "+err.Error())
+		}
+	}
+
+	var statement AttestationStatement
+	err = json.Unmarshal(data, &statement)
+	if err != nil {
+		return nil, MakeError(ErrorInvalidArgument, "Invalid attestation statement: "+err.Error())
+	}
+	if !strings.HasPrefix(statement.Type, inTotoStatementPrefix) {
+		return nil, MakeError(ErrorInvalidArgument, "Attestation isn't an in-toto statement")
+	}
+	if len(statement.Subject) == 0 {
+		return nil, MakeError(ErrorInvalidArgument, "Attestation has no subjects")
+	}
+	return &statement, nil
+}
+
+// Covers returns true if the statement has a subject with the given
+// SHA256 sum.
+func (s *AttestationStatement) Covers(sha256Sum string) bool {
+	for _, subject := range s.Subject {
+		if strings.EqualFold(subject.Digest["sha256"], sha256Sum) {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchiveSHA256 returns the hex SHA256 sum of an archive's contents:
+// its checksum, or the sum of its literal contents if it has no
+// checksum. It returns false if neither is known.
+func ArchiveSHA256(archive *Archive) (string, bool) {
+	if len(archive.Checksum.Sum) > 0 {
+		if archive.Checksum.Type != ChecksumTypeSHA256 {
+			return "", false
+		}
+		return archive.Checksum.Sum, true
+	}
+	if archive.Type == ArchiveTypeLiteral {
+		sum := sha256.Sum256(archive.Literal)
+		return hex.EncodeToString(sum[:]), true
+	}
+	return "", false
+}
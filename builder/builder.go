@@ -18,6 +18,7 @@ package builder
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,12 +32,15 @@ import (
 	"time"
 
 	"github.com/dchest/uniuri"
+
+	"github.com/fission/fission"
 )
 
 const (
 	// supported environment variables
 	envSrcPkg    = "SRC_PKG"
 	envDeployPkg = "DEPLOY_PKG"
+	envHints     = "SRC_PKG_HINTS"
 )
 
 type (
@@ -44,19 +48,45 @@ type (
 		SrcPkgFilename string `json:"srcPkgFilename"`
 		// Command for builder to run with.
 		// A build command consists of commands, parameters and environment variables.
-		// For now, two environment variables are supported:
+		// For now, these environment variables are supported:
 		// 1. SRC_PKG: path to source package directory
 		// 2. DEPLOY_PKG: path to deployment package directory
+		// 3. SRC_PKG_HINTS: comma separated hints about the
+		//    source package, such as npm-package; see
+		//    fission.ArchiveHintFiles
+		// 4. BUILD_SECRETS and BUILD_CONFIGMAPS: directories
+		//    holding the mounted secrets and configmaps, if any
 		BuildCommand string `json:"command"`
+		// Env holds extra KEY=value environment variables for
+		// the build command.
+		Env []string `json:"env,omitempty"`
+		// Hints describe the source package's contents.
+		Hints []string `json:"hints,omitempty"`
+		// PreBuildCommands and PostBuildCommands are hooks run
+		// in order before and after the build command, like it
+		// and with its environment. The build fails if any of
+		// them fails.
+		PreBuildCommands  []string `json:"preBuildCommands,omitempty"`
+		PostBuildCommands []string `json:"postBuildCommands,omitempty"`
+		// Mounts are the secrets and configmaps the build
+		// command and hooks can read; see writeBuildMounts.
+		Mounts []BuildMount `json:"mounts,omitempty"`
+		// RequestId is the ID of the request that created or
+		// updated the package, logged to trace the build to it.
+		RequestId string `json:"requestId,omitempty"`
 	}
 
 	PackageBuildResponse struct {
 		ArtifactFilename string `json:"artifactFilename"`
 		BuildLogs        string `json:"buildLogs"`
+		// HookLogs are the outputs of the build hooks, kept apart
+		// from the build command's.
+		HookLogs []fission.BuildHookLog `json:"hookLogs,omitempty"`
 	}
 
 	Builder struct {
 		sharedVolumePath string
+		progress         buildProgress
 	}
 )
 
@@ -92,7 +122,9 @@ func (builder *Builder) Handler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	log.Printf("Builder received request: %v", req)
+	// the env and mounts may hold secrets, so only log their sizes
+	log.Printf("Builder received request %v: package %v, command %v, %v env vars, %v mounts, hints %v, %v pre-build and %v post-build hooks",
+		req.RequestId, req.SrcPkgFilename, req.BuildCommand, len(req.Env), len(req.Mounts), req.Hints, len(req.PreBuildCommands), len(req.PostBuildCommands))
 
 	log.Println("Starting build...")
 	srcPkgPath := filepath.Join(builder.sharedVolumePath, req.SrcPkgFilename)
@@ -103,16 +135,56 @@ func (builder *Builder) Handler(w http.ResponseWriter, r *http.Request) {
 		// use default build command
 		buildCmd = "/build"
 	}
-	buildLogs, err := builder.build(buildCmd, srcPkgPath, deployPkgPath)
+	defer builder.progress.done(req.SrcPkgFilename)
+
+	mounts, err := writeBuildMounts(req.Mounts)
+	if err != nil {
+		e := fmt.Sprintf("Error mounting build secrets and configmaps: %v", err)
+		log.Println(e)
+		http.Error(w, e, 500)
+		return
+	}
+	defer mounts.remove()
+
+	// the build command and hooks are killed if the builder manager
+	// goes away, e.g. because the build was canceled
+	cmd := buildCommand{
+		ctx:            r.Context(),
+		srcPkgFilename: req.SrcPkgFilename,
+		srcPkgPath:     srcPkgPath,
+		deployPkgPath:  deployPkgPath,
+		env:            req.Env,
+		mountEnv:       mounts.env,
+		hints:          req.Hints,
+	}
+	hookLogs, err := builder.runHooks(cmd, "pre-build", req.PreBuildCommands)
+	if err != nil {
+		hookFailed(w, err, "", hookLogs)
+		return
+	}
+	buildLogs, err := builder.build(cmd, []string{buildCmd}, "Build Logs")
 	if err != nil {
 		e := errors.New(fmt.Sprintf("Error building source package: %v", err))
 		http.Error(w, e.Error(), 500)
 		return
 	}
+	postLogs, err := builder.runHooks(cmd, "post-build", req.PostBuildCommands)
+	if err != nil {
+		hookFailed(w, err, buildLogs, append(hookLogs, postLogs...))
+		return
+	}
+	err = mounts.checkLeaks(deployPkgPath)
+	if err != nil {
+		// don't leave the copy for anything to upload
+		os.RemoveAll(deployPkgPath)
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
 	resp := PackageBuildResponse{
 		ArtifactFilename: deployPkgFilename,
 		BuildLogs:        buildLogs,
+		HookLogs:         append(hookLogs, postLogs...),
 	}
 
 	rBody, err := json.Marshal(resp)
@@ -127,13 +199,64 @@ func (builder *Builder) Handler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (builder *Builder) build(command string, srcPkgPath string, deployPkgPath string) (string, error) {
-	cmd := exec.Command(command)
-	cmd.Dir = srcPkgPath
-	// set env variables for build command
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("%v=%v", envSrcPkg, srcPkgPath),
-		fmt.Sprintf("%v=%v", envDeployPkg, deployPkgPath),
+// buildCommand is what the build command and hooks of a build run
+// with.
+type buildCommand struct {
+	ctx            context.Context
+	srcPkgFilename string
+	srcPkgPath     string
+	deployPkgPath  string
+	env            []string
+	mountEnv       []string
+	hints          []string
+}
+
+// runHooks runs a build's hooks of one kind in order, each a shell
+// command run with "sh -c", stopping at the first that fails. The logs
+// returned end with that of the failed hook, if one did.
+func (builder *Builder) runHooks(bc buildCommand, hook string, commands []string) ([]fission.BuildHookLog, error) {
+	var hookLogs []fission.BuildHookLog
+	for _, command := range commands {
+		logs, err := builder.build(bc, []string{"sh", "-c", command}, fmt.Sprintf("%v Hook Logs (%v)", strings.Title(hook), command))
+		hookLogs = append(hookLogs, fission.BuildHookLog{Hook: hook, Command: command, Log: logs, Failed: err != nil})
+		if err != nil {
+			return hookLogs, fmt.Errorf("Error running %v hook %v: %v", hook, command, err)
+		}
+	}
+	return hookLogs, nil
+}
+
+// hookFailed answers a build whose hook failed, with the logs of the
+// build so far in a PackageBuildResponse, so that they're recorded
+// with the failure.
+func hookFailed(w http.ResponseWriter, err error, buildLogs string, hookLogs []fission.BuildHookLog) {
+	rBody, jsonErr := json.Marshal(&PackageBuildResponse{
+		BuildLogs: buildLogs + err.Error() + "\n",
+		HookLogs:  hookLogs,
+	})
+	if jsonErr != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(rBody)
+}
+
+// build runs a build command or hook, given as its argv, returning
+// its output. title heads the output in the builder's log.
+func (builder *Builder) build(bc buildCommand, argv []string, title string) (string, error) {
+	ctx := bc.ctx
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = bc.srcPkgPath
+	// set env variables for build command; the mount and package
+	// paths come last so the package's build env can't override them
+	cmd.Env = append(os.Environ(), bc.env...)
+	cmd.Env = append(cmd.Env, bc.mountEnv...)
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("%v=%v", envSrcPkg, bc.srcPkgPath),
+		fmt.Sprintf("%v=%v", envDeployPkg, bc.deployPkgPath),
+		fmt.Sprintf("%v=%v", envHints, strings.Join(bc.hints, ",")),
 	)
 
 	cmdReader, err := cmd.StdoutPipe()
@@ -150,21 +273,28 @@ func (builder *Builder) build(command string, srcPkgPath string, deployPkgPath s
 
 	var buildLogs string
 
-	fmt.Println("\n=== Build Logs ===")
+	fmt.Printf("\n=== %v ===\n", title)
 	for scanner.Scan() {
 		output := scanner.Text()
 		fmt.Println(output)
+		if progress, ok := parseProgressLine(output); ok {
+			builder.progress.set(bc.srcPkgFilename, progress)
+			continue
+		}
 		buildLogs += fmt.Sprintf("%v\n", output)
 	}
 	fmt.Println("==================\n")
 
 	if err := scanner.Err(); err != nil {
-		return "", errors.New(fmt.Sprintf("Error reading cmd output: %v", err.Error()))
+		return buildLogs, errors.New(fmt.Sprintf("Error reading cmd output: %v", err.Error()))
 	}
 
 	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return buildLogs, errors.New(fmt.Sprintf("Build stopped: %v", ctx.Err()))
+	}
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("Error waiting for cmd: %v", err.Error()))
+		return buildLogs, errors.New(fmt.Sprintf("Error waiting for cmd: %v", err.Error()))
 	}
 
 	return buildLogs, nil
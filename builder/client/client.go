@@ -18,39 +18,70 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/fission/fission"
 	builder "github.com/fission/fission/builder"
 )
 
+const (
+	// dialTimeout bounds connecting to a builder.
+	dialTimeout = 30 * time.Second
+
+	// progressTimeout bounds each read of a build's progress. A
+	// build itself runs until it's done or canceled.
+	progressTimeout = 10 * time.Second
+)
+
 type (
 	Client struct {
-		url string
+		url        string
+		httpClient *http.Client
 	}
 )
 
 func MakeClient(builderUrl string) *Client {
 	return &Client{
 		url: strings.TrimSuffix(builderUrl, "/"),
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				DialContext:     (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+				IdleConnTimeout: 90 * time.Second,
+			},
+		},
 	}
 }
 
-func (c *Client) Build(req *builder.PackageBuildRequest) (*builder.PackageBuildResponse, error) {
+// Build runs a build, which is stopped when ctx is done. A build whose
+// hook failed returns the logs so far along with the error.
+func (c *Client) Build(ctx context.Context, req *builder.PackageBuildRequest) (*builder.PackageBuildResponse, error) {
 	body, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.Post(c.url, "application/json", bytes.NewReader(body))
+	httpReq, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if len(req.RequestId) > 0 {
+		httpReq.Header.Set(fission.RequestIdHeader, req.RequestId)
+	}
+	resp, err := c.httpClient.Do(httpReq.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	if resp.StatusCode != 200 && !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
 		return nil, fission.MakeErrorFromHTTP(resp)
 	}
 
@@ -64,6 +95,41 @@ func (c *Client) Build(req *builder.PackageBuildRequest) (*builder.PackageBuildR
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != 200 {
+		return &pkgBuildResp, fission.MakeErrorFromHTTPStatus(resp.StatusCode, strings.TrimSpace(pkgBuildResp.BuildLogs))
+	}
 
 	return &pkgBuildResp, nil
 }
+
+// Progress returns the latest progress of the build of a source
+// package, or nil if it hasn't reported any. Builders that predate
+// progress reports have none.
+func (c *Client) Progress(ctx context.Context, srcPkgFilename string) (*fission.BuildProgress, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, c.url+"/progress?srcPkgFilename="+url.QueryEscape(srcPkgFilename), nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, progressTimeout)
+	defer cancel()
+	resp, err := c.httpClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, nil
+	default:
+		return nil, fission.MakeErrorFromHTTP(resp)
+	}
+
+	var progress fission.BuildProgress
+	err = json.NewDecoder(resp.Body).Decode(&progress)
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
@@ -38,5 +38,6 @@ func main() {
 	builder := builder.MakeBuilder(dir)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", builder.Handler)
+	mux.HandleFunc("/progress", builder.ProgressHandler)
 	http.ListenAndServe(":8001", mux)
 }
@@ -0,0 +1,195 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Builds can read secrets and configmaps of the package's namespace,
+// which the builder manager sends with the build request. They are
+// written to a private directory outside the shared volume, so the
+// fetcher never sees them, each key a read-only file:
+//
+//	$BUILD_SECRETS/<secret>/<key>
+//	$BUILD_CONFIGMAPS/<configmap>/<key>
+//
+// and removed when the build is done. A build whose output holds a
+// copy of one of these files fails, so a careless "cp -r" can't ship
+// a credential in the deployment archive. Values embedded in other
+// files aren't found.
+
+const (
+	BuildMountSecret    = "secret"
+	BuildMountConfigMap = "configmap"
+
+	envSecrets    = "BUILD_SECRETS"
+	envConfigMaps = "BUILD_CONFIGMAPS"
+
+	// minLeakCheckSize is the smallest mounted file looked for in
+	// the build output; shorter values, like "true", would match
+	// unrelated files.
+	minLeakCheckSize = 8
+)
+
+type (
+	// BuildMount is a secret or configmap mounted for a build,
+	// with its keys' values.
+	BuildMount struct {
+		Kind  string            `json:"kind"`
+		Name  string            `json:"name"`
+		Files map[string][]byte `json:"files"`
+	}
+
+	// buildMounts are the mounts written for a build.
+	buildMounts struct {
+		dir string
+		env []string
+
+		// sums are the checksums of the mounted files by size,
+		// for checkLeaks.
+		sums map[int64]map[[sha256.Size]byte]string
+	}
+)
+
+// writeBuildMounts writes the mounts of a build, returning the
+// environment variables pointing the build at them. The caller must
+// remove the result.
+func writeBuildMounts(mounts []BuildMount) (*buildMounts, error) {
+	bm := &buildMounts{sums: make(map[int64]map[[sha256.Size]byte]string)}
+	if len(mounts) == 0 {
+		return bm, nil
+	}
+	dir, err := ioutil.TempDir("", "fission-build-mounts-")
+	if err != nil {
+		return nil, err
+	}
+	bm.dir = dir
+
+	kindDirs := map[string]string{
+		BuildMountSecret:    filepath.Join(dir, "secrets"),
+		BuildMountConfigMap: filepath.Join(dir, "configmaps"),
+	}
+	for _, m := range mounts {
+		kindDir, ok := kindDirs[m.Kind]
+		if !ok {
+			bm.remove()
+			return nil, fmt.Errorf("unknown build mount kind '%v'", m.Kind)
+		}
+		if !safeMountName(m.Name) {
+			bm.remove()
+			return nil, fmt.Errorf("bad %v name '%v'", m.Kind, m.Name)
+		}
+		mountDir := filepath.Join(kindDir, m.Name)
+		err = os.MkdirAll(mountDir, 0700)
+		if err != nil {
+			bm.remove()
+			return nil, err
+		}
+		for key, value := range m.Files {
+			if !safeMountName(key) {
+				bm.remove()
+				return nil, fmt.Errorf("%v %v has a bad key '%v'", m.Kind, m.Name, key)
+			}
+			err = ioutil.WriteFile(filepath.Join(mountDir, key), value, 0400)
+			if err != nil {
+				bm.remove()
+				return nil, err
+			}
+			if len(value) >= minLeakCheckSize {
+				size := int64(len(value))
+				if bm.sums[size] == nil {
+					bm.sums[size] = make(map[[sha256.Size]byte]string)
+				}
+				bm.sums[size][sha256.Sum256(value)] = fmt.Sprintf("%v %v key %v", m.Kind, m.Name, key)
+			}
+		}
+		err = os.Chmod(mountDir, 0500)
+		if err != nil {
+			bm.remove()
+			return nil, err
+		}
+	}
+	bm.env = []string{
+		fmt.Sprintf("%v=%v", envSecrets, kindDirs[BuildMountSecret]),
+		fmt.Sprintf("%v=%v", envConfigMaps, kindDirs[BuildMountConfigMap]),
+	}
+	return bm, nil
+}
+
+// safeMountName is true for names that are a single path element.
+func safeMountName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// remove deletes the mounted files.
+func (bm *buildMounts) remove() {
+	if len(bm.dir) == 0 {
+		return
+	}
+	// the read-only directories must be writable to be emptied
+	filepath.Walk(bm.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	os.RemoveAll(bm.dir)
+}
+
+// checkLeaks fails if a file of the build output at deployPkgPath,
+// a file or a directory, is a copy of a mounted file.
+func (bm *buildMounts) checkLeaks(deployPkgPath string) error {
+	if len(bm.sums) == 0 {
+		return nil
+	}
+	return filepath.Walk(deployPkgPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == deployPkgPath {
+				return nil
+			}
+			return err
+		}
+		sums, ok := bm.sums[info.Size()]
+		if !ok || !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		if mounted, ok := sums[sum]; ok {
+			rel, _ := filepath.Rel(deployPkgPath, path)
+			return fmt.Errorf("build output %v is a copy of %v; build secrets and configmaps must not be part of the deployment archive", rel, mounted)
+		}
+		return nil
+	})
+}
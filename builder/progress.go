@@ -0,0 +1,120 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package builder
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fission/fission"
+)
+
+// Build commands can report their progress by printing lines such as
+//
+//	::progress 40 downloading deps
+//	::phase compiling
+//
+// on stdout: a percentage, optionally followed by the phase, or just
+// the phase, whose percentage is then unknown. These lines are left
+// out of the build log. While a build runs, the builder manager reads
+// its latest progress from /progress and records it on the package.
+
+const (
+	progressDirective = "::progress "
+	phaseDirective    = "::phase "
+)
+
+// parseProgressLine returns the progress a build output line reports,
+// if it is a progress or phase line.
+func parseProgressLine(line string) (fission.BuildProgress, bool) {
+	switch {
+	case strings.HasPrefix(line, progressDirective):
+		fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, progressDirective)), " ", 2)
+		percent, err := strconv.Atoi(strings.TrimSuffix(fields[0], "%"))
+		if err != nil {
+			return fission.BuildProgress{}, false
+		}
+		if percent < 0 {
+			percent = 0
+		} else if percent > 100 {
+			percent = 100
+		}
+		progress := fission.BuildProgress{Percent: percent}
+		if len(fields) > 1 {
+			progress.Phase = strings.TrimSpace(fields[1])
+		}
+		return progress, true
+	case strings.HasPrefix(line, phaseDirective):
+		phase := strings.TrimSpace(strings.TrimPrefix(line, phaseDirective))
+		return fission.BuildProgress{Phase: phase, Percent: -1}, len(phase) > 0
+	}
+	return fission.BuildProgress{}, false
+}
+
+// buildProgress holds the latest progress of each running build, by
+// source package file name.
+type buildProgress struct {
+	sync.Mutex
+	builds map[string]fission.BuildProgress
+}
+
+func (bp *buildProgress) set(srcPkgFilename string, progress fission.BuildProgress) {
+	bp.Lock()
+	defer bp.Unlock()
+	if bp.builds == nil {
+		bp.builds = make(map[string]fission.BuildProgress)
+	}
+	bp.builds[srcPkgFilename] = progress
+}
+
+func (bp *buildProgress) get(srcPkgFilename string) (fission.BuildProgress, bool) {
+	bp.Lock()
+	defer bp.Unlock()
+	progress, ok := bp.builds[srcPkgFilename]
+	return progress, ok
+}
+
+func (bp *buildProgress) done(srcPkgFilename string) {
+	bp.Lock()
+	defer bp.Unlock()
+	delete(bp.builds, srcPkgFilename)
+}
+
+// ProgressHandler returns the latest progress of the build of the
+// source package named by the srcPkgFilename query parameter, or 404
+// if it isn't running or hasn't reported any.
+func (builder *Builder) ProgressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "", 405)
+		return
+	}
+	progress, ok := builder.progress.get(r.URL.Query().Get("srcPkgFilename"))
+	if !ok {
+		http.Error(w, "no progress reported", 404)
+		return
+	}
+	body, err := json.Marshal(&progress)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -41,6 +41,8 @@ type (
 	BuilderMgr struct {
 		fissionClient    *tpr.FissionClient
 		kubernetesClient *kubernetes.Clientset
+		envWatcher       *environmentWatcher
+		builds           *buildRegistry
 		storageSvcUrl    string
 		namespace        string
 	}
@@ -50,15 +52,18 @@ func MakeBuilderMgr(fissionClient *tpr.FissionClient,
 	kubernetesClient *kubernetes.Clientset, storageSvcUrl string,
 	envBuilderNamespace string) *BuilderMgr {
 
-	envWatcher := makeEnvironmentWatcher(fissionClient, kubernetesClient, envBuilderNamespace)
+	envWatcher := makeEnvironmentWatcher(fissionClient, kubernetesClient, envBuilderNamespace, storageSvcUrl)
 	go envWatcher.watchEnvironments()
 
-	pkgWatcher := makePackageWatcher(fissionClient, kubernetesClient, envBuilderNamespace, storageSvcUrl)
+	builds := makeBuildRegistry()
+	pkgWatcher := makePackageWatcher(fissionClient, kubernetesClient, envWatcher, builds, envBuilderNamespace, storageSvcUrl)
 	go pkgWatcher.watchPackages()
 
 	return &BuilderMgr{
 		fissionClient:    fissionClient,
 		kubernetesClient: kubernetesClient,
+		envWatcher:       envWatcher,
+		builds:           builds,
 		storageSvcUrl:    storageSvcUrl,
 		namespace:        envBuilderNamespace,
 	}
@@ -83,7 +88,7 @@ func (builderMgr *BuilderMgr) build(w http.ResponseWriter, r *http.Request) {
 	}
 
 	buildLogs, err := buildPackage(builderMgr.fissionClient, builderMgr.kubernetesClient,
-		builderMgr.namespace, builderMgr.storageSvcUrl, buildReq)
+		builderMgr.envWatcher, builderMgr.builds, builderMgr.namespace, builderMgr.storageSvcUrl, buildReq)
 	if err != nil {
 		code, e := fission.GetHTTPError(err)
 		http.Error(w, e, code)
@@ -102,6 +107,7 @@ func (builderMgr *BuilderMgr) build(w http.ResponseWriter, r *http.Request) {
 func (builderMgr *BuilderMgr) Serve(port int) {
 	r := mux.NewRouter()
 	r.HandleFunc("/v1/build", builderMgr.build).Methods("POST")
+	r.HandleFunc("/v1/build/cancel", builderMgr.cancelBuild).Methods("POST")
 	address := fmt.Sprintf(":%v", port)
 	log.Printf("Start buildermgr at port %v", address)
 	log.Fatal(http.ListenAndServe(address, handlers.LoggingHandler(os.Stdout, r)))
@@ -0,0 +1,100 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildermgr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/tpr"
+)
+
+// maxAttestationSize bounds the attestations downloaded for checking.
+const maxAttestationSize = 4 * 1024 * 1024
+
+// attestationClient downloads attestations, so a storage service that
+// stops answering fails the build instead of holding it forever.
+var attestationClient = &http.Client{Timeout: time.Minute}
+
+// requireAttestation returns true if the builder manager only builds
+// packages whose source is covered by their attestation. It's off
+// unless REQUIRE_ATTESTATION is "true".
+func requireAttestation() bool {
+	return os.Getenv("REQUIRE_ATTESTATION") == "true"
+}
+
+// readAttestation returns the contents of a package's attestation,
+// verifying its checksum.
+func readAttestation(archive *fission.Archive) ([]byte, error) {
+	contents := archive.Literal
+	if archive.Type == fission.ArchiveTypeUrl {
+		resp, err := attestationClient.Get(archive.URL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("download attestation: %v", resp.Status)
+		}
+		contents, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxAttestationSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(contents) > maxAttestationSize {
+			return nil, fmt.Errorf("attestation larger than %v bytes", maxAttestationSize)
+		}
+	}
+	if len(archive.Checksum.Sum) > 0 {
+		sum := sha256.Sum256(contents)
+		if archive.Checksum.Type != fission.ChecksumTypeSHA256 || hex.EncodeToString(sum[:]) != archive.Checksum.Sum {
+			return nil, fission.MakeError(fission.ErrorChecksumFail, "attestation checksum validation failed")
+		}
+	}
+	return contents, nil
+}
+
+// checkAttestation fails unless a package has an attestation that
+// covers its source archive.
+func checkAttestation(pkg *tpr.Package) error {
+	if pkg.Spec.Attestation == nil {
+		return errors.New("package has no attestation")
+	}
+	contents, err := readAttestation(pkg.Spec.Attestation)
+	if err != nil {
+		return err
+	}
+	statement, err := fission.ParseAttestation(contents)
+	if err != nil {
+		return err
+	}
+	sum, ok := fission.ArchiveSHA256(&pkg.Spec.Source)
+	if !ok {
+		return errors.New("source archive has no SHA256 checksum")
+	}
+	if !statement.Covers(sum) {
+		return fmt.Errorf("attestation doesn't cover source archive %v", sum)
+	}
+	return nil
+}
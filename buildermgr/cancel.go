@@ -0,0 +1,189 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildermgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/tpr"
+)
+
+type (
+	// buildRegistry tracks the builds in progress, so that they
+	// can be canceled.
+	buildRegistry struct {
+		sync.Mutex
+		cancels map[string]context.CancelFunc
+
+		// statusLocks serialize the status updates of builds
+		// with those of cancels, by buildKey.
+		statusLocks map[string]*statusLock
+	}
+
+	statusLock struct {
+		sync.Mutex
+		refs int
+	}
+)
+
+func makeBuildRegistry() *buildRegistry {
+	return &buildRegistry{
+		cancels:     make(map[string]context.CancelFunc),
+		statusLocks: make(map[string]*statusLock),
+	}
+}
+
+func buildKey(m metav1.ObjectMeta) string {
+	return m.Namespace + "/" + m.Name
+}
+
+// start registers a build of a package. It returns the build's
+// context, done when the build is canceled, and a func to call once
+// the build is over.
+func (b *buildRegistry) start(m metav1.ObjectMeta) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	key := buildKey(m)
+	b.Lock()
+	b.cancels[key] = cancel
+	b.Unlock()
+	return ctx, func() {
+		b.Lock()
+		delete(b.cancels, key)
+		b.Unlock()
+		cancel()
+	}
+}
+
+// lockStatus locks the status of a package's build, returning a func
+// to unlock it. The build holds it while it reads and sets the status
+// as it starts and finishes, and a cancel while it sets the package
+// canceled, so a build that finishes as it's canceled either succeeds
+// before the cancel or sees it, and isn't marked both.
+func (b *buildRegistry) lockStatus(m metav1.ObjectMeta) func() {
+	key := buildKey(m)
+	b.Lock()
+	l, ok := b.statusLocks[key]
+	if !ok {
+		l = &statusLock{}
+		b.statusLocks[key] = l
+	}
+	l.refs++
+	b.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		b.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(b.statusLocks, key)
+		}
+		b.Unlock()
+	}
+}
+
+// cancel stops the build of a package. It returns false if there's no
+// build of it in progress.
+func (b *buildRegistry) cancel(m metav1.ObjectMeta) bool {
+	b.Lock()
+	defer b.Unlock()
+	cancel, ok := b.cancels[buildKey(m)]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// buildCanceled marks the package of a canceled build as such, and
+// returns buildPackage's result for it: the build did as asked, so
+// it's no error.
+func buildCanceled(fissionClient *tpr.FissionClient, pkg *tpr.Package) (string, error) {
+	e := fmt.Sprintf("Build of package %v was canceled", pkg.Metadata.Name)
+	log.Println(e)
+	updatePackage(fissionClient, pkg, fission.BuildStatusCanceled, e, nil)
+	return e, nil
+}
+
+// cancelBuild stops the build of the package given in the request
+// body, killing the build command if it's running, and sets its
+// status to canceled. Packages whose build has finished are left as
+// they are.
+func (builderMgr *BuilderMgr) cancelBuild(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		e := fmt.Sprintf("Failed to read request: %v", err)
+		log.Println(e)
+		http.Error(w, e, 500)
+		return
+	}
+
+	buildReq := BuildRequest{}
+	err = json.Unmarshal([]byte(body), &buildReq)
+	if err != nil {
+		e := fmt.Sprintf("invalid request body: %v", err)
+		log.Println(e)
+		http.Error(w, e, 400)
+		return
+	}
+
+	unlock := builderMgr.builds.lockStatus(buildReq.Package)
+	defer unlock()
+	pkg, err := builderMgr.fissionClient.Packages(buildReq.Package.Namespace).Get(buildReq.Package.Name)
+	if err != nil {
+		e := fmt.Sprintf("Error getting package TPR info: %v", err)
+		log.Println(e)
+		http.Error(w, e, 500)
+		return
+	}
+	status := pkg.Status.BuildStatus
+	if status != fission.BuildStatusPending && status != fission.BuildStatusRunning {
+		e := fmt.Sprintf("package %v isn't building, its build status is %v", pkg.Metadata.Name, status)
+		log.Println(e)
+		http.Error(w, e, 400)
+		return
+	}
+	if fission.PackageImmutable(pkg.Metadata.Annotations) {
+		code, e := fission.GetHTTPError(fission.ImmutablePackageError(pkg.Metadata.Name))
+		log.Println(e)
+		http.Error(w, e, code)
+		return
+	}
+
+	if builderMgr.builds.cancel(pkg.Metadata) {
+		log.Printf("Canceled build of package %v", pkg.Metadata.Name)
+	}
+	// pending builds may not have started yet; buildPackage
+	// doesn't build packages that aren't pending
+	_, err = updatePackage(builderMgr.fissionClient, pkg, fission.BuildStatusCanceled,
+		fmt.Sprintf("Build of package %v was canceled", pkg.Metadata.Name), nil)
+	if err != nil {
+		e := fmt.Sprintf("Error setting package canceled state: %v", err)
+		log.Println(e)
+		http.Error(w, e, 500)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
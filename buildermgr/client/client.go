@@ -51,6 +51,20 @@ func (c *Client) PackageBuild(req *buildermgr.BuildRequest) ([]byte, error) {
 	return c.handleResponse(resp)
 }
 
+// PackageCancelBuild stops the build of a package.
+func (c *Client) PackageCancelBuild(req *buildermgr.BuildRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(c.url+"/build/cancel", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_, err = c.handleResponse(resp)
+	return err
+}
+
 func (c *Client) handleResponse(resp *http.Response) ([]byte, error) {
 	if resp.StatusCode != 200 {
 		return nil, fission.MakeErrorFromHTTP(resp)
@@ -21,6 +21,7 @@ import (
 	"log"
 	"strings"
 
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
@@ -43,8 +44,9 @@ import (
 // 6. Update package status to succeed state
 // 7. Update package resource in package ref of functions that share the same package
 // *. Update package status to failed state,if any one of steps above failed
+// *. Update package status to canceled state, if the build was canceled
 func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes.Clientset,
-	builderNamespace string, storageSvcUrl string, buildReq BuildRequest) (buildLogs string, err error) {
+	envw *environmentWatcher, builds *buildRegistry, builderNamespace string, storageSvcUrl string, buildReq BuildRequest) (buildLogs string, err error) {
 
 	pkg, err := fissionClient.Packages(
 		buildReq.Package.Namespace).Get(buildReq.Package.Name)
@@ -62,17 +64,55 @@ func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes
 		return e, fission.MakeError(400, e)
 	}
 
+	// register the build before it's running, so that a cancel
+	// in between stops it
+	ctx, done := builds.start(pkg.Metadata)
+	defer done()
+
+	// a cancel before the build was registered has set the
+	// package canceled, so it's read again, with cancels locked
+	unlock := builds.lockStatus(pkg.Metadata)
+	current, err := fissionClient.Packages(pkg.Metadata.Namespace).Get(pkg.Metadata.Name)
+	if err != nil {
+		unlock()
+		e := fmt.Sprintf("Error getting function TPR info: %v", err)
+		log.Println(e)
+		return e, fission.MakeError(500, e)
+	}
+	if current.Status.BuildStatus != fission.BuildStatusPending {
+		unlock()
+		e := "package is not in pending state"
+		log.Println(e)
+		return e, fission.MakeError(400, e)
+	}
+	// its build status can't change, so it's left pending
+	if fission.PackageImmutable(current.Metadata.Annotations) {
+		unlock()
+		err = fission.ImmutablePackageError(current.Metadata.Name)
+		log.Println(err)
+		return err.Error(), err
+	}
+	pkg = current
+
 	// update package status to running state, so that
 	// we can know what status a package is through cli.
 	_, err = updatePackage(fissionClient, pkg, fission.BuildStatusRunning, "", nil)
+	unlock()
 	if err != nil {
 		e := fmt.Sprintf("Error setting package pending state: %v", err)
 		log.Println(e)
 		updatePackage(fissionClient, pkg, fission.BuildStatusFailed, e, nil)
 		return e, fission.MakeError(500, e)
 	}
+	if ctx.Err() != nil {
+		return buildCanceled(fissionClient, pkg)
+	}
 
-	env, err := fissionClient.Environments(metav1.NamespaceDefault).Get(pkg.Spec.Environment.Name)
+	envNamespace := pkg.Spec.Environment.Namespace
+	if len(envNamespace) == 0 {
+		envNamespace = metav1.NamespaceDefault
+	}
+	env, err := fissionClient.Environments(envNamespace).Get(pkg.Spec.Environment.Name)
 	if err != nil {
 		e := fmt.Sprintf("Error getting environment TPR info: %v", err)
 		log.Println(e)
@@ -80,7 +120,25 @@ func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes
 		return e, fission.MakeError(500, e)
 	}
 
-	svcName := fmt.Sprintf("%v-%v.%v", env.Metadata.Name, env.Metadata.ResourceVersion, builderNamespace)
+	if requireAttestation() {
+		err = checkAttestation(pkg)
+		if err != nil {
+			e := fmt.Sprintf("Error checking attestation: %v", err)
+			log.Println(e)
+			updatePackage(fissionClient, pkg, fission.BuildStatusFailed, e, nil)
+			return e, fission.MakeError(400, e)
+		}
+	}
+
+	builderName, err := envw.getPackageBuilder(env, pkg)
+	if err != nil {
+		e := fmt.Sprintf("Error getting builder %v: %v", pkg.Spec.BuilderImage, err)
+		log.Println(e)
+		updatePackage(fissionClient, pkg, fission.BuildStatusFailed, e, nil)
+		return e, fission.MakeError(500, e)
+	}
+
+	svcName := fmt.Sprintf("%v.%v", builderName, builderNamespace)
 	srcPkgFilename := fmt.Sprintf("%v-%v", pkg.Metadata.Name, strings.ToLower(uniuri.NewLen(6)))
 	fetcherC := fetcherClient.MakeClient(fmt.Sprintf("http://%v:8000", svcName))
 	builderC := builderClient.MakeClient(fmt.Sprintf("http://%v:8001", svcName))
@@ -93,6 +151,9 @@ func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes
 
 	// send fetch request to fetcher
 	err = fetcherC.Fetch(fetchReq)
+	if ctx.Err() != nil {
+		return buildCanceled(fissionClient, pkg)
+	}
 	if err != nil {
 		e := fmt.Sprintf("Error fetching source package: %v", err)
 		log.Println(e)
@@ -100,18 +161,54 @@ func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes
 		return e, fission.MakeError(500, e)
 	}
 
+	buildEnv, err := resolveBuildEnv(kubernetesClient, pkg)
+	if err != nil {
+		e := fmt.Sprintf("Error resolving build environment variables: %v", err)
+		log.Println(e)
+		updatePackage(fissionClient, pkg, fission.BuildStatusFailed, e, nil)
+		return e, fission.MakeError(500, e)
+	}
+	mounts, err := resolveBuildMounts(kubernetesClient, pkg)
+	if err != nil {
+		e := fmt.Sprintf("Error reading build secrets and configmaps: %v", err)
+		log.Println(e)
+		updatePackage(fissionClient, pkg, fission.BuildStatusFailed, e, nil)
+		return e, fission.MakeError(500, e)
+	}
+
+	var hints []string
+	for _, h := range pkg.Spec.Source.Hints {
+		hints = append(hints, string(h))
+	}
 	pkgBuildReq := &builder.PackageBuildRequest{
 		SrcPkgFilename: srcPkgFilename,
 		BuildCommand:   pkg.Spec.BuildCommand,
+		Env:            buildEnv,
+		Hints:          hints,
+		Mounts:         mounts,
+		RequestId:      pkg.Metadata.Annotations[fission.PackageRequestIdAnnotation],
+
+		PreBuildCommands:  pkg.Spec.PreBuildCommands,
+		PostBuildCommands: pkg.Spec.PostBuildCommands,
 	}
 
-	log.Printf("Start building with source package: %v", srcPkgFilename)
+	log.Printf("Start building with source package: %v (request %v)", srcPkgFilename, pkgBuildReq.RequestId)
 	// send build request to builder
-	buildResp, err := builderC.Build(pkgBuildReq)
+	stopProgress := watchBuildProgress(ctx, fissionClient, builderC, pkg, srcPkgFilename)
+	buildResp, err := builderC.Build(ctx, pkgBuildReq)
+	stopProgress()
+	if ctx.Err() != nil {
+		return buildCanceled(fissionClient, pkg)
+	}
 	if err != nil {
 		e := fmt.Sprintf("Error building deployment package: %v", err)
 		log.Println(e)
-		updatePackage(fissionClient, pkg, fission.BuildStatusFailed, e, nil)
+		status := fission.PackageStatus{BuildStatus: fission.BuildStatusFailed, BuildLog: e}
+		if buildResp != nil {
+			// a hook failed, its logs are kept
+			status.HookLogs = buildResp.HookLogs
+		}
+		updatePackageStatus(fissionClient, pkg, status, nil)
 		return e, fission.MakeError(500, e)
 	}
 
@@ -125,6 +222,9 @@ func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes
 	log.Printf("Start uploading deployment package: %v", buildResp.ArtifactFilename)
 	// ask fetcher to upload the deployment package
 	uploadResp, err := fetcherC.Upload(uploadReq)
+	if ctx.Err() != nil {
+		return buildCanceled(fissionClient, pkg)
+	}
 	if err != nil {
 		e := fmt.Sprintf("Error uploading deployment package: %v", err)
 		log.Println(e)
@@ -133,9 +233,20 @@ func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes
 	}
 
 	log.Printf("Start updating info of package: %v", pkg.Metadata.Name)
-	// update package status and also build logs
-	newPkgRV, err := updatePackage(fissionClient, pkg,
-		fission.BuildStatusSucceeded, buildResp.BuildLogs, uploadResp)
+	// a cancel from now on waits for the status, and finds the
+	// build over
+	unlock = builds.lockStatus(pkg.Metadata)
+	if ctx.Err() != nil {
+		unlock()
+		return buildCanceled(fissionClient, pkg)
+	}
+	// update package status and also build and hook logs
+	newPkgRV, err := updatePackageStatus(fissionClient, pkg, fission.PackageStatus{
+		BuildStatus: fission.BuildStatusSucceeded,
+		BuildLog:    buildResp.BuildLogs,
+		HookLogs:    buildResp.HookLogs,
+	}, uploadResp)
+	unlock()
 	if err != nil {
 		e := fmt.Sprintf("Error creating deployment package TPR resource: %v", err)
 		log.Println(e)
@@ -144,7 +255,7 @@ func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes
 	}
 
 	fnList, err := fissionClient.
-		Functions(metav1.NamespaceDefault).List(metav1.ListOptions{})
+		Functions(pkg.Metadata.Namespace).List(metav1.ListOptions{})
 	if err != nil {
 		e := fmt.Sprintf("Error getting function list: %v", err)
 		log.Println(e)
@@ -175,37 +286,117 @@ func buildPackage(fissionClient *tpr.FissionClient, kubernetesClient *kubernetes
 	return buildResp.BuildLogs, nil
 }
 
+// resolveBuildEnv returns a package's build environment variables as
+// KEY=value strings, reading secret references from the package's
+// namespace.
+func resolveBuildEnv(kubernetesClient *kubernetes.Clientset, pkg *tpr.Package) ([]string, error) {
+	var env []string
+	for _, v := range pkg.Spec.BuildEnv {
+		if v.SecretRef == nil {
+			env = append(env, fmt.Sprintf("%v=%v", v.Name, v.Value))
+			continue
+		}
+		secret, err := kubernetesClient.CoreV1().Secrets(pkg.Metadata.Namespace).Get(v.SecretRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("get secret %v for %v: %v", v.SecretRef.Name, v.Name, err)
+		}
+		value, ok := secret.Data[v.SecretRef.Key]
+		if !ok {
+			return nil, fmt.Errorf("secret %v has no key %v, needed for %v", v.SecretRef.Name, v.SecretRef.Key, v.Name)
+		}
+		env = append(env, fmt.Sprintf("%v=%v", v.Name, string(value)))
+	}
+	return env, nil
+}
+
+// resolveBuildMounts reads the secrets and configmaps a package's build
+// mounts from the package's namespace.
+func resolveBuildMounts(kubernetesClient *kubernetes.Clientset, pkg *tpr.Package) ([]builder.BuildMount, error) {
+	var mounts []builder.BuildMount
+	for _, name := range pkg.Spec.BuildSecrets {
+		secret, err := kubernetesClient.CoreV1().Secrets(pkg.Metadata.Namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("get secret %v: %v", name, err)
+		}
+		mounts = append(mounts, builder.BuildMount{Kind: builder.BuildMountSecret, Name: name, Files: secret.Data})
+	}
+	for _, name := range pkg.Spec.BuildConfigMaps {
+		configMap, err := kubernetesClient.CoreV1().ConfigMaps(pkg.Metadata.Namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("get configmap %v: %v", name, err)
+		}
+		files := make(map[string][]byte, len(configMap.Data))
+		for k, v := range configMap.Data {
+			files[k] = []byte(v)
+		}
+		mounts = append(mounts, builder.BuildMount{Kind: builder.BuildMountConfigMap, Name: name, Files: files})
+	}
+	return mounts, nil
+}
+
 func updatePackage(fissionClient *tpr.FissionClient,
 	pkg *tpr.Package, status fission.BuildStatus, buildLogs string,
 	uploadResp *fetcher.UploadResponse) (string, error) {
-
-	// Kubernetes checks resource version before applying
-	// new resource config. The update operation will be
-	// rejected if the resource version in metadata is lower
-	// than the latest version. Set resource version empty
-	// string to skip resource version check.
-	pkg.Metadata.ResourceVersion = ""
-
-	pkg.Status = fission.PackageStatus{
+	return updatePackageStatus(fissionClient, pkg, fission.PackageStatus{
 		BuildStatus: status,
 		BuildLog:    buildLogs,
-	}
+	}, uploadResp)
+}
 
-	if uploadResp != nil {
-		pkg.Spec.Deployment = fission.Archive{
-			Type:     fission.ArchiveTypeUrl,
-			URL:      uploadResp.ArchiveDownloadUrl,
-			Checksum: uploadResp.Checksum,
-		}
-	}
+// updatePackageStatus sets a package's status, and its built
+// deployment archive if one was uploaded, in the package as it's
+// stored, so that changes made since pkg was read aren't undone. pkg
+// is set to the package written.
+func updatePackageStatus(fissionClient *tpr.FissionClient,
+	pkg *tpr.Package, status fission.PackageStatus,
+	uploadResp *fetcher.UploadResponse) (string, error) {
 
-	// update package spec
-	pkg, err := fissionClient.Packages(metav1.NamespaceDefault).Update(pkg)
+	updated, err := modifyPackage(fissionClient, pkg.Metadata.Namespace, pkg.Metadata.Name, func(p *tpr.Package) bool {
+		p.Status = status
+		if uploadResp != nil {
+			built := fission.Archive{
+				Type:     fission.ArchiveTypeUrl,
+				URL:      uploadResp.ArchiveDownloadUrl,
+				Checksum: uploadResp.Checksum,
+			}
+			// only the default policy overwrites a given deployment
+			if p.Spec.DeploymentPolicy == fission.DeploymentPolicyOverwrite {
+				p.Spec.Deployment = built
+			} else {
+				p.Spec.BuiltDeployment = &built
+			}
+		}
+		return true
+	})
 	if err != nil {
 		log.Printf("Error updating package: %v", err)
 		return "", err
 	}
+	*pkg = *updated
 
 	// return resource version for function to update function package ref
-	return pkg.Metadata.ResourceVersion, nil
+	return updated.Metadata.ResourceVersion, nil
+}
+
+// modifyPackage reads a package, changes it with modify, and writes
+// it at the resource version it was read at, starting over up to
+// tpr.PackageApplyRetries times if another writer got in first. If
+// modify returns false nothing is written, and the package read is
+// returned.
+func modifyPackage(fissionClient *tpr.FissionClient, namespace string, name string, modify func(pkg *tpr.Package) bool) (*tpr.Package, error) {
+	pkgs := fissionClient.Packages(namespace)
+	for attempt := 0; ; attempt++ {
+		pkg, err := pkgs.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if !modify(pkg) {
+			return pkg, nil
+		}
+		updated, err := pkgs.Update(pkg)
+		if err != nil && kerrors.IsConflict(err) && attempt < tpr.PackageApplyRetries {
+			continue
+		}
+		return updated, err
+	}
 }
@@ -17,6 +17,8 @@ limitations under the License.
 package buildermgr
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
@@ -30,6 +32,7 @@ import (
 	apiv1 "k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 
+	"github.com/fission/fission"
 	"github.com/fission/fission/tpr"
 )
 
@@ -41,6 +44,22 @@ const (
 
 	LABEL_ENV_NAME            = "envName"
 	LABEL_ENV_RESOURCEVERSION = "envResourceVersion"
+
+	// Builders running a package's builder image instead of the
+	// environment's are labeled with these instead, so that the
+	// environment's builder service doesn't select their pods.
+	LABEL_OVERRIDE_ENV_NAME            = "overrideEnvName"
+	LABEL_OVERRIDE_ENV_RESOURCEVERSION = "overrideEnvResourceVersion"
+	LABEL_BUILDER_IMAGE                = "builderImage"
+
+	// builderStartTimeout is how long a build waits for a builder
+	// created for a package's builder image to become available.
+	builderStartTimeout = 5 * time.Minute
+
+	// builderCollectInterval is how often builders for packages'
+	// builder images are looked at, to remove those no build needs
+	// any more.
+	builderCollectInterval = 10 * time.Minute
 )
 
 type (
@@ -55,6 +74,14 @@ type (
 		env      *tpr.Environment
 		envList  []tpr.Environment
 		respChan chan envwResponse
+
+		// imageBuilders are the names of the builders for builder
+		// images that packages still need, for cleanup.
+		imageBuilders map[string]bool
+
+		// builderImage overrides the environment's builder
+		// image, if set.
+		builderImage string
 	}
 
 	envwResponse struct {
@@ -70,11 +97,12 @@ type (
 		kubernetesClient       *kubernetes.Clientset
 		fetcherImage           string
 		fetcherImagePullPolicy apiv1.PullPolicy
+		storageSvcUrl          string
 	}
 )
 
 func makeEnvironmentWatcher(fissionClient *tpr.FissionClient,
-	kubernetesClient *kubernetes.Clientset, builderNamespace string) *environmentWatcher {
+	kubernetesClient *kubernetes.Clientset, builderNamespace string, storageSvcUrl string) *environmentWatcher {
 
 	fetcherImage := os.Getenv("FETCHER_IMAGE")
 	if len(fetcherImage) == 0 {
@@ -104,6 +132,7 @@ func makeEnvironmentWatcher(fissionClient *tpr.FissionClient,
 		kubernetesClient:       kubernetesClient,
 		fetcherImage:           fetcherImage,
 		fetcherImagePullPolicy: pullPolicy,
+		storageSvcUrl:          storageSvcUrl,
 	}
 
 	go envWatcher.service()
@@ -122,7 +151,53 @@ func (envw *environmentWatcher) getLabels(envName string, envResourceVersion str
 	}
 }
 
+// getBuilderKey returns the cache key and the name of the service and
+// deployment of an environment's builder, or of a builder running
+// builderImage for the environment if builderImage is set.
+func (envw *environmentWatcher) getBuilderKey(env *tpr.Environment, builderImage string) string {
+	key := envw.getCacheKey(env.Metadata.Name, env.Metadata.ResourceVersion)
+	if len(builderImage) > 0 {
+		key = fmt.Sprintf("%v-%v", key, builderImageHash(builderImage))
+	}
+	return key
+}
+
+// getBuilderLabels returns the labels of the builder that
+// getBuilderKey names.
+func (envw *environmentWatcher) getBuilderLabels(env *tpr.Environment, builderImage string) map[string]string {
+	if len(builderImage) == 0 {
+		return envw.getLabels(env.Metadata.Name, env.Metadata.ResourceVersion)
+	}
+	return map[string]string{
+		LABEL_OVERRIDE_ENV_NAME:            env.Metadata.Name,
+		LABEL_OVERRIDE_ENV_RESOURCEVERSION: env.Metadata.ResourceVersion,
+		LABEL_BUILDER_IMAGE:                builderImageHash(builderImage),
+	}
+}
+
+// getEnvKeyFromLabels returns the cache key of the environment a
+// builder service or deployment belongs to.
+func (envw *environmentWatcher) getEnvKeyFromLabels(labels map[string]string) string {
+	if _, ok := labels[LABEL_BUILDER_IMAGE]; ok {
+		return envw.getCacheKey(labels[LABEL_OVERRIDE_ENV_NAME], labels[LABEL_OVERRIDE_ENV_RESOURCEVERSION])
+	}
+	return envw.getCacheKey(labels[LABEL_ENV_NAME], labels[LABEL_ENV_RESOURCEVERSION])
+}
+
+// builderImageHash shortens an image reference to something usable in
+// labels and resource names.
+func builderImageHash(builderImage string) string {
+	sum := sha256.Sum256([]byte(builderImage))
+	return hex.EncodeToString(sum[:])[:10]
+}
+
 func (envw *environmentWatcher) watchEnvironments() {
+	go func() {
+		for range time.Tick(builderCollectInterval) {
+			envw.sync()
+		}
+	}()
+
 	rv := ""
 	for {
 		wi, err := envw.fissionClient.Environments(metav1.NamespaceAll).Watch(metav1.ListOptions{
@@ -165,12 +240,48 @@ func (envw *environmentWatcher) sync() {
 			len(env.Spec.Builder.Image) == 0 { // ignore env without builder image
 			continue
 		}
-		_, err := envw.getEnvBuilder(&env)
+		_, err := envw.getEnvBuilder(&env, "")
 		if err != nil {
 			log.Printf("Error creating builder for %v: %v", env.Metadata.Name, err)
 		}
 	}
-	envw.cleanupEnvBuilders(envList.Items)
+	imageBuilders, err := envw.imageBuildersInUse(envList.Items)
+	if err != nil {
+		// keep all builders rather than remove those in use
+		log.Printf("Error listing packages for builder cleanup: %v", err)
+		return
+	}
+	envw.cleanupEnvBuilders(envList.Items, imageBuilders)
+}
+
+// imageBuildersInUse returns the names of the builders for packages'
+// builder images that packages waiting for or in a build need. The
+// others are removed when builders are cleaned up; a later build with
+// the same image creates its builder again.
+func (envw *environmentWatcher) imageBuildersInUse(envs []tpr.Environment) (map[string]bool, error) {
+	pkgList, err := envw.fissionClient.Packages(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	for i := range pkgList.Items {
+		pkg := &pkgList.Items[i]
+		if len(pkg.Spec.BuilderImage) == 0 ||
+			(pkg.Status.BuildStatus != fission.BuildStatusPending && pkg.Status.BuildStatus != fission.BuildStatusRunning) {
+			continue
+		}
+		envNamespace := pkg.Spec.Environment.Namespace
+		if len(envNamespace) == 0 {
+			envNamespace = metav1.NamespaceDefault
+		}
+		for j := range envs {
+			env := &envs[j]
+			if env.Metadata.Name == pkg.Spec.Environment.Name && env.Metadata.Namespace == envNamespace {
+				inUse[envw.getBuilderKey(env, pkg.Spec.BuilderImage)] = true
+			}
+		}
+	}
+	return inUse, nil
 }
 
 func (envw *environmentWatcher) service() {
@@ -178,10 +289,10 @@ func (envw *environmentWatcher) service() {
 		req := <-envw.requestChan
 		switch req.requestType {
 		case GET_BUILDER:
-			key := envw.getCacheKey(req.env.Metadata.Name, req.env.Metadata.ResourceVersion)
+			key := envw.getBuilderKey(req.env, req.builderImage)
 			builderInfo, ok := envw.cache[key]
 			if !ok {
-				builderInfo, err := envw.createBuilder(req.env)
+				builderInfo, err := envw.createBuilder(req.env, req.builderImage)
 				if err != nil {
 					req.respChan <- envwResponse{err: err}
 					continue
@@ -203,16 +314,16 @@ func (envw *environmentWatcher) service() {
 			// control (an orphan builder) since there is no record in
 			// cache and TPR. We need to iterate over the services &
 			// deployments to remove both normal and orphan builders.
+			// Builders for packages' builder images go with their
+			// environment's builder, or once no package needs them.
 
 			svcList, err := envw.getBuilderServiceList(nil)
 			if err != nil {
 				log.Println(err.Error())
 			}
 			for _, svc := range svcList {
-				envName := svc.ObjectMeta.Labels[LABEL_ENV_NAME]
-				envResourceVersion := svc.ObjectMeta.Labels[LABEL_ENV_RESOURCEVERSION]
-				key := envw.getCacheKey(envName, envResourceVersion)
-				if _, ok := latestEnvList[key]; !ok {
+				key := envw.getEnvKeyFromLabels(svc.ObjectMeta.Labels)
+				if _, ok := latestEnvList[key]; !ok || envw.isUnusedImageBuilder(svc.ObjectMeta, req.imageBuilders) {
 					err := envw.deleteBuilderService(svc.ObjectMeta.Labels)
 					if err != nil {
 						log.Printf("Error removing builder service: %v", err)
@@ -226,10 +337,8 @@ func (envw *environmentWatcher) service() {
 				log.Printf(err.Error())
 			}
 			for _, deploy := range deployList {
-				envName := deploy.ObjectMeta.Labels[LABEL_ENV_NAME]
-				envResourceVersion := deploy.ObjectMeta.Labels[LABEL_ENV_RESOURCEVERSION]
-				key := envw.getCacheKey(envName, envResourceVersion)
-				if _, ok := latestEnvList[key]; !ok {
+				key := envw.getEnvKeyFromLabels(deploy.ObjectMeta.Labels)
+				if _, ok := latestEnvList[key]; !ok || envw.isUnusedImageBuilder(deploy.ObjectMeta, req.imageBuilders) {
 					err := envw.deleteBuilderDeployment(deploy.ObjectMeta.Labels)
 					if err != nil {
 						log.Printf("Error removing builder deployment: %v", err)
@@ -241,36 +350,93 @@ func (envw *environmentWatcher) service() {
 	}
 }
 
-func (envw *environmentWatcher) getEnvBuilder(env *tpr.Environment) (*builderInfo, error) {
+func (envw *environmentWatcher) getEnvBuilder(env *tpr.Environment, builderImage string) (*builderInfo, error) {
 	respChan := make(chan envwResponse)
 	envw.requestChan <- envwRequest{
-		requestType: GET_BUILDER,
-		env:         env,
-		respChan:    respChan,
+		requestType:  GET_BUILDER,
+		env:          env,
+		builderImage: builderImage,
+		respChan:     respChan,
 	}
 	resp := <-respChan
 	return resp.builderInfo, resp.err
 }
 
-func (envw *environmentWatcher) cleanupEnvBuilders(envs []tpr.Environment) {
+// getPackageBuilder returns the name of the builder service to build
+// a package with. That's the environment's builder, unless the
+// package sets a builder image; then it's a builder running that
+// image, which is created if needed and waited for.
+func (envw *environmentWatcher) getPackageBuilder(env *tpr.Environment, pkg *tpr.Package) (string, error) {
+	builderImage := pkg.Spec.BuilderImage
+	if len(builderImage) == 0 || builderImage == env.Spec.Builder.Image {
+		return envw.getBuilderKey(env, ""), nil
+	}
+	_, err := envw.getEnvBuilder(env, builderImage)
+	if err != nil {
+		return "", err
+	}
+	name := envw.getBuilderKey(env, builderImage)
+	err = envw.waitForBuilderDeployment(name, builderStartTimeout)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// waitForBuilderDeployment waits until a builder deployment has an
+// available pod.
+func (envw *environmentWatcher) waitForBuilderDeployment(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		deploy, err := envw.kubernetesClient.ExtensionsV1beta1().
+			Deployments(envw.builderNamespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("Error getting builder deployment: %v", err)
+		}
+		if deploy.Status.AvailableReplicas > 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Builder deployment %v isn't available after %v", name, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (envw *environmentWatcher) cleanupEnvBuilders(envs []tpr.Environment, imageBuilders map[string]bool) {
 	envw.requestChan <- envwRequest{
-		requestType: CLEANUP_BUILDERS,
-		envList:     envs,
+		requestType:   CLEANUP_BUILDERS,
+		envList:       envs,
+		imageBuilders: imageBuilders,
 	}
 }
 
-func (envw *environmentWatcher) createBuilder(env *tpr.Environment) (*builderInfo, error) {
+// isUnusedImageBuilder returns true if a builder service or deployment
+// runs a package's builder image that no package needs any more. New
+// builders are kept, as their package may have become pending after
+// the packages were listed.
+func (envw *environmentWatcher) isUnusedImageBuilder(meta metav1.ObjectMeta, imageBuilders map[string]bool) bool {
+	if _, ok := meta.Labels[LABEL_BUILDER_IMAGE]; !ok {
+		return false
+	}
+	if time.Since(meta.CreationTimestamp.Time) < builderCollectInterval {
+		return false
+	}
+	return !imageBuilders[meta.Name]
+}
+
+func (envw *environmentWatcher) createBuilder(env *tpr.Environment, builderImage string) (*builderInfo, error) {
 	var svc *apiv1.Service
 	var deploy *v1beta1.Deployment
 
-	sel := envw.getLabels(env.Metadata.Name, env.Metadata.ResourceVersion)
+	sel := envw.getBuilderLabels(env, builderImage)
 
 	svcList, err := envw.getBuilderServiceList(sel)
 	if err != nil {
 		return nil, err
 	}
 	if len(svcList) == 0 {
-		svc, err = envw.createBuilderService(env)
+		svc, err = envw.createBuilderService(env, builderImage)
 		if err != nil {
 			return nil, fmt.Errorf("Error creating builder service: %v", err)
 		}
@@ -281,7 +447,7 @@ func (envw *environmentWatcher) createBuilder(env *tpr.Environment) (*builderInf
 		return nil, err
 	}
 	if len(deployList) == 0 {
-		deploy, err = envw.createBuilderDeployment(env)
+		deploy, err = envw.createBuilderDeployment(env, builderImage)
 		if err != nil {
 			return nil, fmt.Errorf("Error creating builder deployment: %v", err)
 		}
@@ -353,9 +519,9 @@ func (envw *environmentWatcher) getBuilderServiceList(sel map[string]string) ([]
 	return svcList.Items, nil
 }
 
-func (envw *environmentWatcher) createBuilderService(env *tpr.Environment) (*apiv1.Service, error) {
-	name := envw.getCacheKey(env.Metadata.Name, env.Metadata.ResourceVersion)
-	sel := envw.getLabels(env.Metadata.Name, env.Metadata.ResourceVersion)
+func (envw *environmentWatcher) createBuilderService(env *tpr.Environment, builderImage string) (*apiv1.Service, error) {
+	name := envw.getBuilderKey(env, builderImage)
+	sel := envw.getBuilderLabels(env, builderImage)
 	service := apiv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: envw.builderNamespace,
@@ -406,10 +572,14 @@ func (envw *environmentWatcher) getBuilderDeploymentList(sel map[string]string)
 	return deployList.Items, nil
 }
 
-func (envw *environmentWatcher) createBuilderDeployment(env *tpr.Environment) (*v1beta1.Deployment, error) {
+func (envw *environmentWatcher) createBuilderDeployment(env *tpr.Environment, builderImage string) (*v1beta1.Deployment, error) {
 	sharedMountPath := "/package"
-	name := envw.getCacheKey(env.Metadata.Name, env.Metadata.ResourceVersion)
-	sel := envw.getLabels(env.Metadata.Name, env.Metadata.ResourceVersion)
+	name := envw.getBuilderKey(env, builderImage)
+	sel := envw.getBuilderLabels(env, builderImage)
+	image := env.Spec.Builder.Image
+	if len(builderImage) > 0 {
+		image = builderImage
+	}
 	var replicas int32 = 1
 	deployment := &v1beta1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -438,7 +608,7 @@ func (envw *environmentWatcher) createBuilderDeployment(env *tpr.Environment) (*
 					Containers: []apiv1.Container{
 						{
 							Name:                   "builder",
-							Image:                  env.Spec.Builder.Image,
+							Image:                  image,
 							ImagePullPolicy:        apiv1.PullAlways,
 							TerminationMessagePath: "/dev/termination-log",
 							VolumeMounts: []apiv1.VolumeMount{
@@ -461,6 +631,10 @@ func (envw *environmentWatcher) createBuilderDeployment(env *tpr.Environment) (*
 								},
 							},
 							Command: []string{"/fetcher", sharedMountPath},
+							// keep warm archives cached
+							Env: []apiv1.EnvVar{
+								{Name: "STORAGESVC_URL", Value: envw.storageSvcUrl},
+							},
 						},
 					},
 					ServiceAccountName: "fission-builder",
@@ -468,7 +642,7 @@ func (envw *environmentWatcher) createBuilderDeployment(env *tpr.Environment) (*
 			},
 		},
 	}
-	log.Printf("Creating builder deployment: %v", envw.getCacheKey(env.Metadata.Name, env.Metadata.ResourceVersion))
+	log.Printf("Creating builder deployment: %v (image %v)", name, image)
 	_, err := envw.kubernetesClient.ExtensionsV1beta1().Deployments(envw.builderNamespace).Create(deployment)
 	if err != nil {
 		return nil, err
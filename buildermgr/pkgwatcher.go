@@ -32,16 +32,21 @@ type (
 	packageWatcher struct {
 		fissionClient    *tpr.FissionClient
 		kubernetesClient *kubernetes.Clientset
+		envWatcher       *environmentWatcher
+		builds           *buildRegistry
 		builderNamespace string
 		storageSvcUrl    string
 	}
 )
 
 func makePackageWatcher(fissionClient *tpr.FissionClient,
-	kubernetesClient *kubernetes.Clientset, builderNamespace string, storageSvcUrl string) *packageWatcher {
+	kubernetesClient *kubernetes.Clientset, envWatcher *environmentWatcher,
+	builds *buildRegistry, builderNamespace string, storageSvcUrl string) *packageWatcher {
 	pkgw := &packageWatcher{
 		fissionClient:    fissionClient,
 		kubernetesClient: kubernetesClient,
+		envWatcher:       envWatcher,
+		builds:           builds,
 		builderNamespace: builderNamespace,
 		storageSvcUrl:    storageSvcUrl,
 	}
@@ -53,7 +58,7 @@ func (pkgw *packageWatcher) build(pkgMetadata metav1.ObjectMeta) {
 		Package: pkgMetadata,
 	}
 	_, err := buildPackage(pkgw.fissionClient,
-		pkgw.kubernetesClient, pkgw.builderNamespace, pkgw.storageSvcUrl, buildReq)
+		pkgw.kubernetesClient, pkgw.envWatcher, pkgw.builds, pkgw.builderNamespace, pkgw.storageSvcUrl, buildReq)
 	if err != nil {
 		log.Printf("Error building package %v: %v", buildReq.Package.Name, err)
 	}
@@ -62,7 +67,7 @@ func (pkgw *packageWatcher) build(pkgMetadata metav1.ObjectMeta) {
 func (pkgw *packageWatcher) watchPackages() {
 	rv := ""
 	for {
-		wi, err := pkgw.fissionClient.Packages(metav1.NamespaceDefault).Watch(metav1.ListOptions{
+		wi, err := pkgw.fissionClient.Packages(metav1.NamespaceAll).Watch(metav1.ListOptions{
 			ResourceVersion: rv,
 		})
 		if err != nil {
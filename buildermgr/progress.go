@@ -0,0 +1,83 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildermgr
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/fission/fission"
+	builderClient "github.com/fission/fission/builder/client"
+	"github.com/fission/fission/tpr"
+)
+
+// buildProgressInterval is how often the progress of a running build
+// is read from its builder.
+const buildProgressInterval = 2 * time.Second
+
+// watchBuildProgress records the progress a builder reports for a
+// running build in the package's status whenever it changes, until
+// the returned function is called. That function waits for the last
+// update, so that it can't overwrite the build's outcome. Only the
+// progress of the package as it's stored is changed, and only while
+// it's running.
+func watchBuildProgress(ctx context.Context, fissionClient *tpr.FissionClient, builderC *builderClient.Client, pkg *tpr.Package, srcPkgFilename string) func() {
+	// the build updates pkg while it's watched
+	namespace, name := pkg.Metadata.Namespace, pkg.Metadata.Name
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(buildProgressInterval)
+		defer ticker.Stop()
+		var last fission.BuildProgress
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			progress, err := builderC.Progress(ctx, srcPkgFilename)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Error getting build progress of %v: %v", name, err)
+				}
+				continue
+			}
+			if progress == nil || *progress == last {
+				continue
+			}
+			last = *progress
+
+			_, err = modifyPackage(fissionClient, namespace, name, func(p *tpr.Package) bool {
+				if p.Status.BuildStatus != fission.BuildStatusRunning {
+					return false
+				}
+				p.Status.BuildProgress = progress
+				return true
+			})
+			if err != nil {
+				log.Printf("Error recording build progress of %v: %v", name, err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
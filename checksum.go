@@ -0,0 +1,109 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// ChecksumTypesByPreference lists the checksum types that can be
+// computed with NewChecksumHash, cheapest first.
+var ChecksumTypesByPreference = []ChecksumType{ChecksumTypeCRC32C, ChecksumTypeSHA256}
+
+// NewChecksumHash returns a hash computing checksums of type t.
+func NewChecksumHash(t ChecksumType) (hash.Hash, error) {
+	switch t {
+	case ChecksumTypeSHA256:
+		return sha256.New(), nil
+	case ChecksumTypeCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case ChecksumTypeSHA256Tree:
+		return NewTreeHash(), nil
+	}
+	return nil, MakeError(ErrorInvalidArgument, "Unsupported checksum type "+string(t))
+}
+
+// MakeChecksum returns a checksum of the given type for a raw digest,
+// such as the output of sha256.Sum256. The sum is stored hex encoded.
+func MakeChecksum(t ChecksumType, digest []byte) Checksum {
+	return Checksum{
+		Type: t,
+		Sum:  hex.EncodeToString(digest),
+	}
+}
+
+// ChecksumFromBase64 parses a base64 encoded digest, as used by S3's
+// x-amz-checksum-* headers, into a (hex encoded) checksum.
+func ChecksumFromBase64(t ChecksumType, sum string) (Checksum, error) {
+	digest, err := base64.StdEncoding.DecodeString(sum)
+	if err != nil {
+		return Checksum{}, MakeError(ErrorInvalidArgument, "Invalid base64 checksum: "+err.Error())
+	}
+	return MakeChecksum(t, digest), nil
+}
+
+// Digest returns the raw bytes of the checksum.
+func (c Checksum) Digest() ([]byte, error) {
+	digest, err := hex.DecodeString(c.Sum)
+	if err != nil {
+		return nil, MakeError(ErrorInvalidArgument, "Invalid hex checksum: "+err.Error())
+	}
+	return digest, nil
+}
+
+// HexSum returns the checksum hex encoded, normalized to lower case.
+func (c Checksum) HexSum() string {
+	return strings.ToLower(c.Sum)
+}
+
+// Base64Sum returns the checksum base64 encoded.
+func (c Checksum) Base64Sum() (string, error) {
+	digest, err := c.Digest()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(digest), nil
+}
+
+// Equal reports whether two checksums have the same type and
+// digest, regardless of the case of their hex encoding.
+func (c Checksum) Equal(other Checksum) bool {
+	return c.Type == other.Type && c.HexSum() == other.HexSum()
+}
+
+// VerifyLiteral checks an embedded archive's contents against its
+// checksum. Literals without a checksum, as stored before literals
+// were checksummed, pass.
+func VerifyLiteral(archive *Archive) error {
+	if len(archive.Checksum.Sum) == 0 {
+		return nil
+	}
+	h, err := NewChecksumHash(archive.Checksum.Type)
+	if err != nil {
+		return err
+	}
+	h.Write(archive.Literal)
+	if !MakeChecksum(archive.Checksum.Type, h.Sum(nil)).Equal(archive.Checksum) {
+		return MakeError(ErrorChecksumFail, "Literal archive checksum validation failed")
+	}
+	return nil
+}
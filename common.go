@@ -18,9 +18,126 @@ package fission
 
 import (
 	"fmt"
+	"reflect"
+	"regexp"
 )
 
+// maxBuildRefs bounds the secrets and configmaps a build may mount.
+const maxBuildRefs = 16
+
+// buildRefNameRegex matches the names of secrets and configmaps,
+// which are DNS subdomains.
+var buildRefNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
 func UrlForFunction(name string) string {
 	prefix := "/fission-function"
 	return fmt.Sprintf("%v/%v", prefix, name)
 }
+
+// DeploymentArchive returns the archive functions of a package run,
+// as its deployment policy decides: the deployment archive, or the
+// output of building the source.
+func (spec *PackageSpec) DeploymentArchive() *Archive {
+	switch spec.DeploymentPolicy {
+	case DeploymentPolicyPreferBuild:
+		if spec.BuiltDeployment != nil {
+			return spec.BuiltDeployment
+		}
+	case DeploymentPolicyPreferExplicit:
+		if len(spec.Deployment.Type) == 0 && spec.BuiltDeployment != nil {
+			return spec.BuiltDeployment
+		}
+	}
+	return &spec.Deployment
+}
+
+// PackageSpecContentEqual returns true if two package specs describe
+// the same package. Archives with checksums are compared by checksum,
+// since the same contents may be uploaded again under another URL, and
+// the deployment archive a build writes is left out, so that applying
+// an unchanged spec to a built package doesn't build it again.
+func PackageSpecContentEqual(a, b *PackageSpec) bool {
+	x, y := *a, *b
+	if !archiveContentEqual(&x.Source, &y.Source) ||
+		!archiveContentEqual(x.SBOM, y.SBOM) ||
+		!archiveContentEqual(x.Attestation, y.Attestation) {
+		return false
+	}
+	built := len(y.Source.Type) > 0 && y.DeploymentPolicy == DeploymentPolicyOverwrite
+	if !built && !archiveContentEqual(&x.Deployment, &y.Deployment) {
+		return false
+	}
+	x.Source, y.Source = Archive{}, Archive{}
+	x.Deployment, y.Deployment = Archive{}, Archive{}
+	x.SBOM, y.SBOM = nil, nil
+	x.Attestation, y.Attestation = nil, nil
+	x.BuiltDeployment, y.BuiltDeployment = nil, nil
+	return reflect.DeepEqual(x, y)
+}
+
+// archiveContentEqual returns true if two archives have the same
+// contents: the same checksum if both have one, or else the same
+// fields.
+func archiveContentEqual(a, b *Archive) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.Checksum.Sum) > 0 && len(b.Checksum.Sum) > 0 {
+		return a.Checksum.Equal(b.Checksum)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// ValidateDeploymentPolicy checks that policy is a known deployment
+// policy.
+func ValidateDeploymentPolicy(policy DeploymentPolicy) error {
+	switch policy {
+	case DeploymentPolicyOverwrite, DeploymentPolicyPreferBuild, DeploymentPolicyPreferExplicit:
+		return nil
+	}
+	return MakeError(ErrorInvalidArgument,
+		fmt.Sprintf("Unknown deployment policy '%v', use %v or %v", policy, DeploymentPolicyPreferBuild, DeploymentPolicyPreferExplicit))
+}
+
+// ValidateBuildRefs checks the secrets and configmaps a package's
+// build mounts: valid names, each given once, and not too many.
+func ValidateBuildRefs(spec *PackageSpec) error {
+	if len(spec.BuildSecrets)+len(spec.BuildConfigMaps) > maxBuildRefs {
+		return MakeError(ErrorInvalidArgument,
+			fmt.Sprintf("A build can mount at most %v secrets and configmaps", maxBuildRefs))
+	}
+	for _, refs := range []struct {
+		kind  string
+		names []string
+	}{
+		{"secret", spec.BuildSecrets},
+		{"configmap", spec.BuildConfigMaps},
+	} {
+		seen := make(map[string]bool)
+		for _, name := range refs.names {
+			if len(name) > 253 || !buildRefNameRegex.MatchString(name) {
+				return MakeError(ErrorInvalidArgument,
+					fmt.Sprintf("Invalid build %v name '%v'", refs.kind, name))
+			}
+			if seen[name] {
+				return MakeError(ErrorInvalidArgument,
+					fmt.Sprintf("Build %v %v given more than once", refs.kind, name))
+			}
+			seen[name] = true
+		}
+	}
+	return nil
+}
+
+// PackageImmutable returns true if a package's annotations mark it
+// immutable.
+func PackageImmutable(annotations map[string]string) bool {
+	return annotations[PackageImmutableAnnotation] == "true"
+}
+
+// ImmutablePackageError is the error for a change to an immutable
+// package.
+func ImmutablePackageError(name string) error {
+	return MakeError(ErrorInvalidArgument,
+		fmt.Sprintf("Package %v is immutable; unlock it with 'fission package unlock %v' if it really must change", name, name))
+}
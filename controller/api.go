@@ -27,6 +27,7 @@ import (
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/fission/fission"
 	"github.com/fission/fission/fission/logdb"
@@ -39,6 +40,16 @@ type (
 		storageServiceUrl string
 		builderManagerUrl string
 		workflowApiUrl    string
+
+		// kubernetesClient reads the secrets and configmaps
+		// package builds refer to.
+		kubernetesClient *kubernetes.Clientset
+
+		// storageServicePublicUrl is the storage service URL
+		// pre-signed uploads are sent to, from outside the
+		// cluster; storagePresignKey signs them.
+		storageServicePublicUrl string
+		storagePresignKey       string
 	}
 
 	logDBConfig struct {
@@ -57,6 +68,11 @@ func MakeAPI() (*API, error) {
 	} else {
 		api.storageServiceUrl = "http://storagesvc"
 	}
+	api.storageServicePublicUrl = api.storageServiceUrl
+	if u := os.Getenv("STORAGE_SERVICE_PUBLIC_URL"); len(u) > 0 {
+		api.storageServicePublicUrl = strings.TrimSuffix(u, "/")
+	}
+	api.storagePresignKey = os.Getenv("STORAGE_PRESIGN_KEY")
 
 	u = os.Getenv("BUILDER_MANAGER_URL")
 	if len(u) > 0 {
@@ -87,16 +103,20 @@ func (api *API) respondWithSuccess(w http.ResponseWriter, resp []byte) {
 func (api *API) respondWithError(w http.ResponseWriter, err error) {
 	debug.PrintStack()
 
+	code, msg := httpError(err)
+	log.Errorf("Error: %v: %v", code, msg)
+	http.Error(w, msg, code)
+}
+
+// httpError returns the HTTP status and message to respond to a
+// request that failed with err.
+func httpError(err error) (int, string) {
 	// this error type comes with an HTTP code, so just use that
 	se, ok := err.(*kerrors.StatusError)
 	if ok {
-		http.Error(w, string(se.ErrStatus.Reason), int(se.ErrStatus.Code))
-		return
+		return int(se.ErrStatus.Code), string(se.ErrStatus.Reason)
 	}
-
-	code, msg := fission.GetHTTPError(err)
-	log.Errorf("Error: %v: %v", code, msg)
-	http.Error(w, msg, code)
+	return fission.GetHTTPError(err)
 }
 
 func (api *API) getLogDBConfig(dbType string) logDBConfig {
@@ -134,9 +154,14 @@ func (api *API) Serve(port int) {
 
 	r.HandleFunc("/v2/packages", api.PackageApiList).Methods("GET")
 	r.HandleFunc("/v2/packages", api.PackageApiCreate).Methods("POST")
+	r.HandleFunc("/v2/packages/batch", api.PackageApiCreateBatch).Methods("POST")
+	r.HandleFunc("/v2/packages/build-refs", api.PackageApiCheckBuildRefs).Methods("POST")
 	r.HandleFunc("/v2/packages/{package}", api.PackageApiGet).Methods("GET")
 	r.HandleFunc("/v2/packages/{package}", api.PackageApiUpdate).Methods("PUT")
+	r.HandleFunc("/v2/packages/{package}", api.PackageApiApply).Methods("PATCH")
 	r.HandleFunc("/v2/packages/{package}", api.PackageApiDelete).Methods("DELETE")
+	r.HandleFunc("/v2/packages/{package}/events", api.PackageApiEvents).Methods("GET")
+	r.HandleFunc("/v2/packages/{package}/cancel-build", api.PackageApiCancelBuild).Methods("POST")
 
 	r.HandleFunc("/v2/functions", api.FunctionApiList).Methods("GET")
 	r.HandleFunc("/v2/functions", api.FunctionApiCreate).Methods("POST")
@@ -176,6 +201,8 @@ func (api *API) Serve(port int) {
 
 	r.HandleFunc("/proxy/{dbType}", api.FunctionLogsApiPost).Methods("POST")
 	r.HandleFunc("/proxy/storage/v1/archive", api.StorageServiceProxy)
+	r.HandleFunc("/v2/storage/upload-urls", api.StorageUploadUrlApi).Methods("POST")
+	r.HandleFunc("/v2/storage/uploads", api.StorageRegisterUploadApi).Methods("POST")
 	r.HandleFunc("/proxy/buildermgr/v1/build", api.BuilderManagerBuildProxy)
 	r.HandleFunc("/proxy/buildermgr/v1/builder", api.BuilderManagerEnvBuilderProxy)
 	r.HandleFunc("/proxy/workflows-apiserver/{path:.*}", api.WorkflowApiserverProxy)
@@ -18,6 +18,7 @@ package controller
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -312,6 +313,71 @@ func TestTimeTriggerApi(t *testing.T) {
 	assert(len(ts) == 1, "created one trigger, but didn't find it")
 }
 
+func makeTestPackage(name string) *tpr.Package {
+	return &tpr.Package{
+		Metadata: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: fission.PackageSpec{
+			Environment: fission.EnvironmentReference{
+				Name:      "nodejs",
+				Namespace: metav1.NamespaceDefault,
+			},
+			Deployment: fission.Archive{
+				Type:    fission.ArchiveTypeLiteral,
+				Literal: []byte("module.exports = function() {}"),
+			},
+		},
+		Status: fission.PackageStatus{BuildStatus: fission.BuildStatusSucceeded},
+	}
+}
+
+func TestPackageBatchApi(t *testing.T) {
+	pkgs := []*tpr.Package{makeTestPackage("batch-a"), makeTestPackage("batch-b"), makeTestPackage("batch-a")}
+	results, err := g.client.PackageCreateBatch(pkgs)
+	panicIf(err)
+	assert(len(results) == len(pkgs), "batch create must return a result per package")
+	for _, r := range results[:2] {
+		panicIf(r.Err)
+		defer g.client.PackageDelete(r.Metadata)
+	}
+	assertNameReuseFailure(results[2].Err, "package in a batch")
+
+	_, err = g.client.PackageGet(&metav1.ObjectMeta{Name: "batch-b", Namespace: metav1.NamespaceDefault})
+	panicIf(err)
+}
+
+// BenchmarkPackageCreate and BenchmarkPackageCreateBatch compare
+// creating small packages one request at a time with batching.
+func BenchmarkPackageCreate(b *testing.B) {
+	created := make([]*metav1.ObjectMeta, b.N)
+	for i := range created {
+		m, err := g.client.PackageCreate(makeTestPackage(fmt.Sprintf("bench-%v", i)))
+		panicIf(err)
+		created[i] = m
+	}
+	b.StopTimer()
+	for _, m := range created {
+		g.client.PackageDelete(m)
+	}
+}
+
+func BenchmarkPackageCreateBatch(b *testing.B) {
+	pkgs := make([]*tpr.Package, b.N)
+	for i := range pkgs {
+		pkgs[i] = makeTestPackage(fmt.Sprintf("bench-%v", i))
+	}
+	b.ResetTimer()
+	results, err := g.client.PackageCreateBatch(pkgs)
+	panicIf(err)
+	b.StopTimer()
+	for _, r := range results {
+		panicIf(r.Err)
+		g.client.PackageDelete(r.Metadata)
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -22,6 +22,12 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission/buildermgr"
+	builderMgrClient "github.com/fission/fission/buildermgr/client"
 )
 
 func (api *API) BuilderManagerBuildProxy(w http.ResponseWriter, r *http.Request) {
@@ -48,6 +54,27 @@ func (api *API) BuilderManagerEnvBuilderProxy(w http.ResponseWriter, r *http.Req
 	proxy.ServeHTTP(w, r)
 }
 
+// PackageApiCancelBuild asks the builder manager to stop the build of
+// a package.
+func (api *API) PackageApiCancelBuild(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["package"]
+	ns := r.FormValue("namespace")
+	if len(ns) == 0 {
+		ns = metav1.NamespaceDefault
+	}
+
+	c := builderMgrClient.MakeClient(api.builderManagerUrl)
+	err := c.PackageCancelBuild(&buildermgr.BuildRequest{
+		Package: metav1.ObjectMeta{Name: name, Namespace: ns},
+	})
+	if err != nil {
+		api.respondWithError(w, err)
+		return
+	}
+	api.respondWithSuccess(w, []byte(""))
+}
+
 func (api *API) _getBuilderManagerProxy(targetUrl string) (*httputil.ReverseProxy, error) {
 	svcUrl, err := url.Parse(targetUrl)
 	if err != nil {
@@ -18,10 +18,13 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fission/fission"
 )
@@ -29,11 +32,114 @@ import (
 type (
 	Client struct {
 		Url string
+
+		// Headers are added to every request made by this
+		// client, e.g. for auth gateways in front of the
+		// controller.
+		Headers http.Header
+
+		httpClient *http.Client
+		limiter    *RateLimiter
+	}
+
+	// ClientOption configures optional client behaviour at
+	// construction time.
+	ClientOption func(*Client)
+)
+
+func MakeClient(serverUrl string, opts ...ClientOption) *Client {
+	c := &Client{
+		Url:        strings.TrimSuffix(serverUrl, "/"),
+		Headers:    make(http.Header),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithHeaders makes the client send the given headers on every
+// request.
+func WithHeaders(headers http.Header) ClientOption {
+	return func(c *Client) {
+		for k, vs := range headers {
+			for _, v := range vs {
+				c.Headers.Add(k, v)
+			}
+		}
 	}
+}
+
+// tlsClients holds an HTTP client per custom TLS config, so clients
+// made with the same config share a transport and its connections.
+var (
+	tlsClients     = make(map[*tls.Config]*http.Client)
+	tlsClientsLock sync.Mutex
 )
 
-func MakeClient(serverUrl string) *Client {
-	return &Client{Url: strings.TrimSuffix(serverUrl, "/")}
+// WithTLSConfig makes the client use cfg for HTTPS connections, e.g.
+// to trust a private CA.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		tlsClientsLock.Lock()
+		defer tlsClientsLock.Unlock()
+		hc, ok := tlsClients[cfg]
+		if !ok {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.TLSClientConfig = cfg
+			hc = &http.Client{Transport: t}
+			tlsClients[cfg] = hc
+		}
+		c.httpClient = hc
+	}
+}
+
+// do sends the request after applying the client's custom headers,
+// waiting for the client's rate limiter. Throttled requests are
+// retried after the wait the server asks for, when their body can be
+// sent again.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for k, vs := range c.Headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		c.limiter.wait()
+		resp, err := c.httpClient.Do(req)
+		if err != nil || !isThrottled(resp) || attempt == ThrottleRetries {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		time.Sleep(retryAfter(resp, time.Now()))
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (c *Client) get(relativeUrl string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.url(relativeUrl), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+func (c *Client) post(relativeUrl string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.url(relativeUrl), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-type", contentType)
+	return c.do(req)
 }
 
 func (c *Client) delete(relativeUrl string) error {
@@ -42,7 +148,7 @@ func (c *Client) delete(relativeUrl string) error {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -66,7 +172,16 @@ func (c *Client) put(relativeUrl string, contentType string, body []byte) (*http
 		return nil, err
 	}
 	req.Header.Set("Content-type", contentType)
-	return http.DefaultClient.Do(req)
+	return c.do(req)
+}
+
+func (c *Client) patch(relativeUrl string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("PATCH", c.url(relativeUrl), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-type", contentType)
+	return c.do(req)
 }
 
 func (c *Client) url(relativeUrl string) string {
@@ -17,10 +17,8 @@ limitations under the License.
 package client
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -33,7 +31,7 @@ func (c *Client) EnvironmentCreate(env *tpr.Environment) (*metav1.ObjectMeta, er
 		return nil, err
 	}
 
-	resp, err := http.Post(c.url("environments"), "application/json", bytes.NewReader(reqbody))
+	resp, err := c.post("environments", "application/json", reqbody)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +55,7 @@ func (c *Client) EnvironmentGet(m *metav1.ObjectMeta) (*tpr.Environment, error)
 	relativeUrl := fmt.Sprintf("environments/%v", m.Name)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
 
-	resp, err := http.Get(c.url(relativeUrl))
+	resp, err := c.get(relativeUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +109,7 @@ func (c *Client) EnvironmentDelete(m *metav1.ObjectMeta) error {
 }
 
 func (c *Client) EnvironmentList() ([]tpr.Environment, error) {
-	resp, err := http.Get(c.url("environments"))
+	resp, err := c.get("environments")
 	if err != nil {
 		return nil, err
 	}
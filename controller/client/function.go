@@ -17,13 +17,12 @@ limitations under the License.
 package client
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"github.com/fission/fission"
 	"github.com/fission/fission/tpr"
 )
 
@@ -34,7 +33,7 @@ func (c *Client) FunctionCreate(f *tpr.Function) (*metav1.ObjectMeta, error) {
 		return nil, err
 	}
 
-	resp, err := http.Post(c.url("functions"), "application/json", bytes.NewReader(reqbody))
+	resp, err := c.post("functions", "application/json", reqbody)
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +57,7 @@ func (c *Client) FunctionGet(m *metav1.ObjectMeta) (*tpr.Function, error) {
 	relativeUrl := fmt.Sprintf("functions/%v", m.Name)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
 
-	resp, err := http.Get(c.url(relativeUrl))
+	resp, err := c.get(relativeUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -83,7 +82,7 @@ func (c *Client) FunctionGetRawDeployment(m *metav1.ObjectMeta) ([]byte, error)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
 	relativeUrl += fmt.Sprintf("&deploymentraw=1")
 
-	resp, err := http.Get(c.url(relativeUrl))
+	resp, err := c.get(relativeUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +117,32 @@ func (c *Client) FunctionUpdate(f *tpr.Function) (*metav1.ObjectMeta, error) {
 	return &m, nil
 }
 
+// FunctionSetPackage points a function at the current version of a
+// package. The update is conditioned on the function's resource
+// version, so it fails rather than overwrite a concurrent change; on
+// any error the function keeps its old package.
+func (c *Client) FunctionSetPackage(fnMeta *metav1.ObjectMeta, pkgMeta *metav1.ObjectMeta) (*metav1.ObjectMeta, error) {
+	pkg, err := c.PackageGet(pkgMeta)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.FunctionGet(fnMeta)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Spec.Environment != f.Spec.Environment {
+		return nil, fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("package %v is for environment %v, function %v uses %v",
+				pkg.Metadata.Name, pkg.Spec.Environment.Name, f.Metadata.Name, f.Spec.Environment.Name))
+	}
+	f.Spec.Package.PackageRef = fission.PackageRef{
+		Namespace:       pkg.Metadata.Namespace,
+		Name:            pkg.Metadata.Name,
+		ResourceVersion: pkg.Metadata.ResourceVersion,
+	}
+	return c.FunctionUpdate(f)
+}
+
 func (c *Client) FunctionDelete(m *metav1.ObjectMeta) error {
 	relativeUrl := fmt.Sprintf("functions/%v", m.Name)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
@@ -125,7 +150,7 @@ func (c *Client) FunctionDelete(m *metav1.ObjectMeta) error {
 }
 
 func (c *Client) FunctionList() ([]tpr.Function, error) {
-	resp, err := http.Get(c.url("functions"))
+	resp, err := c.get("functions")
 	if err != nil {
 		return nil, err
 	}
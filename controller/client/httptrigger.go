@@ -17,10 +17,8 @@ limitations under the License.
 package client
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -33,7 +31,7 @@ func (c *Client) HTTPTriggerCreate(t *tpr.Httptrigger) (*metav1.ObjectMeta, erro
 		return nil, err
 	}
 
-	resp, err := http.Post(c.url("triggers/http"), "application/json", bytes.NewReader(reqbody))
+	resp, err := c.post("triggers/http", "application/json", reqbody)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +55,7 @@ func (c *Client) HTTPTriggerGet(m *metav1.ObjectMeta) (*tpr.Httptrigger, error)
 	relativeUrl := fmt.Sprintf("triggers/http/%v", m.Name)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
 
-	resp, err := http.Get(c.url(relativeUrl))
+	resp, err := c.get(relativeUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -110,7 +108,7 @@ func (c *Client) HTTPTriggerDelete(m *metav1.ObjectMeta) error {
 }
 
 func (c *Client) HTTPTriggerList() ([]tpr.Httptrigger, error) {
-	resp, err := http.Get(c.url("triggers/http"))
+	resp, err := c.get("triggers/http")
 	if err != nil {
 		return nil, err
 	}
@@ -17,10 +17,8 @@ limitations under the License.
 package client
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -34,7 +32,7 @@ func (c *Client) WatchCreate(w *tpr.Kuberneteswatchtrigger) (*metav1.ObjectMeta,
 		return nil, err
 	}
 
-	resp, err := http.Post(c.url("watches"), "application/json", bytes.NewReader(reqbody))
+	resp, err := c.post("watches", "application/json", reqbody)
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +56,7 @@ func (c *Client) WatchGet(m *metav1.ObjectMeta) (*tpr.Kuberneteswatchtrigger, er
 	relativeUrl := fmt.Sprintf("watches/%v", m.Name)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
 
-	resp, err := http.Get(c.url(relativeUrl))
+	resp, err := c.get(relativeUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -90,7 +88,7 @@ func (c *Client) WatchDelete(m *metav1.ObjectMeta) error {
 }
 
 func (c *Client) WatchList() ([]tpr.Kuberneteswatchtrigger, error) {
-	resp, err := http.Get(c.url("watches"))
+	resp, err := c.get("watches")
 	if err != nil {
 		return nil, err
 	}
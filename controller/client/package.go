@@ -17,13 +17,19 @@ limitations under the License.
 package client
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"github.com/fission/fission"
 	"github.com/fission/fission/tpr"
 )
 
@@ -34,7 +40,7 @@ func (c *Client) PackageCreate(f *tpr.Package) (*metav1.ObjectMeta, error) {
 		return nil, err
 	}
 
-	resp, err := http.Post(c.url("packages"), "application/json", bytes.NewReader(reqbody))
+	resp, err := c.post("packages", "application/json", reqbody)
 	if err != nil {
 		return nil, err
 	}
@@ -54,11 +60,88 @@ func (c *Client) PackageCreate(f *tpr.Package) (*metav1.ObjectMeta, error) {
 	return &m, nil
 }
 
+// PackageCreateResult is the outcome of creating one package of a
+// batch: its metadata, or the error creating it.
+type PackageCreateResult struct {
+	Metadata *metav1.ObjectMeta
+	Err      error
+}
+
+// PackageCreateBatch creates packages using as few requests as
+// possible, up to fission.MaxPackageBatchSize packages per request,
+// and returns a result for each. It returns an error only if a whole
+// request failed; results of earlier requests are still returned.
+// Controllers without batch support get one request per package.
+func (c *Client) PackageCreateBatch(pkgs []*tpr.Package) ([]PackageCreateResult, error) {
+	results := make([]PackageCreateResult, 0, len(pkgs))
+	for start := 0; start < len(pkgs); start += fission.MaxPackageBatchSize {
+		end := start + fission.MaxPackageBatchSize
+		if end > len(pkgs) {
+			end = len(pkgs)
+		}
+		batch, err := c.packageCreateBatch(pkgs[start:end])
+		// older controllers don't route the batch endpoint
+		if fe, ok := err.(fission.Error); ok && fe.Code == fission.ErrorNotFound {
+			batch, err = c.packageCreateEach(pkgs[start:end]), nil
+		}
+		if err != nil {
+			return results, err
+		}
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+func (c *Client) packageCreateBatch(pkgs []*tpr.Package) ([]PackageCreateResult, error) {
+	reqbody, err := json.Marshal(pkgs)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.post("packages/batch", "application/json", reqbody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := c.handleResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var created []fission.PackageBatchCreateResult
+	err = json.Unmarshal(body, &created)
+	if err != nil {
+		return nil, err
+	}
+	if len(created) != len(pkgs) {
+		return nil, fmt.Errorf("batch create returned %v results for %v packages", len(created), len(pkgs))
+	}
+
+	results := make([]PackageCreateResult, len(created))
+	for i, r := range created {
+		if r.Metadata != nil {
+			results[i].Metadata = r.Metadata
+		} else {
+			results[i].Err = fission.MakeErrorFromHTTPStatus(r.Status, r.Error)
+		}
+	}
+	return results, nil
+}
+
+func (c *Client) packageCreateEach(pkgs []*tpr.Package) []PackageCreateResult {
+	results := make([]PackageCreateResult, len(pkgs))
+	for i, pkg := range pkgs {
+		results[i].Metadata, results[i].Err = c.PackageCreate(pkg)
+	}
+	return results
+}
+
 func (c *Client) PackageGet(m *metav1.ObjectMeta) (*tpr.Package, error) {
 	relativeUrl := fmt.Sprintf("packages/%v", m.Name)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
 
-	resp, err := http.Get(c.url(relativeUrl))
+	resp, err := c.get(relativeUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -78,7 +161,22 @@ func (c *Client) PackageGet(m *metav1.ObjectMeta) (*tpr.Package, error) {
 	return &f, nil
 }
 
+// PackageUpdate replaces a package. Updates of packages marked
+// immutable, as the package given says, are checked against the
+// package with tpr.CheckPackageMutable before they're sent, for
+// controllers that don't check them; unlocking one means updating it
+// without fission.PackageImmutableAnnotation.
 func (c *Client) PackageUpdate(f *tpr.Package) (*metav1.ObjectMeta, error) {
+	if fission.PackageImmutable(f.Metadata.Annotations) {
+		existing, err := c.PackageGet(&f.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		err = tpr.CheckPackageMutable(existing, f)
+		if err != nil {
+			return nil, err
+		}
+	}
 	reqbody, err := json.Marshal(f)
 	if err != nil {
 		return nil, err
@@ -104,6 +202,104 @@ func (c *Client) PackageUpdate(f *tpr.Package) (*metav1.ObjectMeta, error) {
 	return &m, nil
 }
 
+// PackageApply creates or updates a package on behalf of
+// fieldManager, so that applying the same package again changes
+// nothing. A package last applied by another manager is an
+// ErrorNameExists error, unless force is set, in which case
+// fieldManager takes it over.
+//
+// Controllers without apply support get the same semantics from a
+// get followed by a create or an update, retried if another writer
+// gets in between.
+func (c *Client) PackageApply(pkg *tpr.Package, fieldManager string, force bool) (*fission.PackageApplyResult, error) {
+	reqbody, err := json.Marshal(pkg)
+	if err != nil {
+		return nil, err
+	}
+	relativeUrl := fmt.Sprintf("packages/%v", pkg.Metadata.Name)
+	relativeUrl += fmt.Sprintf("?namespace=%v&fieldManager=%v&force=%v",
+		pkg.Metadata.Namespace, url.QueryEscape(fieldManager), force)
+
+	resp, err := c.patch(relativeUrl, "application/apply-patch+yaml", reqbody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// older controllers route no PATCH, or don't accept apply patches
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType:
+		return c.packageApplyFallback(pkg, fieldManager, force)
+	}
+
+	body, err := c.handleResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var result fission.PackageApplyResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Client) packageApplyFallback(pkg *tpr.Package, fieldManager string, force bool) (*fission.PackageApplyResult, error) {
+	applier := &tpr.PackageApplier{
+		Get: func(name string) (*tpr.Package, error) {
+			return c.PackageGet(&metav1.ObjectMeta{Name: name, Namespace: pkg.Metadata.Namespace})
+		},
+		Create: c.PackageCreate,
+		Update: func(p *tpr.Package, specChanged bool) (*metav1.ObjectMeta, error) {
+			return c.PackageUpdate(p)
+		},
+		IsNotFound: func(err error) bool {
+			fe, ok := err.(fission.Error)
+			return ok && fe.Code == fission.ErrorNotFound
+		},
+		IsConflict: func(err error) bool {
+			fe, ok := err.(fission.Error)
+			return ok && fe.Code == fission.ErrorNameExists
+		},
+	}
+	return applier.Apply(pkg, fieldManager, force)
+}
+
+// PackageTouchedAnnotation records when a package was last touched.
+const PackageTouchedAnnotation = "fission.io/touched-at"
+
+// PackageTouch updates a package without changing its spec or status,
+// by setting PackageTouchedAnnotation. The builder manager sees the
+// update and builds the package if it is pending, which recovers
+// packages whose build was lost, e.g. when a builder restarted.
+func (c *Client) PackageTouch(m *metav1.ObjectMeta) (*metav1.ObjectMeta, error) {
+	pkg, err := c.PackageGet(m)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Metadata.Annotations == nil {
+		pkg.Metadata.Annotations = make(map[string]string)
+	}
+	pkg.Metadata.Annotations[PackageTouchedAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+	return c.PackageUpdate(pkg)
+}
+
+// PackageCancelBuild stops the build of a package, setting its status
+// to fission.BuildStatusCanceled. It fails if the package isn't
+// pending or building.
+func (c *Client) PackageCancelBuild(m *metav1.ObjectMeta) error {
+	relativeUrl := fmt.Sprintf("packages/%v/cancel-build", m.Name)
+	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
+	resp, err := c.post(relativeUrl, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = c.handleResponse(resp)
+	return err
+}
+
 func (c *Client) PackageDelete(m *metav1.ObjectMeta) error {
 	relativeUrl := fmt.Sprintf("packages/%v", m.Name)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
@@ -111,7 +307,7 @@ func (c *Client) PackageDelete(m *metav1.ObjectMeta) error {
 }
 
 func (c *Client) PackageList() ([]tpr.Package, error) {
-	resp, err := http.Get(c.url("packages"))
+	resp, err := c.get("packages")
 	if err != nil {
 		return nil, err
 	}
@@ -130,3 +326,107 @@ func (c *Client) PackageList() ([]tpr.Package, error) {
 
 	return funcs, nil
 }
+
+// PackageHistory returns the packages of an environment, newest
+// first. A limit greater than zero returns at most that many.
+func (c *Client) PackageHistory(env *metav1.ObjectMeta, limit int) ([]tpr.Package, error) {
+	pkgs, err := c.PackageList()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]tpr.Package, 0)
+	for _, pkg := range pkgs {
+		ref := pkg.Spec.Environment
+		if ref.Name == env.Name && ref.Namespace == env.Namespace {
+			history = append(history, pkg)
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[j].Metadata.CreationTimestamp.Before(&history[i].Metadata.CreationTimestamp)
+	})
+	if limit > 0 && len(history) > limit {
+		history = history[:limit]
+	}
+	return history, nil
+}
+
+// PackageGetManifest returns the file manifest of a package's source
+// archive, or of its deployment archive if the package has no source
+// manifest. The manifest's checksum is verified.
+func (c *Client) PackageGetManifest(m *metav1.ObjectMeta) (*fission.ArchiveManifest, error) {
+	pkg, err := c.PackageGet(m)
+	if err != nil {
+		return nil, err
+	}
+
+	ref := pkg.Spec.Source.Manifest
+	if ref == nil {
+		ref = pkg.Spec.Deployment.Manifest
+	}
+	if ref == nil {
+		return nil, fission.MakeError(fission.ErrorNotFound, "Package has no manifest")
+	}
+
+	body := ref.Literal
+	if len(body) == 0 {
+		req, err := http.NewRequest("GET", ref.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fission.MakeErrorFromHTTP(resp)
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ref.Checksum.Type != fission.ChecksumTypeSHA256 {
+		return nil, fmt.Errorf("%w: unsupported checksum type '%v'", fission.ErrInvalidChecksum, ref.Checksum.Type)
+	}
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != ref.Checksum.Sum {
+		return nil, fmt.Errorf("%w: manifest checksum mismatch", fission.ErrInvalidChecksum)
+	}
+
+	var manifest fission.ArchiveManifest
+	err = json.Unmarshal(body, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// PackageCheckBuildRefs returns which of the secrets and configmaps
+// of a namespace don't exist, as secret/<name> or configmap/<name>.
+func (c *Client) PackageCheckBuildRefs(namespace string, secrets []string, configMaps []string) ([]string, error) {
+	reqbody, err := json.Marshal(&fission.BuildRefCheck{Namespace: namespace, Secrets: secrets, ConfigMaps: configMaps})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.post("packages/build-refs", "application/json", reqbody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := c.handleResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var check fission.BuildRefCheck
+	err = json.Unmarshal(body, &check)
+	if err != nil {
+		return nil, err
+	}
+	return check.Missing, nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/tpr"
+)
+
+const (
+	// packageEventsRetries is the number of times in a row a
+	// dropped event stream is reconnected before giving up.
+	packageEventsRetries = 5
+
+	// packagePollInterval is how often package status is polled
+	// when the controller can't stream it.
+	packagePollInterval = time.Second
+)
+
+type (
+	// PackageEvent is a change in a package's build: a new status,
+	// a new line of build log, or new progress reported by the
+	// build command.
+	PackageEvent struct {
+		Status     fission.BuildStatus
+		LogLine    string
+		IsLog      bool
+		Progress   *fission.BuildProgress
+		IsProgress bool
+	}
+
+	// packageEventTracker turns successive package statuses into
+	// PackageEvents, so that statuses seen again after a reconnect
+	// don't repeat events.
+	packageEventTracker struct {
+		fn       func(PackageEvent)
+		last     fission.PackageStatus
+		logLines int
+		seen     bool
+	}
+)
+
+func (t *packageEventTracker) update(status fission.PackageStatus) {
+	if !t.seen || status.BuildStatus != t.last.BuildStatus {
+		t.fn(PackageEvent{Status: status.BuildStatus})
+	}
+	lines := strings.SplitAfter(status.BuildLog, "\n")
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if !strings.HasPrefix(status.BuildLog, t.last.BuildLog) {
+		// the log was replaced, e.g. by a rebuild
+		t.logLines = 0
+	}
+	for _, line := range lines[t.logLines:] {
+		t.fn(PackageEvent{Status: status.BuildStatus, LogLine: strings.TrimSuffix(line, "\n"), IsLog: true})
+	}
+	t.logLines = len(lines)
+	if p := status.BuildProgress; p != nil && (t.last.BuildProgress == nil || *p != *t.last.BuildProgress) {
+		t.fn(PackageEvent{Status: status.BuildStatus, Progress: p, IsProgress: true})
+	}
+	t.last = status
+	t.seen = true
+}
+
+func (t *packageEventTracker) finished() bool {
+	return t.seen && tpr.IsBuildFinished(t.last.BuildStatus)
+}
+
+// PackageEventsStream calls fn with each change to a package's build
+// status and each new line of its build log, as they happen, until
+// the build has finished; it returns the final status. The first
+// event is the current status. Dropped streams are reconnected, and
+// controllers that can't stream are polled instead. Build logs are
+// recorded by the builder manager, so log lines arrive when it
+// records them.
+func (c *Client) PackageEventsStream(m *metav1.ObjectMeta, fn func(PackageEvent)) (*fission.PackageStatus, error) {
+	return c.PackageEventsStreamContext(context.Background(), m, fn)
+}
+
+// PackageEventsStreamContext is PackageEventsStream, stopping when ctx
+// is done with ctx's error. fn is called from the calling goroutine,
+// and no requests are left running once it returns.
+func (c *Client) PackageEventsStreamContext(ctx context.Context, m *metav1.ObjectMeta, fn func(PackageEvent)) (*fission.PackageStatus, error) {
+	t := &packageEventTracker{fn: fn}
+	failures := 0
+	for {
+		events, err := c.streamPackageStatus(ctx, m, t.update)
+		if t.finished() {
+			return &t.last, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if fe, ok := err.(fission.Error); ok && fe.Code == fission.ErrorNotFound && !t.seen {
+			// older controllers don't route the stream; a missing
+			// package fails the poll too
+			return c.pollPackageStatus(ctx, m, t)
+		}
+		if events > 0 {
+			failures = 0
+		}
+		failures++
+		if failures > packageEventsRetries {
+			if err == nil {
+				err = fmt.Errorf("package event stream for %v keeps ending early", m.Name)
+			}
+			return nil, err
+		}
+		err = sleepContext(ctx, time.Duration(failures)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleepContext sleeps for d, or until ctx is done, returning ctx's
+// error then.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// streamPackageStatus reads a package event stream, calling fn with
+// each status, until it ends. It returns the number of statuses read.
+func (c *Client) streamPackageStatus(ctx context.Context, m *metav1.ObjectMeta, fn func(fission.PackageStatus)) (int, error) {
+	relativeUrl := fmt.Sprintf("packages/%v/events", m.Name)
+	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
+
+	req, err := http.NewRequest("GET", c.url(relativeUrl), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, fission.MakeErrorFromHTTP(resp)
+	}
+
+	events := 0
+	r := bufio.NewReader(resp.Body)
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if data.Len() == 0 {
+				continue
+			}
+			var status fission.PackageStatus
+			err = json.Unmarshal([]byte(data.String()), &status)
+			if err != nil {
+				return events, fmt.Errorf("bad package event: %v", err)
+			}
+			data.Reset()
+			events++
+			fn(status)
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// other fields and ":" comments are ignored
+	}
+}
+
+// PackageBuildProgress returns the progress the build command of a
+// package's running build last reported, or nil if it reported none
+// or the package isn't building.
+func (c *Client) PackageBuildProgress(m *metav1.ObjectMeta) (*fission.BuildProgress, error) {
+	pkg, err := c.PackageGet(m)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Status.BuildStatus != fission.BuildStatusRunning {
+		return nil, nil
+	}
+	return pkg.Status.BuildProgress, nil
+}
+
+// pollPackageStatus gets a package until its build has finished or
+// ctx is done, passing each status to t.
+func (c *Client) pollPackageStatus(ctx context.Context, m *metav1.ObjectMeta, t *packageEventTracker) (*fission.PackageStatus, error) {
+	for {
+		pkg, err := c.PackageGet(m)
+		if err != nil {
+			return nil, err
+		}
+		t.update(pkg.Status)
+		if t.finished() {
+			return &t.last, nil
+		}
+		err = sleepContext(ctx, packagePollInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ThrottleRetries is the number of times a throttled request
+	// is retried after waiting as the server asked.
+	ThrottleRetries = 3
+
+	// maxRetryAfter bounds how long a Retry-After header can make
+	// a request wait.
+	maxRetryAfter = time.Minute
+
+	// defaultRetryAfter is the wait when a throttled response
+	// doesn't say how long to wait.
+	defaultRetryAfter = time.Second
+)
+
+// RateLimiter is a token bucket bounding the rate of requests to the
+// controller, as kubectl does for the Kubernetes API: requests may
+// burst up to the bucket's size, and are otherwise spaced to the
+// given rate. A single limiter can be shared by several clients.
+type RateLimiter struct {
+	mu     sync.Mutex
+	qps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing qps requests per second on
+// average, in bursts of up to burst requests. A rate of zero or less
+// means no limit, and returns nil.
+func NewRateLimiter(qps float64, burst int) *RateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		qps:    qps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a request may be sent.
+func (l *RateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.qps
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// take the token now, so that waiters queue in order
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.qps * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// WithRateLimiter makes the client wait for limiter before each
+// request. Pass the same limiter to every client that should share
+// the rate.
+func WithRateLimiter(limiter *RateLimiter) ClientOption {
+	return func(c *Client) {
+		c.limiter = limiter
+	}
+}
+
+// isThrottled returns true for responses asking the client to slow
+// down.
+func isThrottled(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusServiceUnavailable && len(resp.Header.Get("Retry-After")) > 0)
+}
+
+// retryAfter returns how long a throttled response asks the client to
+// wait, from its Retry-After header in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	d := defaultRetryAfter
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/storagesvc"
+)
+
+// StorageUploadUrl asks the controller for a pre-signed URL to upload
+// an archive of the given size and SHA256 checksum to, directly to the
+// storage service, for a package of namespace.
+func (c *Client) StorageUploadUrl(namespace string, prefix string, checksum fission.Checksum, size int64) (*storagesvc.PresignResponse, error) {
+	reqbody, err := json.Marshal(&storagesvc.PresignRequest{Namespace: namespace, Prefix: prefix, Checksum: checksum, Size: size})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.post("storage/upload-urls", "application/json", reqbody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := c.handleResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var presigned storagesvc.PresignResponse
+	err = json.Unmarshal(body, &presigned)
+	if err != nil {
+		return nil, err
+	}
+	return &presigned, nil
+}
+
+// StorageRegisterUpload tells the controller an archive was uploaded
+// to a pre-signed URL, and returns it as the storage service holds it.
+func (c *Client) StorageRegisterUpload(id string, checksum fission.Checksum) (*storagesvc.RegisterUploadResponse, error) {
+	reqbody, err := json.Marshal(&storagesvc.RegisterUploadRequest{ID: id, Checksum: checksum})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.post("storage/uploads", "application/json", reqbody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := c.handleResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var registered storagesvc.RegisterUploadResponse
+	err = json.Unmarshal(body, &registered)
+	if err != nil {
+		return nil, err
+	}
+	return &registered, nil
+}
@@ -17,10 +17,8 @@ limitations under the License.
 package client
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -33,7 +31,7 @@ func (c *Client) TimeTriggerCreate(t *tpr.Timetrigger) (*metav1.ObjectMeta, erro
 		return nil, err
 	}
 
-	resp, err := http.Post(c.url("triggers/time"), "application/json", bytes.NewReader(reqbody))
+	resp, err := c.post("triggers/time", "application/json", reqbody)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +55,7 @@ func (c *Client) TimeTriggerGet(m *metav1.ObjectMeta) (*tpr.Timetrigger, error)
 	relativeUrl := fmt.Sprintf("triggers/time/%v", m.Name)
 	relativeUrl += fmt.Sprintf("?namespace=%v", m.Namespace)
 
-	resp, err := http.Get(c.url(relativeUrl))
+	resp, err := c.get(relativeUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -110,7 +108,7 @@ func (c *Client) TimeTriggerDelete(m *metav1.ObjectMeta) error {
 }
 
 func (c *Client) TimeTriggerList() ([]tpr.Timetrigger, error) {
-	resp, err := http.Get(c.url("triggers/time"))
+	resp, err := c.get("triggers/time")
 	if err != nil {
 		return nil, err
 	}
@@ -18,11 +18,15 @@ package controller
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 
 	"github.com/fission/fission"
 	"github.com/fission/fission/tpr"
@@ -58,40 +62,155 @@ func (a *API) PackageApiCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = validateResourceName(f.Metadata.Name)
+	setRequestId(&f.Metadata, r.Header.Get(fission.RequestIdHeader))
+	fnew, err := a.createPackage(&f)
 	if err != nil {
 		a.respondWithError(w, err)
 		return
 	}
 
-	// Ensure size limits
-	if len(f.Spec.Source.Literal) > 256*1024 {
-		err := fission.MakeError(fission.ErrorInvalidArgument, "Package literal larger than 256K")
+	resp, err := json.Marshal(fnew.Metadata)
+	if err != nil {
 		a.respondWithError(w, err)
 		return
 	}
-	if len(f.Spec.Deployment.Literal) > 256*1024 {
-		err := fission.MakeError(fission.ErrorInvalidArgument, "Package literal larger than 256K")
+
+	w.WriteHeader(http.StatusCreated)
+	a.respondWithSuccess(w, resp)
+}
+
+// PackageApiCreateBatch creates a list of packages in one request,
+// which saves a round trip per package when creating many small
+// ones. Packages are created in order, and the failure of one doesn't
+// stop the rest; the response holds a fission.PackageBatchCreateResult
+// for each.
+func (a *API) PackageApiCreateBatch(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
 		a.respondWithError(w, err)
 		return
 	}
 
-	fnew, err := a.fissionClient.Packages(f.Metadata.Namespace).Create(&f)
+	var pkgs []tpr.Package
+	err = json.Unmarshal(body, &pkgs)
 	if err != nil {
 		a.respondWithError(w, err)
 		return
 	}
+	if len(pkgs) > fission.MaxPackageBatchSize {
+		err = fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("Batch of %v packages is larger than %v", len(pkgs), fission.MaxPackageBatchSize))
+		a.respondWithError(w, err)
+		return
+	}
 
-	resp, err := json.Marshal(fnew.Metadata)
+	results := make([]fission.PackageBatchCreateResult, len(pkgs))
+	for i := range pkgs {
+		setRequestId(&pkgs[i].Metadata, r.Header.Get(fission.RequestIdHeader))
+		fnew, err := a.createPackage(&pkgs[i])
+		if err != nil {
+			results[i].Status, results[i].Error = httpError(err)
+			continue
+		}
+		results[i].Metadata = &fnew.Metadata
+	}
+
+	resp, err := json.Marshal(results)
 	if err != nil {
 		a.respondWithError(w, err)
 		return
 	}
+	a.respondWithSuccess(w, resp)
+}
 
-	w.WriteHeader(http.StatusCreated)
+// PackageApiCheckBuildRefs reports which of the secrets and configmaps
+// of a fission.BuildRefCheck don't exist, so the CLI can refuse a
+// package whose build would fail to mount them.
+func (a *API) PackageApiCheckBuildRefs(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+	var check fission.BuildRefCheck
+	err = json.Unmarshal(body, &check)
+	if err != nil {
+		a.respondWithError(w, fission.MakeError(fission.ErrorInvalidArgument, err.Error()))
+		return
+	}
+	err = fission.ValidateBuildRefs(&fission.PackageSpec{BuildSecrets: check.Secrets, BuildConfigMaps: check.ConfigMaps})
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+	if len(check.Namespace) == 0 {
+		check.Namespace = metav1.NamespaceDefault
+	}
+
+	check.Missing = nil
+	for _, name := range check.Secrets {
+		_, err := a.kubernetesClient.CoreV1().Secrets(check.Namespace).Get(name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			check.Missing = append(check.Missing, "secret/"+name)
+		} else if err != nil {
+			a.respondWithError(w, err)
+			return
+		}
+	}
+	for _, name := range check.ConfigMaps {
+		_, err := a.kubernetesClient.CoreV1().ConfigMaps(check.Namespace).Get(name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			check.Missing = append(check.Missing, "configmap/"+name)
+		} else if err != nil {
+			a.respondWithError(w, err)
+			return
+		}
+	}
+
+	resp, err := json.Marshal(&check)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
 	a.respondWithSuccess(w, resp)
 }
 
+// createPackage checks a new package and creates it.
+func (a *API) createPackage(f *tpr.Package) (*tpr.Package, error) {
+	err := validateResourceName(f.Metadata.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = validatePackageSpec(&f.Spec)
+	if err != nil {
+		return nil, err
+	}
+	return a.fissionClient.Packages(f.Metadata.Namespace).Create(f)
+}
+
+// validatePackageSpec checks the parts of a package spec the
+// controller limits.
+func validatePackageSpec(spec *fission.PackageSpec) error {
+	// Ensure size limits
+	if len(spec.Source.Literal) > 256*1024 {
+		return fission.MakeError(fission.ErrorInvalidArgument, "Package literal larger than 256K")
+	}
+	if len(spec.Deployment.Literal) > 256*1024 {
+		return fission.MakeError(fission.ErrorInvalidArgument, "Package literal larger than 256K")
+	}
+	if len(spec.BuilderImage) > 0 {
+		err := fission.ValidateImageReference(spec.BuilderImage)
+		if err != nil {
+			return err
+		}
+	}
+	err := fission.ValidateBuildRefs(spec)
+	if err != nil {
+		return err
+	}
+	return fission.ValidateDeploymentPolicy(spec.DeploymentPolicy)
+}
+
 func (a *API) PackageApiGet(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["package"]
@@ -142,7 +261,29 @@ func (a *API) PackageApiUpdate(w http.ResponseWriter, r *http.Request) {
 		a.respondWithError(w, err)
 		return
 	}
+	if len(f.Spec.BuilderImage) > 0 {
+		err = fission.ValidateImageReference(f.Spec.BuilderImage)
+		if err != nil {
+			a.respondWithError(w, err)
+			return
+		}
+	}
+	err = fission.ValidateDeploymentPolicy(f.Spec.DeploymentPolicy)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+	err = a.checkPackageMutable(&f)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
 
+	// only the labels of an immutable package change, so there's
+	// no build to trace
+	if !fission.PackageImmutable(f.Metadata.Annotations) {
+		setRequestId(&f.Metadata, r.Header.Get(fission.RequestIdHeader))
+	}
 	fnew, err := a.fissionClient.Packages(f.Metadata.Namespace).Update(&f)
 	if err != nil {
 		a.respondWithError(w, err)
@@ -157,6 +298,125 @@ func (a *API) PackageApiUpdate(w http.ResponseWriter, r *http.Request) {
 	a.respondWithSuccess(w, resp)
 }
 
+// setRequestId records the request ID of the request creating or
+// updating a package on it, for buildermgr to pass on to the builder,
+// so a build can be traced to the command that asked for it.
+func setRequestId(m *metav1.ObjectMeta, requestId string) {
+	if len(requestId) == 0 {
+		return
+	}
+	if m.Annotations == nil {
+		m.Annotations = make(map[string]string)
+	}
+	m.Annotations[fission.PackageRequestIdAnnotation] = requestId
+}
+
+// checkPackageMutable refuses an update of an immutable package, as
+// tpr.CheckPackageMutable does. A package that can't be read isn't
+// updated either, unless it doesn't exist, which the update reports.
+func (a *API) checkPackageMutable(f *tpr.Package) error {
+	existing, err := a.fissionClient.Packages(f.Metadata.Namespace).Get(f.Metadata.Name)
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tpr.CheckPackageMutable(existing, f)
+}
+
+// PackageApiApply applies a package: it is created if it doesn't
+// exist, updated if its contents differ, and left alone otherwise, so
+// applying the same package again changes nothing; see
+// tpr.PackageApplier. The fieldManager
+// parameter names the applier, recorded in
+// fission.PackageFieldManagerAnnotation; applying a package last
+// applied by another manager is a conflict, unless force is true.
+//
+// Package TPRs can't be server-side applied, so ownership is tracked
+// for the whole spec, rather than per field as Kubernetes does.
+func (a *API) PackageApiApply(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["package"]
+	manager := r.FormValue("fieldManager")
+	force := r.FormValue("force") == "true"
+	if len(manager) == 0 {
+		a.respondWithError(w, fission.MakeError(fission.ErrorInvalidArgument, "Need a fieldManager"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+
+	var f tpr.Package
+	err = json.Unmarshal(body, &f)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+	if name != f.Metadata.Name {
+		err = fission.MakeError(fission.ErrorInvalidArgument, "Package name doesn't match URL")
+		a.respondWithError(w, err)
+		return
+	}
+	if len(f.Metadata.Namespace) == 0 {
+		f.Metadata.Namespace = metav1.NamespaceDefault
+	}
+
+	result, err := a.applyPackage(&f, manager, r.Header.Get(fission.RequestIdHeader), force)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+
+	resp, err := json.Marshal(result)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+	a.respondWithSuccess(w, resp)
+}
+
+// applyPackage creates or updates f on behalf of manager, as
+// described for PackageApiApply, recording requestId on the package
+// if it's created or its spec changes.
+func (a *API) applyPackage(f *tpr.Package, manager, requestId string, force bool) (*fission.PackageApplyResult, error) {
+	err := validatePackageSpec(&f.Spec)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := a.fissionClient.Packages(f.Metadata.Namespace)
+	applier := &tpr.PackageApplier{
+		Get: pkgs.Get,
+		Create: func(pkg *tpr.Package) (*metav1.ObjectMeta, error) {
+			setRequestId(&pkg.Metadata, requestId)
+			fnew, err := a.createPackage(pkg)
+			if err != nil {
+				return nil, err
+			}
+			return &fnew.Metadata, nil
+		},
+		Update: func(pkg *tpr.Package, specChanged bool) (*metav1.ObjectMeta, error) {
+			if specChanged {
+				setRequestId(&pkg.Metadata, requestId)
+			}
+			fnew, err := pkgs.Update(pkg)
+			if err != nil {
+				return nil, err
+			}
+			return &fnew.Metadata, nil
+		},
+		IsNotFound: kerrors.IsNotFound,
+		IsConflict: func(err error) bool {
+			return kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err)
+		},
+	}
+	return applier.Apply(f, manager, force)
+}
+
 func (a *API) PackageApiDelete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["package"]
@@ -173,3 +433,95 @@ func (a *API) PackageApiDelete(w http.ResponseWriter, r *http.Request) {
 
 	a.respondWithSuccess(w, []byte(""))
 }
+
+// packageEventsHeartbeat is how often an idle package event stream
+// sends a comment, so that proxies don't close it.
+const packageEventsHeartbeat = 15 * time.Second
+
+// PackageApiEvents streams a package's status as server-sent events,
+// one JSON fission.PackageStatus per change, starting with the
+// current status. The stream ends once the build has finished or the
+// package is deleted; clients reconnect if it ends otherwise.
+func (a *API) PackageApiEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["package"]
+	ns := r.FormValue("namespace")
+	if len(ns) == 0 {
+		ns = metav1.NamespaceDefault
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		a.respondWithError(w, fission.MakeError(fission.ErrorNotImplmented, "Streaming not supported"))
+		return
+	}
+
+	// watch before reading the current status, so no change is
+	// missed in between
+	watcher, err := a.fissionClient.Packages(ns).Watch(metav1.ListOptions{})
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+	defer watcher.Stop()
+
+	pkg, err := a.fissionClient.Packages(ns).Get(name)
+	if err != nil {
+		a.respondWithError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	last := pkg.Status
+	send := func(status fission.PackageStatus) bool {
+		data, err := json.Marshal(status)
+		if err != nil {
+			return false
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		if err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if !send(last) || tpr.IsBuildFinished(last.BuildStatus) {
+		return
+	}
+
+	heartbeat := time.NewTicker(packageEventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			p, ok := ev.Object.(*tpr.Package)
+			if !ok || p.Metadata.Name != name {
+				continue
+			}
+			if ev.Type == watch.Deleted {
+				return
+			}
+			if p.Status == last {
+				continue
+			}
+			last = p.Status
+			if !send(last) || tpr.IsBuildFinished(last.BuildStatus) {
+				return
+			}
+		}
+	}
+}
@@ -17,13 +17,27 @@ limitations under the License.
 package controller
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/storagesvc"
 )
 
+// presignedUploadTTL is how long a pre-signed upload URL is valid.
+const presignedUploadTTL = 15 * time.Minute
+
+// storageRequestTimeout bounds the controller's requests to the
+// storage service.
+const storageRequestTimeout = 30 * time.Second
+
 func (api *API) StorageServiceProxy(w http.ResponseWriter, r *http.Request) {
 	u := api.storageServiceUrl
 	ssUrl, err := url.Parse(u)
@@ -43,3 +57,82 @@ func (api *API) StorageServiceProxy(w http.ResponseWriter, r *http.Request) {
 	}
 	proxy.ServeHTTP(w, r)
 }
+
+// StorageUploadUrlApi issues a pre-signed URL that the CLI uploads an
+// archive to directly, instead of through StorageServiceProxy. It
+// needs STORAGE_PRESIGN_KEY, the key the storage service checks the
+// URLs with.
+func (api *API) StorageUploadUrlApi(w http.ResponseWriter, r *http.Request) {
+	if len(api.storagePresignKey) == 0 {
+		http.Error(w, "pre-signed uploads aren't enabled", http.StatusNotImplemented)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		api.respondWithError(w, err)
+		return
+	}
+	var req storagesvc.PresignRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil || req.Size < 0 {
+		api.respondWithError(w, fission.MakeError(fission.ErrorInvalidArgument, "need the prefix, checksum and size of an upload"))
+		return
+	}
+	// a client may only upload to its own namespace's partition
+	err = storagesvc.CheckPartitionPrefix(req.Namespace, req.Prefix)
+	if err != nil {
+		api.respondWithError(w, fission.MakeError(fission.ErrorInvalidArgument, err.Error()))
+		return
+	}
+
+	expires := time.Now().Add(presignedUploadTTL)
+	u, id, err := storagesvc.PresignUpload(api.storageServicePublicUrl, api.storagePresignKey, req.Prefix, req.Checksum, req.Size, expires)
+	if err != nil {
+		api.respondWithError(w, fission.MakeError(fission.ErrorInvalidArgument, err.Error()))
+		return
+	}
+	resp, err := json.Marshal(&storagesvc.PresignResponse{URL: u, ID: id, Expires: expires})
+	if err != nil {
+		api.respondWithError(w, err)
+		return
+	}
+	api.respondWithSuccess(w, resp)
+}
+
+// StorageRegisterUploadApi confirms that an archive was stored by an
+// upload to a pre-signed URL, returning its stored size.
+func (api *API) StorageRegisterUploadApi(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		api.respondWithError(w, err)
+		return
+	}
+	var req storagesvc.RegisterUploadRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil || req.Checksum.Type != fission.ChecksumTypeSHA256 ||
+		!strings.HasSuffix(req.ID, storagesvc.ContentID("", req.Checksum.HexSum())) {
+		api.respondWithError(w, fission.MakeError(fission.ErrorInvalidArgument, "need the ID and sha256 checksum of an upload"))
+		return
+	}
+
+	client := &http.Client{Timeout: storageRequestTimeout}
+	resp, err := client.Head(fmt.Sprintf("%v/v1/archive?id=%v", api.storageServiceUrl, url.QueryEscape(req.ID)))
+	if err != nil {
+		api.respondWithError(w, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		api.respondWithError(w, fission.MakeErrorFromHTTPStatus(resp.StatusCode,
+			fmt.Sprintf("archive %v isn't stored: %v", req.ID, resp.Status)))
+		return
+	}
+	log.Printf("Registered pre-signed upload of %v, %v bytes", req.ID, resp.ContentLength)
+
+	out, err := json.Marshal(&storagesvc.RegisterUploadResponse{ID: req.ID, Size: resp.ContentLength})
+	if err != nil {
+		api.respondWithError(w, err)
+		return
+	}
+	api.respondWithSuccess(w, out)
+}
@@ -0,0 +1,151 @@
+package fetcher
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fission/fission"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+const (
+	// archiveCacheDir is where warm archives are cached, under the
+	// shared volume.
+	archiveCacheDir = ".archive-cache"
+
+	// warmInterval is how often the fetcher of a builder syncs its
+	// cache with the storage service's warm list.
+	warmInterval = time.Minute
+)
+
+// archiveCache holds copies of the stored bytes of the archives on
+// the storage service's warm list, named by checksum, so that builds
+// using them don't download them each time. Only warm archives are
+// cached; archives taken off the list are removed at the next sync.
+type archiveCache struct {
+	sync.Mutex
+	dir string
+}
+
+func (c *archiveCache) path(checksum fission.Checksum) string {
+	return filepath.Join(c.dir, string(checksum.Type)+"-"+checksum.HexSum())
+}
+
+// lookup returns the cached copy of an archive, if there is one.
+func (c *archiveCache) lookup(archive *fission.Archive) (string, bool) {
+	if len(archive.Checksum.Type) == 0 {
+		return "", false
+	}
+	path := c.path(archive.Checksum)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// unpackCached writes the decompressed contents of an archive's
+// cached copy to localPath, verifying its checksum again.
+func unpackCached(archive *fission.Archive, cached string, localPath string) error {
+	f, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	vr, err := newVerifyingReader(f, &archive.Checksum)
+	if err != nil {
+		return err
+	}
+	err = unpackStream(archive, vr, localPath)
+	if errors.Is(err, fission.ErrInvalidChecksum) {
+		// don't serve a corrupt copy again
+		os.Remove(cached)
+	}
+	return err
+}
+
+// sync downloads the warm archives not cached yet, verifying their
+// checksums, and removes cached archives no longer on the list.
+func (c *archiveCache) sync(ssClient *storageSvcClient.Client) error {
+	c.Lock()
+	defer c.Unlock()
+
+	warm, err := ssClient.WarmList()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	for _, a := range warm {
+		archive := &fission.Archive{Checksum: a.Checksum}
+		path := c.path(a.Checksum)
+		keep[filepath.Base(path)] = true
+		if _, ok := c.lookup(archive); ok {
+			continue
+		}
+		err := c.fetch(archive, ssClient.GetUrl(a.ID), path)
+		if err != nil {
+			log.Printf("Failed to cache warm archive %v: %v", a.ID, err)
+			continue
+		}
+		log.Printf("Cached warm archive %v (%v bytes)", a.ID, a.Size)
+	}
+
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !keep[e.Name()] {
+			os.Remove(filepath.Join(c.dir, e.Name()))
+		}
+	}
+	return nil
+}
+
+// fetch downloads an archive's stored bytes to path, verifying them.
+func (c *archiveCache) fetch(archive *fission.Archive, archiveUrl string, path string) error {
+	stream, err := DownloadVerified(archive, []string{archiveUrl})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, stream)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// WarmArchives keeps the fetcher's cache in sync with the warm list
+// of the storage service at storageSvcUrl, checking every
+// warmInterval. It's run by the fetchers of builders.
+func (fetcher *Fetcher) WarmArchives(storageSvcUrl string) {
+	ssClient := storageSvcClient.MakeClient(storageSvcUrl)
+	for {
+		err := fetcher.cache.sync(ssClient)
+		if err != nil {
+			log.Printf("Failed to sync warm archives: %v", err)
+		}
+		time.Sleep(warmInterval)
+	}
+}
@@ -9,6 +9,9 @@ import (
 )
 
 // Usage: fetcher <shared volume path>
+//
+// Builders' fetchers are given the storage service URL in
+// STORAGESVC_URL, and keep the archives on its warm list cached.
 func main() {
 	dir := os.Args[1]
 	if _, err := os.Stat(dir); err != nil {
@@ -20,6 +23,9 @@ func main() {
 		}
 	}
 	fetcher := fetcher.MakeFetcher(dir)
+	if storageSvcUrl := os.Getenv("STORAGESVC_URL"); len(storageSvcUrl) > 0 {
+		go fetcher.WarmArchives(storageSvcUrl)
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", fetcher.FetchHandler)
 	mux.HandleFunc("/upload", fetcher.UploadHandler)
@@ -1,11 +1,12 @@
 package fetcher
 
 import (
+	"compress/gzip"
 	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -53,6 +54,7 @@ type (
 		sharedVolumePath string
 		fissionClient    *tpr.FissionClient
 		kubeClient       *kubernetes.Clientset
+		cache            *archiveCache
 	}
 )
 
@@ -71,6 +73,7 @@ func MakeFetcher(sharedVolumePath string) *Fetcher {
 		sharedVolumePath: sharedVolumePath,
 		fissionClient:    fissionClient,
 		kubeClient:       kubeClient,
+		cache:            &archiveCache{dir: filepath.Join(sharedVolumePath, archiveCacheDir)},
 	}
 }
 
@@ -81,6 +84,10 @@ func downloadUrl(url string, localPath string) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP error %v", resp.Status)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
@@ -107,28 +114,225 @@ func getChecksum(path string) (*fission.Checksum, error) {
 		return nil, err
 	}
 
-	c := hex.EncodeToString(hasher.Sum(nil))
+	c := fission.MakeChecksum(fission.ChecksumTypeSHA256, hasher.Sum(nil))
+	return &c, nil
+}
 
-	return &fission.Checksum{
-		Type: fission.ChecksumTypeSHA256,
-		Sum:  c,
-	}, nil
+// verifyingReader hashes the bytes read through it and, when the
+// underlying reader is exhausted, returns a checksum error instead of
+// io.EOF if they don't match the expected checksum. Consumers of the
+// stream therefore fail as soon as the last byte arrives, before they
+// treat what they wrote as complete.
+type verifyingReader struct {
+	r        io.Reader
+	hasher   hash.Hash
+	checksum fission.Checksum
 }
 
-func verifyChecksum(path string, checksum *fission.Checksum) error {
-	if checksum.Type != fission.ChecksumTypeSHA256 {
-		return fission.MakeError(fission.ErrorInvalidArgument, "Unsupported checksum type")
+func newVerifyingReader(r io.Reader, checksum *fission.Checksum) (*verifyingReader, error) {
+	hasher, err := fission.NewChecksumHash(checksum.Type)
+	if err != nil {
+		return nil, err
 	}
-	c, err := getChecksum(path)
+	return &verifyingReader{r: r, hasher: hasher, checksum: *checksum}, nil
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.hasher.Write(p[:n])
+	if err == io.EOF {
+		c := fission.MakeChecksum(vr.checksum.Type, vr.hasher.Sum(nil))
+		if !c.Equal(vr.checksum) {
+			return n, fission.MakeError(fission.ErrorChecksumFail, "Checksum validation failed")
+		}
+	}
+	return n, err
+}
+
+// partsReader reads the concatenated bodies of a list of URLs,
+// requesting each one only when the previous one is exhausted. With
+// chunks, one per URL, each body is checked against its chunk's size
+// and checksum as it ends, so a bad chunk is caught, and named, before
+// the rest are downloaded.
+type partsReader struct {
+	urls   []string
+	chunks []fission.ArchiveChunk
+	next   int
+	body   io.ReadCloser
+
+	hasher hash.Hash
+	size   int64
+}
+
+// checkChunk checks the body just read against its chunk.
+func (pr *partsReader) checkChunk() error {
+	chunk := pr.chunks[pr.next-1]
+	if pr.size != chunk.Size {
+		return fission.MakeError(fission.ErrorChecksumFail,
+			fmt.Sprintf("chunk %v of %v is %v bytes, expected %v", pr.next, len(pr.urls), pr.size, chunk.Size))
+	}
+	if !fission.MakeChecksum(chunk.Checksum.Type, pr.hasher.Sum(nil)).Equal(chunk.Checksum) {
+		return fission.MakeError(fission.ErrorChecksumFail,
+			fmt.Sprintf("chunk %v of %v doesn't match its checksum", pr.next, len(pr.urls)))
+	}
+	return nil
+}
+
+func (pr *partsReader) Read(p []byte) (int, error) {
+	for {
+		if pr.body == nil {
+			if pr.next == len(pr.urls) {
+				return 0, io.EOF
+			}
+			resp, err := http.Get(pr.urls[pr.next])
+			if err != nil {
+				return 0, err
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return 0, fmt.Errorf("part %v of %v: HTTP error %v", pr.next+1, len(pr.urls), resp.Status)
+			}
+			pr.body = resp.Body
+			pr.next++
+			if pr.chunks != nil {
+				pr.hasher, err = fission.NewChecksumHash(pr.chunks[pr.next-1].Checksum.Type)
+				if err != nil {
+					pr.body.Close()
+					pr.body = nil
+					return 0, err
+				}
+				pr.size = 0
+			}
+		}
+		n, err := pr.body.Read(p)
+		if pr.chunks != nil {
+			pr.hasher.Write(p[:n])
+			pr.size += int64(n)
+		}
+		if err == io.EOF {
+			pr.body.Close()
+			pr.body = nil
+			if pr.chunks != nil {
+				if err := pr.checkChunk(); err != nil {
+					return n, err
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (pr *partsReader) Close() error {
+	if pr.body != nil {
+		return pr.body.Close()
+	}
+	return nil
+}
+
+// DownloadVerified returns a stream of an archive's stored bytes,
+// fetched from urls in turn (the parts of a split archive, or a single
+// URL). The stream fails with a checksum error at its end if the bytes
+// don't match the archive's checksum.
+func DownloadVerified(archive *fission.Archive, urls []string) (io.ReadCloser, error) {
+	pr := &partsReader{urls: urls}
+	if len(archive.Chunks) == len(urls) {
+		pr.chunks = archive.Chunks
+	}
+	vr, err := newVerifyingReader(pr, &archive.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{vr, pr}, nil
+}
+
+// decompressReader returns a reader of the decompressed contents of r.
+func decompressReader(r io.Reader, compression fission.ArchiveCompression) (io.Reader, error) {
+	switch compression {
+	case fission.ArchiveCompressionNone:
+		return r, nil
+	case fission.ArchiveCompressionGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fission.MakeError(fission.ErrorInvalidArgument,
+		fmt.Sprintf("Unsupported archive compression '%v'", compression))
+}
+
+// unpackVerified writes the decompressed contents of an archive
+// stored at urls to localPath in a single pass, verifying the
+// checksum of the stored bytes as they stream through. On any error,
+// including a checksum mismatch, the partially written file is
+// removed.
+func unpackVerified(archive *fission.Archive, urls []string, localPath string) error {
+	stream, err := DownloadVerified(archive, urls)
 	if err != nil {
 		return err
 	}
-	if c.Sum != checksum.Sum {
-		return fission.MakeError(fission.ErrorChecksumFail, "Checksum validation failed")
+	defer stream.Close()
+	return unpackStream(archive, stream, localPath)
+}
+
+// unpackStream writes the decompressed contents of a stream of an
+// archive's stored bytes to localPath, reading the stream to its end
+// so that a verifying stream checks the checksum. On any error the
+// partially written file is removed.
+func unpackStream(archive *fission.Archive, stream io.Reader, localPath string) error {
+	out, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		r, err := decompressReader(stream, archive.Compression)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		if err != nil {
+			return err
+		}
+		// the decompressor may stop before the end of the
+		// stream, where the checksum is checked
+		_, err = io.Copy(ioutil.Discard, stream)
+		return err
+	}()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(localPath)
+		return err
 	}
 	return nil
 }
 
+// downloadArchive writes an archive's decompressed contents to
+// localPath, verifying the checksum while downloading. An archive with
+// mirrors is downloaded from the copy that answers a probe fastest,
+// falling back to the others, nearest first, if it fails.
+// Split archives are reassembled from their parts and the combined
+// checksum verified.
+func downloadArchive(archive *fission.Archive, localPath string) error {
+	if len(archive.Parts) > 0 {
+		return unpackVerified(archive, archive.Parts, localPath)
+	}
+
+	var err error
+	for _, u := range orderByLatency(append([]string{archive.URL}, archive.Mirrors...)) {
+		err = unpackVerified(archive, []string{u}, localPath)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to fetch %v: %v", u, err)
+	}
+	return err
+}
+
 func (fetcher *Fetcher) FetchHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "only POST is supported on this endpoint", 405)
@@ -162,6 +366,9 @@ func (fetcher *Fetcher) FetchHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Start downloading...")
 
+	// unpacked is set when tmpPath is already unpacked
+	unpacked := false
+
 	if req.FetchType == FETCH_URL {
 		// fetch the file and save it to the tmp path
 		err := downloadUrl(req.Url, tmpPath)
@@ -180,38 +387,68 @@ func (fetcher *Fetcher) FetchHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, e, 500)
 			return
 		}
+		pkg, err = tpr.ResolvePackageAlias(pkg, func(namespace string, name string) (*tpr.Package, error) {
+			return fetcher.fissionClient.Packages(namespace).Get(name)
+		})
+		if err != nil {
+			e := fmt.Sprintf("Failed to resolve package alias %v: %v", req.Package.Name, err)
+			log.Printf(e)
+			http.Error(w, e, 500)
+			return
+		}
+
+		if pkg.Status.BuildStatus == fission.BuildStatusAwaitingUpload {
+			e := fmt.Sprintf("Package %v is awaiting upload; its archives haven't been committed", pkg.Metadata.Name)
+			log.Printf(e)
+			http.Error(w, e, 409)
+			return
+		}
 
 		var archive *fission.Archive
 		if req.FetchType == FETCH_SOURCE {
 			archive = &pkg.Spec.Source
 		} else if req.FetchType == FETCH_DEPLOYMENT {
-			archive = &pkg.Spec.Deployment
+			archive = pkg.Spec.DeploymentArchive()
 		}
 
-		// get package data as literal or by url
 		if len(archive.Literal) > 0 {
-			// write pkg.Literal into tmpPath
-			err = ioutil.WriteFile(tmpPath, archive.Literal, 0600)
+			err = fission.VerifyLiteral(archive)
 			if err != nil {
-				e := fmt.Sprintf("Failed to write file %v: %v", tmpPath, err)
+				e := fmt.Sprintf("Failed to verify package literal: %v", err)
 				log.Printf(e)
-				http.Error(w, e, 500)
+				http.Error(w, e, 400)
 				return
 			}
-		} else {
-			// download and verify
+		}
 
-			err = downloadUrl(archive.URL, tmpPath)
+		// get package data as literal or by url
+		if len(archive.Literal) > 0 || archive.Packing == fission.ArchivePackingTar {
+			tmpUnpackPath := filepath.Join(fetcher.sharedVolumePath, uuid.NewV4().String())
+			_, err = UnpackLiteral(archive, tmpUnpackPath)
 			if err != nil {
-				e := fmt.Sprintf("Failed to download url %v: %v", req.Url, err)
+				e := fmt.Sprintf("Failed to unpack literal to %v: %v", tmpUnpackPath, err)
 				log.Printf(e)
-				http.Error(w, e, 400)
+				http.Error(w, e, 500)
+				return
+			}
+			tmpPath = tmpUnpackPath
+			unpacked = true
+		} else if cached, ok := fetcher.cache.lookup(archive); ok {
+			// a warm archive, verify and decompress the
+			// cached copy
+			err = unpackCached(archive, cached, tmpPath)
+			if err != nil {
+				e := fmt.Sprintf("Failed to unpack cached archive %v: %v", cached, err)
+				log.Printf(e)
+				http.Error(w, e, 500)
 				return
 			}
+		} else {
+			// download, verify and decompress
 
-			err = verifyChecksum(tmpPath, &archive.Checksum)
+			err = downloadArchive(archive, tmpPath)
 			if err != nil {
-				e := fmt.Sprintf("Failed to verify checksum: %v", err)
+				e := fmt.Sprintf("Failed to download archive: %v", err)
 				log.Printf(e)
 				http.Error(w, e, 400)
 				return
@@ -220,10 +457,10 @@ func (fetcher *Fetcher) FetchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check file type here, if the file is a zip file unarchive it.
-	if archiver.Zip.Match(tmpPath) {
+	if !unpacked && archiver.Zip.Match(tmpPath) {
 		// unarchive tmp file to a tmp unarchive path
 		tmpUnarchivePath := filepath.Join(fetcher.sharedVolumePath, uuid.NewV4().String())
-		err = fetcher.unarchive(tmpPath, tmpUnarchivePath)
+		err = unarchive(tmpPath, tmpUnarchivePath)
 		if err != nil {
 			log.Println(err.Error())
 			http.Error(w, err.Error(), 500)
@@ -351,8 +588,39 @@ func (fetcher *Fetcher) archive(src string, dst string) error {
 	return archiver.Zip.Make(dst, files)
 }
 
+// UnpackLiteral writes the files of a literal archive to dst the way
+// functions and builders get them: packed files and zip files are
+// unpacked into the directory dst, anything else is written as the
+// file dst. It returns whether dst is a directory. The literal isn't
+// verified; callers check it with fission.VerifyLiteral first.
+func UnpackLiteral(archive *fission.Archive, dst string) (bool, error) {
+	if archive.Packing == fission.ArchivePackingTar {
+		// several files packed into the literal
+		err := fission.UnpackFiles(archive.Literal, dst)
+		if err != nil {
+			return false, fmt.Errorf("Failed to unpack files: %v", err)
+		}
+		return true, nil
+	}
+
+	tmpPath := dst + ".tmp"
+	err := ioutil.WriteFile(tmpPath, archive.Literal, 0600)
+	if err != nil {
+		return false, fmt.Errorf("Failed to write file %v: %v", tmpPath, err)
+	}
+	if !archiver.Zip.Match(tmpPath) {
+		return false, os.Rename(tmpPath, dst)
+	}
+	defer os.Remove(tmpPath)
+	err = unarchive(tmpPath, dst)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // unarchive is a function that unzips a zip file to destination
-func (fetcher *Fetcher) unarchive(src string, dst string) error {
+func unarchive(src string, dst string) error {
 	err := archiver.Zip.Open(src, dst)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Failed to unzip file: %v", err))
@@ -0,0 +1,65 @@
+package fetcher
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// mirrorProbeTimeout bounds how long a storage URL may take to answer
+// a probe before it is tried last.
+const mirrorProbeTimeout = 2 * time.Second
+
+// orderByLatency returns the URLs of an archive's copies, nearest
+// first: each is probed with a HEAD request at the same time, and
+// sorted by how long it took to answer. URLs that don't answer, or
+// not with OK, go last, in their given order, so that they are still
+// tried if every copy that answered fails to download.
+func orderByLatency(urls []string) []string {
+	if len(urls) < 2 {
+		return urls
+	}
+
+	type probe struct {
+		url     string
+		latency time.Duration
+		ok      bool
+	}
+	probes := make([]probe, len(urls))
+	client := &http.Client{Timeout: mirrorProbeTimeout}
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			probes[i].url = u
+			start := time.Now()
+			resp, err := client.Head(u)
+			if err != nil {
+				log.Printf("Failed to probe %v: %v", u, err)
+				return
+			}
+			resp.Body.Close()
+			probes[i].latency = time.Since(start)
+			probes[i].ok = resp.StatusCode == http.StatusOK
+		}(i, u)
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if probes[i].ok != probes[j].ok {
+			return probes[i].ok
+		}
+		return probes[i].ok && probes[i].latency < probes[j].latency
+	})
+	ordered := make([]string, len(probes))
+	for i, p := range probes {
+		ordered[i] = p.url
+		if p.ok {
+			log.Printf("Probed %v in %v", p.url, p.latency)
+		}
+	}
+	return ordered
+}
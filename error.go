@@ -17,12 +17,89 @@ limitations under the License.
 package fission
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// Errors returned by archive and storage operations, such as
+// creating, uploading or downloading package archives. They are usually
+// wrapped with more context, so check for them with errors.Is.
+var (
+	// ErrArchiveTooLarge means an archive exceeds a size limit of
+	// the storage service or the controller.
+	ErrArchiveTooLarge = errors.New("archive too large")
+
+	// ErrStorageUnavailable means the storage service couldn't be
+	// reached, or is temporarily unable to serve requests.
+	ErrStorageUnavailable = errors.New("storage service unavailable")
+
+	// ErrInvalidChecksum means an archive's contents don't match
+	// its checksum, or the checksum type isn't supported.
+	ErrInvalidChecksum = errors.New("invalid checksum")
+
+	// ErrArchiveNotFound means a stored archive is gone, e.g. it
+	// was deleted or expired.
+	ErrArchiveNotFound = errors.New("archive not found")
+)
+
+// MaxUploadSizeHeader is set by servers rejecting an upload with 413
+// Payload Too Large to the largest size they accept, in bytes.
+const MaxUploadSizeHeader = "X-Max-Upload-Size"
+
+// ArchiveTooLargeError is returned when a server rejects an archive
+// as too large. It matches ErrArchiveTooLarge with errors.Is.
+type ArchiveTooLargeError struct {
+	// Size of the rejected archive in bytes, 0 if unknown.
+	Size int64
+
+	// Limit is the server's advertised maximum in bytes, 0 if it
+	// didn't advertise one.
+	Limit int64
+}
+
+func (e *ArchiveTooLargeError) Error() string {
+	msg := ErrArchiveTooLarge.Error()
+	switch {
+	case e.Size > 0 && e.Limit > 0:
+		msg += fmt.Sprintf(": %v bytes, the server accepts at most %v", e.Size, e.Limit)
+	case e.Limit > 0:
+		msg += fmt.Sprintf(": the server accepts at most %v bytes", e.Limit)
+	case e.Size > 0:
+		msg += fmt.Sprintf(": %v bytes", e.Size)
+	}
+	return msg + "; make the archive smaller (e.g. ignore build outputs), split it into parts, or raise the server's upload limit"
+}
+
+func (e *ArchiveTooLargeError) Is(target error) bool {
+	return target == ErrArchiveTooLarge
+}
+
+// ArchiveTooLargeFromHTTP returns the error for a 413 response,
+// reading the server's limit from MaxUploadSizeHeader if present.
+func ArchiveTooLargeFromHTTP(resp *http.Response, size int64) *ArchiveTooLargeError {
+	limit, err := strconv.ParseInt(resp.Header.Get(MaxUploadSizeHeader), 10, 64)
+	if err != nil || limit < 0 {
+		limit = 0
+	}
+	return &ArchiveTooLargeError{Size: size, Limit: limit}
+}
+
+// Is lets errors.Is match API errors against the archive error set
+// above, by error code.
+func (err Error) Is(target error) bool {
+	switch target {
+	case ErrArchiveTooLarge:
+		return err.Code == ErrorSizeLimitExceeded
+	case ErrInvalidChecksum:
+		return err.Code == ErrorChecksumFail
+	}
+	return false
+}
+
 func (err Error) Error() string {
 	return fmt.Sprintf("%v - %v", err.Description(), err.Message)
 }
@@ -36,8 +113,21 @@ func MakeErrorFromHTTP(resp *http.Response) error {
 		return nil
 	}
 
+	msg := resp.Status
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil && len(body) > 0 {
+		msg = strings.TrimSpace(string(body))
+	}
+
+	return MakeErrorFromHTTPStatus(resp.StatusCode, msg)
+}
+
+// MakeErrorFromHTTPStatus returns the error for an HTTP status code
+// and message, as MakeErrorFromHTTP does for a response.
+func MakeErrorFromHTTPStatus(status int, msg string) Error {
 	var errCode int
-	switch resp.StatusCode {
+	switch status {
 	case 400:
 		errCode = ErrorInvalidArgument
 	case 403:
@@ -46,17 +136,11 @@ func MakeErrorFromHTTP(resp *http.Response) error {
 		errCode = ErrorNotFound
 	case 409:
 		errCode = ErrorNameExists
+	case 413:
+		errCode = ErrorSizeLimitExceeded
 	default:
 		errCode = ErrorInternal
 	}
-
-	msg := resp.Status
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err == nil && len(body) > 0 {
-		msg = strings.TrimSpace(string(body))
-	}
-
 	return MakeError(errCode, msg)
 }
 
@@ -71,6 +155,8 @@ func (err Error) HTTPStatus() int {
 		code = 404
 	case ErrorNameExists:
 		code = 409
+	case ErrorSizeLimitExceeded:
+		code = 413
 	default:
 		code = 500
 	}
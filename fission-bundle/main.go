@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/docopt/docopt-go"
 	"github.com/fission/fission/buildermgr"
@@ -65,8 +66,21 @@ func runStorageSvc(port int, filePath string) {
 	if len(subdir) == 0 {
 		subdir = "fission-functions"
 	}
-	storagesvc.RunStorageService(storagesvc.StorageTypeLocal,
-		filePath, subdir, port)
+	// the backend is picked by STORAGE_TYPE, and configured by
+	// STORAGE_OPT_<NAME> variables, e.g. credentials
+	storageType := storagesvc.StorageType(os.Getenv("STORAGE_TYPE"))
+	if len(storageType) == 0 {
+		storageType = storagesvc.StorageTypeLocal
+	}
+	options := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "STORAGE_OPT_") {
+			parts := strings.SplitN(strings.TrimPrefix(kv, "STORAGE_OPT_"), "=", 2)
+			options[strings.ToLower(parts[0])] = parts[1]
+		}
+	}
+	storagesvc.RunStorageServiceWithOptions(storageType,
+		filePath, subdir, port, options)
 }
 
 func runBuilderMgr(port int, storageSvcUrl string, envBuilderNamespace string) {
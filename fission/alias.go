@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/tpr"
+)
+
+// resolveAlias returns the package an alias package points at, through
+// the controller.
+func resolveAlias(client *client.Client, pkg *tpr.Package) (*tpr.Package, error) {
+	return tpr.ResolvePackageAlias(pkg, func(namespace string, name string) (*tpr.Package, error) {
+		return client.PackageGet(&metav1.ObjectMeta{Name: name, Namespace: namespace})
+	})
+}
+
+// makeAliasSpec returns the spec of an alias package named pkgName
+// pointing at target. The target must exist, be in environment
+// envName, and not lead back to pkgName.
+func makeAliasSpec(client *client.Client, pkgName, envName, target string) (*fission.PackageSpec, error) {
+	alias := &tpr.Package{
+		Metadata: metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace},
+		Spec: fission.PackageSpec{
+			Environment: fission.EnvironmentReference{
+				Namespace: packageNamespace,
+				Name:      envName,
+			},
+			AliasOf: &fission.PackageRef{
+				Namespace: packageNamespace,
+				Name:      target,
+			},
+		},
+	}
+	resolved, err := resolveAlias(client, alias)
+	if err != nil {
+		return nil, fmt.Errorf("resolve alias target %v: %w", target, err)
+	}
+	if len(envName) == 0 {
+		alias.Spec.Environment = resolved.Spec.Environment
+	} else if resolved.Spec.Environment.Name != envName {
+		return nil, fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("package %v is for environment %v, not %v", resolved.Metadata.Name, resolved.Spec.Environment.Name, envName))
+	}
+	return &alias.Spec, nil
+}
+
+// createAliasPackage creates a new alias package pointing at target.
+func createAliasPackage(client *client.Client, envName, target string, opts archiveOptions) (*metav1.ObjectMeta, error) {
+	// the alias name isn't known yet; it can't be part of a cycle
+	// through a package that exists
+	pkgSpec, err := makeAliasSpec(client, "", envName, target)
+	if err != nil {
+		return nil, err
+	}
+	m, err := saveNewPackage(client, pkgSpec, fission.BuildStatusSucceeded, opts)
+	if err != nil {
+		return nil, err
+	}
+	verbose("Created package %v, an alias of %v (request %v)", m.Name, target, requestId)
+	return m, nil
+}
+
+// updatePackageFunctions points the functions using a package at its
+// new resource version. Functions cache their package by resource
+// version, so they must be updated to pick up changes to it.
+func updatePackageFunctions(client *client.Client, m *metav1.ObjectMeta) error {
+	fns, err := client.FunctionList()
+	if err != nil {
+		return err
+	}
+	for i := range fns {
+		ref := &fns[i].Spec.Package.PackageRef
+		if ref.Name != m.Name || ref.Namespace != m.Namespace {
+			continue
+		}
+		ref.ResourceVersion = m.ResourceVersion
+		_, err = client.FunctionUpdate(&fns[i])
+		if err != nil {
+			return fmt.Errorf("update function %v: %w", fns[i].Metadata.Name, err)
+		}
+	}
+	return nil
+}
+
+func pkgAlias(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		fatalUsage("Need --name, the alias package to create or retarget.")
+	}
+	target := c.String("alias-of")
+	if len(target) == 0 {
+		fatalUsage("Need --alias-of, the package the alias points at.")
+	}
+
+	m := &metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace}
+	pkg, err := client.PackageGet(m)
+	if err != nil {
+		if fe, ok := err.(fission.Error); !ok || fe.Code != fission.ErrorNotFound {
+			checkErr(err, fmt.Sprintf("read package '%v'", pkgName))
+		}
+		pkgSpec, err := makeAliasSpec(client, pkgName, c.String("env"), target)
+		checkErr(err, "create alias")
+		_, err = savePackage(client, pkgName, pkgSpec, fission.BuildStatusSucceeded, nil)
+		checkErr(err, "create alias")
+		fmt.Printf("package '%v' created, an alias of '%v'\n", pkgName, target)
+		return nil
+	}
+
+	if pkg.Spec.AliasOf == nil {
+		fatal(fmt.Sprintf("Package '%v' exists and is not an alias.", pkgName))
+	}
+	pkgSpec, err := makeAliasSpec(client, pkgName, pkg.Spec.Environment.Name, target)
+	checkErr(err, "retarget alias")
+	previous := pkg.Spec.AliasOf.Name
+	pkg.Spec = *pkgSpec
+	newMeta, err := client.PackageUpdate(pkg)
+	checkErr(err, fmt.Sprintf("update package '%v'", pkgName))
+
+	err = updatePackageFunctions(client, newMeta)
+	checkErr(err, "update functions")
+	fmt.Printf("package '%v' now an alias of '%v' (was '%v')\n", pkgName, target, previous)
+	return nil
+}
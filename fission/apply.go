@@ -0,0 +1,484 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ghodss/yaml"
+	"github.com/satori/go.uuid"
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/tpr"
+)
+
+// Outcomes of a single item in a batch.
+const (
+	applyCreated     = "created"
+	applyFailed      = "failed"
+	applyInterrupted = "interrupted"
+	applySkipped     = "skipped"
+)
+
+type (
+	// applySpec is the JSON or YAML file read by "package apply"
+	// and "package reconcile".
+	applySpec struct {
+		Packages []applyItem `json:"packages"`
+
+		// dir holds the inline files of the packages, written
+		// out by readApplySpec; close removes it.
+		dir string
+	}
+
+	// applyItem describes one package to create. Name is
+	// optional; if it's empty the name is made from --label, or
+	// is random. SrcFiles and DeployFiles embed the files of an
+	// archive in the spec, instead of Src and Deploy naming them.
+	applyItem struct {
+		Name        string       `json:"name,omitempty"`
+		Env         string       `json:"env"`
+		Src         string       `json:"src,omitempty"`
+		Deploy      string       `json:"deploy,omitempty"`
+		SrcFiles    []inlineFile `json:"srcFiles,omitempty"`
+		DeployFiles []inlineFile `json:"deployFiles,omitempty"`
+		BuildCmd    string       `json:"buildcmd,omitempty"`
+
+		// srcArchive and deployArchive are the archives to
+		// create: Src and Deploy, or the inline files.
+		srcArchive    string
+		deployArchive string
+	}
+
+	// inlineFile is a file embedded in an apply spec. Content is
+	// base64 encoded, as encoding/json reads []byte.
+	inlineFile struct {
+		Name    string `json:"name"`
+		Content []byte `json:"content"`
+	}
+
+	// applyResult is the outcome of one item, as printed in the
+	// batch report.
+	applyResult struct {
+		Input   applyItem `json:"input"`
+		Outcome string    `json:"outcome"`
+		Package string    `json:"package,omitempty"`
+		Error   string    `json:"error,omitempty"`
+	}
+
+	// packageBatcher accumulates small packages from "package
+	// apply" and creates them with PackageCreateBatch, size at a
+	// time, instead of with a request each. done is called with
+	// each package's outcome.
+	packageBatcher struct {
+		sync.Mutex
+		client *client.Client
+		size   int
+		items  []int
+		pkgs   []*tpr.Package
+		done   func(item int, name string, err error)
+	}
+
+	// applyReport collects results as workers finish, so that a
+	// report can be printed at any point, including on interrupt.
+	applyReport struct {
+		sync.Mutex
+		Results []applyResult `json:"results"`
+	}
+)
+
+func readApplySpec(fileName string, inlineLimit int64) (*applySpec, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON, so this reads both, using the
+	// json field tags
+	var spec applySpec
+	err = yaml.Unmarshal(contents, &spec)
+	if err != nil {
+		return nil, fmt.Errorf("parse %v: %v", fileName, err)
+	}
+	for i := range spec.Packages {
+		item := &spec.Packages[i]
+		if len(item.Env) == 0 {
+			spec.close()
+			return nil, fmt.Errorf("package %v in %v: need env", i, fileName)
+		}
+		if len(item.Src) == 0 && len(item.Deploy) == 0 && len(item.SrcFiles) == 0 && len(item.DeployFiles) == 0 {
+			spec.close()
+			return nil, fmt.Errorf("package %v in %v: need src or deploy", i, fileName)
+		}
+		item.srcArchive, err = spec.inlineArchive(i, "src", item.Src, item.SrcFiles, inlineLimit)
+		if err == nil {
+			item.deployArchive, err = spec.inlineArchive(i, "deploy", item.Deploy, item.DeployFiles, inlineLimit)
+		}
+		if err != nil {
+			spec.close()
+			return nil, fmt.Errorf("package %v in %v: %w", i, fileName, err)
+		}
+	}
+	return &spec, nil
+}
+
+// inlineArchive returns the archive to create for the src or deploy
+// field of package i: fileName, or else the inline files, written
+// out to be embedded in the package like small files given on the
+// command line. Inline files must fit in an embedded archive; larger
+// ones belong in an archive of their own; inlineLimit is the size
+// limit of an embedded archive.
+func (spec *applySpec) inlineArchive(i int, field string, fileName string, files []inlineFile, inlineLimit int64) (string, error) {
+	if len(files) == 0 {
+		return fileName, nil
+	}
+	if len(fileName) > 0 {
+		return "", fmt.Errorf("%v and %vFiles can't be used together", field, field)
+	}
+
+	var size int64
+	names := make(map[string]bool)
+	for _, f := range files {
+		if len(f.Name) == 0 || f.Name != filepath.Base(f.Name) || f.Name == "." || f.Name == ".." || strings.Contains(f.Name, ",") {
+			return "", fmt.Errorf("%vFiles: invalid file name '%v', use a name without directories or commas", field, f.Name)
+		}
+		if names[f.Name] {
+			return "", fmt.Errorf("%vFiles: %v is given more than once", field, f.Name)
+		}
+		names[f.Name] = true
+		size += int64(len(f.Content))
+	}
+	if size >= inlineLimit {
+		return "", fission.MakeError(fission.ErrorSizeLimitExceeded,
+			fmt.Sprintf("%vFiles are %v, more than the %v limit for an embedded archive; put them in an archive and give its path as %v instead",
+				field, formatSize(size), formatSize(inlineLimit), field))
+	}
+
+	if len(spec.dir) == 0 {
+		dir, err := ioutil.TempDir("", "fission-inline-")
+		if err != nil {
+			return "", err
+		}
+		spec.dir = dir
+	}
+	dir := filepath.Join(spec.dir, fmt.Sprintf("%v-%v", i, field))
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	paths := make([]string, len(files))
+	for j, f := range files {
+		paths[j] = filepath.Join(dir, f.Name)
+		err = ioutil.WriteFile(paths[j], f.Content, 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+	// several files are packed together, as a comma separated
+	// list of files given on the command line is
+	return strings.Join(paths, ","), nil
+}
+
+// close removes the inline files written out for the spec.
+func (spec *applySpec) close() {
+	if len(spec.dir) > 0 {
+		os.RemoveAll(spec.dir)
+	}
+}
+
+// input describes the archive an item is made from, for reports.
+func (item *applyItem) input() string {
+	switch {
+	case len(item.Src) > 0:
+		return item.Src
+	case len(item.Deploy) > 0:
+		return item.Deploy
+	case len(item.SrcFiles) > 0:
+		return "(inline src)"
+	}
+	return "(inline deploy)"
+}
+
+func (r *applyReport) set(i int, result applyResult) {
+	r.Lock()
+	defer r.Unlock()
+	r.Results[i] = result
+}
+
+// counts returns the number of created and not created items.
+func (r *applyReport) counts() (created int, notCreated int) {
+	for _, res := range r.Results {
+		if res.Outcome == applyCreated {
+			created++
+		} else {
+			notCreated++
+		}
+	}
+	return created, notCreated
+}
+
+// print writes the report as a table or as JSON. It must be called
+// with the report locked.
+func (r *applyReport) print(output string) error {
+	if output == "json" {
+		out, err := json.MarshalIndent(r, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	t := newTable("INPUT", "OUTCOME", "PACKAGE", "ERROR")
+	for _, res := range r.Results {
+		t.addRow(res.Input.input(), res.Outcome, res.Package, res.Error)
+	}
+	return t.print(os.Stdout, output)
+}
+
+// add queues a package for creation, creating the queued packages if
+// there are enough of them.
+func (b *packageBatcher) add(item int, pkg *tpr.Package) {
+	b.Lock()
+	b.items = append(b.items, item)
+	b.pkgs = append(b.pkgs, pkg)
+	if len(b.pkgs) < b.size {
+		b.Unlock()
+		return
+	}
+	items, pkgs := b.items, b.pkgs
+	b.items, b.pkgs = nil, nil
+	b.Unlock()
+	b.create(items, pkgs)
+}
+
+// flush creates the queued packages.
+func (b *packageBatcher) flush() {
+	b.Lock()
+	items, pkgs := b.items, b.pkgs
+	b.items, b.pkgs = nil, nil
+	b.Unlock()
+	if len(pkgs) > 0 {
+		b.create(items, pkgs)
+	}
+}
+
+func (b *packageBatcher) create(items []int, pkgs []*tpr.Package) {
+	verbose("Creating %v packages in a batch", len(pkgs))
+	results, err := b.client.PackageCreateBatch(pkgs)
+	for i, item := range items {
+		if i >= len(results) {
+			b.done(item, "", fmt.Errorf("create package: %w", err))
+			continue
+		}
+		if results[i].Err != nil {
+			b.done(item, "", fmt.Errorf("create package: %w", results[i].Err))
+			continue
+		}
+		b.done(item, results[i].Metadata.Name, nil)
+	}
+}
+
+// isBatchable returns true if a package can be created by a
+// packageBatcher: its archives are embedded, so creating it is a
+// single cheap request, and its name doesn't depend on what already
+// exists, as labeled names do.
+func isBatchable(item applyItem, pkgSpec *fission.PackageSpec, opts archiveOptions) bool {
+	if len(item.Name) == 0 && len(opts.label) > 0 {
+		return false
+	}
+	for _, archive := range []*fission.Archive{&pkgSpec.Source, &pkgSpec.Deployment} {
+		if len(archive.Type) > 0 && archive.Type != fission.ArchiveTypeLiteral {
+			return false
+		}
+	}
+	return true
+}
+
+// applyPackage creates the package for an item. If batcher isn't nil
+// and the package is small, it's queued on the batcher instead and
+// applyPackage returns true.
+func applyPackage(client *client.Client, batcher *packageBatcher, i int, item applyItem, opts archiveOptions) (string, bool, error) {
+	if len(item.Name) > 0 {
+		// creating it fails below, with the error saying why
+		// rather than that the quota is full
+		pkg, err := client.PackageGet(&metav1.ObjectMeta{Name: item.Name, Namespace: packageNamespace})
+		opts.updatesPackage = err == nil
+		if err == nil {
+			opts.loggedArchives = loggedArchives(&pkg.Spec)
+		}
+	}
+	pkgSpec, pkgStatus, err := makePackageSpec(client, item.Env, item.srcArchive, item.deployArchive, item.BuildCmd, opts)
+	if err != nil {
+		return "", false, err
+	}
+	if batcher != nil && isBatchable(item, pkgSpec, opts) {
+		name := item.Name
+		if len(name) == 0 {
+			name = strings.ToLower(uuid.NewV4().String())
+		}
+		batcher.add(i, &tpr.Package{
+			Metadata: metav1.ObjectMeta{Name: name, Namespace: packageNamespace},
+			Spec:     *pkgSpec,
+			Status:   fission.PackageStatus{BuildStatus: pkgStatus},
+		})
+		return "", true, nil
+	}
+	var m *metav1.ObjectMeta
+	if len(item.Name) > 0 {
+		m, err = savePackage(client, item.Name, pkgSpec, pkgStatus, nil)
+	} else {
+		m, err = saveNewPackage(client, pkgSpec, pkgStatus, opts)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return m.Name, false, nil
+}
+
+func pkgApply(c *cli.Context) error {
+	fileName := c.String("file")
+	if len(fileName) == 0 {
+		fatalUsage("Need --file, a JSON or YAML file listing the packages to create.")
+	}
+	output := c.String("output")
+	checkOutputFormat(output)
+	parallel := c.Int("parallel")
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	client := getClient(c.GlobalString("server"))
+
+	opts := getArchiveOptions(c)
+	spec, err := readApplySpec(fileName, opts.inlineLimit)
+	checkErr(err, "read package list")
+	if opts.progress {
+		// one line for the whole batch; each upload's own bar
+		// only with --verbose
+		opts.batch = newBatchProgress(os.Stderr, len(spec.Packages), verboseOutput)
+	}
+
+	report := &applyReport{Results: make([]applyResult, len(spec.Packages))}
+	for i, item := range spec.Packages {
+		report.Results[i] = applyResult{Input: item, Outcome: applySkipped}
+	}
+
+	var batcher *packageBatcher
+	if batchSize := c.Int("batch-size"); batchSize > 1 {
+		batcher = &packageBatcher{
+			client: client,
+			size:   batchSize,
+			done: func(i int, name string, err error) {
+				result := applyResult{Input: spec.Packages[i], Outcome: applyCreated, Package: name}
+				if err != nil {
+					result = applyResult{Input: spec.Packages[i], Outcome: applyFailed, Error: err.Error()}
+				}
+				report.set(i, result)
+				if opts.batch != nil {
+					opts.batch.done(err != nil)
+				}
+			},
+		}
+	}
+
+	work := make(chan int)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				item := spec.Packages[i]
+				report.set(i, applyResult{Input: item, Outcome: applyInterrupted})
+
+				name, queued, err := applyPackage(client, batcher, i, item, opts)
+				if queued {
+					// the batcher reports it once created
+					continue
+				}
+				result := applyResult{Input: item, Outcome: applyCreated, Package: name}
+				if err != nil {
+					result = applyResult{Input: item, Outcome: applyFailed, Error: err.Error()}
+				}
+				report.set(i, result)
+				if opts.batch != nil {
+					opts.batch.done(err != nil)
+				}
+			}
+		}()
+	}
+	go func() {
+		for i := range spec.Packages {
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+		if batcher != nil {
+			batcher.flush()
+		}
+		close(done)
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var interrupted bool
+	select {
+	case <-done:
+	case <-sigs:
+		interrupted = true
+	}
+	if opts.batch != nil {
+		opts.batch.finish()
+	}
+	if interrupted {
+		fmt.Fprintln(os.Stderr, "Interrupted, reporting completed packages")
+	}
+
+	// Items still running when interrupted stay "interrupted" and
+	// unstarted ones "skipped"; the lock keeps workers from
+	// changing results while we print.
+	report.Lock()
+	defer report.Unlock()
+	err = report.print(output)
+	spec.close()
+	checkErr(err, "print report")
+
+	created, notCreated := report.counts()
+	if notCreated == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%v of %v packages were not created", notCreated, len(report.Results))
+	if created == 0 {
+		fatal(msg)
+	}
+	fatalWithCode(exitCodePartialFailure, msg)
+	return nil
+}
@@ -0,0 +1,1708 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/packager"
+	"github.com/fission/fission/storagesvc"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+const (
+	// defaultScanConcurrency bounds the number of files hashed
+	// (and therefore open) at the same time during a pre-scan.
+	defaultScanConcurrency = 8
+
+	// largeArchiveSize is the total directory size above which
+	// the user is asked to confirm before packing.
+	largeArchiveSize int64 = 100 * 1024 * 1024
+
+	// manifestLiteralSizeLimit is the largest manifest embedded in
+	// the package; bigger ones are uploaded to the storage service.
+	manifestLiteralSizeLimit = 16 * 1024
+
+	// probeTimeout bounds the --probe request for an uploaded
+	// archive's URL.
+	probeTimeout = 5 * time.Second
+
+	// defaultMaxConcurrentUploads is the default for the global
+	// --max-concurrent-uploads flag.
+	defaultMaxConcurrentUploads = 4
+
+	// defaultQPS and defaultBurst are the defaults for the global
+	// --qps and --burst flags, limiting the rate of controller
+	// requests.
+	defaultQPS   = 20
+	defaultBurst = 40
+
+	// progressUpdatesPerSecond bounds how often the --progress
+	// bar is redrawn.
+	progressUpdatesPerSecond = 10
+
+	// lowMemoryBufferSize caps the read buffer with --low-memory.
+	lowMemoryBufferSize = 64 * 1024
+)
+
+// fetcherCompressions are the codecs the fetcher can decompress
+// before handing an archive to a builder or runtime.
+var fetcherCompressions = map[fission.ArchiveCompression]bool{
+	fission.ArchiveCompressionNone: true,
+	fission.ArchiveCompressionGzip: true,
+}
+
+type (
+	// archiveOptions controls how createArchive packs and
+	// uploads archives.
+	archiveOptions struct {
+		// prescan computes per-file checksums before a
+		// directory is packed.
+		prescan bool
+
+		// scanConcurrency is the max number of files hashed
+		// concurrently during a pre-scan.
+		scanConcurrency int
+
+		// assumeYes skips confirmation prompts.
+		assumeYes bool
+
+		// storagePrefix namespaces uploaded archive IDs in
+		// the storage service, e.g. "env/python/".
+		storagePrefix string
+
+		// bufferSize is the read buffer size used to hash and
+		// upload archives.
+		bufferSize int
+
+		// compression is the --compress value: "none", "gzip",
+		// "zstd", or empty for the default.
+		compression string
+
+		// compressionLevel is the --compression-level value, or
+		// zero for the codec's default.
+		compressionLevel int
+
+		// ignore holds glob patterns of files and directories
+		// left out of directory archives. Patterns are matched
+		// against both the relative path and the base name.
+		ignore []string
+
+		// maxFileSize leaves files larger than this many bytes
+		// out of directory archives, or fails if
+		// failLargeFiles is set. Zero means no limit.
+		maxFileSize    int64
+		failLargeFiles bool
+
+		// withManifest stores a manifest of per-file checksums
+		// alongside each archive.
+		withManifest bool
+
+		// probe is the --probe value: "warn" or "fail" check
+		// that uploaded archive URLs are fetchable, and either
+		// warn or fail if not. Empty skips the check.
+		probe string
+
+		// noDefaultBuild leaves the build command empty rather
+		// than using the environment's default.
+		noDefaultBuild bool
+
+		// mirrors are storage service URLs that uploaded
+		// archives are also copied to.
+		mirrors []string
+
+		// strictBuildLint fails on build command lint warnings
+		// instead of printing them.
+		strictBuildLint bool
+
+		// strictEnv fails on warnings that the archives don't
+		// suit their environment's language version instead of
+		// printing them.
+		strictEnv bool
+
+		// transforms are names of fission.ArchiveTransforms run
+		// over the packed archive, in order, before upload.
+		transforms []string
+
+		// label names packages after their environment, the
+		// label and their contents, instead of randomly.
+		label string
+
+		// saveArchive is a file or directory to save a copy of
+		// the uploaded bytes to.
+		saveArchive string
+
+		// buildEnv and buildEnvSecrets are the --build-env
+		// KEY=value and --build-env-secret KEY=secret/key flags.
+		buildEnv        []string
+		buildEnvSecrets []string
+
+		// preBuild and postBuild are the --pre-build and
+		// --post-build hooks of the package's build.
+		preBuild  []string
+		postBuild []string
+
+		// buildSecrets and buildConfigMaps are the --build-secret
+		// and --build-configmap names the builder mounts for the
+		// build; skipRefCheck creates the package without
+		// checking they exist.
+		buildSecrets    []string
+		buildConfigMaps []string
+		skipRefCheck    bool
+
+		// rehost copies archives given as URLs to the storage
+		// service instead of referring to the URL.
+		rehost bool
+
+		// progress shows a progress bar on stderr during uploads.
+		progress bool
+
+		// batch, if set, aggregates the progress of the uploads
+		// of a batch of packages, replacing their own bars.
+		batch *batchProgress
+
+		// partSize splits uploads larger than this many bytes
+		// into parts of this size. Zero means no splitting.
+		partSize int64
+
+		// chunkSize splits uploads into chunks of about this
+		// many bytes at content-defined boundaries, so chunks
+		// shared with other archives are stored once. Zero
+		// means no chunking.
+		chunkSize int64
+
+		// deltaBase maps the sha256 checksums of chunks known
+		// to be stored to their URLs, which chunks with those
+		// checksums reuse without asking the storage service;
+		// see "package watch --delta".
+		deltaBase map[string]string
+
+		// gitTree identifies directory archives by their git
+		// tree, reusing existing archives of the same tree.
+		gitTree bool
+
+		// inlineLimit is the size below which archives are
+		// embedded in the package.
+		inlineLimit int64
+
+		// aliasOf makes createPackage create an alias of this
+		// package instead of a package with archives.
+		aliasOf string
+
+		// deferUpload makes createPackage declare the package,
+		// awaiting upload, and leave creating its archives to
+		// "package commit".
+		deferUpload bool
+
+		// archiveTTL makes the storage service delete uploaded
+		// archives this long after the upload. Zero keeps them.
+		archiveTTL time.Duration
+
+		// forceArchiveTTL allows archiveTTL for packages that
+		// back a function, which stop working once it passes.
+		forceArchiveTTL bool
+
+		// sbom and attestation are files stored with the
+		// package: a software bill of materials and an in-toto
+		// attestation of its archives.
+		sbom        string
+		attestation string
+
+		// builderImage builds the package with this image
+		// instead of the environment's builder.
+		builderImage string
+
+		// noHints leaves hints about their contents off
+		// archives.
+		noHints bool
+
+		// checksum is the sha256 of the archive file computed
+		// beforehand, trusted instead of hashing the file;
+		// checksumSize, if set, is the size it was computed
+		// over, checked first.
+		checksum     string
+		checksumSize int64
+
+		// fromImage is an image whose files under imagePath
+		// make the deployment archive.
+		fromImage string
+		imagePath string
+
+		// noBuildOverwrite refuses a deployment archive given
+		// with a source archive; deploymentPolicy otherwise
+		// decides which of them functions use once built.
+		noBuildOverwrite bool
+		deploymentPolicy fission.DeploymentPolicy
+
+		// stdinName names the file read from stdin for the
+		// archive "-".
+		stdinName string
+
+		// files, if set, are the contents of the archive, held
+		// in memory, by slash separated path, rather than the
+		// file it's named by.
+		files map[string][]byte
+
+		// skipQuota creates packages without checking the
+		// config file's package quota. updatesPackage makes the
+		// spec of a package that exists already, which the quota
+		// has counted, so it isn't checked either.
+		skipQuota      bool
+		updatesPackage bool
+
+		// gitMetadata records the git checkout packages are
+		// made from in annotations, which are set on the
+		// packages created; allowDirty doesn't warn when the
+		// checkout has uncommitted changes.
+		gitMetadata bool
+		allowDirty  bool
+		annotations map[string]string
+
+		// archiveName is the file name uploaded archives are
+		// downloaded as; packageName, the name of the package
+		// they're made for if given, is the default.
+		archiveName string
+		packageName string
+
+		// uploadTimeout bounds the upload of each archive to
+		// the storage service. Zero means no limit.
+		uploadTimeout time.Duration
+
+		// secrets scans archives for secrets before they are
+		// stored. Nil means no scan.
+		secrets *secretScanner
+
+		// transparencyLog is the URL of a transparency log to
+		// record archive checksums in, if set. loggedArchives
+		// are the entries of the package being updated, by
+		// SHA256, which the archives it keeps reuse.
+		transparencyLog string
+		loggedArchives  map[string]*fission.TransparencyEntry
+
+		// strictLayout fails on files missing from the archive
+		// layout the environment declares, instead of warning;
+		// noLayoutCheck skips the check.
+		strictLayout  bool
+		noLayoutCheck bool
+
+		// sizeLimit is the largest archive stored, in bytes, as
+		// declared by sizeLimitOwner; zero for no limit.
+		// noSizeCheck skips fetching it.
+		sizeLimit      int64
+		sizeLimitOwner string
+		noSizeCheck    bool
+
+		// archiveTags are the --archive-tag key=value tags
+		// uploaded archives are given.
+		archiveTags map[string]string
+
+		// noBuilderCheck creates source packages in environments
+		// without a builder, with a warning instead of an error.
+		noBuilderCheck bool
+
+		// rangeChecksums records the checksums of fixed size
+		// ranges of uploaded archives, for sampled verification.
+		rangeChecksums bool
+
+		// lowMemory bounds memory use for huge archives: small
+		// buffers, a single hashing worker, and upload bodies
+		// assembled on disk rather than in memory.
+		lowMemory bool
+
+		// presignedUpload uploads archives to pre-signed URLs the
+		// controller issues, rather than through its proxy.
+		presignedUpload bool
+
+		// resumableUpload uploads archives in chunks, resuming
+		// an interrupted upload of the same archive.
+		resumableUpload bool
+
+		// embedBuildInfo adds a build info file to directory and
+		// layout archives; reproducible packs directories
+		// deterministically, and leaves the time out of it.
+		embedBuildInfo bool
+		reproducible   bool
+
+		// verifyReproducible packs directories and layout files
+		// twice, failing if the archives differ.
+		verifyReproducible bool
+
+		// waitScan waits for the storage service's malware
+		// scan of uploaded archives.
+		waitScan bool
+
+		// namespaceIsolation stores archives in the storage
+		// partition of the package's namespace.
+		namespaceIsolation bool
+	}
+
+	// ArchivePlan is the decision of how to store an archive of
+	// a given size, as made by planArchive.
+	ArchivePlan struct {
+		// Inline is true if the archive is embedded in the
+		// package, false if it's uploaded to the storage
+		// service.
+		Inline bool
+
+		// Confirm is true if the archive is large enough that
+		// the user should confirm before it is packed.
+		Confirm bool
+
+		// Reason explains the decision, for messages.
+		Reason string
+	}
+
+	// scanEntry describes one regular file found in a directory
+	// scan. Checksum is only set if the scan was a pre-scan.
+	scanEntry struct {
+		path     string
+		relPath  string
+		info     os.FileInfo
+		checksum string
+
+		// contents, if set, are the file's contents, for files
+		// held in memory rather than at path.
+		contents []byte
+	}
+
+	// dirScan is the result of walking a directory that is
+	// going to be packed.
+	dirScan struct {
+		root      string
+		entries   []scanEntry
+		totalSize int64
+
+		// excluded are the files left out for being larger
+		// than the maximum file size.
+		excluded []scanEntry
+
+		// deterministic scans are packed with fixed modification
+		// times and modes, so the zip only depends on the files'
+		// paths and contents.
+		deterministic bool
+	}
+)
+
+// structure returns the structure fingerprint of the scanned files,
+// with the modes they are packed with.
+func (scan *dirScan) structure() string {
+	entries := make([]fission.StructureEntry, len(scan.entries))
+	for i, e := range scan.entries {
+		mode := e.info.Mode()
+		if scan.deterministic {
+			mode = packager.DeterministicMode(mode)
+		}
+		entries[i] = fission.StructureEntry{Path: e.relPath, Mode: mode}
+	}
+	return fission.ArchiveStructure(entries)
+}
+
+// getArchiveOptions reads archive related flags from the command
+// line.
+func getArchiveOptions(c *cli.Context) archiveOptions {
+	opts := archiveOptions{
+		prescan:          c.Bool("prescan"),
+		scanConcurrency:  c.Int("prescan-concurrency"),
+		assumeYes:        c.Bool("yes"),
+		storagePrefix:    c.String("storage-prefix"),
+		bufferSize:       c.Int("buffer-size"),
+		compression:      c.String("compress"),
+		compressionLevel: c.Int("compression-level"),
+		ignore:           c.StringSlice("ignore"),
+		maxFileSize:      int64(c.Int("max-file-size")) * 1024 * 1024,
+		failLargeFiles:   c.Bool("fail-large-files"),
+		withManifest:     c.Bool("with-manifest"),
+		probe:            c.String("probe"),
+		noDefaultBuild:   c.Bool("no-default-build"),
+		mirrors:          c.StringSlice("mirror-storage-url"),
+		strictBuildLint:  c.Bool("strict-build-lint"),
+		strictEnv:        c.Bool("strict-env"),
+		transforms:       c.StringSlice("transform"),
+		label:            c.String("label"),
+		saveArchive:      c.String("save-archive"),
+		buildEnv:         c.StringSlice("build-env"),
+		buildEnvSecrets:  c.StringSlice("build-env-secret"),
+		preBuild:         c.StringSlice("pre-build"),
+		postBuild:        c.StringSlice("post-build"),
+		buildSecrets:     c.StringSlice("build-secret"),
+		buildConfigMaps:  c.StringSlice("build-configmap"),
+		skipRefCheck:     c.Bool("skip-ref-check"),
+		rehost:           c.Bool("rehost"),
+		progress:         c.Bool("progress"),
+		partSize:         int64(c.Int("part-size")) * 1024 * 1024,
+		chunkSize:        int64(c.Int("chunk-size")) * 1024,
+		gitTree:          c.Bool("git-tree"),
+		aliasOf:          c.String("alias-of"),
+		deferUpload:      c.Bool("defer-upload"),
+		forceArchiveTTL:  c.Bool("force-archive-ttl"),
+		sbom:             c.String("sbom"),
+		attestation:      c.String("attestation"),
+		builderImage:     c.String("builder-image"),
+		noHints:          c.Bool("no-hints"),
+		checksum:         c.String("checksum"),
+		checksumSize:     int64(c.Int("checksum-size")),
+		fromImage:        c.String("from-image"),
+		imagePath:        c.String("image-path"),
+		noBuildOverwrite: c.Bool("no-build-overwrite"),
+		deploymentPolicy: fission.DeploymentPolicy(c.String("deployment-policy")),
+		stdinName:        c.String("stdin-name"),
+		skipQuota:        c.Bool("skip-quota"),
+		gitMetadata:      c.Bool("git-metadata"),
+		allowDirty:       c.Bool("allow-dirty"),
+		archiveName:      c.String("archive-name"),
+		uploadTimeout:    c.Duration("upload-timeout"),
+		transparencyLog:  c.String("transparency-log"),
+		strictLayout:     c.Bool("strict-layout"),
+		noLayoutCheck:    c.Bool("no-layout-check"),
+		noBuilderCheck:   c.Bool("no-builder-check"),
+		archiveTags:      parseArchiveTags(c.StringSlice("archive-tag")),
+		noSizeCheck:      c.Bool("no-size-check"),
+		rangeChecksums:   c.Bool("range-checksums"),
+		lowMemory:        c.Bool("low-memory"),
+		presignedUpload:  c.Bool("presigned-upload"),
+		resumableUpload:  c.Bool("resumable-upload"),
+		embedBuildInfo:   c.Bool("embed-build-info"),
+		reproducible:     c.Bool("reproducible"),
+
+		namespaceIsolation: c.Bool("namespace-isolation"),
+		verifyReproducible: c.Bool("verify-reproducible"),
+		waitScan:           c.Bool("wait-scan"),
+	}
+	if opts.scanConcurrency <= 0 {
+		opts.scanConcurrency = defaultScanConcurrency
+	}
+	if c.Bool("normalize-eol") {
+		opts.transforms = append(opts.transforms, fission.NormalizeEOLTransform)
+	}
+	if ttl := c.String("archive-ttl"); len(ttl) > 0 {
+		d, err := parseAge(ttl)
+		if err != nil || d <= 0 {
+			fatal(fmt.Sprintf("Bad --archive-ttl '%v', use e.g. 36h or 7d.", ttl))
+		}
+		opts.archiveTTL = d
+	}
+	if c.Bool("scan-secrets") || c.Bool("block-secrets") || len(c.String("secret-rules")) > 0 || len(c.String("secret-allowlist")) > 0 {
+		scanner, err := makeSecretScanner(c.String("secret-rules"), c.String("secret-allowlist"), c.Bool("block-secrets"))
+		if err != nil {
+			fatal(err.Error())
+		}
+		opts.secrets = scanner
+	}
+	if opts.uploadTimeout < 0 {
+		fatal(fmt.Sprintf("Bad --upload-timeout '%v', use e.g. 30m, or 0 for no limit.", opts.uploadTimeout))
+	}
+	if opts.resumableUpload && opts.presignedUpload {
+		fatalUsage("--resumable-upload and --presigned-upload can't be used together.")
+	}
+	if strings.ContainsAny(opts.archiveName, `/\`) {
+		fatal(fmt.Sprintf("--archive-name '%v' must be a file name, without directories.", opts.archiveName))
+	}
+	if opts.deploymentPolicy == "overwrite" {
+		opts.deploymentPolicy = fission.DeploymentPolicyOverwrite
+	}
+	if err := fission.ValidateDeploymentPolicy(opts.deploymentPolicy); err != nil {
+		fatal(err.Error())
+	}
+	archiveFlagDefaults(c, &opts)
+	if opts.chunkSize < 0 {
+		fatalUsage(fmt.Sprintf("Bad --chunk-size %v, use a size in KiB, or 0 for no chunking.", opts.chunkSize/1024))
+	}
+	if opts.chunkSize > 0 {
+		if opts.partSize > 0 && opts.chunkSize*4 > opts.partSize {
+			fatalUsage("--chunk-size makes chunks of up to 4 times its size, more than --part-size.")
+		}
+		switch opts.compression {
+		case "":
+			opts.compression = "none"
+		case "none":
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: archives compressed with --compress %v share few chunks with other archives\n", opts.compression)
+		}
+	}
+	if opts.lowMemory {
+		if opts.bufferSize <= 0 || opts.bufferSize > lowMemoryBufferSize {
+			opts.bufferSize = lowMemoryBufferSize
+		}
+		opts.scanConcurrency = 1
+		// transforms work on whole files in memory
+		if len(opts.transforms) > 0 {
+			fatalUsage("--transform and --normalize-eol can't be used with --low-memory.")
+		}
+	}
+	return opts
+}
+
+// defaultArchiveOptions returns the archive options of commands
+// without archive flags, such as upgrade: the flags' defaults, with
+// those of the config file.
+func defaultArchiveOptions() archiveOptions {
+	opts := archiveOptions{
+		scanConcurrency: defaultScanConcurrency,
+		bufferSize:      storageSvcClient.DefaultBufferSize,
+		compression:     config.Compress,
+		storagePrefix:   config.StoragePrefix,
+		inlineLimit:     config.InlineLimit,
+	}
+	if config.BufferSize > 0 {
+		opts.bufferSize = config.BufferSize
+	}
+	return opts
+}
+
+// uploadPrefix returns the prefix archives are uploaded with: the
+// --storage-prefix, within the partition of the package's namespace
+// with --namespace-isolation.
+func (opts archiveOptions) uploadPrefix() string {
+	if opts.namespaceIsolation {
+		return storagesvc.NamespacePrefix(packageNamespace) + opts.storagePrefix
+	}
+	return opts.storagePrefix
+}
+
+// archiveClientOptions returns the storage client options for
+// uploading archives with opts.
+func archiveClientOptions(opts archiveOptions) []storageSvcClient.ClientOption {
+	ssOpts := []storageSvcClient.ClientOption{
+		storageSvcClient.WithBufferSize(opts.bufferSize),
+		storageSvcClient.WithNamespace(packageNamespace),
+	}
+	if opts.archiveTTL > 0 {
+		ssOpts = append(ssOpts, storageSvcClient.WithArchiveTTL(opts.archiveTTL))
+	}
+	if opts.lowMemory {
+		ssOpts = append(ssOpts, storageSvcClient.WithSpillToDisk(stagingDir()))
+	}
+	return ssOpts
+}
+
+// resolveCompression picks the codec for an uploaded archive. The
+// default is gzip for directories and none for files. Codecs the
+// fetcher can't decompress yet, such as zstd, fall back to gzip with a
+// warning, so archives stay fetchable by every builder and runtime.
+func resolveCompression(flag string, isDir bool) (fission.ArchiveCompression, error) {
+	var compression fission.ArchiveCompression
+	switch flag {
+	case "":
+		if isDir {
+			compression = fission.ArchiveCompressionGzip
+		}
+	case "none":
+		compression = fission.ArchiveCompressionNone
+	case "gzip":
+		compression = fission.ArchiveCompressionGzip
+	case "zstd":
+		compression = fission.ArchiveCompressionZstd
+	default:
+		return "", fmt.Errorf("unknown compression '%v', use one of none, gzip, zstd", flag)
+	}
+
+	if !fetcherCompressions[compression] {
+		fmt.Fprintf(os.Stderr, "Warning: builder doesn't support %v compression, using gzip instead\n", compression)
+		compression = fission.ArchiveCompressionGzip
+	}
+	return compression, nil
+}
+
+// compressionLevelRange is the range of levels a codec accepts, and
+// the level it compresses at when none is given.
+type compressionLevelRange struct {
+	min, max, def int
+}
+
+// compressionLevels trade packing time for upload size, per codec.
+// BenchmarkCompressionLevel measures gzip on this repository's Go
+// sources (1.4MB): level 1 packed nearly 2x as fast as the default 6
+// for 20% more bytes, and level 9 3x as slow for 4% fewer bytes; on a
+// slow link the smaller file can still win. zstd defaults to its own
+// default, 3.
+var compressionLevels = map[fission.ArchiveCompression]compressionLevelRange{
+	fission.ArchiveCompressionGzip: {min: gzip.BestSpeed, max: gzip.BestCompression, def: packager.GzipDefaultLevel},
+	fission.ArchiveCompressionZstd: {min: 1, max: 22, def: 3},
+}
+
+// resolveCompressionLevel checks a --compression-level against the
+// range of the codec asked for with --compress, and returns the level
+// to use with the codec actually used, which differs when zstd falls
+// back to gzip. Zero means the codec's default.
+func resolveCompressionLevel(level int, requested string, compression fission.ArchiveCompression) (int, error) {
+	if level == 0 {
+		return 0, nil
+	}
+	codec := compression
+	if requested == string(fission.ArchiveCompressionZstd) {
+		codec = fission.ArchiveCompressionZstd
+	}
+	levels, ok := compressionLevels[codec]
+	if !ok {
+		return 0, fmt.Errorf("--compression-level needs a compression, use --compress gzip or zstd")
+	}
+	if level < levels.min || level > levels.max {
+		return 0, fmt.Errorf("--compression-level %v is out of range for %v, use %v-%v", level, codec, levels.min, levels.max)
+	}
+	if used := compressionLevels[compression]; codec != compression && level > used.max {
+		fmt.Fprintf(os.Stderr, "Warning: %v level %v isn't a %v level, using %v level %v\n", codec, level, compression, compression, used.max)
+		level = used.max
+	}
+	return level, nil
+}
+
+// compressFile writes a gzip compressed copy of src to a temporary
+// file and returns its path. The caller removes the file. A level of
+// zero is the default level.
+func compressFile(src string, compression fission.ArchiveCompression, level int, bufferSize int) (string, error) {
+	if compression != fission.ArchiveCompressionGzip {
+		return "", fmt.Errorf("unsupported compression '%v'", compression)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(stagingDir(), "fission-archive-gz-")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	err = packager.Gzip(out, in, level, bufferSize)
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// decompressFile replaces the file at path with its decompressed
+// contents.
+func decompressFile(path string, compression fission.ArchiveCompression) error {
+	if compression == fission.ArchiveCompressionNone {
+		return nil
+	}
+	if compression != fission.ArchiveCompressionGzip {
+		return fmt.Errorf("unsupported compression '%v'", compression)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".decompressed"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, zr)
+	out.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// isIgnored returns true if relPath matches any of the ignore
+// patterns.
+func isIgnored(relPath string, patterns []string) bool {
+	for _, p := range patterns {
+		if m, _ := filepath.Match(p, relPath); m {
+			return true
+		}
+		if m, _ := filepath.Match(p, filepath.Base(relPath)); m {
+			return true
+		}
+	}
+	return false
+}
+
+// scanDir lists the regular files under root, leaving out ignored
+// paths. With opts.prescan, the files are also hashed using at most
+// opts.scanConcurrency workers.
+func scanDir(root string, opts archiveOptions) (*dirScan, error) {
+	scan := &dirScan{root: root}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && isIgnored(filepath.ToSlash(rel), opts.ignore) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			if !info.IsDir() {
+				verbose("Skipping non-regular file %v", path)
+			}
+			return nil
+		}
+		entry := scanEntry{
+			path:    path,
+			relPath: filepath.ToSlash(rel),
+			info:    info,
+		}
+		if opts.maxFileSize > 0 && info.Size() > opts.maxFileSize {
+			scan.excluded = append(scan.excluded, entry)
+			return nil
+		}
+		scan.entries = append(scan.entries, entry)
+		scan.totalSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = checkExcludedFiles(scan, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.prescan {
+		return scan, nil
+	}
+
+	concurrency := opts.scanConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultScanConcurrency
+	}
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	work := make(chan int)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				sum, err := fileChecksum(scan.entries[idx].path)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					continue
+				}
+				scan.entries[idx].checksum = sum
+			}
+		}()
+	}
+	for i := range scan.entries {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return scan, nil
+}
+
+// checkExcludedFiles reports the files a scan left out for their
+// size, or fails listing them if opts.failLargeFiles is set.
+func checkExcludedFiles(scan *dirScan, opts archiveOptions) error {
+	if len(scan.excluded) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, e := range scan.excluded {
+		lines = append(lines, fmt.Sprintf("  %v (%v)", e.relPath, formatSize(e.info.Size())))
+	}
+	if opts.failLargeFiles {
+		return fission.MakeError(fission.ErrorSizeLimitExceeded,
+			fmt.Sprintf("%v files are larger than the --max-file-size of %v:\n%v",
+				len(scan.excluded), formatSize(opts.maxFileSize), strings.Join(lines, "\n")))
+	}
+	fmt.Fprintf(os.Stderr, "Warning: left %v files larger than %v out of %v:\n%v\n",
+		len(scan.excluded), formatSize(opts.maxFileSize), scan.root, strings.Join(lines, "\n"))
+	return nil
+}
+
+// fileChecksum returns the hex encoded sha256 of a file.
+func fileChecksum(path string) (string, error) {
+	sum, _, err := packager.FileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+	return sum.Sum, nil
+}
+
+// parseChecksumFlag parses a --checksum value: a hex encoded sha256,
+// optionally prefixed with "sha256:".
+func parseChecksumFlag(value string) (fission.Checksum, error) {
+	sum := strings.ToLower(strings.TrimPrefix(value, string(fission.ChecksumTypeSHA256)+":"))
+	digest, err := hex.DecodeString(sum)
+	if err != nil || len(digest) != sha256.Size {
+		return fission.Checksum{}, fmt.Errorf("bad --checksum '%v', need a hex encoded sha256", value)
+	}
+	return fission.MakeChecksum(fission.ChecksumTypeSHA256, digest), nil
+}
+
+// packDir writes the files found by a scan into a zip file at dst,
+// using the given zip method for each file, and the given level for
+// deflated files (zero for the default). It uses the file info
+// collected by the scan, so files are not stat'd again.
+func packDir(scan *dirScan, dst string, method uint16, level int) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	err = writeZip(scan, out, method, level)
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeZip writes the zip of packDir to out with the packager's zip
+// writer, so programs creating packages through it get the same
+// archives. Entries holding their contents are written from memory,
+// the others read from their path.
+func writeZip(scan *dirScan, out io.Writer, method uint16, level int) error {
+	files := make([]packager.File, len(scan.entries))
+	for i, e := range scan.entries {
+		files[i] = packager.File{Name: e.relPath, Path: e.path, Info: e.info, Contents: e.contents}
+	}
+	return packager.WriteZip(out, files, method, level, scan.deterministic)
+}
+
+// parseArchiveTags parses --archive-tag key=value flags.
+func parseArchiveTags(values []string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(values))
+	for _, v := range values {
+		i := strings.Index(v, "=")
+		if i <= 0 {
+			fatalUsage(fmt.Sprintf("Bad --archive-tag '%v', use key=value.", v))
+		}
+		tags[v[:i]] = v[i+1:]
+	}
+	return tags
+}
+
+// stagingDir returns the directory for temporary archive files:
+// $FISSION_TMPDIR if set, else the system default.
+func stagingDir() string {
+	if dir := os.Getenv("FISSION_TMPDIR"); len(dir) > 0 {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// checkStagingSpace fails early if the staging directory can't hold
+// the given number of bytes, rather than running out of space while
+// writing an archive.
+func checkStagingSpace(need int64) error {
+	dir := stagingDir()
+	free, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("check free space in %v: %w", dir, err)
+	}
+	if free >= 0 && free < need {
+		return fmt.Errorf("staging directory %v has %v bytes free, need about %v; set FISSION_TMPDIR to a larger filesystem", dir, free, need)
+	}
+	return nil
+}
+
+// planArchive decides whether an archive of size bytes is embedded
+// in the package or uploaded, given the literal size limit. It has no
+// side effects, so callers can use it to explain a decision before
+// making it.
+func planArchive(size int64, limit int64) ArchivePlan {
+	plan := ArchivePlan{
+		Inline:  packager.Embedded(size, limit),
+		Confirm: size > largeArchiveSize,
+	}
+	if plan.Inline {
+		plan.Reason = fmt.Sprintf("%v is below the %v literal limit, embedding it in the package",
+			formatSize(size), formatSize(limit))
+	} else {
+		plan.Reason = fmt.Sprintf("%v is at or above the %v literal limit, uploading it to the storage service",
+			formatSize(size), formatSize(limit))
+	}
+	return plan
+}
+
+// packDirArchive scans and zips a directory into a temporary file,
+// returning the zip's path and the scan. The caller removes the file.
+// If compressed is set, the zip is going to be compressed as a whole
+// when uploaded.
+func packDirArchive(dir string, opts archiveOptions, compressed bool) (string, *dirScan, error) {
+	scan, err := scanDir(dir, opts)
+	if err != nil {
+		return "", nil, fmt.Errorf("scan directory %v: %w", dir, err)
+	}
+
+	scan.deterministic = opts.reproducible
+	if opts.embedBuildInfo {
+		cleanup, err := embedBuildInfo(scan, dir, opts)
+		if err != nil {
+			return "", nil, fmt.Errorf("embed build info in %v: %w", dir, err)
+		}
+		defer cleanup()
+	}
+
+	verbose("Directory %v: %v files, %v bytes", dir, len(scan.entries), scan.totalSize)
+
+	plan := planArchive(scan.totalSize, opts.inlineLimit)
+	if plan.Confirm && !opts.assumeYes &&
+		!confirm(fmt.Sprintf("Directory %v contains %v bytes in %v files, continue?", dir, scan.totalSize, len(scan.entries))) {
+		return "", nil, errAborted
+	}
+
+	// the archive is at most about the size of its files, and
+	// compressing it for upload makes a second copy
+	need := scan.totalSize
+	if compressed {
+		need *= 2
+	}
+	err = checkStagingSpace(need)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmpfile, err := ioutil.TempFile(stagingDir(), "fission-archive-")
+	if err != nil {
+		return "", nil, err
+	}
+	tmpfile.Close()
+
+	// When the whole archive will be compressed for upload, store
+	// the entries uncompressed so they aren't compressed twice.
+	method := zip.Deflate
+	if compressed && !plan.Inline {
+		method = zip.Store
+	}
+
+	err = packDir(scan, tmpfile.Name(), method, opts.compressionLevel)
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", nil, fmt.Errorf("pack directory %v: %w", dir, err)
+	}
+	return tmpfile.Name(), scan, nil
+}
+
+// progressBar returns a ProgressFunc drawing an upload's progress
+// on stderr.
+func progressBar(name string) storageSvcClient.ProgressFunc {
+	const width = 30
+	return func(sent int64, total int64) {
+		if total <= 0 {
+			return
+		}
+		done := int(sent * width / total)
+		fmt.Fprintf(os.Stderr, "\r%v [%v%v] %3d%% %v/%v", name,
+			strings.Repeat("=", done), strings.Repeat(" ", width-done),
+			sent*100/total, formatSize(sent), formatSize(total))
+		if sent >= total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+// formatSize formats a byte count for humans, e.g. 12.3MB.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%vB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// probeArchiveUrl checks that an uploaded archive can be fetched
+// from its URL, as the builder or runtime will do later.
+func probeArchiveUrl(ssClient *storageSvcClient.Client, archiveUrl string, mode string) error {
+	switch mode {
+	case "":
+		return nil
+	case "warn", "fail":
+	default:
+		return fmt.Errorf("unknown probe mode '%v', use warn or fail", mode)
+	}
+
+	err := ssClient.Probe(archiveUrl, probeTimeout)
+	if err == nil {
+		verbose("Archive URL %v is reachable", archiveUrl)
+		return nil
+	}
+	if mode == "fail" {
+		return fmt.Errorf("probe archive URL %v: %w", archiveUrl, err)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: archive URL %v is not reachable: %v\n", archiveUrl, err)
+	return nil
+}
+
+// splitArchive cuts a file into consecutive parts of partSize bytes,
+// the last one possibly shorter, written to a temporary directory.
+// Boundaries depend only on the part size, so the same file always
+// splits into the same parts. The caller removes the directory.
+func splitArchive(fileName string, partSize int64) (string, []string, error) {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return "", nil, err
+	}
+	defer in.Close()
+
+	dir, err := ioutil.TempDir(stagingDir(), "fission-parts-")
+	if err != nil {
+		return "", nil, err
+	}
+	var parts []string
+	for i := 0; ; i++ {
+		partName := filepath.Join(dir, fmt.Sprintf("%v.part%03d", filepath.Base(fileName), i))
+		out, err := os.Create(partName)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+		n, err := io.Copy(out, io.LimitReader(in, partSize))
+		out.Close()
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("split %v: %w", fileName, err)
+		}
+		if n == 0 && i > 0 {
+			os.Remove(partName)
+			break
+		}
+		parts = append(parts, partName)
+		if n < partSize {
+			break
+		}
+	}
+	return dir, parts, nil
+}
+
+// uploadParts splits a prepared archive, into chunks with
+// --chunk-size or else into parts of --part-size, and uploads each
+// part, returning the part URLs in order, and for chunks their
+// checksums and sizes. Each part is uploaded conditionally on its own
+// checksum, so re-uploading the same archive, or one sharing chunks
+// with it, reuses parts already stored. If the upload is cancelled or
+// runs past --upload-timeout, the parts it stored are deleted again.
+func uploadParts(ssClient *storageSvcClient.Client, p *preparedArchive, opts archiveOptions) ([]string, []fission.ArchiveChunk, error) {
+	var dir string
+	var parts []string
+	var err error
+	if opts.chunkSize > 0 {
+		dir, parts, err = chunkArchive(p.uploadName, opts.chunkSize)
+	} else {
+		dir, parts, err = splitArchive(p.uploadName, opts.partSize)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	var urls, stored []string
+	var chunks []fission.ArchiveChunk
+	var storedSize, totalSize int64
+	reused := 0
+	metadata := archiveTagMetadata(opts)
+	for i, part := range parts {
+		checksum, err := fileChecksum(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		fi, err := os.Stat(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		if opts.chunkSize > 0 {
+			chunks = append(chunks, fission.ArchiveChunk{
+				Checksum: fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: checksum},
+				Size:     fi.Size(),
+			})
+		}
+		totalSize += fi.Size()
+		if u, ok := opts.deltaBase[checksum]; ok && opts.chunkSize > 0 {
+			if baseChunkStored(ssClient, u, fi.Size()) {
+				urls = append(urls, u)
+				reused++
+				continue
+			}
+			verbose("Chunk %v of %v of the last upload is gone, uploading it again", i+1, p.srcName)
+		}
+		verbose("Uploading part %v of %v of %v", i+1, len(parts), p.srcName)
+		id, existed, err := ssClient.UploadIfNoneMatch(part, opts.uploadPrefix(),
+			fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: checksum}, &metadata)
+		if err != nil {
+			err = fmt.Errorf("upload part %v of %v of %v: %w", i+1, len(parts), p.srcName, err)
+			if (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) && len(stored) > 0 {
+				// parts that were already stored may belong to
+				// other archives, so only the new ones go
+				verbose("Removing %v parts of %v uploaded before cancelling", len(stored), p.srcName)
+				if abortErr := ssClient.Abort(stored); abortErr != nil {
+					fmt.Fprintf(os.Stderr, "Warning: failed to remove parts of cancelled upload of %v: %v\n", p.srcName, abortErr)
+				}
+			}
+			return nil, nil, err
+		}
+		if !existed {
+			stored = append(stored, id)
+			storedSize += fi.Size()
+		}
+		urls = append(urls, ssClient.ArchiveUrl(id))
+	}
+	if opts.chunkSize > 0 {
+		verbose("Stored %v of %v chunks of %v, %v of %v; the others were already stored",
+			len(stored), len(parts), p.srcName, formatSize(storedSize), formatSize(totalSize))
+	}
+	if reused > 0 {
+		verbose("Reused %v of %v chunks of %v from the last upload", reused, len(parts), p.srcName)
+	}
+	return urls, chunks, nil
+}
+
+// baseChunkStored is true if a chunk of the last delta upload is
+// still stored at its URL with the given size. The storage service
+// may have expired or deleted it since, so it's checked with a HEAD
+// before being referred to again; if the check fails, the chunk is
+// uploaded conditionally like any other.
+func baseChunkStored(ssClient *storageSvcClient.Client, archiveUrl string, size int64) bool {
+	id, ok := storageIdFromUrl(archiveUrl)
+	if !ok {
+		return false
+	}
+	stored, err := ssClient.Size(id)
+	if err != nil {
+		verbose("Checking chunk %v: %v", id, err)
+		return false
+	}
+	return stored == size
+}
+
+// uploadMirrors copies an uploaded file to each mirror storage
+// service and returns the URLs of the copies, in the order the
+// mirrors were given; a mirror given twice is uploaded to once. The
+// primary copy is already stored, so a failed mirror is only a
+// warning.
+func uploadMirrors(p *preparedArchive, opts archiveOptions) []string {
+	fileName := p.uploadName
+	metadata := uploadMetadata(p, opts)
+	var urls []string
+	seen := make(map[string]bool)
+	for _, mirror := range opts.mirrors {
+		mirror = strings.TrimSuffix(mirror, "/")
+		if seen[mirror] {
+			continue
+		}
+		seen[mirror] = true
+		ssOpts := append(storageClientOptions(extraHeaders), archiveClientOptions(opts)...)
+		ssClient := storageSvcClient.MakeClient(mirror, append(ssOpts, storageSvcClient.WithContext(uploads.context()))...)
+
+		verbose("Uploading %v to mirror %v", fileName, mirror)
+		id, err := ssClient.UploadWithPrefix(fileName, opts.uploadPrefix(), &metadata)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to upload %v to mirror %v: %v\n", fileName, mirror, err)
+			continue
+		}
+		urls = append(urls, ssClient.GetUrl(id))
+	}
+	return urls
+}
+
+// saveArchive copies the file that was uploaded (or embedded) for
+// srcName to dst, making sure the copy matches checksum if given. If
+// dst is a directory, the copy is named after srcName, so commands
+// creating several archives can save them all.
+func saveArchive(fileName, srcName, dst string, checksum *fission.Checksum) error {
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		name := filepath.Base(filepath.Clean(srcName))
+		if si, err := os.Stat(srcName); err == nil && si.IsDir() {
+			name += ".zip"
+		}
+		if ext := compressionExt(fileName); len(ext) > 0 {
+			name += ext
+		}
+		dst = filepath.Join(dst, name)
+	}
+
+	in, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("save archive: %w", err)
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if err != nil {
+		return fmt.Errorf("save archive to %v: %w", dst, err)
+	}
+	if checksum != nil && !checksum.Equal(fission.MakeChecksum(fission.ChecksumTypeSHA256, h.Sum(nil))) {
+		return fmt.Errorf("%w: saved archive %v doesn't match the uploaded checksum", fission.ErrInvalidChecksum, dst)
+	}
+	fmt.Fprintf(os.Stderr, "Saved archive for %v to %v\n", srcName, dst)
+	return nil
+}
+
+// compressionMagic are the leading bytes of the compressed files the
+// CLI uploads, and the extensions saved copies get.
+var compressionMagic = []struct {
+	magic []byte
+	ext   string
+}{
+	{[]byte{0x1f, 0x8b}, ".gz"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, ".zst"},
+}
+
+// compressionExt returns the extension of a compressed file, ".gz"
+// or ".zst", else "".
+func compressionExt(fileName string) string {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	var head [4]byte
+	n, _ := io.ReadFull(f, head[:])
+	for _, c := range compressionMagic {
+		if bytes.HasPrefix(head[:n], c.magic) {
+			return c.ext
+		}
+	}
+	return ""
+}
+
+// makeManifest describes the files of a pre-scanned directory, or the
+// single file at path if scan is nil.
+func makeManifest(scan *dirScan, path string) (*fission.ArchiveManifest, error) {
+	manifest := &fission.ArchiveManifest{}
+	if scan == nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := fileChecksum(path)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, fission.ArchiveManifestEntry{
+			Path:     filepath.Base(path),
+			Size:     info.Size(),
+			Checksum: fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: sum},
+		})
+		return manifest, nil
+	}
+
+	for _, e := range scan.entries {
+		manifest.Files = append(manifest.Files, fission.ArchiveManifestEntry{
+			Path:     e.relPath,
+			Size:     e.info.Size(),
+			Checksum: fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: e.checksum},
+		})
+	}
+	return manifest, nil
+}
+
+// storeManifest encodes a manifest and returns an archive referencing
+// it, either embedded or uploaded to the storage service depending on
+// its size.
+func storeManifest(ssClient *storageSvcClient.Client, manifest *fission.ArchiveManifest, opts archiveOptions) (*fission.Archive, error) {
+	return storeJSON(ssClient, manifest, "manifest", opts)
+}
+
+// storeJSON is storeManifest for any JSON encoded metadata of an
+// archive, named what for errors.
+func storeJSON(ssClient *storageSvcClient.Client, v interface{}, what string, opts archiveOptions) (*fission.Archive, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	archive := &fission.Archive{
+		Checksum: fission.Checksum{
+			Type: fission.ChecksumTypeSHA256,
+			Sum:  hex.EncodeToString(sum[:]),
+		},
+	}
+
+	if len(body) < manifestLiteralSizeLimit {
+		archive.Type = fission.ArchiveTypeLiteral
+		archive.Literal = body
+		return archive, nil
+	}
+
+	tmpfile, err := ioutil.TempFile(stagingDir(), "fission-"+what+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpfile.Name())
+	_, err = tmpfile.Write(body)
+	tmpfile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := archiveTagMetadata(opts)
+	id, err := ssClient.UploadWithPrefix(tmpfile.Name(), opts.uploadPrefix(), &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("upload %v: %w", what, err)
+	}
+	archive.Type = fission.ArchiveTypeUrl
+	archive.URL = ssClient.ArchiveUrl(id)
+	return archive, nil
+}
+
+// splitArchiveFiles returns the files named by a comma separated list
+// given as an archive, or nil if fileName isn't such a list. A file
+// whose name contains a comma is not split.
+func splitArchiveFiles(fileName string) []string {
+	if !strings.Contains(fileName, ",") {
+		return nil
+	}
+	if _, err := os.Stat(fileName); err == nil {
+		return nil
+	}
+	var files []string
+	for _, f := range strings.Split(fileName, ",") {
+		if f = strings.TrimSpace(f); len(f) > 0 {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// createPackedArchive packs several small files into one literal
+// archive, which fetchers unpack into a directory of those files.
+// Together they must fit in a literal.
+func createPackedArchive(files []string, opts archiveOptions) (*fission.Archive, error) {
+	contents, err := fission.PackFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	if size := int64(len(contents)); size > fission.ArchiveLiteralSizeLimit {
+		return nil, fission.MakeError(fission.ErrorSizeLimitExceeded,
+			fmt.Sprintf("%v packed together are %v, more than the %v limit for an embedded archive; put them in a directory instead",
+				strings.Join(files, ", "), formatSize(size), formatSize(fission.ArchiveLiteralSizeLimit)))
+	}
+	verbose("Packed %v files into a %v embedded archive", len(files), formatSize(int64(len(contents))))
+	if len(opts.transforms) > 0 || opts.withManifest {
+		fmt.Fprintf(os.Stderr, "Warning: transforms and manifests aren't applied to packed files\n")
+	}
+	sum := sha256.Sum256(contents)
+	archive := &fission.Archive{
+		Type:     fission.ArchiveTypeLiteral,
+		Literal:  contents,
+		Packing:  fission.ArchivePackingTar,
+		Checksum: fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:]),
+	}
+	if !opts.noHints {
+		// the files are packed under their base names
+		names := make([]string, len(files))
+		for i, f := range files {
+			names[i] = filepath.Base(f)
+		}
+		archive.Hints = fission.DetectArchiveHints(names)
+	}
+	return archive, nil
+}
+
+// archiveHints returns the hints given by the files of an archive:
+// those found by the scan of the directory it was packed from, or in
+// the zip file fileName. Other files give no hints.
+func archiveHints(fileName string, scan *dirScan) []fission.ArchiveHint {
+	if scan == nil {
+		if !isZip(fileName) {
+			return nil
+		}
+		var err error
+		scan, err = scanZip(fileName)
+		if err != nil {
+			verbose("Can't read %v for hints: %v", fileName, err)
+			return nil
+		}
+	}
+	paths := make([]string, len(scan.entries))
+	for i, e := range scan.entries {
+		paths[i] = filepath.ToSlash(e.relPath)
+	}
+	return fission.DetectArchiveHints(paths)
+}
+
+// unpackZip extracts a zip file into the dst directory. Entries that
+// would be written outside dst are rejected.
+func unpackZip(src string, dst string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	root := filepath.Clean(dst) + string(os.PathSeparator)
+	for _, zf := range r.File {
+		target := filepath.Join(dst, filepath.FromSlash(zf.Name))
+		if !strings.HasPrefix(target, root) {
+			return fmt.Errorf("illegal file path in archive: %v", zf.Name)
+		}
+
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		err := func() error {
+			in, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+
+			// only permission bits are kept, so a downloaded
+			// archive can't make setuid or setgid files
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, zf.Mode().Perm()|0600)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+
+			_, err = io.Copy(out, in)
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transformArchive runs the named transforms over a packed archive,
+// or over a plain file, and writes the result to a new temporary file
+// with the same base name. It returns the new path and a cleanup
+// function for the temporary file.
+func transformArchive(path string, names []string) (string, func(), error) {
+	transforms, err := lookupTransforms(names)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := ioutil.TempDir(stagingDir(), "fission-transform-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	dst := filepath.Join(dir, filepath.Base(path))
+
+	if isZip(path) {
+		err = transformZip(path, dst, transforms)
+	} else {
+		err = transformFile(path, dst, transforms)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dst, cleanup, nil
+}
+
+// lookupTransforms returns the archive transforms with the given
+// names.
+func lookupTransforms(names []string) ([]fission.ArchiveTransform, error) {
+	var transforms []fission.ArchiveTransform
+	for _, name := range names {
+		t, ok := fission.GetArchiveTransform(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown transform '%v', available: %v",
+				name, strings.Join(fission.ArchiveTransformNames(), ", "))
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+func applyTransforms(name string, contents []byte, transforms []fission.ArchiveTransform) ([]byte, error) {
+	for _, t := range transforms {
+		var err error
+		contents, err = t(name, contents)
+		if err != nil || contents == nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+func transformFile(src, dst string, transforms []fission.ArchiveTransform) error {
+	contents, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	contents, err = applyTransforms(filepath.Base(src), contents, transforms)
+	if err != nil {
+		return err
+	}
+	if contents == nil {
+		return fmt.Errorf("transform dropped %v, nothing left to upload", src)
+	}
+	return ioutil.WriteFile(dst, contents, 0644)
+}
+
+func transformZip(src, dst string, transforms []fission.ArchiveTransform) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, zf := range r.File {
+		if zf.FileInfo().IsDir() {
+			if _, err := zw.CreateHeader(&zf.FileHeader); err != nil {
+				return err
+			}
+			continue
+		}
+		contents, err := readZipFile(zf)
+		if err != nil {
+			return err
+		}
+		contents, err = applyTransforms(zf.Name, contents, transforms)
+		if err != nil {
+			return err
+		}
+		if contents == nil {
+			verbose("Transform dropped %v", zf.Name)
+			continue
+		}
+
+		hdr := zf.FileHeader
+		w, err := zw.CreateHeader(&hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(contents); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func readZipFile(zf *zip.File) ([]byte, error) {
+	in, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return ioutil.ReadAll(in)
+}
+
+// scanZip describes the files of a zip archive like scanDir does for
+// a directory, for archives whose contents differ from the directory
+// they were packed from.
+func scanZip(path string) (*dirScan, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	scan := &dirScan{root: path}
+	for _, zf := range r.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		contents, err := readZipFile(zf)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(contents)
+		scan.entries = append(scan.entries, scanEntry{
+			relPath:  zf.Name,
+			info:     zf.FileInfo(),
+			checksum: hex.EncodeToString(sum[:]),
+		})
+		scan.totalSize += int64(len(contents))
+	}
+	return scan, nil
+}
+
+// isZip returns true if the file at path is a readable zip archive.
+func isZip(path string) bool {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+// confirm asks a yes/no question on the terminal. It returns true
+// without asking if stdin is not a terminal.
+func confirm(question string) bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "%v [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
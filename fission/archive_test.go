@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/packager"
+)
+
+func TestUnpackZipModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-unpack-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+
+	zipName := filepath.Join(dir, "archive.zip")
+	f, err := os.Create(zipName)
+	panicIf(err)
+	zw := zip.NewWriter(f)
+	hdr := &zip.FileHeader{Name: "bin/run", Method: zip.Store}
+	hdr.SetMode(0755 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	w, err := zw.CreateHeader(hdr)
+	panicIf(err)
+	_, err = w.Write([]byte("#!/bin/sh"))
+	panicIf(err)
+	panicIf(zw.Close())
+	panicIf(f.Close())
+
+	dst := filepath.Join(dir, "dst")
+	panicIf(unpackZip(zipName, dst))
+	info, err := os.Stat(filepath.Join(dst, "bin", "run"))
+	panicIf(err)
+	if info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+		log.Panicf("Expected only permission bits to be kept, got %v", info.Mode())
+	}
+	if info.Mode().Perm()&0100 == 0 {
+		log.Panicf("Expected the file to stay executable, got %v", info.Mode())
+	}
+}
+
+// BenchmarkCompressionLevel packs this repository's Go sources at each
+// gzip level, reporting the compressed size alongside the time, to
+// check the tradeoff documented on compressionLevels.
+func BenchmarkCompressionLevel(b *testing.B) {
+	var src bytes.Buffer
+	err := filepath.Walk("..", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "vendor" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".go") {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			src.Write(contents)
+		}
+		return nil
+	})
+	panicIf(err)
+
+	levels := compressionLevels[fission.ArchiveCompressionGzip]
+	for level := levels.min; level <= levels.max; level++ {
+		b.Run(fmt.Sprintf("gzip-%v", level), func(b *testing.B) {
+			var out bytes.Buffer
+			b.SetBytes(int64(src.Len()))
+			for i := 0; i < b.N; i++ {
+				out.Reset()
+				panicIf(packager.Gzip(&out, bytes.NewReader(src.Bytes()), level, 0))
+			}
+			b.ReportMetric(float64(out.Len()), "packed-bytes")
+		})
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// batchProgress aggregates the progress of the packages of a batch,
+// such as "package apply --progress", drawing a single line with the
+// packages completed, the bytes uploaded across all of them, and an
+// estimate of the time left. Workers share it: each upload reports to
+// a ProgressFunc from upload, and each package to done.
+type batchProgress struct {
+	sync.Mutex
+	w     io.Writer
+	total int
+	start time.Time
+
+	completed int
+	failed    int
+	sent      int64
+	size      int64
+
+	// last is when the line was last drawn, so that it is redrawn
+	// at most progressUpdatesPerSecond times a second
+	last time.Time
+
+	// itemBars also draws each upload's own progress bar, with
+	// the batch's line drawn below each package as it completes.
+	itemBars bool
+}
+
+func newBatchProgress(w io.Writer, total int, itemBars bool) *batchProgress {
+	return &batchProgress{w: w, total: total, start: time.Now(), itemBars: itemBars}
+}
+
+// upload returns the ProgressFunc of an archive's uploads, and the
+// reset function its retries call. A split archive is uploaded a part
+// at a time, each part counting from zero. A retried upload first
+// takes back the bytes its failed attempt reported, so it isn't
+// counted as another part.
+func (b *batchProgress) upload(name string) (storageSvcClient.ProgressFunc, func(sent int64)) {
+	var bar storageSvcClient.ProgressFunc
+	if b.itemBars {
+		bar = progressBar(name)
+	}
+	started := false
+	var last int64
+	progress := func(sent int64, total int64) {
+		if bar != nil {
+			bar(sent, total)
+		}
+		b.Lock()
+		defer b.Unlock()
+		if !started || sent < last {
+			// a new upload, or the next part
+			started = true
+			last = 0
+			b.size += total
+		}
+		b.sent += sent - last
+		last = sent
+		b.draw(false)
+	}
+	reset := func(sent int64) {
+		b.Lock()
+		defer b.Unlock()
+		if sent < last {
+			b.sent -= last - sent
+			last = sent
+		}
+	}
+	return progress, reset
+}
+
+// done counts a package of the batch as completed.
+func (b *batchProgress) done(failed bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.completed++
+	if failed {
+		b.failed++
+	}
+	b.draw(true)
+}
+
+// finish draws the line a last time and ends it, before the batch's
+// report is printed.
+func (b *batchProgress) finish() {
+	b.Lock()
+	defer b.Unlock()
+	if !b.itemBars {
+		b.draw(true)
+		fmt.Fprintln(b.w)
+	}
+}
+
+// draw redraws the progress line, unless it was drawn too recently
+// and force isn't set. It must be called with b locked.
+func (b *batchProgress) draw(force bool) {
+	now := time.Now()
+	if !force && (b.itemBars || now.Sub(b.last) < time.Second/progressUpdatesPerSecond) {
+		return
+	}
+	b.last = now
+
+	line := fmt.Sprintf("packages %v/%v", b.completed, b.total)
+	if b.failed > 0 {
+		line += fmt.Sprintf(" (%v failed)", b.failed)
+	}
+	if b.size > 0 {
+		line += fmt.Sprintf(", uploaded %v/%v", formatSize(b.sent), formatSize(b.size))
+	}
+	if b.completed > 0 && b.completed < b.total {
+		// packages are assumed to take as long as those done
+		// so far
+		elapsed := now.Sub(b.start)
+		eta := elapsed * time.Duration(b.total-b.completed) / time.Duration(b.completed)
+		line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	if b.itemBars {
+		fmt.Fprintln(b.w, line)
+		return
+	}
+	// pad over the end of a longer previous line
+	fmt.Fprintf(b.w, "\r%-70v", line)
+}
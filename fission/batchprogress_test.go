@@ -0,0 +1,50 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestBatchProgressRetry(t *testing.T) {
+	b := newBatchProgress(ioutil.Discard, 2, false)
+
+	// an upload that fails half way, then once fully sent, and is
+	// retried each time
+	progress, reset := b.upload("a")
+	progress(50, 100)
+	reset(0)
+	progress(100, 100)
+	reset(0)
+	progress(40, 100)
+	progress(100, 100)
+	if b.sent != 100 || b.size != 100 {
+		log.Panicf("Expected 100/100 bytes after retries, got %v/%v", b.sent, b.size)
+	}
+
+	// a split archive's parts, the second resumed from 10 bytes in
+	progress, reset = b.upload("b")
+	progress(30, 30)
+	progress(20, 30)
+	reset(10)
+	progress(30, 30)
+	if b.sent != 160 || b.size != 160 {
+		log.Panicf("Expected 160/160 bytes after the parts, got %v/%v", b.sent, b.size)
+	}
+}
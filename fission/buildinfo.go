@@ -0,0 +1,152 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fission/fission"
+)
+
+// With --embed-build-info, a directory or layout archive gets one more
+// file, .fission/build-info.json at the archive root, so the function
+// can read its own provenance at runtime:
+//
+//	{
+//	  "builtAt": "2017-06-01T12:00:00Z",
+//	  "cliVersion": "0.3.0",
+//	  "gitCommit": "3f2a...",
+//	  "gitDirty": false,
+//	  "files": {"type": "sha256", "sum": "9c1e..."}
+//	}
+//
+// files is the SHA256 of a line "<path>\x00<sha256>\n" for each other
+// file of the archive, sorted by path, so it identifies the contents
+// whatever order or timestamps they're packed with. The git fields are
+// left out if the archived files aren't in a git worktree. With
+// --reproducible, builtAt is left out too, so packing the same files
+// again gives the same file, and archive.
+
+// buildInfoPath is where the build info is put in an archive.
+const buildInfoPath = ".fission/build-info.json"
+
+// buildInfo is the contents of the build info file.
+type buildInfo struct {
+	BuiltAt    *time.Time       `json:"builtAt,omitempty"`
+	CLIVersion string           `json:"cliVersion"`
+	GitCommit  string           `json:"gitCommit,omitempty"`
+	GitDirty   *bool            `json:"gitDirty,omitempty"`
+	Files      fission.Checksum `json:"files"`
+}
+
+// filesChecksum returns the checksum of the scanned files that
+// buildInfo records, hashing the files that weren't hashed yet.
+func filesChecksum(scan *dirScan) (fission.Checksum, error) {
+	entries := make([]*scanEntry, len(scan.entries))
+	for i := range scan.entries {
+		e := &scan.entries[i]
+		if len(e.checksum) == 0 {
+			sum, err := fileChecksum(e.path)
+			if err != nil {
+				return fission.Checksum{}, err
+			}
+			e.checksum = sum
+		}
+		entries[i] = e
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].relPath < entries[j].relPath })
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%v\x00%v\n", e.relPath, e.checksum)
+	}
+	return fission.MakeChecksum(fission.ChecksumTypeSHA256, h.Sum(nil)), nil
+}
+
+// embedBuildInfo adds the build info file to the scan of an archive
+// made from source, a directory or layout file. It returns a function
+// removing the generated file, to be called once the archive is
+// packed.
+func embedBuildInfo(scan *dirScan, source string, opts archiveOptions) (func(), error) {
+	for _, e := range scan.entries {
+		if e.relPath == buildInfoPath {
+			return nil, fmt.Errorf("%v already has a %v, can't embed build info", source, buildInfoPath)
+		}
+	}
+	files, err := filesChecksum(scan)
+	if err != nil {
+		return nil, err
+	}
+	info := buildInfo{CLIVersion: cliVersion, Files: files}
+	if !opts.reproducible {
+		now := time.Now().UTC().Truncate(time.Second)
+		info.BuiltAt = &now
+	}
+	gitOpts := opts
+	gitOpts.allowDirty = true
+	if git := gitMetadataAnnotations(source, gitOpts); git != nil {
+		info.GitCommit = git[gitCommitAnnotation]
+		if dirty, err := strconv.ParseBool(git[gitDirtyAnnotation]); err == nil {
+			info.GitDirty = &dirty
+		}
+	}
+	contents, err := json.MarshalIndent(&info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	contents = append(contents, '\n')
+
+	f, err := ioutil.TempFile(stagingDir(), "fission-build-info-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	sum := sha256.Sum256(contents)
+	scan.entries = append(scan.entries, scanEntry{
+		path:     f.Name(),
+		relPath:  buildInfoPath,
+		info:     fi,
+		checksum: fmt.Sprintf("%x", sum),
+	})
+	scan.totalSize += fi.Size()
+	verbose("Embedding build info in %v: %s", source, contents)
+	return cleanup, nil
+}
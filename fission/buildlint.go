@@ -0,0 +1,170 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+)
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseBuildEnv parses --build-env KEY=value and --build-env-secret
+// KEY=secret/key flags. Plain values for names that look like they
+// hold credentials are refused, since package specs aren't secret.
+func parseBuildEnv(plain []string, secrets []string) ([]fission.BuildEnvVar, error) {
+	var env []fission.BuildEnvVar
+	seen := make(map[string]bool)
+	add := func(flag string, kv string) (string, string, error) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !envNameRegex.MatchString(parts[0]) {
+			return "", "", flagError(fmt.Sprintf("invalid %v '%v', should be KEY=value with KEY a valid environment variable name", flag, kv))
+		}
+		if seen[parts[0]] {
+			return "", "", flagError(fmt.Sprintf("build environment variable %v given more than once", parts[0]))
+		}
+		seen[parts[0]] = true
+		return parts[0], parts[1], nil
+	}
+
+	for _, kv := range plain {
+		name, value, err := add("--build-env", kv)
+		if err != nil {
+			return nil, err
+		}
+		if isSensitiveName(name) {
+			return nil, fission.MakeError(fission.ErrorInvalidArgument,
+				fmt.Sprintf("%v looks like a credential; store it in a secret and use --build-env-secret %v=<secret>/<key>", name, name))
+		}
+		env = append(env, fission.BuildEnvVar{Name: name, Value: value})
+	}
+	for _, kv := range secrets {
+		name, ref, err := add("--build-env-secret", kv)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(ref, "/", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fission.MakeError(fission.ErrorInvalidArgument,
+				fmt.Sprintf("invalid --build-env-secret '%v', should be KEY=<secret>/<key>", kv))
+		}
+		env = append(env, fission.BuildEnvVar{
+			Name:      name,
+			SecretRef: &fission.SecretKeyReference{Name: parts[0], Key: parts[1]},
+		})
+	}
+	return env, nil
+}
+
+// Build command lint. The builder runs build commands as-is in a
+// shell; these checks only surface likely mistakes before a package
+// is created, they are not a sandbox.
+
+var buildLintPatterns = []struct {
+	re  *regexp.Regexp
+	msg string
+}{
+	{regexp.MustCompile(`\|\s*(sudo\s+)?(ba|z)?sh\b`), "pipes output into a shell"},
+	{regexp.MustCompile(`(^|[\s;&|])eval\s`), "uses eval"},
+	{regexp.MustCompile(`\brm\s+-[a-zA-Z]*[rR][a-zA-Z]*\s+(/|~|\$|\*)`), "recursively removes a root, home, variable or glob path"},
+	{regexp.MustCompile(`\bsudo\s`), "uses sudo"},
+}
+
+// lintBuildCommand returns warnings about a build command: unquoted
+// expansions, command substitution, unbalanced quotes and a few
+// dangerous patterns.
+func lintBuildCommand(cmd string) []string {
+	var warnings []string
+
+	var quote rune
+	substitution := false
+	for i := 0; i < len(cmd); i++ {
+		ch := rune(cmd[i])
+		switch {
+		case quote == '\'':
+			if ch == '\'' {
+				quote = 0
+			}
+		case ch == '\\':
+			i++
+		case ch == '\'' && quote == 0, ch == '"' && quote == 0:
+			quote = ch
+		case ch == '"' && quote == '"':
+			quote = 0
+		case ch == '`', ch == '$' && i+1 < len(cmd) && cmd[i+1] == '(':
+			substitution = true
+		case ch == '$' && quote == 0 && i+1 < len(cmd) && isExpansionStart(cmd[i+1]):
+			warnings = append(warnings, fmt.Sprintf("unquoted expansion at offset %v may be split or globbed; quote it", i))
+		}
+	}
+	if quote != 0 {
+		warnings = append(warnings, fmt.Sprintf("unterminated %c quote", quote))
+	}
+	if substitution {
+		warnings = append(warnings, "uses command substitution")
+	}
+
+	for _, p := range buildLintPatterns {
+		if p.re.MatchString(cmd) {
+			warnings = append(warnings, p.msg)
+		}
+	}
+	return warnings
+}
+
+func isExpansionStart(b byte) bool {
+	return b == '{' || b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// checkBuildCommand prints lint warnings for a build command, or
+// fails if strict is set and there are any.
+func checkBuildCommand(cmd string, strict bool) error {
+	warnings := lintBuildCommand(cmd)
+	if len(warnings) == 0 {
+		return nil
+	}
+	if strict {
+		return fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("build command '%v': %v", cmd, strings.Join(warnings, "; ")))
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: build command lint: %v\n", w)
+	}
+	return nil
+}
+
+func pkgLint(c *cli.Context) error {
+	cmd := c.String("buildcmd")
+	if len(cmd) == 0 {
+		fatalUsage("Need --buildcmd, the build command to check.")
+	}
+
+	warnings := lintBuildCommand(cmd)
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	if len(warnings) > 0 && c.Bool("strict-build-lint") {
+		fatal(fmt.Sprintf("%v problems found in build command", len(warnings)))
+	}
+	return nil
+}
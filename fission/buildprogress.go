@@ -0,0 +1,168 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// spinnerInterval is how often the build indicator's spinner turns.
+const spinnerInterval = 150 * time.Millisecond
+
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// buildPrinter prints the events of a build waited on with --follow:
+// status changes and build log lines on stdout, and while the build
+// runs, an indicator on stderr. The indicator is a bar while the
+// build command reports percentages, its current phase with a spinner
+// if it reports only phases, and just a spinner if it reports
+// nothing. It is redrawn in place, and only on a terminal; elsewhere
+// each report of progress is printed as a line of its own.
+type buildPrinter struct {
+	sync.Mutex
+	follow   bool
+	w        io.Writer
+	terminal bool
+
+	running  bool
+	progress *fission.BuildProgress
+	frame    int
+	drawn    bool
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newBuildPrinter(follow bool) *buildPrinter {
+	fi, err := os.Stderr.Stat()
+	bp := &buildPrinter{
+		follow:   follow,
+		w:        os.Stderr,
+		terminal: err == nil && fi.Mode()&os.ModeCharDevice != 0,
+	}
+	if follow && bp.terminal {
+		bp.stop = make(chan struct{})
+		bp.stopped = make(chan struct{})
+		go bp.spin()
+	}
+	return bp
+}
+
+// event prints a package event.
+func (bp *buildPrinter) event(ev client.PackageEvent) {
+	if !bp.follow {
+		return
+	}
+	bp.Lock()
+	defer bp.Unlock()
+	switch {
+	case ev.IsLog:
+		bp.clear()
+		fmt.Println(ev.LogLine)
+	case ev.IsProgress:
+		bp.progress = ev.Progress
+		if !bp.terminal {
+			fmt.Printf("[%v] build %v\n", time.Now().Format("15:04:05"), formatBuildProgress(ev.Progress))
+		}
+	default:
+		bp.clear()
+		fmt.Printf("[%v] build %v\n", time.Now().Format("15:04:05"), ev.Status)
+		bp.running = ev.Status == fission.BuildStatusRunning
+		if !bp.running {
+			bp.progress = nil
+		}
+	}
+	bp.draw()
+}
+
+// spin turns the spinner until finish is called.
+func (bp *buildPrinter) spin() {
+	defer close(bp.stopped)
+	ticker := time.NewTicker(spinnerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bp.stop:
+			return
+		case <-ticker.C:
+		}
+		bp.Lock()
+		bp.frame++
+		bp.draw()
+		bp.Unlock()
+	}
+}
+
+// draw redraws the indicator of a running build. It must be called
+// with bp locked.
+func (bp *buildPrinter) draw() {
+	if !bp.terminal || !bp.running {
+		return
+	}
+	const width = 30
+	var line string
+	spinner := spinnerFrames[bp.frame%len(spinnerFrames)]
+	switch p := bp.progress; {
+	case p != nil && p.Percent >= 0:
+		done := p.Percent * width / 100
+		line = fmt.Sprintf("build [%v%v] %3d%% %v",
+			strings.Repeat("=", done), strings.Repeat(" ", width-done), p.Percent, p.Phase)
+	case p != nil:
+		line = fmt.Sprintf("%v build: %v", spinner, p.Phase)
+	default:
+		line = fmt.Sprintf("%v building", spinner)
+	}
+	// pad over the end of a longer previous line
+	fmt.Fprintf(bp.w, "\r%-70v", line)
+	bp.drawn = true
+}
+
+// clear erases the indicator, so that a line can be printed in its
+// place. It must be called with bp locked.
+func (bp *buildPrinter) clear() {
+	if bp.drawn {
+		fmt.Fprintf(bp.w, "\r%70v\r", "")
+		bp.drawn = false
+	}
+}
+
+// finish stops the spinner and erases the indicator.
+func (bp *buildPrinter) finish() {
+	if bp.stop != nil {
+		close(bp.stop)
+		<-bp.stopped
+	}
+	bp.Lock()
+	defer bp.Unlock()
+	bp.clear()
+}
+
+// formatBuildProgress describes a build's progress, e.g. "40%
+// downloading deps".
+func formatBuildProgress(p *fission.BuildProgress) string {
+	if p.Percent < 0 {
+		return p.Phase
+	}
+	return strings.TrimSpace(fmt.Sprintf("%v%% %v", p.Percent, p.Phase))
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+)
+
+// With --chunk-size, archives are split at content-defined boundaries
+// rather than fixed offsets: a boundary falls wherever a rolling hash
+// of the preceding bytes has its top bits clear, so it moves with the
+// content around it. Files that several packages share are then cut
+// into the same chunks, at least away from their edges, wherever they
+// are in each archive, and each chunk is uploaded conditionally on its
+// checksum, so it is stored once for all of them. Zip archives
+// compress each file on its own, so this holds for them too; whole
+// archive compression doesn't, which is why chunked directories
+// default to none.
+//
+// The hash is a gear hash over a fixed table. Changing either the
+// table or the way boundaries are picked would change every chunk, so
+// neither may change.
+
+// gearTable maps each byte to a pseudorandom value, generated by
+// splitmix64 from a fixed seed.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	x := uint64(0x66697373696f6e) // "fission"
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker picks content-defined boundaries for chunks of an average
+// size, which is rounded down to a power of two. Chunks are at least a
+// quarter and at most four times the average.
+type chunker struct {
+	min, max int64
+	mask     uint64
+
+	hash uint64
+	n    int64
+}
+
+func newChunker(avgSize int64) *chunker {
+	shift := uint(bits.Len64(uint64(avgSize)) - 1)
+	avg := int64(1) << shift
+	return &chunker{
+		min:  avg / 4,
+		max:  avg * 4,
+		mask: (uint64(1)<<shift - 1) << (64 - shift),
+	}
+}
+
+// next returns the length of buf up to and including the end of the
+// current chunk, or -1 if the chunk goes on past buf.
+func (ch *chunker) next(buf []byte) int {
+	for i, b := range buf {
+		ch.hash = ch.hash<<1 + gearTable[b]
+		ch.n++
+		if ch.n >= ch.max || (ch.n >= ch.min && ch.hash&ch.mask == 0) {
+			ch.hash = 0
+			ch.n = 0
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// chunkArchive cuts a file into chunks of about avgSize bytes at
+// content-defined boundaries, written to a temporary directory in
+// order. The caller removes the directory.
+func chunkArchive(fileName string, avgSize int64) (string, []string, error) {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return "", nil, err
+	}
+	defer in.Close()
+
+	dir, err := ioutil.TempDir(stagingDir(), "fission-chunks-")
+	if err != nil {
+		return "", nil, err
+	}
+	var parts []string
+	var out *os.File
+	fail := func(err error) (string, []string, error) {
+		if out != nil {
+			out.Close()
+		}
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("chunk %v: %w", fileName, err)
+	}
+	write := func(p []byte) error {
+		if out == nil {
+			name := filepath.Join(dir, fmt.Sprintf("%v.chunk%05d", filepath.Base(fileName), len(parts)))
+			var err error
+			out, err = os.Create(name)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, name)
+		}
+		_, err := out.Write(p)
+		return err
+	}
+
+	ch := newChunker(avgSize)
+	buf := make([]byte, 64*1024)
+	for {
+		n, readErr := in.Read(buf)
+		rest := buf[:n]
+		for len(rest) > 0 {
+			end := ch.next(rest)
+			boundary := end >= 0
+			if !boundary {
+				end = len(rest)
+			}
+			if err := write(rest[:end]); err != nil {
+				return fail(err)
+			}
+			if boundary {
+				err := out.Close()
+				out = nil
+				if err != nil {
+					return fail(err)
+				}
+			}
+			rest = rest[end:]
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fail(readErr)
+		}
+	}
+	if len(parts) == 0 {
+		// an empty file is a single empty chunk
+		if err := write(nil); err != nil {
+			return fail(err)
+		}
+	}
+	if out != nil {
+		if err := out.Close(); err != nil {
+			return fail(err)
+		}
+	}
+	return dir, parts, nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chunkSums chunks contents and returns the checksums of the chunks,
+// checking that they reassemble into contents and are within the
+// chunker's bounds.
+func chunkSums(dir string, contents []byte, avgSize int64) []string {
+	fileName := filepath.Join(dir, "archive")
+	panicIf(ioutil.WriteFile(fileName, contents, 0644))
+	chunkDir, parts, err := chunkArchive(fileName, avgSize)
+	panicIf(err)
+	defer os.RemoveAll(chunkDir)
+
+	ch := newChunker(avgSize)
+	var joined bytes.Buffer
+	var sums []string
+	for i, part := range parts {
+		b, err := ioutil.ReadFile(part)
+		panicIf(err)
+		if int64(len(b)) > ch.max || (int64(len(b)) < ch.min && i < len(parts)-1) {
+			log.Panicf("Chunk %v is %v bytes, expected %v to %v", i, len(b), ch.min, ch.max)
+		}
+		joined.Write(b)
+		sum, err := fileChecksum(part)
+		panicIf(err)
+		sums = append(sums, sum)
+	}
+	if !bytes.Equal(joined.Bytes(), contents) {
+		log.Panicf("Chunks don't reassemble into the archive")
+	}
+	return sums
+}
+
+func TestChunkArchive(t *testing.T) {
+	const avgSize = 16 * 1024
+	dir, err := ioutil.TempDir("", "fission-chunks-test")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+
+	contents := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+	sums := chunkSums(dir, contents, avgSize)
+
+	// bytes inserted near the start only change the chunks around
+	// them
+	shifted := append(append(append([]byte{}, contents[:1000]...), []byte("inserted")...), contents[1000:]...)
+	shiftedSums := chunkSums(dir, shifted, avgSize)
+	known := make(map[string]bool)
+	for _, sum := range sums {
+		known[sum] = true
+	}
+	shared := 0
+	for _, sum := range shiftedSums {
+		if known[sum] {
+			shared++
+		}
+	}
+	if shared < len(sums)-2 {
+		log.Panicf("Only %v of %v chunks survived an insertion", shared, len(sums))
+	}
+
+	// empty archives are a single empty chunk
+	if n := len(chunkSums(dir, nil, avgSize)); n != 1 {
+		log.Panicf("Empty archive has %v chunks, expected 1", n)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+	"github.com/fission/fission/tpr"
+)
+
+// clonePackageSpec returns the spec of a copy of a package. The copy
+// refers to the same archives; a package with source is to be built
+// again, so its build output isn't copied.
+func clonePackageSpec(pkg *tpr.Package) (*fission.PackageSpec, fission.BuildStatus) {
+	spec := pkg.Spec
+	// the clone's archives may be changed without changing the
+	// original's
+	for _, a := range []**fission.Archive{&spec.BuiltDeployment, &spec.SBOM, &spec.Attestation} {
+		if *a != nil {
+			copied := **a
+			*a = &copied
+		}
+	}
+	status := pkg.Status.BuildStatus
+	if len(spec.Source.Type) > 0 {
+		spec.BuiltDeployment = nil
+		status = fission.BuildStatusPending
+	}
+	return &spec, status
+}
+
+// reuploadArchive copies a stored archive to a new ID, so the clone
+// doesn't share it, e.g. when the original's archives expire. Content
+// addressed archives are stored under the same ID again. Archives that
+// are split, not in the storage service, or without a checksum are
+// left as they are.
+func reuploadArchive(ssClient *storageSvcClient.Client, name string, archive *fission.Archive) error {
+	if archive == nil || archive.Type != fission.ArchiveTypeUrl {
+		return nil
+	}
+	id, ok := storageIdFromUrl(archive.URL)
+	if !ok || len(archive.Parts) > 0 || len(archive.Checksum.Sum) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: not re-uploading the %v archive, referring to it instead\n", name)
+		return nil
+	}
+	res, err := ssClient.Copy(id, ssClient, archive.Checksum)
+	if err != nil {
+		return fmt.Errorf("re-upload %v archive: %w", name, err)
+	}
+	verbose("Re-uploaded %v archive %v as %v", name, id, res.ID)
+	archive.URL = ssClient.ArchiveUrl(res.ID)
+	archive.ServerChecksum = res.ServerChecksum
+	return nil
+}
+
+// cloneMetadata returns the labels and annotations of a package's
+// clone: the original's, less its tag and immutability, plus the new
+// tag if there is one.
+func cloneMetadata(pkg *tpr.Package, tag string) (map[string]string, map[string]string) {
+	labels := make(map[string]string)
+	for k, v := range pkg.Metadata.Labels {
+		if k != fission.PackageTagLabel {
+			labels[k] = v
+		}
+	}
+	if len(tag) > 0 {
+		labels[fission.PackageTagLabel] = tag
+	}
+	annotations := make(map[string]string)
+	for k, v := range pkg.Metadata.Annotations {
+		if k != fission.PackageImmutableAnnotation && k != fission.PackageFieldManagerAnnotation {
+			annotations[k] = v
+		}
+	}
+	return labels, annotations
+}
+
+// checkTagFree fails if a package other than pkgName in its namespace
+// has the tag.
+func checkTagFree(client *client.Client, tag string, pkgName string) {
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+	for _, other := range pkgs {
+		if other.Metadata.Namespace == packageNamespace && other.Metadata.Name != pkgName &&
+			other.Metadata.Labels[fission.PackageTagLabel] == tag {
+			fatalWithCode(exitCodeConflict, fmt.Sprintf("Package '%v' is already tagged '%v'", other.Metadata.Name, tag))
+		}
+	}
+}
+
+// pkgClone creates a package with the spec of an existing one, e.g. to
+// experiment with a function's build without touching the original.
+// The clone keeps the environment and build command, and refers to the
+// same archives unless --reupload is given; a package with source is
+// built again.
+func pkgClone(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	if c.NArg() != 2 {
+		fatalUsage("Need the package to clone and the name of the clone: package clone <src> <newname>")
+	}
+	srcName, newName := c.Args().Get(0), c.Args().Get(1)
+	if errs := validation.IsDNS1123Subdomain(newName); len(errs) > 0 {
+		fatal(fmt.Sprintf("Invalid package name '%v': %v", newName, strings.Join(errs, "; ")))
+	}
+	tag := c.String("tag")
+	if len(tag) > 0 {
+		if errs := validation.IsValidLabelValue(tag); len(errs) > 0 {
+			fatal(fmt.Sprintf("Invalid --tag '%v': %v", tag, strings.Join(errs, "; ")))
+		}
+		checkTagFree(client, tag, newName)
+	}
+
+	pkg, err := client.PackageGet(&metav1.ObjectMeta{Name: srcName, Namespace: packageNamespace})
+	checkErr(err, fmt.Sprintf("read package '%v'", srcName))
+	_, err = client.PackageGet(&metav1.ObjectMeta{Name: newName, Namespace: packageNamespace})
+	if err == nil {
+		fatalWithCode(exitCodeConflict, fmt.Sprintf("Package '%v' already exists", newName))
+	}
+	if fe, ok := err.(fission.Error); !ok || fe.Code != fission.ErrorNotFound {
+		checkErr(err, fmt.Sprintf("check for package '%v'", newName))
+	}
+
+	spec, status := clonePackageSpec(pkg)
+	if c.Bool("reupload") {
+		ssClient := getStorageClient(client)
+		for _, a := range []struct {
+			name    string
+			archive *fission.Archive
+		}{
+			{"source", &spec.Source},
+			{"deployment", &spec.Deployment},
+			{"built deployment", spec.BuiltDeployment},
+			{"sbom", spec.SBOM},
+			{"attestation", spec.Attestation},
+		} {
+			err = reuploadArchive(ssClient, a.name, a.archive)
+			checkErr(err, "clone package")
+		}
+	}
+
+	labels, annotations := cloneMetadata(pkg, tag)
+	clone := &tpr.Package{
+		Metadata: metav1.ObjectMeta{
+			Name:        newName,
+			Namespace:   packageNamespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec:   *spec,
+		Status: fission.PackageStatus{BuildStatus: status},
+	}
+	_, err = client.PackageCreate(clone)
+	checkErr(err, fmt.Sprintf("create package '%v'", newName))
+	fmt.Printf("package '%v' created, a clone of '%v'\n", newName, srcName)
+	if status == fission.BuildStatusPending {
+		fmt.Printf("package '%v' will be built again\n", newName)
+	}
+	return nil
+}
@@ -17,22 +17,262 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/satori/go.uuid"
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
 	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+var (
+	// extraHeaders are sent on every request to the controller
+	// and the storage service, set by the global --header flag.
+	extraHeaders = make(http.Header)
+
+	// verboseOutput is set by the global --verbose flag.
+	verboseOutput bool
+
+	// uploadLimiter is shared by every storage client in the
+	// process, set by the global --max-concurrent-uploads flag.
+	uploadLimiter *storageSvcClient.UploadLimiter
+
+	// apiLimiter is shared by every controller client in the
+	// process, set by the global --qps and --burst flags.
+	apiLimiter *client.RateLimiter
+
+	// debugHTTP is set by the global --debug-http flag.
+	debugHTTP bool
+
+	// transferCompression is set by the global
+	// --transfer-compression flag.
+	transferCompression bool
+
+	// requestId correlates all requests made by one CLI command in
+	// controller, builder and storage logs. It is set by the
+	// global --request-id flag, or generated.
+	requestId string
+
+	// storageCredentials authorize storage requests, set by the
+	// global --storage-token, --storage-token-file and
+	// --storage-hmac-key-file flags.
+	storageCredentials storageSvcClient.CredentialProvider
+
+	// tlsConfig is used for HTTPS connections to the controller
+	// and storage service, set by the global --cacert flag.
+	tlsConfig *tls.Config
+
+	// directStorageUrl is the storage service's own URL, used
+	// instead of the controller's proxy when set by the global
+	// --direct-storage and --storage-url flags.
+	directStorageUrl string
+
+	// directStorageCheck makes sure the direct storage URL is
+	// reachable before it is first used.
+	directStorageCheck sync.Once
+
+	// packageNamespace is the namespace packages, functions,
+	// environments and triggers are created and looked up in, set
+	// by the global --namespace flag, or else the current
+	// kubeconfig context's namespace.
+	packageNamespace string
 )
 
+// directStoragePingTimeout bounds the check that the --storage-url
+// storage service is reachable.
+const directStoragePingTimeout = 10 * time.Second
+
+// sensitiveHeaderWords mark headers whose values must not be
+// printed, matched case-insensitively against the header name.
+var sensitiveHeaderWords = []string{"auth", "key", "token", "secret", "password", "cookie"}
+
+// Exit codes. Scripts can rely on these to tell failures apart;
+// anything not listed exits with exitCodeError. The codes are stable:
+// new kinds of failure get new codes rather than reusing old ones.
+//
+//	1    error
+//	2    usage: a missing or invalid argument or flag of the command
+//	3    storage service unavailable
+//	4    checksum mismatch
+//	5    build failed
+//	6    batch partially failed
+//	7    archive too large
+//	8    conflict with an existing resource
+//	9    archive failed the storage service's malware scan
+//	10   packages differ from a lockfile
+//	130  cancelled
+//
+// Invalid arguments the controller or storage service refuse are
+// errors, not usage: only the CLI's own checks of its arguments and
+// flags exit with exitCodeUsage.
+const (
+	exitCodeError = 1
+
+	// exitCodeUsage means the command was given missing or
+	// invalid arguments or flags.
+	exitCodeUsage = 2
+
+	exitCodeStorageUnavailable = 3
+	exitCodeInvalidChecksum    = 4
+
+	// exitCodeBuildFailed means a package waited on failed to
+	// build.
+	exitCodeBuildFailed = 5
+
+	// exitCodePartialFailure means a batch command completed some
+	// items but not others.
+	exitCodePartialFailure = 6
+
+	exitCodeArchiveTooLarge = 7
+
+	// exitCodeConflict means a resource already exists with
+	// different contents.
+	exitCodeConflict = 8
+
+	// exitCodeInfected means the storage service's malware scan
+	// found an uploaded archive infected.
+	exitCodeInfected = 9
+
+	// exitCodeDrift means "package verify-lock" found packages
+	// that differ from the lockfile.
+	exitCodeDrift = 10
+
+	// exitCodeCancelled means the command was interrupted, as by
+	// the shell's convention for SIGINT.
+	exitCodeCancelled = 130
+)
+
+// errAborted is returned when the user declines a confirmation prompt.
+var errAborted = errors.New("aborted by user")
+
+// errUsage marks errors in the arguments or flags a command was given.
+var errUsage = errors.New("incorrect usage")
+
+// flagError is an error in a command's arguments or flags, found by
+// the CLI's own checks, that exits with exitCodeUsage.
+type flagError string
+
+func (e flagError) Error() string { return string(e) }
+
+func (e flagError) Is(target error) bool { return target == errUsage }
+
+// Commands print their results, such as tables, JSON and outcome
+// lines, on stdout, and everything else, such as prompts, progress,
+// warnings and errors, on stderr, so that output like -o json can be
+// piped to other tools.
+
 func fatal(msg string) {
+	fatalWithCode(exitCodeError, msg)
+}
+
+func fatalWithCode(code int, msg string) {
 	os.Stderr.WriteString(msg + "\n")
-	os.Exit(1)
+	os.Exit(code)
+}
+
+// fatalUsage exits for a missing or invalid argument or flag.
+func fatalUsage(msg string) {
+	fatalWithCode(exitCodeUsage, msg)
+}
+
+// usageError is the OnUsageError handler of the app and its commands,
+// which marks flag parsing errors with errUsage so that they exit with
+// exitCodeUsage.
+func usageError(c *cli.Context, err error, isSubcommand bool) error {
+	return fmt.Errorf("%w: %v", errUsage, err)
+}
+
+// setUsageErrorHandlers sets usageError as the OnUsageError handler of
+// commands and all their subcommands.
+func setUsageErrorHandlers(commands []cli.Command) {
+	for i := range commands {
+		commands[i].OnUsageError = usageError
+		setUsageErrorHandlers(commands[i].Subcommands)
+	}
+}
+
+// exitCode maps an error to the CLI exit code for its kind.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitCodeCancelled
+	case errors.Is(err, fission.ErrArchiveTooLarge):
+		return exitCodeArchiveTooLarge
+	case errors.Is(err, fission.ErrStorageUnavailable):
+		return exitCodeStorageUnavailable
+	case errors.Is(err, fission.ErrInvalidChecksum):
+		return exitCodeInvalidChecksum
+	case errors.Is(err, errUsage):
+		return exitCodeUsage
+	case errors.Is(err, storageSvcClient.ErrArchiveInfected):
+		return exitCodeInfected
+	}
+	var fe fission.Error
+	if errors.As(err, &fe) {
+		switch fe.Code {
+		case fission.ErrorNameExists:
+			return exitCodeConflict
+		}
+	}
+	return exitCodeError
+}
+
+// errorHint returns a suggestion for fixing some kinds of errors.
+func errorHint(err error) string {
+	var timeoutErr *uploadTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return "Large archives can take a while to upload; raise --upload-timeout, or set it to 0 for no limit."
+	}
+	var uploadErr *storageSvcClient.UploadError
+	if errors.As(err, &uploadErr) {
+		switch uploadErr.Class {
+		case storageSvcClient.UploadErrorDNS:
+			return "Check the host name of the storage service URL, or --server."
+		case storageSvcClient.UploadErrorTLS:
+			return "Check that the storage service's certificate is trusted, e.g. with --cacert."
+		case storageSvcClient.UploadErrorTimeout:
+			return "The storage service is slow to answer; check its load, or upload again later."
+		case storageSvcClient.UploadErrorClient:
+			if !errors.Is(err, fission.ErrArchiveTooLarge) {
+				return "The storage service rejected the upload; check --storage-token."
+			}
+		}
+	}
+	switch {
+	case errors.Is(err, fission.ErrArchiveTooLarge):
+		return "Use --part-size to upload the archive in smaller parts, or ignore files that don't need deploying."
+	case errors.Is(err, fission.ErrStorageUnavailable):
+		if len(directStorageUrl) > 0 {
+			return "Check that the storage service is running and reachable at --storage-url."
+		}
+		return "Check that the storage service is running and reachable through --server."
+	case errors.Is(err, fission.ErrInvalidChecksum):
+		return "The archive may be corrupted; try uploading it again."
+	case errors.Is(err, errNotReproducible):
+		return "Use --reproducible to pack with fixed file times and modes."
+	}
+	return ""
 }
 
 func getClient(serverUrl string) *client.Client {
 
 	if len(serverUrl) == 0 {
-		fatal("Need --server or FISSION_URL set to your fission server.")
+		fatalUsage("Need --server or FISSION_URL set to your fission server.")
 	}
 
 	isHTTPS := strings.Index(serverUrl, "https://") == 0
@@ -42,11 +282,217 @@ func getClient(serverUrl string) *client.Client {
 		serverUrl = "http://" + serverUrl
 	}
 
-	return client.MakeClient(serverUrl)
+	for k, vs := range extraHeaders {
+		for _, v := range vs {
+			verbose("Using header %v: %v", k, redactHeader(k, v))
+		}
+	}
+
+	opts := []client.ClientOption{client.WithHeaders(extraHeaders), client.WithRateLimiter(apiLimiter)}
+	if tlsConfig != nil {
+		opts = append(opts, client.WithTLSConfig(tlsConfig))
+	}
+	return client.MakeClient(serverUrl, opts...)
+}
+
+// getStorageClient returns a client for the storage service, reached
+// through the controller's proxy unless --direct-storage is set.
+// Archive URLs recorded in packages point at the proxy either way,
+// since functions and builders may not reach --storage-url.
+func getStorageClient(client *client.Client, opts ...storageSvcClient.ClientOption) *storageSvcClient.Client {
+	opts = append(storageClientOptions(client.Headers), opts...)
+	if len(directStorageUrl) > 0 {
+		opts = append(opts, storageSvcClient.WithArchiveUrl(storageProxyUrl(client)))
+	}
+	ssClient := storageSvcClient.MakeClient(storageUrl(client), opts...)
+	if len(directStorageUrl) > 0 {
+		directStorageCheck.Do(func() {
+			err := ssClient.Ping(directStoragePingTimeout)
+			if err != nil {
+				fatal(fmt.Sprintf("Storage service at --storage-url %v isn't reachable: %v", directStorageUrl, err))
+			}
+		})
+	}
+	return ssClient
+}
+
+// storageUrl returns the URL storage clients use: the storage
+// service's own with --direct-storage, else the controller's proxy.
+func storageUrl(client *client.Client) string {
+	if len(directStorageUrl) > 0 {
+		return directStorageUrl
+	}
+	return storageProxyUrl(client)
+}
+
+// storageProxyUrl returns the URL of the controller's proxy to the
+// storage service.
+func storageProxyUrl(client *client.Client) string {
+	return strings.TrimSuffix(client.Url, "/") + "/proxy/storage"
+}
+
+// storageClientOptions returns the options set by global flags that
+// every storage client should use, sending the given headers.
+func storageClientOptions(headers http.Header) []storageSvcClient.ClientOption {
+	opts := []storageSvcClient.ClientOption{
+		storageSvcClient.WithHeaders(headers),
+		storageSvcClient.WithUploadLimiter(uploadLimiter),
+	}
+	if storageCredentials != nil {
+		opts = append(opts, storageSvcClient.WithCredentials(storageCredentials))
+	}
+	if tlsConfig != nil {
+		opts = append(opts, storageSvcClient.WithTLSConfig(tlsConfig))
+	}
+	if transferCompression {
+		opts = append(opts, storageSvcClient.WithTransferCompression(true))
+	}
+	if debugHTTP {
+		opts = append(opts, storageSvcClient.WithHTTPDiagnostics(func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		}))
+	}
+	return opts
+}
+
+// parseGlobalFlags reads the global flags that affect every
+// command. It runs before any command action.
+func parseGlobalFlags(c *cli.Context) error {
+	verboseOutput = c.GlobalBool("verbose")
+	if err := resolveConfig(c); err != nil {
+		fatal(err.Error())
+	}
+	uploadLimiter = storageSvcClient.NewUploadLimiter(c.GlobalInt("max-concurrent-uploads"))
+	apiLimiter = client.NewRateLimiter(c.GlobalFloat64("qps"), c.GlobalInt("burst"))
+	debugHTTP = c.GlobalBool("debug-http")
+	transferCompression = c.GlobalBool("transfer-compression")
+	uploads.grace = c.GlobalDuration("upload-grace")
+	truncateWidth = c.GlobalInt("truncate-width")
+	if c.GlobalBool("no-truncate") {
+		truncateWidth = 0
+	}
+	colorOutput = useColor()
+
+	packageNamespace = c.GlobalString("namespace")
+	if len(packageNamespace) == 0 {
+		ns, err := kubeNamespace()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v; using namespace %v\n", err, metav1.NamespaceDefault)
+			ns = metav1.NamespaceDefault
+		}
+		packageNamespace = ns
+	}
+
+	for _, h := range c.GlobalStringSlice("header") {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			fatal(fmt.Sprintf("Invalid header '%v', should be of the form key:value", h))
+		}
+		extraHeaders.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	switch {
+	case len(c.GlobalString("storage-hmac-key-file")) > 0:
+		key, err := ioutil.ReadFile(c.GlobalString("storage-hmac-key-file"))
+		if err != nil {
+			fatal(fmt.Sprintf("Error reading --storage-hmac-key-file: %v", err))
+		}
+		storageCredentials = storageSvcClient.HMACSigner{
+			KeyID: c.GlobalString("storage-hmac-key-id"),
+			Key:   bytes.TrimSpace(key),
+		}
+	case len(c.GlobalString("storage-token-file")) > 0:
+		storageCredentials = storageSvcClient.TokenFile(c.GlobalString("storage-token-file"))
+	case len(c.GlobalString("storage-token")) > 0:
+		storageCredentials = storageSvcClient.StaticToken(c.GlobalString("storage-token"))
+	}
+
+	if c.GlobalBool("direct-storage") {
+		u, err := url.Parse(c.GlobalString("storage-url"))
+		switch {
+		case len(c.GlobalString("storage-url")) == 0:
+			fatalUsage("--direct-storage needs --storage-url or FISSION_STORAGE_URL set to the storage service's URL")
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0:
+			fatal(fmt.Sprintf("Invalid --storage-url '%v', should be an http or https URL", c.GlobalString("storage-url")))
+		}
+		directStorageUrl = strings.TrimSuffix(u.String(), "/")
+	}
+
+	if cacert := c.GlobalString("cacert"); len(cacert) > 0 {
+		pool, err := loadCACerts(cacert, c.GlobalBool("cacert-only"))
+		if err != nil {
+			fatal(err.Error())
+		}
+		tlsConfig = &tls.Config{RootCAs: pool}
+	} else if c.GlobalBool("cacert-only") {
+		fatalUsage("--cacert-only needs --cacert")
+	}
+
+	requestId = c.GlobalString("request-id")
+	if len(requestId) == 0 {
+		requestId = uuid.NewV4().String()
+	}
+	extraHeaders.Set(fission.RequestIdHeader, requestId)
+	return nil
+}
+
+// loadCACerts reads a PEM bundle of CA certificates, added to the
+// system pool unless only is set.
+func loadCACerts(fileName string, only bool) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !only {
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("load system CA certificates: %v", err)
+		}
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle %v has no valid PEM certificates", fileName)
+	}
+	return pool, nil
+}
+
+// verbose prints a message to stderr if --verbose is set.
+func verbose(format string, args ...interface{}) {
+	if verboseOutput {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// isSensitiveName returns true for header or variable names that are
+// likely to carry credentials.
+func isSensitiveName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, w := range sensitiveHeaderWords {
+		if strings.Contains(lower, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeader hides the value of headers that are likely to carry
+// credentials, so they can be safely printed.
+func redactHeader(name, value string) string {
+	if isSensitiveName(name) {
+		return "<redacted>"
+	}
+	return value
 }
 
 func checkErr(err error, msg string) {
+	if errors.Is(err, context.Canceled) {
+		fatalWithCode(exitCodeCancelled, fmt.Sprintf("Cancelled, didn't %v", msg))
+	}
 	if err != nil {
-		fatal(fmt.Sprintf("Failed to %v: %v", msg, err))
+		m := fmt.Sprintf("Failed to %v: %v", msg, err)
+		if hint := errorHint(err); len(hint) > 0 {
+			m += "\n" + hint
+		}
+		fatalWithCode(exitCode(err), m)
 	}
 }
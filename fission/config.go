@@ -0,0 +1,192 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ghodss/yaml"
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+)
+
+// cliConfig holds defaults for CLI flags, read from a YAML (or JSON)
+// config file. Precedence is explicit flags, then environment
+// variables, then the config file, then built-in defaults; the
+// resolved values are kept in config.
+type cliConfig struct {
+	Server               string   `json:"server,omitempty"`
+	Headers              []string `json:"headers,omitempty"`
+	StorageTokenFile     string   `json:"storageTokenFile,omitempty"`
+	CACert               string   `json:"cacert,omitempty"`
+	MaxConcurrentUploads *int     `json:"maxConcurrentUploads,omitempty"`
+
+	// archive defaults, for commands taking archive flags
+	Compress      string `json:"compress,omitempty"`
+	BufferSize    int    `json:"bufferSize,omitempty"`
+	StoragePrefix string `json:"storagePrefix,omitempty"`
+
+	// InlineLimit is the size in bytes below which archives are
+	// embedded in packages. It can only lower
+	// fission.ArchiveLiteralSizeLimit.
+	InlineLimit int64 `json:"inlineLimit,omitempty"`
+
+	// MaxPackageSize is the largest archive in bytes packages may
+	// have, for environments that declare no limit of their own.
+	MaxPackageSize int64 `json:"maxPackageSize,omitempty"`
+
+	// PackageQuota limits the packages of the namespace packages
+	// are created in, checked before each is created.
+	PackageQuota packageQuota `json:"packageQuota,omitempty"`
+}
+
+// config is the resolved configuration, set before any command runs.
+var config = cliConfig{InlineLimit: fission.ArchiveLiteralSizeLimit}
+
+// configFilePaths returns the locations searched for a config file
+// when --config-file isn't given, in order.
+func configFilePaths() []string {
+	var paths []string
+	if dir := os.Getenv("XDG_CONFIG_HOME"); len(dir) > 0 {
+		paths = append(paths, filepath.Join(dir, "fission", "config.yaml"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths,
+			filepath.Join(home, ".config", "fission", "config.yaml"),
+			filepath.Join(home, ".fission", "config.yaml"))
+	}
+	return paths
+}
+
+// readConfigFile reads the config file given, or the first one found
+// in the standard locations. A missing file is only an error if it
+// was given explicitly.
+func readConfigFile(fileName string) (*cliConfig, error) {
+	candidates := []string{fileName}
+	if len(fileName) == 0 {
+		candidates = configFilePaths()
+	}
+
+	cfg := &cliConfig{}
+	for _, path := range candidates {
+		contents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && len(fileName) == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %v", err)
+		}
+		err = yaml.Unmarshal(contents, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("parse config file %v: %v", path, err)
+		}
+		verbose("Using config file %v", path)
+		break
+	}
+	if cfg.InlineLimit < 0 || cfg.InlineLimit > fission.ArchiveLiteralSizeLimit {
+		return nil, fmt.Errorf("config inlineLimit must be between 0 and %v", fission.ArchiveLiteralSizeLimit)
+	}
+	if cfg.MaxPackageSize < 0 {
+		return nil, fmt.Errorf("config maxPackageSize can't be negative")
+	}
+	if cfg.PackageQuota.MaxPackages < 0 || cfg.PackageQuota.MaxTotalSize < 0 {
+		return nil, fmt.Errorf("config packageQuota limits can't be negative")
+	}
+	return cfg, nil
+}
+
+// isGlobalFlagSet returns true if a global flag was given on the
+// command line or through its environment variable.
+func isGlobalFlagSet(c *cli.Context, name string, envVar string) bool {
+	return c.GlobalIsSet(name) || (len(envVar) > 0 && len(os.Getenv(envVar)) > 0)
+}
+
+// resolveConfig reads the config file and sets config, filling global
+// flags that weren't given from it so that commands see the resolved
+// values.
+func resolveConfig(c *cli.Context) error {
+	cfg, err := readConfigFile(c.GlobalString("config-file"))
+	if err != nil {
+		return err
+	}
+
+	setDefault := func(name string, envVar string, value string) error {
+		if len(value) == 0 || isGlobalFlagSet(c, name, envVar) {
+			return nil
+		}
+		return c.GlobalSet(name, value)
+	}
+	if err := setDefault("server", "FISSION_URL", cfg.Server); err != nil {
+		return err
+	}
+	if err := setDefault("storage-token-file", "", cfg.StorageTokenFile); err != nil {
+		return err
+	}
+	if err := setDefault("cacert", "FISSION_CACERT", cfg.CACert); err != nil {
+		return err
+	}
+	if cfg.MaxConcurrentUploads != nil {
+		err := setDefault("max-concurrent-uploads", "", strconv.Itoa(*cfg.MaxConcurrentUploads))
+		if err != nil {
+			return err
+		}
+	}
+	if isGlobalFlagSet(c, "header", "") {
+		cfg.Headers = nil
+	}
+	for _, h := range cfg.Headers {
+		if err := c.GlobalSet("header", h); err != nil {
+			return err
+		}
+	}
+
+	cfg.Server = c.GlobalString("server")
+	cfg.StorageTokenFile = c.GlobalString("storage-token-file")
+	cfg.CACert = c.GlobalString("cacert")
+	cfg.Headers = c.GlobalStringSlice("header")
+	if cfg.InlineLimit == 0 {
+		cfg.InlineLimit = fission.ArchiveLiteralSizeLimit
+	}
+	config = *cfg
+	return nil
+}
+
+// archiveFlagDefaults fills archive options not given as flags from
+// the config file.
+func archiveFlagDefaults(c *cli.Context, opts *archiveOptions) {
+	if !c.IsSet("compress") && len(config.Compress) > 0 {
+		opts.compression = config.Compress
+	}
+	if !c.IsSet("buffer-size") && config.BufferSize > 0 {
+		opts.bufferSize = config.BufferSize
+	}
+	if !c.IsSet("storage-prefix") && len(config.StoragePrefix) > 0 {
+		opts.storagePrefix = config.StoragePrefix
+	}
+	opts.inlineLimit = config.InlineLimit
+	if c.IsSet("inline-limit") {
+		opts.inlineLimit = int64(c.Int("inline-limit"))
+		if opts.inlineLimit < 0 || opts.inlineLimit > fission.ArchiveLiteralSizeLimit {
+			fatalUsage(fmt.Sprintf("--inline-limit must be between 0 and %v.", fission.ArchiveLiteralSizeLimit))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/tpr"
+)
+
+const (
+	// pendingSourceAnnotation and pendingDeploymentAnnotation record
+	// the archive paths given when a package awaiting upload was
+	// created, so "package commit" can use them by default.
+	pendingSourceAnnotation     = "fission.io/pending-source"
+	pendingDeploymentAnnotation = "fission.io/pending-deployment"
+)
+
+// createDeferredPackage creates a package awaiting upload, without
+// creating any archives. The archive paths are recorded on the
+// package; they needn't exist until the package is committed.
+func createDeferredPackage(client *client.Client, envName, srcArchiveName, deployArchiveName, buildcmd string, opts archiveOptions) (*metav1.ObjectMeta, error) {
+	// the hooks and mounts are set once it is known whether there
+	// is a source
+	specOpts := opts
+	specOpts.preBuild, specOpts.postBuild = nil, nil
+	specOpts.buildSecrets, specOpts.buildConfigMaps = nil, nil
+	pkgSpec, _, err := makePackageSpec(client, envName, "", "", "", specOpts)
+	if err != nil {
+		return nil, err
+	}
+	err = setBuildHooks(pkgSpec, len(srcArchiveName) > 0, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = setBuildRefs(client, pkgSpec, len(srcArchiveName) > 0, opts)
+	if err != nil {
+		return nil, err
+	}
+	annotations := make(map[string]string)
+	for k, v := range opts.annotations {
+		annotations[k] = v
+	}
+	if len(srcArchiveName) > 0 {
+		// check the environment can build it now rather than at
+		// commit time
+		cmd, err := resolveBuildCommand(client, envName, buildcmd, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(cmd) > 0 {
+			err = checkBuildCommand(cmd, opts.strictBuildLint)
+			if err != nil {
+				return nil, err
+			}
+		}
+		pkgSpec.BuildCommand = cmd
+		annotations[pendingSourceAnnotation] = srcArchiveName
+	}
+	if len(deployArchiveName) > 0 {
+		annotations[pendingDeploymentAnnotation] = deployArchiveName
+	}
+
+	name := strings.ToLower(uuid.NewV4().String())
+	if len(opts.label) > 0 {
+		name = labeledPackageName(opts.label, pkgSpec)
+	}
+	pkg := &tpr.Package{
+		Metadata: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   packageNamespace,
+			Annotations: annotations,
+		},
+		Spec: *pkgSpec,
+		Status: fission.PackageStatus{
+			BuildStatus: fission.BuildStatusAwaitingUpload,
+		},
+	}
+	m, err := client.PackageCreate(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("create package: %w", err)
+	}
+	fmt.Printf("package '%v' created, awaiting upload; run 'fission package commit %v' to upload its archives\n", m.Name, m.Name)
+	return m, nil
+}
+
+// commitPackage creates the archives of a package awaiting upload and
+// moves it to pending, if it has a source archive to build, or
+// succeeded.
+func commitPackage(client *client.Client, pkg *tpr.Package, srcArchiveName, deployArchiveName string, opts archiveOptions) (*metav1.ObjectMeta, error) {
+	if pkg.Status.BuildStatus != fission.BuildStatusAwaitingUpload {
+		return nil, fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("package %v is %v, not %v", pkg.Metadata.Name, pkg.Status.BuildStatus, fission.BuildStatusAwaitingUpload))
+	}
+	if len(srcArchiveName) == 0 {
+		srcArchiveName = pkg.Metadata.Annotations[pendingSourceAnnotation]
+	}
+	if len(deployArchiveName) == 0 {
+		deployArchiveName = pkg.Metadata.Annotations[pendingDeploymentAnnotation]
+	}
+	if len(srcArchiveName) == 0 && len(deployArchiveName) == 0 {
+		return nil, fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("package %v has no archives recorded; use --src or --deploy", pkg.Metadata.Name))
+	}
+
+	opts.sizeLimit, opts.sizeLimitOwner = environmentSizeLimit(client, pkg.Spec.Environment.Name, opts)
+	var status fission.BuildStatus = fission.BuildStatusSucceeded
+	if len(deployArchiveName) > 0 {
+		archive, err := createArchive(client, deployArchiveName, opts)
+		if err != nil {
+			return nil, fmt.Errorf("deployment archive: %w", err)
+		}
+		pkg.Spec.Deployment = *archive
+	}
+	if len(srcArchiveName) > 0 {
+		archive, err := createArchive(client, srcArchiveName, opts)
+		if err != nil {
+			return nil, fmt.Errorf("source archive: %w", err)
+		}
+		pkg.Spec.Source = *archive
+		status = fission.BuildStatusPending
+	}
+
+	delete(pkg.Metadata.Annotations, pendingSourceAnnotation)
+	delete(pkg.Metadata.Annotations, pendingDeploymentAnnotation)
+	pkg.Status = fission.PackageStatus{BuildStatus: status}
+	m, err := client.PackageUpdate(pkg)
+	if err != nil {
+		return nil, fmt.Errorf("update package: %w", err)
+	}
+	return m, updatePackageFunctions(client, m)
+}
+
+func pkgCommit(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	if len(pkgName) == 0 {
+		fatalUsage("Need name of package, use --name")
+	}
+
+	pkg, err := client.PackageGet(&metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace})
+	checkErr(err, fmt.Sprintf("read package '%v'", pkgName))
+
+	_, err = commitPackage(client, pkg, c.String("src"), c.String("deploy"), getArchiveOptions(c))
+	checkErr(err, fmt.Sprintf("commit package '%v'", pkgName))
+	fmt.Printf("package '%v' committed\n", pkgName)
+	return nil
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// diagnoseStage is the outcome of one stage of a diagnosis.
+type diagnoseStage struct {
+	name    string
+	elapsed time.Duration
+	detail  string
+	err     error
+}
+
+// diagnosis runs the stages of a diagnosis in order, stopping at the
+// first failure, and records how each went.
+type diagnosis struct {
+	stages []diagnoseStage
+	failed bool
+}
+
+// run runs a stage unless an earlier one failed. The stage returns a
+// detail to report, such as a URL it derived.
+func (d *diagnosis) run(name string, stage func() (string, error)) {
+	if d.failed {
+		return
+	}
+	start := time.Now()
+	detail, err := stage()
+	d.stages = append(d.stages, diagnoseStage{name: name, elapsed: time.Since(start), detail: detail, err: err})
+	d.failed = err != nil
+}
+
+// runAlways runs a stage even if an earlier one failed, such as one
+// cleaning up after the others.
+func (d *diagnosis) runAlways(name string, stage func() (string, error)) {
+	failed := d.failed
+	d.failed = false
+	d.run(name, stage)
+	d.failed = d.failed || failed
+}
+
+func (d *diagnosis) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", "STAGE", "TIME", "RESULT", "DETAIL")
+	for _, s := range d.stages {
+		result, detail := "ok", s.detail
+		if s.err != nil {
+			result, detail = "failed", s.err.Error()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", s.name, s.elapsed.Round(time.Millisecond), result, detail)
+	}
+	w.Flush()
+}
+
+// diagnoseStorage checks the path from the CLI to the storage
+// service: it uploads a synthetic archive through createArchive,
+// downloads it back through the proxy and verifies its checksum,
+// reporting how long each stage took. The archive is deleted
+// afterwards, whatever the outcome.
+func diagnoseStorage(c *cli.Context) error {
+	size := c.Int("size")
+	if size <= 0 {
+		fatalUsage("--size must be at least 1 KiB.")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "fission-diagnose")
+	checkErr(err, "create temporary directory")
+
+	var (
+		d        diagnosis
+		cl       *client.Client
+		ssClient *storageSvcClient.Client
+		archive  *fission.Archive
+		id       string
+	)
+	start := time.Now()
+
+	d.run("client", func() (string, error) {
+		serverUrl := c.GlobalString("server")
+		if len(serverUrl) == 0 {
+			return "", errors.New("need --server or FISSION_URL set to your fission server")
+		}
+		cl = getClient(serverUrl)
+		return cl.Url, nil
+	})
+	d.run("storage url", func() (string, error) {
+		ssUrl := storageUrl(cl)
+		u, err := url.Parse(ssUrl)
+		if err != nil {
+			return "", err
+		}
+		if len(u.Host) == 0 {
+			return "", fmt.Errorf("no host in %v", ssUrl)
+		}
+		ssClient = getStorageClient(cl)
+		return ssUrl, nil
+	})
+
+	srcFile := filepath.Join(tmpDir, "archive")
+	d.run("upload", func() (string, error) {
+		err := writeRandomFile(srcFile, int64(size)*1024)
+		if err != nil {
+			return "", err
+		}
+		opts := defaultArchiveOptions()
+		opts.assumeYes = true
+		opts.compression = "none"
+		// the round trip is through the storage service, however
+		// small the file
+		opts.inlineLimit = 0
+		archive, err = createArchive(cl, srcFile, opts)
+		if err != nil {
+			return "", err
+		}
+		var ok bool
+		id, ok = storageIdFromUrl(archive.URL)
+		if !ok {
+			return "", fmt.Errorf("archive URL %v isn't on the storage service", archive.URL)
+		}
+		return fmt.Sprintf("%v KiB as %v", size, id), nil
+	})
+	d.run("get url", func() (string, error) {
+		u := ssClient.ArchiveUrl(id)
+		if u != archive.URL {
+			return "", fmt.Errorf("storage client gives %v, not the uploaded %v", u, archive.URL)
+		}
+		return u, nil
+	})
+
+	dstFile := filepath.Join(tmpDir, "download")
+	d.run("download", func() (string, error) {
+		f, err := os.Create(dstFile)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		err = downloadArchiveUrl(cl, archive.URL, f)
+		if err != nil {
+			return "", err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		return formatSize(info.Size()), nil
+	})
+	d.run("verify", func() (string, error) {
+		sum, err := fileChecksum(dstFile)
+		if err != nil {
+			return "", err
+		}
+		if sum != archive.Checksum.Sum {
+			return "", fmt.Errorf("%w: downloaded %v, uploaded %v", fission.ErrInvalidChecksum, sum, archive.Checksum.Sum)
+		}
+		return fmt.Sprintf("%v %v", archive.Checksum.Type, sum), nil
+	})
+
+	if len(id) > 0 {
+		d.runAlways("cleanup", func() (string, error) {
+			return "deleted " + id, ssClient.Delete(id)
+		})
+	}
+	os.RemoveAll(tmpDir)
+
+	d.print()
+	if d.failed {
+		fatal("Storage diagnosis failed.")
+	}
+	fmt.Printf("Round trip took %v\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// writeRandomFile writes size random bytes to a new file, so that the
+// storage service can't have a copy already.
+func writeRandomFile(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(f, rand.Reader, size)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,414 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// Environment compatibility checks. Environments may declare the
+// language version their runtime provides; packages are checked for
+// source that needs a newer one, or where the package itself declares
+// the version it needs. The checks are heuristics on file contents,
+// not parsers: they warn unless --strict-env.
+
+// maxEnvCheckFileSize bounds the size of the files read by the checks.
+const maxEnvCheckFileSize = 1024 * 1024
+
+type (
+	// langVersion is a parsed version such as 3.9 or 14.17.0.
+	langVersion []int
+
+	// envCheckFile is a file of an archive, by its path in the
+	// archive.
+	envCheckFile struct {
+		name     string
+		contents []byte
+	}
+
+	// envChecker checks the files of a language against the
+	// version an environment declares.
+	envChecker struct {
+		// wants returns true for the files the check reads.
+		wants func(name string) bool
+
+		// check returns a warning for each problem found.
+		check func(version langVersion, files []envCheckFile) []string
+	}
+
+	// syntaxFeature is language syntax that needs at least a
+	// version of its runtime.
+	syntaxFeature struct {
+		re      *regexp.Regexp
+		since   string
+		feature string
+	}
+)
+
+// envCheckers are the checks by language. To support another
+// language, add its checker here, and its aliases to
+// envLanguageAliases.
+var envCheckers = map[string]envChecker{
+	"python": {wants: isPythonFile, check: checkPythonVersion},
+	"nodejs": {wants: isNodeFile, check: checkNodeVersion},
+	"go":     {wants: isGoFile, check: checkGoVersion},
+}
+
+// envLanguageAliases maps other names languages go by, in
+// declarations and image names, to their envCheckers key.
+var envLanguageAliases = map[string]string{
+	"python3": "python",
+	"py":      "python",
+	"node":    "nodejs",
+	"js":      "nodejs",
+	"golang":  "go",
+}
+
+// envLanguage returns the envCheckers key of an environment's
+// language: the declared one, else one guessed from its image name,
+// such as fission/python-env.
+func envLanguage(runtime fission.Runtime) string {
+	if len(runtime.Language) > 0 {
+		lang := strings.ToLower(runtime.Language)
+		if alias, ok := envLanguageAliases[lang]; ok {
+			return alias
+		}
+		return lang
+	}
+	name := path.Base(runtime.Image)
+	if i := strings.IndexAny(name, ":@"); i >= 0 {
+		name = name[:i]
+	}
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+		word = strings.ToLower(word)
+		if _, ok := envCheckers[word]; ok {
+			return word
+		}
+		if alias, ok := envLanguageAliases[word]; ok {
+			return alias
+		}
+	}
+	return ""
+}
+
+var langVersionRegex = regexp.MustCompile(`^v?(\d+)(\.\d+)*`)
+
+// parseLangVersion parses the leading numbers of a version such as
+// "3.9", "v14.17.0" or "1.21rc1". It returns nil if there are none.
+func parseLangVersion(s string) langVersion {
+	m := langVersionRegex.FindString(strings.TrimSpace(s))
+	if len(m) == 0 {
+		return nil
+	}
+	var v langVersion
+	for _, part := range strings.Split(strings.TrimPrefix(m, "v"), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil
+		}
+		v = append(v, n)
+	}
+	return v
+}
+
+// less returns true if v is older than other, comparing only the
+// components both have: 3.9 is older than 3.10, and 14 is as old as
+// 14.17.
+func (v langVersion) less(other langVersion) bool {
+	for i := 0; i < len(v) && i < len(other); i++ {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
+
+func (v langVersion) String() string {
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// checkSyntaxFeatures warns about each feature used by the files that
+// needs a newer version than version, naming the first file using it.
+func checkSyntaxFeatures(language string, version langVersion, files []envCheckFile, features []syntaxFeature) []string {
+	var warnings []string
+	for _, f := range features {
+		since := parseLangVersion(f.since)
+		if !version.less(since) {
+			continue
+		}
+		var users []string
+		for _, file := range files {
+			if f.re.Match(file.contents) {
+				users = append(users, file.name)
+			}
+		}
+		if len(users) == 0 {
+			continue
+		}
+		where := users[0]
+		if len(users) > 1 {
+			where = fmt.Sprintf("%v and %v other files", users[0], len(users)-1)
+		}
+		warnings = append(warnings, fmt.Sprintf("%v uses %v, which needs %v %v", where, f.feature, language, f.since))
+	}
+	return warnings
+}
+
+// requiredVersionRegex matches the minimum of a version requirement,
+// such as ">=3.11", "^14.0.0", "~16" or "18.x".
+var requiredVersionRegex = regexp.MustCompile(`^\s*(>=|\^|~|=)?\s*v?(\d+(\.\d+)*)`)
+
+// checkRequiredVersion warns if a package declares, in file, that it
+// needs a newer version than version.
+func checkRequiredVersion(language string, version langVersion, file string, requirement string) []string {
+	m := requiredVersionRegex.FindStringSubmatch(requirement)
+	if m == nil {
+		return nil
+	}
+	required := parseLangVersion(m[2])
+	if required == nil || !version.less(required) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%v requires %v %v", file, language, strings.TrimSpace(requirement))}
+}
+
+func isPythonFile(name string) bool {
+	base := path.Base(name)
+	return strings.HasSuffix(name, ".py") || base == "pyproject.toml" || base == "setup.cfg"
+}
+
+var pythonFeatures = []syntaxFeature{
+	{regexp.MustCompile(`\bf"|\bf'`), "3.6", "f-strings"},
+	{regexp.MustCompile(`[\w)\]]\s*:=\s*[\w(\[]`), "3.8", "assignment expressions (:=)"},
+	{regexp.MustCompile(`(?m)^\s*def\s+\w+\(.*,\s*/\s*[,)]`), "3.8", "positional-only parameters"},
+	{regexp.MustCompile(`(?m)^\s*match\s+[^=\n]+:\s*\n\s+case\s`), "3.10", "match statements"},
+	{regexp.MustCompile(`(?m)^\s*except\s*\*`), "3.11", "exception groups (except*)"},
+	{regexp.MustCompile(`(?m)^type\s+[A-Za-z_]\w*(\[[^\]]*\])?\s*=`), "3.12", "type statements"},
+}
+
+var (
+	pythonPrintStatementRegex = regexp.MustCompile(`(?m)^\s*print\s+[^\s(=]`)
+	pythonRequiresRegex       = regexp.MustCompile(`(?m)^\s*(requires-python|python_requires)\s*=\s*["']?([^"'\n]+)`)
+)
+
+func checkPythonVersion(version langVersion, files []envCheckFile) []string {
+	var sources []envCheckFile
+	var warnings []string
+	for _, f := range files {
+		if !strings.HasSuffix(f.name, ".py") {
+			if m := pythonRequiresRegex.FindSubmatch(f.contents); m != nil {
+				warnings = append(warnings, checkRequiredVersion("Python", version, f.name, string(m[2]))...)
+			}
+			continue
+		}
+		sources = append(sources, f)
+		if version[0] >= 3 && pythonPrintStatementRegex.Match(f.contents) {
+			warnings = append(warnings, fmt.Sprintf("%v uses print statements, which need Python 2", f.name))
+		}
+	}
+	return append(warnings, checkSyntaxFeatures("Python", version, sources, pythonFeatures)...)
+}
+
+func isNodeFile(name string) bool {
+	return strings.HasSuffix(name, ".js") || strings.HasSuffix(name, ".mjs") ||
+		strings.HasSuffix(name, ".cjs") || path.Base(name) == "package.json"
+}
+
+var nodeFeatures = []syntaxFeature{
+	{regexp.MustCompile(`\w\?\.[\w\[(]`), "14", "optional chaining (?.)"},
+	{regexp.MustCompile(`[\w)\]]\s*\?\?\s*[\w'"(\[{]`), "14", "nullish coalescing (??)"},
+	{regexp.MustCompile(`(\?\?|\|\||&&)=`), "15", "logical assignment operators"},
+}
+
+func checkNodeVersion(version langVersion, files []envCheckFile) []string {
+	var sources []envCheckFile
+	var warnings []string
+	for _, f := range files {
+		if path.Base(f.name) != "package.json" {
+			sources = append(sources, f)
+			continue
+		}
+		// only the package's own package.json, not those of
+		// its dependencies
+		if strings.Contains(f.name, "node_modules/") {
+			continue
+		}
+		var pkg struct {
+			Engines struct {
+				Node string `json:"node"`
+			} `json:"engines"`
+		}
+		if json.Unmarshal(f.contents, &pkg) == nil && len(pkg.Engines.Node) > 0 {
+			warnings = append(warnings, checkRequiredVersion("Node.js", version, f.name, pkg.Engines.Node)...)
+		}
+	}
+	return append(warnings, checkSyntaxFeatures("Node.js", version, sources, nodeFeatures)...)
+}
+
+func isGoFile(name string) bool {
+	return path.Base(name) == "go.mod"
+}
+
+var goDirectiveRegex = regexp.MustCompile(`(?m)^go\s+(\d+(\.\d+)*)\s*$`)
+
+func checkGoVersion(version langVersion, files []envCheckFile) []string {
+	var warnings []string
+	for _, f := range files {
+		if m := goDirectiveRegex.FindSubmatch(f.contents); m != nil {
+			warnings = append(warnings, checkRequiredVersion("Go", version, f.name, string(m[1]))...)
+		}
+	}
+	return warnings
+}
+
+// readEnvCheckFiles returns the files of a local archive, a directory,
+// zip file, layout file or single file, that wants asks for. Archives
+// that aren't local files, such as URLs, have none.
+func readEnvCheckFiles(archiveName string, wants func(name string) bool, opts archiveOptions) ([]envCheckFile, error) {
+	var scan *dirScan
+	var err error
+	if isLayoutArchive(archiveName) {
+		scan, err = readLayout(strings.TrimPrefix(archiveName, layoutArchivePrefix))
+		if err != nil {
+			return nil, err
+		}
+		return readScanFiles(scan, wants)
+	}
+
+	info, err := os.Stat(archiveName)
+	if err != nil {
+		return nil, nil
+	}
+	if info.IsDir() {
+		scan, err = scanDir(archiveName, opts)
+		if err != nil {
+			return nil, err
+		}
+		return readScanFiles(scan, wants)
+	}
+	if isZip(archiveName) {
+		return readZipCheckFiles(archiveName, wants)
+	}
+	if !wants(info.Name()) || info.Size() > maxEnvCheckFileSize {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(archiveName)
+	if err != nil {
+		return nil, err
+	}
+	return []envCheckFile{{name: info.Name(), contents: contents}}, nil
+}
+
+func readScanFiles(scan *dirScan, wants func(name string) bool) ([]envCheckFile, error) {
+	var files []envCheckFile
+	for _, e := range scan.entries {
+		if !wants(e.relPath) || e.info.Size() > maxEnvCheckFileSize {
+			continue
+		}
+		contents, err := ioutil.ReadFile(e.path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, envCheckFile{name: e.relPath, contents: contents})
+	}
+	return files, nil
+}
+
+func readZipCheckFiles(zipFile string, wants func(name string) bool) ([]envCheckFile, error) {
+	r, err := zip.OpenReader(zipFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var files []envCheckFile
+	for _, zf := range r.File {
+		if zf.FileInfo().IsDir() || !wants(zf.Name) || zf.UncompressedSize64 > maxEnvCheckFileSize {
+			continue
+		}
+		contents, err := readZipFile(zf)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, envCheckFile{name: zf.Name, contents: contents})
+	}
+	return files, nil
+}
+
+// checkEnvironmentCompat checks the local archives of a package
+// against the language version its environment declares, printing
+// warnings, or failing on them if opts.strictEnv is set. Environments
+// that declare no version, or whose language has no checker, aren't
+// checked.
+func checkEnvironmentCompat(client *client.Client, envName string, archiveNames []string, opts archiveOptions) error {
+	env, err := client.EnvironmentGet(&metav1.ObjectMeta{
+		Namespace: packageNamespace,
+		Name:      envName,
+	})
+	if err != nil {
+		verbose("Not checking archives against environment %v: %v", envName, err)
+		return nil
+	}
+	version := parseLangVersion(env.Spec.Runtime.LanguageVersion)
+	language := envLanguage(env.Spec.Runtime)
+	checker, ok := envCheckers[language]
+	if version == nil || !ok {
+		verbose("Environment %v declares no language version that can be checked", envName)
+		return nil
+	}
+
+	var files []envCheckFile
+	for _, name := range archiveNames {
+		if len(name) == 0 {
+			continue
+		}
+		archiveFiles, err := readEnvCheckFiles(name, checker.wants, opts)
+		if err != nil {
+			return fmt.Errorf("check %v against environment %v: %w", name, envName, err)
+		}
+		files = append(files, archiveFiles...)
+	}
+	warnings := checker.check(version, files)
+	if len(warnings) == 0 {
+		return nil
+	}
+	if opts.strictEnv {
+		return fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("environment %v runs %v %v: %v", envName, language, version, strings.Join(warnings, "; ")))
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: environment %v runs %v %v: %v\n", envName, language, version, w)
+	}
+	return nil
+}
@@ -33,12 +33,12 @@ func envCreate(c *cli.Context) error {
 
 	envName := c.String("name")
 	if len(envName) == 0 {
-		fatal("Need a name, use --name.")
+		fatalUsage("Need a name, use --name.")
 	}
 
 	envImg := c.String("image")
 	if len(envImg) == 0 {
-		fatal("Need an image, use --image.")
+		fatalUsage("Need an image, use --image.")
 	}
 
 	envVersion := c.Int("version")
@@ -55,19 +55,21 @@ func envCreate(c *cli.Context) error {
 	// Environment API interface version is not specified and
 	// builder image is empty, set default interface version
 	if envVersion == 0 {
-		fmt.Println("Use default environment v1 API interface")
+		fmt.Fprintln(os.Stderr, "Use default environment v1 API interface")
 		envVersion = 1
 	}
 
 	env := &tpr.Environment{
 		Metadata: metav1.ObjectMeta{
 			Name:      envName,
-			Namespace: metav1.NamespaceDefault,
+			Namespace: packageNamespace,
 		},
 		Spec: fission.EnvironmentSpec{
 			Version: envVersion,
 			Runtime: fission.Runtime{
-				Image: envImg,
+				Image:           envImg,
+				Language:        c.String("language"),
+				LanguageVersion: c.String("language-version"),
 			},
 			Builder: fission.Builder{
 				Image:   envBuilderImg,
@@ -75,6 +77,17 @@ func envCreate(c *cli.Context) error {
 			},
 		},
 	}
+	if f := c.String("archive-layout"); len(f) > 0 {
+		layout, err := readArchiveLayout(f)
+		checkErr(err, "read --archive-layout")
+		env.Spec.ArchiveLayout = layout
+	}
+	if size := c.Int("max-package-size"); size != 0 {
+		if size < 0 {
+			fatalUsage("--max-package-size can't be negative.")
+		}
+		env.Spec.MaxPackageSize = int64(size) * 1024 * 1024
+	}
 
 	_, err := client.EnvironmentCreate(env)
 	checkErr(err, "create environment")
@@ -88,12 +101,12 @@ func envGet(c *cli.Context) error {
 
 	envName := c.String("name")
 	if len(envName) == 0 {
-		fatal("Need a name, use --name.")
+		fatalUsage("Need a name, use --name.")
 	}
 
 	m := &metav1.ObjectMeta{
 		Name:      envName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	}
 	env, err := client.EnvironmentGet(m)
 	checkErr(err, "get environment")
@@ -111,19 +124,26 @@ func envUpdate(c *cli.Context) error {
 
 	envName := c.String("name")
 	if len(envName) == 0 {
-		fatal("Need a name, use --name.")
+		fatalUsage("Need a name, use --name.")
 	}
 	envImg := c.String("image")
 	envBuilderImg := c.String("builder")
 	envBuildCmd := c.String("buildcmd")
+	envLanguage := c.String("language")
+	envLanguageVersion := c.String("language-version")
+	envLayout := c.String("archive-layout")
+	envMaxPackageSize := c.IsSet("max-package-size")
 
-	if len(envImg) == 0 && len(envBuilderImg) == 0 && len(envBuildCmd) == 0 {
-		fatal("Need --image to specify env image, or use --builder to specify env builder, or use --buildcmd to specify new build command.")
+	if len(envImg) == 0 && len(envBuilderImg) == 0 && len(envBuildCmd) == 0 && len(envLanguage) == 0 && len(envLanguageVersion) == 0 && len(envLayout) == 0 && !envMaxPackageSize {
+		fatalUsage("Need --image to specify env image, or use --builder to specify env builder, or use --buildcmd to specify new build command, or --language and --language-version to declare the runtime's language, or --archive-layout to declare where packages' files go, or --max-package-size to limit packages' size.")
+	}
+	if c.Int("max-package-size") < 0 {
+		fatalUsage("--max-package-size can't be negative.")
 	}
 
 	env, err := client.EnvironmentGet(&metav1.ObjectMeta{
 		Name:      envName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, "find environment")
 
@@ -141,6 +161,21 @@ func envUpdate(c *cli.Context) error {
 	if len(envBuildCmd) > 0 {
 		env.Spec.Builder.Command = envBuildCmd
 	}
+	if len(envLanguage) > 0 {
+		env.Spec.Runtime.Language = envLanguage
+	}
+	if len(envLanguageVersion) > 0 {
+		env.Spec.Runtime.LanguageVersion = envLanguageVersion
+	}
+	if len(envLayout) > 0 {
+		layout, err := readArchiveLayout(envLayout)
+		checkErr(err, "read --archive-layout")
+		env.Spec.ArchiveLayout = layout
+	}
+	if envMaxPackageSize {
+		// 0 removes the limit
+		env.Spec.MaxPackageSize = int64(c.Int("max-package-size")) * 1024 * 1024
+	}
 
 	_, err = client.EnvironmentUpdate(env)
 	checkErr(err, "update environment")
@@ -154,12 +189,12 @@ func envDelete(c *cli.Context) error {
 
 	envName := c.String("name")
 	if len(envName) == 0 {
-		fatal("Need a name , use --name.")
+		fatalUsage("Need a name , use --name.")
 	}
 
 	m := &metav1.ObjectMeta{
 		Name:      envName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	}
 	err := client.EnvironmentDelete(m)
 	checkErr(err, "delete environment")
@@ -171,16 +206,15 @@ func envDelete(c *cli.Context) error {
 func envList(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 
+	output := c.String("output")
+	checkOutputFormat(output)
+
 	envs, err := client.EnvironmentList()
 	checkErr(err, "list environments")
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-	fmt.Fprintf(w, "%v\t%v\t%v\n", "NAME", "UID", "IMAGE")
+	t := newTable("NAME", "UID", "IMAGE")
 	for _, env := range envs {
-		fmt.Fprintf(w, "%v\t%v\t%v\n",
-			env.Metadata.Name, env.Metadata.UID, env.Spec.Runtime.Image)
+		t.addRow(env.Metadata.Name, env.Metadata.UID, env.Spec.Runtime.Image)
 	}
-	w.Flush()
-
-	return nil
+	return t.print(os.Stdout, output)
 }
@@ -0,0 +1,253 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// readArchiveLayout reads an environment's archive layout from a YAML
+// or JSON file.
+func readArchiveLayout(fileName string) (*fission.ArchiveLayout, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var layout fission.ArchiveLayout
+	err = yaml.Unmarshal(contents, &layout)
+	if err != nil {
+		return nil, fmt.Errorf("parse archive layout %v: %w", fileName, err)
+	}
+	for _, files := range [][]fission.ArchiveLayoutFile{layout.Source, layout.Deployment} {
+		for _, f := range files {
+			if _, err := path.Match(f.Path, ""); err != nil || len(f.Path) == 0 {
+				return nil, fmt.Errorf("archive layout %v: bad path '%v'", fileName, f.Path)
+			}
+		}
+	}
+	return &layout, nil
+}
+
+// archivePaths returns the slash separated paths of the files in a
+// local archive: a directory, layout file, zip file or single file.
+// Archives that aren't local files, such as URLs, return false.
+func archivePaths(archiveName string, opts archiveOptions) ([]string, bool, error) {
+	var scan *dirScan
+	if isLayoutArchive(archiveName) {
+		var err error
+		scan, err = readLayout(strings.TrimPrefix(archiveName, layoutArchivePrefix))
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		info, err := os.Stat(archiveName)
+		if err != nil {
+			return nil, false, nil
+		}
+		if !info.IsDir() {
+			if !isZip(archiveName) {
+				return []string{info.Name()}, true, nil
+			}
+			r, err := zip.OpenReader(archiveName)
+			if err != nil {
+				return nil, false, err
+			}
+			defer r.Close()
+			var paths []string
+			for _, zf := range r.File {
+				if !zf.FileInfo().IsDir() {
+					paths = append(paths, zf.Name)
+				}
+			}
+			return paths, true, nil
+		}
+		// only the paths are needed, not checksums
+		opts.prescan = false
+		scan, err = scanDir(archiveName, opts)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	paths := make([]string, len(scan.entries))
+	for i, e := range scan.entries {
+		paths[i] = filepath.ToSlash(e.relPath)
+	}
+	return paths, true, nil
+}
+
+// missingLayoutFiles returns the files of a layout that none of the
+// paths match.
+func missingLayoutFiles(files []fission.ArchiveLayoutFile, paths []string) []fission.ArchiveLayoutFile {
+	var missing []fission.ArchiveLayoutFile
+	for _, f := range files {
+		found := false
+		for _, p := range paths {
+			if ok, _ := path.Match(f.Path, p); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// describeLayoutFile names a layout file for messages.
+func describeLayoutFile(f fission.ArchiveLayoutFile) string {
+	if len(f.Role) > 0 {
+		return fmt.Sprintf("%v (%v)", f.Path, f.Role)
+	}
+	return f.Path
+}
+
+// wrappedDir returns the single directory a directory archive has all
+// its files in, such as the project directory of a checkout, or false
+// if it has files at its top.
+func wrappedDir(archiveName string, paths []string) (string, bool) {
+	if len(paths) == 0 {
+		return "", false
+	}
+	info, err := os.Stat(archiveName)
+	if err != nil || !info.IsDir() {
+		return "", false
+	}
+	top := strings.SplitN(paths[0], "/", 2)[0]
+	for _, p := range paths {
+		if !strings.HasPrefix(p, top+"/") {
+			return "", false
+		}
+	}
+	return top, true
+}
+
+// checkArchiveLayout checks a local archive against the files a
+// layout expects. When a directory has all its files in a single
+// subdirectory and the layout expects them at the top, the archive is
+// reshaped to that subdirectory with opts.strictLayout, and only
+// warned about otherwise, so advisory checks never change what is
+// packed. It returns the archive to use, and the required files still
+// missing.
+func checkArchiveLayout(archiveName string, files []fission.ArchiveLayoutFile, opts archiveOptions) (string, []fission.ArchiveLayoutFile, error) {
+	if len(archiveName) == 0 || len(files) == 0 {
+		return archiveName, nil, nil
+	}
+	paths, ok, err := archivePaths(archiveName, opts)
+	if err != nil || !ok {
+		return archiveName, nil, err
+	}
+	missing := missingLayoutFiles(files, paths)
+	if len(missing) == 0 {
+		return archiveName, nil, nil
+	}
+
+	if top, ok := wrappedDir(archiveName, paths); ok {
+		var inner []string
+		for _, p := range paths {
+			inner = append(inner, strings.TrimPrefix(p, top+"/"))
+		}
+		if innerMissing := missingLayoutFiles(files, inner); len(innerMissing) < len(missing) {
+			reshaped := filepath.Join(archiveName, filepath.FromSlash(top))
+			if opts.strictLayout {
+				fmt.Fprintf(os.Stderr, "%v has all its files under %v/; packing %v instead, to match the environment's layout\n",
+					archiveName, top, reshaped)
+				archiveName, missing = reshaped, innerMissing
+			} else {
+				fmt.Fprintf(os.Stderr, "Warning: %v has all its files under %v/; the environment's layout expects them at the top, as when packing %v\n",
+					archiveName, top, reshaped)
+			}
+		}
+	}
+
+	var required []fission.ArchiveLayoutFile
+	for _, f := range missing {
+		if f.Required {
+			required = append(required, f)
+		} else {
+			verbose("%v has no %v", archiveName, describeLayoutFile(f))
+		}
+	}
+	return archiveName, required, nil
+}
+
+// checkEnvironmentLayout checks the local source and deployment
+// archives of a package against the archive layout its environment
+// declares, printing a warning for each required file that is
+// missing, or failing on them if opts.strictLayout is set. It returns
+// the archives to use, which differ from those given if strict checks
+// reshaped them. Environments that declare no layout aren't checked, nor is
+// anything with opts.noLayoutCheck.
+func checkEnvironmentLayout(client *client.Client, envName string, srcArchiveName, deployArchiveName string, opts archiveOptions) (string, string, error) {
+	if opts.noLayoutCheck || (len(srcArchiveName) == 0 && len(deployArchiveName) == 0) {
+		return srcArchiveName, deployArchiveName, nil
+	}
+	env, err := client.EnvironmentGet(&metav1.ObjectMeta{
+		Namespace: packageNamespace,
+		Name:      envName,
+	})
+	if err != nil {
+		verbose("Not checking archive layout against environment %v: %v", envName, err)
+		return srcArchiveName, deployArchiveName, nil
+	}
+	layout := env.Spec.ArchiveLayout
+	if layout == nil {
+		return srcArchiveName, deployArchiveName, nil
+	}
+
+	var problems []string
+	for _, a := range []struct {
+		kind  string
+		name  *string
+		files []fission.ArchiveLayoutFile
+	}{
+		{"source", &srcArchiveName, layout.Source},
+		{"deployment", &deployArchiveName, layout.Deployment},
+	} {
+		name, missing, err := checkArchiveLayout(*a.name, a.files, opts)
+		if err != nil {
+			return "", "", fmt.Errorf("check %v archive %v against environment %v: %w", a.kind, *a.name, envName, err)
+		}
+		*a.name = name
+		for _, f := range missing {
+			problems = append(problems, fmt.Sprintf("%v archive %v has no %v", a.kind, name, describeLayoutFile(f)))
+		}
+	}
+	if len(problems) == 0 {
+		return srcArchiveName, deployArchiveName, nil
+	}
+	if opts.strictLayout {
+		return "", "", fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("environment %v expects other files: %v", envName, strings.Join(problems, "; ")))
+	}
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "Warning: environment %v expects other files: %v\n", envName, p)
+	}
+	return srcArchiveName, deployArchiveName, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fission/fission"
+)
+
+func TestCheckArchiveLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-layout-check-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+
+	// a checkout with the project in a subdirectory
+	checkout := filepath.Join(dir, "checkout")
+	project := filepath.Join(checkout, "app")
+	panicIf(os.MkdirAll(filepath.Join(project, "src"), 0755))
+	panicIf(ioutil.WriteFile(filepath.Join(project, "requirements.txt"), []byte("flask\n"), 0644))
+	panicIf(ioutil.WriteFile(filepath.Join(project, "src", "main.py"), []byte("pass\n"), 0644))
+
+	files := []fission.ArchiveLayoutFile{
+		{Path: "requirements.txt", Role: "dependencies", Required: true},
+		{Path: "src/*.py", Role: "handler", Required: true},
+		{Path: "config.yaml", Role: "config"},
+	}
+	opts := archiveOptions{assumeYes: true, scanConcurrency: 1}
+
+	// advisory checks only warn, packing what was given
+	name, missing, err := checkArchiveLayout(checkout, files, opts)
+	panicIf(err)
+	if name != checkout || len(missing) != 2 {
+		log.Panicf("Expected %v to be kept, missing 2 files, got %v missing %v", checkout, name, missing)
+	}
+
+	// strict checks pack the subdirectory that has the files
+	opts.strictLayout = true
+	name, missing, err = checkArchiveLayout(checkout, files, opts)
+	panicIf(err)
+	if name != project || len(missing) != 0 {
+		log.Panicf("Expected %v to be packed, missing nothing, got %v missing %v", project, name, missing)
+	}
+
+	// but not one that doesn't get closer to the layout
+	other := filepath.Join(dir, "other")
+	panicIf(os.MkdirAll(filepath.Join(other, "docs"), 0755))
+	panicIf(ioutil.WriteFile(filepath.Join(other, "docs", "README"), []byte("hi\n"), 0644))
+	name, missing, err = checkArchiveLayout(other, files, opts)
+	panicIf(err)
+	if name != other || len(missing) != 2 {
+		log.Panicf("Expected %v to be kept, missing 2 files, got %v missing %v", other, name, missing)
+	}
+
+	// a project laid out as expected only lacks the optional file
+	name, missing, err = checkArchiveLayout(project, files, archiveOptions{assumeYes: true, scanConcurrency: 1})
+	panicIf(err)
+	if name != project || len(missing) != 0 {
+		log.Panicf("Expected %v to match the layout, got %v missing %v", project, name, missing)
+	}
+}
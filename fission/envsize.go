@@ -0,0 +1,60 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// environmentSizeLimit returns the largest archive the packages of an
+// environment may have, and what declares it: the environment's
+// maxPackageSize, or else the config file's. Zero means no limit, as
+// does opts.noSizeCheck.
+func environmentSizeLimit(client *client.Client, envName string, opts archiveOptions) (int64, string) {
+	if opts.noSizeCheck {
+		return 0, ""
+	}
+	env, err := client.EnvironmentGet(&metav1.ObjectMeta{
+		Namespace: packageNamespace,
+		Name:      envName,
+	})
+	if err != nil {
+		verbose("Not checking archive sizes against environment %v: %v", envName, err)
+	} else if env.Spec.MaxPackageSize > 0 {
+		return env.Spec.MaxPackageSize, fmt.Sprintf("environment %v", envName)
+	}
+	if config.MaxPackageSize > 0 {
+		return config.MaxPackageSize, "the config file's maxPackageSize"
+	}
+	return 0, ""
+}
+
+// checkSizeLimit fails if an archive of size bytes, as stored, is
+// larger than opts.sizeLimit.
+func checkSizeLimit(name string, size int64, opts archiveOptions) error {
+	if opts.sizeLimit <= 0 || size <= opts.sizeLimit {
+		return nil
+	}
+	return fission.MakeError(fission.ErrorSizeLimitExceeded,
+		fmt.Sprintf("%v is %v, more than the %v limit of %v; make it smaller, or use --no-size-check to skip the check",
+			name, formatSize(size), formatSize(opts.sizeLimit), opts.sizeLimitOwner))
+}
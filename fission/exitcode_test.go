@@ -0,0 +1,76 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+
+	"github.com/fission/fission"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+func TestExitCode(t *testing.T) {
+	wrap := func(err error) error {
+		return fmt.Errorf("create archive: %w", err)
+	}
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{errors.New("something broke"), exitCodeError},
+		{usageError(nil, errors.New("flag provided but not defined: -x"), false), exitCodeUsage},
+		// the controller refusing an argument isn't a usage error
+		{fission.MakeError(fission.ErrorInvalidArgument, "invalid package name"), exitCodeError},
+		{wrap(flagError("build hooks can't be empty")), exitCodeUsage},
+		{wrap(&fission.ArchiveTooLargeError{Size: 2, Limit: 1}), exitCodeArchiveTooLarge},
+		{wrap(fission.ErrStorageUnavailable), exitCodeStorageUnavailable},
+		{wrap(fission.ErrInvalidChecksum), exitCodeInvalidChecksum},
+		{fission.MakeError(fission.ErrorNameExists, "package exists"), exitCodeConflict},
+		{wrap(context.Canceled), exitCodeCancelled},
+		{wrap(fmt.Errorf("%w: Eicar-Signature FOUND", storageSvcClient.ErrArchiveInfected)), exitCodeInfected},
+	}
+	// the codes scripts rely on
+	codes := map[int]int{
+		exitCodeError:              1,
+		exitCodeUsage:              2,
+		exitCodeStorageUnavailable: 3,
+		exitCodeInvalidChecksum:    4,
+		exitCodeBuildFailed:        5,
+		exitCodePartialFailure:     6,
+	}
+	for code, expected := range codes {
+		if code != expected {
+			log.Panicf("Exit code %v changed to %v", expected, code)
+		}
+	}
+	for _, tc := range cases {
+		if code := exitCode(tc.err); code != tc.code {
+			log.Panicf("Exit code of '%v' is %v, expected %v", tc.err, code, tc.code)
+		}
+	}
+
+	if code := buildExitCode(fission.BuildStatusFailed); code != exitCodeBuildFailed {
+		log.Panicf("Exit code of a failed build is %v, expected %v", code, exitCodeBuildFailed)
+	}
+	if code := buildExitCode(fission.BuildStatusAwaitingUpload); code != exitCodeError {
+		log.Panicf("Exit code of a package awaiting upload is %v, expected %v", code, exitCodeError)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/storagesvc"
+)
+
+// explainer prints resolved settings as aligned "key: value" lines.
+type explainer struct {
+	w *tabwriter.Writer
+}
+
+func newExplainer(out io.Writer) *explainer {
+	return &explainer{w: tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)}
+}
+
+func (e *explainer) line(key string, format string, args ...interface{}) {
+	fmt.Fprintf(e.w, "%v:\t%v\n", key, fmt.Sprintf(format, args...))
+}
+
+func (e *explainer) section(title string) {
+	fmt.Fprintf(e.w, "\n%v\n", title)
+}
+
+// defaulted marks a value that wasn't given as a flag.
+func defaulted(c *cli.Context, flag string, value interface{}) string {
+	s := fmt.Sprint(value)
+	if len(s) == 0 {
+		s = "none"
+	}
+	if c.IsSet(flag) {
+		return s
+	}
+	return s + " (default)"
+}
+
+// explainArchive prints how an archive would be stored, preparing it
+// as package create would but uploading nothing.
+func explainArchive(e *explainer, client *client.Client, kind string, fileName string, opts archiveOptions) {
+	e.section(kind + " archive")
+	e.line("path", "%v", fileName)
+	switch {
+	case isRemoteArchive(fileName):
+		if opts.rehost {
+			e.line("plan", "download the URL and upload it to the storage service (--rehost)")
+		} else {
+			e.line("plan", "refer to the URL, verifying a checksum it advertises")
+		}
+		return
+	case len(splitArchiveFiles(fileName)) > 1:
+		files := splitArchiveFiles(fileName)
+		contents, err := fission.PackFiles(files)
+		if err != nil {
+			e.line("error", "%v", err)
+			return
+		}
+		size := int64(len(contents))
+		e.line("plan", "pack %v files into an embedded archive of %v", len(files), formatSize(size))
+		if size > fission.ArchiveLiteralSizeLimit {
+			e.line("error", "more than the %v limit for an embedded archive", formatSize(fission.ArchiveLiteralSizeLimit))
+		}
+		return
+	}
+	if opts.gitTree {
+		if tree := gitTreeHash(fileName); len(tree) > 0 {
+			e.line("git tree", "%v, reused if a package already has an archive of it", tree)
+		}
+	}
+
+	p, err := prepareArchive(fileName, opts)
+	if err != nil {
+		e.line("error", "%v", err)
+		return
+	}
+	defer p.close()
+
+	info, err := os.Stat(p.uploadName)
+	if err != nil {
+		e.line("error", "%v", err)
+		return
+	}
+	size := info.Size()
+	if p.scan != nil {
+		e.line("files", "%v, %v", len(p.scan.entries), formatSize(p.scan.totalSize))
+		if len(p.scan.excluded) > 0 {
+			e.line("excluded", "%v files larger than %v", len(p.scan.excluded), formatSize(opts.maxFileSize))
+		}
+		if p.scan.totalSize > size {
+			size = p.scan.totalSize
+		}
+	}
+	plan := planArchive(size, opts.inlineLimit)
+	e.line("plan", "%v", plan.Reason)
+	e.line("checksum", "%v:%v", p.checksum.Type, p.checksum.HexSum())
+	if len(p.structure) > 0 {
+		e.line("structure", "%v", p.structure)
+	}
+	if p.literal {
+		return
+	}
+
+	compression := string(p.compression)
+	if len(compression) == 0 {
+		compression = "none"
+	}
+	e.line("compression", "%v, %v stored", compression, formatSize(info.Size()))
+	if opts.chunkSize > 0 {
+		e.line("chunks", "content-defined chunks of about %v", formatSize(opts.chunkSize))
+	} else if opts.partSize > 0 && info.Size() > opts.partSize {
+		parts := (info.Size() + opts.partSize - 1) / opts.partSize
+		e.line("parts", "%v parts of up to %v", parts, formatSize(opts.partSize))
+	} else {
+		id := storagesvc.ContentID(opts.uploadPrefix(), p.checksum.HexSum())
+		e.line("storage URL", "%v", getStorageClient(client).ArchiveUrl(id))
+	}
+	for _, m := range opts.mirrors {
+		e.line("mirror", "%v", m)
+	}
+}
+
+// explainPackageCreate prints what package create would do with the
+// given flags: the resolved settings, and for each archive whether it
+// would be embedded or uploaded, and where. Nothing is created or
+// uploaded.
+func explainPackageCreate(c *cli.Context, cl *client.Client, envName, srcArchiveName, deployArchiveName, buildcmd string, opts archiveOptions) {
+	e := newExplainer(os.Stdout)
+
+	e.section("controller")
+	e.line("server", "%v", cl.Url)
+	e.line("request ID", "%v", requestId)
+	headers := make([]string, 0, len(cl.Headers))
+	for k := range cl.Headers {
+		headers = append(headers, k)
+	}
+	if len(headers) > 0 {
+		e.line("extra headers", "%v", strings.Join(headers, ", "))
+	}
+	if apiLimiter == nil {
+		e.line("rate limit", "none")
+	} else {
+		e.line("rate limit", "%v requests/s, bursts of %v", c.GlobalFloat64("qps"), c.GlobalInt("burst"))
+	}
+	e.line("throttled requests", "retried up to %v times, waiting as Retry-After asks", client.ThrottleRetries)
+
+	e.section("package")
+	switch {
+	case len(c.String("name")) > 0:
+		e.line("name", "%v", c.String("name"))
+	case len(opts.label) > 0:
+		e.line("name", "%v-%v-<content hash>", sanitizeName(envName), sanitizeName(opts.label))
+	default:
+		e.line("name", "random")
+	}
+	e.line("namespace", "%v", packageNamespace)
+	e.line("environment", "%v/%v", packageNamespace, envName)
+	switch {
+	case c.Bool("replace"):
+		e.line("existing package", "kept if identical, otherwise replaced")
+	case c.Bool("if-not-exists"):
+		e.line("existing package", "kept if identical, otherwise an error")
+	}
+	if len(srcArchiveName) > 0 {
+		cmd, err := resolveBuildCommand(cl, envName, buildcmd, opts)
+		if err != nil {
+			e.line("build command", "error: %v", err)
+		} else {
+			e.line("build command", "%v", cmd)
+		}
+	}
+
+	e.section("storage")
+	e.line("storage service", "%v", storageUrl(cl))
+	e.line("storage prefix", "%v", defaulted(c, "storage-prefix", opts.storagePrefix))
+	e.line("inline limit", "%v", formatSize(opts.inlineLimit))
+	e.line("compression", "%v", defaulted(c, "compress", opts.compression))
+	if opts.compressionLevel != 0 {
+		e.line("compression level", "%v", opts.compressionLevel)
+	}
+	e.line("buffer size", "%v", defaulted(c, "buffer-size", opts.bufferSize))
+	e.line("max concurrent uploads", "%v", c.GlobalInt("max-concurrent-uploads"))
+	if len(opts.probe) > 0 {
+		e.line("probe", "%v, timeout %v", opts.probe, probeTimeout)
+	}
+	if opts.archiveTTL > 0 {
+		e.line("archive TTL", "%v", opts.archiveTTL)
+	}
+
+	if len(srcArchiveName) > 0 {
+		explainArchive(e, cl, "source", srcArchiveName, opts)
+	}
+	if len(deployArchiveName) > 0 {
+		explainArchive(e, cl, "deployment", deployArchiveName, opts)
+	}
+	e.w.Flush()
+}
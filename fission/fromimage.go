@@ -0,0 +1,500 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// Registry defaults, as docker has them.
+const (
+	defaultRegistry      = "registry-1.docker.io"
+	defaultImageTag      = "latest"
+	defaultImagePlatform = "linux/amd64"
+)
+
+// Media types of image manifests, indexes and layers the CLI reads.
+const (
+	mediaTypeOCIIndex          = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest       = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerList        = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCILayerGzip      = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayer          = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeDockerLayerGzip   = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// Whiteout files of image layers mark files deleted from lower
+// layers: .wh.<name> deletes name, and an opaque whiteout clears
+// its directory.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+type (
+	// imageReference is a parsed --from-image reference.
+	imageReference struct {
+		registry   string
+		repository string
+		tag        string
+		digest     string
+	}
+
+	imageDescriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int64  `json:"size"`
+		Platform  *struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform,omitempty"`
+	}
+
+	// imageManifest holds the parts of image manifests and
+	// indexes the CLI uses.
+	imageManifest struct {
+		MediaType string            `json:"mediaType"`
+		Layers    []imageDescriptor `json:"layers"`
+		Manifests []imageDescriptor `json:"manifests"`
+	}
+
+	// registryClient reads manifests and blobs of one repository,
+	// with anonymous token auth as registries such as Docker Hub
+	// require for public images.
+	registryClient struct {
+		ref   imageReference
+		token string
+	}
+)
+
+// parseImageReference splits an image reference into its registry,
+// repository, tag and digest, filling in docker's defaults.
+func parseImageReference(ref string) (imageReference, error) {
+	err := fission.ValidateImageReference(ref)
+	if err != nil {
+		return imageReference{}, err
+	}
+	var r imageReference
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, r.digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.tag = name[:i], name[i+1:]
+	}
+	if r.tag == "" && r.digest == "" {
+		r.tag = defaultImageTag
+	}
+
+	r.registry = defaultRegistry
+	if i := strings.Index(name, "/"); i >= 0 {
+		domain := name[:i]
+		if strings.ContainsAny(domain, ".:") || domain == "localhost" {
+			r.registry, name = domain, name[i+1:]
+		}
+	}
+	if r.registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	r.repository = name
+	return r, nil
+}
+
+// baseUrl returns the URL of the registry's API. Registries on
+// localhost are reached with plain HTTP, as docker does.
+func (r imageReference) baseUrl() string {
+	host := strings.Split(r.registry, ":")[0]
+	if host == "localhost" || host == "127.0.0.1" {
+		return "http://" + r.registry + "/v2/"
+	}
+	return "https://" + r.registry + "/v2/"
+}
+
+// get requests a path of the repository, authenticating with a token
+// if the registry asks for one.
+func (rc *registryClient) get(relativeUrl string, accept []string) (*http.Response, error) {
+	u := rc.ref.baseUrl() + rc.ref.repository + "/" + relativeUrl
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if len(rc.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+rc.token)
+		}
+		resp, err := getRemoteClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			rc.token, err = registryToken(challenge)
+			if err != nil {
+				return nil, fmt.Errorf("authenticate to %v: %w", rc.ref.registry, err)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %v: %v", u, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// registryToken gets an anonymous token as a Bearer challenge asks.
+func registryToken(challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported auth challenge '%v'", challenge)
+	}
+	params := make(map[string]string)
+	for _, p := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	realm := params["realm"]
+	if len(realm) == 0 {
+		return "", fmt.Errorf("no realm in auth challenge '%v'", challenge)
+	}
+	q := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			q.Set(k, v)
+		}
+	}
+	resp, err := getRemoteClient().Get(realm + "?" + q.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %v: %v", realm, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+	if len(body.Token) > 0 {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// manifest returns the image manifest for reference, a tag or
+// digest, resolving indexes to the manifest of defaultImagePlatform.
+// Manifests fetched by digest are verified against it.
+func (rc *registryClient) manifest(reference string) (*imageManifest, error) {
+	resp, err := rc.get("manifests/"+reference,
+		[]string{mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerList, mediaTypeDockerManifest})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		err = verifyDigest(reference, body)
+		if err != nil {
+			return nil, fmt.Errorf("manifest of %v: %w", rc.ref.repository, err)
+		}
+	}
+
+	var m imageManifest
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return nil, fmt.Errorf("parse manifest of %v: %w", rc.ref.repository, err)
+	}
+	if len(m.MediaType) == 0 {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	if m.MediaType != mediaTypeOCIIndex && m.MediaType != mediaTypeDockerList {
+		return &m, nil
+	}
+
+	platform := strings.SplitN(defaultImagePlatform, "/", 2)
+	for _, d := range m.Manifests {
+		if d.Platform != nil && d.Platform.OS == platform[0] && d.Platform.Architecture == platform[1] {
+			return rc.manifest(d.Digest)
+		}
+	}
+	return nil, fmt.Errorf("image %v has no %v manifest", rc.ref.repository, defaultImagePlatform)
+}
+
+// verifyDigest checks contents against a sha256 digest.
+func verifyDigest(digest string, contents []byte) error {
+	sum := sha256.Sum256(contents)
+	if "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return fmt.Errorf("%w: contents don't match digest %v", fission.ErrInvalidChecksum, digest)
+	}
+	return nil
+}
+
+// extractLayer applies the files of a layer under imagePath to dst,
+// verifying the layer's digest.
+func (rc *registryClient) extractLayer(layer imageDescriptor, imagePath string, dst string) error {
+	if !strings.HasPrefix(layer.Digest, "sha256:") {
+		return fmt.Errorf("%w: unsupported layer digest '%v'", fission.ErrInvalidChecksum, layer.Digest)
+	}
+	var gzipped bool
+	switch layer.MediaType {
+	case mediaTypeOCILayerGzip, mediaTypeDockerLayerGzip, mediaTypeDockerForeignGzip:
+		gzipped = true
+	case mediaTypeOCILayer:
+	default:
+		return fmt.Errorf("unsupported layer type '%v'", layer.MediaType)
+	}
+
+	resp, err := rc.get("blobs/"+layer.Digest, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	tee := io.TeeReader(resp.Body, h)
+	in := tee
+	if gzipped {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("layer %v: %w", layer.Digest, err)
+		}
+		in = zr
+	}
+	err = extractLayerTar(tar.NewReader(in), imagePath, dst)
+	if err != nil {
+		return fmt.Errorf("layer %v: %w", layer.Digest, err)
+	}
+
+	// the digest covers trailing bytes the tar reader didn't need
+	_, err = io.Copy(ioutil.Discard, tee)
+	if err != nil {
+		return err
+	}
+	if "sha256:"+hex.EncodeToString(h.Sum(nil)) != layer.Digest {
+		return fmt.Errorf("%w: layer doesn't match digest %v", fission.ErrInvalidChecksum, layer.Digest)
+	}
+	return nil
+}
+
+// extractLayerTar writes the entries of a layer below imagePath into
+// dst, relative to imagePath, applying whiteouts. Symlinks are left
+// out, since archives hold only files.
+func extractLayerTar(r *tar.Reader, imagePath string, dst string) error {
+	prefix := strings.TrimPrefix(path.Clean("/"+imagePath), "/")
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if len(prefix) > 0 && name == path.Join(path.Dir(prefix), whiteoutPrefix+path.Base(prefix)) {
+			// the image path itself was deleted
+			os.RemoveAll(dst)
+			err = os.MkdirAll(dst, 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		rel, ok := imageRelPath(name, prefix)
+		if !ok {
+			continue
+		}
+		dir, base := path.Split(rel)
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+
+		switch {
+		case base == whiteoutOpaque:
+			entries, _ := ioutil.ReadDir(filepath.Join(dst, filepath.FromSlash(dir)))
+			for _, e := range entries {
+				os.RemoveAll(filepath.Join(dst, filepath.FromSlash(dir), e.Name()))
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			deleted, ok := whiteoutTarget(dst, dir, base)
+			if !ok {
+				return fmt.Errorf("whiteout %v doesn't name a file below %v", hdr.Name, imagePath)
+			}
+			os.RemoveAll(deleted)
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeLayerFile(target, r, os.FileMode(hdr.Mode).Perm())
+		case tar.TypeLink:
+			linkName := strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")
+			linkRel, ok := imageRelPath(linkName, prefix)
+			if !ok {
+				verbose("Leaving out %v, a hard link to %v outside --image-path", name, hdr.Linkname)
+				continue
+			}
+			err = copyFile(filepath.Join(dst, filepath.FromSlash(linkRel)), target)
+		case tar.TypeSymlink:
+			verbose("Leaving out symlink %v", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// whiteoutTarget returns the path below dst that the whiteout base in
+// dir deletes. It returns false for whiteouts of names such as "." or
+// "..", which would delete dst or a path outside it.
+func whiteoutTarget(dst, dir, base string) (string, bool) {
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+	target := filepath.Join(dst, filepath.FromSlash(dir), name)
+	rel, err := filepath.Rel(dst, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
+
+// imageRelPath returns the path of a layer entry relative to the
+// image path prefix, if it is below it.
+func imageRelPath(name string, prefix string) (string, bool) {
+	if len(prefix) == 0 {
+		return name, len(name) > 0
+	}
+	if !strings.HasPrefix(name, prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(name, prefix+"/"), true
+}
+
+func writeLayerFile(target string, r io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	// a lower layer's file may be read-only
+	os.Remove(target)
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// extractImagePath pulls an image's layers and extracts the files
+// under imagePath into a new temporary directory, removed by the
+// returned cleanup function. Layers and manifests fetched by digest
+// are verified against their digests.
+func extractImagePath(ref string, imagePath string) (string, func(), error) {
+	r, err := parseImageReference(ref)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(r.digest) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %v isn't pinned to a digest, so the tag may point at other contents later; use %v@sha256:... for reproducible packages\n", ref, ref)
+	}
+
+	rc := &registryClient{ref: r}
+	reference := r.digest
+	if len(reference) == 0 {
+		reference = r.tag
+	}
+	m, err := rc.manifest(reference)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(m.Layers) == 0 {
+		return "", nil, fmt.Errorf("image %v has no layers", ref)
+	}
+
+	dir, err := ioutil.TempDir(stagingDir(), "fission-image-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	for _, layer := range m.Layers {
+		verbose("Extracting %v from layer %v of %v (%v)", imagePath, layer.Digest, ref, formatSize(layer.Size))
+		err = rc.extractLayer(layer, imagePath, dir)
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err == nil && len(entries) == 0 {
+		err = errors.New("no files")
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("%v in image %v: %w", imagePath, ref, err)
+	}
+	return dir, cleanup, nil
+}
+
+// createImageArchive makes an archive of the files under
+// opts.imagePath in the image opts.fromImage.
+func createImageArchive(client *client.Client, opts archiveOptions) (*fission.Archive, error) {
+	dir, cleanup, err := extractImagePath(opts.fromImage, opts.imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return createArchive(client, dir, opts)
+}
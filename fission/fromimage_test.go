@@ -0,0 +1,75 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// layerTar makes a layer of the given entries, directories ending with
+// a slash and other names being files.
+func layerTar(names ...string) *tar.Reader {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		panicIf(w.WriteHeader(hdr))
+	}
+	panicIf(w.Close())
+	return tar.NewReader(&buf)
+}
+
+func TestExtractLayerWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-fromimage-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "dst")
+	outside := filepath.Join(dir, "outside")
+	panicIf(os.MkdirAll(dst, 0755))
+	panicIf(ioutil.WriteFile(outside, nil, 0644))
+
+	panicIf(extractLayerTar(layerTar("app/", "app/a", "app/b"), "app", dst))
+	panicIf(extractLayerTar(layerTar("app/.wh.a"), "app", dst))
+	if _, err := os.Stat(filepath.Join(dst, "a")); !os.IsNotExist(err) {
+		log.Panicf("Expected a whiteout to delete its file, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "b")); err != nil {
+		log.Panicf("Expected other files to be kept, got %v", err)
+	}
+
+	// whiteouts of . and .. would delete dst or what's beside it
+	for _, name := range []string{"app/.wh..", "app/.wh...", "app/sub/.wh..."} {
+		if extractLayerTar(layerTar(name), "app", dst) == nil {
+			log.Panicf("Expected whiteout %v to be refused", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "b")); err != nil {
+		log.Panicf("Expected dst to be kept, got %v", err)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		log.Panicf("Expected files outside dst to be kept, got %v", err)
+	}
+}
@@ -19,11 +19,11 @@ package main
 import (
 	"context"
 	"crypto/sha256"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -35,120 +35,902 @@ import (
 	"github.com/fission/fission"
 	"github.com/fission/fission/controller/client"
 	"github.com/fission/fission/fission/logdb"
+	"github.com/fission/fission/storagesvc"
 	storageSvcClient "github.com/fission/fission/storagesvc/client"
 	"github.com/fission/fission/tpr"
 )
 
-func fileSize(filePath string) int64 {
-	info, err := os.Stat(filePath)
-	checkErr(err, fmt.Sprintf("stat %v", filePath))
-	return info.Size()
+// preparedArchive is a file or directory made ready to be stored in
+// a package: packed, transformed and, if it's too big to embed,
+// compressed. Nothing has been uploaded yet.
+type preparedArchive struct {
+	// srcName is what a manifest of the archive describes.
+	srcName string
+	scan    *dirScan
+
+	// literal is true if the archive should be embedded in the
+	// package; uploadName then holds the contents to embed.
+	literal     bool
+	uploadName  string
+	compression fission.ArchiveCompression
+
+	// checksum covers the bytes of uploadName.
+	checksum fission.Checksum
+
+	// contents holds an archive prepared in memory. If it's
+	// embedded it's only written to uploadName for
+	// --save-archive; otherwise it's spilled there to be
+	// uploaded.
+	contents []byte
+
+	// hints and structure are recorded on the stored archive.
+	hints     []fission.ArchiveHint
+	structure string
+
+	cleanups []func()
 }
 
-// upload a file and return a fission.Archive
-func createArchive(client *client.Client, fileName string) *fission.Archive {
+// close removes the prepared archive's temporary files.
+func (p *preparedArchive) close() {
+	for i := len(p.cleanups) - 1; i >= 0; i-- {
+		p.cleanups[i]()
+	}
+}
+
+// prepareArchive packs, transforms and compresses a file or directory
+// as opts ask, and decides whether to embed or upload it, as
+// createArchive does but without storing anything. The caller must
+// close the result.
+//
+// Archives of files held in memory and of stdin are prepared the same
+// way, with prepareScan and prepareContents taking the place of
+// packing and transforming the file; finish is the rest, shared by
+// all of them.
+func prepareArchive(fileName string, opts archiveOptions) (*preparedArchive, error) {
+	p := &preparedArchive{srcName: fileName, uploadName: fileName}
+	err := p.prepare(opts)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *preparedArchive) prepare(opts archiveOptions) error {
+	fileName := p.uploadName
+	layout := isLayoutArchive(fileName)
+	if layout {
+		fileName = strings.TrimPrefix(fileName, layoutArchivePrefix)
+		p.srcName = fileName
+	}
+	original := fileName
+
+	// directories and layout files are zipped up first; the scan
+	// total lets us skip the literal path when the contents are
+	// obviously too big.
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	packed := info.IsDir() || layout
+	if opts.embedBuildInfo && !packed {
+		fmt.Fprintf(os.Stderr, "Warning: %v isn't a directory or layout file, not embedding build info in it\n", p.srcName)
+	}
+	if opts.verifyReproducible && !packed {
+		verbose("%v isn't a directory or layout file, it is uploaded as it is", p.srcName)
+	}
+	compression, err := resolveCompression(opts.compression, packed)
+	if err != nil {
+		return err
+	}
+	opts.compressionLevel, err = resolveCompressionLevel(opts.compressionLevel, opts.compression, compression)
+	if err != nil {
+		return err
+	}
+	if packed && opts.withManifest {
+		// the manifest needs per-file checksums
+		opts.prescan = true
+	}
+	if packed {
+		var zipFile string
+		if layout {
+			zipFile, p.scan, err = packLayoutArchive(fileName, opts, compression != fission.ArchiveCompressionNone)
+		} else {
+			zipFile, p.scan, err = packDirArchive(fileName, opts, compression != fission.ArchiveCompressionNone)
+		}
+		if err != nil {
+			return err
+		}
+		p.cleanups = append(p.cleanups, func() { os.Remove(zipFile) })
+		if opts.verifyReproducible {
+			err = verifyReproducible(fileName, layout, zipFile, opts, compression != fission.ArchiveCompressionNone)
+			if err != nil {
+				return err
+			}
+		}
+		fileName = zipFile
+		info, err = os.Stat(zipFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(opts.transforms) > 0 {
+		transformed, cleanup, err := transformArchive(fileName, opts.transforms)
+		if err != nil {
+			return fmt.Errorf("transform %v: %w", p.srcName, err)
+		}
+		p.cleanups = append(p.cleanups, cleanup)
+		if p.scan != nil {
+			// the manifest must describe the transformed files
+			p.scan, err = scanZip(transformed)
+			if err != nil {
+				return err
+			}
+		} else {
+			p.srcName = transformed
+		}
+		fileName = transformed
+		info, err = os.Stat(fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.secrets != nil {
+		err = opts.secrets.check(p.srcName, fileName)
+		if err != nil {
+			return err
+		}
+	}
+	return p.finish(fileName, info.Size(), original, compression, opts)
+}
+
+// finish decides whether to embed or upload a packed and transformed
+// archive of size bytes, at fileName or in p.contents, compresses it
+// if it's uploaded, and checksums what is stored. original is the
+// file given, which only --checksum can be trusted for.
+func (p *preparedArchive) finish(fileName string, size int64, original string, compression fission.ArchiveCompression, opts archiveOptions) error {
+	if !opts.noHints && p.hints == nil {
+		p.hints = archiveHints(fileName, p.scan)
+		if len(p.hints) > 0 {
+			verbose("%v: hints %v", p.srcName, p.hints)
+		}
+	}
+	if p.scan != nil {
+		p.structure = p.scan.structure()
+	}
+
+	// a directory is only embedded if both its files and the zip
+	// are small enough
+	planned := size
+	if p.scan != nil && p.scan.totalSize > planned {
+		planned = p.scan.totalSize
+	}
+	plan := planArchive(planned, opts.inlineLimit)
+	verbose("%v: %v", p.srcName, plan.Reason)
+	p.literal = plan.Inline
+
+	// what's held in memory is only written to disk to be
+	// uploaded, or saved
+	onDisk := p.contents == nil
+	if !onDisk && (!p.literal || len(opts.saveArchive) > 0) {
+		err := p.spill(filepath.Base(p.srcName), p.contents)
+		if err != nil {
+			return err
+		}
+		if original == fileName {
+			original = p.uploadName
+		}
+		fileName = p.uploadName
+		onDisk = true
+	}
+
+	// the checksum covers the bytes actually stored, i.e. the
+	// compressed file
+	if !p.literal && compression != fission.ArchiveCompressionNone {
+		if p.scan == nil && p.contents == nil {
+			err := checkStagingSpace(size)
+			if err != nil {
+				return err
+			}
+		}
+		compressed, err := compressFile(fileName, compression, opts.compressionLevel, opts.bufferSize)
+		if err != nil {
+			return fmt.Errorf("compress file %v: %w", fileName, err)
+		}
+		p.cleanups = append(p.cleanups, func() { os.Remove(compressed) })
+
+		compressedInfo, err := os.Stat(compressed)
+		if err != nil {
+			return err
+		}
+		verbose("Compressed %v with %v: %v -> %v bytes (ratio %.2f)",
+			fileName, compression, size, compressedInfo.Size(),
+			float64(compressedInfo.Size())/float64(size))
+
+		fileName = compressed
+		p.compression = compression
+	}
+	if onDisk {
+		p.uploadName = fileName
+	}
+
+	if len(opts.checksum) > 0 {
+		// the checksum must cover the bytes actually stored
+		if len(original) == 0 || fileName != original {
+			return fmt.Errorf("--checksum needs %v stored as is, without packing, transforms or compression", p.srcName)
+		}
+		checksum, err := parseChecksumFlag(opts.checksum)
+		if err != nil {
+			return err
+		}
+		if opts.checksumSize > 0 && size != opts.checksumSize {
+			return fmt.Errorf("%w: %v is %v bytes, not the %v given by --checksum-size",
+				fission.ErrInvalidChecksum, fileName, size, opts.checksumSize)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: trusting the --checksum of %v as is, without hashing it\n", fileName)
+		p.checksum = checksum
+		return nil
+	}
+
+	if !onDisk {
+		sum := sha256.Sum256(p.contents)
+		p.checksum = fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:])
+		return nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("find file %v: %w", fileName, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := storageSvcClient.CopyBuffer(h, f, opts.bufferSize); err != nil {
+		return fmt.Errorf("calculate checksum for file %v: %w", fileName, err)
+	}
+	p.checksum = fission.MakeChecksum(fission.ChecksumTypeSHA256, h.Sum(nil))
+	return nil
+}
+
+// upload a file or directory and return a fission.Archive. Errors
+// wrap the archive error set of the fission package (e.g.
+// fission.ErrStorageUnavailable) where one applies. With --wait-scan,
+// the archive isn't returned until the storage service has scanned
+// it.
+func createArchive(client *client.Client, fileName string, opts archiveOptions) (*fission.Archive, error) {
+	archive, err := storeNewArchive(client, fileName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.waitScan {
+		err = waitScan(client, fileName, archive, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return archive, nil
+}
+
+// storeNewArchive makes and stores the archive of createArchive.
+func storeNewArchive(client *client.Client, fileName string, opts archiveOptions) (*fission.Archive, error) {
+	verbose("Creating archive from %v (request %v)", fileName, requestId)
+	if opts.files != nil {
+		p, err := prepareFilesArchive(fileName, opts.files, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer p.close()
+		return storeArchive(client, p, opts)
+	}
+	if fileName == stdinArchive {
+		return createStdinArchive(client, opts)
+	}
+	if isRemoteArchive(fileName) {
+		return createRemoteArchive(client, fileName, opts)
+	}
+	if files := splitArchiveFiles(fileName); len(files) > 1 {
+		if len(opts.checksum) > 0 {
+			return nil, fmt.Errorf("--checksum needs a single archive file, not %v", fileName)
+		}
+		return createPackedArchive(files, opts)
+	}
+	if opts.gitTree {
+		if fi, err := os.Stat(fileName); err == nil && fi.IsDir() {
+			return createGitTreeArchive(client, fileName, opts)
+		}
+	}
+
+	p, err := prepareArchive(fileName, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer p.close()
+	return storeArchive(client, p, opts)
+}
+
+// uploadTimeoutError is an upload stopped by --upload-timeout, as
+// opposed to the storage service or the network timing out.
+type uploadTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *uploadTimeoutError) Error() string {
+	return fmt.Sprintf("%v: upload took longer than --upload-timeout %v", e.err, e.timeout)
+}
+
+func (e *uploadTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// uploadContext returns the context an archive's upload is made with:
+// that of uploads, with opts.uploadTimeout if set.
+func uploadContext(opts archiveOptions) (context.Context, context.CancelFunc) {
+	if opts.uploadTimeout > 0 {
+		return context.WithTimeout(uploads.context(), opts.uploadTimeout)
+	}
+	return context.WithCancel(uploads.context())
+}
+
+// uploadTimeout marks err as an uploadTimeoutError if the upload made
+// with ctx failed since it ran out of time. The storage service
+// discards uploads cut short, and uploadParts deletes the parts it
+// stored, so nothing partial is left.
+func uploadTimeout(ctx context.Context, err error, opts archiveOptions) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return &uploadTimeoutError{timeout: opts.uploadTimeout, err: err}
+}
+
+// uploadMetadata is the metadata an archive is uploaded with: the
+// name it is downloaded as, and its tags.
+func uploadMetadata(p *preparedArchive, opts archiveOptions) map[string]string {
+	metadata := archiveTagMetadata(opts)
+	metadata[storagesvc.ArchiveNameMetadata] = archiveDownloadName(p, opts)
+	return metadata
+}
+
+// archiveTagMetadata is the upload metadata tagging an archive with
+// its --archive-tag tags, and with --git-metadata a git-sha tag of the
+// commit it was made from, so "storage find" can trace it. The parts,
+// chunks and manifests of an archive are tagged the same, but aren't
+// downloaded as it, so they aren't named.
+func archiveTagMetadata(opts archiveOptions) map[string]string {
+	metadata := make(map[string]string)
+	if commit := opts.annotations[gitCommitAnnotation]; len(commit) > 0 {
+		metadata[storagesvc.ArchiveTagMetadataPrefix+"git-sha"] = commit
+	}
+	for k, v := range opts.archiveTags {
+		metadata[storagesvc.ArchiveTagMetadataPrefix+k] = v
+	}
+	return metadata
+}
+
+// storeArchive embeds or uploads a prepared archive and returns the
+// fission.Archive referencing it.
+func storeArchive(client *client.Client, p *preparedArchive, opts archiveOptions) (*fission.Archive, error) {
+	if p.literal {
+		contents := p.contents
+		if contents == nil {
+			var err error
+			contents, err = ioutil.ReadFile(p.uploadName)
+			if err != nil {
+				return nil, fmt.Errorf("read %v: %w", p.uploadName, err)
+			}
+		}
+		return storeLiteral(client, p, contents, opts)
+	}
+	fi, err := os.Stat(p.uploadName)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSizeLimit(p.srcName, fi.Size(), opts)
+	if err != nil {
+		return nil, err
+	}
+
 	var archive fission.Archive
-	if fileSize(fileName) < fission.ArchiveLiteralSizeLimit {
-		contents := getContents(fileName)
-		archive.Type = fission.ArchiveTypeLiteral
-		archive.Literal = contents
-	} else {
-		u := strings.TrimSuffix(client.Url, "/") + "/proxy/storage"
-		ssClient := storageSvcClient.MakeClient(u)
 
-		// TODO add a progress bar
-		id, err := ssClient.Upload(fileName, nil)
-		checkErr(err, fmt.Sprintf("upload file %v", fileName))
+	err = uploads.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer uploads.end()
+
+	ctx, cancel := uploadContext(opts)
+	defer cancel()
+	ssOpts := append(archiveClientOptions(opts), storageSvcClient.WithContext(ctx))
+	if opts.batch != nil {
+		progress, reset := opts.batch.upload(p.srcName)
+		ssOpts = append(ssOpts, storageSvcClient.WithProgress(progress, progressUpdatesPerSecond),
+			storageSvcClient.WithProgressReset(reset))
+	} else if opts.progress {
+		ssOpts = append(ssOpts, storageSvcClient.WithProgress(progressBar(p.srcName), progressUpdatesPerSecond))
+	}
+	ssClient := getStorageClient(client, ssOpts...)
+	archive.Compression = p.compression
+	archive.Checksum = p.checksum
+	archive.Hints = p.hints
+	archive.Structure = p.structure
+
+	verbose("Uploading %v to the storage service (request %v)", p.srcName, requestId)
+
+	if opts.chunkSize > 0 {
+		a, err := storeParts(client, ssClient, p, &archive, opts)
+		return a, uploadTimeout(ctx, err, opts)
+	}
+	if opts.partSize > 0 {
+		if fi.Size() > opts.partSize {
+			a, err := storeParts(client, ssClient, p, &archive, opts)
+			return a, uploadTimeout(ctx, err, opts)
+		}
+	}
 
-		archiveUrl := ssClient.GetUrl(id)
+	var res *storageSvcClient.UploadResult
+	err = errPresignUnavailable
+	if opts.resumableUpload {
+		res, err = uploadResumable(ssClient, p, opts)
+	} else if opts.presignedUpload && opts.archiveTTL <= 0 {
+		// pre-signed archives don't expire
+		res, err = uploadPresigned(client, ssClient, p, opts)
+	}
+	if errors.Is(err, errPresignUnavailable) {
+		metadata := uploadMetadata(p, opts)
+		res, err = ssClient.UploadVerified(p.uploadName, opts.uploadPrefix(), archive.Checksum, &metadata)
+	}
+	if err != nil {
+		return nil, uploadTimeout(ctx, fmt.Errorf("upload file %v: %w", p.srcName, err), opts)
+	}
+	if res.Stored {
+		verbose("%v is already in the storage service, skipped upload", p.srcName)
+	}
+	if res.ServerChecksum != nil {
+		verbose("Storage service verified %v with %v", p.srcName, res.ServerChecksum.Type)
+	}
 
-		archive.Type = fission.ArchiveTypeUrl
-		archive.URL = archiveUrl
+	archive.Type = fission.ArchiveTypeUrl
+	archive.URL = ssClient.ArchiveUrl(res.ID)
+	archive.ServerChecksum = res.ServerChecksum
 
-		f, err := os.Open(fileName)
+	err = probeArchiveUrl(ssClient, archive.URL, opts.probe)
+	if err != nil {
+		return nil, err
+	}
+	archive.Mirrors = uploadMirrors(p, opts)
+	if opts.rangeChecksums {
+		archive.RangeManifest, err = storeRangeManifest(ssClient, p.uploadName, opts)
+		if err != nil {
+			return nil, fmt.Errorf("range checksums of %v: %w", p.srcName, err)
+		}
+	}
+	if len(opts.saveArchive) > 0 {
+		err = saveArchive(p.uploadName, p.srcName, opts.saveArchive, &archive.Checksum)
 		if err != nil {
-			checkErr(err, fmt.Sprintf("find file %v", fileName))
+			return nil, err
 		}
-		defer f.Close()
+	}
+
+	return addManifest(client, &archive, p.scan, p.srcName, opts)
+}
 
-		h := sha256.New()
-		if _, err := io.Copy(h, f); err != nil {
-			checkErr(err, fmt.Sprintf("calculate checksum for file %v", fileName))
+// storeLiteral embeds a prepared archive, whose contents are given,
+// in the package. uploadName need only exist if --save-archive asks
+// for a copy of it.
+func storeLiteral(client *client.Client, p *preparedArchive, contents []byte, opts archiveOptions) (*fission.Archive, error) {
+	err := checkSizeLimit(p.srcName, int64(len(contents)), opts)
+	if err != nil {
+		return nil, err
+	}
+	archive := &fission.Archive{
+		Type:      fission.ArchiveTypeLiteral,
+		Literal:   contents,
+		Checksum:  p.checksum,
+		Hints:     p.hints,
+		Structure: p.structure,
+	}
+	if len(opts.saveArchive) > 0 {
+		err = saveArchive(p.uploadName, p.srcName, opts.saveArchive, nil)
+		if err != nil {
+			return nil, err
 		}
+	}
+	return addManifest(client, archive, p.scan, p.srcName, opts)
+}
 
-		archive.Checksum = fission.Checksum{
-			Type: fission.ChecksumTypeSHA256,
-			Sum:  hex.EncodeToString(h.Sum(nil)),
+// archiveDownloadName returns the file name an uploaded archive is
+// downloaded as: --archive-name, else the package name or the name of
+// the archived file, with the extensions of what's stored.
+func archiveDownloadName(p *preparedArchive, opts archiveOptions) string {
+	if len(opts.archiveName) > 0 {
+		return opts.archiveName
+	}
+	base := filepath.Base(p.srcName)
+	ext := filepath.Ext(base)
+	if p.scan != nil && !strings.EqualFold(ext, ".zip") {
+		// a directory, zipped up
+		base += ".zip"
+		ext = ".zip"
+	}
+	name := base
+	if len(opts.packageName) > 0 {
+		name = opts.packageName + ext
+	}
+	if p.compression == fission.ArchiveCompressionGzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// storeParts uploads a prepared archive in parts or chunks. Mirrors
+// aren't supported for split archives.
+func storeParts(client *client.Client, ssClient *storageSvcClient.Client, p *preparedArchive, archive *fission.Archive, opts archiveOptions) (*fission.Archive, error) {
+	if len(opts.mirrors) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %v is split into parts, not uploading it to mirrors\n", p.srcName)
+	}
+	parts, chunks, err := uploadParts(ssClient, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	archive.Type = fission.ArchiveTypeUrl
+	archive.Parts = parts
+	archive.Chunks = chunks
+	for _, u := range parts {
+		err = probeArchiveUrl(ssClient, u, opts.probe)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return &archive
+	if len(opts.saveArchive) > 0 {
+		err = saveArchive(p.uploadName, p.srcName, opts.saveArchive, &archive.Checksum)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return addManifest(client, archive, p.scan, p.srcName, opts)
+}
+
+// addManifest stores a manifest for the archive made from srcName if
+// opts asks for one.
+func addManifest(client *client.Client, archive *fission.Archive, scan *dirScan, srcName string, opts archiveOptions) (*fission.Archive, error) {
+	if !opts.withManifest {
+		return archive, nil
+	}
+	manifest, err := makeManifest(scan, srcName)
+	if err != nil {
+		return nil, fmt.Errorf("create manifest for %v: %w", srcName, err)
+	}
+	archive.Manifest, err = storeManifest(getStorageClient(client, storageSvcClient.WithContext(uploads.context())), manifest, opts)
+	if err != nil {
+		return nil, err
+	}
+	verbose("Stored manifest of %v files for %v", len(manifest.Files), srcName)
+	return archive, nil
 }
 
-func createPackage(client *client.Client, envName, srcArchiveName, deployArchiveName, buildcmd string) *metav1.ObjectMeta {
+// makePackageSpec uploads the archives and returns the spec of a
+// package made from them, along with its initial build status.
+func makePackageSpec(client *client.Client, envName, srcArchiveName, deployArchiveName, buildcmd string, opts archiveOptions) (*fission.PackageSpec, fission.BuildStatus, error) {
 	pkgSpec := fission.PackageSpec{
 		Environment: fission.EnvironmentReference{
-			Namespace: metav1.NamespaceDefault,
+			Namespace: packageNamespace,
 			Name:      envName,
 		},
 	}
 	var pkgStatus fission.BuildStatus = fission.BuildStatusSucceeded
 
+	if len(opts.stdinName) > 0 && len(srcArchiveName) == 0 && len(deployArchiveName) == 0 && len(opts.fromImage) == 0 {
+		deployArchiveName = stdinArchive
+	}
+	if srcArchiveName == stdinArchive && deployArchiveName == stdinArchive {
+		return nil, "", fmt.Errorf("only one of --src and --deploy can read stdin")
+	}
+	usage, err := checkPackageQuota(client, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	srcArchiveName, deployArchiveName, err = checkEnvironmentLayout(client, envName, srcArchiveName, deployArchiveName, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	err = checkEnvironmentCompat(client, envName, []string{srcArchiveName, deployArchiveName}, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	var env *tpr.Environment
+	if len(srcArchiveName) > 0 {
+		// before anything is uploaded for a build that can't run
+		env, err = environmentBuilder(client, envName, opts)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	opts.sizeLimit, opts.sizeLimitOwner = environmentSizeLimit(client, envName, opts)
+	if len(opts.checksum) > 0 && len(deployArchiveName) > 0 && len(srcArchiveName) > 0 {
+		return nil, "", fmt.Errorf("--checksum can't be used with both a source and a deployment archive")
+	}
+	if len(srcArchiveName) > 0 && (len(deployArchiveName) > 0 || len(opts.fromImage) > 0) {
+		if opts.deploymentPolicy == fission.DeploymentPolicyOverwrite {
+			if opts.noBuildOverwrite {
+				return nil, "", fission.MakeError(fission.ErrorInvalidArgument,
+					"The build would overwrite the deployment archive given with the source archive; use --deployment-policy to keep it")
+			}
+			fmt.Fprintln(os.Stderr, "Warning: deployment may be overwritten by builder manager after source package compilation; use --deployment-policy to keep it")
+		}
+		pkgSpec.DeploymentPolicy = opts.deploymentPolicy
+	}
+
+	if len(opts.fromImage) > 0 {
+		if len(deployArchiveName) > 0 {
+			return nil, "", fmt.Errorf("--from-image and --deploy can't be used together")
+		}
+		archive, err := createImageArchive(client, opts)
+		if err != nil {
+			return nil, "", fmt.Errorf("archive %v of image %v: %w", opts.imagePath, opts.fromImage, err)
+		}
+		pkgSpec.Deployment = *archive
+	}
 	if len(deployArchiveName) > 0 {
-		pkgSpec.Deployment = *createArchive(client, deployArchiveName)
-		if len(srcArchiveName) > 0 {
-			fmt.Println("Deployment may be overwritten by builder manager after source package compilation")
+		archive, err := createArchive(client, deployArchiveName, opts)
+		if err != nil {
+			return nil, "", err
 		}
+		pkgSpec.Deployment = *archive
 	}
 	if len(srcArchiveName) > 0 {
-		pkgSpec.Source = *createArchive(client, srcArchiveName)
+		archive, err := createArchive(client, srcArchiveName, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		pkgSpec.Source = *archive
 		// set pending status to package
 		pkgStatus = fission.BuildStatusPending
 	}
 
+	logPackageArchives(&pkgSpec, srcArchiveName, deployArchiveName, opts)
+
+	if len(srcArchiveName) > 0 {
+		buildcmd = defaultBuildCommand(env, buildcmd, opts)
+	}
+
+	buildEnv, err := parseBuildEnv(opts.buildEnv, opts.buildEnvSecrets)
+	if err != nil {
+		return nil, "", err
+	}
+	pkgSpec.BuildEnv = buildEnv
+
+	if len(opts.builderImage) > 0 {
+		err := fission.ValidateImageReference(opts.builderImage)
+		if err != nil {
+			return nil, "", err
+		}
+		pkgSpec.BuilderImage = opts.builderImage
+	}
+
 	if len(buildcmd) > 0 {
+		err := checkBuildCommand(buildcmd, opts.strictBuildLint)
+		if err != nil {
+			return nil, "", err
+		}
 		pkgSpec.BuildCommand = buildcmd
 	}
+	err = setBuildHooks(&pkgSpec, len(srcArchiveName) > 0, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	err = setBuildRefs(client, &pkgSpec, len(srcArchiveName) > 0, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = attachSupplyChainFiles(client, &pkgSpec, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	err = checkSpecQuota(client, usage, &pkgSpec)
+	if err != nil {
+		return nil, "", err
+	}
+	return &pkgSpec, pkgStatus, nil
+}
+
+// setBuildHooks records the --pre-build and --post-build hooks on a
+// package spec, linted like build commands. Only packages with source
+// archives are built, so others warn that the hooks are ignored.
+func setBuildHooks(pkgSpec *fission.PackageSpec, hasSource bool, opts archiveOptions) error {
+	if len(opts.preBuild) == 0 && len(opts.postBuild) == 0 {
+		return nil
+	}
+	if !hasSource {
+		fmt.Fprintf(os.Stderr, "Warning: --pre-build and --post-build are ignored without a source archive to build\n")
+		return nil
+	}
+	for _, cmd := range append(append([]string{}, opts.preBuild...), opts.postBuild...) {
+		if len(strings.TrimSpace(cmd)) == 0 {
+			return flagError("build hooks can't be empty")
+		}
+		err := checkBuildCommand(cmd, opts.strictBuildLint)
+		if err != nil {
+			return err
+		}
+	}
+	pkgSpec.PreBuildCommands = opts.preBuild
+	pkgSpec.PostBuildCommands = opts.postBuild
+	return nil
+}
 
-	pkgName := strings.ToLower(uuid.NewV4().String())
+// setBuildRefs records the --build-secret and --build-configmap
+// mounts on a package spec, checking with the controller that they
+// exist in the package's namespace unless --skip-ref-check is given:
+// the build would fail without them. Like hooks, they are ignored
+// without a source archive.
+func setBuildRefs(client *client.Client, pkgSpec *fission.PackageSpec, hasSource bool, opts archiveOptions) error {
+	if len(opts.buildSecrets) == 0 && len(opts.buildConfigMaps) == 0 {
+		return nil
+	}
+	if !hasSource {
+		fmt.Fprintf(os.Stderr, "Warning: --build-secret and --build-configmap are ignored without a source archive to build\n")
+		return nil
+	}
+	spec := fission.PackageSpec{BuildSecrets: opts.buildSecrets, BuildConfigMaps: opts.buildConfigMaps}
+	err := fission.ValidateBuildRefs(&spec)
+	if err != nil {
+		return err
+	}
+	if opts.skipRefCheck {
+		verbose("Not checking build secrets %v and configmaps %v", opts.buildSecrets, opts.buildConfigMaps)
+	} else {
+		missing, err := client.PackageCheckBuildRefs(packageNamespace, opts.buildSecrets, opts.buildConfigMaps)
+		if err != nil {
+			return fmt.Errorf("check build secrets and configmaps (skip with --skip-ref-check): %w", err)
+		}
+		if len(missing) > 0 {
+			return fission.MakeError(fission.ErrorInvalidArgument,
+				fmt.Sprintf("%v not found in namespace %v; create them first, or use --skip-ref-check", strings.Join(missing, ", "), packageNamespace))
+		}
+	}
+	pkgSpec.BuildSecrets = opts.buildSecrets
+	pkgSpec.BuildConfigMaps = opts.buildConfigMaps
+	return nil
+}
+
+// keepBuildHooks uses the build hooks and mounts of a function's old
+// package for its new one, like its build command, unless others are
+// given. Only a new source archive is built, so only it keeps them.
+func keepBuildHooks(c *cli.Context, opts *archiveOptions, old *fission.PackageSpec, hasSource bool) {
+	if !hasSource {
+		return
+	}
+	if !c.IsSet("pre-build") {
+		opts.preBuild = old.PreBuildCommands
+	}
+	if !c.IsSet("post-build") {
+		opts.postBuild = old.PostBuildCommands
+	}
+	if !c.IsSet("build-secret") && !c.IsSet("build-configmap") {
+		opts.buildSecrets = old.BuildSecrets
+		opts.buildConfigMaps = old.BuildConfigMaps
+	}
+}
+
+// environmentBuilder returns the environment a source package is
+// built in, failing if it has no builder: the package would stay
+// pending forever. With --no-builder-check, that's only a warning, for
+// environments a builder is about to be added to.
+func environmentBuilder(client *client.Client, envName string, opts archiveOptions) (*tpr.Environment, error) {
+	env, err := client.EnvironmentGet(&metav1.ObjectMeta{
+		Namespace: packageNamespace,
+		Name:      envName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get environment %v: %w", envName, err)
+	}
+	if len(env.Spec.Builder.Image) > 0 {
+		return env, nil
+	}
+	if opts.noBuilderCheck {
+		fmt.Fprintf(os.Stderr, "Warning: environment %v has no builder, the package stays pending until one is added\n", envName)
+		return env, nil
+	}
+	return nil, fission.MakeError(fission.ErrorInvalidArgument,
+		fmt.Sprintf("environment %v has no builder, so source packages can't be built; add a builder to the environment, or give a deployment archive with --deploy instead", envName))
+}
+
+// resolveBuildCommand checks that the environment can build source
+// packages, and returns the build command to use: buildcmd if set,
+// else the environment's default unless --no-default-build is given.
+func resolveBuildCommand(client *client.Client, envName, buildcmd string, opts archiveOptions) (string, error) {
+	env, err := environmentBuilder(client, envName, opts)
+	if err != nil {
+		return "", err
+	}
+	return defaultBuildCommand(env, buildcmd, opts), nil
+}
+
+// defaultBuildCommand returns buildcmd, or if it's empty the build
+// command of the environment, unless --no-default-build is set.
+func defaultBuildCommand(env *tpr.Environment, buildcmd string, opts archiveOptions) string {
+	if len(buildcmd) > 0 || opts.noDefaultBuild || len(env.Spec.Builder.Command) == 0 {
+		return buildcmd
+	}
+	fmt.Fprintf(os.Stderr, "Using build command '%v' from environment %v\n", env.Spec.Builder.Command, env.Metadata.Name)
+	return env.Spec.Builder.Command
+}
+
+func createPackage(client *client.Client, envName, srcArchiveName, deployArchiveName, buildcmd string, opts archiveOptions) (*metav1.ObjectMeta, error) {
+	if len(opts.aliasOf) > 0 {
+		if len(srcArchiveName) > 0 || len(deployArchiveName) > 0 {
+			return nil, flagError("--alias-of can't be used with --src, --deploy or --code")
+		}
+		return createAliasPackage(client, envName, opts.aliasOf, opts)
+	}
+	if len(opts.builderImage) > 0 && len(srcArchiveName) == 0 {
+		return nil, flagError("--builder-image needs a source archive to build, use --src")
+	}
+	opts.annotations = packageGitMetadata(srcArchiveName, deployArchiveName, opts)
+	if opts.deferUpload {
+		return createDeferredPackage(client, envName, srcArchiveName, deployArchiveName, buildcmd, opts)
+	}
+	pkgSpec, pkgStatus, err := makePackageSpec(client, envName, srcArchiveName, deployArchiveName, buildcmd, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := saveNewPackage(client, pkgSpec, pkgStatus, opts)
+	if err != nil {
+		return nil, err
+	}
+	verbose("Created package %v (request %v)", m.Name, requestId)
+	return m, nil
+}
+
+// savePackage creates a package with the given name, spec and
+// annotations, which may be nil.
+func savePackage(client *client.Client, pkgName string, pkgSpec *fission.PackageSpec, pkgStatus fission.BuildStatus, annotations map[string]string) (*metav1.ObjectMeta, error) {
 	pkg := &tpr.Package{
 		Metadata: metav1.ObjectMeta{
-			Name:      pkgName,
-			Namespace: metav1.NamespaceDefault,
+			Name:        pkgName,
+			Namespace:   packageNamespace,
+			Annotations: annotations,
 		},
-		Spec: pkgSpec,
+		Spec: *pkgSpec,
 		Status: fission.PackageStatus{
 			BuildStatus: pkgStatus,
 		},
 	}
 	pkgMetadata, err := client.PackageCreate(pkg)
-	checkErr(err, "create package")
-	return pkgMetadata
+	if err != nil {
+		return nil, fmt.Errorf("create package: %w", err)
+	}
+	return pkgMetadata, nil
 }
 
-func getContents(filePath string) []byte {
-	var code []byte
-	var err error
-
-	code, err = ioutil.ReadFile(filePath)
-	checkErr(err, fmt.Sprintf("read %v", filePath))
-	return code
+// checkFunctionArchiveTTL refuses --archive-ttl for packages made for
+// a function, unless forced: the storage service would delete the
+// archives while the function still uses them.
+func checkFunctionArchiveTTL(opts archiveOptions) {
+	if opts.archiveTTL > 0 && !opts.forceArchiveTTL {
+		fatalUsage("--archive-ttl would expire archives of a function's package while the function uses them; " +
+			"use --force-archive-ttl if the function is ephemeral too.")
+	}
 }
 
 func fnCreate(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 
 	if len(c.String("package")) > 0 {
-		fatal("--package is deprecated, please use --deploy instead.")
+		fatalUsage("--package is deprecated, please use --deploy instead.")
 	}
 
 	fnName := c.String("name")
 	if len(fnName) == 0 {
-		fatal("Need --name argument.")
+		fatalUsage("Need --name argument.")
 	}
 
 	envName := c.String("env")
 	if len(envName) == 0 {
-		fatal("Need --env argument.")
+		fatalUsage("Need --env argument.")
 	}
 
 	srcArchiveName := c.String("src")
@@ -157,27 +939,27 @@ func fnCreate(c *cli.Context) error {
 		deployArchiveName = c.String("deploy")
 	}
 
-	if len(srcArchiveName) == 0 && len(deployArchiveName) == 0 {
-		fatal("Need --code or --deploy to specify deployment archive, or use --src to specify source archive.")
+	if len(srcArchiveName) == 0 && len(deployArchiveName) == 0 && len(c.String("alias-of")) == 0 && len(c.String("from-image")) == 0 && len(c.String("stdin-name")) == 0 {
+		fatalUsage("Need --code or --deploy to specify deployment archive, use --src to specify source archive, --from-image to archive files of an image, --stdin-name to read one from stdin, or --alias-of to use an existing package.")
 	}
 
 	entrypoint := c.String("entrypoint")
 	buildcmd := c.String("buildcmd")
-	if len(buildcmd) == 0 {
-		buildcmd = "/builder"
-	}
 
-	pkgMetadata := createPackage(client, envName, srcArchiveName, deployArchiveName, buildcmd)
+	opts := getArchiveOptions(c)
+	checkFunctionArchiveTTL(opts)
+	pkgMetadata, err := createPackage(client, envName, srcArchiveName, deployArchiveName, buildcmd, opts)
+	checkErr(err, "create package")
 
 	function := &tpr.Function{
 		Metadata: metav1.ObjectMeta{
 			Name:      fnName,
-			Namespace: metav1.NamespaceDefault,
+			Namespace: packageNamespace,
 		},
 		Spec: fission.FunctionSpec{
 			Environment: fission.EnvironmentReference{
 				Name:      envName,
-				Namespace: metav1.NamespaceDefault,
+				Namespace: packageNamespace,
 			},
 			Package: fission.FunctionPackageRef{
 				FunctionName: entrypoint,
@@ -190,7 +972,7 @@ func fnCreate(c *cli.Context) error {
 		},
 	}
 
-	_, err := client.FunctionCreate(function)
+	_, err = client.FunctionCreate(function)
 	checkErr(err, "create function")
 
 	fmt.Printf("function '%v' created\n", fnName)
@@ -208,7 +990,7 @@ func fnCreate(c *cli.Context) error {
 	ht := &tpr.Httptrigger{
 		Metadata: metav1.ObjectMeta{
 			Name:      triggerName,
-			Namespace: metav1.NamespaceDefault,
+			Namespace: packageNamespace,
 		},
 		Spec: fission.HTTPTriggerSpec{
 			RelativeURL: triggerUrl,
@@ -231,11 +1013,11 @@ func fnGet(c *cli.Context) error {
 
 	fnName := c.String("name")
 	if len(fnName) == 0 {
-		fatal("Need name of function, use --name")
+		fatalUsage("Need name of function, use --name")
 	}
 	m := &metav1.ObjectMeta{
 		Name:      fnName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	}
 	fn, err := client.FunctionGet(m)
 	checkErr(err, "get function")
@@ -255,12 +1037,12 @@ func fnGetMeta(c *cli.Context) error {
 
 	fnName := c.String("name")
 	if len(fnName) == 0 {
-		fatal("Need name of function, use --name")
+		fatalUsage("Need name of function, use --name")
 	}
 
 	m := &metav1.ObjectMeta{
 		Name:      fnName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	}
 
 	f, err := client.FunctionGet(m)
@@ -279,16 +1061,16 @@ func fnUpdate(c *cli.Context) error {
 
 	fnName := c.String("name")
 	if len(fnName) == 0 {
-		fatal("Need name of function, use --name")
+		fatalUsage("Need name of function, use --name")
 	}
 
 	if len(c.String("package")) > 0 {
-		fatal("--package is deprecated, please use --deploy instead.")
+		fatalUsage("--package is deprecated, please use --deploy instead.")
 	}
 
 	function, err := client.FunctionGet(&metav1.ObjectMeta{
 		Name:      fnName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, fmt.Sprintf("read function '%v'", fnName))
 
@@ -300,7 +1082,7 @@ func fnUpdate(c *cli.Context) error {
 	srcArchiveName := c.String("src")
 
 	if len(envName) == 0 && len(deployArchiveName) == 0 && len(srcArchiveName) == 0 {
-		fatal("Need --env or --code or --package or --deploy argument.")
+		fatalUsage("Need --env or --code or --package or --deploy argument.")
 	}
 
 	if len(envName) > 0 {
@@ -326,8 +1108,12 @@ func fnUpdate(c *cli.Context) error {
 
 	if len(deployArchiveName) > 0 || len(srcArchiveName) > 0 {
 		// create a new package for function
-		pkgMetadata := createPackage(client,
-			function.Spec.Environment.Name, srcArchiveName, deployArchiveName, buildcmd)
+		opts := getArchiveOptions(c)
+		checkFunctionArchiveTTL(opts)
+		keepBuildHooks(c, &opts, &pkg.Spec, len(srcArchiveName) > 0)
+		pkgMetadata, err := createPackage(client,
+			function.Spec.Environment.Name, srcArchiveName, deployArchiveName, buildcmd, opts)
+		checkErr(err, "create package")
 
 		// update function spec with resource version
 		function.Spec.Package.PackageRef = fission.PackageRef{
@@ -344,17 +1130,89 @@ func fnUpdate(c *cli.Context) error {
 	return err
 }
 
+// fnSetPackage points a function at another package: an existing one
+// given with --pkg, or one created from --src/--deploy. With --wait,
+// the package must build successfully first; otherwise the function
+// keeps its old package.
+func fnSetPackage(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	fnName := c.String("name")
+	if len(fnName) == 0 {
+		fatalUsage("Need name of function, use --name")
+	}
+	fnMeta := &metav1.ObjectMeta{Name: fnName, Namespace: packageNamespace}
+
+	pkgName := c.String("pkg")
+	srcArchiveName := c.String("src")
+	deployArchiveName := c.String("code")
+	if len(deployArchiveName) == 0 {
+		deployArchiveName = c.String("deploy")
+	}
+	hasPkg := len(pkgName) > 0
+	hasArchives := len(srcArchiveName) > 0 || len(deployArchiveName) > 0
+	if hasPkg == hasArchives {
+		fatalUsage("Need either --pkg, an existing package, or --src or --deploy to create one.")
+	}
+	if c.Bool("follow") && !c.Bool("wait") {
+		fatalUsage("--follow needs --wait.")
+	}
+
+	function, err := client.FunctionGet(fnMeta)
+	checkErr(err, fmt.Sprintf("read function '%v'", fnName))
+	oldPkg := function.Spec.Package.PackageRef.Name
+
+	pkgMeta := &metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace}
+	if hasArchives {
+		oldPkgMeta := &metav1.ObjectMeta{Name: oldPkg, Namespace: function.Spec.Package.PackageRef.Namespace}
+		opts := getArchiveOptions(c)
+		checkFunctionArchiveTTL(opts)
+		buildcmd := c.String("buildcmd")
+		if pkg, err := client.PackageGet(oldPkgMeta); err == nil {
+			if len(buildcmd) == 0 {
+				buildcmd = pkg.Spec.BuildCommand
+			}
+			keepBuildHooks(c, &opts, &pkg.Spec, len(srcArchiveName) > 0)
+		}
+		pkgMeta, err = createPackage(client, function.Spec.Environment.Name, srcArchiveName, deployArchiveName, buildcmd, opts)
+		checkErr(err, "create package")
+		fmt.Printf("package '%v' created\n", pkgMeta.Name)
+	}
+
+	if c.Bool("wait") {
+		status, err := waitForBuild(client, pkgMeta, c.Bool("follow"))
+		checkErr(err, fmt.Sprintf("wait for package '%v'", pkgMeta.Name))
+		if status.BuildStatus != fission.BuildStatusSucceeded {
+			fatalWithCode(buildExitCode(status.BuildStatus), fmt.Sprintf("Package '%v' is %v; function '%v' is still on package '%v'.",
+				pkgMeta.Name, status.BuildStatus, fnName, oldPkg))
+		}
+	} else {
+		pkg, err := client.PackageGet(pkgMeta)
+		checkErr(err, fmt.Sprintf("read package '%v'", pkgMeta.Name))
+		switch pkg.Status.BuildStatus {
+		case fission.BuildStatusFailed, fission.BuildStatusAwaitingUpload:
+			fatalWithCode(buildExitCode(pkg.Status.BuildStatus), fmt.Sprintf("Package '%v' is %v; function '%v' is still on package '%v'.",
+				pkgMeta.Name, pkg.Status.BuildStatus, fnName, oldPkg))
+		}
+	}
+
+	_, err = client.FunctionSetPackage(fnMeta, pkgMeta)
+	checkErr(err, fmt.Sprintf("point function '%v' at package '%v'; it is still on package '%v'", fnName, pkgMeta.Name, oldPkg))
+	fmt.Printf("function '%v' now uses package '%v' (was '%v')\n", fnName, pkgMeta.Name, oldPkg)
+	return nil
+}
+
 func fnDelete(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 
 	fnName := c.String("name")
 	if len(fnName) == 0 {
-		fatal("Need name of function, use --name")
+		fatalUsage("Need name of function, use --name")
 	}
 
 	m := &metav1.ObjectMeta{
 		Name:      fnName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	}
 
 	err := client.FunctionDelete(m)
@@ -367,19 +1225,17 @@ func fnDelete(c *cli.Context) error {
 func fnList(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 
+	output := c.String("output")
+	checkOutputFormat(output)
+
 	fns, err := client.FunctionList()
 	checkErr(err, "list functions")
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-
-	fmt.Fprintf(w, "%v\t%v\t%v\n", "NAME", "UID", "ENV")
+	t := newTable("NAME", "UID", "ENV")
 	for _, f := range fns {
-		fmt.Fprintf(w, "%v\t%v\t%v\n",
-			f.Metadata.Name, f.Metadata.UID, f.Spec.Environment.Name)
+		t.addRow(f.Metadata.Name, f.Metadata.UID, f.Spec.Environment.Name)
 	}
-	w.Flush()
-
-	return err
+	return t.print(os.Stdout, output)
 }
 
 func fnLogs(c *cli.Context) error {
@@ -387,7 +1243,7 @@ func fnLogs(c *cli.Context) error {
 
 	fnName := c.String("name")
 	if len(fnName) == 0 {
-		fatal("Need name of function, use --name")
+		fatalUsage("Need name of function, use --name")
 	}
 
 	dbType := c.String("dbtype")
@@ -398,7 +1254,7 @@ func fnLogs(c *cli.Context) error {
 	fnPod := c.String("pod")
 	m := &metav1.ObjectMeta{
 		Name:      fnName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	}
 
 	f, err := client.FunctionGet(m)
@@ -461,7 +1317,7 @@ func fnPods(c *cli.Context) error {
 
 	fnName := c.String("name")
 	if len(fnName) == 0 {
-		fatal("Need name of function, use --name")
+		fatalUsage("Need name of function, use --name")
 	}
 
 	dbType := c.String("dbtype")
@@ -0,0 +1,257 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// Annotations recording the git checkout a package's archive was made
+// from, set by --git-metadata.
+const (
+	gitCommitAnnotation = "fission.io/git-commit"
+	gitBranchAnnotation = "fission.io/git-branch"
+	gitDirtyAnnotation  = "fission.io/git-dirty"
+)
+
+// git runs a git command in dir and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %v: %v: %v", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitArchiveDirty returns true if the files archived from scope, a
+// directory or file under dir, differ from those committed. git status
+// lists changed and untracked files but not ignored ones, which are
+// archived all the same unless --ignore leaves them out, so the files
+// git tracks are also compared with those the archive would have.
+func gitArchiveDirty(dir, scope string, opts archiveOptions) (bool, error) {
+	status, err := git(dir, "status", "--porcelain", "--", scope)
+	if err != nil {
+		return false, err
+	}
+	if len(status) > 0 {
+		return true, nil
+	}
+	out, err := git(dir, "ls-files", "-z", "--", scope)
+	if err != nil {
+		return false, err
+	}
+	tracked := make(map[string]bool)
+	for _, p := range strings.Split(out, "\x00") {
+		if len(p) > 0 {
+			tracked[p] = true
+		}
+	}
+
+	archived := []string{scope}
+	if scope == "." {
+		scan, err := scanDir(dir, archiveOptions{ignore: opts.ignore})
+		if err != nil {
+			return false, err
+		}
+		archived = nil
+		for _, e := range scan.entries {
+			if opts.maxFileSize > 0 && e.info.Size() > opts.maxFileSize {
+				continue
+			}
+			archived = append(archived, e.relPath)
+		}
+	}
+	if len(archived) != len(tracked) {
+		return true, nil
+	}
+	for _, p := range archived {
+		if !tracked[p] {
+			verbose("%v would be archived but isn't committed", p)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// gitTreeHash returns the SHA of the committed git tree of dir. It
+// returns an empty string if dir isn't in a git worktree, or if the
+// files that would be archived aren't exactly those committed, since
+// the tree then doesn't describe them.
+func gitTreeHash(dir string) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		verbose("git not found, using content hashing for %v", dir)
+		return ""
+	}
+	if _, err := git(dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		verbose("%v is not in a git worktree, using content hashing", dir)
+		return ""
+	}
+	dirty, err := gitArchiveDirty(dir, ".", archiveOptions{})
+	if err != nil || dirty {
+		verbose("%v has uncommitted, untracked or ignored files, using content hashing", dir)
+		return ""
+	}
+	tree, err := git(dir, "rev-parse", "HEAD:./")
+	if err != nil {
+		verbose("Can't read the git tree of %v: %v", dir, err)
+		return ""
+	}
+	return tree
+}
+
+// findGitTreeArchive returns an existing package archive made from the
+// same git tree with the same options, so it can be reused without
+// packing or uploading anything. Options that change the archived
+// bytes other than compression aren't recorded, so archives made with
+// them are never reused.
+func findGitTreeArchive(client *client.Client, tree string, opts archiveOptions) (*fission.Archive, error) {
+	if len(opts.transforms) > 0 || len(opts.ignore) > 0 || opts.maxFileSize > 0 || opts.embedBuildInfo || opts.reproducible {
+		return nil, nil
+	}
+	compression, err := resolveCompression(opts.compression, true)
+	if err != nil {
+		return nil, err
+	}
+	pkgs, err := client.PackageList()
+	if err != nil {
+		return nil, err
+	}
+	for i := range pkgs {
+		for _, archive := range []*fission.Archive{&pkgs[i].Spec.Source, &pkgs[i].Spec.Deployment} {
+			if archive.GitTree != tree || archive.Compression != compression {
+				continue
+			}
+			if opts.withManifest && archive.Manifest == nil {
+				continue
+			}
+			a := *archive
+			return &a, nil
+		}
+	}
+	return nil, nil
+}
+
+// createGitTreeArchive creates an archive from a directory identified
+// by its git tree, reusing an existing archive of the same tree if
+// there is one. It falls back to createArchive's content hashing when
+// the directory isn't a clean git checkout.
+func createGitTreeArchive(client *client.Client, dir string, opts archiveOptions) (*fission.Archive, error) {
+	opts.gitTree = false
+	tree := gitTreeHash(dir)
+	if len(tree) == 0 {
+		return createArchive(client, dir, opts)
+	}
+
+	existing, err := findGitTreeArchive(client, tree, opts)
+	if err != nil {
+		return nil, fmt.Errorf("look for archives of git tree %v: %w", tree, err)
+	}
+	if existing != nil {
+		verbose("Reusing archive of git tree %v for %v", tree, dir)
+		return existing, nil
+	}
+
+	archive, err := createArchive(client, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	// expiring archives mustn't be reused by packages that outlive
+	// them
+	if opts.archiveTTL == 0 {
+		archive.GitTree = tree
+	}
+	return archive, nil
+}
+
+// gitMetadataAnnotations returns the annotations --git-metadata
+// records for a package made from archiveName: the commit checked out,
+// the branch unless HEAD is detached, and whether the archived files
+// differ from those committed, in which case it warns unless
+// opts.allowDirty is set. It returns nil for archives that aren't
+// local files in a git worktree, or if git isn't installed.
+func gitMetadataAnnotations(archiveName string, opts archiveOptions) map[string]string {
+	if len(archiveName) == 0 || archiveName == stdinArchive || isRemoteArchive(archiveName) {
+		return nil
+	}
+	if files := splitArchiveFiles(archiveName); len(files) > 0 {
+		archiveName = files[0]
+	}
+	fi, err := os.Stat(archiveName)
+	if err != nil {
+		return nil
+	}
+	// the status is of the archived files only
+	dir, scope := archiveName, "."
+	if !fi.IsDir() {
+		dir, scope = filepath.Dir(archiveName), filepath.Base(archiveName)
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		verbose("git not found, not recording git metadata")
+		return nil
+	}
+	if _, err := git(dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		verbose("%v is not in a git worktree, not recording git metadata", archiveName)
+		return nil
+	}
+	commit, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		// e.g. a repository without commits yet
+		verbose("Can't read the git commit of %v: %v", archiveName, err)
+		return nil
+	}
+
+	annotations := map[string]string{gitCommitAnnotation: commit}
+	if branch, err := git(dir, "rev-parse", "--abbrev-ref", "HEAD"); err == nil && branch != "HEAD" {
+		annotations[gitBranchAnnotation] = branch
+	}
+	dirty, err := gitArchiveDirty(dir, scope, opts)
+	if err != nil {
+		verbose("Can't read the git status of %v: %v", archiveName, err)
+		return annotations
+	}
+	annotations[gitDirtyAnnotation] = strconv.FormatBool(dirty)
+	if dirty && !opts.allowDirty {
+		fmt.Fprintf(os.Stderr, "Warning: %v has uncommitted, untracked or ignored files, the package won't match commit %v; use --allow-dirty to silence this\n",
+			archiveName, commit)
+	}
+	return annotations
+}
+
+// packageGitMetadata returns the annotations --git-metadata records
+// for a package, from its source archive if it has one, else its
+// deployment archive.
+func packageGitMetadata(srcArchiveName, deployArchiveName string, opts archiveOptions) map[string]string {
+	if !opts.gitMetadata {
+		return nil
+	}
+	if len(srcArchiveName) > 0 {
+		return gitMetadataAnnotations(srcArchiveName, opts)
+	}
+	return gitMetadataAnnotations(deployArchiveName, opts)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitArchiveDirty(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := ioutil.TempDir("", "fission-gittree-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	panicIf(os.Mkdir(src, 0755))
+
+	_, err = git(dir, "init", "-q")
+	panicIf(err)
+	panicIf(ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.log\n"), 0644))
+	panicIf(ioutil.WriteFile(filepath.Join(src, "main.go"), []byte("package main\n"), 0644))
+	_, err = git(dir, "add", ".")
+	panicIf(err)
+	_, err = git(dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init")
+	panicIf(err)
+
+	dirty, err := gitArchiveDirty(src, ".", archiveOptions{})
+	panicIf(err)
+	if dirty {
+		log.Panicf("Expected a committed directory to be clean")
+	}
+	if len(gitTreeHash(src)) == 0 {
+		log.Panicf("Expected a committed directory to have a git tree")
+	}
+
+	// an ignored file isn't listed by git status, but is archived
+	panicIf(ioutil.WriteFile(filepath.Join(src, "debug.log"), []byte("trace\n"), 0644))
+	dirty, err = gitArchiveDirty(src, ".", archiveOptions{})
+	panicIf(err)
+	if !dirty {
+		log.Panicf("Expected an archived ignored file to make the directory dirty")
+	}
+	if len(gitTreeHash(src)) > 0 {
+		log.Panicf("Expected no git tree for a directory with an ignored file")
+	}
+
+	// unless --ignore leaves it out of the archive too
+	dirty, err = gitArchiveDirty(src, ".", archiveOptions{ignore: []string{"*.log"}})
+	panicIf(err)
+	if dirty {
+		log.Panicf("Expected a file left out of the archive not to make it dirty")
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"text/tabwriter"
 
 	"github.com/satori/go.uuid"
 	"github.com/urfave/cli"
@@ -62,11 +61,11 @@ func htCreate(c *cli.Context) error {
 
 	fnName := c.String("function")
 	if len(fnName) == 0 {
-		fatal("Need a function name to create a trigger, use --function")
+		fatalUsage("Need a function name to create a trigger, use --function")
 	}
 	triggerUrl := c.String("url")
 	if len(triggerUrl) == 0 {
-		fatal("Need a trigger URL, use --url")
+		fatalUsage("Need a trigger URL, use --url")
 	}
 	method := c.String("method")
 	if len(method) == 0 {
@@ -79,7 +78,7 @@ func htCreate(c *cli.Context) error {
 	ht := &tpr.Httptrigger{
 		Metadata: metav1.ObjectMeta{
 			Name:      triggerName,
-			Namespace: metav1.NamespaceDefault,
+			Namespace: packageNamespace,
 		},
 		Spec: fission.HTTPTriggerSpec{
 			RelativeURL: triggerUrl,
@@ -106,18 +105,18 @@ func htUpdate(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 	htName := c.String("name")
 	if len(htName) == 0 {
-		fatal("Need name of trigger, use --name")
+		fatalUsage("Need name of trigger, use --name")
 	}
 
 	// update function ref
 	newFn := c.String("function")
 	if len(newFn) == 0 {
-		fatal("Nothing to update. Use --function to specify a new function.")
+		fatalUsage("Nothing to update. Use --function to specify a new function.")
 	}
 
 	ht, err := client.HTTPTriggerGet(&metav1.ObjectMeta{
 		Name:      htName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, "get HTTP trigger")
 
@@ -136,12 +135,12 @@ func htDelete(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 	htName := c.String("name")
 	if len(htName) == 0 {
-		fatal("Need name of trigger to delete, use --name")
+		fatalUsage("Need name of trigger to delete, use --name")
 	}
 
 	err := client.HTTPTriggerDelete(&metav1.ObjectMeta{
 		Name:      htName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, "delete trigger")
 
@@ -152,17 +151,15 @@ func htDelete(c *cli.Context) error {
 func htList(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 
+	output := c.String("output")
+	checkOutputFormat(output)
+
 	hts, err := client.HTTPTriggerList()
 	checkErr(err, "list HTTP triggers")
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-
-	fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", "NAME", "METHOD", "URL", "FUNCTION_NAME")
+	t := newTable("NAME", "METHOD", "URL", "FUNCTION_NAME")
 	for _, ht := range hts {
-		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n",
-			ht.Metadata.Name, ht.Spec.Method, ht.Spec.RelativeURL, ht.Spec.FunctionReference.Name)
+		t.addRow(ht.Metadata.Name, ht.Spec.Method, ht.Spec.RelativeURL, ht.Spec.FunctionReference.Name)
 	}
-	w.Flush()
-
-	return nil
+	return t.print(os.Stdout, output)
 }
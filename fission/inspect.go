@@ -0,0 +1,177 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ghodss/yaml"
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/environments/fetcher"
+	"github.com/fission/fission/tpr"
+)
+
+// "package inspect" lists or extracts the literal archive of an
+// exported package, e.g. from "kubectl get package -o yaml", without
+// a cluster or storage service. The literal is checked against its
+// recorded checksum and unpacked with the fetcher's code, so the files
+// are those functions and builders get. A zip literal with a recorded
+// structure fingerprint is also checked against it.
+
+// readPackageFile reads a package exported as YAML or JSON.
+func readPackageFile(fileName string) (*tpr.Package, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var pkg tpr.Package
+	err = yaml.Unmarshal(contents, &pkg)
+	if err != nil {
+		return nil, fmt.Errorf("parse %v: %v", fileName, err)
+	}
+	if len(pkg.Metadata.Name) == 0 {
+		return nil, fmt.Errorf("%v isn't a package: no metadata.name", fileName)
+	}
+	return &pkg, nil
+}
+
+// literalFiles returns a table of the files under an unpacked literal
+// and their sizes, by slash separated path relative to it, and how
+// many there are. A literal of a single file is listed under its own
+// name.
+func literalFiles(path string, isDir bool) (*table, int, error) {
+	t := newTable("PATH", "SIZE")
+	if !isDir {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		t.addRow(filepath.Base(path), info.Size())
+		return t, 1, nil
+	}
+	n := 0
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		t.addRow(filepath.ToSlash(rel), info.Size())
+		n++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return t, n, nil
+}
+
+// literalStructure returns the structure fingerprint of a zip
+// literal's files, and false if the literal isn't a zip.
+func literalStructure(archive *fission.Archive) (string, bool) {
+	r, err := zip.NewReader(bytes.NewReader(archive.Literal), int64(len(archive.Literal)))
+	if err != nil {
+		return "", false
+	}
+	var entries []fission.StructureEntry
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entries = append(entries, fission.StructureEntry{Path: f.Name, Mode: f.Mode()})
+	}
+	return fission.ArchiveStructure(entries), true
+}
+
+func pkgInspect(c *cli.Context) error {
+	output := c.String("output")
+	checkOutputFormat(output)
+
+	fileName := c.String("file")
+	if len(fileName) == 0 {
+		fileName = c.Args().First()
+	}
+	if len(fileName) == 0 {
+		fatalUsage("Need an exported package file, use --file")
+	}
+	pkg, err := readPackageFile(fileName)
+	checkErr(err, "read package")
+	pkgName := pkg.Metadata.Name
+
+	archive := &pkg.Spec.Source
+	kind := "source"
+	if c.Bool("deployment") || len(archive.Type) == 0 {
+		archive = pkg.Spec.DeploymentArchive()
+		kind = "deployment"
+	}
+	if archive.Type != fission.ArchiveTypeLiteral {
+		fatal(fmt.Sprintf("The %v archive of package '%v' isn't embedded in %v; use 'package fetch' to download it", kind, pkgName, fileName))
+	}
+
+	err = fission.VerifyLiteral(archive)
+	checkErr(err, fmt.Sprintf("verify the %v archive of package '%v'", kind, pkgName))
+	if len(archive.Checksum.Sum) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: the %v archive of package '%v' has no recorded checksum, its contents aren't verified\n", kind, pkgName)
+	} else {
+		verbose("The %v archive of package '%v' matches its %v checksum", kind, pkgName, archive.Checksum.Type)
+	}
+	if len(archive.Structure) > 0 {
+		fmt.Fprintf(os.Stderr, "%v archive structure %v\n", kind, archive.Structure)
+		if structure, ok := literalStructure(archive); ok && structure != archive.Structure {
+			fmt.Fprintf(os.Stderr, "Warning: the %v archive of package '%v' is laid out differently from its recorded structure fingerprint (%v)\n", kind, pkgName, structure)
+		}
+	}
+
+	// the files are unpacked into <dir>/<package>, a directory or a
+	// single file
+	dir := c.String("extract")
+	if len(dir) == 0 {
+		dir, err = ioutil.TempDir(stagingDir(), "fission-inspect-")
+		checkErr(err, "create temporary directory")
+		defer os.RemoveAll(dir)
+	} else {
+		err = os.MkdirAll(dir, 0755)
+		checkErr(err, fmt.Sprintf("create %v", dir))
+	}
+	dst := filepath.Join(dir, pkgName)
+	if _, err := os.Lstat(dst); err == nil {
+		fatal(fmt.Sprintf("%v already exists", dst))
+	}
+	isDir, err := fetcher.UnpackLiteral(archive, dst)
+	checkErr(err, fmt.Sprintf("unpack the %v archive of package '%v'", kind, pkgName))
+
+	t, n, err := literalFiles(dst, isDir)
+	checkErr(err, fmt.Sprintf("list %v", dst))
+	err = t.print(os.Stdout, output)
+	checkErr(err, "print files")
+	if c.IsSet("extract") {
+		fmt.Fprintf(os.Stderr, "extracted %v files to %v\n", n, dst)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/environments/fetcher"
+)
+
+const inspectPackageYaml = `apiVersion: fission.io/v1
+kind: Package
+metadata:
+  name: hello
+  namespace: default
+spec:
+  environment:
+    name: nodejs
+    namespace: default
+  deployment:
+    type: literal
+    literal: aGVsbG8=
+    checksum:
+      type: sha256
+      sum: 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824
+`
+
+func TestInspectLiteral(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-inspect-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "hello.yaml")
+	panicIf(ioutil.WriteFile(fileName, []byte(inspectPackageYaml), 0644))
+	pkg, err := readPackageFile(fileName)
+	panicIf(err)
+	archive := pkg.Spec.DeploymentArchive()
+	panicIf(fission.VerifyLiteral(archive))
+
+	dst := filepath.Join(dir, pkg.Metadata.Name)
+	isDir, err := fetcher.UnpackLiteral(archive, dst)
+	panicIf(err)
+	if isDir {
+		log.Panicf("Expected a single file literal to be unpacked as a file")
+	}
+	tbl, n, err := literalFiles(dst, isDir)
+	panicIf(err)
+	if n != 1 || len(tbl.rows) != 1 || tbl.rows[0][0] != "hello" || tbl.rows[0][1] != "5" {
+		log.Panicf("Expected hello of 5 bytes, got %v", tbl.rows)
+	}
+
+	// a literal that doesn't match its checksum isn't trusted
+	archive.Literal = []byte("jello")
+	if fission.VerifyLiteral(archive) == nil {
+		log.Panicf("Expected a changed literal to fail verification")
+	}
+	if _, ok := literalStructure(archive); ok {
+		log.Panicf("Expected a literal that isn't a zip to have no structure")
+	}
+}
+
+func TestInspectLiteralStructure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-inspect-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	panicIf(os.MkdirAll(filepath.Join(src, "lib"), 0755))
+	panicIf(ioutil.WriteFile(filepath.Join(src, "index.js"), []byte("hello"), 0644))
+	panicIf(ioutil.WriteFile(filepath.Join(src, "lib", "run.sh"), []byte("#!/bin/sh"), 0755))
+
+	opts := archiveOptions{assumeYes: true, scanConcurrency: 1, reproducible: true}
+	packed, scan, err := packDirArchive(src, opts, false)
+	panicIf(err)
+	defer os.Remove(packed)
+	literal, err := ioutil.ReadFile(packed)
+	panicIf(err)
+
+	archive := &fission.Archive{Type: fission.ArchiveTypeLiteral, Literal: literal}
+	structure, ok := literalStructure(archive)
+	if !ok || structure != scan.structure() {
+		log.Panicf("Expected the literal's structure to be %v, got %v", scan.structure(), structure)
+	}
+
+	// the same files at other paths are laid out differently
+	panicIf(os.Rename(filepath.Join(src, "lib"), filepath.Join(src, "bin")))
+	moved, _, err := packDirArchive(src, opts, false)
+	panicIf(err)
+	defer os.Remove(moved)
+	archive.Literal, err = ioutil.ReadFile(moved)
+	panicIf(err)
+	if other, _ := literalStructure(archive); other == structure {
+		log.Panicf("Expected moved files to change the structure")
+	}
+}
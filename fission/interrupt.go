@@ -0,0 +1,128 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultUploadGrace is how long uploads in flight may run after an
+// interrupt, by default.
+const defaultUploadGrace = 10 * time.Second
+
+// uploadGuard handles SIGINT and SIGTERM while archives are being
+// uploaded. Uploads in flight are given a grace period to finish,
+// and are then cancelled, as they are at once on a second signal; no
+// new uploads start. Cancelled uploads clean up what they stored, so
+// that no partial archives are left on the storage service.
+//
+// The signal handler is only installed while uploads are in flight;
+// at other times signals have their usual effect.
+type uploadGuard struct {
+	mu          sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	grace       time.Duration
+	inFlight    int
+	interrupted bool
+	sigs        chan os.Signal
+}
+
+// uploads guards every upload in the process. Its grace period is
+// set by the global --upload-grace flag.
+var uploads = newUploadGuard(defaultUploadGrace)
+
+func newUploadGuard(grace time.Duration) *uploadGuard {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &uploadGuard{ctx: ctx, cancel: cancel, grace: grace}
+}
+
+// context returns the context that storage requests of uploads are
+// made with, cancelled when uploads are.
+func (g *uploadGuard) context() context.Context {
+	return g.ctx
+}
+
+// begin marks the start of an upload; end must be called once it is
+// over. After an interrupt, no new uploads may begin.
+func (g *uploadGuard) begin() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.interrupted {
+		return fmt.Errorf("upload not started: %w", context.Canceled)
+	}
+	g.inFlight++
+	if g.inFlight == 1 {
+		g.sigs = make(chan os.Signal, 2)
+		signal.Notify(g.sigs, os.Interrupt, syscall.SIGTERM)
+		go g.watch(g.sigs)
+	}
+	return nil
+}
+
+// end marks the end of an upload.
+func (g *uploadGuard) end() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inFlight--
+	if g.inFlight == 0 {
+		signal.Stop(g.sigs)
+		close(g.sigs)
+	}
+}
+
+// stop keeps new uploads from starting, as an interrupt does, and
+// returns whether any are in flight. It's for commands that handle
+// interrupts themselves and must not exit under an upload.
+func (g *uploadGuard) stop() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.interrupted = true
+	return g.inFlight > 0
+}
+
+// watch waits for signals while uploads are in flight, until sigs is
+// closed.
+func (g *uploadGuard) watch(sigs chan os.Signal) {
+	if _, ok := <-sigs; !ok {
+		return
+	}
+	g.mu.Lock()
+	g.interrupted = true
+	g.mu.Unlock()
+
+	if g.grace > 0 {
+		fmt.Fprintf(os.Stderr, "Interrupted, waiting up to %v for uploads in flight to finish; interrupt again to cancel them\n", g.grace)
+		timer := time.NewTimer(g.grace)
+		defer timer.Stop()
+		select {
+		case _, ok := <-sigs:
+			if !ok {
+				return
+			}
+		case <-timer.C:
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Cancelling uploads in flight")
+	g.cancel()
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// inClusterNamespaceFile holds the namespace of the pod the CLI runs
+// in, when it runs in a cluster.
+const inClusterNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// kubeConfig is the part of a kubeconfig file needed to find the
+// current namespace.
+type kubeConfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+// kubeConfigPaths returns the kubeconfig files to read, as kubectl
+// does: those listed in $KUBECONFIG, else ~/.kube/config.
+func kubeConfigPaths() []string {
+	if env := os.Getenv("KUBECONFIG"); len(env) > 0 {
+		return filepath.SplitList(env)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return []string{filepath.Join(home, ".kube", "config")}
+	}
+	return nil
+}
+
+// kubeNamespace returns the namespace kubectl would use: that of the
+// current kubeconfig context, or of the pod the CLI runs in when
+// there is no kubeconfig. Like kubectl, it merges the files in
+// $KUBECONFIG, the first to set a value winning. It returns "default"
+// if no namespace is configured.
+func kubeNamespace() (string, error) {
+	var currentContext string
+	namespaces := make(map[string]string)
+	found := false
+	for _, path := range kubeConfigPaths() {
+		contents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("read kubeconfig: %v", err)
+		}
+		var cfg kubeConfig
+		err = yaml.Unmarshal(contents, &cfg)
+		if err != nil {
+			return "", fmt.Errorf("parse kubeconfig %v: %v", path, err)
+		}
+		found = true
+		if len(currentContext) == 0 {
+			currentContext = cfg.CurrentContext
+		}
+		for _, ctx := range cfg.Contexts {
+			if _, ok := namespaces[ctx.Name]; !ok {
+				namespaces[ctx.Name] = ctx.Context.Namespace
+			}
+		}
+	}
+
+	if !found {
+		contents, err := ioutil.ReadFile(inClusterNamespaceFile)
+		if err == nil && len(strings.TrimSpace(string(contents))) > 0 {
+			return strings.TrimSpace(string(contents)), nil
+		}
+		return metav1.NamespaceDefault, nil
+	}
+	if ns := namespaces[currentContext]; len(ns) > 0 {
+		return ns, nil
+	}
+	return metav1.NamespaceDefault, nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// layoutArchivePrefix marks an archive name as a layout file, e.g.
+// --deploy @layout.txt. A layout file lists the files of an archive
+// one per line as source:dest, where source is a local file, relative
+// to the layout file's directory, and dest is its path in the
+// archive. Blank lines and lines starting with # are skipped.
+const layoutArchivePrefix = "@"
+
+// isLayoutArchive returns true if an archive name refers to a layout
+// file.
+func isLayoutArchive(fileName string) bool {
+	return len(fileName) > len(layoutArchivePrefix) && strings.HasPrefix(fileName, layoutArchivePrefix)
+}
+
+// readLayout reads a layout file into the scan of the files it lists,
+// ordered by their paths in the archive. All sources must be regular
+// files, and no two may have the same dest.
+func readLayout(layoutFile string) (*dirScan, error) {
+	f, err := os.Open(layoutFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scan := &dirScan{root: layoutFile, deterministic: true}
+	dir := filepath.Dir(layoutFile)
+	dests := make(map[string]int)
+	var missing []string
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the dest is everything after the last colon, so sources
+		// may contain colons but dests may not
+		i := strings.LastIndex(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			return nil, fmt.Errorf("%v:%v: need source:dest, not '%v'", layoutFile, lineNo, line)
+		}
+		src, dest := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		dest = path.Clean(filepath.ToSlash(dest))
+		if path.IsAbs(dest) || dest == "." || dest == ".." || strings.HasPrefix(dest, "../") {
+			return nil, fmt.Errorf("%v:%v: dest '%v' must be a relative path inside the archive", layoutFile, lineNo, line[i+1:])
+		}
+		if prev, ok := dests[dest]; ok {
+			return nil, fmt.Errorf("%v:%v: dest '%v' is already used on line %v", layoutFile, lineNo, dest, prev)
+		}
+		dests[dest] = lineNo
+
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(dir, src)
+		}
+		info, err := os.Stat(src)
+		if os.IsNotExist(err) {
+			missing = append(missing, fmt.Sprintf("  %v (line %v)", src, lineNo))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%v:%v: source %v isn't a regular file", layoutFile, lineNo, src)
+		}
+		scan.entries = append(scan.entries, scanEntry{path: src, relPath: dest, info: info})
+		scan.totalSize += info.Size()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%v lists %v missing files:\n%v", layoutFile, len(missing), strings.Join(missing, "\n"))
+	}
+	if len(scan.entries) == 0 {
+		return nil, fmt.Errorf("%v lists no files", layoutFile)
+	}
+
+	sort.Slice(scan.entries, func(i, j int) bool { return scan.entries[i].relPath < scan.entries[j].relPath })
+	return scan, nil
+}
+
+// packLayoutArchive zips the files listed by a layout file into a
+// temporary file, as packDirArchive does for a directory. The caller
+// removes the file.
+func packLayoutArchive(layoutFile string, opts archiveOptions, compressed bool) (string, *dirScan, error) {
+	scan, err := readLayout(layoutFile)
+	if err != nil {
+		return "", nil, err
+	}
+	if opts.embedBuildInfo {
+		cleanup, err := embedBuildInfo(scan, layoutFile, opts)
+		if err != nil {
+			return "", nil, fmt.Errorf("embed build info in %v: %w", layoutFile, err)
+		}
+		defer cleanup()
+	}
+	verbose("Layout %v: %v files, %v bytes", layoutFile, len(scan.entries), scan.totalSize)
+
+	if opts.prescan {
+		for i := range scan.entries {
+			scan.entries[i].checksum, err = fileChecksum(scan.entries[i].path)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	err = checkStagingSpace(scan.totalSize)
+	if err != nil {
+		return "", nil, err
+	}
+	tmpfile, err := ioutil.TempFile(stagingDir(), "fission-archive-")
+	if err != nil {
+		return "", nil, err
+	}
+	tmpfile.Close()
+
+	plan := planArchive(scan.totalSize, opts.inlineLimit)
+	method := zip.Deflate
+	if compressed && !plan.Inline {
+		method = zip.Store
+	}
+	err = packDir(scan, tmpfile.Name(), method, opts.compressionLevel)
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", nil, fmt.Errorf("pack layout %v: %w", layoutFile, err)
+	}
+	return tmpfile.Name(), scan, nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPackLayoutArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-layout-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	panicIf(os.MkdirAll(filepath.Join(dir, "build", "out"), 0755))
+	panicIf(ioutil.WriteFile(filepath.Join(dir, "build", "out", "main.js"), []byte("main"), 0644))
+	panicIf(ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte("{}"), 0644))
+
+	layout := filepath.Join(dir, "layout.txt")
+	panicIf(ioutil.WriteFile(layout, []byte(`# scattered build outputs
+build/out/main.js : app/index.js
+
+package.json:package.json
+`), 0644))
+	if !isLayoutArchive("@" + layout) {
+		log.Panicf("Expected @%v to name a layout file", layout)
+	}
+
+	scan, err := readLayout(layout)
+	panicIf(err)
+	if len(scan.entries) != 2 || scan.entries[0].relPath != "app/index.js" || scan.entries[1].relPath != "package.json" {
+		log.Panicf("Expected the layout's dests in order, got %+v", scan.entries)
+	}
+
+	// the same files give the same archive, whenever they changed
+	opts := archiveOptions{scanConcurrency: 1}
+	first, _, err := packLayoutArchive(layout, opts, false)
+	panicIf(err)
+	defer os.Remove(first)
+	later := time.Now().Add(time.Hour)
+	panicIf(os.Chtimes(filepath.Join(dir, "package.json"), later, later))
+	second, _, err := packLayoutArchive(layout, opts, false)
+	panicIf(err)
+	defer os.Remove(second)
+	a, err := ioutil.ReadFile(first)
+	panicIf(err)
+	b, err := ioutil.ReadFile(second)
+	panicIf(err)
+	if !bytes.Equal(a, b) {
+		log.Panicf("Expected packing a layout to be deterministic")
+	}
+
+	bad := []struct {
+		layout string
+		err    string
+	}{
+		{"missing.js:index.js\n", "missing files"},
+		{"package.json:a.json\nbuild/out/main.js:a.json\n", "already used on line 1"},
+		{"package.json:../package.json\n", "inside the archive"},
+		{"package.json\n", "need source:dest"},
+		{"build:build\n", "isn't a regular file"},
+		{"# nothing\n", "lists no files"},
+	}
+	for _, test := range bad {
+		panicIf(ioutil.WriteFile(layout, []byte(test.layout), 0644))
+		_, err := readLayout(layout)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			log.Panicf("Expected layout %q to fail with %q, got %v", test.layout, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/tpr"
+)
+
+// A lockfile records the packages of a namespace and the checksums of
+// their archives, so that the exact artifacts deployed can be
+// committed and checked later with "package verify-lock". It is
+// indented JSON with the packages sorted by name and no timestamps,
+// so locking an unchanged cluster gives the same file and changes
+// show up as small diffs.
+
+// packageLockVersion is the version of the lockfile format.
+const packageLockVersion = 1
+
+type (
+	// packageLock is a lockfile.
+	packageLock struct {
+		Version  int                `json:"version"`
+		Selector string             `json:"selector,omitempty"`
+		Packages []packageLockEntry `json:"packages"`
+	}
+
+	// packageLockEntry is a locked package. Checksums are those
+	// of the stored archives; archives whose checksum isn't known
+	// are locked without one.
+	packageLockEntry struct {
+		Name        string            `json:"name"`
+		Tag         string            `json:"tag,omitempty"`
+		Environment string            `json:"environment"`
+		Source      *fission.Checksum `json:"source,omitempty"`
+		Deployment  *fission.Checksum `json:"deployment,omitempty"`
+	}
+)
+
+// lockChecksum returns the checksum an archive is locked with, nil if
+// there is no archive or its checksum isn't known.
+func lockChecksum(archive *fission.Archive) *fission.Checksum {
+	if len(archive.Type) == 0 {
+		return nil
+	}
+	if len(archive.Checksum.Sum) > 0 {
+		sum := archive.Checksum
+		return &sum
+	}
+	if sum, ok := fission.ArchiveSHA256(archive); ok {
+		return &fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: sum}
+	}
+	return nil
+}
+
+// lockEntry returns the lockfile entry of a package.
+func lockEntry(pkg *tpr.Package) packageLockEntry {
+	return packageLockEntry{
+		Name:        pkg.Metadata.Name,
+		Tag:         pkg.Metadata.Labels[fission.PackageTagLabel],
+		Environment: pkg.Spec.Environment.Name,
+		Source:      lockChecksum(&pkg.Spec.Source),
+		Deployment:  lockChecksum(&pkg.Spec.Deployment),
+	}
+}
+
+// lockedPackages returns the lockfile entries of the packages of the
+// namespace whose labels match selector, sorted by name.
+func lockedPackages(client *client.Client, selector labels.Selector) ([]packageLockEntry, error) {
+	pkgs, err := client.PackageList()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]packageLockEntry, 0, len(pkgs))
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		if pkg.Metadata.Namespace != packageNamespace || !selector.Matches(labels.Set(pkg.Metadata.Labels)) {
+			continue
+		}
+		entries = append(entries, lockEntry(pkg))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// parseLockSelector parses a --selector, matching everything if it's
+// empty.
+func parseLockSelector(value string) labels.Selector {
+	selector, err := labels.Parse(value)
+	if err != nil {
+		fatalUsage(fmt.Sprintf("Bad --selector: %v", err))
+	}
+	return selector
+}
+
+func pkgLock(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	selector := parseLockSelector(c.String("selector"))
+
+	entries, err := lockedPackages(client, selector)
+	checkErr(err, "list packages")
+	lock := packageLock{
+		Version:  packageLockVersion,
+		Selector: c.String("selector"),
+		Packages: entries,
+	}
+	out, err := json.MarshalIndent(&lock, "", "  ")
+	checkErr(err, "encode lockfile")
+	out = append(out, '\n')
+
+	fileName := c.String("output")
+	if len(fileName) == 0 {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	err = ioutil.WriteFile(fileName, out, 0644)
+	checkErr(err, fmt.Sprintf("write lockfile %v", fileName))
+	fmt.Fprintf(os.Stderr, "locked %v packages in %v\n", len(entries), fileName)
+	return nil
+}
+
+// readPackageLock reads a lockfile.
+func readPackageLock(fileName string) (*packageLock, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var lock packageLock
+	err = json.Unmarshal(contents, &lock)
+	if err != nil {
+		return nil, fmt.Errorf("parse lockfile %v: %w", fileName, err)
+	}
+	if lock.Version != packageLockVersion {
+		return nil, fmt.Errorf("lockfile %v has version %v, this fission supports %v", fileName, lock.Version, packageLockVersion)
+	}
+	return &lock, nil
+}
+
+// formatLockChecksum formats a locked checksum for drift reports.
+func formatLockChecksum(sum *fission.Checksum) string {
+	if sum == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%v:%v", sum.Type, sum.Sum)
+}
+
+// lockDrift returns how a package differs from its lockfile entry,
+// or nothing if it matches.
+func lockDrift(locked, current packageLockEntry) []string {
+	var drift []string
+	if locked.Environment != current.Environment {
+		drift = append(drift, fmt.Sprintf("environment %v, locked %v", current.Environment, locked.Environment))
+	}
+	if locked.Tag != current.Tag {
+		drift = append(drift, fmt.Sprintf("tag '%v', locked '%v'", current.Tag, locked.Tag))
+	}
+	for _, a := range []struct {
+		kind            string
+		locked, current *fission.Checksum
+	}{
+		{"source", locked.Source, current.Source},
+		{"deployment", locked.Deployment, current.Deployment},
+	} {
+		if a.locked == nil && a.current == nil {
+			continue
+		}
+		if a.locked == nil || a.current == nil || !a.locked.Equal(*a.current) {
+			drift = append(drift, fmt.Sprintf("%v %v, locked %v", a.kind, formatLockChecksum(a.current), formatLockChecksum(a.locked)))
+		}
+	}
+	return drift
+}
+
+func pkgVerifyLock(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	output := c.String("output")
+	checkOutputFormat(output)
+
+	fileName := c.String("file")
+	lock, err := readPackageLock(fileName)
+	checkErr(err, "read lockfile")
+	// the packages locked are those the lock's selector matched,
+	// unless another is given
+	selector := lock.Selector
+	if c.IsSet("selector") {
+		selector = c.String("selector")
+	}
+
+	entries, err := lockedPackages(client, parseLockSelector(selector))
+	checkErr(err, "list packages")
+	current := make(map[string]packageLockEntry, len(entries))
+	for _, e := range entries {
+		current[e.Name] = e
+	}
+
+	t := newTable("PACKAGE", "DRIFT")
+	drifted := 0
+	for _, locked := range lock.Packages {
+		e, ok := current[locked.Name]
+		if !ok {
+			t.addRow(locked.Name, "missing")
+			drifted++
+			continue
+		}
+		delete(current, locked.Name)
+		if drift := lockDrift(locked, e); len(drift) > 0 {
+			t.addRow(locked.Name, strings.Join(drift, "; "))
+			drifted++
+		}
+	}
+	for _, e := range entries {
+		if _, ok := current[e.Name]; ok {
+			t.addRow(e.Name, "not in lockfile")
+			drifted++
+		}
+	}
+
+	if drifted == 0 {
+		if output == "json" {
+			return t.print(os.Stdout, output)
+		}
+		fmt.Printf("%v packages match %v\n", len(lock.Packages), fileName)
+		return nil
+	}
+	err = t.print(os.Stdout, output)
+	checkErr(err, "print drift")
+	fatalWithCode(exitCodeDrift, fmt.Sprintf("%v packages differ from %v", drifted, fileName))
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/tpr"
+)
+
+func TestLockDrift(t *testing.T) {
+	pkg := &tpr.Package{
+		Metadata: metav1.ObjectMeta{
+			Name:   "hello",
+			Labels: map[string]string{fission.PackageTagLabel: "v1"},
+		},
+		Spec: fission.PackageSpec{
+			Environment: fission.EnvironmentReference{Name: "nodejs"},
+			Deployment: fission.Archive{
+				Type:    fission.ArchiveTypeLiteral,
+				Literal: []byte("module.exports = () => 'hello'\n"),
+			},
+		},
+	}
+	locked := lockEntry(pkg)
+	if locked.Tag != "v1" || locked.Source != nil || locked.Deployment == nil || locked.Deployment.Type != fission.ChecksumTypeSHA256 {
+		log.Panicf("Unexpected lock entry %+v", locked)
+	}
+	if drift := lockDrift(locked, lockEntry(pkg)); len(drift) != 0 {
+		log.Panicf("Expected no drift, got %v", drift)
+	}
+
+	pkg.Spec.Deployment.Literal = []byte("module.exports = () => 'bye'\n")
+	pkg.Metadata.Labels[fission.PackageTagLabel] = "v2"
+	drift := lockDrift(locked, lockEntry(pkg))
+	if len(drift) != 2 || !strings.HasPrefix(drift[0], "tag 'v2'") || !strings.HasPrefix(drift[1], "deployment sha256:") {
+		log.Panicf("Expected tag and deployment drift, got %v", drift)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fission/fission"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// peakHeap runs f and returns how far the heap grew above where it
+// started, sampled every millisecond.
+func peakHeap(f func()) uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base := ms.HeapAlloc
+
+	var peak uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > base && ms.HeapAlloc-base > peak {
+				peak = ms.HeapAlloc - base
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	f()
+	close(stop)
+	<-sampled
+	return peak
+}
+
+func TestLowMemoryArchive(t *testing.T) {
+	const inputSize = 64 * 1024 * 1024
+	const bound = 16 * 1024 * 1024
+
+	dir, err := ioutil.TempDir("", "fission-low-memory")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	panicIf(os.Mkdir(src, 0755))
+	big, err := os.Create(filepath.Join(src, "big.bin"))
+	panicIf(err)
+	panicIf(big.Truncate(inputSize))
+	panicIf(big.Close())
+	panicIf(ioutil.WriteFile(filepath.Join(src, "index.js"), []byte("module.exports = () => 'ok'\n"), 0644))
+
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		atomic.AddInt64(&received, n)
+		fmt.Fprint(w, `{"id": "big"}`)
+	}))
+	defer server.Close()
+
+	opts := archiveOptions{
+		prescan:         true,
+		scanConcurrency: 1,
+		assumeYes:       true,
+		bufferSize:      lowMemoryBufferSize,
+		inlineLimit:     config.InlineLimit,
+		lowMemory:       true,
+	}
+	peak := peakHeap(func() {
+		packed, _, err := packDirArchive(src, opts, true)
+		panicIf(err)
+		defer os.Remove(packed)
+		compressed, err := compressFile(packed, fission.ArchiveCompressionGzip, 0, opts.bufferSize)
+		panicIf(err)
+		defer os.Remove(compressed)
+		_, err = fileChecksum(packed)
+		panicIf(err)
+
+		// the packed archive is stored, not deflated, so it's
+		// as large as its input
+		ssClient := storageSvcClient.MakeClient(server.URL, archiveClientOptions(opts)...)
+		_, err = ssClient.UploadWithPrefix(packed, "", nil)
+		panicIf(err)
+	})
+
+	if atomic.LoadInt64(&received) < inputSize {
+		log.Panicf("Uploaded %v bytes, expected at least %v", received, inputSize)
+	}
+	if peak > bound {
+		log.Panicf("Heap grew by %v packing and uploading %v, more than %v", formatSize(int64(peak)), formatSize(inputSize), formatSize(bound))
+	}
+}
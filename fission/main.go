@@ -20,17 +20,47 @@ import (
 	"os"
 
 	"github.com/urfave/cli"
+
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
 )
 
+// cliVersion is the version of this CLI.
+const cliVersion = "0.3.0"
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "fission"
 	app.Usage = "Serverless functions for Kubernetes"
-	app.Version = "0.3.0"
+	app.Version = cliVersion
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{Name: "server", Usage: "Fission server URL", EnvVar: "FISSION_URL"},
+		cli.StringFlag{Name: "namespace", EnvVar: "FISSION_NAMESPACE", Usage: "Namespace of packages, functions, environments and triggers; defaults to the current kubeconfig context's namespace"},
+		cli.StringFlag{Name: "config-file", Usage: "YAML file of flag defaults; by default ~/.config/fission/config.yaml or ~/.fission/config.yaml if present", EnvVar: "FISSION_CONFIG"},
+		cli.StringSliceFlag{Name: "header", Usage: "Extra HTTP header sent on every request, as key:value (repeatable)"},
+		cli.BoolFlag{Name: "verbose", Usage: "Print verbose output"},
+		cli.StringFlag{Name: "storage-token", Usage: "Bearer token for the storage service", EnvVar: "FISSION_STORAGE_TOKEN"},
+		cli.StringFlag{Name: "storage-token-file", Usage: "File holding the storage service bearer token, re-read on every request so rotated tokens are used"},
+		cli.StringFlag{Name: "storage-hmac-key-file", Usage: "File holding a key shared with the storage service, to sign every storage request with HMAC-SHA256 instead of sending a bearer token"},
+		cli.StringFlag{Name: "storage-hmac-key-id", Usage: "ID of the --storage-hmac-key-file key, sent with signatures"},
+		cli.BoolFlag{Name: "direct-storage", Usage: "Talk to the storage service at --storage-url directly instead of through the controller's proxy; archive URLs recorded in packages still point at the proxy, which functions and builders reach"},
+		cli.StringFlag{Name: "storage-url", EnvVar: "FISSION_STORAGE_URL", Usage: "URL of the storage service, used with --direct-storage"},
+		cli.StringFlag{Name: "cacert", EnvVar: "FISSION_CACERT", Usage: "PEM bundle of CA certificates to trust for HTTPS connections to the controller and storage service"},
+		cli.BoolFlag{Name: "cacert-only", Usage: "trust only the --cacert certificates, not the system ones"},
+		cli.StringFlag{Name: "request-id", Usage: "ID sent as X-Request-Id on every request, to trace a command across server logs; generated if not given"},
+		cli.BoolFlag{Name: "debug-http", Usage: "Log connection reuse, protocol and TLS details of storage requests"},
+		cli.BoolFlag{Name: "transfer-compression", EnvVar: "FISSION_TRANSFER_COMPRESSION", Usage: "gzip archives sent to and from the storage service on the wire, for slow links; what's stored is unchanged, and already compressed archives are sent as they are"},
+		cli.Float64Flag{Name: "qps", Value: defaultQPS, Usage: "Maximum average rate of requests to the controller, per second; 0 for no limit"},
+		cli.IntFlag{Name: "burst", Value: defaultBurst, Usage: "Maximum number of requests to the controller sent in a burst above --qps"},
+		cli.IntFlag{Name: "max-concurrent-uploads", Value: defaultMaxConcurrentUploads, Usage: "Maximum number of archive uploads in flight at once; 0 for no limit"},
+		cli.BoolFlag{Name: "no-truncate", Usage: "Show UUIDs in tables whole"},
+		cli.IntFlag{Name: "truncate-width", Value: defaultTruncateWidth, Usage: "Number of characters of UUIDs shown in tables"},
+		cli.DurationFlag{Name: "upload-grace", Value: defaultUploadGrace, Usage: "How long uploads in flight may run to completion after an interrupt before they are cancelled; 0 cancels at once"},
 	}
+	app.Before = parseGlobalFlags
+
+	// output format of list commands
+	listOutputFlag := cli.StringFlag{Name: "output, o", Value: "table", Usage: "output format: table|json"}
 
 	// trigger method and url flags (used in function and route CLIs)
 	htMethodFlag := cli.StringFlag{Name: "method", Usage: "HTTP Method: GET|POST|PUT|DELETE|HEAD; defaults to GET"}
@@ -41,25 +71,186 @@ func main() {
 	fnEnvNameFlag := cli.StringFlag{Name: "env", Usage: "environment name for function"}
 	fnCodeFlag := cli.StringFlag{Name: "code", Usage: "local path or URL for source code"}
 	fnPackageFlag := cli.StringFlag{Name: "package", Usage: "(Deprecated) local path or URL for binary package"}
-	fnDeployArchiveFlag := cli.StringFlag{Name: "deployarchive, deploy", Usage: "local path or URL for deployment archive"}
-	fnSrcArchiveFlag := cli.StringFlag{Name: "sourcearchive, src", Usage: "local path or URL for source archive"}
+	fnDeployArchiveFlag := cli.StringFlag{Name: "deployarchive, deploy", Usage: "local path or URL for deployment archive, a comma separated list of small files to embed together, or @file for a layout file of source:dest lines"}
+	fnSrcArchiveFlag := cli.StringFlag{Name: "sourcearchive, src", Usage: "local path or URL for source archive, a comma separated list of small files to embed together, or @file for a layout file of source:dest lines"}
 	fnPodFlag := cli.StringFlag{Name: "pod", Usage: "function pod name, optional (use latest if unspecified)"}
 	fnFollowFlag := cli.BoolFlag{Name: "follow, f", Usage: "specify if the logs should be streamed"}
 	fnDetailFlag := cli.BoolFlag{Name: "detail, d", Usage: "display detailed information"}
 	fnLogDBTypeFlag := cli.StringFlag{Name: "dbtype", Usage: "log database type, e.g. influxdb (currently only influxdb is supported)"}
 	fnEntryPointFlag := cli.StringFlag{Name: "entrypoint", Usage: "entry point for environment v2 to load with"}
-	fnBuildCmdFlag := cli.StringFlag{Name: "buildcmd", Usage: "build command for builder to run with"}
+	fnBuildCmdFlag := cli.StringFlag{Name: "buildcmd", Usage: "build command for builder to run with; defaults to the environment's build command"}
+	fnPrescanFlag := cli.BoolFlag{Name: "prescan", Usage: "checksum every file of a directory archive before packing it"}
+	fnPrescanConcurrencyFlag := cli.IntFlag{Name: "prescan-concurrency", Value: defaultScanConcurrency, Usage: "max number of files hashed concurrently during --prescan"}
+	fnYesFlag := cli.BoolFlag{Name: "yes, y", Usage: "don't ask for confirmation before packing large directories"}
+	fnStoragePrefixFlag := cli.StringFlag{Name: "storage-prefix", Usage: "key prefix for archives uploaded to the storage service, e.g. env/python/"}
+	fnCompressFlag := cli.StringFlag{Name: "compress", Usage: "compression for uploaded archives: none|gzip|zstd, zstd falling back to gzip until builders support it; defaults to gzip for directories"}
+	fnCompressionLevelFlag := cli.IntFlag{Name: "compression-level", Usage: "compression level, trading packing time for upload size: 1-9 for gzip (default 6), 1-22 for zstd (default 3)"}
+	fnIgnoreFlag := cli.StringSliceFlag{Name: "ignore", Usage: "glob pattern of files to leave out of directory archives (repeatable)"}
+	fnWithManifestFlag := cli.BoolFlag{Name: "with-manifest", Usage: "store a manifest of per-file checksums alongside each archive"}
+	fnProbeFlag := cli.StringFlag{Name: "probe", Usage: "check that uploaded archives are fetchable from their URL: warn|fail (optional)"}
+	fnNoDefaultBuildFlag := cli.BoolFlag{Name: "no-default-build", Usage: "don't use the environment's default build command when --buildcmd is not given"}
+	fnMirrorStorageUrlFlag := cli.StringSliceFlag{Name: "mirror-storage-url", Usage: "storage service URL, such as in another region, to also upload archives to; builds download from whichever copy answers fastest (repeatable)"}
+	fnStrictBuildLintFlag := cli.BoolFlag{Name: "strict-build-lint", Usage: "fail instead of warning when the build command looks unsafe; the builder runs it as-is either way"}
+	fnStrictEnvFlag := cli.BoolFlag{Name: "strict-env", Usage: "fail instead of warning when the archives look incompatible with the environment's declared language version"}
+	fnNormalizeEOLFlag := cli.BoolFlag{Name: "normalize-eol", Usage: "convert CRLF line endings of text files to LF before upload, leaving binary files as they are"}
+	fnTransformFlag := cli.StringSliceFlag{Name: "transform", Usage: "transform to run over archive contents before upload, e.g. minify-json, strip-sourcemaps (repeatable)"}
+	fnLabelFlag := cli.StringFlag{Name: "label", Usage: "name packages <env>-<label>-<content hash> instead of randomly; an existing package with the same name and contents is reused"}
+	fnSaveArchiveFlag := cli.StringFlag{Name: "save-archive", Usage: "save a copy of the exact bytes uploaded to this file, or into this directory if it is one"}
+	fnBuildEnvFlag := cli.StringSliceFlag{Name: "build-env", Usage: "KEY=value environment variable for the build command (repeatable)"}
+	fnBuildEnvSecretFlag := cli.StringSliceFlag{Name: "build-env-secret", Usage: "KEY=<secret>/<key> environment variable read from a secret for the build command (repeatable)"}
+	fnRehostFlag := cli.BoolFlag{Name: "rehost", Usage: "copy archives given as http(s) URLs to the storage service, rather than referring to the URL"}
+	fnProgressFlag := cli.BoolFlag{Name: "progress", Usage: "show a progress bar while uploading archives; package apply shows one line for the whole batch instead, and each upload's bar too with --verbose"}
+	fnMaxFileSizeFlag := cli.IntFlag{Name: "max-file-size", Usage: "leave files larger than this many MiB out of directory archives, listing them; 0 for no limit"}
+	fnFailLargeFilesFlag := cli.BoolFlag{Name: "fail-large-files", Usage: "fail instead of leaving out files larger than --max-file-size"}
+	fnPartSizeFlag := cli.IntFlag{Name: "part-size", Usage: "split archives larger than this many MiB into parts of this size, for storage that limits object size"}
+	fnGitTreeFlag := cli.BoolFlag{Name: "git-tree", Usage: "identify directories in a clean git checkout by their git tree, reusing an existing archive of the same tree"}
+	fnArchiveTTLFlag := cli.StringFlag{Name: "archive-ttl", Usage: "have the storage service delete uploaded archives after this long, e.g. 36h or 7d; for ephemeral packages such as preview deploys"}
+	fnForceArchiveTTLFlag := cli.BoolFlag{Name: "force-archive-ttl", Usage: "allow --archive-ttl for a function's package"}
+	fnSBOMFlag := cli.StringFlag{Name: "sbom", Usage: "software bill of materials file to store with the package"}
+	fnAttestationFlag := cli.StringFlag{Name: "attestation", Usage: "in-toto attestation file to store with the package, checked by 'package verify'"}
+	fnChecksumFlag := cli.StringFlag{Name: "checksum", Usage: "sha256 of the archive file, computed beforehand e.g. by CI; trusted as is instead of hashing the file"}
+	fnChecksumSizeFlag := cli.IntFlag{Name: "checksum-size", Usage: "with --checksum, size in bytes of the file the checksum was computed over, checked before trusting it"}
+	fnFromImageFlag := cli.StringFlag{Name: "from-image", Usage: "make the deployment archive from files in this container image, e.g. repo/app@sha256:..."}
+	fnImagePathFlag := cli.StringFlag{Name: "image-path", Value: "/", Usage: "with --from-image, the directory of the image to archive"}
+	fnNoBuildOverwriteFlag := cli.BoolFlag{Name: "no-build-overwrite", Usage: "refuse a deployment archive given with a source archive if the build would overwrite it"}
+	fnStdinNameFlag := cli.StringFlag{Name: "stdin-name", Usage: "read the deployment archive from stdin (or the archive given as -) as a file of this name, e.g. bundle.js"}
+	fnSkipQuotaFlag := cli.BoolFlag{Name: "skip-quota", Usage: "don't check the package quota of the config file before creating packages"}
+	fnGitMetadataFlag := cli.BoolFlag{Name: "git-metadata", Usage: "record the git commit, branch and dirty state of the archived checkout as package annotations"}
+	fnAllowDirtyFlag := cli.BoolFlag{Name: "allow-dirty", Usage: "with --git-metadata, don't warn about uncommitted changes"}
+	fnArchiveNameFlag := cli.StringFlag{Name: "archive-name", Usage: "file name uploaded archives are downloaded as; defaults to the package name, or the archived file's name"}
+	fnDeploymentPolicyFlag := cli.StringFlag{Name: "deployment-policy", Usage: "with both a source and a deployment archive, which functions use once the source is built: overwrite (the default; the build replaces the deployment archive), prefer-build or prefer-explicit (both keep it)"}
+	fnNoHintsFlag := cli.BoolFlag{Name: "no-hints", Usage: "don't record hints such as \"has package.json\" on archives for the builder"}
+	fnBuilderImageFlag := cli.StringFlag{Name: "builder-image", Usage: "builder image to build the source package with instead of the environment's builder"}
+	fnDeferUploadFlag := cli.BoolFlag{Name: "defer-upload", Usage: "create the package awaiting upload, and upload its archives later with 'package commit'"}
+	fnAliasOfFlag := cli.StringFlag{Name: "alias-of", Usage: "create the function's package as an alias of this existing package, instead of from archives"}
+	fnBufferSizeFlag := cli.IntFlag{Name: "buffer-size", Value: storageSvcClient.DefaultBufferSize, Usage: "read buffer size in bytes used to checksum and upload archives"}
+
+	// flags controlling how archives are packed and uploaded,
+	// shared by all commands that create packages
+	fnPkgRefFlag := cli.StringFlag{Name: "pkg", Usage: "existing package to point the function at"}
+	fnSetPackageWaitFlag := cli.BoolFlag{Name: "wait", Usage: "wait for the package to build, and only switch if it succeeded"}
+	fnSetPackageFollowFlag := cli.BoolFlag{Name: "follow", Usage: "with --wait, print build status changes and logs as they happen"}
+	fnUploadTimeoutFlag := cli.DurationFlag{Name: "upload-timeout", Usage: "how long uploading each archive may take, e.g. 30m; 0 for no limit"}
+	fnScanSecretsFlag := cli.BoolFlag{Name: "scan-secrets", Usage: "warn about files that look like they hold secrets, such as private keys or API tokens, before storing archives"}
+	fnBlockSecretsFlag := cli.BoolFlag{Name: "block-secrets", Usage: "like --scan-secrets, but fail instead of warning"}
+	fnSecretRulesFlag := cli.StringFlag{Name: "secret-rules", Usage: "file of name=regex lines to scan for instead of the default secret rules"}
+	fnSecretAllowlistFlag := cli.StringFlag{Name: "secret-allowlist", Usage: "file of archive path globs, each optionally followed by a rule name, whose secret findings are ignored"}
+	fnTransparencyLogFlag := cli.StringFlag{Name: "transparency-log", EnvVar: "FISSION_TRANSPARENCY_LOG", Usage: "URL of a Rekor-like transparency log to record archive checksums in, with the inclusion proofs kept on the package for 'package verify'"}
+	fnStrictLayoutFlag := cli.BoolFlag{Name: "strict-layout", Usage: "fail instead of warning when the archives lack files the environment's archive layout requires, packing the subdirectory of a directory that has them all there"}
+	fnNoLayoutCheckFlag := cli.BoolFlag{Name: "no-layout-check", Usage: "don't check or reshape the archives to match the environment's archive layout"}
+	fnRangeChecksumsFlag := cli.BoolFlag{Name: "range-checksums", Usage: "record checksums of each 4 MiB range of uploaded archives, so that package verify --sample can check sampled ranges"}
+	fnNoBuilderCheckFlag := cli.BoolFlag{Name: "no-builder-check", Usage: "create source packages even if the environment has no builder; they stay pending until one is added"}
+	fnArchiveTagFlag := cli.StringSliceFlag{Name: "archive-tag", Usage: "key=value tag for uploaded archives, which storage find looks up (repeatable); --git-metadata adds git-sha"}
+	fnPreBuildFlag := cli.StringSliceFlag{Name: "pre-build", Usage: "shell command for the builder to run with sh -c in the source directory before the build command, e.g. to fetch private dependencies (repeatable, run in order)"}
+	fnPostBuildFlag := cli.StringSliceFlag{Name: "post-build", Usage: "shell command for the builder to run with sh -c in the source directory after the build command, e.g. to run tests (repeatable, run in order)"}
+	fnBuildSecretFlag := cli.StringSliceFlag{Name: "build-secret", Usage: "secret the builder mounts read-only under $BUILD_SECRETS/<name> for the build, e.g. registry credentials; never part of the deployment archive (repeatable)"}
+	fnBuildConfigMapFlag := cli.StringSliceFlag{Name: "build-configmap", Usage: "configmap the builder mounts read-only under $BUILD_CONFIGMAPS/<name> for the build (repeatable)"}
+	fnSkipRefCheckFlag := cli.BoolFlag{Name: "skip-ref-check", Usage: "don't check that --build-secret and --build-configmap objects exist"}
+	fnNoSizeCheckFlag := cli.BoolFlag{Name: "no-size-check", Usage: "don't check the archives against the environment's maximum package size"}
+	fnLowMemoryFlag := cli.BoolFlag{Name: "low-memory", Usage: "bound memory use for huge archives, for small CI runners: small buffers, one hashing worker, and uploads staged on disk; slower, and can't be used with --transform"}
+	fnInlineLimitFlag := cli.IntFlag{Name: "inline-limit", Usage: "embed archives smaller than this many bytes in the package instead of uploading them; defaults to the config file's inlineLimit"}
+	fnResumableUploadFlag := cli.BoolFlag{Name: "resumable-upload", Usage: "upload archives in chunks, so that an interrupted upload resumes where it stopped when the command is run again; needs a storage service with upload sessions"}
+	fnPresignedUploadFlag := cli.BoolFlag{Name: "presigned-upload", Usage: "upload archives straight to the storage service, to a pre-signed URL the controller issues, instead of through the controller; falls back to the controller if it issues none"}
+	fnEmbedBuildInfoFlag := cli.BoolFlag{Name: "embed-build-info", Usage: "add .fission/build-info.json to directory and layout archives, recording when and from which git commit they were packed, the CLI version, and a checksum of the other files"}
+	fnReproducibleFlag := cli.BoolFlag{Name: "reproducible", Usage: "pack directories with fixed file times and modes, and leave the time out of --embed-build-info, so the same files always give the same archive"}
+	fnNamespaceIsolationFlag := cli.BoolFlag{Name: "namespace-isolation", Usage: "store archives in the storage service's partition of the package's namespace, so they are never shared with other namespaces"}
+	fnChunkSizeFlag := cli.IntFlag{Name: "chunk-size", Usage: "split archives into chunks of about this many KiB at content-defined boundaries, storing chunks shared with other packages once; directories default to --compress none"}
+	fnVerifyReproducibleFlag := cli.BoolFlag{Name: "verify-reproducible", Usage: "pack directories and layout files twice and fail if the archives differ, naming the first entry that does; packing takes twice as long"}
+	fnWaitScanFlag := cli.BoolFlag{Name: "wait-scan", Usage: "wait for the storage service to scan uploaded archives for malware, failing if one is infected; ignored if it doesn't scan"}
+	archiveFlags := []cli.Flag{fnPrescanFlag, fnPrescanConcurrencyFlag, fnYesFlag, fnStoragePrefixFlag, fnBufferSizeFlag, fnCompressFlag, fnCompressionLevelFlag, fnIgnoreFlag, fnWithManifestFlag, fnProbeFlag, fnNoDefaultBuildFlag, fnMirrorStorageUrlFlag, fnStrictBuildLintFlag, fnTransformFlag, fnLabelFlag, fnSaveArchiveFlag, fnBuildEnvFlag, fnBuildEnvSecretFlag, fnRehostFlag, fnProgressFlag, fnPartSizeFlag, fnGitTreeFlag, fnArchiveTTLFlag, fnForceArchiveTTLFlag, fnSBOMFlag, fnAttestationFlag, fnMaxFileSizeFlag, fnFailLargeFilesFlag, fnBuilderImageFlag, fnNoHintsFlag, fnChecksumFlag, fnChecksumSizeFlag, fnFromImageFlag, fnImagePathFlag, fnNoBuildOverwriteFlag, fnDeploymentPolicyFlag, fnStdinNameFlag, fnSkipQuotaFlag, fnGitMetadataFlag, fnAllowDirtyFlag, fnArchiveNameFlag, fnNormalizeEOLFlag, fnStrictEnvFlag, fnUploadTimeoutFlag, fnScanSecretsFlag, fnBlockSecretsFlag, fnSecretRulesFlag, fnSecretAllowlistFlag, fnTransparencyLogFlag, fnStrictLayoutFlag, fnNoLayoutCheckFlag, fnNoSizeCheckFlag, fnLowMemoryFlag, fnPresignedUploadFlag, fnResumableUploadFlag, fnInlineLimitFlag, fnEmbedBuildInfoFlag, fnReproducibleFlag, fnNamespaceIsolationFlag, fnChunkSizeFlag, fnVerifyReproducibleFlag, fnWaitScanFlag, fnRangeChecksumsFlag, fnPreBuildFlag, fnPostBuildFlag, fnNoBuilderCheckFlag, fnArchiveTagFlag, fnBuildSecretFlag, fnBuildConfigMapFlag, fnSkipRefCheckFlag}
 	fnSubcommands := []cli.Command{
-		{Name: "create", Usage: "Create new function (and optionally, an HTTP route to it)", Flags: []cli.Flag{fnNameFlag, fnEnvNameFlag, fnCodeFlag, fnPackageFlag, fnSrcArchiveFlag, fnDeployArchiveFlag, fnEntryPointFlag, fnBuildCmdFlag, htUrlFlag, htMethodFlag}, Action: fnCreate},
+		{Name: "create", Usage: "Create new function (and optionally, an HTTP route to it)", Flags: append([]cli.Flag{fnNameFlag, fnEnvNameFlag, fnCodeFlag, fnPackageFlag, fnSrcArchiveFlag, fnDeployArchiveFlag, fnEntryPointFlag, fnBuildCmdFlag, fnAliasOfFlag, fnDeferUploadFlag, htUrlFlag, htMethodFlag}, archiveFlags...), Action: fnCreate},
 		{Name: "get", Usage: "Get function source code", Flags: []cli.Flag{fnNameFlag}, Action: fnGet},
 		{Name: "getmeta", Usage: "Get function metadata", Flags: []cli.Flag{fnNameFlag}, Action: fnGetMeta},
-		{Name: "update", Usage: "Update function source code", Flags: []cli.Flag{fnNameFlag, fnEnvNameFlag, fnCodeFlag, fnPackageFlag, fnSrcArchiveFlag, fnDeployArchiveFlag, fnEntryPointFlag, fnBuildCmdFlag}, Action: fnUpdate},
+		{Name: "update", Usage: "Update function source code", Flags: append([]cli.Flag{fnNameFlag, fnEnvNameFlag, fnCodeFlag, fnPackageFlag, fnSrcArchiveFlag, fnDeployArchiveFlag, fnEntryPointFlag, fnBuildCmdFlag}, archiveFlags...), Action: fnUpdate},
+		{Name: "set-package", Usage: "Point a function at another package, optionally once it has built", Flags: append([]cli.Flag{fnNameFlag, fnPkgRefFlag, fnCodeFlag, fnSrcArchiveFlag, fnDeployArchiveFlag, fnBuildCmdFlag, fnSetPackageWaitFlag, fnSetPackageFollowFlag}, archiveFlags...), Action: fnSetPackage},
 		{Name: "delete", Usage: "Delete function", Flags: []cli.Flag{fnNameFlag}, Action: fnDelete},
-		{Name: "list", Usage: "List all functions", Flags: []cli.Flag{}, Action: fnList},
+		{Name: "list", Usage: "List all functions", Flags: []cli.Flag{listOutputFlag}, Action: fnList},
 		{Name: "logs", Usage: "Display function logs", Flags: []cli.Flag{fnNameFlag, fnPodFlag, fnFollowFlag, fnDetailFlag, fnLogDBTypeFlag}, Action: fnLogs},
 		{Name: "pods", Usage: "Display function pods", Flags: []cli.Flag{fnNameFlag, fnLogDBTypeFlag}, Action: fnPods},
 	}
 
+	// packages
+	pkgFailedFlag := cli.BoolFlag{Name: "failed", Usage: "only select packages whose build failed"}
+	pkgOlderThanFlag := cli.StringFlag{Name: "older-than", Usage: "only select packages older than this, e.g. 36h or 7d"}
+	pkgDryRunFlag := cli.BoolFlag{Name: "dry-run", Usage: "list what would be deleted without deleting anything"}
+	pkgNameFlag := cli.StringFlag{Name: "name", Usage: "package name"}
+	pkgDestFlag := cli.StringFlag{Name: "dest", Usage: "destination directory"}
+	pkgDeploymentFlag := cli.BoolFlag{Name: "deployment", Usage: "fetch the deployment archive instead of the source archive"}
+	pkgUpdateFilePathFlag := cli.StringFlag{Name: "path", Usage: "path of the file to replace, relative to the archive root"}
+	pkgUpdateFileFileFlag := cli.StringFlag{Name: "file", Usage: "local file to put at --path"}
+	pkgUpdateFileDeploymentFlag := cli.BoolFlag{Name: "deployment", Usage: "update the deployment archive instead of the source archive"}
+	pkgUpdateFileChecksumPolicyFlag := cli.StringFlag{Name: "checksum-policy", Value: "recompute", Usage: "verification of the update: recompute (verify the old archive and the stored update), trust (rely on the storage service's check of the update) or skip (verify nothing)"}
+	pkgInspectFileFlag := cli.StringFlag{Name: "file, f", Usage: "exported package, YAML or JSON, e.g. from 'kubectl get package <name> -o yaml'"}
+	pkgInspectDeploymentFlag := cli.BoolFlag{Name: "deployment", Usage: "inspect the deployment archive instead of the source archive"}
+	pkgInspectExtractFlag := cli.StringFlag{Name: "extract", Usage: "also extract the files to <dir>/<package>"}
+	pkgForceFlag := cli.BoolFlag{Name: "force", Usage: "overwrite the contents of a non-empty destination"}
+	pkgImmutableFlag := cli.BoolFlag{Name: "immutable", Usage: "refuse later updates and rebuilds of the package, e.g. for a release; lifted with 'package unlock'"}
+	pkgUnlockYesFlag := cli.BoolFlag{Name: "yes, y", Usage: "unlock without asking for confirmation"}
+	pkgTagFlag := cli.StringFlag{Name: "tag", Usage: "new tag of the package, a human-facing name unique in its namespace"}
+	pkgEnvFlag := cli.StringFlag{Name: "env", Usage: "environment name for the package"}
+	pkgBuildCmdFlag := cli.StringFlag{Name: "buildcmd", Usage: "build command for builder to run with; defaults to the environment's build command"}
+	pkgWatchDeployFlag := cli.BoolFlag{Name: "deployment", Usage: "upload the directory as a deployment archive instead of a source archive"}
+	pkgWatchDeltaFlag := cli.BoolFlag{Name: "delta", Usage: "pack the directory reproducibly into chunks and upload only the chunks that changed since the last upload, keeping a manifest between runs"}
+	pkgWatchFullResyncFlag := cli.BoolFlag{Name: "full-resync", Usage: "with --delta, ignore the manifest of the last run and upload every chunk once"}
+	pkgWaitFlag := cli.BoolFlag{Name: "wait", Usage: "wait for each build to finish and print its status"}
+	pkgFollowFlag := cli.BoolFlag{Name: "follow", Usage: "with --wait, print build status changes and logs as they happen"}
+	pkgApplyFileFlag := cli.StringFlag{Name: "file, f", Usage: "JSON file listing the packages to create"}
+	pkgApplyOutputFlag := cli.StringFlag{Name: "output, o", Value: "table", Usage: "report format: table|json"}
+	pkgApplyParallelFlag := cli.IntFlag{Name: "parallel", Value: 1, Usage: "number of packages to create at once"}
+	pkgApplyBatchSizeFlag := cli.IntFlag{Name: "batch-size", Value: 50, Usage: "create packages with embedded archives this many per request; 1 creates each with its own request"}
+	pkgLimitFlag := cli.IntFlag{Name: "limit", Value: 20, Usage: "maximum number of packages to list; 0 for all"}
+	pkgReconcileFileFlag := cli.StringFlag{Name: "file, f", Usage: "JSON or YAML file listing the desired packages, each with a name"}
+	pkgReconcilePruneFlag := cli.BoolFlag{Name: "prune", Usage: "also delete packages of the listed environments that aren't in the file"}
+	pkgIfNotExistsFlag := cli.BoolFlag{Name: "if-not-exists", Usage: "with --name, keep an existing package with the same contents instead of failing; one with different contents exits with code 7"}
+	pkgReplaceFlag := cli.BoolFlag{Name: "replace", Usage: "with --name, update an existing package with different contents"}
+	pkgFieldManagerFlag := cli.StringFlag{Name: "field-manager", Usage: "with --name, apply the package as this manager: create or update it, changing nothing if it's unchanged; a package applied by another manager exits with code 7 unless --replace is given"}
+	pkgRefreshWithinFlag := cli.StringFlag{Name: "within", Value: "24h", Usage: "refresh URLs expiring within this long, e.g. 36h or 7d"}
+	pkgRefreshDryRunFlag := cli.BoolFlag{Name: "dry-run", Usage: "list the packages that would be refreshed without changing anything"}
+	pkgExplainFlag := cli.BoolFlag{Name: "explain", Usage: "print the resolved settings and how each archive would be stored, without creating or uploading anything"}
+	pkgMigrateFromFlag := cli.StringFlag{Name: "from", Usage: "URL of the storage service to move archives from"}
+	pkgMigrateToFlag := cli.StringFlag{Name: "to", Usage: "URL of the storage service to move archives to"}
+	pkgVerifyAllFlag := cli.BoolFlag{Name: "all", Usage: "check the checksums of the archives of every package in the namespace, or with --env an environment's"}
+	pkgVerifyParallelFlag := cli.IntFlag{Name: "parallel", Value: 4, Usage: "with --all, number of archives to download at once"}
+	pkgVerifyRateFlag := cli.Float64Flag{Name: "rate", Value: 10, Usage: "with --all, most archive downloads to start per second; 0 for no limit"}
+	pkgVerifySampleFlag := cli.BoolFlag{Name: "sample", Usage: "check the checksums of sampled ranges of each archive, of one package or with --all every package, instead of all their bytes; faster on huge archives, but only likely to find damage, not certain; needs archives created with --range-checksums or --chunk-size"}
+	pkgVerifySampleRangesFlag := cli.IntFlag{Name: "sample-ranges", Value: 16, Usage: "with --sample, number of ranges or chunks to check per archive"}
+	pkgVerifyCheckpointDirFlag := cli.StringFlag{Name: "checkpoint-dir", Usage: "checkpoint the downloads and hashes of archives in this directory, so that an interrupted verify resumes where it stopped; without --all, the package's archives are then also checked against their checksums"}
+	pkgVerifyStateFileFlag := cli.StringFlag{Name: "state-file", Usage: "with --all, record the result of each archive in this file as it's verified, so the sweep can be continued with --resume"}
+	pkgVerifyResumeFlag := cli.BoolFlag{Name: "resume", Usage: "continue the sweep of --state-file, skipping the archives it has results for unless they failed or changed"}
+	pkgMigrateParallelFlag := cli.IntFlag{Name: "parallel", Value: 4, Usage: "number of packages to migrate at once"}
+	pkgMigrateDryRunFlag := cli.BoolFlag{Name: "dry-run", Usage: "list the packages that would be migrated without changing anything"}
+	pkgReconcileApplyFlag := cli.BoolFlag{Name: "apply", Usage: "make the planned changes; without it only the plan is printed"}
+	pkgCloneReuploadFlag := cli.BoolFlag{Name: "reupload", Usage: "copy the archives for the clone instead of referring to the original's"}
+	pkgLockOutputFlag := cli.StringFlag{Name: "output, o", Usage: "file to write the lockfile to, e.g. fission.lock; stdout if not given"}
+	pkgLockFileFlag := cli.StringFlag{Name: "file, f", Value: "fission.lock", Usage: "lockfile to check the packages against"}
+	pkgSelectorFlag := cli.StringFlag{Name: "selector, l", Usage: "only packages whose labels match this selector, e.g. app=web,tier!=test"}
+	pkgSubcommands := []cli.Command{
+		{Name: "create", Usage: "Create a package; flags not given are read from the nearest .fissionrc in the working directory or above it", Flags: append([]cli.Flag{pkgNameFlag, pkgEnvFlag, fnSrcArchiveFlag, fnDeployArchiveFlag, pkgBuildCmdFlag, pkgIfNotExistsFlag, pkgReplaceFlag, pkgFieldManagerFlag, pkgExplainFlag, pkgImmutableFlag}, archiveFlags...), Action: pkgCreate},
+		{Name: "apply", Usage: "Create a batch of packages and report the outcome of each", Flags: append([]cli.Flag{pkgApplyFileFlag, pkgApplyOutputFlag, pkgApplyParallelFlag, pkgApplyBatchSizeFlag}, archiveFlags...), Action: pkgApply},
+		{Name: "watch", Usage: "Rebuild a package whenever files in a directory change", ArgsUsage: "<directory>", Flags: append([]cli.Flag{pkgEnvFlag, pkgBuildCmdFlag, pkgWatchDeployFlag, pkgWatchDeltaFlag, pkgWatchFullResyncFlag, pkgWaitFlag, pkgFollowFlag}, archiveFlags...), Action: pkgWatch},
+		{Name: "update-file", Usage: "Replace one file in a package's archive and upload it again", ArgsUsage: "[name]", Flags: append([]cli.Flag{pkgNameFlag, pkgUpdateFilePathFlag, pkgUpdateFileFileFlag, pkgUpdateFileDeploymentFlag, pkgUpdateFileChecksumPolicyFlag}, archiveFlags...), Action: pkgUpdateFile},
+		{Name: "fetch", Usage: "Download a package's source or deployment archive", ArgsUsage: "[name]", Flags: []cli.Flag{pkgNameFlag, pkgDestFlag, pkgDeploymentFlag, pkgForceFlag}, Action: pkgFetch},
+		{Name: "inspect", Usage: "List or extract the embedded archive of an exported package without a cluster, checking it against its recorded checksum", ArgsUsage: "[file]", Flags: []cli.Flag{pkgInspectFileFlag, pkgInspectDeploymentFlag, pkgInspectExtractFlag, listOutputFlag}, Action: pkgInspect},
+		{Name: "lint", Usage: "Check a build command for likely shell mistakes", Flags: []cli.Flag{pkgBuildCmdFlag, fnStrictBuildLintFlag}, Action: pkgLint},
+		{Name: "reconcile", Usage: "Create, update and optionally delete packages to match a file", Flags: append([]cli.Flag{pkgReconcileFileFlag, pkgReconcilePruneFlag, pkgReconcileApplyFlag}, archiveFlags...), Action: pkgReconcile},
+		{Name: "clone", Usage: "Create a package with the spec of an existing one, e.g. to experiment with its build; packages with source are built again", ArgsUsage: "<src> <newname>", Flags: []cli.Flag{pkgTagFlag, pkgCloneReuploadFlag}, Action: pkgClone},
+		{Name: "alias", Usage: "Create an alias package pointing at another package, or retarget one", Flags: []cli.Flag{pkgNameFlag, pkgEnvFlag, fnAliasOfFlag}, Action: pkgAlias},
+		{Name: "commit", Usage: "Upload the archives of a package awaiting upload", ArgsUsage: "[name]", Flags: append([]cli.Flag{pkgNameFlag, fnSrcArchiveFlag, fnDeployArchiveFlag}, archiveFlags...), Action: pkgCommit},
+		{Name: "verify", Usage: "Check that a package's archives match its attestation, or with --all that every package's archives match their checksums, or with --sample sampled ranges of them", ArgsUsage: "[name]", Flags: []cli.Flag{pkgNameFlag, pkgVerifyAllFlag, pkgEnvFlag, pkgVerifyParallelFlag, pkgVerifyRateFlag, pkgVerifyCheckpointDirFlag, pkgVerifyStateFileFlag, pkgVerifyResumeFlag, pkgVerifySampleFlag, pkgVerifySampleRangesFlag, listOutputFlag}, Action: pkgVerify},
+		{Name: "validate-refs", Usage: "Report functions and packages referring to missing packages, environments or stored archives, in every namespace; exits non-zero if there are any", Flags: []cli.Flag{listOutputFlag}, Action: pkgValidateRefs},
+		{Name: "migrate-storage", Usage: "Copy package archives to another storage service and point the packages at it", Flags: []cli.Flag{pkgMigrateFromFlag, pkgMigrateToFlag, pkgMigrateParallelFlag, pkgMigrateDryRunFlag}, Action: pkgMigrateStorage},
+		{Name: "refresh-urls", Usage: "Re-sign package archive URLs that are about to expire", Flags: []cli.Flag{pkgRefreshWithinFlag, pkgRefreshDryRunFlag}, Action: pkgRefreshUrls},
+		{Name: "touch", Usage: "Make the builder manager look at a package again, e.g. one stuck pending", ArgsUsage: "[name]", Flags: []cli.Flag{pkgNameFlag}, Action: pkgTouch},
+		{Name: "cancel-build", Usage: "Stop a package's pending or running build", ArgsUsage: "[name]", Flags: []cli.Flag{pkgNameFlag}, Action: pkgCancelBuild},
+		{Name: "retag", Usage: "Change the tag of a package without recreating it", ArgsUsage: "[name]", Flags: []cli.Flag{pkgNameFlag, pkgTagFlag}, Action: pkgRetag},
+		{Name: "unlock", Usage: "Let an immutable package be changed again, after confirmation", ArgsUsage: "[name]", Flags: []cli.Flag{pkgNameFlag, pkgUnlockYesFlag}, Action: pkgUnlock},
+		{Name: "history", Usage: "List an environment's packages, newest first", Flags: []cli.Flag{pkgEnvFlag, pkgLimitFlag, listOutputFlag}, Action: pkgHistory},
+		{Name: "prune", Usage: "Delete failed packages and their archives", Flags: []cli.Flag{pkgFailedFlag, pkgOlderThanFlag, pkgDryRunFlag}, Action: pkgPrune},
+		{Name: "lock", Usage: "Write a lockfile of the packages and the checksums of their archives", Flags: []cli.Flag{pkgLockOutputFlag, pkgSelectorFlag}, Action: pkgLock},
+		{Name: "verify-lock", Usage: "Check that the packages match a lockfile, reporting drift; exits with code 10 if they don't", Flags: []cli.Flag{pkgLockFileFlag, pkgSelectorFlag, listOutputFlag}, Action: pkgVerifyLock},
+	}
+
 	// httptriggers
 	htNameFlag := cli.StringFlag{Name: "name", Usage: "HTTP Trigger name"}
 	htFnNameFlag := cli.StringFlag{Name: "function", Usage: "Function name"}
@@ -68,7 +259,7 @@ func main() {
 		{Name: "get", Usage: "Get HTTP trigger", Flags: []cli.Flag{htMethodFlag, htUrlFlag}, Action: htGet},
 		{Name: "update", Usage: "Update HTTP trigger", Flags: []cli.Flag{htNameFlag, htFnNameFlag}, Action: htUpdate},
 		{Name: "delete", Usage: "Delete HTTP trigger", Flags: []cli.Flag{htNameFlag}, Action: htDelete},
-		{Name: "list", Usage: "List HTTP triggers", Flags: []cli.Flag{}, Action: htList},
+		{Name: "list", Usage: "List HTTP triggers", Flags: []cli.Flag{listOutputFlag}, Action: htList},
 	}
 
 	// timetriggers
@@ -80,7 +271,7 @@ func main() {
 		{Name: "get", Usage: "Get Time trigger", Flags: []cli.Flag{}, Action: ttGet},
 		{Name: "update", Usage: "Update Time trigger", Flags: []cli.Flag{ttNameFlag, ttCronFlag, ttFnNameFlag}, Action: ttUpdate},
 		{Name: "delete", Usage: "Delete Time trigger", Flags: []cli.Flag{ttNameFlag}, Action: ttDelete},
-		{Name: "list", Usage: "List Time triggers", Flags: []cli.Flag{}, Action: ttList},
+		{Name: "list", Usage: "List Time triggers", Flags: []cli.Flag{listOutputFlag}, Action: ttList},
 	}
 
 	// Message queue trigger
@@ -95,7 +286,7 @@ func main() {
 		{Name: "get", Usage: "Get message queue trigger", Flags: []cli.Flag{}, Action: mqtGet},
 		{Name: "update", Usage: "Update message queue trigger", Flags: []cli.Flag{mqtNameFlag, mqtTopicFlag, mqtRespTopicFlag, mqtFnNameFlag, mqtMsgContentType}, Action: mqtUpdate},
 		{Name: "delete", Usage: "Delete message queue trigger", Flags: []cli.Flag{mqtNameFlag}, Action: mqtDelete},
-		{Name: "list", Usage: "List message queue triggers", Flags: []cli.Flag{mqtMQTypeFlag}, Action: mqtList},
+		{Name: "list", Usage: "List message queue triggers", Flags: []cli.Flag{mqtMQTypeFlag, listOutputFlag}, Action: mqtList},
 	}
 
 	// environments
@@ -104,12 +295,16 @@ func main() {
 	envBuilderImageFlag := cli.StringFlag{Name: "builder", Usage: "Environment builder image URL (optional)"}
 	envBuildCmdFlag := cli.StringFlag{Name: "buildcmd", Usage: "Build command for environment builder to build source package (optional)"}
 	envVersionFlag := cli.IntFlag{Name: "version", Usage: "Environment API version: defaults to 1 (means v1 interface)"}
+	envLanguageFlag := cli.StringFlag{Name: "language", Usage: "Language of the runtime image, e.g. python or nodejs (optional)"}
+	envArchiveLayoutFlag := cli.StringFlag{Name: "archive-layout", Usage: "YAML file of the files expected in packages' source and deployment archives, which are checked against it (optional)"}
+	envMaxPackageSizeFlag := cli.IntFlag{Name: "max-package-size", Usage: "largest archive in MiB the environment's packages may have, checked when they are created (optional)"}
+	envLanguageVersionFlag := cli.StringFlag{Name: "language-version", Usage: "Language version of the runtime image, e.g. 3.9; packages are checked against it (optional)"}
 	envSubcommands := []cli.Command{
-		{Name: "create", Aliases: []string{"add"}, Usage: "Add an environment", Flags: []cli.Flag{envNameFlag, envImageFlag, envBuilderImageFlag, envBuildCmdFlag, envVersionFlag}, Action: envCreate},
+		{Name: "create", Aliases: []string{"add"}, Usage: "Add an environment", Flags: []cli.Flag{envNameFlag, envImageFlag, envBuilderImageFlag, envBuildCmdFlag, envVersionFlag, envLanguageFlag, envLanguageVersionFlag, envArchiveLayoutFlag, envMaxPackageSizeFlag}, Action: envCreate},
 		{Name: "get", Usage: "Get environment details", Flags: []cli.Flag{envNameFlag}, Action: envGet},
-		{Name: "update", Usage: "Update environment", Flags: []cli.Flag{envNameFlag, envImageFlag, envBuilderImageFlag, envBuildCmdFlag}, Action: envUpdate},
+		{Name: "update", Usage: "Update environment", Flags: []cli.Flag{envNameFlag, envImageFlag, envBuilderImageFlag, envBuildCmdFlag, envLanguageFlag, envLanguageVersionFlag, envArchiveLayoutFlag, envMaxPackageSizeFlag}, Action: envUpdate},
 		{Name: "delete", Usage: "Delete environment", Flags: []cli.Flag{envNameFlag}, Action: envDelete},
-		{Name: "list", Usage: "List all environments", Flags: []cli.Flag{}, Action: envList},
+		{Name: "list", Usage: "List all environments", Flags: []cli.Flag{listOutputFlag}, Action: envList},
 	}
 
 	// watches
@@ -123,7 +318,7 @@ func main() {
 		{Name: "get", Usage: "Get details about a watch", Flags: []cli.Flag{wNameFlag}, Action: wGet},
 		// TODO add update flag when supported
 		{Name: "delete", Usage: "Delete watch", Flags: []cli.Flag{wNameFlag}, Action: wDelete},
-		{Name: "list", Usage: "List all watches", Flags: []cli.Flag{}, Action: wList},
+		{Name: "list", Usage: "List all watches", Flags: []cli.Flag{listOutputFlag}, Action: wList},
 	}
 
 	upgradeFileFlag := cli.StringFlag{Name: "file", Usage: "JSON file containing all fission state"}
@@ -131,15 +326,36 @@ func main() {
 		{Name: "dump", Usage: "Dump all state from a v0.1 fission installation", Flags: []cli.Flag{upgradeFileFlag}, Action: upgradeDumpState},
 		{Name: "restore", Usage: "Restore state dumped from a v0.1 install into a v0.2+ install", Flags: []cli.Flag{upgradeFileFlag}, Action: upgradeRestoreState},
 	}
+	storageOlderThanFlag := cli.StringFlag{Name: "older-than", Usage: "only archives last stored longer ago than this, e.g. 7d or 12h"}
+	storageTagFlag := cli.StringSliceFlag{Name: "tag", Usage: "key=value tag the archives must hold, e.g. git-sha=<commit> (repeatable)"}
+	storageSubcommands := []cli.Command{
+		{Name: "warm", Usage: "Have builders cache archives, given by checksum, ahead of the builds using them", ArgsUsage: "<checksum...>", Action: storageWarm},
+		{Name: "stats", Usage: "Show how much space is saved by sharing identical archives", Flags: []cli.Flag{listOutputFlag}, Action: storageStats},
+		{Name: "orphans", Usage: "List stored archives that no package refers to", Flags: []cli.Flag{listOutputFlag, storageOlderThanFlag}, Action: storageOrphans},
+		{Name: "find", Usage: "List stored archives by upload tag, and the packages referring to them", Flags: []cli.Flag{storageTagFlag, listOutputFlag}, Action: storageFind},
+	}
+
+	diagnoseSizeFlag := cli.IntFlag{Name: "size", Value: 64, Usage: "size in KiB of the test archive"}
+	diagnoseSubcommands := []cli.Command{
+		{Name: "storage", Usage: "Upload, download and verify a test archive through the storage service, timing each stage", Flags: []cli.Flag{diagnoseSizeFlag}, Action: diagnoseStorage},
+	}
+
 	app.Commands = []cli.Command{
 		{Name: "function", Aliases: []string{"fn"}, Usage: "Create, update and manage functions", Subcommands: fnSubcommands},
+		{Name: "package", Aliases: []string{"pkg"}, Usage: "Manage packages", Subcommands: pkgSubcommands},
 		{Name: "httptrigger", Aliases: []string{"ht", "route"}, Usage: "Manage HTTP triggers (routes) for functions", Subcommands: htSubcommands},
 		{Name: "timetrigger", Aliases: []string{"tt", "timer"}, Usage: "Manage Time triggers (timers) for functions", Subcommands: ttSubcommands},
 		{Name: "mqtrigger", Aliases: []string{"mqt", "messagequeue"}, Usage: "Manage message queue triggers for functions", Subcommands: mqtSubcommands},
 		{Name: "environment", Aliases: []string{"env"}, Usage: "Manage environments", Subcommands: envSubcommands},
 		{Name: "watch", Aliases: []string{"w"}, Usage: "Manage watches", Subcommands: wSubCommands},
 		{Name: "upgrade", Aliases: []string{}, Usage: "Upgrade tool from fission v0.1", Subcommands: upgradeSubCommands},
+		{Name: "storage", Usage: "Manage archives in the storage service", Subcommands: storageSubcommands},
+		{Name: "diagnose", Usage: "Check that fission services work from here", Subcommands: diagnoseSubcommands},
 	}
 
-	app.Run(os.Args)
+	app.OnUsageError = usageError
+	setUsageErrorHandlers(app.Commands)
+	if err := app.Run(os.Args); err != nil {
+		fatalWithCode(exitCode(err), err.Error())
+	}
 }
@@ -0,0 +1,259 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/packager"
+)
+
+// createArchiveFromFiles makes an archive of files held in memory,
+// keyed by their slash separated paths in the archive, as
+// createArchive would of a directory holding them; name is what the
+// archive is called in messages and when downloaded. The files are
+// zipped, transformed, checked for secrets and sized in memory, so an
+// archive below the literal limit is embedded without touching the
+// disk. A larger one is spilled to the staging directory, then
+// compressed and uploaded as usual; past packing, it's prepared and
+// stored as createArchive does a directory, by the same code.
+//
+// It's the CLI's, for archives made in memory and for tests. Programs
+// embedding package creation can use the packager package instead,
+// which zips with the same writer and modes.
+//
+// The zip is deterministic: entries are sorted by path, with fixed
+// modification times and mode 0644, so the same files always give the
+// same checksum.
+func createArchiveFromFiles(client *client.Client, name string, files map[string][]byte, opts archiveOptions) (*fission.Archive, error) {
+	opts.files = files
+	return createArchive(client, name, opts)
+}
+
+// memFileInfo describes a file held in memory.
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return packager.ZipModTime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// scanFiles describes files held in memory like scanDir does for a
+// directory, with their checksums. Paths must be clean and relative,
+// inside the archive.
+func scanFiles(files map[string][]byte) (*dirScan, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to archive")
+	}
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		if len(p) == 0 || p != path.Clean(p) || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") || strings.Contains(p, `\`) {
+			return nil, fmt.Errorf("'%v' must be a clean, slash separated path inside the archive", p)
+		}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	scan := &dirScan{deterministic: true}
+	for _, p := range paths {
+		contents := files[p]
+		if contents == nil {
+			// writeZip reads entries without contents from
+			// their path
+			contents = []byte{}
+		}
+		sum := sha256.Sum256(contents)
+		scan.entries = append(scan.entries, scanEntry{
+			relPath:  p,
+			info:     memFileInfo{name: path.Base(p), size: int64(len(contents))},
+			checksum: hex.EncodeToString(sum[:]),
+			contents: contents,
+		})
+		scan.totalSize += int64(len(contents))
+	}
+	return scan, nil
+}
+
+// transformFiles applies the named transforms to the files of a scan
+// held in memory, as transformArchive does to a zip.
+func transformFiles(scan *dirScan, names []string) (*dirScan, error) {
+	transforms, err := lookupTransforms(names)
+	if err != nil {
+		return nil, err
+	}
+	transformed := &dirScan{deterministic: scan.deterministic}
+	for _, e := range scan.entries {
+		contents, err := applyTransforms(e.relPath, e.contents, transforms)
+		if err != nil {
+			return nil, err
+		}
+		if contents == nil {
+			verbose("Transform dropped %v", e.relPath)
+			continue
+		}
+		sum := sha256.Sum256(contents)
+		e.contents = contents
+		e.info = memFileInfo{name: e.info.Name(), size: int64(len(contents))}
+		e.checksum = hex.EncodeToString(sum[:])
+		transformed.entries = append(transformed.entries, e)
+		transformed.totalSize += int64(len(contents))
+	}
+	if len(transformed.entries) == 0 {
+		return nil, fmt.Errorf("transforms dropped every file, nothing left to store")
+	}
+	return transformed, nil
+}
+
+// prepareFilesArchive is prepareArchive for files held in memory. The
+// caller must close the result.
+func prepareFilesArchive(name string, files map[string][]byte, opts archiveOptions) (*preparedArchive, error) {
+	if filepath.Base(name) != name {
+		return nil, fmt.Errorf("archive name '%v' must be a file name, without directories", name)
+	}
+	if len(opts.checksum) > 0 {
+		return nil, fmt.Errorf("--checksum needs a single archive file, not files packed in memory")
+	}
+	scan, err := scanFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	p := &preparedArchive{srcName: name}
+	err = p.prepareScan(scan, opts)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// prepareScan is prepare for files held in memory, described by scan
+// with their contents: they're transformed, checked for secrets and
+// zipped in memory.
+func (p *preparedArchive) prepareScan(scan *dirScan, opts archiveOptions) error {
+	var err error
+	if len(opts.transforms) > 0 {
+		scan, err = transformFiles(scan, opts.transforms)
+		if err != nil {
+			return fmt.Errorf("transform %v: %w", p.srcName, err)
+		}
+	}
+	if opts.secrets != nil {
+		err = opts.secrets.checkScan(p.srcName, scan)
+		if err != nil {
+			return err
+		}
+	}
+	compression, err := resolveCompression(opts.compression, true)
+	if err != nil {
+		return err
+	}
+	opts.compressionLevel, err = resolveCompressionLevel(opts.compressionLevel, opts.compression, compression)
+	if err != nil {
+		return err
+	}
+	verbose("%v: %v files, %v bytes", p.srcName, len(scan.entries), scan.totalSize)
+
+	// as in packDirArchive, entries are stored uncompressed when the
+	// whole zip is compressed for upload
+	method := uint16(zip.Deflate)
+	if compression != fission.ArchiveCompressionNone && !planArchive(scan.totalSize, opts.inlineLimit).Inline {
+		method = zip.Store
+	}
+	var buf bytes.Buffer
+	err = writeZip(scan, &buf, method, opts.compressionLevel)
+	if err != nil {
+		return fmt.Errorf("pack %v: %w", p.srcName, err)
+	}
+	p.scan = scan
+	p.contents = buf.Bytes()
+	return p.finish(p.srcName, int64(buf.Len()), "", compression, opts)
+}
+
+// prepareContents is prepare for a single file held in memory, such
+// as what was read from stdin.
+func (p *preparedArchive) prepareContents(contents []byte, opts archiveOptions) error {
+	original := p.srcName
+	if len(opts.transforms) > 0 {
+		transforms, err := lookupTransforms(opts.transforms)
+		if err != nil {
+			return fmt.Errorf("transform %v: %w", p.srcName, err)
+		}
+		contents, err = applyTransforms(p.srcName, contents, transforms)
+		if err != nil {
+			return fmt.Errorf("transform %v: %w", p.srcName, err)
+		}
+		if contents == nil {
+			return fmt.Errorf("transform dropped %v, nothing left to upload", p.srcName)
+		}
+		original = ""
+	}
+	if opts.secrets != nil {
+		err := opts.secrets.checkContents(p.srcName, contents)
+		if err != nil {
+			return err
+		}
+	}
+	compression, err := resolveCompression(opts.compression, false)
+	if err != nil {
+		return err
+	}
+	opts.compressionLevel, err = resolveCompressionLevel(opts.compressionLevel, opts.compression, compression)
+	if err != nil {
+		return err
+	}
+	p.contents = contents
+	return p.finish(p.srcName, int64(len(contents)), original, compression, opts)
+}
+
+// spill writes the zip of a prepared archive to a file in the staging
+// directory, named name, as its uploadName.
+func (p *preparedArchive) spill(name string, contents []byte) error {
+	err := checkStagingSpace(int64(len(contents)))
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(stagingDir(), "fission-files-")
+	if err != nil {
+		return err
+	}
+	p.cleanups = append(p.cleanups, func() { os.RemoveAll(dir) })
+	p.uploadName = filepath.Join(dir, name)
+	err = ioutil.WriteFile(p.uploadName, contents, 0644)
+	if err != nil {
+		return fmt.Errorf("spill %v to %v: %w", name, p.uploadName, err)
+	}
+	verbose("%v: spilled %v to %v", name, formatSize(int64(len(contents))), p.uploadName)
+	return nil
+}
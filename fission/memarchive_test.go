@@ -0,0 +1,91 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/fission/fission"
+)
+
+func TestCreateArchiveFromFiles(t *testing.T) {
+	files := map[string][]byte{
+		"index.js":     []byte("module.exports = require('./lib/hello')\n"),
+		"lib/hello.js": []byte("module.exports = () => 'hello'\n"),
+		"package.json": []byte(`{"name": "hello"}`),
+	}
+	opts := archiveOptions{inlineLimit: config.InlineLimit}
+
+	archive, err := createArchiveFromFiles(nil, "hello", files, opts)
+	panicIf(err)
+	if archive.Type != fission.ArchiveTypeLiteral {
+		log.Panicf("Expected a literal archive, got %v", archive.Type)
+	}
+	sum := sha256.Sum256(archive.Literal)
+	if !archive.Checksum.Equal(fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:])) {
+		log.Panicf("Checksum %v doesn't cover the literal", archive.Checksum)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archive.Literal), int64(len(archive.Literal)))
+	panicIf(err)
+	if len(r.File) != len(files) {
+		log.Panicf("Expected %v files in the archive, got %v", len(files), len(r.File))
+	}
+	for _, zf := range r.File {
+		contents, err := readZipFile(zf)
+		panicIf(err)
+		if !bytes.Equal(contents, files[zf.Name]) {
+			log.Panicf("%v holds %q, expected %q", zf.Name, contents, files[zf.Name])
+		}
+	}
+
+	// the same files always make the same archive
+	again, err := createArchiveFromFiles(nil, "hello", files, opts)
+	panicIf(err)
+	if !again.Checksum.Equal(archive.Checksum) {
+		log.Panicf("Archives of the same files differ: %v and %v", archive.Checksum, again.Checksum)
+	}
+
+	// an archive at the literal limit is spilled for upload
+	opts.inlineLimit = 1
+	opts.compression = "gzip"
+	p, err := prepareFilesArchive("hello", files, opts)
+	panicIf(err)
+	if p.literal || p.compression != fission.ArchiveCompressionGzip {
+		log.Panicf("Expected a gzipped upload, got literal %v, compression %v", p.literal, p.compression)
+	}
+	sumHex, err := fileChecksum(p.uploadName)
+	panicIf(err)
+	if sumHex != p.checksum.HexSum() {
+		log.Panicf("Checksum %v doesn't cover %v", p.checksum, p.uploadName)
+	}
+	p.close()
+	if _, err := os.Stat(p.uploadName); !os.IsNotExist(err) {
+		log.Panicf("Expected %v to be removed, got %v", p.uploadName, err)
+	}
+
+	for _, bad := range []string{"", "/etc/passwd", "../up", "a/../b", `a\b`} {
+		_, err := createArchiveFromFiles(nil, "hello", map[string][]byte{bad: nil}, opts)
+		if err == nil {
+			log.Panicf("Expected path %q to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+	"github.com/fission/fission/tpr"
+)
+
+// storageMigration copies archives from one storage service to
+// another.
+type storageMigration struct {
+	from    *storageSvcClient.Client
+	to      *storageSvcClient.Client
+	fromUrl string
+	dryRun  bool
+}
+
+// isOnSource returns true if an archive URL points at the storage
+// service being migrated from.
+func (m *storageMigration) isOnSource(archiveUrl string) bool {
+	if !strings.HasPrefix(archiveUrl, m.fromUrl) {
+		return false
+	}
+	_, ok := storageIdFromUrl(archiveUrl)
+	return ok
+}
+
+// needsMigration returns true if any of an archive's contents, or
+// its manifests, are stored on the storage service being migrated
+// from.
+func (m *storageMigration) needsMigration(archive *fission.Archive) bool {
+	if archive == nil || archive.Type != fission.ArchiveTypeUrl {
+		return false
+	}
+	for _, u := range archiveUrls(archive) {
+		if m.isOnSource(u) {
+			return true
+		}
+	}
+	return m.needsMigration(archive.Manifest) || m.needsMigration(archive.RangeManifest)
+}
+
+// migrateArchive copies an archive to the new storage service and
+// points it there. Its contents are verified against its checksum
+// when downloaded, and by the new storage service when uploaded;
+// storage services that can copy to each other do so directly. The
+// parts of a split archive are joined. Mirrors on the old storage
+// service are dropped; others are kept.
+func (m *storageMigration) migrateArchive(archive *fission.Archive) error {
+	if !m.needsMigration(archive) {
+		return nil
+	}
+	if archive.Manifest != nil {
+		if err := m.migrateArchive(archive.Manifest); err != nil {
+			return fmt.Errorf("manifest: %w", err)
+		}
+	}
+	if archive.RangeManifest != nil {
+		if err := m.migrateArchive(archive.RangeManifest); err != nil {
+			return fmt.Errorf("range manifest: %w", err)
+		}
+	}
+	urls := archiveUrls(archive)
+	if len(urls) == 0 || !m.isOnSource(urls[0]) {
+		return nil
+	}
+	ids := make([]string, len(urls))
+	for i, u := range urls {
+		if !m.isOnSource(u) {
+			return fmt.Errorf("archive %v is split across storage services", urls[0])
+		}
+		ids[i], _ = storageIdFromUrl(u)
+	}
+	if m.dryRun {
+		return nil
+	}
+
+	var res *storageSvcClient.UploadResult
+	checksum := archive.Checksum
+	var err error
+	if len(ids) == 1 && checksum.Type == fission.ChecksumTypeSHA256 && len(checksum.Sum) > 0 {
+		// the storage services copy whole archives between
+		// themselves, if they can
+		res, err = m.from.Copy(ids[0], m.to, checksum)
+		if err != nil {
+			return fmt.Errorf("copy %v: %w", urls[0], err)
+		}
+	} else {
+		res, checksum, err = m.joinArchive(ids, urls[0], checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	var mirrors []string
+	for _, u := range archive.Mirrors {
+		if !m.isOnSource(u) {
+			mirrors = append(mirrors, u)
+		}
+	}
+	archive.URL = m.to.GetUrl(res.ID)
+	archive.Parts = nil
+	archive.Chunks = nil
+	archive.Mirrors = mirrors
+	archive.Checksum = checksum
+	archive.ServerChecksum = res.ServerChecksum
+	return nil
+}
+
+// joinArchive downloads the parts of an archive, checks them against
+// its checksum, or computes one if it has none, and uploads them
+// joined to the new storage service.
+func (m *storageMigration) joinArchive(ids []string, url string, checksum fission.Checksum) (*storageSvcClient.UploadResult, fission.Checksum, error) {
+	dir, err := ioutil.TempDir("", "fission-migrate")
+	if err != nil {
+		return nil, checksum, err
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "archive")
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, checksum, err
+	}
+	defer f.Close()
+	for _, id := range ids {
+		err = m.from.DownloadTo(id, f)
+		if err != nil {
+			return nil, checksum, fmt.Errorf("download %v: %w", id, err)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, checksum, err
+	}
+
+	sum, err := fileChecksum(fileName)
+	if err != nil {
+		return nil, checksum, err
+	}
+	if len(checksum.Sum) == 0 {
+		checksum = fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: sum}
+	}
+	if checksum.Type != fission.ChecksumTypeSHA256 {
+		return nil, checksum, fmt.Errorf("%w: unsupported checksum type '%v'", fission.ErrInvalidChecksum, checksum.Type)
+	}
+	if sum != checksum.Sum {
+		return nil, checksum, fission.MakeError(fission.ErrorChecksumFail, fmt.Sprintf("Checksum validation failed for %v", url))
+	}
+
+	// keep the storage prefix the archive was uploaded with
+	prefix := ""
+	if i := strings.LastIndex(ids[0], "/"); i >= 0 {
+		prefix = ids[0][:i+1]
+	}
+	res, err := m.to.UploadVerified(fileName, prefix, checksum, nil)
+	if err != nil {
+		return nil, checksum, fmt.Errorf("upload %v: %w", url, err)
+	}
+	return res, checksum, nil
+}
+
+// migratePackage moves a package's archives to the new storage
+// service and updates it.
+func (m *storageMigration) migratePackage(client *client.Client, pkg *tpr.Package) error {
+	for _, a := range []struct {
+		name    string
+		archive *fission.Archive
+	}{
+		{"source", &pkg.Spec.Source},
+		{"deployment", &pkg.Spec.Deployment},
+		{"SBOM", pkg.Spec.SBOM},
+		{"attestation", pkg.Spec.Attestation},
+	} {
+		err := m.migrateArchive(a.archive)
+		if err != nil {
+			return fmt.Errorf("%v archive: %w", a.name, err)
+		}
+	}
+	if m.dryRun {
+		return nil
+	}
+
+	meta, err := client.PackageUpdate(pkg)
+	if err != nil {
+		return fmt.Errorf("update package: %w", err)
+	}
+	return updatePackageFunctions(client, meta)
+}
+
+func pkgMigrateStorage(c *cli.Context) error {
+	from := strings.TrimSuffix(c.String("from"), "/")
+	to := strings.TrimSuffix(c.String("to"), "/")
+	if len(from) == 0 || len(to) == 0 {
+		fatalUsage("Need --from and --to, the URLs of the storage services to migrate from and to.")
+	}
+	if from == to {
+		fatalUsage("--from and --to are the same storage service.")
+	}
+	parallel := c.Int("parallel")
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	client := getClient(c.GlobalString("server"))
+	opts := storageClientOptions(client.Headers)
+	m := &storageMigration{
+		from:    storageSvcClient.MakeClient(from, opts...),
+		to:      storageSvcClient.MakeClient(to, opts...),
+		fromUrl: from + "/v1/archive",
+		dryRun:  c.Bool("dry-run"),
+	}
+
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+	var todo []*tpr.Package
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		for _, archive := range []*fission.Archive{&pkg.Spec.Source, &pkg.Spec.Deployment, pkg.Spec.SBOM, pkg.Spec.Attestation} {
+			if m.needsMigration(archive) {
+				todo = append(todo, pkg)
+				break
+			}
+		}
+	}
+	if len(todo) == 0 {
+		fmt.Printf("no packages have archives on %v\n", from)
+		return nil
+	}
+
+	var (
+		mu       sync.Mutex
+		finished int
+		failed   int
+	)
+	report := func(pkg *tpr.Package, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		finished++
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(os.Stderr, "[%v/%v] package %v failed: %v\n", finished, len(todo), pkg.Metadata.Name, err)
+		case m.dryRun:
+			fmt.Printf("[%v/%v] would migrate package %v\n", finished, len(todo), pkg.Metadata.Name)
+		default:
+			fmt.Printf("[%v/%v] migrated package %v\n", finished, len(todo), pkg.Metadata.Name)
+		}
+	}
+
+	work := make(chan *tpr.Package)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range work {
+				report(pkg, m.migratePackage(client, pkg))
+			}
+		}()
+	}
+	for _, pkg := range todo {
+		work <- pkg
+	}
+	close(work)
+	wg.Wait()
+
+	if m.dryRun {
+		fmt.Printf("%v packages would be migrated from %v to %v\n", len(todo), from, to)
+		return nil
+	}
+	if failed == 0 {
+		fmt.Printf("migrated %v packages from %v to %v\n", len(todo), from, to)
+		return nil
+	}
+	msg := fmt.Sprintf("%v of %v packages were not migrated", failed, len(todo))
+	if failed == len(todo) {
+		fatal(msg)
+	}
+	fatalWithCode(exitCodePartialFailure, msg)
+	return nil
+}
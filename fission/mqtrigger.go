@@ -19,7 +19,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"text/tabwriter"
 
 	"github.com/satori/go.uuid"
 	"github.com/urfave/cli"
@@ -39,7 +38,7 @@ func mqtCreate(c *cli.Context) error {
 	}
 	fnName := c.String("function")
 	if len(fnName) == 0 {
-		fatal("Need a function name to create a trigger, use --function")
+		fatalUsage("Need a function name to create a trigger, use --function")
 	}
 
 	mqType := c.String("mqtype")
@@ -75,7 +74,7 @@ func mqtCreate(c *cli.Context) error {
 	mqt := tpr.Messagequeuetrigger{
 		Metadata: metav1.ObjectMeta{
 			Name:      mqtName,
-			Namespace: metav1.NamespaceDefault,
+			Namespace: packageNamespace,
 		},
 		Spec: fission.MessageQueueTriggerSpec{
 			FunctionReference: fission.FunctionReference{
@@ -104,7 +103,7 @@ func mqtUpdate(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 	mqtName := c.String("name")
 	if len(mqtName) == 0 {
-		fatal("Need name of trigger, use --name")
+		fatalUsage("Need name of trigger, use --name")
 	}
 	topic := c.String("topic")
 	respTopic := c.String("resptopic")
@@ -113,7 +112,7 @@ func mqtUpdate(c *cli.Context) error {
 
 	mqt, err := client.MessageQueueTriggerGet(&metav1.ObjectMeta{
 		Name:      mqtName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, "get Time trigger")
 
@@ -138,7 +137,7 @@ func mqtUpdate(c *cli.Context) error {
 	}
 
 	if !updated {
-		fatal("Nothing to update. Use --topic, --resptopic, or --function.")
+		fatalUsage("Nothing to update. Use --topic, --resptopic, or --function.")
 	}
 
 	_, err = client.MessageQueueTriggerUpdate(mqt)
@@ -152,12 +151,12 @@ func mqtDelete(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 	mqtName := c.String("name")
 	if len(mqtName) == 0 {
-		fatal("Need name of trigger to delete, use --name")
+		fatalUsage("Need name of trigger to delete, use --name")
 	}
 
 	err := client.MessageQueueTriggerDelete(&metav1.ObjectMeta{
 		Name:      mqtName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, "delete trigger")
 
@@ -168,20 +167,17 @@ func mqtDelete(c *cli.Context) error {
 func mqtList(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 
+	output := c.String("output")
+	checkOutputFormat(output)
+
 	mqts, err := client.MessageQueueTriggerList(c.String("mqtype"))
 	checkErr(err, "list message queue triggers")
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-
-	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
-		"NAME", "FUNCTION_NAME", "MESSAGE_QUEUE_TYPE", "TOPIC", "RESPONSE_TOPIC", "PUB_MSG_CONTENT_TYPE")
+	t := newTable("NAME", "FUNCTION_NAME", "MESSAGE_QUEUE_TYPE", "TOPIC", "RESPONSE_TOPIC", "PUB_MSG_CONTENT_TYPE")
 	for _, mqt := range mqts {
-		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
-			mqt.Metadata.Name, mqt.Spec.FunctionReference.Name, mqt.Spec.MessageQueueType, mqt.Spec.Topic, mqt.Spec.ResponseTopic, mqt.Spec.ContentType)
+		t.addRow(mqt.Metadata.Name, mqt.Spec.FunctionReference.Name, mqt.Spec.MessageQueueType, mqt.Spec.Topic, mqt.Spec.ResponseTopic, mqt.Spec.ContentType)
 	}
-	w.Flush()
-
-	return nil
+	return t.print(os.Stdout, output)
 }
 
 func checkMQTopicAvailability(mqType string, topics ...string) {
@@ -0,0 +1,209 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// Package names made from a label look like <env>-<label>-<hash>,
+// where hash identifies the package contents. They are stable across
+// runs with the same contents, which suits CI, unlike random names.
+
+const (
+	// maxNameLength is the Kubernetes limit on resource names.
+	maxNameLength = 63
+
+	contentHashLength = 12
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// sanitizeName lowercases s and replaces characters that aren't
+// allowed in resource names with dashes.
+func sanitizeName(s string) string {
+	s = invalidNameChars.ReplaceAllString(strings.ToLower(s), "-")
+	return strings.Trim(s, "-")
+}
+
+func hashArchive(h func(...string), archive *fission.Archive) {
+	if len(archive.Literal) > 0 {
+		sum := sha256.Sum256(archive.Literal)
+		h("literal", hex.EncodeToString(sum[:]))
+		if len(archive.Packing) > 0 {
+			h("packing", string(archive.Packing))
+		}
+		return
+	}
+	h(string(archive.Type), string(archive.Checksum.Type), archive.Checksum.HexSum(), string(archive.Compression))
+	if len(archive.Structure) > 0 {
+		h("structure", archive.Structure)
+	}
+}
+
+// packageContentHash hashes what a package builds and runs: its
+// environment, build command, hooks, env and mounts and archive contents, and
+// any SBOM or attestation supplied with it, but not storage URLs,
+// which differ between uploads of the same bytes.
+func packageContentHash(spec *fission.PackageSpec) string {
+	hasher := sha256.New()
+	h := func(fields ...string) {
+		for _, f := range fields {
+			fmt.Fprintf(hasher, "%v\x00", f)
+		}
+	}
+	h(spec.Environment.Namespace, spec.Environment.Name, spec.BuildCommand)
+	for _, v := range spec.BuildEnv {
+		h(v.Name, v.Value)
+		if v.SecretRef != nil {
+			h(v.SecretRef.Name, v.SecretRef.Key)
+		}
+	}
+	if len(spec.PreBuildCommands) > 0 || len(spec.PostBuildCommands) > 0 {
+		h("hooks")
+		h(spec.PreBuildCommands...)
+		h("post")
+		h(spec.PostBuildCommands...)
+	}
+	if len(spec.BuildSecrets) > 0 || len(spec.BuildConfigMaps) > 0 {
+		h("mounts")
+		h(spec.BuildSecrets...)
+		h("configmaps")
+		h(spec.BuildConfigMaps...)
+	}
+	hashArchive(h, &spec.Source)
+	hashArchive(h, &spec.Deployment)
+	if spec.AliasOf != nil {
+		h("alias", spec.AliasOf.Namespace, spec.AliasOf.Name)
+	}
+	if spec.SBOM != nil {
+		h("sbom")
+		hashArchive(h, spec.SBOM)
+	}
+	if spec.Attestation != nil {
+		h("attestation")
+		hashArchive(h, spec.Attestation)
+	}
+	if len(spec.BuilderImage) > 0 {
+		h("builder", spec.BuilderImage)
+	}
+	if len(spec.DeploymentPolicy) > 0 {
+		h("deployment policy", string(spec.DeploymentPolicy))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// labeledPackageName returns the package name for a label.
+func labeledPackageName(label string, spec *fission.PackageSpec) string {
+	hash := packageContentHash(spec)[:contentHashLength]
+	prefix := sanitizeName(spec.Environment.Name) + "-" + sanitizeName(label)
+	if max := maxNameLength - contentHashLength - 1; len(prefix) > max {
+		prefix = strings.TrimRight(prefix[:max], "-")
+	}
+	return prefix + "-" + hash
+}
+
+// saveNewPackage creates a package with a name made from opts.label,
+// or a random name if there's no label. If a package with the
+// labeled name exists, it is reused when its contents are identical,
+// and is an error otherwise.
+func saveNewPackage(client *client.Client, pkgSpec *fission.PackageSpec, pkgStatus fission.BuildStatus, opts archiveOptions) (*metav1.ObjectMeta, error) {
+	if len(opts.label) == 0 {
+		return savePackage(client, strings.ToLower(uuid.NewV4().String()), pkgSpec, pkgStatus, opts.annotations)
+	}
+
+	m := &metav1.ObjectMeta{
+		Name:      labeledPackageName(opts.label, pkgSpec),
+		Namespace: packageNamespace,
+	}
+	existing, err := client.PackageGet(m)
+	if err != nil {
+		if fe, ok := err.(fission.Error); !ok || fe.Code != fission.ErrorNotFound {
+			return nil, fmt.Errorf("check for package %v: %w", m.Name, err)
+		}
+		return savePackage(client, m.Name, pkgSpec, pkgStatus, opts.annotations)
+	}
+
+	if packageContentHash(&existing.Spec) != packageContentHash(pkgSpec) {
+		return nil, fission.MakeError(fission.ErrorNameExists,
+			fmt.Sprintf("package %v already exists with different contents", m.Name))
+	}
+	fmt.Fprintf(os.Stderr, "Package %v already exists with the same contents, reusing it\n", m.Name)
+	return &existing.Metadata, nil
+}
+
+// conditionalPackageResult says what saveNamedPackage did.
+type conditionalPackageResult string
+
+const (
+	packageCreated  conditionalPackageResult = "created"
+	packageExisted  conditionalPackageResult = "unchanged"
+	packageReplaced conditionalPackageResult = "replaced"
+)
+
+// saveNamedPackage creates a package with the given name unless one
+// exists with identical contents, in which case that one is kept. A
+// package with different contents is an ErrorNameExists error, unless
+// replace is set; it is then updated to the new contents, and the
+// functions using it are pointed at the update.
+func saveNamedPackage(client *client.Client, pkgName string, pkgSpec *fission.PackageSpec, pkgStatus fission.BuildStatus, annotations map[string]string, replace bool) (*metav1.ObjectMeta, conditionalPackageResult, error) {
+	m := &metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace}
+	existing, err := client.PackageGet(m)
+	if err != nil {
+		if fe, ok := err.(fission.Error); !ok || fe.Code != fission.ErrorNotFound {
+			return nil, "", fmt.Errorf("check for package %v: %w", m.Name, err)
+		}
+		m, err = savePackage(client, pkgName, pkgSpec, pkgStatus, annotations)
+		return m, packageCreated, err
+	}
+
+	if packageContentHash(&existing.Spec) == packageContentHash(pkgSpec) {
+		return &existing.Metadata, packageExisted, nil
+	}
+	if !replace {
+		return nil, "", fission.MakeError(fission.ErrorNameExists,
+			fmt.Sprintf("package %v already exists with different contents", m.Name))
+	}
+	existing.Spec = *pkgSpec
+	existing.Status = fission.PackageStatus{BuildStatus: pkgStatus}
+	for k, v := range annotations {
+		if existing.Metadata.Annotations == nil {
+			existing.Metadata.Annotations = make(map[string]string)
+		}
+		existing.Metadata.Annotations[k] = v
+	}
+	m, err = client.PackageUpdate(existing)
+	if err != nil {
+		return nil, "", fmt.Errorf("replace package %v: %w", pkgName, err)
+	}
+	err = updatePackageFunctions(client, m)
+	if err != nil {
+		return nil, "", err
+	}
+	return m, packageReplaced, nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/fission/fission"
+)
+
+func TestPackageContentHashStructure(t *testing.T) {
+	spec := fission.PackageSpec{
+		Environment: fission.EnvironmentReference{Namespace: "default", Name: "nodejs"},
+		Deployment: fission.Archive{
+			Type:     fission.ArchiveTypeUrl,
+			Checksum: fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: strings.Repeat("ab", 32)},
+		},
+	}
+
+	// packages without a structure fingerprint keep the names they
+	// had before it was recorded
+	const unchanged = "29fd38717ffe63e2dc9ddc4c0ec3b748a166ac13fa9da74ab71025f6a12fbef6"
+	if hash := packageContentHash(&spec); hash != unchanged {
+		log.Panicf("Expected a package without a structure to hash to %v, got %v", unchanged, hash)
+	}
+
+	spec.Deployment.Structure = strings.Repeat("cd", 32)
+	structured := packageContentHash(&spec)
+	if structured == unchanged {
+		log.Panicf("Expected the structure to change the content hash")
+	}
+	if hash := packageContentHash(&spec); hash != structured {
+		log.Panicf("Expected the same structure to hash to %v, got %v", structured, hash)
+	}
+	spec.Deployment.Structure = strings.Repeat("ef", 32)
+	if packageContentHash(&spec) == structured {
+		log.Panicf("Expected another structure to change the content hash")
+	}
+}
@@ -0,0 +1,950 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/satori/go.uuid"
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/packager"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+	"github.com/fission/fission/tpr"
+)
+
+// parseAge parses durations such as "36h" or "7d". In addition to the
+// units understood by time.ParseDuration, "d" means 24 hours.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// storageIdFromUrl returns the storage service ID of an archive URL
+// generated by the storage service client, and false if the URL
+// doesn't point at the storage service.
+func storageIdFromUrl(archiveUrl string) (string, bool) {
+	u, err := url.Parse(archiveUrl)
+	if err != nil || !strings.HasSuffix(u.Path, "/v1/archive") {
+		return "", false
+	}
+	id := u.Query().Get("id")
+	return id, len(id) > 0
+}
+
+// archiveUrls returns the URLs an archive's contents are stored at:
+// its parts if it was split, otherwise its URL.
+func archiveUrls(archive *fission.Archive) []string {
+	if len(archive.Parts) > 0 {
+		return archive.Parts
+	}
+	if len(archive.URL) > 0 {
+		return []string{archive.URL}
+	}
+	return nil
+}
+
+// isArchiveShared returns true if a package other than pkg refers to
+// the archive URL, as packages made from identical content can.
+func isArchiveShared(archiveUrl string, pkg *tpr.Package, pkgs []tpr.Package) bool {
+	for i := range pkgs {
+		other := &pkgs[i]
+		if other.Metadata.Name == pkg.Metadata.Name && other.Metadata.Namespace == pkg.Metadata.Namespace {
+			continue
+		}
+		for _, archive := range []*fission.Archive{&other.Spec.Source, &other.Spec.Deployment} {
+			for _, u := range archiveUrls(archive) {
+				if u == archiveUrl {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isPackageReferenced returns true if any function uses the package.
+func isPackageReferenced(pkg *tpr.Package, fns []tpr.Function) bool {
+	return packageFunctionCount(pkg, fns) > 0
+}
+
+// packageFunctionCount returns the number of functions using the
+// package.
+func packageFunctionCount(pkg *tpr.Package, fns []tpr.Function) int {
+	var count int
+	for _, fn := range fns {
+		ref := fn.Spec.Package.PackageRef
+		if ref.Name == pkg.Metadata.Name && ref.Namespace == pkg.Metadata.Namespace {
+			count++
+		}
+	}
+	return count
+}
+
+func pkgPrune(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	if !c.Bool("failed") {
+		fatalUsage("Need --failed, only failed packages can be pruned.")
+	}
+
+	var olderThan time.Duration
+	if len(c.String("older-than")) > 0 {
+		var err error
+		olderThan, err = parseAge(c.String("older-than"))
+		checkErr(err, "parse --older-than")
+	}
+	dryRun := c.Bool("dry-run")
+
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+
+	fns, err := client.FunctionList()
+	checkErr(err, "list functions")
+
+	ssClient := getStorageClient(client)
+
+	var pkgCount, archiveCount int
+	var reclaimed int64
+
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		if pkg.Status.BuildStatus != fission.BuildStatusFailed {
+			continue
+		}
+		if time.Since(pkg.Metadata.CreationTimestamp.Time) < olderThan {
+			continue
+		}
+		if isPackageReferenced(pkg, fns) {
+			fmt.Fprintf(os.Stderr, "Skipping package '%v', it is used by a function\n", pkg.Metadata.Name)
+			continue
+		}
+
+		for _, archive := range []fission.Archive{pkg.Spec.Source, pkg.Spec.Deployment} {
+			if archive.Type == fission.ArchiveTypeLiteral {
+				reclaimed += int64(len(archive.Literal))
+				continue
+			}
+			for _, u := range archiveUrls(&archive) {
+				id, ok := storageIdFromUrl(u)
+				if !ok {
+					continue
+				}
+				if isArchiveShared(u, pkg, pkgs) {
+					fmt.Fprintf(os.Stderr, "Keeping archive '%v', it is used by another package\n", id)
+					continue
+				}
+				size, err := ssClient.Size(id)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to get size of archive '%v': %v\n", id, err)
+					size = 0
+				}
+				if !dryRun {
+					err = ssClient.Delete(id)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to delete archive '%v': %v\n", id, err)
+						continue
+					}
+				}
+				archiveCount++
+				reclaimed += size
+			}
+		}
+
+		pkgCount++
+		if dryRun {
+			fmt.Printf("package '%v' would be deleted\n", pkg.Metadata.Name)
+			continue
+		}
+		err = client.PackageDelete(&pkg.Metadata)
+		checkErr(err, fmt.Sprintf("delete package '%v'", pkg.Metadata.Name))
+		fmt.Printf("package '%v' deleted\n", pkg.Metadata.Name)
+	}
+
+	if dryRun {
+		fmt.Printf("Would delete %v packages and %v archives, reclaiming %v bytes\n", pkgCount, archiveCount, reclaimed)
+	} else {
+		fmt.Printf("Deleted %v packages and %v archives, reclaimed %v bytes\n", pkgCount, archiveCount, reclaimed)
+	}
+	return nil
+}
+
+// shortChecksum abbreviates an archive's checksum for display.
+func shortChecksum(archive *fission.Archive) string {
+	if archive.Type == fission.ArchiveTypeLiteral {
+		sum := sha256.Sum256(archive.Literal)
+		return hex.EncodeToString(sum[:6])
+	}
+	sum := archive.Checksum.HexSum()
+	if len(sum) > 12 {
+		sum = sum[:12]
+	}
+	return sum
+}
+
+// shortStructure abbreviates the structure fingerprint of a package's
+// source archive, or of its deployment archive if the source has
+// none, so packages with the same checksums but another layout stand
+// out in its history.
+func shortStructure(spec *fission.PackageSpec) string {
+	structure := spec.Source.Structure
+	if len(structure) == 0 {
+		structure = spec.Deployment.Structure
+	}
+	if len(structure) > 12 {
+		structure = structure[:12]
+	}
+	return structure
+}
+
+func pkgTouch(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	if len(pkgName) == 0 {
+		fatalUsage("Need name of package, use --name")
+	}
+
+	m := &metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace}
+	pkg, err := client.PackageGet(m)
+	checkErr(err, fmt.Sprintf("read package '%v'", pkgName))
+	if pkg.Status.BuildStatus != fission.BuildStatusPending {
+		fmt.Fprintf(os.Stderr, "Warning: package '%v' is %v; only pending packages are built\n",
+			pkgName, pkg.Status.BuildStatus)
+	}
+
+	_, err = client.PackageTouch(m)
+	checkErr(err, fmt.Sprintf("touch package '%v'", pkgName))
+	fmt.Printf("package '%v' touched\n", pkgName)
+	return nil
+}
+
+// pkgCancelBuild stops a package's build, e.g. one stuck or no longer
+// needed. The package's status becomes canceled, not failed.
+func pkgCancelBuild(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	if len(pkgName) == 0 {
+		fatalUsage("Need name of package, use --name")
+	}
+
+	m := &metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace}
+	err := client.PackageCancelBuild(m)
+	checkErr(err, fmt.Sprintf("cancel build of package '%v'", pkgName))
+	fmt.Printf("build of package '%v' canceled\n", pkgName)
+	return nil
+}
+
+// pkgUnlock lifts the immutability of a package made with
+// --immutable, after confirmation: interactively, or with --yes.
+func pkgUnlock(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	if len(pkgName) == 0 {
+		fatalUsage("Need name of package, use --name")
+	}
+
+	m := &metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace}
+	pkg, err := client.PackageGet(m)
+	checkErr(err, fmt.Sprintf("read package '%v'", pkgName))
+	if !fission.PackageImmutable(pkg.Metadata.Annotations) {
+		fmt.Printf("package '%v' isn't immutable\n", pkgName)
+		return nil
+	}
+
+	if !c.Bool("yes") {
+		fi, err := os.Stdin.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			fatal(fmt.Sprintf("Unlocking package '%v' needs confirmation; use --yes when not running interactively.", pkgName))
+		}
+		if !confirm(fmt.Sprintf("Package '%v' is immutable, e.g. as a released artifact. Unlock it so it can be changed?", pkgName)) {
+			checkErr(errAborted, fmt.Sprintf("unlock package '%v'", pkgName))
+		}
+	}
+
+	delete(pkg.Metadata.Annotations, fission.PackageImmutableAnnotation)
+	_, err = client.PackageUpdate(pkg)
+	checkErr(err, fmt.Sprintf("unlock package '%v'", pkgName))
+	fmt.Printf("package '%v' unlocked\n", pkgName)
+	return nil
+}
+
+// pkgRetag sets the tag of a package, its human-facing name, keeping
+// the package and the functions using it as they are. No other
+// package in the namespace may have the tag.
+func pkgRetag(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	if len(pkgName) == 0 {
+		fatalUsage("Need name of package, use --name")
+	}
+	tag := c.String("tag")
+	if len(tag) == 0 {
+		fatalUsage("Need the new tag, use --tag")
+	}
+	if errs := validation.IsValidLabelValue(tag); len(errs) > 0 {
+		fatal(fmt.Sprintf("Invalid --tag '%v': %v", tag, strings.Join(errs, "; ")))
+	}
+
+	pkg, err := client.PackageGet(&metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace})
+	checkErr(err, fmt.Sprintf("read package '%v'", pkgName))
+	old := pkg.Metadata.Labels[fission.PackageTagLabel]
+	if old == tag {
+		fmt.Printf("package '%v' is already tagged '%v'\n", pkgName, tag)
+		return nil
+	}
+
+	checkTagFree(client, tag, pkgName)
+
+	if pkg.Metadata.Labels == nil {
+		pkg.Metadata.Labels = make(map[string]string)
+	}
+	pkg.Metadata.Labels[fission.PackageTagLabel] = tag
+	_, err = client.PackageUpdate(pkg)
+	checkErr(err, fmt.Sprintf("retag package '%v'", pkgName))
+	if len(old) == 0 {
+		old = "(none)"
+	}
+	fmt.Printf("package '%v' retagged: %v -> %v\n", pkgName, old, tag)
+	return nil
+}
+
+// pkgCreate creates a package. With --if-not-exists, an existing
+// package of the same name is kept if its contents are identical,
+// exiting 0, and is a conflict otherwise, exiting with
+// exitCodeConflict, unless --replace is given. With --field-manager,
+// the package is applied instead: created, updated or left alone as
+// needed, with applying a package of another manager a conflict
+// unless --replace is given.
+func pkgCreate(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	opts := getArchiveOptions(c)
+
+	// flags not given default to the project's .fissionrc
+	envName, srcArchiveName, buildcmd := projectDefaults(c, c.String("env"), c.String("src"), c.String("buildcmd"), &opts)
+	if len(envName) == 0 {
+		fatalUsage("Need --env argument, or env in a " + projectConfigName + ".")
+	}
+	deployArchiveName := c.String("deploy")
+	if len(srcArchiveName) == 0 && len(deployArchiveName) == 0 && len(c.String("from-image")) == 0 && len(c.String("stdin-name")) == 0 {
+		fatalUsage("Need --deploy to specify deployment archive, --src to specify source archive, --from-image to archive files of an image, or --stdin-name to read one from stdin.")
+	}
+
+	pkgName := c.String("name")
+	ifNotExists := c.Bool("if-not-exists")
+	replace := c.Bool("replace")
+	fieldManager := c.String("field-manager")
+	if (ifNotExists || replace || len(fieldManager) > 0) && len(pkgName) == 0 {
+		fatalUsage("--if-not-exists, --replace and --field-manager need --name, the package to check for.")
+	}
+	if ifNotExists && len(fieldManager) > 0 {
+		fatalUsage("--if-not-exists and --field-manager can't be used together.")
+	}
+	if len(pkgName) > 0 && len(opts.label) > 0 {
+		fatalUsage("--name and --label can't be used together.")
+	}
+	opts.packageName = pkgName
+
+	if c.Bool("explain") {
+		explainPackageCreate(c, client, envName, srcArchiveName, deployArchiveName, buildcmd, opts)
+		return nil
+	}
+
+	opts.annotations = packageGitMetadata(srcArchiveName, deployArchiveName, opts)
+	if c.Bool("immutable") {
+		if opts.annotations == nil {
+			opts.annotations = make(map[string]string)
+		}
+		opts.annotations[fission.PackageImmutableAnnotation] = "true"
+	}
+	pkgSpec, pkgStatus, err := makePackageSpec(client, envName, srcArchiveName, deployArchiveName, buildcmd, opts)
+	checkErr(err, "create package")
+
+	if len(fieldManager) > 0 {
+		applyNamedPackage(client, pkgName, pkgSpec, pkgStatus, opts.annotations, fieldManager, replace)
+		return nil
+	}
+
+	if !ifNotExists && !replace {
+		var m *metav1.ObjectMeta
+		if len(pkgName) > 0 {
+			m, err = savePackage(client, pkgName, pkgSpec, pkgStatus, opts.annotations)
+		} else {
+			m, err = saveNewPackage(client, pkgSpec, pkgStatus, opts)
+		}
+		checkErr(err, "create package")
+		fmt.Printf("package '%v' created\n", m.Name)
+		return nil
+	}
+
+	m, result, err := saveNamedPackage(client, pkgName, pkgSpec, pkgStatus, opts.annotations, replace)
+	if fe, ok := err.(fission.Error); ok && fe.Code == fission.ErrorNameExists {
+		fatalWithCode(exitCodeConflict, fmt.Sprintf("Package '%v' already exists with different contents; use --replace to update it.", pkgName))
+	}
+	checkErr(err, "create package")
+	switch result {
+	case packageExisted:
+		fmt.Printf("package '%v' already exists with the same contents\n", m.Name)
+	case packageReplaced:
+		fmt.Printf("package '%v' replaced\n", m.Name)
+	default:
+		fmt.Printf("package '%v' created\n", m.Name)
+	}
+	return nil
+}
+
+// applyNamedPackage applies a package for pkgCreate, pointing the
+// functions using it at the update if it changed.
+func applyNamedPackage(client *client.Client, pkgName string, pkgSpec *fission.PackageSpec, pkgStatus fission.BuildStatus, annotations map[string]string, fieldManager string, force bool) {
+	pkg := &tpr.Package{
+		Metadata: metav1.ObjectMeta{
+			Name:        pkgName,
+			Namespace:   packageNamespace,
+			Annotations: annotations,
+		},
+		Spec: *pkgSpec,
+		Status: fission.PackageStatus{
+			BuildStatus: pkgStatus,
+		},
+	}
+	result, err := client.PackageApply(pkg, fieldManager, force)
+	if fe, ok := err.(fission.Error); ok && fe.Code == fission.ErrorNameExists {
+		fatalWithCode(exitCodeConflict, fmt.Sprintf("%v; use --replace to take it over.", fe.Message))
+	}
+	checkErr(err, "apply package")
+
+	if result.Outcome == fission.PackageApplyUpdated {
+		err = updatePackageFunctions(client, result.Metadata)
+		checkErr(err, "update functions of package")
+	}
+	fmt.Printf("package '%v' %v\n", result.Metadata.Name, result.Outcome)
+}
+
+func pkgHistory(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	envName := c.String("env")
+	if len(envName) == 0 {
+		fatalUsage("Need --env argument.")
+	}
+	output := c.String("output")
+	checkOutputFormat(output)
+
+	pkgs, err := client.PackageHistory(&metav1.ObjectMeta{
+		Name:      envName,
+		Namespace: packageNamespace,
+	}, c.Int("limit"))
+	checkErr(err, "list packages")
+
+	fns, err := client.FunctionList()
+	checkErr(err, "list functions")
+
+	t := newTable("NAME", "AGE", "STATUS", "FUNCTIONS", "SOURCE", "DEPLOYMENT", "LAYOUT", "LABELS")
+	t.colorBuildStatus("STATUS")
+	for i := range pkgs {
+		pkg := &pkgs[i]
+
+		var labels []string
+		for k, v := range pkg.Metadata.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+
+		age := time.Since(pkg.Metadata.CreationTimestamp.Time).Round(time.Second)
+		t.addRow(pkg.Metadata.Name, age, pkg.Status.BuildStatus, packageFunctionCount(pkg, fns),
+			shortChecksum(&pkg.Spec.Source), shortChecksum(&pkg.Spec.Deployment),
+			shortStructure(&pkg.Spec), strings.Join(labels, ","))
+	}
+	return t.print(os.Stdout, output)
+}
+
+// downloadArchive saves the contents of a URL archive to filePath,
+// concatenating the parts of a split archive, going through the
+// storage service proxy when the archive is stored there, and
+// verifies its checksum.
+func downloadArchive(client *client.Client, archive *fission.Archive, filePath string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, u := range archiveUrls(archive) {
+		err = downloadArchiveUrl(client, u, f)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	if len(archive.Checksum.Sum) == 0 {
+		return nil
+	}
+	if archive.Checksum.Type != fission.ChecksumTypeSHA256 {
+		return fmt.Errorf("%w: unsupported checksum type '%v'", fission.ErrInvalidChecksum, archive.Checksum.Type)
+	}
+	sum, err := fileChecksum(filePath)
+	if err != nil {
+		return err
+	}
+	if sum != archive.Checksum.Sum {
+		return fission.MakeError(fission.ErrorChecksumFail, "Checksum validation failed")
+	}
+	return nil
+}
+
+// downloadArchiveUrl appends the contents at an archive URL to w.
+func downloadArchiveUrl(client *client.Client, archiveUrl string, w io.Writer) error {
+	if id, ok := storageIdFromUrl(archiveUrl); ok {
+		return getStorageClient(client).DownloadTo(id, w)
+	}
+
+	resp, err := getRemoteClient().Get(archiveUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("HTTP error %v: %w", resp.StatusCode, fission.ErrArchiveNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("HTTP error %v", resp.StatusCode))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// downloadArchiveUrlFrom appends the contents at an archive URL from
+// offset on to w, resuming an interrupted download.
+func downloadArchiveUrlFrom(client *client.Client, archiveUrl string, offset int64, w io.Writer) error {
+	if offset == 0 {
+		return downloadArchiveUrl(client, archiveUrl, w)
+	}
+	if id, ok := storageIdFromUrl(archiveUrl); ok {
+		return getStorageClient(client).DownloadFrom(id, offset, w)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, archiveUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	resp, err := getRemoteClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return storageSvcClient.ReadRange(resp, offset, w)
+}
+
+func pkgFetch(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	if len(pkgName) == 0 {
+		fatalUsage("Need name of package, use --name")
+	}
+
+	dest := c.String("dest")
+	if len(dest) == 0 {
+		fatalUsage("Need destination directory, use --dest")
+	}
+
+	if entries, err := ioutil.ReadDir(dest); err == nil && len(entries) > 0 && !c.Bool("force") {
+		fatal(fmt.Sprintf("Destination %v is not empty, use --force to overwrite its contents", dest))
+	}
+
+	pkg, err := client.PackageGet(&metav1.ObjectMeta{
+		Name:      pkgName,
+		Namespace: packageNamespace,
+	})
+	checkErr(err, fmt.Sprintf("read package '%v'", pkgName))
+
+	archive := &pkg.Spec.Source
+	if c.Bool("deployment") || (len(archive.Literal) == 0 && len(archiveUrls(archive)) == 0) {
+		archive = pkg.Spec.DeploymentArchive()
+	}
+	if len(archive.Literal) == 0 && len(archiveUrls(archive)) == 0 {
+		fatal(fmt.Sprintf("Package '%v' has no archive to fetch", pkgName))
+	}
+
+	tmpfile, err := ioutil.TempFile(stagingDir(), "fission-fetch-")
+	checkErr(err, "create temporary file")
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	if len(archive.Literal) > 0 {
+		err = fission.VerifyLiteral(archive)
+		checkErr(err, "verify archive")
+		err = ioutil.WriteFile(tmpfile.Name(), archive.Literal, 0600)
+		checkErr(err, "write archive")
+	} else {
+		os.Remove(tmpfile.Name())
+		err = downloadArchive(client, archive, tmpfile.Name())
+		checkErr(err, "download archive")
+		err = decompressFile(tmpfile.Name(), archive.Compression)
+		checkErr(err, "decompress archive")
+	}
+
+	err = os.MkdirAll(dest, 0755)
+	checkErr(err, fmt.Sprintf("create directory %v", dest))
+
+	if archive.Packing == fission.ArchivePackingTar {
+		err = fission.UnpackFiles(archive.Literal, dest)
+		checkErr(err, fmt.Sprintf("unpack archive into %v", dest))
+	} else if isZip(tmpfile.Name()) {
+		err = unpackZip(tmpfile.Name(), dest)
+		checkErr(err, fmt.Sprintf("unpack archive into %v", dest))
+	} else {
+		// a single file archive has no name of its own, so
+		// name it after the package
+		contents, err := ioutil.ReadFile(tmpfile.Name())
+		checkErr(err, "read archive")
+		err = ioutil.WriteFile(filepath.Join(dest, pkgName), contents, 0644)
+		checkErr(err, fmt.Sprintf("write archive into %v", dest))
+	}
+
+	fmt.Printf("package '%v' fetched into %v\n", pkgName, dest)
+	return nil
+}
+
+// watchDebounce is how long package watch waits for file changes to
+// settle before rebuilding.
+const watchDebounce = 500 * time.Millisecond
+
+// waitForBuild waits for a package's build to finish and returns its
+// final status. If follow is set, status changes and build log lines
+// are printed as they arrive, with the build's progress below them.
+// Interrupting the wait offers to cancel
+// the build too, and returns an error matching context.Canceled.
+func waitForBuild(client *client.Client, m *metav1.ObjectMeta, follow bool) (*fission.PackageStatus, error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	printer := newBuildPrinter(follow)
+	status, err := packager.WaitForBuild(ctx, client, m, printer.event)
+	printer.finish()
+	if errors.Is(err, context.Canceled) {
+		return nil, stoppedBuildWait(client, m)
+	}
+	return status, err
+}
+
+// buildExitCode returns the exit code for a package that didn't
+// build.
+func buildExitCode(status fission.BuildStatus) int {
+	if status == fission.BuildStatusFailed {
+		return exitCodeBuildFailed
+	}
+	return exitCodeError
+}
+
+// stoppedBuildWait handles an interrupted wait for a build: it asks
+// whether to cancel the build, which goes on otherwise, and returns
+// context.Canceled for the caller to exit with. Without a terminal to
+// ask on, the build is left running.
+func stoppedBuildWait(client *client.Client, m *metav1.ObjectMeta) error {
+	fmt.Println()
+	fi, err := os.Stdin.Stat()
+	interactive := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	if interactive && confirm(fmt.Sprintf("Stopped waiting; cancel the build of package '%v' too?", m.Name)) {
+		err := client.PackageCancelBuild(m)
+		if err != nil {
+			return fmt.Errorf("cancel build of package '%v': %w", m.Name, err)
+		}
+		fmt.Fprintf(os.Stderr, "Build of package '%v' canceled.\n", m.Name)
+		return context.Canceled
+	}
+	fmt.Fprintf(os.Stderr, "Stopped waiting; package '%v' is still building. Cancel it with 'fission package cancel-build %v'.\n", m.Name, m.Name)
+	return context.Canceled
+}
+
+// addWatches watches dir and all its subdirectories that aren't
+// ignored. fsnotify watches aren't recursive.
+func addWatches(watcher *fsnotify.Watcher, root string, dir string, ignore []string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && isIgnored(filepath.ToSlash(rel), ignore) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+func pkgWatch(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	envName := c.String("env")
+	if len(envName) == 0 {
+		fatalUsage("Need --env argument.")
+	}
+
+	dir := c.Args().First()
+	if len(dir) == 0 {
+		fatalUsage("Need a directory to watch.")
+	}
+	info, err := os.Stat(dir)
+	checkErr(err, fmt.Sprintf("stat %v", dir))
+	if !info.IsDir() {
+		fatal(fmt.Sprintf("%v is not a directory.", dir))
+	}
+
+	srcArchiveName, deployArchiveName := dir, ""
+	if c.Bool("deployment") {
+		srcArchiveName, deployArchiveName = "", dir
+	}
+	buildcmd := c.String("buildcmd")
+	wait := c.Bool("wait")
+	follow := c.Bool("follow")
+	if follow && !wait {
+		fatalUsage("--follow needs --wait.")
+	}
+
+	// don't block rebuilds on the large archive prompt
+	opts := getArchiveOptions(c)
+	opts.assumeYes = true
+	if c.Bool("full-resync") && !c.Bool("delta") {
+		fatalUsage("--full-resync needs --delta.")
+	}
+	var delta *deltaWatch
+	if c.Bool("delta") {
+		delta = newDeltaWatch(client, dir, c.Bool("full-resync"), &opts)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	checkErr(err, "create file watcher")
+	defer watcher.Close()
+
+	err = addWatches(watcher, dir, dir, opts.ignore)
+	checkErr(err, fmt.Sprintf("watch %v", dir))
+
+	// An interrupt stops watching at once, unless a rebuild is
+	// uploading, whose uploads the upload guard finishes or cancels
+	// first, or waiting for a build, which asks whether to cancel
+	// it; watch then stops when the rebuild returns.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	stop := make(chan struct{})
+	var waiting int32
+	stopWatching := func() {
+		watcher.Close()
+		fatalWithCode(exitCodeCancelled, "Stopped watching")
+	}
+	go func() {
+		<-sigs
+		close(stop)
+		if !uploads.stop() && atomic.LoadInt32(&waiting) == 0 {
+			stopWatching()
+		}
+	}()
+
+	var pkgMeta *metav1.ObjectMeta
+	var logged map[string]*fission.TransparencyEntry
+	rebuild := func() {
+		start := time.Now()
+
+		specOpts := opts
+		specOpts.updatesPackage = pkgMeta != nil
+		specOpts.loggedArchives = logged
+		var files map[string]string
+		if delta != nil {
+			var changes deltaChanges
+			changes, files, err = delta.changes()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Rebuild failed: %v\n", err)
+				return
+			}
+			if pkgMeta != nil && changes.empty() {
+				verbose("No files changed, package '%v' is up to date", pkgMeta.Name)
+				return
+			}
+			verbose("Files since the last upload: %v", changes)
+			specOpts.deltaBase = delta.manifest.base()
+		}
+
+		spec, status, err := makePackageSpec(client, envName, srcArchiveName, deployArchiveName, buildcmd, specOpts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Rebuild failed: %v\n", err)
+			return
+		}
+
+		action := "created"
+		if pkgMeta == nil {
+			pkgMeta, err = client.PackageCreate(&tpr.Package{
+				Metadata: metav1.ObjectMeta{
+					Name:      strings.ToLower(uuid.NewV4().String()),
+					Namespace: packageNamespace,
+				},
+				Spec:   *spec,
+				Status: fission.PackageStatus{BuildStatus: status},
+			})
+		} else {
+			action = "updated"
+			var pkg *tpr.Package
+			pkg, err = client.PackageGet(pkgMeta)
+			if err == nil {
+				pkg.Spec = *spec
+				pkg.Status = fission.PackageStatus{BuildStatus: status}
+				pkgMeta, err = client.PackageUpdate(pkg)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Rebuild failed: %v\n", err)
+			return
+		}
+		fmt.Printf("[%v] package '%v' %v in %v\n",
+			time.Now().Format("15:04:05"), pkgMeta.Name, action, time.Since(start))
+		logged = loggedArchives(spec)
+		if delta != nil {
+			archive := &spec.Source
+			if len(deployArchiveName) > 0 {
+				archive = &spec.Deployment
+			}
+			delta.uploaded(pkgMeta.Name, archive, files)
+		}
+
+		if wait && status == fission.BuildStatusPending {
+			atomic.StoreInt32(&waiting, 1)
+			status, err := waitForBuild(client, pkgMeta, follow)
+			atomic.StoreInt32(&waiting, 0)
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to get build status: %v\n", err)
+				return
+			}
+			if follow {
+				return
+			}
+			fmt.Printf("[%v] build %v\n", time.Now().Format("15:04:05"), status.BuildStatus)
+			if status.BuildStatus == fission.BuildStatusFailed {
+				fmt.Println(status.BuildLog)
+			}
+		}
+	}
+
+	rebuild()
+	fmt.Fprintf(os.Stderr, "Watching %v for changes, press Ctrl-C to stop\n", dir)
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, ev.Name)
+			if err != nil || isIgnored(filepath.ToSlash(rel), opts.ignore) {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					err = addWatches(watcher, dir, ev.Name, opts.ignore)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to watch %v: %v\n", ev.Name, err)
+					}
+				}
+			}
+			verbose("Change detected: %v", ev)
+			settled = time.After(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "Watch error: %v\n", err)
+		case <-settled:
+			settled = nil
+			select {
+			case <-stop:
+				stopWatching()
+			default:
+			}
+			rebuild()
+		case <-stop:
+			stopWatching()
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// presignAttempts is how many pre-signed URLs are tried for an
+// upload, a new one being requested each time one expires.
+const presignAttempts = 3
+
+// errPresignUnavailable means the controller doesn't issue pre-signed
+// upload URLs, so the archive should be uploaded through its proxy.
+var errPresignUnavailable = errors.New("pre-signed uploads unavailable")
+
+// uploadPresigned uploads a prepared archive to a pre-signed URL the
+// controller issues, straight to the storage service, and registers
+// it with the controller. Pre-signed archives are stored under their
+// content ID, with the same metadata as other uploads. If the controller can't
+// issue a URL, it returns errPresignUnavailable.
+func uploadPresigned(client *client.Client, ssClient *storageSvcClient.Client, p *preparedArchive, opts archiveOptions) (*storageSvcClient.UploadResult, error) {
+	if p.checksum.Type != fission.ChecksumTypeSHA256 {
+		return nil, errPresignUnavailable
+	}
+	fi, err := os.Stat(p.uploadName)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := uploadMetadata(p, opts)
+	var res *storageSvcClient.UploadResult
+	for attempt := 1; ; attempt++ {
+		presigned, err := client.StorageUploadUrl(packageNamespace, opts.uploadPrefix(), p.checksum, fi.Size())
+		if err != nil {
+			verbose("Controller didn't issue a pre-signed upload URL for %v: %v", p.srcName, err)
+			return nil, errPresignUnavailable
+		}
+		res, err = ssClient.UploadPresigned(presigned.URL, p.uploadName, &metadata)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, storageSvcClient.ErrPresignExpired) || attempt >= presignAttempts {
+			return nil, err
+		}
+		verbose("Pre-signed upload URL for %v expired, requesting another", p.srcName)
+	}
+	if !res.ServerChecksum.Equal(p.checksum) {
+		return nil, fmt.Errorf("%w: storage service stored %v as %v", fission.ErrInvalidChecksum, p.srcName, res.ServerChecksum.Sum)
+	}
+
+	registered, err := client.StorageRegisterUpload(res.ID, p.checksum)
+	if err != nil {
+		return nil, fmt.Errorf("register upload of %v: %w", p.srcName, err)
+	}
+	if registered.Size != fi.Size() {
+		return nil, fmt.Errorf("storage service holds %v bytes of %v, expected %v", registered.Size, p.srcName, fi.Size())
+	}
+	return res, nil
+}
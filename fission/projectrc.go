@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ghodss/yaml"
+	"github.com/urfave/cli"
+)
+
+// A project can keep the settings of "package create" in a
+// .fissionrc, a YAML (or JSON) file in the project's directory, so
+// that they needn't be given each time:
+//
+//	env: nodejs
+//	buildcmd: npm run build
+//	ignore: [node_modules, "*.log"]
+//	namespace: team-a
+//	src: .
+//
+// The file is searched for in the working directory, then in each
+// directory above it up to the root; the first one found is used, and
+// files further up are not merged with it. Explicit flags win over the
+// file, as does $FISSION_NAMESPACE for the namespace, and the file wins
+// over the user's config file and the built-in defaults. Without
+// --src or --deploy, the source archive is the file's src, relative to
+// the directory holding the file, or else that whole directory.
+
+// projectConfigName is the name of a project's config file.
+const projectConfigName = ".fissionrc"
+
+// projectConfig is a project's .fissionrc.
+type projectConfig struct {
+	Env       string   `json:"env,omitempty"`
+	BuildCmd  string   `json:"buildcmd,omitempty"`
+	Ignore    []string `json:"ignore,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Src       string   `json:"src,omitempty"`
+
+	// dir is the directory holding the file.
+	dir string
+}
+
+// findProjectConfig reads the .fissionrc nearest to dir, walking up
+// to the root. It returns nil if there is none.
+func findProjectConfig(dir string) (*projectConfig, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		fileName := filepath.Join(dir, projectConfigName)
+		contents, err := ioutil.ReadFile(fileName)
+		if err == nil {
+			var rc projectConfig
+			err = yaml.Unmarshal(contents, &rc)
+			if err != nil {
+				return nil, fmt.Errorf("parse %v: %v", fileName, err)
+			}
+			rc.dir = dir
+			verbose("Using project config %v", fileName)
+			return &rc, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("read %v: %v", fileName, err)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// srcArchive returns the source archive the project config names.
+func (rc *projectConfig) srcArchive() string {
+	if len(rc.Src) == 0 {
+		return rc.dir
+	}
+	if filepath.IsAbs(rc.Src) {
+		return rc.Src
+	}
+	return filepath.Join(rc.dir, rc.Src)
+}
+
+// projectDefaults fills the settings of "package create" that weren't
+// given as flags from the nearest .fissionrc: the environment, build
+// command and source archive, which are returned, and the ignore
+// patterns and namespace.
+func projectDefaults(c *cli.Context, envName, srcArchiveName, buildcmd string, opts *archiveOptions) (string, string, string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return envName, srcArchiveName, buildcmd
+	}
+	rc, err := findProjectConfig(wd)
+	checkErr(err, "read project config")
+	if rc == nil {
+		return envName, srcArchiveName, buildcmd
+	}
+
+	if !c.IsSet("env") && len(rc.Env) > 0 {
+		envName = rc.Env
+	}
+	if !c.IsSet("buildcmd") && len(rc.BuildCmd) > 0 {
+		buildcmd = rc.BuildCmd
+	}
+	if !c.IsSet("ignore") && len(rc.Ignore) > 0 {
+		opts.ignore = rc.Ignore
+	}
+	if !isGlobalFlagSet(c, "namespace", "FISSION_NAMESPACE") && len(rc.Namespace) > 0 {
+		packageNamespace = rc.Namespace
+	}
+	if !c.IsSet("src") && !c.IsSet("deploy") && !c.IsSet("from-image") && !c.IsSet("stdin-name") {
+		srcArchiveName = rc.srcArchive()
+	}
+	return envName, srcArchiveName, buildcmd
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+	"github.com/fission/fission/tpr"
+)
+
+// packageQuota limits the packages of a namespace, for shared
+// clusters. It is set in the config file and checked by the CLI
+// before a package is created, so that going over it fails with the
+// usage and the limit instead of an opaque admission error. Zero
+// fields don't limit anything.
+type packageQuota struct {
+	// MaxPackages is the most packages the namespace may hold.
+	MaxPackages int `json:"maxPackages,omitempty"`
+
+	// MaxTotalSize is the most bytes the archives of the
+	// namespace's packages may hold, counting archives shared by
+	// several packages once.
+	MaxTotalSize int64 `json:"maxTotalSize,omitempty"`
+}
+
+// quotaUsage is what the packages of a namespace use of its quota.
+type quotaUsage struct {
+	namespace string
+	pkgs      []tpr.Package
+	count     int
+	size      int64
+
+	// seen are the archive URLs already counted in size.
+	seen map[string]bool
+}
+
+// quotaExceededError is returned when creating a package would go
+// over the namespace's quota.
+type quotaExceededError struct {
+	namespace string
+	resource  string
+	usage     string
+	limit     string
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("package quota of namespace %v exceeded: %v would be %v, the limit is %v; "+
+		"delete or prune packages, raise packageQuota in the config file, or use --skip-quota",
+		e.namespace, e.resource, e.usage, e.limit)
+}
+
+// getQuotaUsage lists the packages of a namespace and, if quota
+// limits their size, measures their archives.
+func getQuotaUsage(client *client.Client, namespace string, quota packageQuota) (*quotaUsage, error) {
+	pkgs, err := client.PackageList()
+	if err != nil {
+		return nil, fmt.Errorf("list packages: %w", err)
+	}
+	usage := &quotaUsage{namespace: namespace, seen: make(map[string]bool)}
+	for i := range pkgs {
+		if pkgs[i].Metadata.Namespace == namespace {
+			usage.pkgs = append(usage.pkgs, pkgs[i])
+		}
+	}
+	usage.count = len(usage.pkgs)
+	if quota.MaxTotalSize == 0 {
+		return usage, nil
+	}
+
+	ssClient := getStorageClient(client)
+	for i := range usage.pkgs {
+		size, err := usage.specSize(ssClient, &usage.pkgs[i].Spec)
+		if err != nil {
+			return nil, err
+		}
+		usage.size += size
+	}
+	return usage, nil
+}
+
+// specSize returns the bytes of a package's archives not yet counted:
+// literals, and the stored size of each URL not seen before.
+func (u *quotaUsage) specSize(ssClient *storageSvcClient.Client, spec *fission.PackageSpec) (int64, error) {
+	var size int64
+	for _, archive := range []*fission.Archive{&spec.Source, &spec.Deployment} {
+		if archive.Type == fission.ArchiveTypeLiteral {
+			size += int64(len(archive.Literal))
+			continue
+		}
+		for _, archiveUrl := range archiveUrls(archive) {
+			if u.seen[archiveUrl] {
+				continue
+			}
+			u.seen[archiveUrl] = true
+			id, ok := storageIdFromUrl(archiveUrl)
+			if !ok {
+				// not on our storage service, so not ours
+				// to count
+				continue
+			}
+			n, err := ssClient.Size(id)
+			if err != nil {
+				return 0, fmt.Errorf("get size of archive %v for package quota: %w", id, err)
+			}
+			size += n
+		}
+	}
+	return size, nil
+}
+
+// checkCount fails if one more package would exceed the quota.
+func (u *quotaUsage) checkCount(quota packageQuota) error {
+	if quota.MaxPackages > 0 && u.count+1 > quota.MaxPackages {
+		return &quotaExceededError{
+			namespace: u.namespace,
+			resource:  "package count",
+			usage:     fmt.Sprintf("%v", u.count+1),
+			limit:     fmt.Sprintf("%v", quota.MaxPackages),
+		}
+	}
+	return nil
+}
+
+// checkSize fails if adding size bytes would exceed the quota.
+func (u *quotaUsage) checkSize(quota packageQuota, size int64) error {
+	if quota.MaxTotalSize > 0 && u.size+size > quota.MaxTotalSize {
+		return &quotaExceededError{
+			namespace: u.namespace,
+			resource:  "total archive size",
+			usage:     fmt.Sprintf("%v (%v used, %v new)", formatSize(u.size+size), formatSize(u.size), formatSize(size)),
+			limit:     formatSize(quota.MaxTotalSize),
+		}
+	}
+	return nil
+}
+
+// checkPackageQuota checks, before any archive is made, that the
+// namespace has room for another package. It returns the usage to
+// check the new package's archives against once they're made, or nil
+// if there is no quota, --skip-quota is given or the spec is of an
+// existing package.
+func checkPackageQuota(client *client.Client, opts archiveOptions) (*quotaUsage, error) {
+	quota := config.PackageQuota
+	if opts.skipQuota || opts.updatesPackage || (quota.MaxPackages == 0 && quota.MaxTotalSize == 0) {
+		return nil, nil
+	}
+	usage, err := getQuotaUsage(client, packageNamespace, quota)
+	if err != nil {
+		return nil, err
+	}
+	verbose("Package quota of namespace %v: %v of %v packages, %v of %v", packageNamespace,
+		usage.count, quota.MaxPackages, formatSize(usage.size), formatSize(quota.MaxTotalSize))
+	err = usage.checkCount(quota)
+	if err == nil {
+		err = usage.checkSize(quota, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// checkSpecQuota checks a new package's archives against the quota.
+// If they don't fit, the archives it uploaded are deleted again,
+// unless another package of the namespace refers to them too.
+func checkSpecQuota(client *client.Client, usage *quotaUsage, spec *fission.PackageSpec) error {
+	if usage == nil || config.PackageQuota.MaxTotalSize == 0 {
+		return nil
+	}
+	ssClient := getStorageClient(client)
+	size, err := usage.specSize(ssClient, spec)
+	if err != nil {
+		return err
+	}
+	err = usage.checkSize(config.PackageQuota, size)
+	if err == nil {
+		return nil
+	}
+
+	newPkg := &tpr.Package{Spec: *spec}
+	for _, archive := range []*fission.Archive{&spec.Source, &spec.Deployment} {
+		for _, u := range archiveUrls(archive) {
+			id, ok := storageIdFromUrl(u)
+			if !ok || isArchiveShared(u, newPkg, usage.pkgs) {
+				continue
+			}
+			if derr := ssClient.Delete(id); derr != nil {
+				fmt.Fprintf(os.Stderr, "Failed to delete archive '%v': %v\n", id, derr)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/tpr"
+)
+
+// Actions in a reconcile plan.
+const (
+	reconcileCreate    = "create"
+	reconcileUpdate    = "update"
+	reconcileUnchanged = "unchanged"
+	reconcileDelete    = "delete"
+)
+
+// reconcileStep is one line of a reconcile plan.
+type reconcileStep struct {
+	name    string
+	action  string
+	reasons []string
+
+	desired  applyItem
+	existing *tpr.Package
+
+	// buildCmd is the desired build command, the environment's if
+	// the manifest gives none for a source package.
+	buildCmd string
+
+	// src and deploy are set for archives of an existing package
+	// that changed and must be stored again.
+	src    *preparedArchive
+	deploy *preparedArchive
+}
+
+func (step *reconcileStep) close() {
+	for _, p := range []*preparedArchive{step.src, step.deploy} {
+		if p != nil {
+			p.close()
+		}
+	}
+}
+
+// layoutChanged returns true if a package archive and a prepared
+// archive were both packed from directories, laid out differently.
+func layoutChanged(existing *fission.Archive, p *preparedArchive) bool {
+	return len(existing.Structure) > 0 && len(p.structure) > 0 && existing.Structure != p.structure
+}
+
+// archiveMatches returns true if a package archive holds the same
+// bytes as a prepared archive, in the same layout.
+func archiveMatches(existing *fission.Archive, p *preparedArchive) bool {
+	if layoutChanged(existing, p) {
+		return false
+	}
+	if p.literal {
+		sum := sha256.Sum256(existing.Literal)
+		return len(existing.Literal) > 0 &&
+			fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:]).Equal(p.checksum)
+	}
+	return existing.Type == fission.ArchiveTypeUrl &&
+		existing.Compression == p.compression &&
+		existing.Checksum.Equal(p.checksum)
+}
+
+// diffArchive prepares a desired archive and returns it if it differs
+// from the existing one.
+func diffArchive(fileName string, existing *fission.Archive, opts archiveOptions) (*preparedArchive, error) {
+	p, err := prepareArchive(fileName, opts)
+	if err != nil {
+		return nil, err
+	}
+	if archiveMatches(existing, p) {
+		p.close()
+		return nil, nil
+	}
+	return p, nil
+}
+
+// reconcileBuildCommand returns the build command a package of the
+// manifest is created with: its own, or for a source package the
+// default build command of its environment, as makePackageSpec
+// resolves it. envCmds caches the environments' commands.
+func reconcileBuildCommand(client *client.Client, item applyItem, envCmds map[string]string, opts archiveOptions) (string, error) {
+	if len(item.BuildCmd) > 0 || len(item.srcArchive) == 0 || opts.noDefaultBuild {
+		return item.BuildCmd, nil
+	}
+	cmd, ok := envCmds[item.Env]
+	if !ok {
+		env, err := client.EnvironmentGet(&metav1.ObjectMeta{Name: item.Env, Namespace: packageNamespace})
+		if err != nil {
+			return "", fmt.Errorf("get environment %v: %w", item.Env, err)
+		}
+		cmd = env.Spec.Builder.Command
+		envCmds[item.Env] = cmd
+	}
+	return cmd, nil
+}
+
+// planReconcile compares desired packages to the cluster's. Packages
+// missing from the manifest are only deleted with prune, and only in
+// environments the manifest mentions.
+func planReconcile(client *client.Client, spec *applySpec, pkgs []tpr.Package, fns []tpr.Function, prune bool, opts archiveOptions) ([]*reconcileStep, error) {
+	existing := make(map[string]*tpr.Package)
+	for i := range pkgs {
+		if pkgs[i].Metadata.Namespace == packageNamespace {
+			existing[pkgs[i].Metadata.Name] = &pkgs[i]
+		}
+	}
+
+	var plan []*reconcileStep
+	fail := func(err error) ([]*reconcileStep, error) {
+		for _, step := range plan {
+			step.close()
+		}
+		return nil, err
+	}
+
+	desired := make(map[string]bool)
+	envs := make(map[string]bool)
+	envCmds := make(map[string]string)
+	for _, item := range spec.Packages {
+		if len(item.Name) == 0 {
+			return fail(fmt.Errorf("package with src '%v' and deploy '%v' has no name; reconcile needs names", item.Src, item.Deploy))
+		}
+		if desired[item.Name] {
+			return fail(fmt.Errorf("package %v is listed more than once", item.Name))
+		}
+		desired[item.Name] = true
+		envs[item.Env] = true
+
+		step := &reconcileStep{name: item.Name, desired: item, existing: existing[item.Name]}
+		plan = append(plan, step)
+
+		if step.existing == nil {
+			// archives are stored when the package is created
+			step.action = reconcileCreate
+			continue
+		}
+		if step.existing.Spec.Environment.Name != item.Env {
+			step.reasons = append(step.reasons, "environment")
+		}
+
+		var err error
+		step.buildCmd, err = reconcileBuildCommand(client, item, envCmds, opts)
+		if err != nil {
+			return fail(fmt.Errorf("build command of %v: %w", item.Name, err))
+		}
+		if step.existing.Spec.BuildCommand != step.buildCmd {
+			step.reasons = append(step.reasons, "build command")
+		}
+		if len(item.srcArchive) > 0 {
+			step.src, err = diffArchive(item.srcArchive, &step.existing.Spec.Source, opts)
+			if err != nil {
+				return fail(fmt.Errorf("prepare source of %v: %w", item.Name, err))
+			}
+			if step.src != nil {
+				step.reasons = append(step.reasons, "source")
+				if layoutChanged(&step.existing.Spec.Source, step.src) {
+					step.reasons = append(step.reasons, "source layout")
+				}
+			}
+		}
+		// a source package's deployment archive is the build
+		// output, so it only drifts if a deployment is given
+		if len(item.deployArchive) > 0 {
+			step.deploy, err = diffArchive(item.deployArchive, &step.existing.Spec.Deployment, opts)
+			if err != nil {
+				return fail(fmt.Errorf("prepare deployment of %v: %w", item.Name, err))
+			}
+			if step.deploy != nil {
+				step.reasons = append(step.reasons, "deployment")
+				if layoutChanged(&step.existing.Spec.Deployment, step.deploy) {
+					step.reasons = append(step.reasons, "deployment layout")
+				}
+			}
+		}
+
+		step.action = reconcileUnchanged
+		if len(step.reasons) > 0 {
+			step.action = reconcileUpdate
+		}
+	}
+
+	if prune {
+		for i := range pkgs {
+			pkg := &pkgs[i]
+			if desired[pkg.Metadata.Name] || !envs[pkg.Spec.Environment.Name] ||
+				pkg.Metadata.Namespace != packageNamespace {
+				continue
+			}
+			step := &reconcileStep{name: pkg.Metadata.Name, action: reconcileDelete, existing: pkg}
+			if isPackageReferenced(pkg, fns) {
+				step.action = reconcileUnchanged
+				step.reasons = []string{"not in manifest, but used by a function"}
+			}
+			plan = append(plan, step)
+		}
+	}
+	return plan, nil
+}
+
+func printReconcilePlan(plan []*reconcileStep) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "%v\t%v\t%v\n", "NAME", "ACTION", "CHANGED")
+	for _, step := range plan {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", step.name, step.action, strings.Join(step.reasons, ", "))
+	}
+	w.Flush()
+}
+
+// applyReconcileStep makes the cluster match one step of the plan.
+func applyReconcileStep(client *client.Client, step *reconcileStep, opts archiveOptions) error {
+	switch step.action {
+	case reconcileCreate:
+		pkgSpec, pkgStatus, err := makePackageSpec(client, step.desired.Env,
+			step.desired.srcArchive, step.desired.deployArchive, step.desired.BuildCmd, opts)
+		if err != nil {
+			return err
+		}
+		_, err = savePackage(client, step.name, pkgSpec, pkgStatus, nil)
+		return err
+
+	case reconcileUpdate:
+		pkg := step.existing
+		pkg.Spec.Environment.Name = step.desired.Env
+		pkg.Spec.BuildCommand = step.buildCmd
+		if step.deploy != nil {
+			archive, err := storeArchive(client, step.deploy, opts)
+			if err != nil {
+				return err
+			}
+			pkg.Spec.Deployment = *archive
+		}
+		if step.src != nil {
+			archive, err := storeArchive(client, step.src, opts)
+			if err != nil {
+				return err
+			}
+			pkg.Spec.Source = *archive
+		}
+		if len(step.desired.srcArchive) > 0 && len(step.reasons) > 0 {
+			// source, environment or build changed: rebuild
+			pkg.Status.BuildStatus = fission.BuildStatusPending
+		}
+		_, err := client.PackageUpdate(pkg)
+		return err
+
+	case reconcileDelete:
+		return client.PackageDelete(&step.existing.Metadata)
+	}
+	return nil
+}
+
+func pkgReconcile(c *cli.Context) error {
+	fileName := c.String("file")
+	if len(fileName) == 0 {
+		fatalUsage("Need --file, a JSON or YAML file listing the desired packages.")
+	}
+
+	client := getClient(c.GlobalString("server"))
+
+	opts := getArchiveOptions(c)
+	spec, err := readApplySpec(fileName, opts.inlineLimit)
+	checkErr(err, "read package list")
+	defer spec.close()
+
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+	fns, err := client.FunctionList()
+	checkErr(err, "list functions")
+
+	plan, err := planReconcile(client, spec, pkgs, fns, c.Bool("prune"), opts)
+	checkErr(err, "plan reconcile")
+	defer func() {
+		for _, step := range plan {
+			step.close()
+		}
+	}()
+
+	printReconcilePlan(plan)
+	if !c.Bool("apply") {
+		fmt.Fprintln(os.Stderr, "Run with --apply to make these changes.")
+		return nil
+	}
+
+	for _, step := range plan {
+		err := applyReconcileStep(client, step, opts)
+		checkErr(err, fmt.Sprintf("%v package %v", step.action, step.name))
+		if step.action != reconcileUnchanged {
+			fmt.Printf("package '%v': %v done\n", step.name, step.action)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+	"github.com/fission/fission/tpr"
+)
+
+// urlExpiry returns when a presigned URL stops working, read from
+// the query parameters of the common signing schemes: AWS and GCS V4
+// signatures, AWS V2 and CloudFront Expires, and Azure SAS tokens. It
+// returns false for URLs that don't expire.
+func urlExpiry(archiveUrl string) (time.Time, bool) {
+	u, err := url.Parse(archiveUrl)
+	if err != nil {
+		return time.Time{}, false
+	}
+	q := u.Query()
+	for _, scheme := range []string{"Amz", "Goog"} {
+		date := q.Get("X-" + scheme + "-Date")
+		expires := q.Get("X-" + scheme + "-Expires")
+		if len(date) == 0 || len(expires) == 0 {
+			continue
+		}
+		signed, err := time.Parse("20060102T150405Z", date)
+		if err != nil {
+			continue
+		}
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			continue
+		}
+		return signed.Add(time.Duration(seconds) * time.Second), true
+	}
+	if expires := q.Get("Expires"); len(expires) > 0 {
+		if seconds, err := strconv.ParseInt(expires, 10, 64); err == nil {
+			return time.Unix(seconds, 0), true
+		}
+	}
+	if se := q.Get("se"); len(se) > 0 && len(q.Get("sig")) > 0 {
+		if t, err := time.Parse(time.RFC3339, se); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// urlRefresher re-signs the archive URLs of packages that expire
+// before a deadline. URLs without an expiry, such as the storage
+// service's own, are stable and skipped.
+type urlRefresher struct {
+	client   *client.Client
+	deadline time.Time
+	dryRun   bool
+
+	// namespace is the namespace of the package being refreshed,
+	// whose partition its archives are in
+	namespace string
+
+	// stable counts the URLs skipped for not expiring
+	stable int
+
+	// unrefreshable lists expiring URLs that can't be re-signed,
+	// because they aren't the storage service's
+	unrefreshable []string
+}
+
+// refresh re-signs one URL if it expires before the deadline. It
+// returns the URL to use and whether it changed.
+func (r *urlRefresher) refresh(archiveUrl string) (string, bool, error) {
+	expires, ok := urlExpiry(archiveUrl)
+	if !ok {
+		r.stable++
+		return archiveUrl, false, nil
+	}
+	if expires.After(r.deadline) {
+		return archiveUrl, false, nil
+	}
+	id, ok := storageIdFromUrl(archiveUrl)
+	if !ok {
+		r.unrefreshable = append(r.unrefreshable, archiveUrl)
+		return archiveUrl, false, nil
+	}
+	if r.dryRun {
+		return archiveUrl, true, nil
+	}
+	u, _ := url.Parse(archiveUrl)
+	base := strings.TrimSuffix(u.Scheme+"://"+u.Host+u.Path, "/v1/archive")
+	ssOpts := append(storageClientOptions(r.client.Headers), storageSvcClient.WithNamespace(r.namespace))
+	ssClient := storageSvcClient.MakeClient(base, ssOpts...)
+	fresh, err := ssClient.RefreshUrl(id)
+	if err != nil {
+		return "", false, fmt.Errorf("refresh %v: %w", id, err)
+	}
+	return fresh, fresh != archiveUrl, nil
+}
+
+// refreshArchive re-signs an archive's expiring URLs, those of its
+// parts and mirrors, and its manifest's.
+func (r *urlRefresher) refreshArchive(archive *fission.Archive) (bool, error) {
+	if archive == nil || archive.Type != fission.ArchiveTypeUrl {
+		return false, nil
+	}
+	changed := false
+	refreshAll := func(urls []string) error {
+		for i, u := range urls {
+			fresh, ok, err := r.refresh(u)
+			if err != nil {
+				return err
+			}
+			if ok {
+				urls[i] = fresh
+				changed = true
+			}
+		}
+		return nil
+	}
+	if len(archive.URL) > 0 {
+		urls := []string{archive.URL}
+		if err := refreshAll(urls); err != nil {
+			return false, err
+		}
+		archive.URL = urls[0]
+	}
+	if err := refreshAll(archive.Parts); err != nil {
+		return false, err
+	}
+	if err := refreshAll(archive.Mirrors); err != nil {
+		return false, err
+	}
+	manifestChanged, err := r.refreshArchive(archive.Manifest)
+	if err != nil {
+		return false, err
+	}
+	rangesChanged, err := r.refreshArchive(archive.RangeManifest)
+	if err != nil {
+		return false, err
+	}
+	return changed || manifestChanged || rangesChanged, nil
+}
+
+// refreshPackage re-signs a package's expiring archive URLs and
+// updates it if any changed.
+func (r *urlRefresher) refreshPackage(pkg *tpr.Package) (bool, error) {
+	r.namespace = pkg.Metadata.Namespace
+	changed := false
+	for _, archive := range []*fission.Archive{&pkg.Spec.Source, &pkg.Spec.Deployment, pkg.Spec.SBOM, pkg.Spec.Attestation} {
+		ok, err := r.refreshArchive(archive)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || ok
+	}
+	if !changed || r.dryRun {
+		return changed, nil
+	}
+	meta, err := r.client.PackageUpdate(pkg)
+	if err != nil {
+		return false, fmt.Errorf("update package: %w", err)
+	}
+	return true, updatePackageFunctions(r.client, meta)
+}
+
+func pkgRefreshUrls(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	within, err := parseAge(c.String("within"))
+	if err != nil {
+		fatal(fmt.Sprintf("Invalid --within '%v', use a duration such as 36h or 7d", c.String("within")))
+	}
+	r := &urlRefresher{
+		client:   client,
+		deadline: time.Now().Add(within),
+		dryRun:   c.Bool("dry-run"),
+	}
+
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+	refreshed, failed := 0, 0
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		changed, err := r.refreshPackage(pkg)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(os.Stderr, "Failed to refresh package '%v': %v\n", pkg.Metadata.Name, err)
+		case changed && r.dryRun:
+			refreshed++
+			fmt.Printf("would refresh package '%v'\n", pkg.Metadata.Name)
+		case changed:
+			refreshed++
+			fmt.Printf("refreshed package '%v'\n", pkg.Metadata.Name)
+		}
+	}
+	for _, u := range r.unrefreshable {
+		fmt.Fprintf(os.Stderr, "Warning: %v expires soon and isn't a storage service URL, so it can't be re-signed; recreate its package from a fresh URL\n", u)
+	}
+
+	if failed > 0 {
+		msg := fmt.Sprintf("%v packages could not be refreshed", failed)
+		if refreshed == 0 {
+			fatal(msg)
+		}
+		fatalWithCode(exitCodePartialFailure, msg)
+	}
+	verbose("Skipped %v archive URLs that don't expire", r.stable)
+	if refreshed == 0 {
+		fmt.Println("no package URLs need refreshing")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fission/fission"
+)
+
+func TestUrlExpiry(t *testing.T) {
+	for _, c := range []struct {
+		url     string
+		expires time.Time
+		ok      bool
+	}{
+		{"https://bucket.s3.amazonaws.com/a.zip?X-Amz-Date=20200102T030405Z&X-Amz-Expires=3600&X-Amz-Signature=ab",
+			time.Date(2020, 1, 2, 4, 4, 5, 0, time.UTC), true},
+		{"https://storage.googleapis.com/b/a.zip?X-Goog-Date=20200102T030405Z&X-Goog-Expires=60",
+			time.Date(2020, 1, 2, 3, 5, 5, 0, time.UTC), true},
+		{"https://d1.cloudfront.net/a.zip?Expires=1577934245&Signature=ab", time.Unix(1577934245, 0), true},
+		{"https://acct.blob.core.windows.net/c/a.zip?se=2020-01-02T03:04:05Z&sig=ab",
+			time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), true},
+		// the storage service's URLs are stable
+		{"http://storagesvc.fission/v1/archive?id=sha256-ab", time.Time{}, false},
+		{"https://example.com/a.zip?se=2020-01-02T03:04:05Z", time.Time{}, false},
+	} {
+		expires, ok := urlExpiry(c.url)
+		if ok != c.ok || !expires.Equal(c.expires) {
+			log.Panicf("Expected %v to expire at %v (%v), got %v (%v)", c.url, c.expires, c.ok, expires, ok)
+		}
+	}
+}
+
+func TestRefreshArchiveDryRun(t *testing.T) {
+	r := &urlRefresher{deadline: time.Now().Add(24 * time.Hour), dryRun: true}
+	soon := time.Now().Add(time.Hour).Unix()
+	later := time.Now().Add(48 * time.Hour).Unix()
+
+	// stable URLs and ones expiring after the deadline are left alone
+	archive := &fission.Archive{
+		Type:    fission.ArchiveTypeUrl,
+		URL:     "http://storagesvc.fission/v1/archive?id=a",
+		Mirrors: []string{"https://d1.cloudfront.net/a.zip?Expires=" + strconv.FormatInt(later, 10)},
+	}
+	changed, err := r.refreshArchive(archive)
+	panicIf(err)
+	if changed || r.stable != 1 || len(r.unrefreshable) != 0 {
+		log.Panicf("Expected nothing to refresh and a stable URL, got %v, %v stable, %v", changed, r.stable, r.unrefreshable)
+	}
+
+	// an expiring storage service URL is re-signed, others can't be
+	archive.URL = "http://storagesvc.fission/v1/archive?id=a&Expires=" + strconv.FormatInt(soon, 10)
+	archive.Mirrors = []string{"https://d1.cloudfront.net/a.zip?Expires=" + strconv.FormatInt(soon, 10)}
+	changed, err = r.refreshArchive(archive)
+	panicIf(err)
+	if !changed || len(r.unrefreshable) != 1 || r.unrefreshable[0] != archive.Mirrors[0] {
+		log.Panicf("Expected the storage URL to be refreshed and the mirror reported, got %v, %v", changed, r.unrefreshable)
+	}
+}
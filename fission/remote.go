@@ -0,0 +1,203 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// isRemoteArchive returns true if fileName is an http(s) URL rather
+// than a local path.
+func isRemoteArchive(fileName string) bool {
+	return strings.HasPrefix(fileName, "http://") || strings.HasPrefix(fileName, "https://")
+}
+
+// headerChecksum returns the sha256 checksum a server advertises for
+// a response, if any: X-Checksum-Sha256 (hex), x-amz-checksum-sha256
+// (base64) or an RFC 3230 Digest header.
+func headerChecksum(h http.Header) (*fission.Checksum, error) {
+	if sum := h.Get("X-Checksum-Sha256"); len(sum) > 0 {
+		digest, err := hex.DecodeString(sum)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("X-Checksum-Sha256 %q isn't a hex sha256 checksum", sum)
+		}
+		c := fission.MakeChecksum(fission.ChecksumTypeSHA256, digest)
+		return &c, nil
+	}
+	if sum := h.Get("X-Amz-Checksum-Sha256"); len(sum) > 0 {
+		c, err := fission.ChecksumFromBase64(fission.ChecksumTypeSHA256, sum)
+		return &c, err
+	}
+	for _, d := range strings.Split(h.Get("Digest"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "sha-256") {
+			c, err := fission.ChecksumFromBase64(fission.ChecksumTypeSHA256, kv[1])
+			return &c, err
+		}
+	}
+	return nil, nil
+}
+
+const (
+	// remoteResponseTimeout bounds how long an external host may
+	// take to start answering.
+	remoteResponseTimeout = time.Minute
+
+	// remoteTimeout bounds a whole request to an external host,
+	// including reading the archive.
+	remoteTimeout = 30 * time.Minute
+)
+
+var (
+	remoteClientOnce sync.Once
+	remoteClient     *http.Client
+)
+
+// getRemoteClient returns the client for URLs outside the cluster,
+// shared so connections are reused, trusting --cacert like the
+// cluster clients.
+func getRemoteClient() *http.Client {
+	remoteClientOnce.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = remoteResponseTimeout
+		if tlsConfig != nil {
+			t.TLSClientConfig = tlsConfig
+		}
+		remoteClient = &http.Client{Transport: t, Timeout: remoteTimeout}
+	})
+	return remoteClient
+}
+
+// getRemote fetches a URL, following redirects, and fails unless the
+// final response is a 200.
+func getRemote(method, archiveUrl string) (*http.Response, error) {
+	req, err := http.NewRequest(method, archiveUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := getRemoteClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v %v: %v", method, archiveUrl, resp.Status)
+	}
+	if final := resp.Request.URL.String(); final != archiveUrl {
+		verbose("%v redirected to %v", archiveUrl, final)
+	}
+	return resp, nil
+}
+
+// downloadRemote saves a URL's contents to w and returns their
+// checksum.
+func downloadRemote(archiveUrl string, w io.Writer) (*fission.Checksum, error) {
+	resp, err := getRemote(http.MethodGet, archiveUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, h), resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("download %v: %w", archiveUrl, err)
+	}
+	c := fission.MakeChecksum(fission.ChecksumTypeSHA256, h.Sum(nil))
+	return &c, nil
+}
+
+// createRemoteArchive makes an archive from an http(s) URL. Without
+// rehost the package refers to the URL itself, checksummed with the
+// server's advertised checksum or, failing that, by downloading it
+// once. With rehost the contents are copied to the storage service,
+// so the package doesn't depend on the external host.
+func createRemoteArchive(client *client.Client, archiveUrl string, opts archiveOptions) (*fission.Archive, error) {
+	resp, err := getRemote(http.MethodHead, archiveUrl)
+	if err != nil {
+		return nil, fmt.Errorf("check archive URL: %w", err)
+	}
+	resp.Body.Close()
+	advertised, err := headerChecksum(resp.Header)
+	if err != nil {
+		return nil, fmt.Errorf("parse checksum header of %v: %w", archiveUrl, err)
+	}
+
+	if !opts.rehost {
+		checksum := advertised
+		if checksum == nil {
+			verbose("%v has no checksum header, downloading it to compute one", archiveUrl)
+			checksum, err = downloadRemote(archiveUrl, ioutil.Discard)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &fission.Archive{
+			Type:     fission.ArchiveTypeUrl,
+			URL:      archiveUrl,
+			Checksum: *checksum,
+		}, nil
+	}
+
+	// keep the remote file name, so that e.g. a saved copy or a
+	// single file deployment is named sensibly
+	dir, err := ioutil.TempDir(stagingDir(), "fission-rehost-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	name := path.Base(resp.Request.URL.Path)
+	if name == "/" || name == "." {
+		name = "archive"
+	}
+	localPath := dir + string(os.PathSeparator) + name
+
+	if resp.ContentLength > 0 {
+		err = checkStagingSpace(resp.ContentLength)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Create(localPath)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := downloadRemote(archiveUrl, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if advertised != nil && !advertised.Equal(*checksum) {
+		return nil, fmt.Errorf("%w: %v doesn't match its advertised checksum", fission.ErrInvalidChecksum, archiveUrl)
+	}
+
+	verbose("Rehosting %v", archiveUrl)
+	return createArchive(client, localPath, opts)
+}
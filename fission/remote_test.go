@@ -0,0 +1,46 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"testing"
+)
+
+func TestHeaderChecksum(t *testing.T) {
+	// sha256 of "hello"
+	sum := "2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824"
+	h := make(http.Header)
+	h.Set("X-Checksum-Sha256", sum)
+	c, err := headerChecksum(h)
+	panicIf(err)
+	if c == nil || c.Sum != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		log.Panicf("Expected the hex checksum to be read, got %v", c)
+	}
+
+	for _, bad := range []string{"not-hex", "2cf24dba", sum + "00"} {
+		h.Set("X-Checksum-Sha256", bad)
+		if _, err := headerChecksum(h); err == nil {
+			log.Panicf("Expected X-Checksum-Sha256 %q to be rejected", bad)
+		}
+	}
+
+	if c, err := headerChecksum(make(http.Header)); err != nil || c != nil {
+		log.Panicf("Expected no checksum without a header, got %v, %v", c, err)
+	}
+}
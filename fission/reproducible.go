@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errNotReproducible means packing the same files twice gave
+// different archives.
+var errNotReproducible = errors.New("archive isn't reproducible")
+
+// verifyReproducible packs a directory or layout file a second time,
+// from a fresh scan, and checks that the archive is the same as the
+// first pack's, which is at packed. Archives that differ can't be
+// deduplicated, so the error names the first entry that differs.
+func verifyReproducible(fileName string, layout bool, packed string, opts archiveOptions, compressed bool) error {
+	// the first pack already asked for confirmation
+	opts.assumeYes = true
+	var again string
+	var err error
+	if layout {
+		again, _, err = packLayoutArchive(fileName, opts, compressed)
+	} else {
+		again, _, err = packDirArchive(fileName, opts, compressed)
+	}
+	if err != nil {
+		return fmt.Errorf("pack %v again: %w", fileName, err)
+	}
+	defer os.Remove(again)
+
+	first, err := fileChecksum(packed)
+	if err != nil {
+		return err
+	}
+	second, err := fileChecksum(again)
+	if err != nil {
+		return err
+	}
+	if first == second {
+		verbose("%v packed twice to the same archive, %v", fileName, first)
+		return nil
+	}
+	diff, err := zipDifference(packed, again)
+	if err != nil {
+		return fmt.Errorf("compare packs of %v: %w", fileName, err)
+	}
+	return fmt.Errorf("%w: %v packed twice to different archives: %v", errNotReproducible, fileName, diff)
+}
+
+// zipDifference describes the first difference between two zip files,
+// comparing their entries in order.
+func zipDifference(a, b string) (string, error) {
+	za, err := zip.OpenReader(a)
+	if err != nil {
+		return "", err
+	}
+	defer za.Close()
+	zb, err := zip.OpenReader(b)
+	if err != nil {
+		return "", err
+	}
+	defer zb.Close()
+
+	for i := 0; i < len(za.File) && i < len(zb.File); i++ {
+		fa, fb := za.File[i].FileHeader, zb.File[i].FileHeader
+		switch {
+		case fa.Name != fb.Name:
+			return fmt.Sprintf("entry %v is %v in one and %v in the other; the files are in a different order", i+1, fa.Name, fb.Name), nil
+		case !fa.Modified.Equal(fb.Modified):
+			return fmt.Sprintf("%v is modified at %v in one and %v in the other", fa.Name, fa.Modified, fb.Modified), nil
+		case fa.Mode() != fb.Mode():
+			return fmt.Sprintf("%v has mode %v in one and %v in the other", fa.Name, fa.Mode(), fb.Mode()), nil
+		case fa.UncompressedSize64 != fb.UncompressedSize64 || fa.CRC32 != fb.CRC32:
+			return fmt.Sprintf("%v has different contents (%v and %v bytes)", fa.Name, fa.UncompressedSize64, fb.UncompressedSize64), nil
+		case fa.Method != fb.Method || fa.CompressedSize64 != fb.CompressedSize64:
+			return fmt.Sprintf("%v is compressed differently", fa.Name), nil
+		case string(fa.Extra) != string(fb.Extra):
+			return fmt.Sprintf("%v has different extra fields", fa.Name), nil
+		}
+	}
+	switch {
+	case len(za.File) > len(zb.File):
+		return fmt.Sprintf("%v is only in the first", za.File[len(zb.File)].Name), nil
+	case len(zb.File) > len(za.File):
+		return fmt.Sprintf("%v is only in the second", zb.File[len(za.File)].Name), nil
+	}
+	return "the entries are the same, but the zip metadata differs", nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-reproducible")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	panicIf(os.Mkdir(src, 0755))
+	index := filepath.Join(src, "index.js")
+	panicIf(ioutil.WriteFile(index, []byte("module.exports = () => 'ok'\n"), 0644))
+
+	opts := archiveOptions{assumeYes: true, scanConcurrency: 1, inlineLimit: config.InlineLimit}
+	packed, _, err := packDirArchive(src, opts, false)
+	panicIf(err)
+	defer os.Remove(packed)
+	panicIf(verifyReproducible(src, false, packed, opts, false))
+
+	// a file touched between the packs changes the archive
+	later := time.Now().Add(time.Hour)
+	panicIf(os.Chtimes(index, later, later))
+	err = verifyReproducible(src, false, packed, opts, false)
+	if !errors.Is(err, errNotReproducible) || !strings.Contains(err.Error(), "index.js is modified") {
+		log.Panicf("Expected index.js to be reported modified, got %v", err)
+	}
+
+	// unless times are fixed
+	opts.reproducible = true
+	fixed, _, err := packDirArchive(src, opts, false)
+	panicIf(err)
+	defer os.Remove(fixed)
+	panicIf(os.Chtimes(index, time.Now(), time.Now()))
+	panicIf(verifyReproducible(src, false, fixed, opts, false))
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// With --resumable-upload, archives are sent to the storage service
+// in chunks, the progress saved in the staging directory after each
+// one. An upload that's interrupted resumes where it stopped when the
+// command is run again: the archive is packed again, and the saved
+// progress is used if its contents are the same. Archives are
+// checksummed with a tree hash of their chunks, so those already sent
+// aren't hashed again.
+
+// resumableStatePath is where the progress of a resumable upload of
+// an archive is saved, by its contents and upload prefix.
+func resumableStatePath(p *preparedArchive, opts archiveOptions) string {
+	key := sha256.Sum256([]byte(opts.uploadPrefix() + "\x00" + string(p.checksum.Type) + ":" + p.checksum.Sum))
+	return filepath.Join(stagingDir(), fmt.Sprintf("fission-upload-%v.json", hex.EncodeToString(key[:8])))
+}
+
+// uploadResumable uploads a prepared archive in resumable chunks.
+func uploadResumable(ssClient *storageSvcClient.Client, p *preparedArchive, opts archiveOptions) (*storageSvcClient.UploadResult, error) {
+	statePath := resumableStatePath(p, opts)
+	metadata := uploadMetadata(p, opts)
+	res, err := ssClient.UploadResumableContent(p.uploadName, opts.uploadPrefix(), statePath, p.checksum, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("%w; run the command again to resume the upload", err)
+	}
+	if res.ResumedAt > 0 {
+		verbose("Resumed upload of %v at %v", p.srcName, formatSize(res.ResumedAt))
+	}
+	return &res.UploadResult, nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// Sampled verification checks a few ranges of an archive instead of
+// hashing all of it. Archives created with --range-checksums record
+// the SHA256 of each rangeChecksumSize range of the stored bytes in a
+// range manifest; "package verify --sample" checks the archive's size
+// and downloads only --sample-ranges of those ranges, always
+// including the first and last, to check them. Chunked archives
+// sample their chunks instead, each checked against its checksum.
+//
+// This is probabilistic: it finds damage to a stored archive, such as
+// truncation or a corrupted region, with a probability of about
+// 1-(1-f)^k for damage touching a fraction f of the ranges when k
+// are sampled, e.g. 80% for damage to 10% of the ranges with the
+// default 16. A single flipped byte in a large archive is likely to
+// be missed. Only a full verify, still the default, proves the
+// archive matches its checksum.
+
+const (
+	// rangeChecksumSize is the size of the ranges of a range
+	// manifest.
+	rangeChecksumSize = 4 * 1024 * 1024
+
+	// verifySampled is the outcome of an archive whose sampled
+	// ranges matched.
+	verifySampled = "sampled"
+)
+
+// makeRangeManifest hashes each range of rangeSize bytes of a file.
+func makeRangeManifest(fileName string, rangeSize int64) (*fission.ArchiveRangeManifest, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := &fission.ArchiveRangeManifest{RangeSize: rangeSize, Checksums: []string{}}
+	for {
+		h := sha256.New()
+		n, err := io.CopyN(h, f, rangeSize)
+		if n > 0 {
+			manifest.Checksums = append(manifest.Checksums, hex.EncodeToString(h.Sum(nil)))
+			manifest.Size += n
+		}
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// storeRangeManifest makes the range manifest of an uploaded archive
+// and stores it like a manifest.
+func storeRangeManifest(ssClient *storageSvcClient.Client, fileName string, opts archiveOptions) (*fission.Archive, error) {
+	manifest, err := makeRangeManifest(fileName, rangeChecksumSize)
+	if err != nil {
+		return nil, err
+	}
+	verbose("Recorded checksums of %v ranges of %v", len(manifest.Checksums), fileName)
+	return storeJSON(ssClient, manifest, "range manifest", opts)
+}
+
+// sampleIndexes picks k of n indexes, always the first and last, in
+// increasing order.
+func sampleIndexes(n, k int) []int {
+	if k >= n {
+		k = n
+	}
+	picked := make(map[int]bool, k)
+	if k > 0 {
+		picked[0] = true
+	}
+	if k > 1 {
+		picked[n-1] = true
+	}
+	for _, i := range rand.Perm(n) {
+		if len(picked) >= k {
+			break
+		}
+		picked[i] = true
+	}
+	indexes := make([]int, 0, len(picked))
+	for i := range picked {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// verifyArchiveSample checks sampled ranges of an archive, as
+// described above. Archives without range checksums or chunks, or not
+// in the storage service, are verified in full, as are literals.
+func verifyArchiveSample(client *client.Client, archive *fission.Archive, ranges int, wait func()) (string, error) {
+	if archive.Type != fission.ArchiveTypeUrl {
+		return verifyArchiveChecksum(client, archive, wait, "")
+	}
+	if len(archive.Chunks) > 0 && len(archive.Chunks) == len(archive.Parts) {
+		return verifyChunkSample(client, archive, ranges, wait)
+	}
+	id, ok := storageIdFromUrl(archive.URL)
+	if archive.RangeManifest == nil || !ok {
+		verbose("%v has no range checksums, verifying all of it", archive.URL)
+		return verifyArchiveChecksum(client, archive, wait, "")
+	}
+
+	contents, err := readArchive(client, archive.RangeManifest)
+	if err != nil {
+		return verifyFailed, fmt.Errorf("read range manifest: %w", err)
+	}
+	var manifest fission.ArchiveRangeManifest
+	err = json.Unmarshal(contents, &manifest)
+	if err != nil || manifest.RangeSize <= 0 {
+		return verifyFailed, fmt.Errorf("parse range manifest: %v", err)
+	}
+
+	ssClient := getStorageClient(client)
+	wait()
+	size, err := ssClient.Size(id)
+	if errors.Is(err, fission.ErrArchiveNotFound) {
+		return verifyMissing, fmt.Errorf("%v: %w", archive.URL, err)
+	}
+	if err != nil {
+		return verifyFailed, fmt.Errorf("size of %v: %w", archive.URL, err)
+	}
+	if size != manifest.Size {
+		return verifyMismatched, fmt.Errorf("%w: %v is %v bytes, the range manifest %v", fission.ErrInvalidChecksum, archive.URL, size, manifest.Size)
+	}
+
+	for _, i := range sampleIndexes(len(manifest.Checksums), ranges) {
+		offset := int64(i) * manifest.RangeSize
+		length := manifest.RangeSize
+		if offset+length > manifest.Size {
+			length = manifest.Size - offset
+		}
+		h := sha256.New()
+		wait()
+		err = ssClient.DownloadRange(id, offset, length, h)
+		if errors.Is(err, fission.ErrArchiveNotFound) {
+			return verifyMissing, fmt.Errorf("%v: %w", archive.URL, err)
+		}
+		if err != nil {
+			return verifyFailed, fmt.Errorf("download range at offset %v of %v: %w", offset, archive.URL, err)
+		}
+		if hex.EncodeToString(h.Sum(nil)) != manifest.Checksums[i] {
+			return verifyMismatched, fmt.Errorf("%w: range %v at offset %v", fission.ErrInvalidChecksum, i, offset)
+		}
+	}
+	return verifySampled, nil
+}
+
+// verifyChunkSample checks sampled chunks of a chunked archive.
+func verifyChunkSample(client *client.Client, archive *fission.Archive, chunks int, wait func()) (string, error) {
+	for _, i := range sampleIndexes(len(archive.Chunks), chunks) {
+		chunk := archive.Chunks[i]
+		h, err := fission.NewChecksumHash(chunk.Checksum.Type)
+		if err != nil {
+			return verifyFailed, err
+		}
+		wait()
+		u := archive.Parts[i]
+		err = downloadArchiveUrl(client, u, h)
+		if errors.Is(err, fission.ErrArchiveNotFound) {
+			return verifyMissing, fmt.Errorf("%v: %w", u, err)
+		}
+		if err != nil {
+			return verifyFailed, fmt.Errorf("download %v: %w", u, err)
+		}
+		if !fission.MakeChecksum(chunk.Checksum.Type, h.Sum(nil)).Equal(chunk.Checksum) {
+			return verifyMismatched, fmt.Errorf("%w: chunk %v", fission.ErrInvalidChecksum, i)
+		}
+	}
+	return verifySampled, nil
+}
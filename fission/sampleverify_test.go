@@ -0,0 +1,57 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestRangeManifest(t *testing.T) {
+	f, err := ioutil.TempFile("", "fission-ranges")
+	panicIf(err)
+	defer os.Remove(f.Name())
+	contents := make([]byte, 2500)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	_, err = f.Write(contents)
+	panicIf(err)
+	panicIf(f.Close())
+
+	manifest, err := makeRangeManifest(f.Name(), 1000)
+	panicIf(err)
+	if manifest.Size != 2500 || len(manifest.Checksums) != 3 {
+		log.Panicf("Expected 3 ranges of 2500 bytes, got %v of %v", len(manifest.Checksums), manifest.Size)
+	}
+	last := sha256.Sum256(contents[2000:])
+	if manifest.Checksums[2] != hex.EncodeToString(last[:]) {
+		log.Panicf("Last range checksum %v doesn't cover the last 500 bytes", manifest.Checksums[2])
+	}
+
+	indexes := sampleIndexes(100, 5)
+	if len(indexes) != 5 || indexes[0] != 0 || indexes[4] != 99 {
+		log.Panicf("Expected 5 sorted indexes including the first and last, got %v", indexes)
+	}
+	if indexes := sampleIndexes(3, 16); len(indexes) != 3 {
+		log.Panicf("Expected all 3 indexes, got %v", indexes)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fission/fission"
+)
+
+func TestCompressionExt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-save-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		contents []byte
+		ext      string
+	}{
+		{[]byte{0x1f, 0x8b, 0x08, 0x00}, ".gz"},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, ".zst"},
+		{[]byte("PK\x03\x04"), ""},
+		{[]byte{0x1f}, ""},
+		{nil, ""},
+	} {
+		fileName := filepath.Join(dir, "archive")
+		panicIf(ioutil.WriteFile(fileName, c.contents, 0644))
+		if ext := compressionExt(fileName); ext != c.ext {
+			log.Panicf("Expected %v for %x, got %v", c.ext, c.contents, ext)
+		}
+	}
+}
+
+func TestResolveCompression(t *testing.T) {
+	c, err := resolveCompression("", true)
+	panicIf(err)
+	if c != fission.ArchiveCompressionGzip {
+		log.Panicf("Expected gzip for directories by default, got %v", c)
+	}
+	// zstd isn't decompressed by the fetcher yet, so it falls back
+	// to gzip
+	c, err = resolveCompression("zstd", false)
+	panicIf(err)
+	if c != fission.ArchiveCompressionGzip {
+		log.Panicf("Expected zstd to fall back to gzip, got %v", c)
+	}
+	if _, err := resolveCompression("xz", true); err == nil {
+		log.Panicf("Expected an unknown compression to be refused")
+	}
+	if _, err := resolveCompressionLevel(12, "gzip", fission.ArchiveCompressionGzip); err == nil {
+		log.Panicf("Expected level 12 to be out of range for gzip")
+	}
+	if _, err := resolveCompressionLevel(3, "none", fission.ArchiveCompressionNone); err == nil {
+		log.Panicf("Expected a level to be refused without compression")
+	}
+	// zstd levels are checked against zstd's range, and clamped to
+	// gzip's when zstd falls back to gzip
+	level, err := resolveCompressionLevel(19, "zstd", fission.ArchiveCompressionGzip)
+	panicIf(err)
+	if level != gzip.BestCompression {
+		log.Panicf("Expected zstd level 19 to become gzip level %v, got %v", gzip.BestCompression, level)
+	}
+	if _, err := resolveCompressionLevel(23, "zstd", fission.ArchiveCompressionGzip); err == nil {
+		log.Panicf("Expected level 23 to be out of range for zstd")
+	}
+}
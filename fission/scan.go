@@ -0,0 +1,61 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// scanWaitTimeout bounds how long --wait-scan waits for the scan of
+// each stored object of an archive.
+const scanWaitTimeout = 15 * time.Minute
+
+// waitScan waits for the storage service to scan the stored objects of
+// an archive for malware, with --wait-scan, failing if any is
+// infected. If the service doesn't scan uploads, there is nothing to
+// wait for.
+func waitScan(client *client.Client, name string, archive *fission.Archive, opts archiveOptions) error {
+	ssClient := getStorageClient(client, append(archiveClientOptions(opts), storageSvcClient.WithContext(uploads.context()))...)
+	for _, u := range archiveUrls(archive) {
+		id, ok := storageIdFromUrl(u)
+		if !ok {
+			continue
+		}
+		verbose("Waiting for the malware scan of %v", id)
+		result, err := ssClient.WaitScan(id, scanWaitTimeout)
+		if errors.Is(err, storageSvcClient.ErrScanUnavailable) {
+			fmt.Fprintf(os.Stderr, "Warning: the storage service doesn't scan uploads, not waiting for a scan of %v\n", name)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("scan %v: %w", name, err)
+		}
+		if result == nil {
+			verbose("%v was stored before uploads were scanned", id)
+		} else {
+			verbose("Malware scan found %v clean", id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fission/fission"
+)
+
+// The secret scan looks for credentials in the packed contents of an
+// archive before it is stored, line by line. Like the environment
+// checks, the rules are regexes, not parsers: they catch the obvious
+// cases, such as a committed private key, and --secret-allowlist
+// suppresses the false positives.
+
+// maxSecretScanLine bounds the lines the secret scan reads; the rest
+// of a file with a longer line, such as minified code, isn't scanned.
+const maxSecretScanLine = 1024 * 1024
+
+type (
+	// secretRule is a named regex matching a kind of secret.
+	secretRule struct {
+		name string
+		re   *regexp.Regexp
+	}
+
+	// secretAllow suppresses the findings of a rule, or of any
+	// rule if rule is empty, in files whose archive path matches
+	// pattern.
+	secretAllow struct {
+		pattern string
+		rule    string
+	}
+
+	// secretScanLine is a line of a rules or allowlist file.
+	secretScanLine struct {
+		num  int
+		text string
+	}
+
+	// secretFinding is a line of a file that matches a rule.
+	secretFinding struct {
+		file string
+		line int
+		rule string
+	}
+
+	// secretScanner checks archives for secrets, set by the
+	// --scan-secrets, --block-secrets, --secret-rules and
+	// --secret-allowlist flags.
+	secretScanner struct {
+		rules []secretRule
+		allow []secretAllow
+
+		// block fails the archive on findings instead of
+		// warning.
+		block bool
+	}
+)
+
+// defaultSecretRules are the rules used unless --secret-rules gives
+// others.
+var defaultSecretRules = []secretRule{
+	{"private key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"Stripe key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+}
+
+// makeSecretScanner reads the rules and allowlist files, either of
+// which may be empty for the defaults. Rules are lines of the form
+// name=regex; allowlist lines are an archive path glob, optionally
+// followed by the name of the one rule to suppress. Blank lines and
+// lines starting with # are ignored in both.
+func makeSecretScanner(rulesFile string, allowlistFile string, block bool) (*secretScanner, error) {
+	s := &secretScanner{rules: defaultSecretRules, block: block}
+	if len(rulesFile) > 0 {
+		lines, err := readSecretScanLines(rulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("read --secret-rules: %w", err)
+		}
+		s.rules = nil
+		for _, l := range lines {
+			kv := strings.SplitN(l.text, "=", 2)
+			if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+				return nil, fmt.Errorf("%v:%v: rule should be of the form name=regex", rulesFile, l.num)
+			}
+			re, err := regexp.Compile(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return nil, fmt.Errorf("%v:%v: %w", rulesFile, l.num, err)
+			}
+			s.rules = append(s.rules, secretRule{name: strings.TrimSpace(kv[0]), re: re})
+		}
+		if len(s.rules) == 0 {
+			return nil, fmt.Errorf("--secret-rules %v has no rules", rulesFile)
+		}
+	}
+	if len(allowlistFile) > 0 {
+		lines, err := readSecretScanLines(allowlistFile)
+		if err != nil {
+			return nil, fmt.Errorf("read --secret-allowlist: %w", err)
+		}
+		for _, l := range lines {
+			fields := strings.SplitN(l.text, " ", 2)
+			a := secretAllow{pattern: fields[0]}
+			if len(fields) == 2 {
+				a.rule = strings.TrimSpace(fields[1])
+			}
+			if _, err := path.Match(a.pattern, ""); err != nil {
+				return nil, fmt.Errorf("%v:%v: bad pattern '%v': %w", allowlistFile, l.num, a.pattern, err)
+			}
+			s.allow = append(s.allow, a)
+		}
+	}
+	return s, nil
+}
+
+// readSecretScanLines returns the lines of a rules or allowlist file
+// that aren't blank or comments.
+func readSecretScanLines(fileName string) ([]secretScanLine, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var lines []secretScanLine
+	for i, l := range strings.Split(string(contents), "\n") {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		lines = append(lines, secretScanLine{num: i + 1, text: l})
+	}
+	return lines, nil
+}
+
+// allowed returns true if the allowlist suppresses a finding.
+func (s *secretScanner) allowed(f secretFinding) bool {
+	for _, a := range s.allow {
+		if len(a.rule) > 0 && a.rule != f.rule {
+			continue
+		}
+		if ok, _ := path.Match(a.pattern, f.file); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scanReader returns the findings in one file's contents. Binary
+// files, with a NUL byte near the start, aren't scanned.
+func (s *secretScanner) scanReader(name string, r io.Reader) ([]secretFinding, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	var findings []secretFinding
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSecretScanLine)
+	for num := 1; scanner.Scan(); num++ {
+		for _, rule := range s.rules {
+			if !rule.re.Match(scanner.Bytes()) {
+				continue
+			}
+			f := secretFinding{file: name, line: num, rule: rule.name}
+			if !s.allowed(f) {
+				findings = append(findings, f)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return nil, err
+	}
+	return findings, nil
+}
+
+// scanFile returns the findings in a file to be stored: the files of
+// a zip, or the file itself.
+func (s *secretScanner) scanFile(fileName string) ([]secretFinding, error) {
+	if !isZip(fileName) {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return s.scanReader(filepath.Base(fileName), f)
+	}
+
+	r, err := zip.OpenReader(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var findings []secretFinding
+	for _, zf := range r.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("read %v: %w", zf.Name, err)
+		}
+		fileFindings, err := s.scanReader(zf.Name, rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %v: %w", zf.Name, err)
+		}
+		findings = append(findings, fileFindings...)
+	}
+	return findings, nil
+}
+
+// check scans the file to be stored for an archive, printing a
+// warning for each finding, or failing on them if s.block is set.
+// The matched text itself is never printed.
+func (s *secretScanner) check(srcName string, fileName string) error {
+	findings, err := s.scanFile(fileName)
+	if err != nil {
+		return fmt.Errorf("scan %v for secrets: %w", srcName, err)
+	}
+	return s.report(srcName, findings)
+}
+
+// checkScan is check for the files of a scan held in memory.
+func (s *secretScanner) checkScan(srcName string, scan *dirScan) error {
+	var findings []secretFinding
+	for _, e := range scan.entries {
+		fileFindings, err := s.scanReader(e.relPath, bytes.NewReader(e.contents))
+		if err != nil {
+			return fmt.Errorf("scan %v for secrets: %w", srcName, err)
+		}
+		findings = append(findings, fileFindings...)
+	}
+	return s.report(srcName, findings)
+}
+
+// checkContents is check for a single file held in memory.
+func (s *secretScanner) checkContents(srcName string, contents []byte) error {
+	findings, err := s.scanReader(srcName, bytes.NewReader(contents))
+	if err != nil {
+		return fmt.Errorf("scan %v for secrets: %w", srcName, err)
+	}
+	return s.report(srcName, findings)
+}
+
+// report prints or fails on the findings of check.
+func (s *secretScanner) report(srcName string, findings []secretFinding) error {
+	if len(findings) == 0 {
+		verbose("%v: no secrets found", srcName)
+		return nil
+	}
+
+	var locations []string
+	for _, f := range findings {
+		locations = append(locations, fmt.Sprintf("%v:%v (%v)", f.file, f.line, f.rule))
+	}
+	if s.block {
+		return fission.MakeError(fission.ErrorInvalidArgument,
+			fmt.Sprintf("%v looks like it holds secrets at %v; remove them, or add false positives to --secret-allowlist",
+				srcName, strings.Join(locations, ", ")))
+	}
+	for _, l := range locations {
+		fmt.Fprintf(os.Stderr, "Warning: %v looks like it holds a secret at %v\n", srcName, l)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// stdinArchive is the archive name that reads the archive from stdin,
+// as in --deploy -.
+const stdinArchive = "-"
+
+// defaultStdinName names archives read from stdin without
+// --stdin-name.
+const defaultStdinName = "stdin"
+
+// createStdinArchive makes a single file archive of what is piped to
+// stdin, e.g. a bundle written to stdout by a build tool, as
+// createArchive would of a file.
+//
+// Up to the literal limit is held in memory: if stdin ends before it,
+// the archive is prepared in memory, and embedded without touching the
+// disk. Otherwise what was read is spilled to a file in the staging
+// directory, named opts.stdinName, along with the rest of stdin, and
+// the file is prepared and uploaded as usual; memory use stays at the
+// literal limit however large the archive is.
+func createStdinArchive(client *client.Client, opts archiveOptions) (*fission.Archive, error) {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return nil, errors.New("the archive is read from stdin, but nothing is piped to it")
+	}
+	name := opts.stdinName
+	if len(name) == 0 {
+		name = defaultStdinName
+	}
+	if filepath.Base(name) != name {
+		return nil, fmt.Errorf("--stdin-name '%v' must be a file name, without directories", name)
+	}
+
+	p := &preparedArchive{srcName: name}
+	defer p.close()
+	if !opts.noHints {
+		// having no path, stdin is hinted by its name
+		p.hints = fission.DetectArchiveHints([]string{name})
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, os.Stdin, opts.inlineLimit)
+	if err == io.EOF {
+		verbose("%v: read %v from stdin", name, formatSize(n))
+		err = p.prepareContents(buf.Bytes(), opts)
+		if err != nil {
+			return nil, err
+		}
+		return storeArchive(client, p, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read stdin: %w", err)
+	}
+
+	dir, err := ioutil.TempDir(stagingDir(), "fission-stdin-")
+	if err != nil {
+		return nil, err
+	}
+	p.cleanups = append(p.cleanups, func() { os.RemoveAll(dir) })
+	p.uploadName = filepath.Join(dir, name)
+	f, err := os.Create(p.uploadName)
+	if err != nil {
+		return nil, err
+	}
+	size, err := buf.WriteTo(f)
+	if err == nil {
+		n, err = storageSvcClient.CopyBuffer(f, os.Stdin, opts.bufferSize)
+		size += n
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("spill stdin to %v: %w", p.uploadName, err)
+	}
+	verbose("%v: read %v from stdin, spilled to %v", name, formatSize(size), p.uploadName)
+	err = p.prepare(opts)
+	if err != nil {
+		return nil, err
+	}
+	return storeArchive(client, p, opts)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission/tpr"
+)
+
+// archivePackages returns the names of the packages referring to the
+// stored archive with the given ID, sorted, namespaced when they
+// aren't in the default namespace.
+func archivePackages(pkgs []tpr.Package, id string) []string {
+	var names []string
+	for i := range pkgs {
+		if makeStorageRefs(pkgs[i:i+1]).count(id) == 0 {
+			continue
+		}
+		name := pkgs[i].Metadata.Name
+		if ns := pkgs[i].Metadata.Namespace; len(ns) > 0 && ns != packageNamespace {
+			name = ns + "/" + name
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// storageFind lists the stored archives holding every --tag, and the
+// packages referring to them.
+func storageFind(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	output := c.String("output")
+	checkOutputFormat(output)
+
+	tags := c.StringSlice("tag")
+	if len(tags) == 0 {
+		fatalUsage("Need --tag key=value, e.g. --tag git-sha=<commit>.")
+	}
+	for _, tag := range tags {
+		if strings.Index(tag, "=") <= 0 {
+			fatalUsage(fmt.Sprintf("Bad --tag '%v', use key=value.", tag))
+		}
+	}
+
+	archives, err := getStorageClient(client).FindByTags(tags)
+	checkErr(err, "find archives by tag")
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+
+	t := newTable("ID", "SIZE", "PACKAGES", "TAGS")
+	for _, a := range archives {
+		names := archivePackages(pkgs, a.ID)
+		referenced := "-"
+		if len(names) > 0 {
+			referenced = strings.Join(names, ",")
+		}
+		t.addRow(a.ID, formatSize(a.Size), referenced, strings.Join(a.Tags, ","))
+	}
+	if len(archives) == 0 && output != "json" {
+		fmt.Fprintf(os.Stderr, "No stored archives are tagged %v\n", strings.Join(tags, ", "))
+		return nil
+	}
+	return t.print(os.Stdout, output)
+}
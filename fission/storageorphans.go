@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/storagesvc"
+	"github.com/fission/fission/tpr"
+)
+
+// storageRefs are the stored archives packages refer to. Storage
+// service URLs may be re-signed, so archives are matched on the ID
+// in their URLs rather than on the URLs themselves; content
+// addressed archives also match on their SHA256 checksums.
+type storageRefs struct {
+	ids  map[string]int
+	sums map[string]bool
+}
+
+// makeStorageRefs collects the storage service IDs and checksums of
+// every archive of the packages: source, deployments, SBOMs and
+// attestations, their manifests, parts and mirrors.
+func makeStorageRefs(pkgs []tpr.Package) *storageRefs {
+	refs := &storageRefs{ids: make(map[string]int), sums: make(map[string]bool)}
+	var add func(archive *fission.Archive)
+	add = func(archive *fission.Archive) {
+		if archive == nil {
+			return
+		}
+		urls := append(archiveUrls(archive), archive.Mirrors...)
+		for _, u := range urls {
+			if id, ok := storageIdFromUrl(u); ok {
+				refs.ids[id]++
+			}
+		}
+		if archive.Checksum.Type == fission.ChecksumTypeSHA256 && len(archive.Checksum.Sum) > 0 {
+			refs.sums[strings.ToLower(archive.Checksum.Sum)] = true
+		}
+		add(archive.Manifest)
+	}
+	for i := range pkgs {
+		spec := &pkgs[i].Spec
+		add(&spec.Source)
+		add(&spec.Deployment)
+		add(spec.BuiltDeployment)
+		add(spec.SBOM)
+		add(spec.Attestation)
+	}
+	return refs
+}
+
+// count returns how many package archives refer to the stored
+// archive with the given ID.
+func (refs *storageRefs) count(id string) int {
+	if n := refs.ids[id]; n > 0 {
+		return n
+	}
+	// a content addressed ID is "<prefix>sha256-<sum>"
+	if i := strings.LastIndex(id, "sha256-"); i >= 0 && refs.sums[id[i+len("sha256-"):]] {
+		return 1
+	}
+	return 0
+}
+
+// storageOrphans lists the stored archives no package refers to, in
+// any namespace.
+func storageOrphans(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	output := c.String("output")
+
+	var olderThan time.Duration
+	if s := c.String("older-than"); len(s) > 0 {
+		var err error
+		olderThan, err = parseAge(s)
+		if err != nil {
+			fatal(fmt.Sprintf("Invalid --older-than '%v': %v", s, err))
+		}
+	}
+
+	stats, err := getStorageClient(client).Stats()
+	checkErr(err, "get storage service stats")
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+	refs := makeStorageRefs(pkgs)
+
+	orphans := make([]storagesvc.ArchiveStats, 0)
+	for _, a := range stats.Items {
+		if refs.count(a.ID) > 0 {
+			continue
+		}
+		if olderThan > 0 && time.Since(a.Modified) < olderThan {
+			continue
+		}
+		orphans = append(orphans, a)
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Modified.Before(orphans[j].Modified)
+	})
+
+	if output == "json" {
+		out, err := json.MarshalIndent(orphans, "", "    ")
+		checkErr(err, "print orphaned archives")
+		fmt.Println(string(out))
+		return nil
+	}
+
+	var total int64
+	t := newTable("ID", "SIZE", "AGE")
+	for _, a := range orphans {
+		total += a.Size
+		age := "-"
+		if !a.Modified.IsZero() {
+			age = time.Since(a.Modified).Round(time.Second).String()
+		}
+		t.addRow(a.ID, formatSize(a.Size), age)
+	}
+	err = t.print(os.Stdout, output)
+	checkErr(err, "print orphaned archives")
+	fmt.Printf("%v orphaned archives, %v\n", len(orphans), formatSize(total))
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission/storagesvc"
+	"github.com/fission/fission/tpr"
+)
+
+// dedupStats is how well identical archives are shared: by packages,
+// which refer to the same stored archive when made from the same
+// content, and by uploads, which the storage service stores once.
+type dedupStats struct {
+	// Archives and StoredBytes cover everything stored.
+	Archives    int   `json:"archives"`
+	StoredBytes int64 `json:"storedBytes"`
+
+	// PackageReferences counts the archives of packages that are
+	// in the storage service; LogicalBytes is their total size, as
+	// if each was stored on its own, and PhysicalBytes the size of
+	// the distinct archives they refer to.
+	PackageReferences int   `json:"packageReferences"`
+	LogicalBytes      int64 `json:"logicalBytes"`
+	PhysicalBytes     int64 `json:"physicalBytes"`
+	SavedBytes        int64 `json:"savedBytes"`
+
+	// SharedArchives are referred to by more than one package.
+	SharedArchives int `json:"sharedArchives"`
+
+	// UnreferencedArchives aren't referred to by any package,
+	// e.g. warm archives or leftovers of failed package creation.
+	UnreferencedArchives int   `json:"unreferencedArchives"`
+	UnreferencedBytes    int64 `json:"unreferencedBytes"`
+
+	// Uploads counts all uploads, DedupedUploads those that found
+	// their content already stored.
+	Uploads        int   `json:"uploads"`
+	DedupedUploads int   `json:"dedupedUploads"`
+	UploadedBytes  int64 `json:"uploadedBytes"`
+}
+
+// makeDedupStats cross-references the packages' archives with the
+// storage service's stats.
+func makeDedupStats(stats *storagesvc.StorageStats, pkgs []tpr.Package) *dedupStats {
+	d := &dedupStats{
+		Archives:       stats.Archives,
+		StoredBytes:    stats.Bytes,
+		Uploads:        stats.Uploads,
+		DedupedUploads: stats.DedupedUploads,
+		UploadedBytes:  stats.LogicalBytes,
+	}
+
+	refs := makeStorageRefs(pkgs)
+	for _, a := range stats.Items {
+		n := refs.count(a.ID)
+		if n == 0 {
+			d.UnreferencedArchives++
+			d.UnreferencedBytes += a.Size
+			continue
+		}
+		d.PackageReferences += n
+		d.LogicalBytes += a.Size * int64(n)
+		d.PhysicalBytes += a.Size
+		if n > 1 {
+			d.SharedArchives++
+		}
+	}
+	d.SavedBytes = d.LogicalBytes - d.PhysicalBytes
+	return d
+}
+
+// percent formats part/total as a percentage.
+func percent(part, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+}
+
+// storageStats reports how much deduplication saves in the storage
+// service.
+func storageStats(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	output := c.String("output")
+
+	stats, err := getStorageClient(client).Stats()
+	checkErr(err, "get storage service stats")
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+	d := makeDedupStats(stats, pkgs)
+
+	if output == "json" {
+		out, err := json.MarshalIndent(d, "", "    ")
+		checkErr(err, "print storage stats")
+		fmt.Println(string(out))
+		return nil
+	}
+
+	t := newTable("STAT", "VALUE")
+	t.addRow("Stored archives", fmt.Sprintf("%v (%v)", d.Archives, formatSize(d.StoredBytes)))
+	t.addRow("Package references", fmt.Sprintf("%v to %v archives", d.PackageReferences, d.Archives-d.UnreferencedArchives))
+	t.addRow("Logical bytes", formatSize(d.LogicalBytes))
+	t.addRow("Physical bytes", formatSize(d.PhysicalBytes))
+	t.addRow("Saved by dedup", fmt.Sprintf("%v (%v)", formatSize(d.SavedBytes), percent(d.SavedBytes, d.LogicalBytes)))
+	t.addRow("Shared archives", fmt.Sprint(d.SharedArchives))
+	t.addRow("Unreferenced archives", fmt.Sprintf("%v (%v)", d.UnreferencedArchives, formatSize(d.UnreferencedBytes)))
+	t.addRow("Deduplicated uploads", fmt.Sprintf("%v of %v (%v)", d.DedupedUploads, d.Uploads, percent(int64(d.DedupedUploads), int64(d.Uploads))))
+	err = t.print(os.Stdout, output)
+	checkErr(err, "print storage stats")
+	return nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// supplyChainArchiveOptions returns the options used to store SBOM
+// and attestation files: uncompressed and untransformed, so that
+// they are stored as given.
+func supplyChainArchiveOptions(opts archiveOptions) archiveOptions {
+	return archiveOptions{
+		assumeYes:       true,
+		storagePrefix:   opts.storagePrefix,
+		bufferSize:      opts.bufferSize,
+		compression:     "none",
+		scanConcurrency: defaultScanConcurrency,
+		inlineLimit:     opts.inlineLimit,
+		mirrors:         opts.mirrors,
+		archiveTTL:      opts.archiveTTL,
+	}
+}
+
+// attachSupplyChainFiles stores the --sbom and --attestation files
+// with a package. The attestation must be an in-toto statement; it is
+// not required to cover the package's archives until verified.
+func attachSupplyChainFiles(client *client.Client, pkgSpec *fission.PackageSpec, opts archiveOptions) error {
+	if len(opts.sbom) > 0 {
+		archive, err := createArchive(client, opts.sbom, supplyChainArchiveOptions(opts))
+		if err != nil {
+			return fmt.Errorf("store SBOM %v: %w", opts.sbom, err)
+		}
+		pkgSpec.SBOM = archive
+	}
+	if len(opts.attestation) > 0 {
+		contents, err := ioutil.ReadFile(opts.attestation)
+		if err != nil {
+			return err
+		}
+		_, err = fission.ParseAttestation(contents)
+		if err != nil {
+			return fmt.Errorf("attestation %v: %w", opts.attestation, err)
+		}
+		archive, err := createArchive(client, opts.attestation, supplyChainArchiveOptions(opts))
+		if err != nil {
+			return fmt.Errorf("store attestation %v: %w", opts.attestation, err)
+		}
+		pkgSpec.Attestation = archive
+	}
+	return nil
+}
+
+// readArchive returns the contents of an archive, verifying its
+// checksum.
+func readArchive(client *client.Client, archive *fission.Archive) ([]byte, error) {
+	if archive.Type == fission.ArchiveTypeLiteral {
+		if err := fission.VerifyLiteral(archive); err != nil {
+			return nil, err
+		}
+		return archive.Literal, nil
+	}
+	dir, err := ioutil.TempDir("", "fission-archive")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "archive")
+	err = downloadArchive(client, archive, fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(fileName)
+}
+
+func pkgVerify(c *cli.Context) error {
+	if c.Bool("all") || c.Bool("sample") || c.IsSet("state-file") {
+		return pkgVerifyAll(c)
+	}
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	if len(pkgName) == 0 {
+		fatalUsage("Need name of package, use --name")
+	}
+
+	pkg, err := client.PackageGet(&metav1.ObjectMeta{Name: pkgName, Namespace: packageNamespace})
+	checkErr(err, fmt.Sprintf("read package '%v'", pkgName))
+	pkg, err = resolveAlias(client, pkg)
+	checkErr(err, fmt.Sprintf("resolve package '%v'", pkgName))
+
+	// with checkpoints, the archives' contents are checked too
+	checkpointDir := c.String("checkpoint-dir")
+	if len(checkpointDir) > 0 {
+		verifyPackageArchives(client, pkg, checkpointDir)
+	}
+
+	logged, logFailed := verifyTransparency(pkg)
+	if logFailed {
+		fatalWithCode(exitCodeInvalidChecksum, fmt.Sprintf("Package '%v' doesn't match its transparency log entries.", pkg.Metadata.Name))
+	}
+
+	if pkg.Spec.SBOM != nil {
+		_, err = readArchive(client, pkg.Spec.SBOM)
+		checkErr(err, "read SBOM")
+	}
+	if pkg.Spec.Attestation == nil {
+		if logged > 0 {
+			fmt.Printf("package '%v' matches its transparency log entries\n", pkg.Metadata.Name)
+			return nil
+		}
+		if len(checkpointDir) > 0 {
+			fmt.Printf("package '%v' matches its checksums\n", pkg.Metadata.Name)
+			return nil
+		}
+		fatal(fmt.Sprintf("Package '%v' has no attestation or transparency log entries.", pkg.Metadata.Name))
+	}
+	contents, err := readArchive(client, pkg.Spec.Attestation)
+	checkErr(err, "read attestation")
+	statement, err := fission.ParseAttestation(contents)
+	checkErr(err, "parse attestation")
+
+	// a deployment built from the source isn't known when the
+	// attestation is made, so only the source must be covered
+	built := len(pkg.Spec.Source.Type) > 0
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "%v\t%v\t%v\n", "ARCHIVE", "SHA256", "ATTESTED")
+	failed := false
+	for _, a := range []struct {
+		name     string
+		archive  *fission.Archive
+		required bool
+	}{
+		{"source", &pkg.Spec.Source, true},
+		{"deployment", &pkg.Spec.Deployment, !built},
+	} {
+		if len(a.archive.Type) == 0 {
+			continue
+		}
+		sum, ok := fission.ArchiveSHA256(a.archive)
+		attested := "no"
+		var literalErr error
+		if a.archive.Type == fission.ArchiveTypeLiteral {
+			literalErr = fission.VerifyLiteral(a.archive)
+		}
+		switch {
+		case literalErr != nil:
+			attested = "checksum mismatch"
+			failed = true
+		case !ok:
+			attested = "unknown checksum"
+		case statement.Covers(sum):
+			attested = "yes"
+		case !a.required:
+			attested = "no (built)"
+		}
+		if attested != "yes" && a.required {
+			failed = true
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", a.name, sum, attested)
+	}
+	w.Flush()
+
+	if failed {
+		fatalWithCode(exitCodeInvalidChecksum, fmt.Sprintf("Package '%v' doesn't match its attestation.", pkg.Metadata.Name))
+	}
+	fmt.Printf("package '%v' matches its attestation\n", pkg.Metadata.Name)
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fission/fission"
+)
+
+// defaultTruncateWidth is how many characters of UUIDs tables show by
+// default, as many as the UUID's first group.
+const defaultTruncateWidth = 8
+
+// Table rendering settings, set by global flags.
+var (
+	// truncateWidth is how many characters of UUIDs tables show;
+	// 0 shows them whole, as --no-truncate does.
+	truncateWidth = defaultTruncateWidth
+
+	// colorOutput colors tables, if stdout is a terminal and
+	// NO_COLOR isn't set.
+	colorOutput = false
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}(-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12}$`)
+
+// ANSI escape sequences used to color tables.
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// buildStatusColors are the colors of build statuses in tables.
+var buildStatusColors = map[string]string{
+	fission.BuildStatusSucceeded:      colorGreen,
+	fission.BuildStatusFailed:         colorRed,
+	fission.BuildStatusPending:        colorYellow,
+	fission.BuildStatusRunning:        colorYellow,
+	fission.BuildStatusAwaitingUpload: colorYellow,
+}
+
+// useColor says whether output to stdout should be colored: only if
+// it's a terminal, and NO_COLOR (https://no-color.org) isn't set.
+func useColor() bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// table is the output of a list command: rows under column headers,
+// printed as aligned text or as JSON.
+type table struct {
+	headers []string
+	rows    [][]string
+
+	// colors colors the cells of a column by value.
+	colors map[int]map[string]string
+}
+
+func newTable(headers ...string) *table {
+	return &table{headers: headers, colors: make(map[int]map[string]string)}
+}
+
+// addRow adds a row, formatting each value with %v. Missing values
+// are left empty.
+func (t *table) addRow(values ...interface{}) {
+	row := make([]string, len(t.headers))
+	for i := range row {
+		if i < len(values) {
+			row[i] = fmt.Sprintf("%v", values[i])
+		}
+	}
+	t.rows = append(t.rows, row)
+}
+
+// colorBuildStatus colors the named column's build statuses.
+func (t *table) colorBuildStatus(header string) {
+	for i, h := range t.headers {
+		if h == header {
+			t.colors[i] = buildStatusColors
+		}
+	}
+}
+
+// cell returns a cell as printed in text: UUIDs truncated, unless
+// truncateWidth is 0.
+func (t *table) cell(value string) string {
+	if truncateWidth > 0 && utf8.RuneCountInString(value) > truncateWidth && uuidRegexp.MatchString(value) {
+		return value[:truncateWidth]
+	}
+	return value
+}
+
+// print writes the table in the given output format, table or json.
+// JSON has a list of objects keyed by lowercased header, with values
+// neither truncated nor colored.
+func (t *table) print(w io.Writer, output string) error {
+	if output == "json" {
+		objs := make([]map[string]string, len(t.rows))
+		for i, row := range t.rows {
+			objs[i] = make(map[string]string, len(row))
+			for j, v := range row {
+				objs[i][strings.ToLower(t.headers[j])] = v
+			}
+		}
+		out, err := json.MarshalIndent(objs, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	}
+
+	rows := make([][]string, 0, len(t.rows)+1)
+	rows = append(rows, t.headers)
+	for _, row := range t.rows {
+		cells := make([]string, len(row))
+		for i, v := range row {
+			cells[i] = t.cell(v)
+		}
+		rows = append(rows, cells)
+	}
+
+	widths := make([]int, len(t.headers))
+	for _, row := range rows {
+		for i, v := range row {
+			if n := utf8.RuneCountInString(v); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	for r, row := range rows {
+		var line strings.Builder
+		for i, v := range row {
+			text := v
+			if color, ok := t.colors[i][v]; ok && colorOutput && r > 0 {
+				text = color + v + colorReset
+			}
+			line.WriteString(text)
+			// like tabwriter, pad every column but the last
+			if i < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(v)+1))
+			}
+		}
+		_, err := fmt.Fprintln(w, line.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOutputFormat exits if output isn't a format tables print.
+func checkOutputFormat(output string) {
+	if output != "table" && output != "json" {
+		fatal(fmt.Sprintf("Unknown --output '%v', use table or json.", output))
+	}
+}
@@ -19,7 +19,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"text/tabwriter"
 
 	"github.com/satori/go.uuid"
 	"github.com/urfave/cli"
@@ -38,17 +37,17 @@ func ttCreate(c *cli.Context) error {
 	}
 	fnName := c.String("function")
 	if len(fnName) == 0 {
-		fatal("Need a function name to create a trigger, use --function")
+		fatalUsage("Need a function name to create a trigger, use --function")
 	}
 	cron := c.String("cron")
 	if len(cron) == 0 {
-		fatal("Need a cron spec like '0 30 * * *', '@every 1h30m', or '@hourly'; use --cron")
+		fatalUsage("Need a cron spec like '0 30 * * *', '@every 1h30m', or '@hourly'; use --cron")
 	}
 
 	tt := &tpr.Timetrigger{
 		Metadata: metav1.ObjectMeta{
 			Name:      name,
-			Namespace: metav1.NamespaceDefault,
+			Namespace: packageNamespace,
 		},
 		Spec: fission.TimeTriggerSpec{
 			Cron: cron,
@@ -74,12 +73,12 @@ func ttUpdate(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 	ttName := c.String("name")
 	if len(ttName) == 0 {
-		fatal("Need name of trigger, use --name")
+		fatalUsage("Need name of trigger, use --name")
 	}
 
 	tt, err := client.TimeTriggerGet(&metav1.ObjectMeta{
 		Name:      ttName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, "get time trigger")
 
@@ -96,7 +95,7 @@ func ttUpdate(c *cli.Context) error {
 	}
 
 	if !updated {
-		fatal("Nothing to update. Use --cron or --function.")
+		fatalUsage("Nothing to update. Use --cron or --function.")
 	}
 
 	_, err = client.TimeTriggerUpdate(tt)
@@ -110,12 +109,12 @@ func ttDelete(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 	ttName := c.String("name")
 	if len(ttName) == 0 {
-		fatal("Need name of trigger to delete, use --name")
+		fatalUsage("Need name of trigger to delete, use --name")
 	}
 
 	err := client.TimeTriggerDelete(&metav1.ObjectMeta{
 		Name:      ttName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, "delete trigger")
 
@@ -126,17 +125,15 @@ func ttDelete(c *cli.Context) error {
 func ttList(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 
+	output := c.String("output")
+	checkOutputFormat(output)
+
 	tts, err := client.TimeTriggerList()
 	checkErr(err, "list Time triggers")
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-
-	fmt.Fprintf(w, "%v\t%v\t%v\n", "NAME", "CRON", "FUNCTION_NAME")
+	t := newTable("NAME", "CRON", "FUNCTION_NAME")
 	for _, tt := range tts {
-		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n",
-			tt.Metadata.Name, tt.Spec.Cron, tt.Spec.FunctionReference.Name)
+		t.addRow(tt.Metadata.Name, tt.Spec.Cron, tt.Spec.FunctionReference.Name)
 	}
-	w.Flush()
-
-	return nil
+	return t.print(os.Stdout, output)
 }
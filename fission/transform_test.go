@@ -0,0 +1,76 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fission/fission"
+)
+
+func TestNormalizeEOL(t *testing.T) {
+	files := []struct {
+		name, contents, normalized string
+	}{
+		{"index.js", "a\r\nb\r\n", "a\nb\n"},
+		// no known extension, but text
+		{"Makefile", "all:\r\n\tgo build\r\n", "all:\n\tgo build\n"},
+		{"lone.txt", "a\rb\r\n", "a\rb\n"},
+		// Windows scripts need CRLF
+		{"run.bat", "echo hi\r\n", "echo hi\r\n"},
+		{"logo.png", "\x89PNG\r\n", "\x89PNG\r\n"},
+		// no known extension, and binary
+		{"blob", "\x00\x01\r\n", "\x00\x01\r\n"},
+	}
+
+	dir, err := ioutil.TempDir("", "fission-eol-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	panicIf(os.Mkdir(src, 0755))
+	for _, f := range files {
+		panicIf(ioutil.WriteFile(filepath.Join(src, f.name), []byte(f.contents), 0644))
+	}
+
+	opts := archiveOptions{assumeYes: true, scanConcurrency: 1}
+	packed, _, err := packDirArchive(src, opts, false)
+	panicIf(err)
+	defer os.Remove(packed)
+	transformed, cleanup, err := transformArchive(packed, []string{fission.NormalizeEOLTransform})
+	panicIf(err)
+	defer cleanup()
+
+	r, err := zip.OpenReader(transformed)
+	panicIf(err)
+	defer r.Close()
+	got := make(map[string]string)
+	for _, zf := range r.File {
+		contents, err := readZipFile(zf)
+		panicIf(err)
+		got[zf.Name] = string(contents)
+	}
+	for _, f := range files {
+		if got[f.name] != f.normalized {
+			log.Panicf("Expected %v to be %q, got %q", f.name, f.normalized, got[f.name])
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/tpr"
+)
+
+// The transparency log API follows Rekor's paths but isn't Rekor's:
+// entries are created by POSTing a TransparencyEntryBody to
+// <log>/api/v1/log/entries, and read back from
+// <log>/api/v1/log/entries/<uuid>. Both answer with a single
+// transparencyLogEntry, which for a new entry includes its proof,
+// where Rekor takes a typed proposed entry and answers with a map of
+// UUIDs to entries. Rekor itself needs a proxy translating between
+// the two.
+
+// transparencyLogTimeout bounds each request to the transparency log.
+const transparencyLogTimeout = 10 * time.Second
+
+// errTransparencyEntryNotFound means the log has no entry of a UUID.
+var errTransparencyEntryNotFound = errors.New("entry not found in transparency log")
+
+type transparencyLogEntry struct {
+	UUID           string `json:"uuid"`
+	LogIndex       int64  `json:"logIndex"`
+	IntegratedTime int64  `json:"integratedTime"`
+	Body           string `json:"body"`
+	Verification   struct {
+		InclusionProof fission.InclusionProof `json:"inclusionProof"`
+	} `json:"verification"`
+}
+
+// transparencyRequest sends a request to a URL of a transparency log
+// and decodes the entry it answers with. An entry that already exists
+// is read from the Location the log answers with.
+func transparencyRequest(method string, logUrl string, reqUrl string, body []byte) (*fission.TransparencyEntry, error) {
+	req, err := http.NewRequest(method, reqUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(fission.RequestIdHeader, requestId)
+	client := &http.Client{Timeout: transparencyLogTimeout}
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict && len(resp.Header.Get("Location")) > 0:
+		loc, err := req.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return nil, fmt.Errorf("transparency log entry location: %w", err)
+		}
+		return transparencyRequest(http.MethodGet, logUrl, loc.String(), nil)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errTransparencyEntryNotFound
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("transparency log error %v: %v", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var e transparencyLogEntry
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	if err != nil {
+		return nil, fmt.Errorf("read transparency log entry: %w", err)
+	}
+	return &fission.TransparencyEntry{
+		Log:            logUrl,
+		UUID:           e.UUID,
+		LogIndex:       e.LogIndex,
+		IntegratedTime: e.IntegratedTime,
+		Body:           e.Body,
+		InclusionProof: e.Verification.InclusionProof,
+	}, nil
+}
+
+// transparencyEntriesUrl returns the URL of a log's entries.
+func transparencyEntriesUrl(logUrl string) string {
+	return strings.TrimSuffix(logUrl, "/") + "/api/v1/log/entries"
+}
+
+// loggedArchives returns the transparency log entries of a package's
+// archives by their hex SHA256 sums, so an update keeping an archive
+// keeps its entry instead of logging it again.
+func loggedArchives(pkgSpec *fission.PackageSpec) map[string]*fission.TransparencyEntry {
+	logged := make(map[string]*fission.TransparencyEntry)
+	for _, archive := range []*fission.Archive{&pkgSpec.Source, &pkgSpec.Deployment} {
+		if archive.Transparency == nil {
+			continue
+		}
+		if sum, ok := fission.ArchiveSHA256(archive); ok {
+			logged[strings.ToLower(sum)] = archive.Transparency
+		}
+	}
+	return logged
+}
+
+// logArchive records an archive's checksum in the transparency log,
+// storing the entry and its proof on the archive. An archive the
+// package being updated already logged there keeps its entry. The
+// log is only an audit trail, so failing to reach it is a warning.
+func logArchive(archive *fission.Archive, name string, logUrl string, logged map[string]*fission.TransparencyEntry) {
+	sum, ok := fission.ArchiveSHA256(archive)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Warning: not logging %v, which has no SHA256 checksum\n", name)
+		return
+	}
+	if entry := logged[strings.ToLower(sum)]; entry != nil && entry.Log == logUrl && entry.Verify(sum) == nil {
+		verbose("%v is unchanged, keeping its entry %v in %v", name, entry.UUID, logUrl)
+		archive.Transparency = entry
+		return
+	}
+	body, err := json.Marshal(fission.TransparencyEntryBody{
+		Kind:   fission.TransparencyEntryKind,
+		Name:   name,
+		SHA256: sum,
+	})
+	if err != nil {
+		fatal(err.Error())
+	}
+	entry, err := transparencyRequest(http.MethodPost, logUrl, transparencyEntriesUrl(logUrl), body)
+	if err == nil {
+		err = entry.Verify(sum)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to log %v in transparency log %v: %v\n", name, logUrl, err)
+		return
+	}
+	verbose("Logged %v in %v as entry %v at index %v", name, logUrl, entry.UUID, entry.LogIndex)
+	archive.Transparency = entry
+}
+
+// logPackageArchives logs the source and deployment archives of a
+// package spec with --transparency-log, but for those
+// opts.loggedArchives has entries of.
+func logPackageArchives(pkgSpec *fission.PackageSpec, srcArchiveName, deployArchiveName string, opts archiveOptions) {
+	if len(opts.transparencyLog) == 0 {
+		return
+	}
+	if len(pkgSpec.Source.Type) > 0 {
+		logArchive(&pkgSpec.Source, srcArchiveName, opts.transparencyLog, opts.loggedArchives)
+	}
+	if len(pkgSpec.Deployment.Type) > 0 {
+		logArchive(&pkgSpec.Deployment, deployArchiveName, opts.transparencyLog, opts.loggedArchives)
+	}
+}
+
+// verifyTransparency checks the transparency log entries of a
+// package's archives and prints a line for each. Proofs are checked
+// offline; an entry the log no longer has fails, but a log that can't
+// be reached is only a warning. It returns how many archives have
+// entries, and whether any failed.
+func verifyTransparency(pkg *tpr.Package) (int, bool) {
+	logged, failed := 0, false
+	for _, a := range []struct {
+		name    string
+		archive *fission.Archive
+	}{
+		{"source", &pkg.Spec.Source},
+		{"deployment", &pkg.Spec.Deployment},
+	} {
+		entry := a.archive.Transparency
+		if entry == nil {
+			continue
+		}
+		logged++
+		sum, _ := fission.ArchiveSHA256(a.archive)
+		if err := entry.Verify(sum); err != nil {
+			fmt.Printf("%v: transparency log entry %v: %v\n", a.name, entry.UUID, err)
+			failed = true
+			continue
+		}
+		logEntry, err := transparencyRequest(http.MethodGet, entry.Log, transparencyEntriesUrl(entry.Log)+"/"+entry.UUID, nil)
+		switch {
+		case err == nil && logEntry.Body != entry.Body:
+			fmt.Printf("%v: transparency log %v has a different entry %v\n", a.name, entry.Log, entry.UUID)
+			failed = true
+		case errors.Is(err, errTransparencyEntryNotFound):
+			fmt.Printf("%v: transparency log %v has no entry %v\n", a.name, entry.Log, entry.UUID)
+			failed = true
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Warning: couldn't confirm %v entry %v with transparency log %v: %v\n", a.name, entry.UUID, entry.Log, err)
+			fmt.Printf("%v: proven in transparency log at index %v (unconfirmed)\n", a.name, entry.LogIndex)
+		default:
+			fmt.Printf("%v: in transparency log at index %v\n", a.name, entry.LogIndex)
+		}
+	}
+	return logged, failed
+}
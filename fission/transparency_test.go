@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/fission/fission"
+)
+
+// The leaves and roots of the RFC 6962 test tree, as in the
+// certificate-transparency reference implementation's tests.
+var transparencyTestLeaves = []string{
+	"", "00", "10", "2021", "3031", "40414243",
+	"5051525354555657", "606162636465666768696a6b6c6d6e6f",
+}
+
+var transparencyTestRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	proofs := []struct {
+		index, size int64
+		hashes      []string
+	}{
+		{0, 1, nil},
+		{0, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{5, 8, []string{
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 3, []string{
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		}},
+		{1, 5, []string{
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+		{3, 4, []string{
+			"0298d122906dcfc10892cb53a73992fc5b9f493ea4c9badb27b791b4127a7fe7",
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		}},
+		// the last leaf of a tree that isn't a power of two
+		{4, 5, []string{
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{6, 7, []string{
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+	}
+
+	for _, p := range proofs {
+		leaf, err := hex.DecodeString(transparencyTestLeaves[p.index])
+		panicIf(err)
+		proof := fission.InclusionProof{
+			LogIndex: p.index,
+			TreeSize: p.size,
+			RootHash: transparencyTestRoots[p.size-1],
+			Hashes:   p.hashes,
+		}
+		if err := proof.VerifyInclusion(leaf); err != nil {
+			log.Panicf("Expected leaf %v of %v to be proven, got %v", p.index, p.size, err)
+		}
+
+		invalid := map[string]fission.InclusionProof{}
+		other := proof
+		other.LogIndex = (p.index + 1) % p.size
+		if p.size > 1 {
+			invalid["another index"] = other
+		}
+		other = proof
+		other.RootHash = transparencyTestRoots[(p.size)%8]
+		invalid["another root"] = other
+		other = proof
+		other.Hashes = append(append([]string{}, p.hashes...), transparencyTestRoots[0])
+		invalid["an extra hash"] = other
+		if len(p.hashes) > 0 {
+			other = proof
+			other.Hashes = p.hashes[:len(p.hashes)-1]
+			invalid["a missing hash"] = other
+		}
+		for name, proof := range invalid {
+			if err := proof.VerifyInclusion(leaf); !errors.Is(err, fission.ErrInvalidInclusionProof) {
+				log.Panicf("Expected a proof of leaf %v of %v with %v to fail, got %v", p.index, p.size, name, err)
+			}
+		}
+		if err := proof.VerifyInclusion(append(leaf, 0)); !errors.Is(err, fission.ErrInvalidInclusionProof) {
+			log.Panicf("Expected a proof of another leaf to fail, got %v", err)
+		}
+	}
+
+	// the last leaf of 5 has a single hash; in a tree of 8 it has 3
+	leaf, err := hex.DecodeString(transparencyTestLeaves[4])
+	panicIf(err)
+	proof := fission.InclusionProof{LogIndex: 4, TreeSize: 8, RootHash: transparencyTestRoots[4], Hashes: proofs[6].hashes}
+	if err := proof.VerifyInclusion(leaf); !errors.Is(err, fission.ErrInvalidInclusionProof) {
+		log.Panicf("Expected a proof for another tree size to fail, got %v", err)
+	}
+	proof = fission.InclusionProof{LogIndex: 8, TreeSize: 8, RootHash: transparencyTestRoots[7]}
+	if err := proof.VerifyInclusion(nil); !errors.Is(err, fission.ErrInvalidInclusionProof) {
+		log.Panicf("Expected an index out of the tree to fail, got %v", err)
+	}
+}
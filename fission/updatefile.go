@@ -0,0 +1,301 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+)
+
+// errNotContainer means an archive is a single file rather than a
+// zip or packed files, so there is no file in it to replace.
+var errNotContainer = errors.New("archive is a single file, not a zip or packed files")
+
+// The --checksum-policy of update-file decides which checks an update
+// pays for. The updated archive's checksum is always computed while
+// it is packed: it's what fetchers and "package verify" check the
+// stored bytes against, so verifying works the same whatever the
+// policy. What the policies change is what is known to be right when
+// the update is done:
+//
+//   - recompute, the default, verifies the old archive against its
+//     checksum before using its files, and downloads the stored
+//     update to check it again. Damage to the old archive, or to the
+//     update on its way to or in storage, is found before the
+//     package changes, for two downloads and three hashes of the
+//     archive.
+//   - trust relies on the storage service having checked the update
+//     against its checksum as it was stored, instead of downloading
+//     it again; updates the storage service didn't check are
+//     downloaded as with recompute. Damage in storage after that
+//     check is only found by the fetcher or "package verify".
+//   - skip doesn't verify anything. If the old archive was damaged,
+//     its damaged files are packed into the update under a checksum
+//     that matches them, so no later verification can tell.
+//
+// Policies other than recompute are recorded on the package in
+// checksumPolicyAnnotation.
+const (
+	checksumPolicyRecompute = "recompute"
+	checksumPolicyTrust     = "trust"
+	checksumPolicySkip      = "skip"
+
+	checksumPolicyAnnotation = "fission.io/checksum-policy"
+
+	// update checks of updateCheck
+	updateCheckDownload = "download"
+	updateCheckServer   = "server"
+	updateCheckLiteral  = "literal"
+	updateCheckNone     = "none"
+)
+
+// parseChecksumPolicy checks a --checksum-policy, defaulting to
+// recompute.
+func parseChecksumPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return checksumPolicyRecompute, nil
+	case checksumPolicyRecompute, checksumPolicyTrust, checksumPolicySkip:
+		return policy, nil
+	}
+	return "", flagError(fmt.Sprintf("Unknown --checksum-policy '%v', use %v, %v or %v", policy, checksumPolicyRecompute, checksumPolicyTrust, checksumPolicySkip))
+}
+
+// updateCheck returns how an updated archive is checked once stored
+// under a policy. Embedded archives are checked in memory, which is
+// cheap, unless checks are skipped.
+func updateCheck(policy string, archive *fission.Archive) string {
+	switch {
+	case policy == checksumPolicySkip:
+		return updateCheckNone
+	case archive.Type == fission.ArchiveTypeLiteral:
+		return updateCheckLiteral
+	case policy == checksumPolicyTrust && archive.ServerChecksum != nil:
+		return updateCheckServer
+	}
+	return updateCheckDownload
+}
+
+// unpackArchive extracts the files of a zip or packed archive into
+// dst, verifying its checksum first. Downloads are staged in tmpDir.
+func unpackArchive(client *client.Client, archive *fission.Archive, tmpDir string, dst string) error {
+	if archive.Packing == fission.ArchivePackingTar {
+		err := fission.VerifyLiteral(archive)
+		if err != nil {
+			return err
+		}
+		return fission.UnpackFiles(archive.Literal, dst)
+	}
+
+	zipFile := filepath.Join(tmpDir, "archive.zip")
+	if len(archive.Literal) > 0 {
+		err := fission.VerifyLiteral(archive)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(zipFile, archive.Literal, 0600)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := downloadArchive(client, archive, zipFile)
+		if err != nil {
+			return err
+		}
+		err = decompressFile(zipFile, archive.Compression)
+		if err != nil {
+			return err
+		}
+	}
+	if !isZip(zipFile) {
+		return errNotContainer
+	}
+	return unpackZip(zipFile, dst)
+}
+
+// verifyStoredArchive checks that an archive's stored contents match
+// its checksum.
+func verifyStoredArchive(client *client.Client, archive *fission.Archive, tmpDir string) error {
+	if archive.Type == fission.ArchiveTypeLiteral {
+		return fission.VerifyLiteral(archive)
+	}
+	tmpfile := filepath.Join(tmpDir, "verify")
+	defer os.Remove(tmpfile)
+	return downloadArchive(client, archive, tmpfile)
+}
+
+// copyFile copies a regular file, keeping its permissions.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%v isn't a regular file", src)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// pkgUpdateFile replaces one file in a package's source archive, or
+// its deployment archive with --deployment, for hotfixes that don't
+// warrant uploading the whole tree again. The archive is downloaded
+// and verified, the file replaced (or added), and the archive packed
+// and stored again the way it was, then verified once stored, as
+// --checksum-policy allows. A package whose source changed goes back
+// to pending, to be built again.
+func pkgUpdateFile(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	if len(pkgName) == 0 {
+		fatalUsage("Need name of package, use --name")
+	}
+	relPath := c.String("path")
+	srcFile := c.String("file")
+	if len(relPath) == 0 || len(srcFile) == 0 {
+		fatalUsage("Need --path, the file in the archive to replace, and --file, the file to replace it with.")
+	}
+	relPath = path.Clean(filepath.ToSlash(relPath))
+	if path.IsAbs(relPath) || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		fatal(fmt.Sprintf("--path '%v' must be relative to the archive root, and inside it.", c.String("path")))
+	}
+	policy, err := parseChecksumPolicy(c.String("checksum-policy"))
+	if err != nil {
+		fatalUsage(err.Error())
+	}
+	opts := getArchiveOptions(c)
+
+	pkg, err := client.PackageGet(&metav1.ObjectMeta{
+		Name:      pkgName,
+		Namespace: packageNamespace,
+	})
+	checkErr(err, fmt.Sprintf("read package '%v'", pkgName))
+
+	archive := &pkg.Spec.Source
+	isSource := true
+	if c.Bool("deployment") || (len(archive.Literal) == 0 && len(archiveUrls(archive)) == 0) {
+		archive = &pkg.Spec.Deployment
+		isSource = false
+	}
+	if len(archive.Literal) == 0 && len(archiveUrls(archive)) == 0 {
+		fatal(fmt.Sprintf("Package '%v' has no archive to update", pkgName))
+	}
+	if archive.Packing == fission.ArchivePackingTar && strings.Contains(relPath, "/") {
+		fatal(fmt.Sprintf("Package '%v' holds packed files, which have no directories; --path must be a file name.", pkgName))
+	}
+
+	tmpDir, err := ioutil.TempDir(stagingDir(), "fission-update-file-")
+	checkErr(err, "create temporary directory")
+	defer os.RemoveAll(tmpDir)
+
+	unpacked := filepath.Join(tmpDir, "files")
+	old := *archive
+	if policy == checksumPolicySkip {
+		fmt.Fprintf(os.Stderr, "Warning: --checksum-policy skip: the archive of package '%v' isn't verified before it is updated\n", pkgName)
+		old.Checksum = fission.Checksum{}
+	}
+	err = unpackArchive(client, &old, tmpDir, unpacked)
+	if err == errNotContainer {
+		fatal(fmt.Sprintf("The archive of package '%v' is a single file, not a zip or packed files; create the package again instead.", pkgName))
+	}
+	checkErr(err, fmt.Sprintf("unpack archive of package '%v'", pkgName))
+
+	target := filepath.Join(unpacked, filepath.FromSlash(relPath))
+	action := "replaced"
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		action = "added"
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	checkErr(err, "create directory")
+	err = copyFile(srcFile, target)
+	checkErr(err, fmt.Sprintf("copy %v into archive", srcFile))
+
+	var updated *fission.Archive
+	if archive.Packing == fission.ArchivePackingTar {
+		var entries []os.FileInfo
+		entries, err = ioutil.ReadDir(unpacked)
+		checkErr(err, "list packed files")
+		files := make([]string, len(entries))
+		for i, e := range entries {
+			files[i] = filepath.Join(unpacked, e.Name())
+		}
+		updated, err = createPackedArchive(files, opts)
+	} else {
+		updated, err = createArchive(client, unpacked, opts)
+	}
+	checkErr(err, "pack updated archive")
+	switch check := updateCheck(policy, updated); check {
+	case updateCheckDownload, updateCheckLiteral:
+		err = verifyStoredArchive(client, updated, tmpDir)
+		checkErr(err, "verify updated archive")
+	default:
+		verbose("Updated archive of '%v' checked: %v (--checksum-policy %v)", pkgName, check, policy)
+	}
+
+	*archive = *updated
+	if policy == checksumPolicyRecompute {
+		delete(pkg.Metadata.Annotations, checksumPolicyAnnotation)
+	} else {
+		if pkg.Metadata.Annotations == nil {
+			pkg.Metadata.Annotations = make(map[string]string)
+		}
+		pkg.Metadata.Annotations[checksumPolicyAnnotation] = policy
+	}
+	if isSource {
+		pkg.Status = fission.PackageStatus{BuildStatus: fission.BuildStatusPending}
+	}
+	m, err := client.PackageUpdate(pkg)
+	checkErr(err, fmt.Sprintf("update package '%v'", pkgName))
+	err = updatePackageFunctions(client, m)
+	checkErr(err, "update functions of package")
+
+	fmt.Printf("package '%v' updated, %v %v\n", pkgName, action, relPath)
+	if isSource {
+		fmt.Println("The package will be built again")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"log"
+	"testing"
+
+	"github.com/fission/fission"
+)
+
+func TestChecksumPolicy(t *testing.T) {
+	policy, err := parseChecksumPolicy("")
+	panicIf(err)
+	if policy != checksumPolicyRecompute {
+		log.Panicf("Expected the default policy to be %v, got %v", checksumPolicyRecompute, policy)
+	}
+	if _, err := parseChecksumPolicy("sometimes"); err == nil {
+		log.Panicf("Expected an unknown policy to fail")
+	}
+
+	contents := []byte("hello")
+	sum := sha256.Sum256(contents)
+	checksum := fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:])
+	literal := &fission.Archive{Type: fission.ArchiveTypeLiteral, Literal: contents, Checksum: checksum}
+	unchecked := &fission.Archive{Type: fission.ArchiveTypeUrl, Checksum: checksum}
+	serverChecked := &fission.Archive{Type: fission.ArchiveTypeUrl, Checksum: checksum, ServerChecksum: &checksum}
+
+	for _, c := range []struct {
+		policy   string
+		archive  *fission.Archive
+		expected string
+	}{
+		{checksumPolicyRecompute, serverChecked, updateCheckDownload},
+		{checksumPolicyRecompute, literal, updateCheckLiteral},
+		{checksumPolicyTrust, serverChecked, updateCheckServer},
+		{checksumPolicyTrust, unchecked, updateCheckDownload},
+		{checksumPolicyTrust, literal, updateCheckLiteral},
+		{checksumPolicySkip, unchecked, updateCheckNone},
+		{checksumPolicySkip, literal, updateCheckNone},
+	} {
+		if check := updateCheck(c.policy, c.archive); check != c.expected {
+			log.Panicf("Policy %v checks %+v with %v, expected %v", c.policy, c.archive, check, c.expected)
+		}
+	}
+
+	// the checksum is the same whatever checked it, so verify works
+	// regardless of the policy
+	outcome, err := verifyArchiveChecksum(nil, literal, func() {}, "")
+	panicIf(err)
+	if outcome != verifyVerified {
+		log.Panicf("Expected the literal to verify, got %v", outcome)
+	}
+}
@@ -37,7 +37,7 @@ type (
 
 func getV1URL(serverUrl string) string {
 	if len(serverUrl) == 0 {
-		fatal("Need --server or FISSION_URL set to your fission server.")
+		fatalUsage("Need --server or FISSION_URL set to your fission server.")
 	}
 	isHTTPS := strings.Index(serverUrl, "https://") == 0
 	isHTTP := strings.Index(serverUrl, "http://") == 0
@@ -121,32 +121,32 @@ func (nr *nameRemapper) trackName(old string) {
 func upgradeDumpV1State(v1url string, filename string) {
 	var v1state V1FissionState
 
-	fmt.Println("Getting environments")
+	fmt.Fprintln(os.Stderr, "Getting environments")
 	resp := get(v1url + "/environments")
 	err := json.Unmarshal(resp, &v1state.Environments)
 	checkErr(err, "parse server response")
 
-	fmt.Println("Getting watches")
+	fmt.Fprintln(os.Stderr, "Getting watches")
 	resp = get(v1url + "/watches")
 	err = json.Unmarshal(resp, &v1state.Watches)
 	checkErr(err, "parse server response")
 
-	fmt.Println("Getting routes")
+	fmt.Fprintln(os.Stderr, "Getting routes")
 	resp = get(v1url + "/triggers/http")
 	err = json.Unmarshal(resp, &v1state.Httptriggers)
 	checkErr(err, "parse server response")
 
-	fmt.Println("Getting message queue triggers")
+	fmt.Fprintln(os.Stderr, "Getting message queue triggers")
 	resp = get(v1url + "/triggers/messagequeue")
 	err = json.Unmarshal(resp, &v1state.Mqtriggers)
 	checkErr(err, "parse server response")
 
-	fmt.Println("Getting time triggers")
+	fmt.Fprintln(os.Stderr, "Getting time triggers")
 	resp = get(v1url + "/triggers/time")
 	err = json.Unmarshal(resp, &v1state.Timetriggers)
 	checkErr(err, "parse server response")
 
-	fmt.Println("Getting function list")
+	fmt.Fprintln(os.Stderr, "Getting function list")
 	resp = get(v1url + "/functions")
 	err = json.Unmarshal(resp, &v1state.Functions)
 	checkErr(err, "parse server response")
@@ -184,7 +184,7 @@ func upgradeDumpV1State(v1url string, filename string) {
 		nr.trackName(e.Metadata.Name)
 	}
 
-	fmt.Println("Getting functions")
+	fmt.Fprintln(os.Stderr, "Getting functions")
 	// get each function
 	funcs := make(map[v1.Metadata]v1.Function)
 	for m := range funcMetaSet {
@@ -238,7 +238,7 @@ func functionRefFromV1Metadata(m *v1.Metadata, nameRemap map[string]string) *fis
 func tprMetadataFromV1Metadata(m *v1.Metadata, nameRemap map[string]string) *metav1.ObjectMeta {
 	return &metav1.ObjectMeta{
 		Name:      nameRemap[m.Name],
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	}
 }
 
@@ -291,21 +291,22 @@ func upgradeRestoreState(c *cli.Context) error {
 		tmpfile.Close()
 
 		// upload
-		archive := createArchive(client, tmpfile.Name())
+		archive, err := createArchive(client, tmpfile.Name(), defaultArchiveOptions())
 		os.Remove(tmpfile.Name())
+		checkErr(err, "create archive")
 
 		// create pkg
 		pkgSpec := fission.PackageSpec{
 			Environment: fission.EnvironmentReference{
 				Name:      v1state.NameChanges[f.Environment.Name],
-				Namespace: metav1.NamespaceDefault,
+				Namespace: packageNamespace,
 			},
 			Deployment: *archive,
 		}
 		pkg, err := client.PackageCreate(&tpr.Package{
 			Metadata: metav1.ObjectMeta{
 				Name:      pkgName,
-				Namespace: metav1.NamespaceDefault,
+				Namespace: packageNamespace,
 			},
 			Spec: pkgSpec,
 		})
@@ -0,0 +1,181 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/tpr"
+)
+
+// Kinds of dangling reference.
+const (
+	danglingPackage     = "missing package"
+	danglingEnvironment = "missing environment"
+	danglingArchive     = "missing archive"
+)
+
+// danglingRef is a reference to something that doesn't exist.
+type danglingRef struct {
+	Kind string `json:"kind"`
+	// From is the function or package holding the reference, as
+	// "function <ns>/<name>" or "package <ns>/<name>".
+	From string `json:"from"`
+	// To is what it refers to: a package or environment as
+	// <ns>/<name>, or an archive's storage service ID.
+	To      string `json:"to"`
+	Archive string `json:"archive,omitempty"`
+}
+
+// refKey is how a resource is named in a reference. An empty
+// namespace is the default namespace.
+func refKey(namespace, name string) string {
+	if len(namespace) == 0 {
+		namespace = metav1.NamespaceDefault
+	}
+	return namespace + "/" + name
+}
+
+// findDanglingRefs checks the references between functions, packages,
+// environments and stored archives: the package of each function, the
+// environment and alias target of each package, and the stored
+// archives of each package. stored holds the IDs in the storage
+// service; archives stored elsewhere aren't checked.
+func findDanglingRefs(fns []tpr.Function, pkgs []tpr.Package, envs []tpr.Environment, stored map[string]bool) []danglingRef {
+	pkgKeys := make(map[string]bool)
+	for _, pkg := range pkgs {
+		pkgKeys[refKey(pkg.Metadata.Namespace, pkg.Metadata.Name)] = true
+	}
+	envKeys := make(map[string]bool)
+	for _, env := range envs {
+		envKeys[refKey(env.Metadata.Namespace, env.Metadata.Name)] = true
+	}
+
+	dangling := make([]danglingRef, 0)
+	for _, fn := range fns {
+		ref := fn.Spec.Package.PackageRef
+		if len(ref.Name) == 0 {
+			continue
+		}
+		if key := refKey(ref.Namespace, ref.Name); !pkgKeys[key] {
+			dangling = append(dangling, danglingRef{
+				Kind: danglingPackage,
+				From: "function " + refKey(fn.Metadata.Namespace, fn.Metadata.Name),
+				To:   key,
+			})
+		}
+	}
+
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		from := "package " + refKey(pkg.Metadata.Namespace, pkg.Metadata.Name)
+		spec := &pkg.Spec
+		if env := spec.Environment; len(env.Name) > 0 && !envKeys[refKey(env.Namespace, env.Name)] {
+			dangling = append(dangling, danglingRef{Kind: danglingEnvironment, From: from, To: refKey(env.Namespace, env.Name)})
+		}
+		if alias := spec.AliasOf; alias != nil && !pkgKeys[refKey(alias.Namespace, alias.Name)] {
+			dangling = append(dangling, danglingRef{Kind: danglingPackage, From: from, To: refKey(alias.Namespace, alias.Name)})
+		}
+		for _, a := range []struct {
+			name    string
+			archive *fission.Archive
+		}{
+			{"source", &spec.Source},
+			{"deployment", &spec.Deployment},
+			{"built deployment", spec.BuiltDeployment},
+			{"sbom", spec.SBOM},
+			{"attestation", spec.Attestation},
+		} {
+			if a.archive == nil {
+				continue
+			}
+			var urls []string
+			urls = append(urls, archiveUrls(a.archive)...)
+			if a.archive.Manifest != nil {
+				urls = append(urls, archiveUrls(a.archive.Manifest)...)
+			}
+			for _, u := range urls {
+				if id, ok := storageIdFromUrl(u); ok && !stored[id] {
+					dangling = append(dangling, danglingRef{Kind: danglingArchive, From: from, To: id, Archive: a.name})
+				}
+			}
+		}
+	}
+	return dangling
+}
+
+// pkgValidateRefs reports functions whose packages are missing,
+// packages whose environments or alias targets are missing, and
+// packages whose archives are missing from the storage service,
+// across all namespaces. It exits non-zero if there are any, for use
+// in health checks.
+func pkgValidateRefs(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	output := c.String("output")
+	checkOutputFormat(output)
+
+	fns, err := client.FunctionList()
+	checkErr(err, "list functions")
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+	envs, err := client.EnvironmentList()
+	checkErr(err, "list environments")
+	stats, err := getStorageClient(client).Stats()
+	checkErr(err, "list stored archives")
+	stored := make(map[string]bool, len(stats.Items))
+	for _, a := range stats.Items {
+		stored[a.ID] = true
+	}
+
+	dangling := findDanglingRefs(fns, pkgs, envs, stored)
+
+	if output == "json" {
+		out, err := json.MarshalIndent(dangling, "", "    ")
+		checkErr(err, "print dangling references")
+		fmt.Println(string(out))
+	} else {
+		counts := make(map[string]int)
+		for _, kind := range []string{danglingPackage, danglingEnvironment, danglingArchive} {
+			for _, d := range dangling {
+				if d.Kind != kind {
+					continue
+				}
+				if counts[kind] == 0 {
+					fmt.Printf("%v:\n", kind)
+				}
+				counts[kind]++
+				if len(d.Archive) > 0 {
+					fmt.Printf("  %v %v archive %v\n", d.From, d.Archive, d.To)
+				} else {
+					fmt.Printf("  %v -> %v\n", d.From, d.To)
+				}
+			}
+		}
+		fmt.Printf("Checked %v functions and %v packages: %v missing packages, %v missing environments, %v missing archives\n",
+			len(fns), len(pkgs), counts[danglingPackage], counts[danglingEnvironment], counts[danglingArchive])
+	}
+
+	if len(dangling) > 0 {
+		fatal(fmt.Sprintf("%v dangling references", len(dangling)))
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/tpr"
+)
+
+// Outcomes of verifying one archive.
+const (
+	verifyVerified   = "verified"
+	verifyMismatched = "mismatched"
+	verifyMissing    = "missing"
+	verifyFailed     = "failed"
+	verifyUnchecked  = "unchecked"
+)
+
+type (
+	// archiveVerification is the outcome of verifying one archive
+	// of a package.
+	archiveVerification struct {
+		Package string `json:"package"`
+		Archive string `json:"archive"`
+		Outcome string `json:"outcome"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	// verifyJob is an archive to verify.
+	verifyJob struct {
+		pkg     *tpr.Package
+		name    string
+		archive *fission.Archive
+	}
+)
+
+// packageVerifyJobs returns the archives of a package to verify.
+func packageVerifyJobs(pkg *tpr.Package) []verifyJob {
+	var jobs []verifyJob
+	for _, a := range []struct {
+		name    string
+		archive *fission.Archive
+	}{
+		{"source", &pkg.Spec.Source},
+		{"deployment", &pkg.Spec.Deployment},
+		{"built deployment", pkg.Spec.BuiltDeployment},
+		{"sbom", pkg.Spec.SBOM},
+		{"attestation", pkg.Spec.Attestation},
+	} {
+		if a.archive != nil && len(a.archive.Type) > 0 {
+			jobs = append(jobs, verifyJob{pkg: pkg, name: a.name, archive: a.archive})
+		}
+	}
+	return jobs
+}
+
+// verifyPackageArchives downloads the archives of a single package
+// and checks them against their checksums, checkpointing to dir as
+// "verify --all" does, so an interrupted verify of a large archive
+// resumes both the download and the hash. It prints each archive's
+// outcome, and exits unless all are verified or unchecked.
+func verifyPackageArchives(client *client.Client, pkg *tpr.Package, dir string) {
+	err := os.MkdirAll(dir, 0700)
+	checkErr(err, "create checkpoint directory")
+	for _, job := range packageVerifyJobs(pkg) {
+		outcome, err := verifyArchiveChecksum(client, job.archive, func() {}, verifyCheckpointPath(dir, pkg, job.name))
+		switch outcome {
+		case verifyMismatched:
+			fatalWithCode(exitCodeInvalidChecksum, fmt.Sprintf("The %v archive of package '%v' doesn't match its checksum: %v", job.name, pkg.Metadata.Name, err))
+		case verifyMissing, verifyFailed:
+			fatal(fmt.Sprintf("Couldn't verify the %v archive of package '%v': %v", job.name, pkg.Metadata.Name, err))
+		}
+		fmt.Printf("%v: %v\n", job.name, outcome)
+	}
+}
+
+// verifyArchiveChecksum downloads an archive and checks it against its
+// checksum, without keeping its contents. wait is called before each
+// download. With a checkpoint file, the download and hash are
+// checkpointed to it, and resume from an earlier checkpoint.
+func verifyArchiveChecksum(client *client.Client, archive *fission.Archive, wait func(), checkpoint string) (string, error) {
+	if len(archive.Checksum.Sum) == 0 {
+		return verifyUnchecked, nil
+	}
+	if archive.Type == fission.ArchiveTypeLiteral {
+		if err := fission.VerifyLiteral(archive); err != nil {
+			return verifyMismatched, err
+		}
+		return verifyVerified, nil
+	}
+	if len(checkpoint) > 0 {
+		return verifyArchiveResumable(client, archive, wait, checkpoint)
+	}
+
+	h, err := fission.NewChecksumHash(archive.Checksum.Type)
+	if err != nil {
+		return verifyFailed, err
+	}
+	for _, u := range archiveUrls(archive) {
+		wait()
+		err = downloadArchiveUrl(client, u, h)
+		if errors.Is(err, fission.ErrArchiveNotFound) {
+			return verifyMissing, fmt.Errorf("%v: %w", u, err)
+		}
+		if err != nil {
+			return verifyFailed, fmt.Errorf("download %v: %w", u, err)
+		}
+	}
+	if !fission.MakeChecksum(archive.Checksum.Type, h.Sum(nil)).Equal(archive.Checksum) {
+		return verifyMismatched, fission.ErrInvalidChecksum
+	}
+	return verifyVerified, nil
+}
+
+// verifyArchiveResumable is verifyArchiveChecksum with checkpoints.
+// A checkpoint is saved when a download fails, so that the next run
+// resumes from the last byte hashed.
+func verifyArchiveResumable(client *client.Client, archive *fission.Archive, wait func(), checkpoint string) (string, error) {
+	urls := archiveUrls(archive)
+	ch, err := resumeVerification(checkpoint, archive, len(urls))
+	if err != nil {
+		return verifyFailed, err
+	}
+	resumed := ch.checkpoint.Part > 0 || ch.checkpoint.Offset > 0
+	if resumed {
+		verbose("Resuming verification from %v: part %v, offset %v", checkpoint, ch.checkpoint.Part, ch.checkpoint.Offset)
+	}
+	for ch.checkpoint.Part < len(urls) {
+		u := urls[ch.checkpoint.Part]
+		wait()
+		err = downloadArchiveUrlFrom(client, u, ch.checkpoint.Offset, ch)
+		if errors.Is(err, fission.ErrArchiveNotFound) {
+			ch.remove()
+			return verifyMissing, fmt.Errorf("%v: %w", u, err)
+		}
+		if err != nil {
+			if saveErr := ch.save(); saveErr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: couldn't save verification checkpoint: %v\n", saveErr)
+			}
+			return verifyFailed, fmt.Errorf("download %v: %w", u, err)
+		}
+		ch.nextPart()
+		err = ch.save()
+		if err != nil {
+			return verifyFailed, fmt.Errorf("save verification checkpoint: %w", err)
+		}
+	}
+	ch.remove()
+	if !fission.MakeChecksum(archive.Checksum.Type, ch.h.Sum(nil)).Equal(archive.Checksum) {
+		if resumed {
+			// the checkpoint may have been stale; make sure
+			// before reporting a mismatch
+			verbose("Resumed verification from %v didn't match, verifying from scratch", checkpoint)
+			return verifyArchiveResumable(client, archive, wait, checkpoint)
+		}
+		return verifyMismatched, fission.ErrInvalidChecksum
+	}
+	return verifyVerified, nil
+}
+
+// pkgVerifyAll checks the archives of every package in the namespace,
+// or of an environment's or a single package's, against their
+// checksums, downloading --parallel archives at a time and starting at
+// most --rate downloads a second. With --sample, only sampled ranges
+// of each archive are checked. With --state-file, results are recorded
+// as they come and --resume skips those already recorded.
+func pkgVerifyAll(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	output := c.String("output")
+	checkOutputFormat(output)
+	envName := c.String("env")
+	parallel := c.Int("parallel")
+	if parallel < 1 {
+		parallel = 1
+	}
+	rate := c.Float64("rate")
+	pkgName := c.String("name")
+	if len(pkgName) == 0 {
+		pkgName = c.Args().First()
+	}
+	sample := 0
+	if c.Bool("sample") {
+		sample = c.Int("sample-ranges")
+		if sample < 1 {
+			fatalUsage("--sample-ranges must be at least 1.")
+		}
+	}
+	checkpointDir := c.String("checkpoint-dir")
+	if len(checkpointDir) > 0 && sample > 0 {
+		fatalUsage("--checkpoint-dir and --sample can't be used together.")
+	}
+	if len(checkpointDir) > 0 {
+		err := os.MkdirAll(checkpointDir, 0700)
+		checkErr(err, "create checkpoint directory")
+	}
+	stateFile := c.String("state-file")
+	resume := c.Bool("resume")
+	if resume && len(stateFile) == 0 {
+		fatalUsage("--resume needs the --state-file of the sweep to continue.")
+	}
+
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+	var jobs []verifyJob
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		if pkg.Metadata.Namespace != packageNamespace {
+			continue
+		}
+		if len(envName) > 0 && pkg.Spec.Environment.Name != envName {
+			continue
+		}
+		if len(pkgName) > 0 && pkg.Metadata.Name != pkgName {
+			continue
+		}
+		jobs = append(jobs, packageVerifyJobs(pkg)...)
+	}
+
+	wait := func() {}
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		wait = func() { <-ticker.C }
+	}
+
+	results := make([]archiveVerification, len(jobs))
+	pending := make([]int, 0, len(jobs))
+	var sweep *verifySweep
+	if len(stateFile) > 0 {
+		header := verifySweepHeader{
+			Version:      verifySweepVersion,
+			Namespace:    packageNamespace,
+			Env:          envName,
+			Package:      pkgName,
+			SampleRanges: sample,
+		}
+		var recorded map[string]verifySweepEntry
+		sweep, recorded, err = openVerifySweep(stateFile, header, resume)
+		checkErr(err, "open verification state file")
+		defer sweep.close()
+		for i, job := range jobs {
+			e, ok := recorded[verifySweepKey(job.pkg.Metadata.Name, job.name)]
+			if ok && e.completes(job.archive) {
+				results[i] = e.archiveVerification
+				continue
+			}
+			pending = append(pending, i)
+		}
+		if resume {
+			fmt.Fprintf(os.Stderr, "Resuming %v: %v of %v archives already have results\n", stateFile, len(jobs)-len(pending), len(jobs))
+		}
+	} else {
+		for i := range jobs {
+			pending = append(pending, i)
+		}
+	}
+
+	work := make(chan int)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		done = len(jobs) - len(pending)
+	)
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				job := jobs[i]
+				checkpoint := ""
+				if len(checkpointDir) > 0 {
+					checkpoint = verifyCheckpointPath(checkpointDir, job.pkg, job.name)
+				}
+				var outcome string
+				var err error
+				if sample > 0 {
+					outcome, err = verifyArchiveSample(client, job.archive, sample, wait)
+				} else {
+					outcome, err = verifyArchiveChecksum(client, job.archive, wait, checkpoint)
+				}
+				result := archiveVerification{Package: job.pkg.Metadata.Name, Archive: job.name, Outcome: outcome}
+				if err != nil {
+					result.Error = err.Error()
+				}
+				results[i] = result
+				if sweep != nil {
+					if err := sweep.record(result, job.archive); err != nil {
+						fmt.Fprintf(os.Stderr, "Warning: couldn't record %v of package %v in %v: %v\n", job.name, result.Package, stateFile, err)
+					}
+				}
+
+				mu.Lock()
+				done++
+				if outcome != verifyVerified && outcome != verifySampled && outcome != verifyUnchecked {
+					fmt.Fprintf(os.Stderr, "[%v/%v] %v of package %v %v: %v\n",
+						done, len(jobs), job.name, result.Package, outcome, result.Error)
+				} else {
+					verbose("[%v/%v] %v of package %v %v", done, len(jobs), job.name, result.Package, outcome)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, i := range pending {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Outcome]++
+	}
+	if output == "json" {
+		out, err := json.MarshalIndent(results, "", "    ")
+		checkErr(err, "print verification")
+		fmt.Println(string(out))
+	} else {
+		t := newTable("OUTCOME", "ARCHIVES")
+		for _, outcome := range []string{verifyVerified, verifySampled, verifyMismatched, verifyMissing, verifyFailed, verifyUnchecked} {
+			t.addRow(outcome, fmt.Sprint(counts[outcome]))
+		}
+		err = t.print(os.Stdout, output)
+		checkErr(err, "print verification")
+	}
+
+	bad := counts[verifyMismatched] + counts[verifyMissing]
+	switch {
+	case counts[verifyMismatched] > 0:
+		fatalWithCode(exitCodeInvalidChecksum, fmt.Sprintf("%v of %v archives are mismatched or missing", bad, len(jobs)))
+	case bad > 0:
+		fatal(fmt.Sprintf("%v of %v archives are missing", bad, len(jobs)))
+	case counts[verifyFailed] > 0:
+		fatal(fmt.Sprintf("%v of %v archives couldn't be verified", counts[verifyFailed], len(jobs)))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/tpr"
+)
+
+// verifyCheckpointInterval is how many bytes of an archive are hashed
+// between checkpoints.
+const verifyCheckpointInterval = 64 * 1024 * 1024
+
+// verifyCheckpoint is how far the verification of an archive got:
+// the part being downloaded, the offset in it, and the state of the
+// hash of everything before. With "package verify --checkpoint-dir",
+// an interrupted verification resumes the download and the hash from
+// there, rather than starting over.
+type verifyCheckpoint struct {
+	Checksum fission.Checksum `json:"checksum"`
+	Parts    int              `json:"parts"`
+	Part     int              `json:"part"`
+	Offset   int64            `json:"offset"`
+	Hash     []byte           `json:"hash"`
+}
+
+// checkpointingHash hashes what's written to it, saving a checkpoint
+// every verifyCheckpointInterval bytes.
+type checkpointingHash struct {
+	h          hash.Hash
+	path       string
+	checkpoint verifyCheckpoint
+	unsaved    int64
+}
+
+// verifyCheckpointPath is the file under dir the checkpoint of
+// verifying one archive of a package is kept in.
+func verifyCheckpointPath(dir string, pkg *tpr.Package, archiveName string) string {
+	name := fmt.Sprintf("%v-%v-%v.json", pkg.Metadata.Namespace, pkg.Metadata.Name, strings.Replace(archiveName, " ", "-", -1))
+	return filepath.Join(dir, name)
+}
+
+// resumeVerification returns a hash of an archive's contents that
+// resumes from the checkpoint at path, if there is one for the
+// archive, or starts from scratch.
+func resumeVerification(path string, archive *fission.Archive, parts int) (*checkpointingHash, error) {
+	h, err := fission.NewChecksumHash(archive.Checksum.Type)
+	if err != nil {
+		return nil, err
+	}
+	ch := &checkpointingHash{
+		h:          h,
+		path:       path,
+		checkpoint: verifyCheckpoint{Checksum: archive.Checksum, Parts: parts},
+	}
+
+	contents, err := ioutil.ReadFile(ch.path)
+	if os.IsNotExist(err) {
+		return ch, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved verifyCheckpoint
+	err = json.Unmarshal(contents, &saved)
+	unmarshaler, ok := h.(encoding.BinaryUnmarshaler)
+	if err != nil || !ok || !saved.Checksum.Equal(archive.Checksum) || saved.Parts != parts {
+		// a checkpoint cut short, or of another archive; start
+		// over
+		return ch, nil
+	}
+	if err := unmarshaler.UnmarshalBinary(saved.Hash); err != nil {
+		h.Reset()
+		return ch, nil
+	}
+	ch.checkpoint = saved
+	return ch, nil
+}
+
+func (ch *checkpointingHash) Write(p []byte) (int, error) {
+	n, _ := ch.h.Write(p)
+	ch.checkpoint.Offset += int64(n)
+	ch.unsaved += int64(n)
+	if ch.unsaved >= verifyCheckpointInterval {
+		if err := ch.save(); err != nil {
+			return n, fmt.Errorf("save verification checkpoint: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// nextPart moves the checkpoint to the start of the next part.
+func (ch *checkpointingHash) nextPart() {
+	ch.checkpoint.Part++
+	ch.checkpoint.Offset = 0
+}
+
+// save writes the checkpoint, replacing the previous one.
+func (ch *checkpointingHash) save() error {
+	marshaler, ok := ch.h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	ch.checkpoint.Hash = state
+	contents, err := json.Marshal(&ch.checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := ch.path + ".tmp"
+	err = ioutil.WriteFile(tmp, contents, 0600)
+	if err != nil {
+		return err
+	}
+	ch.unsaved = 0
+	return os.Rename(tmp, ch.path)
+}
+
+// remove deletes the checkpoint, once the archive is verified or
+// found not to match.
+func (ch *checkpointingHash) remove() {
+	os.Remove(ch.path)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/fission/fission"
+)
+
+// With --state-file, "package verify --all" records the result of each
+// archive in a state file as soon as it's verified, so a sweep of a
+// large fleet is also an incremental report, and can be stopped at any
+// point and continued with --resume. The file is JSON lines: a header
+// with the sweep's settings, then one line per archive verified, the
+// latest line of an archive winning. A resumed sweep skips archives
+// with a result for the checksum they still have, and verifies again
+// those that failed to download or have changed; a line cut short by
+// an interruption is ignored. --parallel and --rate keep a background
+// sweep from loading the storage service, and --checkpoint-dir also
+// resumes the archives being downloaded when the sweep stopped.
+
+// verifySweepVersion is the version of the state file format.
+const verifySweepVersion = 1
+
+type (
+	// verifySweepHeader is the first line of a state file. A sweep
+	// can only be resumed with the same settings.
+	verifySweepHeader struct {
+		Version      int    `json:"version"`
+		Namespace    string `json:"namespace"`
+		Env          string `json:"env,omitempty"`
+		Package      string `json:"package,omitempty"`
+		SampleRanges int    `json:"sampleRanges,omitempty"`
+	}
+
+	// verifySweepEntry is the result of an archive in a state file,
+	// with the checksum it was verified against.
+	verifySweepEntry struct {
+		archiveVerification
+		Checksum fission.Checksum `json:"checksum"`
+	}
+
+	// verifySweep appends results to a state file.
+	verifySweep struct {
+		sync.Mutex
+		file *os.File
+	}
+)
+
+// verifySweepKey identifies an archive of a package in a state file.
+func verifySweepKey(pkgName, archiveName string) string {
+	return pkgName + "/" + archiveName
+}
+
+// completes is true if a recorded result still stands for an archive,
+// so a resumed sweep can skip it.
+func (e *verifySweepEntry) completes(archive *fission.Archive) bool {
+	return e.Outcome != verifyFailed && e.Checksum.Equal(archive.Checksum)
+}
+
+// readVerifySweep reads the results of a state file, by
+// verifySweepKey, checking it was written by a sweep with header's
+// settings.
+func readVerifySweep(fileName string, header verifySweepHeader) (map[string]verifySweepEntry, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%v is empty", fileName)
+	}
+	var saved verifySweepHeader
+	err = json.Unmarshal(scanner.Bytes(), &saved)
+	if err != nil {
+		return nil, fmt.Errorf("%v isn't a verification state file: %v", fileName, err)
+	}
+	if saved.Version != verifySweepVersion {
+		return nil, fmt.Errorf("%v has version %v, this fission supports %v", fileName, saved.Version, verifySweepVersion)
+	}
+	if saved != header {
+		return nil, fmt.Errorf("%v is of a sweep with other settings (%+v)", fileName, saved)
+	}
+
+	entries := make(map[string]verifySweepEntry)
+	line := 1
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e verifySweepEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			verbose("Ignoring line %v of %v: %v", line, fileName, err)
+			continue
+		}
+		entries[verifySweepKey(e.Package, e.Archive)] = e
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// openVerifySweep starts a state file, or with resume continues one,
+// returning the results it already has.
+func openVerifySweep(fileName string, header verifySweepHeader, resume bool) (*verifySweep, map[string]verifySweepEntry, error) {
+	entries := make(map[string]verifySweepEntry)
+	if resume {
+		var err error
+		entries, err = readVerifySweep(fileName, header)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if info, err := os.Stat(fileName); err == nil && info.Size() > 0 {
+		return nil, nil, fmt.Errorf("%v already exists; use --resume to continue its sweep, or remove it", fileName)
+	}
+
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	sweep := &verifySweep{file: f}
+	if !resume {
+		err = sweep.writeLine(header)
+	} else {
+		// end a line cut short, so the next result is read
+		_, err = f.Write([]byte("\n"))
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return sweep, entries, nil
+}
+
+// writeLine appends a JSON line. It must be called with the sweep
+// locked, or before it's shared.
+func (s *verifySweep) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// record appends the result of an archive.
+func (s *verifySweep) record(result archiveVerification, archive *fission.Archive) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.writeLine(verifySweepEntry{archiveVerification: result, Checksum: archive.Checksum})
+}
+
+func (s *verifySweep) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fission/fission"
+)
+
+func TestVerifySweepResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-sweep-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "sweep.jsonl")
+
+	header := verifySweepHeader{Version: verifySweepVersion, Namespace: "default"}
+	a := &fission.Archive{Type: fission.ArchiveTypeUrl, Checksum: fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: "aa"}}
+	b := &fission.Archive{Type: fission.ArchiveTypeUrl, Checksum: fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: "bb"}}
+
+	sweep, recorded, err := openVerifySweep(fileName, header, false)
+	panicIf(err)
+	if len(recorded) != 0 {
+		log.Panicf("Expected a new sweep to have no results, got %v", recorded)
+	}
+	panicIf(sweep.record(archiveVerification{Package: "a", Archive: "source", Outcome: verifyVerified}, a))
+	panicIf(sweep.record(archiveVerification{Package: "b", Archive: "source", Outcome: verifyFailed, Error: "timeout"}, b))
+	// an interrupted write
+	_, err = sweep.file.Write([]byte(`{"package":"c","arch`))
+	panicIf(err)
+	panicIf(sweep.close())
+
+	if _, _, err := openVerifySweep(fileName, header, false); err == nil {
+		log.Panicf("Expected starting over an existing state file to fail")
+	}
+	other := header
+	other.Env = "nodejs"
+	if _, _, err := openVerifySweep(fileName, other, true); err == nil {
+		log.Panicf("Expected resuming a sweep with other settings to fail")
+	}
+
+	sweep, recorded, err = openVerifySweep(fileName, header, true)
+	panicIf(err)
+	if len(recorded) != 2 {
+		log.Panicf("Expected 2 results, got %v", recorded)
+	}
+	ea := recorded[verifySweepKey("a", "source")]
+	if !ea.completes(a) {
+		log.Panicf("Expected a verified archive to be skipped")
+	}
+	changed := *a
+	changed.Checksum.Sum = "cc"
+	if ea.completes(&changed) {
+		log.Panicf("Expected a changed archive to be verified again")
+	}
+	eb := recorded[verifySweepKey("b", "source")]
+	if eb.completes(b) {
+		log.Panicf("Expected a failed archive to be verified again")
+	}
+
+	// results recorded after resuming are read, the latest winning
+	panicIf(sweep.record(archiveVerification{Package: "b", Archive: "source", Outcome: verifyVerified}, b))
+	panicIf(sweep.close())
+	recorded, err = readVerifySweep(fileName, header)
+	panicIf(err)
+	if eb := recorded[verifySweepKey("b", "source")]; !eb.completes(b) {
+		log.Panicf("Expected the resumed result to be read, got %+v", eb)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+
+	"github.com/fission/fission"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+	"github.com/fission/fission/tpr"
+)
+
+// findArchiveByChecksum returns the storage ID of an archive with the
+// given checksum: one a package refers to, or else one stored by a
+// conditional upload. Split archives have no single ID, so aren't
+// found.
+func findArchiveByChecksum(ssClient *storageSvcClient.Client, pkgs []tpr.Package, checksum fission.Checksum) (string, bool, error) {
+	for i := range pkgs {
+		for _, archive := range []*fission.Archive{&pkgs[i].Spec.Source, &pkgs[i].Spec.Deployment} {
+			if archive.Type != fission.ArchiveTypeUrl || len(archive.Parts) > 0 || !archive.Checksum.Equal(checksum) {
+				continue
+			}
+			if id, ok := storageIdFromUrl(archive.URL); ok {
+				return id, true, nil
+			}
+		}
+	}
+	return ssClient.GetByChecksum("", checksum)
+}
+
+// storageWarm puts archives, given by checksum, on the storage
+// service's warm list, so that builders download and cache them ahead
+// of the builds that use them. Archives already cached are skipped.
+func storageWarm(c *cli.Context) error {
+	client := getClient(c.GlobalString("server"))
+	if c.NArg() == 0 {
+		fatalUsage("Need the checksums of the archives to warm.")
+	}
+
+	var checksums []fission.Checksum
+	for _, arg := range c.Args() {
+		checksum, err := parseChecksumFlag(arg)
+		if err != nil {
+			fatal(fmt.Sprintf("Bad checksum '%v', need a hex encoded sha256.", arg))
+		}
+		checksums = append(checksums, checksum)
+	}
+
+	pkgs, err := client.PackageList()
+	checkErr(err, "list packages")
+
+	ssClient := getStorageClient(client)
+	t := newTable("CHECKSUM", "ARCHIVE", "SIZE", "RESULT")
+	failed := 0
+	for _, checksum := range checksums {
+		id, ok, err := findArchiveByChecksum(ssClient, pkgs, checksum)
+		if err != nil {
+			t.addRow(checksum.HexSum(), "", "", fmt.Sprintf("failed: %v", err))
+			failed++
+			continue
+		}
+		if !ok {
+			t.addRow(checksum.HexSum(), "", "", "not found")
+			failed++
+			continue
+		}
+		resp, err := ssClient.Warm(id, checksum)
+		if err != nil {
+			t.addRow(checksum.HexSum(), id, "", fmt.Sprintf("failed: %v", err))
+			failed++
+			continue
+		}
+		result := "warmed"
+		if resp.AlreadyWarm {
+			result = "already cached, skipped"
+		}
+		t.addRow(checksum.HexSum(), id, formatSize(resp.Archive.Size), result)
+	}
+	err = t.print(os.Stdout, "table")
+	checkErr(err, "print warmed archives")
+
+	if failed > 0 {
+		fatalWithCode(exitCodePartialFailure, fmt.Sprintf("%v of %v archives couldn't be warmed.", failed, len(checksums)))
+	}
+	fmt.Fprintln(os.Stderr, "Builders cache warm archives at their next sync, within a minute.")
+	return nil
+}
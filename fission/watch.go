@@ -19,7 +19,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"text/tabwriter"
 
 	"github.com/satori/go.uuid"
 	"github.com/urfave/cli"
@@ -34,28 +33,28 @@ func wCreate(c *cli.Context) error {
 
 	fnName := c.String("function")
 	if len(fnName) == 0 {
-		fatal("Need a function name to create a watch, use --function")
+		fatalUsage("Need a function name to create a watch, use --function")
 	}
 
 	namespace := c.String("ns")
 	if len(namespace) == 0 {
-		fmt.Println("Watch 'default' namespace. Use --ns <namespace> to override.")
+		fmt.Fprintln(os.Stderr, "Watch 'default' namespace. Use --ns <namespace> to override.")
 		namespace = "default"
 	}
 
 	objType := c.String("type")
 	if len(objType) == 0 {
-		fmt.Println("Object type unspecified, will watch pods.  Use --type <type> to override.")
+		fmt.Fprintln(os.Stderr, "Object type unspecified, will watch pods.  Use --type <type> to override.")
 		objType = "pod"
 	}
 
 	labels := c.String("labels")
 	// empty 'labels' selects everything
 	if len(labels) == 0 {
-		fmt.Printf("Watching all objects of type '%v', use --labels to refine selection.\n", objType)
+		fmt.Fprintf(os.Stderr, "Watching all objects of type '%v', use --labels to refine selection.\n", objType)
 	} else {
 		// TODO
-		fmt.Printf("Label selector not implemented, watching all objects")
+		fmt.Fprintln(os.Stderr, "Label selector not implemented, watching all objects")
 	}
 
 	// automatically name watches
@@ -64,7 +63,7 @@ func wCreate(c *cli.Context) error {
 	w := &tpr.Kuberneteswatchtrigger{
 		Metadata: metav1.ObjectMeta{
 			Name:      watchName,
-			Namespace: metav1.NamespaceDefault,
+			Namespace: packageNamespace,
 		},
 		Spec: fission.KubernetesWatchTriggerSpec{
 			Namespace: namespace,
@@ -101,12 +100,12 @@ func wDelete(c *cli.Context) error {
 
 	wName := c.String("name")
 	if len(wName) == 0 {
-		fatal("Need name of watch to delete, use --name")
+		fatalUsage("Need name of watch to delete, use --name")
 	}
 
 	err := client.WatchDelete(&metav1.ObjectMeta{
 		Name:      wName,
-		Namespace: metav1.NamespaceDefault,
+		Namespace: packageNamespace,
 	})
 	checkErr(err, "delete watch")
 
@@ -117,18 +116,15 @@ func wDelete(c *cli.Context) error {
 func wList(c *cli.Context) error {
 	client := getClient(c.GlobalString("server"))
 
+	output := c.String("output")
+	checkOutputFormat(output)
+
 	ws, err := client.WatchList()
 	checkErr(err, "list watches")
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-
-	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n",
-		"NAME", "NAMESPACE", "OBJTYPE", "LABELS", "FUNCTION_NAME")
+	t := newTable("NAME", "NAMESPACE", "OBJTYPE", "LABELS", "FUNCTION_NAME")
 	for _, wa := range ws {
-		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
-			wa.Metadata.Name, wa.Spec.Namespace, wa.Spec.Type, wa.Spec.LabelSelector, wa.Spec.FunctionReference.Name)
+		t.addRow(wa.Metadata.Name, wa.Spec.Namespace, wa.Spec.Type, wa.Spec.LabelSelector, wa.Spec.FunctionReference.Name)
 	}
-	w.Flush()
-
-	return nil
+	return t.print(os.Stdout, output)
 }
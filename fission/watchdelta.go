@@ -0,0 +1,290 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/tpr"
+)
+
+// With --delta, "package watch" uploads only what changed since the
+// last upload. The directory is packed reproducibly and cut into
+// content-defined chunks, so unchanged files give the same chunks
+// each time, and a manifest kept between runs records the checksum of
+// each file and the stored chunks of the last archive uploaded. A
+// rebuild is skipped if no file changed; otherwise chunks of the last
+// archive that the storage service still has, checked with a HEAD
+// each, are referred to again, and only new or missing chunks are
+// uploaded. The package's archive is then the
+// base's chunks plus the delta, which fetchers reassemble, checking
+// each chunk and the whole archive's checksum.
+//
+// The manifest is only trusted for the package it was written for:
+// if that package is gone or its archive differs, if it was written
+// for another storage service, or with --full-resync, the first
+// rebuild uploads every chunk conditionally, as without --delta.
+
+const (
+	// deltaManifestVersion is the version of the manifest format.
+	deltaManifestVersion = 1
+
+	// defaultDeltaChunkSize is the chunk size of --delta without
+	// --chunk-size.
+	defaultDeltaChunkSize = 256 * 1024
+)
+
+type (
+	// deltaManifest is what "package watch --delta" keeps of the
+	// last archive it uploaded of a directory.
+	deltaManifest struct {
+		Version int    `json:"version"`
+		Dir     string `json:"dir"`
+		Storage string `json:"storage"`
+		Package string `json:"package,omitempty"`
+
+		// Files are the sha256 checksums of the files packed,
+		// by their slash separated paths.
+		Files map[string]string `json:"files"`
+
+		// Checksum, Chunks and Parts are those of the archive
+		// uploaded, if it was chunked.
+		Checksum fission.Checksum       `json:"checksum"`
+		Chunks   []fission.ArchiveChunk `json:"chunks,omitempty"`
+		Parts    []string               `json:"parts,omitempty"`
+	}
+
+	// deltaChanges are the files added, changed and removed since
+	// a manifest was written.
+	deltaChanges struct {
+		added, changed, removed []string
+	}
+)
+
+// deltaManifestPath returns where the manifest of a watched
+// directory is kept, in the user's cache directory.
+func deltaManifestPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		cache = stagingDir()
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(cache, "fission", "watch-delta", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// readDeltaManifest reads the manifest of a directory, returning nil
+// if there is none or it can't be used.
+func readDeltaManifest(fileName, dir, storage string) *deltaManifest {
+	contents, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	var m deltaManifest
+	if err == nil {
+		err = json.Unmarshal(contents, &m)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring unreadable delta manifest %v: %v\n", fileName, err)
+		return nil
+	}
+	abs, _ := filepath.Abs(dir)
+	if m.Version != deltaManifestVersion || m.Dir != abs || m.Storage != storage {
+		verbose("Delta manifest %v is for another directory, storage service or version", fileName)
+		return nil
+	}
+	return &m
+}
+
+// write saves the manifest.
+func (m *deltaManifest) write(fileName string) error {
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, contents, 0644)
+}
+
+// checkBase makes sure the package a manifest was written for still
+// holds its archive, so its chunks can be trusted to be stored.
+func (m *deltaManifest) checkBase(client *client.Client) bool {
+	if len(m.Package) == 0 || len(m.Chunks) == 0 {
+		return false
+	}
+	pkg, err := client.PackageGet(&metav1.ObjectMeta{Name: m.Package, Namespace: packageNamespace})
+	if err != nil {
+		verbose("Delta base package '%v' can't be read: %v", m.Package, err)
+		return false
+	}
+	archive := deltaArchive(pkg)
+	if !archive.Checksum.Equal(m.Checksum) {
+		verbose("Delta base package '%v' has a different archive", m.Package)
+		return false
+	}
+	return true
+}
+
+// deltaArchive returns the archive of a package that watch uploads.
+func deltaArchive(pkg *tpr.Package) *fission.Archive {
+	if len(pkg.Spec.Source.Type) > 0 {
+		return &pkg.Spec.Source
+	}
+	return &pkg.Spec.Deployment
+}
+
+// base returns the chunks of the manifest's archive, by checksum, for
+// archiveOptions.deltaBase.
+func (m *deltaManifest) base() map[string]string {
+	if len(m.Chunks) != len(m.Parts) {
+		return nil
+	}
+	base := make(map[string]string, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		if chunk.Checksum.Type == fission.ChecksumTypeSHA256 {
+			base[chunk.Checksum.Sum] = m.Parts[i]
+		}
+	}
+	return base
+}
+
+// diffFiles compares the files of a scan, which must have checksums,
+// to those of a manifest.
+func diffFiles(old map[string]string, scan *dirScan) (deltaChanges, map[string]string) {
+	var d deltaChanges
+	files := make(map[string]string, len(scan.entries))
+	for _, e := range scan.entries {
+		files[e.relPath] = e.checksum
+		sum, ok := old[e.relPath]
+		if !ok {
+			d.added = append(d.added, e.relPath)
+		} else if sum != e.checksum {
+			d.changed = append(d.changed, e.relPath)
+		}
+	}
+	for p := range old {
+		if _, ok := files[p]; !ok {
+			d.removed = append(d.removed, p)
+		}
+	}
+	sort.Strings(d.added)
+	sort.Strings(d.changed)
+	sort.Strings(d.removed)
+	return d, files
+}
+
+// empty is true if no file changed.
+func (d deltaChanges) empty() bool {
+	return len(d.added) == 0 && len(d.changed) == 0 && len(d.removed) == 0
+}
+
+func (d deltaChanges) String() string {
+	return fmt.Sprintf("%v added, %v changed, %v removed", len(d.added), len(d.changed), len(d.removed))
+}
+
+// deltaWatch is the state of "package watch --delta" between
+// rebuilds.
+type deltaWatch struct {
+	dir      string
+	fileName string
+	manifest *deltaManifest
+	opts     archiveOptions
+}
+
+// newDeltaWatch loads the manifest of a watched directory, unless
+// fullResync discards it, and sets up opts for delta uploads.
+func newDeltaWatch(client *client.Client, dir string, fullResync bool, opts *archiveOptions) *deltaWatch {
+	if opts.chunkSize == 0 {
+		opts.chunkSize = defaultDeltaChunkSize
+		if len(opts.compression) == 0 {
+			opts.compression = "none"
+		}
+	}
+	opts.reproducible = true
+
+	fileName, err := deltaManifestPath(dir)
+	checkErr(err, "find delta manifest")
+	abs, err := filepath.Abs(dir)
+	checkErr(err, fmt.Sprintf("resolve %v", dir))
+	dw := &deltaWatch{dir: dir, fileName: fileName, opts: *opts}
+	storage := storageUrl(client)
+	if !fullResync {
+		dw.manifest = readDeltaManifest(fileName, dir, storage)
+	}
+	if dw.manifest != nil && !dw.manifest.checkBase(client) {
+		dw.manifest = nil
+	}
+	if dw.manifest == nil {
+		fmt.Fprintf(os.Stderr, "Delta watch: uploading all of %v once\n", dir)
+		dw.manifest = &deltaManifest{Version: deltaManifestVersion, Dir: abs, Storage: storage}
+	} else {
+		verbose("Delta watch: using %v, base package '%v'", fileName, dw.manifest.Package)
+	}
+	return dw
+}
+
+// changes scans the directory, returning its files' checksums and how
+// they differ from the last upload.
+func (dw *deltaWatch) changes() (deltaChanges, map[string]string, error) {
+	scanOpts := dw.opts
+	scanOpts.prescan = true
+	scan, err := scanDir(dw.dir, scanOpts)
+	if err != nil {
+		return deltaChanges{}, nil, err
+	}
+	d, files := diffFiles(dw.manifest.Files, scan)
+	return d, files, nil
+}
+
+// uploaded records the archive of a package created or updated from
+// files.
+func (dw *deltaWatch) uploaded(pkgName string, archive *fission.Archive, files map[string]string) {
+	m := &deltaManifest{
+		Version:  deltaManifestVersion,
+		Dir:      dw.manifest.Dir,
+		Storage:  dw.manifest.Storage,
+		Package:  pkgName,
+		Files:    files,
+		Checksum: archive.Checksum,
+	}
+	if len(archive.Chunks) > 0 && len(archive.Chunks) == len(archive.Parts) {
+		m.Chunks = archive.Chunks
+		m.Parts = archive.Parts
+	}
+	dw.manifest = m
+	err := m.write(dw.fileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save delta manifest %v: %v\n", dw.fileName, err)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fission/fission"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+func TestDeltaManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fission-delta-test")
+	if err != nil {
+		log.Panicf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for name, contents := range map[string]string{"a.js": "a", "b.js": "b", "c.js": "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			log.Panicf("Error writing %v: %v", name, err)
+		}
+	}
+	scan, err := scanDir(dir, archiveOptions{prescan: true})
+	if err != nil {
+		log.Panicf("Error scanning %v: %v", dir, err)
+	}
+	d, files := diffFiles(nil, scan)
+	if len(d.added) != 3 || len(files) != 3 {
+		log.Panicf("Expected 3 added files, got %v", d)
+	}
+
+	// a change, an addition and a removal since the last upload show
+	ioutil.WriteFile(filepath.Join(dir, "a.js"), []byte("A"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "d.js"), []byte("d"), 0644)
+	os.Remove(filepath.Join(dir, "c.js"))
+	scan, err = scanDir(dir, archiveOptions{prescan: true})
+	if err != nil {
+		log.Panicf("Error scanning %v: %v", dir, err)
+	}
+	d, _ = diffFiles(files, scan)
+	if d.String() != "1 added, 1 changed, 1 removed" || d.changed[0] != "a.js" || d.added[0] != "d.js" || d.removed[0] != "c.js" {
+		log.Panicf("Unexpected changes %v: %+v", d, d)
+	}
+
+	// the manifest's chunks are the base of the next upload
+	m := &deltaManifest{
+		Version: deltaManifestVersion,
+		Dir:     dir,
+		Storage: "http://storage",
+		Files:   files,
+		Chunks: []fission.ArchiveChunk{{
+			Checksum: fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: "abc"},
+			Size:     3,
+		}},
+		Parts: []string{"http://storage/v1/archive?id=abc"},
+	}
+	fileName := filepath.Join(dir, "manifest", "delta.json")
+	if err := m.write(fileName); err != nil {
+		log.Panicf("Error writing manifest: %v", err)
+	}
+	read := readDeltaManifest(fileName, dir, "http://storage")
+	if read == nil || read.base()["abc"] != m.Parts[0] || len(read.Files) != 3 {
+		log.Panicf("Unexpected manifest %+v", read)
+	}
+	if readDeltaManifest(fileName, dir, "http://other") != nil {
+		log.Panicf("Manifest of another storage service was used")
+	}
+}
+
+func TestDeltaBaseChunkStored(t *testing.T) {
+	// the storage service has chunk "abc" of 3 bytes, and nothing else
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Query().Get("id") != "abc" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", "3")
+	}))
+	defer server.Close()
+	ssClient := storageSvcClient.MakeClient(server.URL)
+
+	if !baseChunkStored(ssClient, ssClient.ArchiveUrl("abc"), 3) {
+		log.Panicf("Expected a stored chunk to be reused")
+	}
+	if baseChunkStored(ssClient, ssClient.ArchiveUrl("gone"), 3) {
+		log.Panicf("Expected a deleted chunk to be uploaded again")
+	}
+	if baseChunkStored(ssClient, ssClient.ArchiveUrl("abc"), 4) {
+		log.Panicf("Expected a chunk of another size to be uploaded again")
+	}
+	if baseChunkStored(ssClient, "http://example.com/abc.zip", 3) {
+		log.Panicf("Expected a chunk outside the storage service to be uploaded again")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"sort"
+	"strings"
+)
+
+// ArchiveHintFiles maps the well-known files that give archive hints
+// to their hints. Only files at the archive root count, since that's
+// where builders run build commands.
+var ArchiveHintFiles = map[string]ArchiveHint{
+	"requirements.txt": ArchiveHintPipRequirements,
+	"package.json":     ArchiveHintNpmPackage,
+	"go.mod":           ArchiveHintGoModule,
+	"pom.xml":          ArchiveHintMavenProject,
+	"Gemfile":          ArchiveHintBundlerGemfile,
+	"composer.json":    ArchiveHintComposerPackage,
+}
+
+// DetectArchiveHints returns the sorted hints given by the files at
+// the root of an archive, from the relative, slash separated paths
+// of its files.
+func DetectArchiveHints(paths []string) []ArchiveHint {
+	found := make(map[ArchiveHint]bool)
+	for _, p := range paths {
+		p = strings.TrimPrefix(p, "./")
+		if hint, ok := ArchiveHintFiles[p]; ok {
+			found[hint] = true
+		}
+	}
+	var hints []ArchiveHint
+	for hint := range found {
+		hints = append(hints, hint)
+	}
+	sort.Slice(hints, func(i, j int) bool { return hints[i] < hints[j] })
+	return hints
+}
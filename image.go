@@ -0,0 +1,59 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// imageReferenceRegexp matches container image references as docker
+// parses them: [domain[:port]/]name[/name...][:tag][@digest], with
+// lower case names.
+var imageReferenceRegexp = regexp.MustCompile(`^` +
+	`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?` +
+	`(?:@[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-fA-F0-9]{32,})?` +
+	`$`)
+
+// imageTagOrDigestRegexp matches the tag and digest ending an image
+// reference.
+var imageTagOrDigestRegexp = regexp.MustCompile(`[:@][^/]*$`)
+
+// maxImageNameLength is the longest image name, without its tag and
+// digest, that registries accept.
+const maxImageNameLength = 255
+
+// ValidateImageReference checks that ref is a well-formed container
+// image reference, such as "fission/node-builder:0.4" or
+// "registry:5000/builder@sha256:...".
+func ValidateImageReference(ref string) error {
+	if !imageReferenceRegexp.MatchString(ref) {
+		return MakeError(ErrorInvalidArgument,
+			fmt.Sprintf("Invalid image reference '%v': expected [registry/]name[:tag][@digest], with a lower case name", ref))
+	}
+	name := ref
+	if i := imageTagOrDigestRegexp.FindStringIndex(ref); i != nil {
+		name = ref[:i[0]]
+	}
+	if len(name) > maxImageNameLength {
+		return MakeError(ErrorInvalidArgument,
+			fmt.Sprintf("Invalid image reference '%v': name is longer than %v characters", ref, maxImageNameLength))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packager_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/packager"
+)
+
+// This creates a package from a source directory and waits for its
+// build, printing each stage, and gives up after ten minutes. The
+// controller is a fake one, whose builds log two steps.
+func ExamplePackageCreator() {
+	controller := makeFakeController(false)
+	defer controller.Close()
+	dir := makeSourceDir()
+	defer os.RemoveAll(dir)
+
+	pc := packager.MakePackageCreator(client.MakeClient(controller.URL))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	op := pc.Start(ctx, packager.PackageRequest{
+		Name:         "hello-src",
+		Environment:  "nodejs",
+		Source:       dir,
+		WaitForBuild: true,
+	})
+	for e := range op.Events() {
+		switch e.Type {
+		case packager.EventCreated:
+			fmt.Println("created")
+		case packager.EventUploading:
+			fmt.Printf("uploading %v: %v of %v bytes\n", e.Archive, e.Sent, e.Total)
+		case packager.EventBuild:
+			if e.Build.IsLog {
+				fmt.Printf("build: %v\n", e.Build.LogLine)
+			} else {
+				fmt.Printf("build %v\n", e.Build.Status)
+			}
+		default:
+			fmt.Printf("%v %v\n", e.Type, e.Archive)
+		}
+	}
+	result, err := op.Wait()
+	if err != nil {
+		log.Fatalf("create package: %v", err)
+	}
+	fmt.Printf("package %v built: %v\n", result.Metadata.Name, result.Status.BuildStatus)
+	// Output:
+	// packing source
+	// archived source
+	// created
+	// build running
+	// build: step 1
+	// build succeeded
+	// build: step 2
+	// package hello-src built: succeeded
+}
+
+// Create reports the same events to a callback instead. A small file
+// like this one is embedded in the package.
+func ExamplePackageCreator_Create() {
+	controller := makeFakeController(false)
+	defer controller.Close()
+	dir, err := ioutil.TempDir("", "fission-packager-example-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "hello.js")
+	err = ioutil.WriteFile(fileName, []byte("module.exports = () => 'hello'\n"), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pc := packager.MakePackageCreator(client.MakeClient(controller.URL))
+	result, err := pc.Create(context.Background(), packager.PackageRequest{
+		Environment: "nodejs",
+		Deployment:  fileName,
+	}, func(e packager.Event) {
+		if len(e.Archive) > 0 {
+			fmt.Printf("%v %v\n", e.Type, e.Archive)
+		} else {
+			fmt.Println(e.Type)
+		}
+	})
+	if err != nil {
+		log.Fatalf("create package: %v", err)
+	}
+	fmt.Printf("deployment archive: %v\n", result.Spec.Deployment.Type)
+	// Output:
+	// packing deployment
+	// archived deployment
+	// created
+	// deployment archive: literal
+}
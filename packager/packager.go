@@ -0,0 +1,495 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package packager creates Fission packages from Go programs, such as
+// a web UI backend or an operator, reporting the progress of each
+// stage as events instead of printing it: packing, uploading,
+// creating the package and, if asked, its build. Every stage can be
+// cancelled through the context it is given, and failures are
+// returned as errors rather than ending the process.
+//
+// It covers the common path of "fission package create", with the
+// CLI's own archive helpers: directories are zipped as with
+// --reproducible, archives below the literal limit are embedded, and
+// others are uploaded to the storage service, directories gzip
+// compressed, and checked against their SHA256 checksums. The CLI's
+// other options, such as transforms, chunking and secret scans, aren't
+// offered here.
+package packager
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/satori/go.uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/storagesvc"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+	"github.com/fission/fission/tpr"
+)
+
+const (
+	// EventPacking is sent before an archive is packed, if it is
+	// a directory, and checksummed.
+	EventPacking EventType = "packing"
+	// EventUploading is sent as an archive is uploaded, with the
+	// bytes sent so far.
+	EventUploading EventType = "uploading"
+	// EventArchived is sent once an archive is embedded or stored.
+	EventArchived EventType = "archived"
+	// EventCreated is sent once the package is created.
+	EventCreated EventType = "created"
+	// EventBuild is sent for each change to the package's build
+	// while it is waited for.
+	EventBuild EventType = "build"
+
+	// uploadProgressPerSecond bounds the upload events sent per
+	// second.
+	uploadProgressPerSecond = 4
+)
+
+type (
+	// EventType is the kind of an Event.
+	EventType string
+
+	// Event is the progress of a package creation. Archive is
+	// "source" or "deployment" for the events of an archive; Sent
+	// and Total are the bytes of an upload, Total -1 if unknown.
+	// Build is set for EventBuild.
+	Event struct {
+		Type    EventType
+		Archive string
+		Sent    int64
+		Total   int64
+		Build   *client.PackageEvent
+	}
+
+	// PackageRequest describes a package to create. Source and
+	// Deployment are paths to archive files or directories; at
+	// least one is needed, and only a package with a source is
+	// built. An empty Name is a random one, as the CLI gives.
+	PackageRequest struct {
+		Name         string
+		Namespace    string
+		Environment  string
+		Source       string
+		Deployment   string
+		BuildCommand string
+		Labels       map[string]string
+
+		// WaitForBuild waits for the build of a package with a
+		// source to finish, sending its events.
+		WaitForBuild bool
+	}
+
+	// Result is a created package: its metadata, spec and, if its
+	// build was waited for, its final status.
+	Result struct {
+		Metadata metav1.ObjectMeta
+		Spec     fission.PackageSpec
+		Status   *fission.PackageStatus
+	}
+
+	// PackageCreator creates packages through a controller.
+	PackageCreator struct {
+		client       *client.Client
+		storageUrl   string
+		storageOpts  []storageSvcClient.ClientOption
+		literalLimit int64
+	}
+
+	// PackageCreatorOption configures a PackageCreator.
+	PackageCreatorOption func(*PackageCreator)
+
+	// Operation is a package creation started with Start.
+	Operation struct {
+		events chan Event
+		done   chan struct{}
+		result *Result
+		err    error
+	}
+)
+
+// MakePackageCreator makes a PackageCreator using the given controller
+// client, uploading through the controller's storage proxy.
+func MakePackageCreator(controller *client.Client, opts ...PackageCreatorOption) *PackageCreator {
+	pc := &PackageCreator{
+		client:       controller,
+		storageUrl:   strings.TrimSuffix(controller.Url, "/") + "/proxy/storage",
+		literalLimit: fission.ArchiveLiteralSizeLimit,
+	}
+	for _, opt := range opts {
+		opt(pc)
+	}
+	return pc
+}
+
+// WithStorageUrl uploads archives to the storage service at url
+// instead of through the controller.
+func WithStorageUrl(url string) PackageCreatorOption {
+	return func(pc *PackageCreator) {
+		pc.storageUrl = url
+	}
+}
+
+// WithStorageOptions configures the storage clients uploads use, e.g.
+// with credentials or an upload limiter shared with other uploads.
+func WithStorageOptions(opts ...storageSvcClient.ClientOption) PackageCreatorOption {
+	return func(pc *PackageCreator) {
+		pc.storageOpts = append(pc.storageOpts, opts...)
+	}
+}
+
+// WithLiteralLimit embeds archives below limit bytes in the package
+// instead of uploading them, like the CLI's --inline-limit; 0 uploads
+// every archive. The limit can't be raised above
+// fission.ArchiveLiteralSizeLimit.
+func WithLiteralLimit(limit int64) PackageCreatorOption {
+	return func(pc *PackageCreator) {
+		if limit > fission.ArchiveLiteralSizeLimit {
+			limit = fission.ArchiveLiteralSizeLimit
+		}
+		pc.literalLimit = limit
+	}
+}
+
+// Create creates a package, calling progress, which may be nil, with
+// its events from the calling goroutine. If ctx is cancelled, Create
+// stops and returns an error matching context.Canceled; archives
+// already uploaded are left to the storage service's cleanup. A build
+// being waited for goes on; it can be stopped with
+// client.PackageCancelBuild.
+func (pc *PackageCreator) Create(ctx context.Context, req PackageRequest, progress func(Event)) (*Result, error) {
+	if progress == nil {
+		progress = func(Event) {}
+	}
+	if len(req.Environment) == 0 {
+		return nil, fission.MakeError(fission.ErrorInvalidArgument, "need an environment")
+	}
+	if len(req.Source) == 0 && len(req.Deployment) == 0 {
+		return nil, fission.MakeError(fission.ErrorInvalidArgument, "need a source or deployment archive")
+	}
+
+	namespace := req.Namespace
+	if len(namespace) == 0 {
+		namespace = metav1.NamespaceDefault
+	}
+	spec := fission.PackageSpec{
+		Environment: fission.EnvironmentReference{
+			Namespace: namespace,
+			Name:      req.Environment,
+		},
+		BuildCommand: req.BuildCommand,
+	}
+	status := fission.BuildStatus(fission.BuildStatusSucceeded)
+	for _, a := range []struct {
+		kind    string
+		path    string
+		archive *fission.Archive
+	}{
+		{"deployment", req.Deployment, &spec.Deployment},
+		{"source", req.Source, &spec.Source},
+	} {
+		if len(a.path) == 0 {
+			continue
+		}
+		archive, err := pc.archive(ctx, namespace, a.kind, a.path, progress)
+		if err != nil {
+			return nil, fmt.Errorf("%v archive %v: %w", a.kind, a.path, err)
+		}
+		*a.archive = *archive
+		progress(Event{Type: EventArchived, Archive: a.kind})
+	}
+	if len(req.Source) > 0 {
+		status = fission.BuildStatusPending
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	name := req.Name
+	if len(name) == 0 {
+		name = strings.ToLower(uuid.NewV4().String())
+	}
+	m, err := pc.client.PackageCreate(&tpr.Package{
+		Metadata: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: req.Labels},
+		Spec:     spec,
+		Status:   fission.PackageStatus{BuildStatus: status},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create package: %w", err)
+	}
+	progress(Event{Type: EventCreated})
+	result := &Result{Metadata: *m, Spec: spec}
+
+	if req.WaitForBuild && status == fission.BuildStatusPending {
+		result.Status, err = WaitForBuild(ctx, pc.client, m, func(e client.PackageEvent) {
+			progress(Event{Type: EventBuild, Build: &e})
+		})
+		if err != nil {
+			return result, fmt.Errorf("wait for build: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// Start is Create in the background: the operation's Events channel
+// receives the events, and is closed when the creation is done.
+// Events must be read, or the creation stalls.
+func (pc *PackageCreator) Start(ctx context.Context, req PackageRequest) *Operation {
+	op := &Operation{events: make(chan Event), done: make(chan struct{})}
+	go func() {
+		defer close(op.done)
+		defer close(op.events)
+		op.result, op.err = pc.Create(ctx, req, func(e Event) {
+			select {
+			case op.events <- e:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return op
+}
+
+// Events returns the channel of the operation's events.
+func (op *Operation) Events() <-chan Event {
+	return op.events
+}
+
+// Wait waits for the operation to finish and returns its result, as
+// Create would. The events not read yet are discarded.
+func (op *Operation) Wait() (*Result, error) {
+	for range op.events {
+	}
+	<-op.done
+	return op.result, op.err
+}
+
+// WaitForBuild calls fn with the events of a package's build, from
+// the calling goroutine, until it has finished, and returns its final
+// status. It's how the CLI waits for builds. If ctx is done first, it
+// returns ctx's error, with the build still going on; the event
+// stream is closed before it returns either way.
+func WaitForBuild(ctx context.Context, controller *client.Client, m *metav1.ObjectMeta, fn func(client.PackageEvent)) (*fission.PackageStatus, error) {
+	status, err := controller.PackageEventsStreamContext(ctx, m, fn)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	}
+	return status, err
+}
+
+// archive makes the archive of a file or directory, embedding it if
+// it's small enough and uploading it otherwise, as the CLI does with
+// its default options and --reproducible.
+func (pc *PackageCreator) archive(ctx context.Context, namespace string, kind string, path string, progress func(Event)) (*fission.Archive, error) {
+	progress(Event{Type: EventPacking, Archive: kind})
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	archive := &fission.Archive{}
+	fileName := path
+	name := filepath.Base(path)
+	var files []File
+	size := info.Size()
+	if info.IsDir() {
+		var total int64
+		files, total, err = listFiles(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		// the zip is compressed as a whole if it's uploaded, so
+		// its files aren't compressed twice
+		method := zip.Deflate
+		if !Embedded(total, pc.literalLimit) {
+			method = zip.Store
+		}
+		fileName, err = tempFile(func(f *os.File) error {
+			return WriteZip(f, files, method, 0, true)
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(fileName)
+		name += ".zip"
+
+		zipInfo, err := os.Stat(fileName)
+		if err != nil {
+			return nil, err
+		}
+		// a directory is only embedded if both its files and the
+		// zip are small enough
+		size = zipInfo.Size()
+		if total > size {
+			size = total
+		}
+		archive.Structure = structure(files)
+	} else if files, err = zipFiles(fileName); err != nil {
+		files = nil
+	}
+	if len(files) > 0 {
+		paths := make([]string, len(files))
+		for i, f := range files {
+			paths[i] = f.Name
+		}
+		archive.Hints = fission.DetectArchiveHints(paths)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if Embedded(size, pc.literalLimit) {
+		contents, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		checksum, _, err := FileChecksum(fileName)
+		if err != nil {
+			return nil, err
+		}
+		archive.Type = fission.ArchiveTypeLiteral
+		archive.Literal = contents
+		archive.Checksum = checksum
+		return archive, nil
+	}
+
+	if info.IsDir() {
+		zipName := fileName
+		fileName, err = tempFile(func(f *os.File) error {
+			in, err := os.Open(zipName)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			return Gzip(f, in, 0, storageSvcClient.DefaultBufferSize)
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(fileName)
+		archive.Compression = fission.ArchiveCompressionGzip
+		name += ".gz"
+	}
+	archive.Checksum, _, err = FileChecksum(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append([]storageSvcClient.ClientOption{
+		storageSvcClient.WithHeaders(pc.client.Headers),
+		storageSvcClient.WithNamespace(namespace),
+		storageSvcClient.WithContext(ctx),
+		storageSvcClient.WithProgress(func(sent int64, total int64) {
+			progress(Event{Type: EventUploading, Archive: kind, Sent: sent, Total: total})
+		}, uploadProgressPerSecond),
+	}, pc.storageOpts...)
+	ssClient := storageSvcClient.MakeClient(pc.storageUrl, opts...)
+	metadata := map[string]string{storagesvc.ArchiveNameMetadata: name}
+	res, err := ssClient.UploadVerified(fileName, "", archive.Checksum, &metadata)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+			err = fmt.Errorf("%v: %w", err, ctxErr)
+		}
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+	archive.Type = fission.ArchiveTypeUrl
+	archive.URL = ssClient.ArchiveUrl(res.ID)
+	archive.ServerChecksum = res.ServerChecksum
+	return archive, nil
+}
+
+// listFiles returns the regular files under dir, sorted by path, and
+// their total size.
+func listFiles(ctx context.Context, dir string) ([]File, int64, error) {
+	var files []File
+	var total int64
+	// Walk visits files in lexical order
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Name: filepath.ToSlash(rel), Path: path, Info: info})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return files, total, nil
+}
+
+// zipFiles returns the files of a zip, for its hints.
+func zipFiles(fileName string) ([]File, error) {
+	r, err := zip.OpenReader(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var files []File
+	for _, f := range r.File {
+		if !f.FileInfo().IsDir() {
+			files = append(files, File{Name: f.Name, Info: f.FileInfo()})
+		}
+	}
+	return files, nil
+}
+
+// structure returns the structure fingerprint of files zipped
+// deterministically.
+func structure(files []File) string {
+	entries := make([]fission.StructureEntry, len(files))
+	for i, f := range files {
+		entries[i] = fission.StructureEntry{Path: f.Name, Mode: DeterministicMode(f.Info.Mode())}
+	}
+	return fission.ArchiveStructure(entries)
+}
+
+// tempFile writes a temporary file with write, removing it again if
+// that fails, and returns its name. The caller removes it.
+func tempFile(write func(f *os.File) error) (string, error) {
+	f, err := ioutil.TempFile("", "fission-packager-")
+	if err != nil {
+		return "", err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
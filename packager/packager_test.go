@@ -0,0 +1,305 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packager_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/controller/client"
+	"github.com/fission/fission/packager"
+	"github.com/fission/fission/storagesvc"
+	"github.com/fission/fission/tpr"
+)
+
+func panicIf(err error) {
+	if err != nil {
+		log.Panicf("err: %v", err)
+	}
+}
+
+// fakeController serves the package routes a PackageCreator uses:
+// created packages are kept, and their event streams report a running
+// build, then a successful one. A holding controller never finishes
+// builds, keeping their streams open until the client goes away.
+type fakeController struct {
+	*httptest.Server
+	hold bool
+
+	sync.Mutex
+	packages map[string]*tpr.Package
+	streams  int32
+}
+
+func makeFakeController(hold bool) *fakeController {
+	fc := &fakeController{hold: hold, packages: make(map[string]*tpr.Package)}
+	fc.Server = httptest.NewServer(http.HandlerFunc(fc.handle))
+	return fc
+}
+
+func (fc *fakeController) handle(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v2/packages":
+		var pkg tpr.Package
+		if err := json.NewDecoder(r.Body).Decode(&pkg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fc.Lock()
+		fc.packages[pkg.Metadata.Name] = &pkg
+		fc.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pkg.Metadata)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v2/packages/") && strings.HasSuffix(r.URL.Path, "/events"):
+		atomic.AddInt32(&fc.streams, 1)
+		defer atomic.AddInt32(&fc.streams, -1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		send := func(status fission.PackageStatus) {
+			data, _ := json.Marshal(status)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+		send(fission.PackageStatus{BuildStatus: fission.BuildStatusRunning, BuildLog: "step 1\n"})
+		if fc.hold {
+			<-r.Context().Done()
+			return
+		}
+		send(fission.PackageStatus{BuildStatus: fission.BuildStatusSucceeded, BuildLog: "step 1\nstep 2\n"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (fc *fakeController) pkg(name string) *tpr.Package {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.packages[name]
+}
+
+// makeSourceDir makes a directory with a file and an executable one
+// under a subdirectory.
+func makeSourceDir() string {
+	dir, err := ioutil.TempDir("", "fission-packager-test-")
+	panicIf(err)
+	panicIf(os.MkdirAll(filepath.Join(dir, "lib"), 0755))
+	panicIf(ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte("{}"), 0644))
+	panicIf(ioutil.WriteFile(filepath.Join(dir, "lib", "run.sh"), []byte("#!/bin/sh"), 0700))
+	return dir
+}
+
+func eventTypes(events []packager.Event) []string {
+	var types []string
+	for _, e := range events {
+		switch {
+		case e.Type == packager.EventUploading:
+			// how often progress is reported depends on timing
+			if len(types) == 0 || types[len(types)-1] != "uploading" {
+				types = append(types, "uploading")
+			}
+		case e.Type == packager.EventBuild && e.Build.IsLog:
+			types = append(types, "log "+e.Build.LogLine)
+		case e.Type == packager.EventBuild:
+			types = append(types, "build "+string(e.Build.Status))
+		default:
+			types = append(types, strings.TrimSpace(string(e.Type)+" "+e.Archive))
+		}
+	}
+	return types
+}
+
+func TestCreateLiteral(t *testing.T) {
+	fc := makeFakeController(false)
+	defer fc.Close()
+	dir, err := ioutil.TempDir("", "fission-packager-test-")
+	panicIf(err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "hello.js")
+	panicIf(ioutil.WriteFile(fileName, []byte("hello"), 0644))
+
+	var events []packager.Event
+	pc := packager.MakePackageCreator(client.MakeClient(fc.URL))
+	result, err := pc.Create(context.Background(), packager.PackageRequest{
+		Environment: "nodejs",
+		Deployment:  fileName,
+	}, func(e packager.Event) {
+		events = append(events, e)
+	})
+	panicIf(err)
+
+	if got := strings.Join(eventTypes(events), ", "); got != "packing deployment, archived deployment, created" {
+		log.Panicf("Unexpected events: %v", got)
+	}
+	// a random name, as the CLI gives
+	if len(result.Metadata.Name) != 36 || strings.ToLower(result.Metadata.Name) != result.Metadata.Name {
+		log.Panicf("Expected a lowercase uuid name, got %v", result.Metadata.Name)
+	}
+	pkg := fc.pkg(result.Metadata.Name)
+	if pkg == nil {
+		log.Panicf("Expected package %v to be created", result.Metadata.Name)
+	}
+	archive := pkg.Spec.Deployment
+	if archive.Type != fission.ArchiveTypeLiteral || string(archive.Literal) != "hello" {
+		log.Panicf("Expected a literal of hello, got %+v", archive)
+	}
+	panicIf(fission.VerifyLiteral(&archive))
+	if archive.Checksum.Sum != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		log.Panicf("Unexpected checksum %v", archive.Checksum.Sum)
+	}
+	if pkg.Status.BuildStatus != fission.BuildStatusSucceeded || pkg.Metadata.Namespace != "default" {
+		log.Panicf("Expected a built package in the default namespace, got %+v %+v", pkg.Metadata, pkg.Status)
+	}
+}
+
+func TestCreateUploaded(t *testing.T) {
+	port := 8091
+	_ = storagesvc.RunStorageService(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), port)
+	time.Sleep(time.Second)
+
+	fc := makeFakeController(false)
+	defer fc.Close()
+	dir := makeSourceDir()
+	defer os.RemoveAll(dir)
+
+	pc := packager.MakePackageCreator(client.MakeClient(fc.URL),
+		packager.WithStorageUrl(fmt.Sprintf("http://localhost:%v", port)),
+		packager.WithLiteralLimit(0))
+	create := func() (*packager.Result, []packager.Event) {
+		var events []packager.Event
+		result, err := pc.Create(context.Background(), packager.PackageRequest{
+			Name:         "hello",
+			Environment:  "nodejs",
+			Source:       dir,
+			WaitForBuild: true,
+		}, func(e packager.Event) {
+			events = append(events, e)
+		})
+		panicIf(err)
+		return result, events
+	}
+	result, events := create()
+
+	expected := "packing source, uploading, archived source, created, build running, log step 1, build succeeded, log step 2"
+	if got := strings.Join(eventTypes(events), ", "); got != expected {
+		log.Panicf("Expected events %v, got %v", expected, got)
+	}
+	if result.Status == nil || result.Status.BuildStatus != fission.BuildStatusSucceeded || result.Status.BuildLog != "step 1\nstep 2\n" {
+		log.Panicf("Expected a succeeded build, got %+v", result.Status)
+	}
+
+	archive := fc.pkg("hello").Spec.Source
+	if archive.Type != fission.ArchiveTypeUrl || archive.Compression != fission.ArchiveCompressionGzip {
+		log.Panicf("Expected a gzip compressed uploaded archive, got %+v", archive)
+	}
+	if len(archive.Hints) != 1 || archive.Hints[0] != fission.ArchiveHintNpmPackage {
+		log.Panicf("Expected an npm hint, got %v", archive.Hints)
+	}
+	expectedStructure := fission.ArchiveStructure([]fission.StructureEntry{
+		{Path: "lib/run.sh", Mode: 0755},
+		{Path: "package.json", Mode: 0644},
+	})
+	if archive.Structure != expectedStructure {
+		log.Panicf("Expected structure %v, got %v", expectedStructure, archive.Structure)
+	}
+
+	// the upload is the archive, gzip compressed
+	resp, err := http.Get(archive.URL)
+	panicIf(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	panicIf(err)
+	if resp.StatusCode != 200 {
+		log.Panicf("Download of %v failed: %v", archive.URL, resp.Status)
+	}
+	digest := sha256.Sum256(body)
+	if sum := fission.MakeChecksum(fission.ChecksumTypeSHA256, digest[:]); !sum.Equal(archive.Checksum) {
+		log.Panicf("Expected checksum %v, got %v", archive.Checksum, sum)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	panicIf(err)
+	zipped, err := ioutil.ReadAll(zr)
+	panicIf(err)
+	r, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+	panicIf(err)
+	var names []string
+	for _, f := range r.File {
+		names = append(names, fmt.Sprintf("%v %v %v", f.Name, f.Mode(), f.Method))
+	}
+	if got := strings.Join(names, ", "); got != "lib/run.sh -rwxr-xr-x 0, package.json -rw-r--r-- 0" {
+		log.Panicf("Unexpected zip entries: %v", got)
+	}
+
+	// the same files give the same archive, which is stored once
+	again, _ := create()
+	if !again.Spec.Source.Checksum.Equal(archive.Checksum) || again.Spec.Source.URL != archive.URL {
+		log.Panicf("Expected the same archive, got %+v", again.Spec.Source)
+	}
+}
+
+func TestCreateCancelledBuildWait(t *testing.T) {
+	fc := makeFakeController(true)
+	defer fc.Close()
+	dir := makeSourceDir()
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pc := packager.MakePackageCreator(client.MakeClient(fc.URL))
+	result, err := pc.Create(ctx, packager.PackageRequest{
+		Name:         "hello",
+		Environment:  "nodejs",
+		Source:       dir,
+		WaitForBuild: true,
+	}, func(e packager.Event) {
+		if e.Type == packager.EventBuild && e.Build.Status == fission.BuildStatusRunning {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		log.Panicf("Expected the wait to be cancelled, got %v", err)
+	}
+	if result == nil || result.Metadata.Name != "hello" || result.Status != nil {
+		log.Panicf("Expected the created package without a status, got %+v", result)
+	}
+
+	// the event stream is closed, not left to a goroutine
+	for i := 0; atomic.LoadInt32(&fc.streams) > 0; i++ {
+		if i == 100 {
+			log.Panicf("Expected the event stream to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
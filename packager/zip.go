@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packager
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fission/fission"
+	storageSvcClient "github.com/fission/fission/storagesvc/client"
+)
+
+// The archive helpers here are those of "fission package create" as
+// well as of PackageCreator, so archives made either way are the same.
+
+// GzipDefaultLevel is the gzip level archives are compressed with for
+// upload, unless another is asked for.
+const GzipDefaultLevel = 6
+
+// ZipModTime is the modification time of every file of a
+// deterministic zip.
+var ZipModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// File is a regular file to zip under Name, a slash separated path.
+// Its contents are Contents if set, and are read from Path otherwise.
+type File struct {
+	Name     string
+	Path     string
+	Info     os.FileInfo
+	Contents []byte
+}
+
+// DeterministicMode is the mode a file of the given mode has in a
+// deterministic zip: 0755 if it's executable, 0644 otherwise.
+func DeterministicMode(mode os.FileMode) os.FileMode {
+	if mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// WriteZip writes files to out as a zip, in the order given, using the
+// given zip method for each file, and the given level for deflated
+// files (zero for the default). A deterministic zip has fixed
+// modification times and modes, so it only depends on the files'
+// names, contents and whether they're executable.
+func WriteZip(out io.Writer, files []File, method uint16, level int, deterministic bool) error {
+	zw := zip.NewWriter(out)
+	if method == zip.Deflate && level != 0 {
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+	for _, f := range files {
+		hdr, err := zip.FileInfoHeader(f.Info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = f.Name
+		hdr.Method = method
+		if deterministic {
+			hdr.SetModTime(ZipModTime)
+			hdr.SetMode(DeterministicMode(f.Info.Mode()))
+		}
+
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if f.Contents != nil {
+			if _, err := w.Write(f.Contents); err != nil {
+				return err
+			}
+			continue
+		}
+
+		src, err := os.Open(f.Path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Gzip writes in to out gzip compressed at level, GzipDefaultLevel if
+// zero, copying with a buffer of bufferSize bytes.
+func Gzip(out io.Writer, in io.Reader, level int, bufferSize int) error {
+	if level == 0 {
+		level = GzipDefaultLevel
+	}
+	zw, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		return err
+	}
+	_, err = storageSvcClient.CopyBuffer(zw, in, bufferSize)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Embedded reports whether an archive of size bytes is embedded in
+// its package, rather than uploaded, given the literal size limit.
+func Embedded(size int64, limit int64) bool {
+	return size < limit
+}
+
+// FileChecksum returns the SHA256 checksum and size of a file.
+func FileChecksum(fileName string) (fission.Checksum, int64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fission.Checksum{}, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fission.Checksum{}, 0, err
+	}
+	return fission.MakeChecksum(fission.ChecksumTypeSHA256, h.Sum(nil)), size, nil
+}
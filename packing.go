@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PackFiles packs regular files into an ArchivePackingTar literal,
+// each under its base name. Base names must be unique.
+func PackFiles(paths []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	names := make(map[string]string)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, MakeError(ErrorInvalidArgument, fmt.Sprintf("%v isn't a regular file; pack directories on their own", path))
+		}
+		name := filepath.Base(path)
+		if other, ok := names[name]; ok {
+			return nil, MakeError(ErrorInvalidArgument, fmt.Sprintf("%v and %v have the same name", other, path))
+		}
+		names[name] = path
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = w.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     int64(info.Mode().Perm()),
+			Size:     int64(len(contents)),
+			ModTime:  info.ModTime(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnpackFiles writes the files of an ArchivePackingTar literal into
+// the dst directory, creating it. Entries that aren't plain files in
+// dst are rejected.
+func UnpackFiles(data []byte, dst string) error {
+	err := os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+	r := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || strings.ContainsAny(hdr.Name, `/\`) || hdr.Name == ".." || hdr.Name == "." {
+			return fmt.Errorf("illegal entry in packed archive: %v", hdr.Name)
+		}
+		out, err := os.OpenFile(filepath.Join(dst, hdr.Name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode).Perm()|0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type (
+	// Backend stores the archives of the storage service. The HTTP
+	// API is the same whichever backend is used; archive IDs are
+	// whatever the backend's Put returns.
+	//
+	// Backends must be safe for concurrent use, and must return
+	// ErrNotFound from Get, Delete and Stat for IDs they don't
+	// store. backendtest.Run checks a backend against this
+	// contract.
+	Backend interface {
+		// Put stores size bytes read from r under name, replacing
+		// anything stored under it, and returns the stored
+		// object's ID. If it fails, nothing may be left under
+		// name.
+		Put(name string, r io.Reader, size int64) (string, error)
+
+		// Get opens a stored object for reading.
+		Get(id string) (io.ReadCloser, error)
+
+		// Delete removes a stored object.
+		Delete(id string) error
+
+		// Stat describes a stored object.
+		Stat(id string) (*ObjectInfo, error)
+
+		// List returns up to count objects whose names start with
+		// prefix, from cursor on, and the cursor of the next
+		// page. Listing starts with an empty cursor, and ends
+		// when the returned cursor is empty.
+		List(prefix string, cursor string, count int) ([]ObjectInfo, string, error)
+	}
+
+	// ObjectInfo describes an object stored by a Backend.
+	ObjectInfo struct {
+		ID           string
+		Size         int64
+		LastModified time.Time
+	}
+
+	// BackendConfig configures a backend. Path is a local directory
+	// the backend may keep its data in, Container the name of the
+	// bucket, container or directory to store objects in. Options
+	// holds backend specific settings, such as credentials.
+	BackendConfig struct {
+		Path      string
+		Container string
+		Options   map[string]string
+	}
+
+	// BackendFactory makes a backend from its config.
+	BackendFactory func(config BackendConfig) (Backend, error)
+)
+
+// ErrNotFound is returned by backends for objects they don't store.
+var ErrNotFound = errors.New("not found")
+
+var (
+	backendsLock sync.Mutex
+	backends     = make(map[StorageType]BackendFactory)
+)
+
+// RegisterBackend makes a backend available as a storage type. It's
+// meant to be called from init funcs, and panics if the storage type
+// is already registered.
+func RegisterBackend(storageType StorageType, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if _, ok := backends[storageType]; ok {
+		panic(fmt.Sprintf("storage backend %v registered twice", storageType))
+	}
+	backends[storageType] = factory
+}
+
+// MakeBackend makes the backend of a storage type.
+func MakeBackend(storageType StorageType, config BackendConfig) (Backend, error) {
+	backendsLock.Lock()
+	factory, ok := backends[storageType]
+	backendsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type '%v'", storageType)
+	}
+	return factory(config)
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/fission/fission/storagesvc"
+	"github.com/fission/fission/storagesvc/backendtest"
+)
+
+func TestFilesystemBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) storagesvc.Backend {
+		dir, err := ioutil.TempDir("", "storagesvc_backend_test_")
+		if err != nil {
+			t.Fatalf("Error making temp dir: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		b, err := storagesvc.MakeBackend(storagesvc.StorageTypeLocal, storagesvc.BackendConfig{Path: dir, Container: "archives"})
+		if err != nil {
+			t.Fatalf("Error making filesystem backend: %v", err)
+		}
+		return b
+	})
+}
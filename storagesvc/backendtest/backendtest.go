@@ -0,0 +1,323 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package backendtest checks storage service backends against the
+// storagesvc.Backend contract. A backend's tests call Run with a func
+// that makes an empty backend:
+//
+//	func TestS3Backend(t *testing.T) {
+//		backendtest.Run(t, func(t *testing.T) storagesvc.Backend {
+//			return makeTestS3Backend(t)
+//		})
+//	}
+package backendtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fission/fission/storagesvc"
+)
+
+// Run runs the conformance tests, each on a backend made by
+// newBackend, which must store nothing yet.
+func Run(t *testing.T, newBackend func(t *testing.T) storagesvc.Backend) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, b storagesvc.Backend)
+	}{
+		{"PutGet", testPutGet},
+		{"PutEmpty", testPutEmpty},
+		{"PutReplaces", testPutReplaces},
+		{"PutNested", testPutNested},
+		{"PutFailure", testPutFailure},
+		{"Stat", testStat},
+		{"Delete", testDelete},
+		{"NotFound", testNotFound},
+		{"List", testList},
+		{"ListPrefix", testListPrefix},
+		{"ListPages", testListPages},
+		{"Concurrent", testConcurrent},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newBackend(t))
+		})
+	}
+}
+
+func put(t *testing.T, b storagesvc.Backend, name string, contents []byte) string {
+	t.Helper()
+	id, err := b.Put(name, bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		t.Fatalf("Put %v: %v", name, err)
+	}
+	if len(id) == 0 {
+		t.Fatalf("Put %v returned an empty ID", name)
+	}
+	return id
+}
+
+func get(t *testing.T, b storagesvc.Backend, id string) []byte {
+	t.Helper()
+	r, err := b.Get(id)
+	if err != nil {
+		t.Fatalf("Get %v: %v", id, err)
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %v: %v", id, err)
+	}
+	return contents
+}
+
+// list returns the IDs of all objects with the given prefix.
+func list(t *testing.T, b storagesvc.Backend, prefix string, count int) []string {
+	t.Helper()
+	var ids []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			t.Fatalf("List %v didn't end after %v pages", prefix, pages)
+		}
+		infos, next, err := b.List(prefix, cursor, count)
+		if err != nil {
+			t.Fatalf("List %v: %v", prefix, err)
+		}
+		if len(infos) > count {
+			t.Fatalf("List %v returned %v objects, asked for %v", prefix, len(infos), count)
+		}
+		for _, info := range infos {
+			ids = append(ids, info.ID)
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func expectNotFound(t *testing.T, op string, err error) {
+	t.Helper()
+	if err != storagesvc.ErrNotFound {
+		t.Errorf("%v: expected storagesvc.ErrNotFound, got %v", op, err)
+	}
+}
+
+func expectIDs(t *testing.T, what string, got []string, expected ...string) {
+	t.Helper()
+	sort.Strings(expected)
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("%v: got %v, expected %v", what, got, expected)
+	}
+}
+
+func testPutGet(t *testing.T, b storagesvc.Backend) {
+	contents := bytes.Repeat([]byte("0123456789"), 10*1024)
+	id := put(t, b, "archive", contents)
+	if !bytes.Equal(get(t, b, id), contents) {
+		t.Errorf("Get returned different contents than were Put")
+	}
+}
+
+func testPutEmpty(t *testing.T, b storagesvc.Backend) {
+	id := put(t, b, "empty", nil)
+	if got := get(t, b, id); len(got) != 0 {
+		t.Errorf("Get of an empty object returned %v bytes", len(got))
+	}
+}
+
+func testPutReplaces(t *testing.T, b storagesvc.Backend) {
+	id := put(t, b, "archive", []byte("first"))
+	id2 := put(t, b, "archive", []byte("second"))
+	if id != id2 {
+		t.Errorf("Put of the same name returned IDs %v and %v", id, id2)
+	}
+	if got := string(get(t, b, id)); got != "second" {
+		t.Errorf("Get after replacing Put returned '%v'", got)
+	}
+	expectIDs(t, "List after replacing Put", list(t, b, "", 10), id)
+}
+
+func testPutNested(t *testing.T, b storagesvc.Backend) {
+	id := put(t, b, "env/python/archive", []byte("nested"))
+	if got := string(get(t, b, id)); got != "nested" {
+		t.Errorf("Get of nested name returned '%v'", got)
+	}
+}
+
+// failingReader returns some bytes, then an error, like a client
+// going away mid-upload.
+type failingReader struct {
+	n int
+}
+
+var errReader = errors.New("reader failed")
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errReader
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = '.'
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func testPutFailure(t *testing.T, b storagesvc.Backend) {
+	_, err := b.Put("partial", &failingReader{n: 1024}, 4096)
+	if err == nil {
+		t.Fatalf("Put from a failing reader succeeded")
+	}
+	expectIDs(t, "List after failed Put", list(t, b, "", 10))
+}
+
+func testStat(t *testing.T, b storagesvc.Backend) {
+	before := time.Now().Add(-time.Minute)
+	contents := bytes.Repeat([]byte("."), 12345)
+	id := put(t, b, "archive", contents)
+	info, err := b.Stat(id)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.ID != id {
+		t.Errorf("Stat returned ID %v, expected %v", info.ID, id)
+	}
+	if info.Size != int64(len(contents)) {
+		t.Errorf("Stat returned size %v, expected %v", info.Size, len(contents))
+	}
+	if info.LastModified.Before(before) || info.LastModified.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Stat returned last modified time %v, expected about now", info.LastModified)
+	}
+}
+
+func testDelete(t *testing.T, b storagesvc.Backend) {
+	id := put(t, b, "archive", []byte("contents"))
+	keep := put(t, b, "other", []byte("other"))
+	err := b.Delete(id)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	_, err = b.Get(id)
+	expectNotFound(t, "Get after Delete", err)
+	_, err = b.Stat(id)
+	expectNotFound(t, "Stat after Delete", err)
+	expectNotFound(t, "second Delete", b.Delete(id))
+	expectIDs(t, "List after Delete", list(t, b, "", 10), keep)
+}
+
+func testNotFound(t *testing.T, b storagesvc.Backend) {
+	id := put(t, b, "exists", []byte("contents"))
+	missing := id + "-missing"
+	_, err := b.Get(missing)
+	expectNotFound(t, "Get", err)
+	_, err = b.Stat(missing)
+	expectNotFound(t, "Stat", err)
+	expectNotFound(t, "Delete", b.Delete(missing))
+}
+
+func testList(t *testing.T, b storagesvc.Backend) {
+	expectIDs(t, "List of empty backend", list(t, b, "", 10))
+	a := put(t, b, "a", []byte("a"))
+	bb := put(t, b, "b", []byte("bb"))
+	infos, _, err := b.List("", "", 10)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	sizes := make(map[string]int64)
+	for _, info := range infos {
+		sizes[info.ID] = info.Size
+	}
+	if sizes[a] != 1 || sizes[bb] != 2 || len(sizes) != 2 {
+		t.Errorf("List returned sizes %v, expected %v: 1 and %v: 2", sizes, a, bb)
+	}
+}
+
+func testListPrefix(t *testing.T, b storagesvc.Backend) {
+	p1 := put(t, b, "env/python/one", []byte("1"))
+	p2 := put(t, b, "env/python/two", []byte("2"))
+	n := put(t, b, "env/nodejs/one", []byte("3"))
+	top := put(t, b, "top", []byte("4"))
+	expectIDs(t, "List env/python/", list(t, b, "env/python/", 10), p1, p2)
+	expectIDs(t, "List env/", list(t, b, "env/", 10), p1, p2, n)
+	expectIDs(t, "List everything", list(t, b, "", 10), p1, p2, n, top)
+	expectIDs(t, "List missing prefix", list(t, b, "none/", 10))
+}
+
+func testListPages(t *testing.T, b storagesvc.Backend) {
+	var ids []string
+	for i := 0; i < 7; i++ {
+		ids = append(ids, put(t, b, fmt.Sprintf("archive-%v", i), []byte{byte(i)}))
+	}
+	for _, count := range []int{1, 2, 3, 7, 100} {
+		expectIDs(t, fmt.Sprintf("List by %v", count), list(t, b, "", count), ids...)
+	}
+}
+
+func testConcurrent(t *testing.T, b storagesvc.Backend) {
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			contents := bytes.Repeat([]byte{byte('a' + i)}, 64*1024)
+			id, err := b.Put(fmt.Sprintf("concurrent-%v", i), bytes.NewReader(contents), int64(len(contents)))
+			if err != nil {
+				errs <- err
+				return
+			}
+			r, err := b.Get(id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer r.Close()
+			var got bytes.Buffer
+			if _, err := io.Copy(&got, r); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got.Bytes(), contents) {
+				errs <- fmt.Errorf("concurrent-%v: Get returned different contents than were Put", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if ids := list(t, b, "concurrent-", 100); len(ids) != n {
+		t.Errorf("List after concurrent Puts returned %v objects, expected %v", len(ids), n)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// abortTimeout bounds how long Abort spends deleting archives, since
+// it usually runs while the user waits for an interrupted command to
+// exit.
+const abortTimeout = 10 * time.Second
+
+// WithContext ties the client's requests to ctx: once it is
+// cancelled, requests in flight are abandoned and new ones fail, with
+// errors matching context.Canceled. The storage service discards
+// uploads that don't arrive whole.
+func WithContext(ctx context.Context) ClientOption {
+	return func(c *Client) {
+		c.ctx = ctx
+	}
+}
+
+// Abort deletes archives that were uploaded as parts of an upload
+// that won't complete, such as the parts of a split archive uploaded
+// before it was cancelled. It isn't bound by the client's context,
+// which is usually cancelled by then. It tries every ID, and returns
+// the first error.
+func (c *Client) Abort(ids []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	var firstErr error
+	for _, id := range ids {
+		req, err := http.NewRequest(http.MethodDelete, c.GetUrl(id), nil)
+		if err == nil {
+			err = c.delete(req.WithContext(ctx))
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"sync"
+)
+
+type (
+	// flightGroup coalesces concurrent calls with the same key:
+	// while one is in flight, later callers wait for it and share
+	// its result instead of making their own call.
+	flightGroup struct {
+		mu    sync.Mutex
+		calls map[string]*flightCall
+	}
+
+	flightCall struct {
+		done chan struct{}
+		val  interface{}
+		err  error
+	}
+)
+
+// flights is shared by every client, since callers such as the CLI
+// make a client per archive.
+var flights = &flightGroup{calls: make(map[string]*flightCall)}
+
+// do calls fn, unless a call with the same key is in flight, in which
+// case it waits for that call and returns its result. shared is true
+// for results of another caller's call.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.val, call.err, true
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.val, call.err = fn()
+	return call.val, call.err, false
+}
+
+// flightKey identifies what a request's result depends on: the
+// server, the client settings that change it, and the request.
+func (c *Client) flightKey(op string, args ...interface{}) string {
+	return fmt.Sprintf("%v\x00%v\x00%v\x00%v\x00%v", op, c.url, c.headers, c.archiveTTL, fmt.Sprint(args...))
+}
+
+// coalescedUpload runs a content-addressed upload, or waits for an
+// identical one in flight and reuses its result. The file is then
+// not sent, so the result is marked as already stored.
+func (c *Client) coalescedUpload(key string, upload func() (*UploadResult, error)) (*UploadResult, error) {
+	val, err, shared := flights.do(key, func() (interface{}, error) {
+		return upload()
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := *val.(*UploadResult)
+	if shared {
+		res.Stored = true
+	}
+	return &res, nil
+}
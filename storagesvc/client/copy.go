@@ -0,0 +1,151 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/storagesvc"
+)
+
+// Copy copies the archive identified by ID to the storage service of
+// dest, keeping its prefix, and returns the result of storing it
+// there. If this client's storage service can copy to dest, it does
+// so itself; otherwise, or if that fails, the archive is downloaded
+// and uploaded to dest. Either way the copy is verified against the
+// checksum, and stored with dest's credentials: the storage service
+// is sent the headers dest would authorize the upload with.
+func (c *Client) Copy(id string, dest *Client, checksum fission.Checksum) (*UploadResult, error) {
+	prefix := ""
+	if i := strings.LastIndex(id, "/"); i >= 0 {
+		prefix = id[:i+1]
+	}
+
+	if caps, err := c.capabilities(); err == nil && caps.Copy {
+		res, err := c.serverCopy(id, dest, prefix, checksum)
+		// a missing archive can't be copied through the client
+		// either
+		if err == nil || errors.Is(err, fission.ErrArchiveNotFound) {
+			return res, err
+		}
+		log.Printf("Warning: storage service couldn't copy %v to %v, copying through the client: %v", id, dest.url, err)
+	}
+	return c.clientCopy(id, dest, prefix, checksum)
+}
+
+// serverCopy asks the storage service to copy an archive to dest.
+func (c *Client) serverCopy(id string, dest *Client, prefix string, checksum fission.Checksum) (*UploadResult, error) {
+	headers, err := dest.uploadHeaders()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(&storagesvc.CopyRequest{
+		ID:                 id,
+		Destination:        dest.url,
+		DestinationHeaders: headers,
+		Prefix:             prefix,
+		Checksum:           checksum,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+"/copy", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("Copy error %v: %w", resp.Status, fission.ErrArchiveNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError("Copy error", resp)
+	}
+	var cr storagesvc.CopyResponse
+	err = json.NewDecoder(resp.Body).Decode(&cr)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadResult{ID: cr.ID, ServerChecksum: &checksum}, nil
+}
+
+// uploadHeaders returns the headers and credentials the client sends
+// with an upload, for a storage service to upload on its behalf. The
+// body isn't known yet, so a signed upload doesn't cover it; the
+// destination verifies the checksum instead.
+func (c *Client) uploadHeaders() (map[string]string, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url+"/archive", ioutil.NopCloser(bytes.NewReader(nil)))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range c.headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	err = c.authorize(req)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string)
+	for k := range req.Header {
+		headers[k] = req.Header.Get(k)
+	}
+	return headers, nil
+}
+
+// clientCopy downloads an archive to a temporary file, checks it, and
+// uploads it to dest.
+func (c *Client) clientCopy(id string, dest *Client, prefix string, checksum fission.Checksum) (*UploadResult, error) {
+	dir, err := ioutil.TempDir("", "fission-copy")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "archive")
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = c.DownloadStream(context.Background(), id, f, DownloadOptions{Checksum: &checksum})
+	if err == nil {
+		err = f.Close()
+	}
+	if errors.Is(err, fission.ErrInvalidChecksum) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("download %v: %w", id, err)
+	}
+	return dest.UploadVerified(fileName, prefix, checksum, nil)
+}
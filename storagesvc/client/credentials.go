@@ -0,0 +1,177 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// HMACAlgorithm names the signing scheme of HMACSigner in the
+	// Authorization header.
+	HMACAlgorithm = "HMAC-SHA256"
+
+	// ContentSHA256Header carries the hex SHA256 of a signed
+	// request's body, or UnsignedPayload.
+	ContentSHA256Header = "X-Content-Sha256"
+
+	// UnsignedPayload is the body hash of requests whose body
+	// can't be read twice, so isn't covered by the signature.
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+type (
+	// CredentialProvider authorizes requests to the storage
+	// service. It is called for every request, so providers can
+	// refresh short-lived credentials, or sign each request.
+	CredentialProvider interface {
+		Authorize(req *http.Request) error
+	}
+
+	// StaticToken sends the same bearer token on every request.
+	StaticToken string
+
+	// TokenFile reads a bearer token from a file on every request,
+	// so that tokens rotated by another process are picked up
+	// during long uploads.
+	TokenFile string
+
+	// TokenFunc gets a bearer token for each request, e.g. from a
+	// metadata server.
+	TokenFunc func() (string, error)
+
+	// HMACSigner signs every request with a key shared with the
+	// storage service, for services that check signatures instead
+	// of bearer tokens. The signature is the hex HMAC-SHA256 of
+	//
+	//	HMAC-SHA256\n<method>\n<path and query>\n<date>\n<body hash>
+	//
+	// sent as "Authorization: HMAC-SHA256 KeyId=<id>,Signature=<sig>",
+	// with the date in the Date header and the body hash in
+	// X-Content-Sha256. A Date already set on the request is kept.
+	HMACSigner struct {
+		KeyID string
+		Key   []byte
+	}
+)
+
+func setBearerToken(req *http.Request, token string) error {
+	token = strings.TrimSpace(token)
+	if len(token) == 0 {
+		return errors.New("empty storage token")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (t StaticToken) Authorize(req *http.Request) error {
+	return setBearerToken(req, string(t))
+}
+
+func (f TokenFile) Authorize(req *http.Request) error {
+	token, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return err
+	}
+	return setBearerToken(req, string(token))
+}
+
+func (f TokenFunc) Authorize(req *http.Request) error {
+	token, err := f()
+	if err != nil {
+		return err
+	}
+	return setBearerToken(req, token)
+}
+
+func (s HMACSigner) Authorize(req *http.Request) error {
+	if len(s.Key) == 0 {
+		return errors.New("empty storage HMAC key")
+	}
+	bodyHash, err := requestBodyHash(req)
+	if err != nil {
+		return err
+	}
+	date := req.Header.Get("Date")
+	if len(date) == 0 {
+		date = time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+	}
+	req.Header.Set(ContentSHA256Header, bodyHash)
+	req.Header.Set("Authorization", fmt.Sprintf("%v KeyId=%v,Signature=%v",
+		HMACAlgorithm, s.KeyID, s.Signature(req.Method, req.URL.RequestURI(), date, bodyHash)))
+	return nil
+}
+
+// Signature returns the signature of a request with the given
+// method, path and query, date and body hash.
+func (s HMACSigner) Signature(method, uri, date, bodyHash string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v\n%v", HMACAlgorithm, method, uri, date, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestBodyHash returns the hex SHA256 of a request's body, read
+// from a copy made by GetBody, or UnsignedPayload if there's no way
+// to read it without consuming it.
+func requestBodyHash(req *http.Request) (string, error) {
+	h := sha256.New()
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return UnsignedPayload, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		_, err = io.Copy(h, body)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WithCredentials makes the client authorize every request with the
+// given provider.
+func WithCredentials(provider CredentialProvider) ClientOption {
+	return func(c *Client) {
+		c.credentials = provider
+	}
+}
+
+// authorize applies the client's credentials, if any, to req.
+func (c *Client) authorize(req *http.Request) error {
+	if c.credentials == nil {
+		return nil
+	}
+	err := c.credentials.Authorize(req)
+	if err != nil {
+		return fmt.Errorf("get storage credentials: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fission/fission"
+)
+
+// DownloadOptions are the optional parts of a streamed download.
+type DownloadOptions struct {
+	// Checksum, if set, is the checksum the archive must have. A
+	// download that doesn't match it fails with an error matching
+	// fission.ErrInvalidChecksum; its bytes have been written to
+	// the writer by then, so callers must discard them.
+	Checksum *fission.Checksum
+
+	// Progress, if set, is called with the bytes written so far
+	// and the archive's size, or -1 if the service didn't send it
+	// uncompressed, at most PerSecond times a second, and once
+	// when the download completes.
+	Progress  ProgressFunc
+	PerSecond int
+}
+
+// progressWriter reports the bytes written through it.
+type progressWriter struct {
+	w       io.Writer
+	written int64
+	total   int64
+	sampler *progressSampler
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	if n > 0 {
+		pw.sampler.update(pw.written, pw.total)
+	}
+	return n, err
+}
+
+// DownloadStream writes the contents of the file identified by ID to
+// w as they arrive, without holding the archive in memory or on disk,
+// and returns the number of bytes written. ctx cancels the download;
+// with context.Background(), the client's context does, as for other
+// requests. An ID the service doesn't hold is an error matching
+// fission.ErrArchiveNotFound.
+func (c *Client) DownloadStream(ctx context.Context, id string, w io.Writer, opts DownloadOptions) (int64, error) {
+	var h hash.Hash
+	if opts.Checksum != nil {
+		var err error
+		h, err = fission.NewChecksumHash(opts.Checksum.Type)
+		if err != nil {
+			return 0, err
+		}
+		w = io.MultiWriter(w, h)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.GetUrl(id), nil)
+	if err != nil {
+		return 0, err
+	}
+	c.acceptEncoding(req)
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, fmt.Errorf("HTTP error %v: %w", resp.Status, fission.ErrArchiveNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, statusError("HTTP error", resp)
+	}
+	body, err := decodedBody(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	var pw *progressWriter
+	if opts.Progress != nil {
+		perSecond := opts.PerSecond
+		if perSecond <= 0 {
+			perSecond = 1
+		}
+		total := resp.ContentLength
+		if body != resp.Body {
+			// the length is of the compressed transfer
+			total = -1
+		}
+		pw = &progressWriter{
+			w:       w,
+			total:   total,
+			sampler: newProgressSampler(opts.Progress, time.Second/time.Duration(perSecond)),
+		}
+		w = pw
+	}
+
+	n, err := CopyBuffer(w, body, c.bufferSize)
+	if err != nil {
+		if ctxErr := resp.Request.Context().Err(); ctxErr != nil {
+			return n, fmt.Errorf("download of %v cancelled: %w", id, ctxErr)
+		}
+		return n, err
+	}
+	if pw != nil {
+		pw.sampler.finish(n)
+	}
+	if h != nil && !fission.MakeChecksum(opts.Checksum.Type, h.Sum(nil)).Equal(*opts.Checksum) {
+		return n, fmt.Errorf("%w: %v doesn't match its %v checksum", fission.ErrInvalidChecksum, id, opts.Checksum.Type)
+	}
+	return n, nil
+}
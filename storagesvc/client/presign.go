@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/fission/fission/storagesvc"
+)
+
+// ErrPresignExpired means a pre-signed upload URL expired before the
+// upload reached the storage service; a new URL should be requested.
+var ErrPresignExpired = errors.New("pre-signed upload URL expired")
+
+// UploadPresigned PUTs a file to a pre-signed upload URL, such as one
+// issued by the controller, and returns the result with the checksum
+// the storage service verified the upload against. The URL is its own
+// authorization, so the PUT is sent bare, without the client's headers
+// or credentials, which are for the service it usually talks to; only
+// the upload metadata is sent, as with UploadWithPrefix. The upload
+// isn't retried; an expired URL fails with ErrPresignExpired.
+func (c *Client) UploadPresigned(presignedUrl string, filePath string, metadata *map[string]string) (*UploadResult, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, presignedUrl, c.withProgress(f, fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = fi.Size()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(f, 0, fi.Size())), nil
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, vs := range metadataHeader(nil, metadata) {
+		req.Header[k] = vs
+	}
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
+	}
+
+	c.limiter.acquire()
+	defer c.limiter.release()
+	client := &http.Client{Transport: c.transport}
+	resp, err := client.Do(c.traceRequest(req))
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, fmt.Errorf("request to storage service cancelled: %w", ctxErr)
+		}
+		return nil, &unavailableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden && resp.Header.Get(storagesvc.UploadErrorHeader) == storagesvc.UploadErrorPresignExpired {
+		return nil, ErrPresignExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError("Upload error", resp)
+	}
+
+	var ur storagesvc.UploadResponse
+	err = json.NewDecoder(resp.Body).Decode(&ur)
+	if err != nil {
+		return nil, err
+	}
+	if len(ur.ID) == 0 || ur.Checksum == nil {
+		return nil, fmt.Errorf("Upload error: bad response from %v", req.URL.Host)
+	}
+	return &UploadResult{ID: ur.ID, ServerChecksum: ur.Checksum}, nil
+}
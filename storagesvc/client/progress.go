@@ -0,0 +1,152 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"io"
+	"time"
+)
+
+// maxProgressStride bounds how many reads go by without looking at
+// the clock.
+const maxProgressStride = 1024
+
+type (
+	// ProgressFunc is called with the bytes sent so far and the
+	// total size of an upload, or of a download, where the total
+	// is -1 until it completes if the size isn't known.
+	ProgressFunc func(sent int64, total int64)
+
+	// progressSampler calls a ProgressFunc at most once per
+	// interval, plus once when the transfer completes. Reading the
+	// clock on every chunk is itself noticeable on fast links, so
+	// it's only read every stride updates; the stride doubles while
+	// updates keep arriving within the interval and halves when
+	// they don't.
+	progressSampler struct {
+		fn       ProgressFunc
+		interval time.Duration
+		last     time.Time
+		stride   int
+		pending  int
+		final    bool
+	}
+
+	// progressReader reports the bytes read through it.
+	progressReader struct {
+		r       io.Reader
+		sent    int64
+		total   int64
+		sampler *progressSampler
+	}
+)
+
+// WithProgress makes uploads report their progress to fn, at most
+// perSecond times a second. The completed transfer is always
+// reported.
+func WithProgress(fn ProgressFunc, perSecond int) ClientOption {
+	return func(c *Client) {
+		if perSecond <= 0 {
+			perSecond = 1
+		}
+		c.progress = fn
+		c.progressInterval = time.Second / time.Duration(perSecond)
+	}
+}
+
+// WithProgressReset makes a retried upload call fn with the bytes
+// the retry starts from, before its progress is reported again from
+// there, so that progress summed across uploads can take back what
+// the failed attempt reported.
+func WithProgressReset(fn func(sent int64)) ClientOption {
+	return func(c *Client) {
+		c.progressReset = fn
+	}
+}
+
+// resetProgress reports that an upload is retried from sent.
+func (c *Client) resetProgress(sent int64) {
+	if c.progressReset != nil {
+		c.progressReset(sent)
+	}
+}
+
+func newProgressSampler(fn ProgressFunc, interval time.Duration) *progressSampler {
+	return &progressSampler{fn: fn, interval: interval, stride: 1}
+}
+
+func (s *progressSampler) update(sent int64, total int64) {
+	if s.final {
+		return
+	}
+	if total >= 0 && sent >= total {
+		s.final = true
+		s.fn(sent, total)
+		return
+	}
+	s.pending++
+	if s.pending < s.stride {
+		return
+	}
+	s.pending = 0
+
+	now := time.Now()
+	elapsed := now.Sub(s.last)
+	if elapsed < s.interval {
+		if s.stride < maxProgressStride {
+			s.stride *= 2
+		}
+		return
+	}
+	if elapsed > 2*s.interval && s.stride > 1 {
+		s.stride /= 2
+	}
+	s.last = now
+	s.fn(sent, total)
+}
+
+// finish reports a completed transfer of sent bytes, unless its last
+// update already did.
+func (s *progressSampler) finish(sent int64) {
+	if s.final {
+		return
+	}
+	s.final = true
+	s.fn(sent, sent)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.sent += int64(n)
+	if n > 0 || err == io.EOF {
+		r.sampler.update(r.sent, r.total)
+	}
+	return n, err
+}
+
+// withProgress wraps an upload body of size total so that it reports
+// progress, if the client has a ProgressFunc.
+func (c *Client) withProgress(body io.Reader, total int64) io.Reader {
+	if c.progress == nil {
+		return body
+	}
+	return &progressReader{
+		r:       body,
+		total:   total,
+		sampler: newProgressSampler(c.progress, c.progressInterval),
+	}
+}
@@ -0,0 +1,402 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/storagesvc"
+)
+
+type (
+	// ResumableResult describes a completed resumable upload.
+	ResumableResult struct {
+		UploadResult
+
+		// Checksum is the ChecksumTypeSHA256Tree checksum of the
+		// file, which the server verified. Downloads can be
+		// verified against it like any other checksum.
+		Checksum fission.Checksum
+
+		// ResumedAt is the offset the upload resumed from, or 0
+		// if it started from scratch.
+		ResumedAt int64
+	}
+
+	// resumableState is what UploadResumable saves after each
+	// chunk, so that an interrupted upload resumes where it
+	// stopped without hashing the chunks it sent again. Hash has
+	// the digest of each chunk the server received, the last one
+	// too however short, as the server hashes them. Checksum is
+	// set by UploadResumableContent.
+	resumableState struct {
+		SessionID string                `json:"sessionId"`
+		FileSize  int64                 `json:"fileSize"`
+		ModTime   time.Time             `json:"modTime"`
+		Checksum  string                `json:"checksum,omitempty"`
+		Hash      fission.TreeHashState `json:"hash"`
+	}
+)
+
+// errSessionConflict means the server's session state doesn't match
+// what the client expects, e.g. since another client is sending
+// chunks of it.
+var errSessionConflict = errors.New("upload session is out of sync with the storage service")
+
+// UploadResumable sends a file to the storage service in chunks, like
+// UploadWithPrefix. Its progress is saved to statePath after every
+// chunk; if the upload is interrupted, calling UploadResumable again
+// with the same file and statePath sends only the chunks the server
+// hasn't received. The file must not change in between, or the upload
+// starts over. statePath is removed once the upload completes.
+func (c *Client) UploadResumable(filePath string, prefix string, statePath string, metadata *map[string]string) (*ResumableResult, error) {
+	return c.uploadResumable(filePath, prefix, statePath, "", metadata)
+}
+
+// UploadResumableContent is like UploadResumable, for files made
+// again with the same contents before each attempt, e.g. archives
+// packed again: the upload resumes if the file has the given
+// checksum, whenever it was written.
+func (c *Client) UploadResumableContent(filePath string, prefix string, statePath string, checksum fission.Checksum, metadata *map[string]string) (*ResumableResult, error) {
+	return c.uploadResumable(filePath, prefix, statePath, string(checksum.Type)+":"+checksum.Sum, metadata)
+}
+
+// uploadResumable is UploadResumable, resuming uploads of the file
+// with contents identified by checksum, if set, instead of its
+// modification time.
+func (c *Client) uploadResumable(filePath string, prefix string, statePath string, checksum string, metadata *map[string]string) (*ResumableResult, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c.limiter.acquire()
+	defer c.limiter.release()
+
+	state, session, err := c.resumeSession(f, fi, statePath, checksum)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		session, err = c.createSession(fi.Size(), prefix, metadata)
+		if err != nil {
+			return nil, err
+		}
+		state = &resumableState{SessionID: session.ID, FileSize: fi.Size(), ModTime: fi.ModTime(), Checksum: checksum}
+		err = saveResumableState(statePath, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if session.ChunkSize != fission.TreeHashChunkSize {
+		return nil, fmt.Errorf("storage service sends %v byte chunks, the tree hash needs %v", session.ChunkSize, fission.TreeHashChunkSize)
+	}
+	result := &ResumableResult{ResumedAt: session.Offset}
+
+	var sampler *progressSampler
+	if c.progress != nil {
+		sampler = newProgressSampler(c.progress, c.progressInterval)
+	}
+	chunk := make([]byte, session.ChunkSize)
+	for offset := session.Offset; offset < session.Size; {
+		n, err := f.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if int64(n) < session.ChunkSize && offset+int64(n) < session.Size {
+			return nil, fmt.Errorf("%v changed during upload", filePath)
+		}
+		sum := sha256.Sum256(chunk[:n])
+
+		session, err = c.sendChunk(session, offset, chunk[:n], sampler)
+		if err != nil {
+			return nil, err
+		}
+		state.Hash.Chunks = append(state.Hash.Chunks, hex.EncodeToString(sum[:]))
+		if !equalChunks(state.Hash.Chunks, session.Chunks) {
+			return nil, &UploadError{Class: UploadErrorChecksum, Attempts: 1,
+				Err: fmt.Errorf("chunk at offset %v: %w", offset, fission.ErrInvalidChecksum)}
+		}
+		err = saveResumableState(statePath, state)
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+	}
+
+	treeChecksum, err := fission.TreeHashOf(state.Hash)
+	if err != nil {
+		return nil, err
+	}
+	ur, err := c.completeSession(session.ID, treeChecksum)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(statePath)
+
+	result.ID = ur.ID
+	result.Checksum = treeChecksum
+	result.ServerChecksum = &treeChecksum
+	return result, nil
+}
+
+// resumeSession returns the saved state of an upload of f and the
+// server's state of its session, reconciled so that the saved state
+// covers exactly the chunks the server received. It returns a nil
+// session if there's nothing to resume.
+func (c *Client) resumeSession(f *os.File, fi os.FileInfo, statePath string, checksum string) (*resumableState, *storagesvc.UploadSession, error) {
+	state, err := loadResumableState(statePath)
+	if err != nil || state == nil {
+		return nil, nil, err
+	}
+	changed := state.Checksum != checksum
+	if len(checksum) == 0 {
+		changed = !state.ModTime.Equal(fi.ModTime())
+	}
+	if state.FileSize != fi.Size() || changed {
+		// the file changed; its chunks on the server are no use
+		c.abortSession(state.SessionID)
+		return nil, nil, nil
+	}
+	session, err := c.getSession(state.SessionID)
+	if err != nil || session == nil {
+		return nil, nil, err
+	}
+
+	// The server may have received a chunk whose state wasn't
+	// saved, if the upload stopped right after sending it; only
+	// chunks like that are hashed again.
+	local := state.Hash.Chunks
+	if len(local) > len(session.Chunks) {
+		local = local[:len(session.Chunks)]
+	}
+	chunk := make([]byte, session.ChunkSize)
+	for i := len(local); i < len(session.Chunks); i++ {
+		n, err := f.ReadAt(chunk, int64(i)*session.ChunkSize)
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		sum := sha256.Sum256(chunk[:n])
+		local = append(local, hex.EncodeToString(sum[:]))
+	}
+	if !equalChunks(local, session.Chunks) {
+		c.abortSession(state.SessionID)
+		return nil, nil, nil
+	}
+	state.Hash.Chunks = local
+	return state, session, nil
+}
+
+func equalChunks(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func loadResumableState(statePath string) (*resumableState, error) {
+	contents, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state resumableState
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		// a state file cut short; start over
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func saveResumableState(statePath string, state *resumableState) error {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := statePath + ".tmp"
+	err = ioutil.WriteFile(tmp, contents, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
+func (c *Client) sessionUrl(path string, id string) string {
+	return fmt.Sprintf("%v/upload-sessions%v?id=%v", c.url, path, url.QueryEscape(id))
+}
+
+// sessionRequest sends a request about an upload session and decodes
+// its JSON response into v.
+func (c *Client) sessionRequest(req *http.Request, v interface{}) (*http.Response, error) {
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return resp, errSessionConflict
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, statusError("Upload session error", resp)
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) createSession(fileSize int64, prefix string, metadata *map[string]string) (*storagesvc.UploadSession, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url+"/upload-sessions", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-File-Size", strconv.FormatInt(fileSize, 10))
+	if len(prefix) > 0 {
+		req.Header.Set("X-Archive-Prefix", prefix)
+	}
+	if c.archiveTTL > 0 {
+		seconds := int64((c.archiveTTL + time.Second - 1) / time.Second)
+		req.Header.Set(storagesvc.ArchiveTTLHeader, strconv.FormatInt(seconds, 10))
+	}
+	for k, vs := range metadataHeader(nil, metadata) {
+		req.Header[k] = vs
+	}
+	var session storagesvc.UploadSession
+	_, err = c.sessionRequest(req, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// getSession returns the server's state of a session, or nil if it
+// doesn't have the session any more.
+func (c *Client) getSession(id string) (*storagesvc.UploadSession, error) {
+	req, err := http.NewRequest(http.MethodGet, c.sessionUrl("", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var session storagesvc.UploadSession
+	resp, err := c.sessionRequest(req, &session)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// sendChunk sends the chunk at offset, retrying failures that may
+// succeed when tried again, as upload does; a chunk is PUT at its
+// offset, so sending it twice writes it once. It returns the
+// session's state after the chunk.
+func (c *Client) sendChunk(session *storagesvc.UploadSession, offset int64, chunk []byte, sampler *progressSampler) (*storagesvc.UploadSession, error) {
+	u := c.sessionUrl("", session.ID) + "&offset=" + strconv.FormatInt(offset, 10)
+	for attempt := 1; ; attempt++ {
+		var body io.Reader = bytes.NewReader(chunk)
+		if sampler != nil {
+			body = &progressReader{r: body, sent: offset, total: session.Size, sampler: sampler}
+		}
+		req, err := http.NewRequest(http.MethodPut, u, body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(chunk))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(chunk)), nil
+		}
+
+		var next storagesvc.UploadSession
+		resp, err := c.sessionRequest(req, &next)
+		if err == nil {
+			return &next, nil
+		}
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		class := classifyUploadError(err, status, resp)
+		cancelled := c.ctx != nil && c.ctx.Err() != nil
+		if !class.Retryable() || cancelled || attempt >= defaultUploadAttempts {
+			return nil, &UploadError{Class: class, Attempts: attempt, LastStatus: status, Err: err}
+		}
+		if c.debugLogf != nil {
+			c.debugLogf("chunk at offset %v failed (%v), retrying: %v", offset, class, err)
+		}
+		c.resetProgress(offset)
+		time.Sleep(c.retryDelay << uint(attempt-1))
+	}
+}
+
+func (c *Client) completeSession(id string, checksum fission.Checksum) (*storagesvc.UploadResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, c.sessionUrl("/complete", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(storagesvc.UploadChecksumHeader, string(checksum.Type)+":"+checksum.Sum)
+	var ur storagesvc.UploadResponse
+	resp, err := c.sessionRequest(req, &ur)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		return nil, &UploadError{Class: classifyUploadError(err, status, resp), Attempts: 1, LastStatus: status, Err: err}
+	}
+	if ur.Checksum != nil && !ur.Checksum.Equal(checksum) {
+		return nil, &UploadError{Class: UploadErrorChecksum, Attempts: 1, LastStatus: resp.StatusCode,
+			Err: fmt.Errorf("server combined checksum %v: %w", ur.Checksum.Sum, fission.ErrInvalidChecksum)}
+	}
+	return &ur, nil
+}
+
+// abortSession discards a session the client won't resume. Failures
+// are ignored: the server discards abandoned sessions eventually.
+func (c *Client) abortSession(id string) {
+	req, err := http.NewRequest(http.MethodDelete, c.sessionUrl("", id), nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
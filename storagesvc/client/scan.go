@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fission/fission/storagesvc"
+)
+
+var (
+	// ErrArchiveInfected means the storage service's malware scan
+	// found an archive infected; the service deleted it.
+	ErrArchiveInfected = errors.New("archive failed malware scan")
+
+	// ErrScanUnavailable means the storage service doesn't scan
+	// uploads.
+	ErrScanUnavailable = errors.New("storage service doesn't scan uploads")
+)
+
+// maxScanPollInterval bounds the wait between polls of a scan.
+const maxScanPollInterval = 5 * time.Second
+
+// ScanResult returns the result of the malware scan of an archive, or
+// nil if it has none, e.g. as it was stored before the storage
+// service scanned uploads.
+func (c *Client) ScanResult(id string) (*storagesvc.ScanResult, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url+"/scan?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError("Scan error", resp)
+	}
+	var result storagesvc.ScanResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// WaitScan waits up to timeout for the malware scan of an archive to
+// complete, polling its result, and returns it. It fails with
+// ErrArchiveInfected if the archive is infected, and with
+// ErrScanUnavailable if the storage service doesn't scan uploads. The
+// result is nil for archives stored without a scan.
+func (c *Client) WaitScan(id string, timeout time.Duration) (*storagesvc.ScanResult, error) {
+	caps, err := c.capabilities()
+	if err != nil || !caps.Scan {
+		return nil, ErrScanUnavailable
+	}
+	deadline := time.Now().Add(timeout)
+	interval := 500 * time.Millisecond
+	for {
+		result, err := c.ScanResult(id)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case result == nil || result.Status == storagesvc.ScanStatusClean:
+			return result, nil
+		case result.Status == storagesvc.ScanStatusInfected:
+			return result, fmt.Errorf("%w: %v", ErrArchiveInfected, result.Detail)
+		case result.Status == storagesvc.ScanStatusError:
+			return result, fmt.Errorf("malware scan of %v failed: %v", id, result.Detail)
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return result, fmt.Errorf("malware scan of %v didn't complete in %v", id, timeout)
+		}
+		if c.debugLogf != nil {
+			c.debugLogf("malware scan of %v is %v, polling again in %v", id, result.Status, interval)
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > maxScanPollInterval {
+			interval = maxScanPollInterval
+		}
+	}
+}
@@ -18,15 +18,27 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/dchest/uniuri"
 
+	"github.com/fission/fission"
 	"github.com/fission/fission/storagesvc"
 )
 
@@ -85,6 +97,13 @@ func TestStorageService(t *testing.T) {
 		log.Panicf("Contents don't match")
 	}
 
+	// check its size
+	size, err := client.Size(fileId)
+	panicIf(err)
+	if size != 10*1024 {
+		log.Panicf("Size mismatch: got %v, expected %v", size, 10*1024)
+	}
+
 	// delete uploaded file
 	err = client.Delete(fileId)
 	panicIf(err)
@@ -95,6 +114,1156 @@ func TestStorageService(t *testing.T) {
 		log.Panicf("Download succeeded but file isn't supposed to exist")
 	}
 
+	// store it under a prefix
+	fileId, err = client.UploadWithPrefix(tmpfile.Name(), "env/test", &metadata)
+	panicIf(err)
+	if !strings.Contains(fileId, "env/test/") {
+		log.Panicf("Uploaded file ID '%v' doesn't contain prefix", fileId)
+	}
+	err = client.Delete(fileId)
+	panicIf(err)
+
+	// prefixes escaping the container must be rejected
+	_, err = client.UploadWithPrefix(tmpfile.Name(), "../escape", &metadata)
+	if err == nil {
+		log.Panicf("Upload succeeded with a path traversal prefix")
+	}
+
+	// conditional uploads store content once
+	sum := sha256.Sum256(contents1)
+	checksum := fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:])
+	fileId, stored, err := client.UploadIfNoneMatch(tmpfile.Name(), "", checksum, &metadata)
+	panicIf(err)
+	if stored {
+		log.Panicf("First conditional upload reported content as already stored")
+	}
+	fileId2, stored, err := client.UploadIfNoneMatch(tmpfile.Name(), "", checksum, &metadata)
+	panicIf(err)
+	if !stored || fileId2 != fileId {
+		log.Panicf("Second conditional upload: stored=%v id=%v, expected true and %v", stored, fileId2, fileId)
+	}
+
+	// both uploads are counted, though stored once
+	stats, err := client.Stats()
+	panicIf(err)
+	found := false
+	for _, a := range stats.Items {
+		if a.ID == fileId {
+			found = true
+			if a.Uploads != 2 || a.Size != 10*1024 {
+				log.Panicf("Stats of %v: %v uploads of %v bytes, expected 2 of %v", fileId, a.Uploads, a.Size, 10*1024)
+			}
+		}
+	}
+	if !found || stats.DedupedUploads < 1 || stats.LogicalBytes <= stats.Bytes {
+		log.Panicf("Stats %+v don't show the deduplicated upload of %v", stats, fileId)
+	}
+	err = client.Delete(fileId)
+	panicIf(err)
+
+	// verified uploads use the cheapest negotiated checksum
+	if t := client.NegotiateChecksumType(); t != fission.ChecksumTypeCRC32C {
+		log.Panicf("Negotiated checksum type %v, expected %v", t, fission.ChecksumTypeCRC32C)
+	}
+	res, err := client.UploadVerified(tmpfile.Name(), "", checksum, nil)
+	panicIf(err)
+	if res.ServerChecksum == nil || res.ServerChecksum.Type != fission.ChecksumTypeCRC32C {
+		log.Panicf("Verified upload returned server checksum %v", res.ServerChecksum)
+	}
+	err = client.Delete(res.ID)
+	panicIf(err)
+
+	// named archives are downloaded under their name
+	fileId, err = client.Upload(tmpfile.Name(), &map[string]string{storagesvc.ArchiveNameMetadata: "hello.zip"})
+	panicIf(err)
+	resp, err := http.Get(client.GetUrl(fileId))
+	panicIf(err)
+	resp.Body.Close()
+	if d := resp.Header.Get("Content-Disposition"); d != `attachment; filename=hello.zip` {
+		log.Panicf("Content-Disposition '%v', expected the archive name", d)
+	}
+	err = client.Delete(fileId)
+	panicIf(err)
+	_, err = client.Upload(tmpfile.Name(), &map[string]string{storagesvc.ArchiveNameMetadata: "../escape"})
+	if err == nil {
+		log.Panicf("Upload succeeded with a name with directories")
+	}
+
+	// warm archives are listed until deleted
+	fileId, err = client.Upload(tmpfile.Name(), &metadata)
+	panicIf(err)
+	wr, err := client.Warm(fileId, checksum)
+	panicIf(err)
+	if wr.AlreadyWarm || wr.Archive.Size != 10*1024 {
+		log.Panicf("First warm: already=%v size=%v, expected false and %v", wr.AlreadyWarm, wr.Archive.Size, 10*1024)
+	}
+	wr, err = client.Warm(fileId, checksum)
+	panicIf(err)
+	if !wr.AlreadyWarm {
+		log.Panicf("Second warm didn't report the archive as already cached")
+	}
+	warm, err := client.WarmList()
+	panicIf(err)
+	if len(warm) != 1 || warm[0].ID != fileId || !warm[0].Checksum.Equal(checksum) {
+		log.Panicf("Warm list %v, expected only %v", warm, fileId)
+	}
+	err = client.Delete(fileId)
+	panicIf(err)
+	warm, err = client.WarmList()
+	panicIf(err)
+	if len(warm) != 0 {
+		log.Panicf("Warm list %v still has the deleted archive", warm)
+	}
+	if _, err = client.Warm(fileId, checksum); err == nil {
+		log.Panicf("Warming a deleted archive succeeded")
+	}
+
+	// archives uploaded with a TTL disappear once it passes
+	ttlClient := MakeClient(fmt.Sprintf("http://localhost:%v/", port), WithArchiveTTL(time.Second))
+	fileId, err = ttlClient.Upload(tmpfile.Name(), &metadata)
+	panicIf(err)
+	_, err = client.Size(fileId)
+	panicIf(err)
+	time.Sleep(1100 * time.Millisecond)
+	if _, err = client.Size(fileId); err == nil {
+		log.Panicf("Archive %v still exists after its TTL", fileId)
+	}
+
+	// resumable uploads interrupted after a chunk send only the rest
+	bigfile := MakeTestFile(3*fission.TreeHashChunkSize + 1024)
+	defer os.Remove(bigfile.Name())
+	statePath := bigfile.Name() + ".upload"
+	defer os.Remove(statePath)
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := MakeClient(fmt.Sprintf("http://localhost:%v/", port), WithContext(ctx),
+		WithProgress(func(sent int64, total int64) {
+			if sent > fission.TreeHashChunkSize {
+				cancel()
+			}
+		}, 1000))
+	_, err = interrupted.UploadResumable(bigfile.Name(), "", statePath, &metadata)
+	cancel()
+	if err == nil {
+		log.Panicf("Interrupted resumable upload succeeded")
+	}
+	rr, err := client.UploadResumable(bigfile.Name(), "", statePath, &metadata)
+	panicIf(err)
+	if rr.ResumedAt < fission.TreeHashChunkSize || rr.ResumedAt%fission.TreeHashChunkSize != 0 {
+		log.Panicf("Resumable upload resumed at %v, expected a chunk boundary after the first chunk", rr.ResumedAt)
+	}
+	if _, err = os.Stat(statePath); !os.IsNotExist(err) {
+		log.Panicf("Resumable upload state %v left behind", statePath)
+	}
+	var downloaded bytes.Buffer
+	err = client.DownloadTo(rr.ID, &downloaded)
+	panicIf(err)
+	treeHash, err := fission.NewChecksumHash(fission.ChecksumTypeSHA256Tree)
+	panicIf(err)
+	treeHash.Write(downloaded.Bytes())
+	if !fission.MakeChecksum(fission.ChecksumTypeSHA256Tree, treeHash.Sum(nil)).Equal(rr.Checksum) {
+		log.Panicf("Downloaded archive doesn't match its tree checksum %v", rr.Checksum.Sum)
+	}
+	contents3, err := ioutil.ReadFile(bigfile.Name())
+	panicIf(err)
+	if !bytes.Equal(downloaded.Bytes(), contents3) {
+		log.Panicf("Contents of resumed upload don't match")
+	}
+	err = client.Delete(rr.ID)
+	panicIf(err)
+
+	// the file's last chunk is short, and hashed as the server
+	// hashes it; written again with the same contents, it resumes
+	// by them
+	sum3 := sha256.Sum256(contents3)
+	checksum3 := fission.MakeChecksum(fission.ChecksumTypeSHA256, sum3[:])
+	ctx, cancel = context.WithCancel(context.Background())
+	interrupted = MakeClient(fmt.Sprintf("http://localhost:%v/", port), WithContext(ctx),
+		WithProgress(func(sent int64, total int64) {
+			if sent > 2*fission.TreeHashChunkSize {
+				cancel()
+			}
+		}, 1000))
+	_, err = interrupted.UploadResumableContent(bigfile.Name(), "", statePath, checksum3, nil)
+	cancel()
+	if err == nil {
+		log.Panicf("Interrupted resumable upload succeeded")
+	}
+	later := time.Now().Add(time.Hour)
+	panicIf(os.Chtimes(bigfile.Name(), later, later))
+	rr2, err := client.UploadResumableContent(bigfile.Name(), "", statePath, checksum3, nil)
+	panicIf(err)
+	if rr2.ResumedAt < 2*fission.TreeHashChunkSize {
+		log.Panicf("Rewritten file resumed at %v, expected after the second chunk", rr2.ResumedAt)
+	}
+	if !rr2.Checksum.Equal(rr.Checksum) {
+		log.Panicf("Expected the same tree checksum %v, got %v", rr.Checksum.Sum, rr2.Checksum.Sum)
+	}
+	err = client.Delete(rr2.ID)
+	panicIf(err)
+
+	// unsupported API versions must fail clearly
+	_, err = MakeClient(fmt.Sprintf("http://localhost:%v/", port), WithAPIVersion(99)).Size(fileId)
+	if err == nil || !strings.Contains(err.Error(), "API version") {
+		log.Panicf("Expected API version error, got %v", err)
+	}
+
 	// cleanup /tmp
 	os.RemoveAll(fmt.Sprintf("/tmp/%v", testId))
+	os.Remove(fmt.Sprintf("/tmp/.%v-expiry.json", testId))
+	os.Remove(fmt.Sprintf("/tmp/.%v-warm.json", testId))
+	os.Remove(fmt.Sprintf("/tmp/.%v-names.json", testId))
+	os.Remove(fmt.Sprintf("/tmp/.%v-uploads.json", testId))
+	os.RemoveAll(fmt.Sprintf("/tmp/.%v-sessions", testId))
+}
+
+func benchmarkCopyBuffer(b *testing.B, bufferSize int) {
+	tmpfile := MakeTestFile(64 * 1024 * 1024)
+	defer os.Remove(tmpfile.Name())
+
+	b.SetBytes(64 * 1024 * 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(tmpfile.Name())
+		panicIf(err)
+		_, err = CopyBuffer(sha256.New(), f, bufferSize)
+		panicIf(err)
+		f.Close()
+	}
+}
+
+func BenchmarkCopyBuffer32K(b *testing.B) { benchmarkCopyBuffer(b, 32*1024) }
+func BenchmarkCopyBuffer1M(b *testing.B)  { benchmarkCopyBuffer(b, DefaultBufferSize) }
+
+func TestProgressSampler(t *testing.T) {
+	var calls int
+	var last int64
+	s := newProgressSampler(func(sent int64, total int64) {
+		calls++
+		last = sent
+	}, time.Hour)
+
+	const total = 1000000
+	for sent := int64(1); sent <= total; sent++ {
+		s.update(sent, total)
+	}
+	// the first sample, then nothing until the final 100%
+	if calls != 2 || last != total {
+		log.Panicf("Expected 2 progress updates ending at %v, got %v ending at %v", total, calls, last)
+	}
+}
+
+func TestArchiveUrl(t *testing.T) {
+	c := MakeClient("http://localhost:8090/")
+	if u := c.ArchiveUrl("a/b"); u != c.GetUrl("a/b") {
+		log.Panicf("Expected archive URLs on the client's URL, got %v", u)
+	}
+
+	// a client reaching the service directly records the in-cluster URL
+	c = MakeClient("http://localhost:8090/", WithArchiveUrl("http://controller.fission/proxy/storage/"))
+	expected := "http://controller.fission/proxy/storage/v1/archive?id=a%2Fb"
+	if u := c.ArchiveUrl("a/b"); u != expected {
+		log.Panicf("Expected archive URL %v, got %v", expected, u)
+	}
+	if u := c.GetUrl("a/b"); u != "http://localhost:8090/v1/archive?id=a%2Fb" {
+		log.Panicf("Expected downloads from the client's URL, got %v", u)
+	}
+}
+
+func benchmarkProgress(b *testing.B, fn ProgressFunc) {
+	const size = 64 * 1024 * 1024
+	data := make([]byte, size)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var r io.Reader = bytes.NewReader(data)
+		if fn != nil {
+			r = &progressReader{r: r, total: size, sampler: newProgressSampler(fn, 100*time.Millisecond)}
+		}
+		// small reads, as on a fast link, are the worst case
+		_, err := CopyBuffer(ioutil.Discard, r, minBufferSize)
+		panicIf(err)
+	}
+}
+
+func BenchmarkProgressNone(b *testing.B) { benchmarkProgress(b, nil) }
+func BenchmarkProgressSampled(b *testing.B) {
+	benchmarkProgress(b, func(sent int64, total int64) {
+		fmt.Fprintf(ioutil.Discard, "\r%v%%", sent*100/total)
+	})
+}
+
+func TestConcurrentIdenticalUploads(t *testing.T) {
+	var uploads, lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/archive":
+			atomic.AddInt32(&uploads, 1)
+			io.Copy(ioutil.Discard, r.Body)
+			// keep the upload in flight while the others start
+			time.Sleep(200 * time.Millisecond)
+			sum := strings.Trim(r.Header.Get("If-None-Match"), `"`)
+			fmt.Fprintf(w, `{"id": %q}`, storagesvc.ContentID("", sum))
+		case r.Method == http.MethodHead:
+			atomic.AddInt32(&lookups, 1)
+			time.Sleep(200 * time.Millisecond)
+			http.NotFound(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	f := MakeTestFile(10 * 1024)
+	defer os.Remove(f.Name())
+	contents, err := ioutil.ReadFile(f.Name())
+	panicIf(err)
+	checksum := fission.Checksum{
+		Type: fission.ChecksumTypeSHA256,
+		Sum:  fmt.Sprintf("%x", sha256.Sum256(contents)),
+	}
+
+	const callers = 8
+	ids := make([]string, callers)
+	stored := make([]bool, callers)
+	found := make([]bool, callers)
+	errs := make([]error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// a client per caller, as the CLI makes per archive
+			client := MakeClient(server.URL)
+			_, found[i], errs[i] = client.GetByChecksum("", checksum)
+			if errs[i] != nil {
+				return
+			}
+			ids[i], stored[i], errs[i] = client.UploadIfNoneMatch(f.Name(), "", checksum, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil {
+			log.Panicf("Caller %v failed: %v", i, errs[i])
+		}
+		if found[i] {
+			log.Panicf("Caller %v found an archive that isn't stored", i)
+		}
+		if ids[i] != ids[0] {
+			log.Panicf("Caller %v got ID %v, expected %v", i, ids[i], ids[0])
+		}
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		log.Panicf("Expected 1 lookup, server got %v", n)
+	}
+	if n := atomic.LoadInt32(&uploads); n != 1 {
+		log.Panicf("Expected 1 upload, server got %v", n)
+	}
+	sent := 0
+	for _, s := range stored {
+		if !s {
+			sent++
+		}
+	}
+	if sent != 1 {
+		log.Panicf("Expected 1 caller to send the file, %v did", sent)
+	}
+}
+
+func TestCancelledUpload(t *testing.T) {
+	var deleted []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			// hold the upload until the client gives up
+			<-r.Context().Done()
+		case http.MethodDelete:
+			mu.Lock()
+			deleted = append(deleted, r.URL.Query().Get("id"))
+			mu.Unlock()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	f := MakeTestFile(10 * 1024)
+	defer os.Remove(f.Name())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := MakeClient(server.URL, WithContext(ctx))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	_, err := client.UploadWithPrefix(f.Name(), "", nil)
+	if !errors.Is(err, context.Canceled) {
+		log.Panicf("Expected a cancelled upload, got %v", err)
+	}
+
+	// the context is cancelled, but aborting must still reach the
+	// server
+	err = client.Abort([]string{"part-1", "part-2"})
+	panicIf(err)
+	if len(deleted) != 2 || deleted[0] != "part-1" || deleted[1] != "part-2" {
+		log.Panicf("Expected parts to be deleted, server deleted %v", deleted)
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUploadErrorClassification(t *testing.T) {
+	retry := WithRetryDelay(time.Millisecond)
+
+	f := MakeTestFile(1024)
+	defer os.Remove(f.Name())
+	contents, err := ioutil.ReadFile(f.Name())
+	panicIf(err)
+	sum := sha256.Sum256(contents)
+	checksum := fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:])
+
+	tests := []struct {
+		name        string
+		conditional bool
+		handler     http.HandlerFunc
+		class       UploadErrorClass
+		attempts    int
+		status      int
+	}{
+		{"5xx", true, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "storage failed", 500)
+		}, UploadErrorServer, defaultUploadAttempts, 500},
+		// the server may have stored it, so sending it again
+		// could store it twice
+		{"5xx unconditional", false, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "storage failed", 500)
+		}, UploadErrorServer, 1, 500},
+		{"4xx", false, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad request", 400)
+		}, UploadErrorClient, 1, 400},
+		{"checksum", false, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(storagesvc.UploadErrorHeader, storagesvc.UploadErrorChecksumMismatch)
+			http.Error(w, "checksum mismatch", 400)
+		}, UploadErrorChecksum, 1, 400},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			io.Copy(ioutil.Discard, r.Body)
+			test.handler(w, r)
+		}))
+		client := MakeClient(server.URL, retry)
+		var err error
+		if test.conditional {
+			_, _, err = client.UploadIfNoneMatch(f.Name(), "", checksum, nil)
+		} else {
+			_, err = client.UploadWithPrefix(f.Name(), "", nil)
+		}
+		server.Close()
+
+		var uploadErr *UploadError
+		if !errors.As(err, &uploadErr) {
+			log.Panicf("%v: expected an UploadError, got %v", test.name, err)
+		}
+		if uploadErr.Class != test.class || uploadErr.Attempts != test.attempts || uploadErr.LastStatus != test.status {
+			log.Panicf("%v: expected %v after %v attempts with status %v, got %v after %v with %v", test.name,
+				test.class, test.attempts, test.status, uploadErr.Class, uploadErr.Attempts, uploadErr.LastStatus)
+		}
+		if n := atomic.LoadInt32(&requests); int(n) != test.attempts {
+			log.Panicf("%v: expected %v requests, server got %v", test.name, test.attempts, n)
+		}
+	}
+
+	// a retried upload that succeeds
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "unavailable", 503)
+			return
+		}
+		fmt.Fprint(w, `{"id": "retried"}`)
+	}))
+	id, _, err := MakeClient(server.URL, retry).UploadIfNoneMatch(f.Name(), "", checksum, nil)
+	server.Close()
+	panicIf(err)
+	if id != "retried" {
+		log.Panicf("Expected the retried upload's ID, got %v", id)
+	}
+
+	// an untrusted certificate
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	_, err = MakeClient(tlsServer.URL, retry).UploadWithPrefix(f.Name(), "", nil)
+	tlsServer.Close()
+	expectUploadError(err, UploadErrorTLS, 1)
+
+	// nothing listening; nothing was sent, so even an
+	// unconditional upload is tried again
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, err = MakeClient(closed.URL, retry).UploadWithPrefix(f.Name(), "", nil)
+	expectUploadError(err, UploadErrorConnection, defaultUploadAttempts)
+	if !errors.Is(err, fission.ErrStorageUnavailable) {
+		log.Panicf("Expected a connection failure to be ErrStorageUnavailable, got %v", err)
+	}
+
+	// transport failures that can't be set up reliably
+	dnsErr := &unavailableError{&net.DNSError{Err: "no such host", Name: "storagesvc.invalid", IsNotFound: true}}
+	if class := classifyUploadError(dnsErr, 0, nil); class != UploadErrorDNS {
+		log.Panicf("Expected a DNS failure, got %v", class)
+	}
+	timeoutErr := &unavailableError{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}}
+	if class := classifyUploadError(timeoutErr, 0, nil); class != UploadErrorTimeout || !class.Retryable() {
+		log.Panicf("Expected a retryable timeout, got %v", class)
+	}
+	readErr := &unavailableError{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}}
+	if mayRetry(UploadErrorTimeout, readErr, http.Header{}) {
+		log.Panicf("Expected an unconditional upload that timed out once sent not to be retried")
+	}
+	if !mayRetry(UploadErrorTimeout, readErr, http.Header{"If-None-Match": {`"` + checksum.HexSum() + `"`}}) {
+		log.Panicf("Expected a conditional upload that timed out to be retried")
+	}
+}
+
+func expectUploadError(err error, class UploadErrorClass, attempts int) {
+	var uploadErr *UploadError
+	if !errors.As(err, &uploadErr) || uploadErr.Class != class || uploadErr.Attempts != attempts {
+		log.Panicf("Expected a %v upload error after %v attempts, got %v", class, attempts, err)
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	signer := HMACSigner{KeyID: "test", Key: []byte("secret-key")}
+	date := "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	tests := []struct {
+		method    string
+		body      io.Reader
+		bodyHash  string
+		signature string
+	}{
+		{http.MethodPost, strings.NewReader("hello"),
+			"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			"78d14c5f82d74b2fb0d37c1aa4e2a75af5d51020b0cdc7141518220481e6a1b1"},
+		{http.MethodGet, nil,
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			"a29f2d468e4ab19ef2c129c299afb5db47f439c0db27708ce7721ad310d06acb"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "http://storage/v1/archive?id=abc", test.body)
+		panicIf(err)
+		req.Header.Set("Date", date)
+		panicIf(signer.Authorize(req))
+
+		if h := req.Header.Get(ContentSHA256Header); h != test.bodyHash {
+			log.Panicf("%v: expected body hash %v, got %v", test.method, test.bodyHash, h)
+		}
+		expected := "HMAC-SHA256 KeyId=test,Signature=" + test.signature
+		if auth := req.Header.Get("Authorization"); auth != expected {
+			log.Panicf("%v: expected Authorization %q, got %q", test.method, expected, auth)
+		}
+	}
+
+	// uploads are signed over their whole body
+	var verified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		panicIf(err)
+		sum := sha256.Sum256(body)
+		bodyHash := fmt.Sprintf("%x", sum)
+		expected := "HMAC-SHA256 KeyId=test,Signature=" +
+			signer.Signature(r.Method, r.URL.RequestURI(), r.Header.Get("Date"), bodyHash)
+		if r.Header.Get(ContentSHA256Header) == bodyHash && r.Header.Get("Authorization") == expected {
+			atomic.AddInt32(&verified, 1)
+		}
+		fmt.Fprint(w, `{"id": "signed"}`)
+	}))
+	defer server.Close()
+
+	f := MakeTestFile(1024)
+	defer os.Remove(f.Name())
+	_, err := MakeClient(server.URL, WithCredentials(signer)).UploadWithPrefix(f.Name(), "", nil)
+	panicIf(err)
+	if atomic.LoadInt32(&verified) != 1 {
+		log.Panicf("Expected the upload's signature to verify")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	srcPort, destPort := 8081, 8082
+	destUrl := fmt.Sprintf("http://localhost:%v/", destPort)
+	_ = storagesvc.RunStorageServiceWithOptions(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), srcPort,
+		map[string]string{storagesvc.CopyDestinationsOption: destUrl + "v1"})
+	_ = storagesvc.RunStorageService(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), destPort)
+	time.Sleep(time.Second)
+	src := MakeClient(fmt.Sprintf("http://localhost:%v/", srcPort))
+	dest := MakeClient(destUrl)
+
+	f := MakeTestFile(10 * 1024)
+	defer os.Remove(f.Name())
+	contents, err := ioutil.ReadFile(f.Name())
+	panicIf(err)
+	checksum := fission.Checksum{
+		Type: fission.ChecksumTypeSHA256,
+		Sum:  fmt.Sprintf("%x", sha256.Sum256(contents)),
+	}
+	id, err := src.UploadWithPrefix(f.Name(), "env/copy", nil)
+	panicIf(err)
+
+	// the source service copies to the destination itself
+	res, err := src.Copy(id, dest, checksum)
+	panicIf(err)
+	if !strings.HasPrefix(res.ID, "env/copy/") {
+		log.Panicf("Copy '%v' lost the prefix of '%v'", res.ID, id)
+	}
+	var copied bytes.Buffer
+	panicIf(dest.DownloadTo(res.ID, &copied))
+	if !bytes.Equal(copied.Bytes(), contents) {
+		log.Panicf("Copied contents don't match")
+	}
+
+	// the destination can't copy back, so the client does
+	back, err := dest.Copy(res.ID, src, checksum)
+	panicIf(err)
+	size, err := src.Size(back.ID)
+	panicIf(err)
+	if size != int64(len(contents)) {
+		log.Panicf("Size mismatch: got %v, expected %v", size, len(contents))
+	}
+
+	// copies are verified
+	bad := fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: strings.Repeat("0", 64)}
+	_, err = src.Copy(id, dest, bad)
+	if !errors.Is(err, fission.ErrInvalidChecksum) {
+		log.Panicf("Expected a checksum error copying with a bad checksum, got %v", err)
+	}
+}
+
+func TestCopyCredentials(t *testing.T) {
+	var authorization atomic.Value
+	authorization.Store("")
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, `{"id": "copied"}`)
+	}))
+	defer dest.Close()
+
+	srcPort := 8090
+	_ = storagesvc.RunStorageServiceWithOptions(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), srcPort,
+		map[string]string{storagesvc.CopyDestinationsOption: dest.URL + "/v1"})
+	time.Sleep(time.Second)
+	src := MakeClient(fmt.Sprintf("http://localhost:%v/", srcPort))
+
+	f := MakeTestFile(1024)
+	defer os.Remove(f.Name())
+	contents, err := ioutil.ReadFile(f.Name())
+	panicIf(err)
+	checksum := fission.Checksum{
+		Type: fission.ChecksumTypeSHA256,
+		Sum:  fmt.Sprintf("%x", sha256.Sum256(contents)),
+	}
+	id, err := src.UploadWithPrefix(f.Name(), "", nil)
+	panicIf(err)
+
+	// the source service uploads with the destination's credentials
+	res, err := src.Copy(id, MakeClient(dest.URL, WithCredentials(StaticToken("dest-token"))), checksum)
+	panicIf(err)
+	if res.ID != "copied" {
+		log.Panicf("Expected the destination's ID, got %v", res.ID)
+	}
+	if a := authorization.Load().(string); a != "Bearer dest-token" {
+		log.Panicf("Expected the copy to carry the destination's token, got '%v'", a)
+	}
+}
+
+func TestUploadPresigned(t *testing.T) {
+	port := 8083
+	key := uniuri.NewLen(16)
+	storageUrl := fmt.Sprintf("http://localhost:%v", port)
+	_ = storagesvc.RunStorageServiceWithOptions(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), port,
+		map[string]string{storagesvc.PresignKeyOption: key})
+	time.Sleep(time.Second)
+	client := MakeClient(storageUrl)
+
+	f := MakeTestFile(10 * 1024)
+	defer os.Remove(f.Name())
+	contents, err := ioutil.ReadFile(f.Name())
+	panicIf(err)
+	checksum := fission.Checksum{
+		Type: fission.ChecksumTypeSHA256,
+		Sum:  fmt.Sprintf("%x", sha256.Sum256(contents)),
+	}
+	size := int64(len(contents))
+
+	presignedUrl, id, err := storagesvc.PresignUpload(storageUrl, key, "env/presigned", checksum, size, time.Now().Add(time.Minute))
+	panicIf(err)
+	metadata := map[string]string{storagesvc.ArchiveTagMetadataPrefix + "git-sha": "abc123"}
+	res, err := client.UploadPresigned(presignedUrl, f.Name(), &metadata)
+	panicIf(err)
+	if res.ID != id || !res.ServerChecksum.Equal(checksum) {
+		log.Panicf("Pre-signed upload stored %v (%v), expected %v", res.ID, res.ServerChecksum, id)
+	}
+	// and tagged like any other upload
+	archives, err := client.FindByTags([]string{"git-sha=abc123"})
+	panicIf(err)
+	if len(archives) != 1 || archives[0].ID != id {
+		log.Panicf("Expected pre-signed upload %v to be tagged, found %v", id, archives)
+	}
+	var uploaded bytes.Buffer
+	panicIf(client.DownloadTo(id, &uploaded))
+	if !bytes.Equal(uploaded.Bytes(), contents) {
+		log.Panicf("Pre-signed upload contents don't match")
+	}
+
+	// expired URLs are reported as such, so they can be renewed
+	expiredUrl, _, err := storagesvc.PresignUpload(storageUrl, key, "env/presigned", checksum, size, time.Now().Add(-time.Minute))
+	panicIf(err)
+	_, err = client.UploadPresigned(expiredUrl, f.Name(), nil)
+	if !errors.Is(err, ErrPresignExpired) {
+		log.Panicf("Expected an expired pre-signed URL error, got %v", err)
+	}
+
+	// URLs signed with another key are rejected
+	forgedUrl, _, err := storagesvc.PresignUpload(storageUrl, "not-"+key, "env/presigned", checksum, size, time.Now().Add(time.Minute))
+	panicIf(err)
+	_, err = client.UploadPresigned(forgedUrl, f.Name(), nil)
+	if err == nil || errors.Is(err, ErrPresignExpired) {
+		log.Panicf("Expected a forged pre-signed URL to be rejected, got %v", err)
+	}
+
+	// the file must match the checksum the URL is signed for
+	bad := fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: strings.Repeat("0", 64)}
+	badUrl, _, err := storagesvc.PresignUpload(storageUrl, key, "env/presigned", bad, size, time.Now().Add(time.Minute))
+	panicIf(err)
+	_, err = client.UploadPresigned(badUrl, f.Name(), nil)
+	if err == nil {
+		log.Panicf("Expected a checksum mismatch in a pre-signed upload")
+	}
+	// and isn't stored when it doesn't
+	badId := storagesvc.ContentID("env/presigned", bad.HexSum())
+	if _, err := client.Size(badId); err == nil {
+		log.Panicf("Expected a mismatched pre-signed upload not to be stored")
+	}
+
+	// the URL is the upload's authorization, so the client's own
+	// headers and credentials aren't sent with it
+	var leaked atomic.Value
+	leaked.Store("")
+	bare := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked.Store(r.Header.Get("Authorization") + r.Header.Get("X-Secret"))
+		io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprintf(w, `{"id": %q, "checksum": {"type": "sha256", "sum": %q}}`, id, checksum.Sum)
+	}))
+	defer bare.Close()
+	withCredentials := MakeClient(storageUrl, WithCredentials(StaticToken("token")),
+		WithHeaders(http.Header{"X-Secret": []string{"secret"}}))
+	_, err = withCredentials.UploadPresigned(bare.URL+"/v1/presigned", f.Name(), nil)
+	panicIf(err)
+	if l := leaked.Load().(string); len(l) > 0 {
+		log.Panicf("Expected a bare pre-signed upload, got headers '%v'", l)
+	}
+}
+
+func TestDownloadFrom(t *testing.T) {
+	port := 8084
+	_ = storagesvc.RunStorageService(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), port)
+	time.Sleep(time.Second)
+	client := MakeClient(fmt.Sprintf("http://localhost:%v/", port))
+
+	f := MakeTestFile(10 * 1024)
+	defer os.Remove(f.Name())
+	contents, err := ioutil.ReadFile(f.Name())
+	panicIf(err)
+	id, err := client.UploadWithPrefix(f.Name(), "", nil)
+	panicIf(err)
+
+	// a resumed download gets the rest of the file
+	var rest bytes.Buffer
+	panicIf(client.DownloadFrom(id, 4000, &rest))
+	if !bytes.Equal(rest.Bytes(), contents[4000:]) {
+		log.Panicf("Resumed download got %v bytes, expected the last %v", rest.Len(), len(contents)-4000)
+	}
+
+	// and a range download just the range
+	var sampled bytes.Buffer
+	panicIf(client.DownloadRange(id, 4000, 1000, &sampled))
+	if !bytes.Equal(sampled.Bytes(), contents[4000:5000]) {
+		log.Panicf("Range download got %v bytes, expected bytes 4000-4999", sampled.Len())
+	}
+
+	// offsets past the end are an error
+	err = client.DownloadFrom(id, int64(len(contents)), ioutil.Discard)
+	if err == nil {
+		log.Panicf("Expected an error downloading from past the end")
+	}
+}
+
+func TestDownloadStream(t *testing.T) {
+	port := 8088
+	_ = storagesvc.RunStorageService(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), port)
+	time.Sleep(time.Second)
+	client := MakeClient(fmt.Sprintf("http://localhost:%v/", port))
+
+	f := MakeTestFile(100 * 1024)
+	defer os.Remove(f.Name())
+	contents, err := ioutil.ReadFile(f.Name())
+	panicIf(err)
+	id, err := client.UploadWithPrefix(f.Name(), "", nil)
+	panicIf(err)
+	sum := sha256.Sum256(contents)
+	checksum := fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:])
+
+	// a download is checked and reports its progress to the end
+	var downloaded bytes.Buffer
+	var lastSent, lastTotal int64
+	n, err := client.DownloadStream(context.Background(), id, &downloaded, DownloadOptions{
+		Checksum: &checksum,
+		Progress: func(sent int64, total int64) {
+			lastSent, lastTotal = sent, total
+		},
+	})
+	panicIf(err)
+	if n != int64(len(contents)) || !bytes.Equal(downloaded.Bytes(), contents) {
+		log.Panicf("Streamed download got %v bytes, expected %v", n, len(contents))
+	}
+	if lastSent != n || lastTotal != n {
+		log.Panicf("Last progress %v of %v, expected %v of %v", lastSent, lastTotal, n, n)
+	}
+
+	// one that doesn't match its checksum fails
+	wrong := fission.MakeChecksum(fission.ChecksumTypeSHA256, make([]byte, sha256.Size))
+	_, err = client.DownloadStream(context.Background(), id, ioutil.Discard, DownloadOptions{Checksum: &wrong})
+	if !errors.Is(err, fission.ErrInvalidChecksum) {
+		log.Panicf("Expected a checksum mismatch, got %v", err)
+	}
+
+	// and a cancelled one stops
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.DownloadStream(ctx, id, ioutil.Discard, DownloadOptions{})
+	if !errors.Is(err, context.Canceled) {
+		log.Panicf("Expected a cancelled download, got %v", err)
+	}
+}
+
+func TestTransferCompression(t *testing.T) {
+	port := 8085
+	_ = storagesvc.RunStorageService(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), port)
+	time.Sleep(time.Second)
+	client := MakeClient(fmt.Sprintf("http://localhost:%v/", port), WithTransferCompression(true))
+
+	f := MakeTestFile(100 * 1024)
+	defer os.Remove(f.Name())
+	contents, err := ioutil.ReadFile(f.Name())
+	panicIf(err)
+
+	// gzipped on the wire, stored as is
+	id, err := client.UploadWithPrefix(f.Name(), "", nil)
+	panicIf(err)
+	size, err := client.Size(id)
+	panicIf(err)
+	if size != int64(len(contents)) {
+		log.Panicf("Stored %v bytes, expected %v", size, len(contents))
+	}
+	var downloaded bytes.Buffer
+	panicIf(client.DownloadTo(id, &downloaded))
+	if !bytes.Equal(downloaded.Bytes(), contents) {
+		log.Panicf("Downloaded contents don't match")
+	}
+
+	get := func(id string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, client.GetUrl(id), nil)
+		panicIf(err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		panicIf(err)
+		resp.Body.Close()
+		return resp
+	}
+	if enc := get(id).Header.Get("Content-Encoding"); enc != "gzip" {
+		log.Panicf("Expected a gzipped download, got Content-Encoding '%v'", enc)
+	}
+
+	// compressed content isn't compressed again
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(contents)
+	panicIf(gz.Close())
+	gzFile, err := ioutil.TempFile("", "storagesvc_test_")
+	panicIf(err)
+	defer os.Remove(gzFile.Name())
+	_, err = gzFile.Write(gzipped.Bytes())
+	panicIf(err)
+	panicIf(gzFile.Close())
+	gzId, err := client.UploadWithPrefix(gzFile.Name(), "", nil)
+	panicIf(err)
+	if enc := get(gzId).Header.Get("Content-Encoding"); len(enc) > 0 {
+		log.Panicf("Expected a gzip file to be sent as it is, got Content-Encoding '%v'", enc)
+	}
+}
+
+func TestNamespaceIsolation(t *testing.T) {
+	port := 8086
+	storageUrl := fmt.Sprintf("http://localhost:%v/", port)
+	tokens, err := ioutil.TempFile("", "storagesvc_test_tokens_")
+	panicIf(err)
+	defer os.Remove(tokens.Name())
+	_, err = tokens.WriteString("# namespace token\nteam-a token-a\nteam-b token-b\n* token-cluster\n")
+	panicIf(err)
+	panicIf(tokens.Close())
+
+	_ = storagesvc.RunStorageServiceWithOptions(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), port,
+		map[string]string{
+			storagesvc.NamespaceIsolationOption: "strict",
+			storagesvc.NamespaceTokensOption:    tokens.Name(),
+		})
+	time.Sleep(time.Second)
+	teamA := MakeClient(storageUrl, WithCredentials(StaticToken("token-a")))
+	teamB := MakeClient(storageUrl, WithNamespace("team-b"), WithCredentials(StaticToken("token-b")))
+	cluster := MakeClient(storageUrl, WithCredentials(StaticToken("token-cluster")))
+
+	f := MakeTestFile(10 * 1024)
+	defer os.Remove(f.Name())
+
+	// requests without a known token are refused, as are those that
+	// say another namespace than their token's
+	if _, err := MakeClient(storageUrl, WithNamespace("team-a")).UploadWithPrefix(f.Name(), "", nil); err == nil {
+		log.Panicf("Expected an upload without a token to fail")
+	}
+	if _, err := MakeClient(storageUrl, WithCredentials(StaticToken("token-x"))).UploadWithPrefix(f.Name(), "", nil); err == nil {
+		log.Panicf("Expected an upload with an unknown token to fail")
+	}
+	if _, err := MakeClient(storageUrl, WithNamespace("team-a"), WithCredentials(StaticToken("token-b"))).UploadWithPrefix(f.Name(), "", nil); err == nil {
+		log.Panicf("Expected an upload saying another namespace than its token's to fail")
+	}
+	if _, err := cluster.UploadWithPrefix(f.Name(), "", nil); err == nil {
+		log.Panicf("Expected an upload without a namespace to fail")
+	}
+
+	// the same content is stored in each namespace's partition
+	idA, err := teamA.UploadWithPrefix(f.Name(), "env/", nil)
+	panicIf(err)
+	idB, err := teamB.UploadWithPrefix(f.Name(), "env/", nil)
+	panicIf(err)
+	if !strings.HasPrefix(idA, storagesvc.NamespacePrefix("team-a")+"env/") {
+		log.Panicf("Expected %v to be in team-a's partition", idA)
+	}
+	if idA == idB {
+		log.Panicf("Expected namespaces not to share %v", idA)
+	}
+
+	// a namespace can't read another's archives
+	var buf bytes.Buffer
+	panicIf(teamA.DownloadTo(idA, &buf))
+	if err := teamB.DownloadTo(idA, &buf); err == nil {
+		log.Panicf("Expected team-b's download of %v to fail", idA)
+	}
+	if err := teamB.Delete(idA); err == nil {
+		log.Panicf("Expected team-b's delete of %v to fail", idA)
+	}
+	stats, err := teamB.Stats()
+	panicIf(err)
+	for _, a := range stats.Items {
+		if !strings.HasPrefix(a.ID, storagesvc.NamespacePrefix("team-b")) {
+			log.Panicf("Expected team-b's stats not to have %v", a.ID)
+		}
+	}
+	if stats.Archives != 1 {
+		log.Panicf("Expected team-b's stats to have its archive, got %+v", stats)
+	}
+
+	// the cluster's token reads every partition
+	panicIf(cluster.DownloadTo(idA, &buf))
+	panicIf(cluster.DownloadTo(idB, &buf))
+	panicIf(teamA.Delete(idA))
+}
+
+func TestMalwareScan(t *testing.T) {
+	port := 8087
+	scanner, err := ioutil.TempFile("", "storagesvc_test_scanner_")
+	panicIf(err)
+	defer os.Remove(scanner.Name())
+	// the scanner fails the first scan of a FLAKY archive, and every
+	// scan of a BROKEN one
+	failed := scanner.Name() + ".failed"
+	defer os.Remove(failed)
+	_, err = scanner.WriteString(`#!/bin/sh
+in=$(cat)
+case "$in" in
+*MALWARE*) echo MALWARE FOUND; exit 1 ;;
+*BROKEN*) echo scanner unavailable; exit 2 ;;
+*FLAKY*) if [ ! -e ` + failed + ` ]; then touch ` + failed + `; echo scanner unavailable; exit 2; fi ;;
+esac
+`)
+	panicIf(err)
+	panicIf(scanner.Close())
+	panicIf(os.Chmod(scanner.Name(), 0755))
+
+	_ = storagesvc.RunStorageServiceWithOptions(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), port,
+		map[string]string{
+			storagesvc.ScanCommandOption: scanner.Name(),
+			storagesvc.ScanRetryOption:   "100ms",
+		})
+	time.Sleep(time.Second)
+	client := MakeClient(fmt.Sprintf("http://localhost:%v/", port))
+
+	clean := MakeTestFile(10 * 1024)
+	defer os.Remove(clean.Name())
+	id, err := client.UploadWithPrefix(clean.Name(), "", nil)
+	panicIf(err)
+	result, err := client.WaitScan(id, time.Minute)
+	panicIf(err)
+	if result.Status != storagesvc.ScanStatusClean {
+		log.Panicf("Expected %v to be clean, got %v", id, result.Status)
+	}
+	var buf bytes.Buffer
+	panicIf(client.DownloadTo(id, &buf))
+
+	infected, err := ioutil.TempFile("", "storagesvc_test_")
+	panicIf(err)
+	defer os.Remove(infected.Name())
+	_, err = infected.WriteString("harmless, but MALWARE to the scanner\n")
+	panicIf(err)
+	panicIf(infected.Close())
+	id, err = client.UploadWithPrefix(infected.Name(), "", nil)
+	panicIf(err)
+	_, err = client.WaitScan(id, time.Minute)
+	if !errors.Is(err, ErrArchiveInfected) {
+		log.Panicf("Expected %v to be infected, got %v", id, err)
+	}
+	if err := client.DownloadTo(id, &buf); err == nil {
+		log.Panicf("Expected the download of infected %v to fail", id)
+	}
+
+	// a failed scan is retried, the archive staying pending
+	upload := func(contents string) string {
+		f, err := ioutil.TempFile("", "storagesvc_test_")
+		panicIf(err)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(contents)
+		panicIf(err)
+		panicIf(f.Close())
+		id, err := client.UploadWithPrefix(f.Name(), "", nil)
+		panicIf(err)
+		return id
+	}
+	id = upload("FLAKY\n")
+	result, err = client.WaitScan(id, time.Minute)
+	panicIf(err)
+	if result.Status != storagesvc.ScanStatusClean || result.Failures != 0 {
+		log.Panicf("Expected %v to be clean after a retry, got %+v", id, result)
+	}
+	panicIf(client.DownloadTo(id, &buf))
+
+	// until it has failed every attempt
+	id = upload("BROKEN\n")
+	result, err = client.WaitScan(id, time.Minute)
+	if err == nil || result == nil || result.Status != storagesvc.ScanStatusError || result.Failures < 2 {
+		log.Panicf("Expected the scan of %v to fail after retries, got %+v, %v", id, result, err)
+	}
+	if err := client.DownloadTo(id, &buf); err == nil {
+		log.Panicf("Expected the download of unscanned %v to fail", id)
+	}
+}
+
+func TestFindByTags(t *testing.T) {
+	port := 8089
+	_ = storagesvc.RunStorageService(storagesvc.StorageTypeLocal, "/tmp", uniuri.NewLen(8), port)
+	time.Sleep(time.Second)
+	client := MakeClient(fmt.Sprintf("http://localhost:%v/", port))
+
+	f := MakeTestFile(10 * 1024)
+	defer os.Remove(f.Name())
+	metadata := map[string]string{
+		storagesvc.ArchiveTagMetadataPrefix + "git-sha": "abc123",
+		storagesvc.ArchiveTagMetadataPrefix + "build":   "7",
+	}
+	id, err := client.Upload(f.Name(), &metadata)
+	panicIf(err)
+
+	g := MakeTestFile(10 * 1024)
+	defer os.Remove(g.Name())
+	other := map[string]string{storagesvc.ArchiveTagMetadataPrefix + "git-sha": "def456"}
+	_, err = client.Upload(g.Name(), &other)
+	panicIf(err)
+
+	// only the archive holding every tag is found
+	archives, err := client.FindByTags([]string{"git-sha=abc123", "build=7"})
+	panicIf(err)
+	if len(archives) != 1 || archives[0].ID != id || archives[0].Size != 10*1024 {
+		log.Panicf("Expected archive %v, found %v", id, archives)
+	}
+	if len(archives[0].Tags) != 2 || archives[0].Tags[0] != "build=7" || archives[0].Tags[1] != "git-sha=abc123" {
+		log.Panicf("Unexpected tags %v", archives[0].Tags)
+	}
+
+	// and a deleted one is forgotten
+	panicIf(client.Delete(id))
+	archives, err = client.FindByTags([]string{"git-sha=abc123"})
+	panicIf(err)
+	if len(archives) != 0 {
+		log.Panicf("Found deleted archive: %v", archives)
+	}
+}
+
+func TestConditionalUploadStaged(t *testing.T) {
+	testId := uniuri.NewLen(8)
+	port := 8092
+	_ = storagesvc.RunStorageService(storagesvc.StorageTypeLocal, "/tmp", testId, port)
+	time.Sleep(time.Second)
+	client := MakeClient(fmt.Sprintf("http://localhost:%v/", port))
+	ttlClient := MakeClient(fmt.Sprintf("http://localhost:%v/", port), WithArchiveTTL(time.Second))
+
+	good := MakeTestFile(10 * 1024)
+	defer os.Remove(good.Name())
+	contents, err := ioutil.ReadFile(good.Name())
+	panicIf(err)
+	sum := sha256.Sum256(contents)
+	checksum := fission.MakeChecksum(fission.ChecksumTypeSHA256, sum[:])
+	bad, err := ioutil.TempFile("", "storagesvc_test_")
+	panicIf(err)
+	defer os.Remove(bad.Name())
+	_, err = bad.Write(bytes.Repeat([]byte("x"), 10*1024))
+	panicIf(err)
+	panicIf(bad.Close())
+
+	// an expired archive is uploaded again, but a body that doesn't
+	// hash to its content ID never replaces it
+	id, _, err := ttlClient.UploadIfNoneMatch(good.Name(), "", checksum, nil)
+	panicIf(err)
+	time.Sleep(1100 * time.Millisecond)
+	if _, _, err := client.UploadIfNoneMatch(bad.Name(), "", checksum, nil); !errors.Is(err, fission.ErrInvalidChecksum) {
+		log.Panicf("Expected a bad body to be refused as a checksum mismatch, got %v", err)
+	}
+	stored, err := ioutil.ReadFile(fmt.Sprintf("/tmp/%v/%v", testId, storagesvc.ContentID("", checksum.HexSum())))
+	panicIf(err)
+	if !bytes.Equal(stored, contents) {
+		log.Panicf("Expected %v to still hold its content after a bad upload", id)
+	}
+
+	// the expired archive is stored again by a good upload
+	id2, existed, err := client.UploadIfNoneMatch(good.Name(), "", checksum, nil)
+	panicIf(err)
+	if existed || id2 != id {
+		log.Panicf("Expected the expired archive to be stored again as %v, got %v (existed %v)", id, id2, existed)
+	}
+	retrieved, err := ioutil.TempFile("", "storagesvc_verify_")
+	panicIf(err)
+	os.Remove(retrieved.Name())
+	defer os.Remove(retrieved.Name())
+	panicIf(client.Download(id, retrieved.Name()))
+	downloaded, err := ioutil.ReadFile(retrieved.Name())
+	panicIf(err)
+	if !bytes.Equal(downloaded, contents) {
+		log.Panicf("Downloaded archive differs from the upload")
+	}
 }
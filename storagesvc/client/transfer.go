@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fission/fission/storagesvc"
+)
+
+// WithTransferCompression makes the client gzip uploads on the wire,
+// if the service decodes them, and ask for gzipped downloads. Neither
+// changes what's stored; content that's already compressed is sent as
+// it is. Without it, transfers aren't compressed.
+func WithTransferCompression(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.transferCompression = enabled
+	}
+}
+
+// serverDecodesGzip returns true if the service accepts gzipped upload
+// bodies. The service is asked once per client.
+func (c *Client) serverDecodesGzip() bool {
+	c.transferNegotiate.Do(func() {
+		caps, err := c.capabilities()
+		if err != nil {
+			if c.debugLogf != nil {
+				c.debugLogf("storage capabilities: %v; not compressing uploads", err)
+			}
+			return
+		}
+		c.serverGzip = caps.TransferCompression
+	})
+	return c.serverGzip
+}
+
+// gzipUpload returns true if the file at filePath should be gzipped
+// for upload.
+func (c *Client) gzipUpload(filePath string) bool {
+	if !c.transferCompression {
+		return false
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, storagesvc.SniffSize)
+	n, _ := io.ReadFull(f, head)
+	if storagesvc.IsCompressed(head[:n]) {
+		return false
+	}
+	return c.serverDecodesGzip()
+}
+
+// acceptEncoding sets the Accept-Encoding of a download request. It's
+// always set, since the transport would otherwise ask for gzip itself
+// whether transfer compression was enabled or not.
+func (c *Client) acceptEncoding(req *http.Request) {
+	if c.transferCompression {
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// decodedBody returns the body of a download response, gunzipped if
+// the server gzipped it.
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return gz, nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/storagesvc"
+)
+
+// UploadErrorClass is the root cause of a failed upload.
+type UploadErrorClass string
+
+const (
+	// UploadErrorDNS means the storage service's host name
+	// couldn't be resolved.
+	UploadErrorDNS UploadErrorClass = "dns"
+
+	// UploadErrorTLS means the TLS handshake failed, e.g. on an
+	// untrusted or mismatched certificate.
+	UploadErrorTLS UploadErrorClass = "tls"
+
+	// UploadErrorTimeout means a connection or request timed out.
+	UploadErrorTimeout UploadErrorClass = "timeout"
+
+	// UploadErrorConnection means the connection failed otherwise,
+	// e.g. it was refused or reset.
+	UploadErrorConnection UploadErrorClass = "connection"
+
+	// UploadErrorClient means the storage service rejected the
+	// upload with a 4xx status.
+	UploadErrorClient UploadErrorClass = "4xx"
+
+	// UploadErrorServer means the storage service failed with a
+	// 5xx status.
+	UploadErrorServer UploadErrorClass = "5xx"
+
+	// UploadErrorChecksum means the uploaded bytes didn't match
+	// their checksum.
+	UploadErrorChecksum UploadErrorClass = "checksum"
+
+	// UploadErrorOther is any other failure.
+	UploadErrorOther UploadErrorClass = "other"
+)
+
+// defaultUploadAttempts is how many times an upload is tried before
+// it fails, if its failures are retryable.
+const defaultUploadAttempts = 3
+
+// defaultUploadRetryDelay is the wait before the second attempt of
+// an upload, doubled for each attempt after it; see WithRetryDelay.
+const defaultUploadRetryDelay = 500 * time.Millisecond
+
+// Retryable returns true if an upload failing this way may succeed
+// when tried again.
+func (c UploadErrorClass) Retryable() bool {
+	switch c {
+	case UploadErrorTimeout, UploadErrorConnection, UploadErrorServer:
+		return true
+	}
+	return false
+}
+
+// mayRetry returns true if an upload attempt that failed this way
+// can be tried again. A conditional upload is stored under its
+// checksum, so sending it twice stores it once; any other upload
+// stores a new archive each time it reaches the server, and is only
+// tried again if it never did, its connection failing.
+func mayRetry(class UploadErrorClass, err error, header http.Header) bool {
+	if !class.Retryable() {
+		return false
+	}
+	if len(header.Get("If-None-Match")) > 0 {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// UploadError is the error of an upload that failed, after retries if
+// its cause was retryable. It wraps the error of the last attempt.
+type UploadError struct {
+	Class UploadErrorClass
+
+	// Attempts is how many times the upload was tried.
+	Attempts int
+
+	// LastStatus is the HTTP status of the last attempt, or 0 if
+	// it got no response.
+	LastStatus int
+
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	msg := fmt.Sprintf("upload failed (%v) after %v attempt", e.Class, e.Attempts)
+	if e.Attempts != 1 {
+		msg += "s"
+	}
+	if e.LastStatus != 0 {
+		msg += fmt.Sprintf(", last status %v %v", e.LastStatus, http.StatusText(e.LastStatus))
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes uploads the server rejected for a checksum mismatch match
+// fission.ErrInvalidChecksum.
+func (e *UploadError) Is(target error) bool {
+	return e.Class == UploadErrorChecksum && target == fission.ErrInvalidChecksum
+}
+
+// unavailableError is a failure to get a response from the storage
+// service. It matches fission.ErrStorageUnavailable, and unwraps to
+// the transport's error so that its cause can be classified.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%v: %v", fission.ErrStorageUnavailable, e.err)
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == fission.ErrStorageUnavailable
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+// classifyUploadError returns the root cause of an upload attempt
+// that failed with err and, if it got a response, status.
+func classifyUploadError(err error, status int, resp *http.Response) UploadErrorClass {
+	if resp != nil && resp.Header.Get(storagesvc.UploadErrorHeader) == storagesvc.UploadErrorChecksumMismatch {
+		return UploadErrorChecksum
+	}
+	if errors.Is(err, fission.ErrInvalidChecksum) {
+		return UploadErrorChecksum
+	}
+	switch {
+	case status >= 500:
+		return UploadErrorServer
+	case status >= 400:
+		return UploadErrorClient
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return UploadErrorTimeout
+		}
+		return UploadErrorDNS
+	}
+	if isTLSError(err) {
+		return UploadErrorTLS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return UploadErrorTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return UploadErrorConnection
+	}
+	if errors.Is(err, fission.ErrStorageUnavailable) {
+		return UploadErrorConnection
+	}
+	return UploadErrorOther
+}
+
+// isTLSError returns true if err is a failed TLS handshake or
+// certificate verification.
+func isTLSError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		recordHeader     tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &unknownAuthority), errors.As(err, &hostname), errors.As(err, &invalid),
+		errors.As(err, &recordHeader):
+		return true
+	}
+	return strings.Contains(err.Error(), "tls: ")
+}
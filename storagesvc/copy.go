@@ -0,0 +1,229 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fission/fission"
+)
+
+// A storage service can copy one of its archives to another storage
+// service itself, so that migrations don't download and upload every
+// archive through the client. Since the service then makes requests
+// to the destination, it only copies to the storage services listed
+// in its CopyDestinationsOption; without any, it doesn't copy, and
+// clients fall back to copying the bytes themselves. The upload to the
+// destination carries the headers the client would authorize it with,
+// so the copy is stored with the client's credentials there rather
+// than with none.
+
+// CopyDestinationsOption is the backend option, STORAGE_OPT_COPY_DESTINATIONS
+// in the storage service's environment, listing the comma separated
+// API URLs of the storage services archives may be copied to, such as
+// http://storagesvc.fission-b/v1.
+const CopyDestinationsOption = "copy_destinations"
+
+// copyTimeout bounds a copy to another storage service.
+const copyTimeout = time.Hour
+
+type (
+	// CopyRequest asks the storage service to copy an archive to
+	// another storage service, with POST /v1/copy. Both services
+	// verify the copied bytes against Checksum.
+	CopyRequest struct {
+		ID string `json:"id"`
+
+		// Destination is the API URL of the storage service to
+		// copy to, as listed in CopyDestinationsOption.
+		Destination string `json:"destination"`
+
+		// DestinationHeaders are sent with the upload to the
+		// destination, such as the Authorization the client
+		// has for it.
+		DestinationHeaders map[string]string `json:"destinationHeaders,omitempty"`
+
+		// Prefix is the archive prefix the copy is stored with.
+		Prefix string `json:"prefix,omitempty"`
+
+		Checksum fission.Checksum `json:"checksum"`
+	}
+
+	// CopyResponse has the ID of the copy on the destination.
+	CopyResponse struct {
+		ID string `json:"id"`
+	}
+)
+
+// copyDestinations parses CopyDestinationsOption.
+func copyDestinations(options map[string]string) map[string]bool {
+	destinations := make(map[string]bool)
+	for _, d := range strings.Split(options[CopyDestinationsOption], ",") {
+		d = strings.TrimSuffix(strings.TrimSpace(d), "/")
+		if len(d) > 0 {
+			destinations[d] = true
+		}
+	}
+	return destinations
+}
+
+// copyHandler copies an archive to another storage service, streaming
+// it from the backend into an upload to the destination. The upload
+// asks the destination to verify the checksum, and is broken off if
+// the stored bytes don't match it, so the destination discards it.
+func (ss *StorageService) copyHandler(w http.ResponseWriter, r *http.Request) {
+	var cr CopyRequest
+	err := json.NewDecoder(r.Body).Decode(&cr)
+	if err != nil || len(cr.ID) == 0 || len(cr.Destination) == 0 {
+		http.Error(w, "need the id, checksum and destination of a copy", 400)
+		return
+	}
+	destinations := copyDestinations(ss.config.options)
+	if len(destinations) == 0 {
+		http.Error(w, "copying isn't enabled on this storage service", http.StatusNotImplemented)
+		return
+	}
+	destination := strings.TrimSuffix(cr.Destination, "/")
+	if !destinations[destination] {
+		http.Error(w, fmt.Sprintf("copying to %v isn't allowed", destination), http.StatusForbidden)
+		return
+	}
+	verifier, err := fission.NewChecksumHash(cr.Checksum.Type)
+	if err != nil || len(cr.Checksum.Sum) == 0 {
+		http.Error(w, "need the checksum of the archive", 400)
+		return
+	}
+	if _, err := cleanPrefix(cr.Prefix); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	for _, elem := range strings.Split(cr.ID, "/") {
+		if elem == ".." {
+			http.Error(w, "Invalid id", 400)
+			return
+		}
+	}
+
+	if status := ss.scanBlocked(cr.ID); len(status) > 0 {
+		scanBlockedError(w, status)
+		return
+	}
+	info, err := ss.backend.Stat(cr.ID)
+	var f io.ReadCloser
+	if err == nil && (ss.expiry.isExpired(cr.ID, time.Now()) || !ss.inPartition(r, cr.ID)) {
+		err = ErrNotFound
+	}
+	if err == nil {
+		f, err = ss.backend.Get(cr.ID)
+	}
+	if err != nil {
+		log.Printf("Error getting item id '%v' to copy: %v", cr.ID, err)
+		if err == ErrNotFound {
+			http.Error(w, "Error retrieving item: not found", 404)
+		} else {
+			http.Error(w, "Error retrieving item", 400)
+		}
+		return
+	}
+	defer f.Close()
+
+	// the multipart body is written as the destination reads it, so
+	// the archive is never held in memory
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("uploadfile", path.Base(cr.ID))
+		if err == nil {
+			_, err = io.Copy(io.MultiWriter(part, verifier), f)
+		}
+		if err == nil && !fission.MakeChecksum(cr.Checksum.Type, verifier.Sum(nil)).Equal(cr.Checksum) {
+			err = fmt.Errorf("%v doesn't match its %v checksum", cr.ID, cr.Checksum.Type)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, destination+"/archive", pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	for k, v := range cr.DestinationHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-File-Size", strconv.FormatInt(info.Size, 10))
+	req.Header.Set(UploadChecksumHeader, fmt.Sprintf("%v:%v", cr.Checksum.Type, cr.Checksum.Sum))
+	req.Header.Set(APIVersionHeader, strconv.Itoa(APIVersion))
+	if len(cr.Prefix) > 0 {
+		req.Header.Set("X-Archive-Prefix", cr.Prefix)
+	}
+	if id := r.Header.Get(fission.RequestIdHeader); len(id) > 0 {
+		req.Header.Set(fission.RequestIdHeader, id)
+	}
+	if namespace := r.Header.Get(NamespaceHeader); len(namespace) > 0 {
+		req.Header.Set(NamespaceHeader, namespace)
+	}
+	if name := ss.names.get(cr.ID); len(name) > 0 {
+		req.Header.Set(ArchiveNameHeader, name)
+	}
+
+	log.Printf("Copying %v to %v (request %v)", cr.ID, destination, r.Header.Get(fission.RequestIdHeader))
+	client := &http.Client{Timeout: copyTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		pr.CloseWithError(err)
+		log.Printf("Error copying %v to %v: %v", cr.ID, destination, err)
+		http.Error(w, fmt.Sprintf("Error copying to %v: %v", destination, err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error copying %v to %v: %v", cr.ID, destination, resp.Status)
+		if e := resp.Header.Get(UploadErrorHeader); len(e) > 0 {
+			w.Header().Set(UploadErrorHeader, e)
+		}
+		http.Error(w, fmt.Sprintf("Error copying to %v: %v", destination, resp.Status), http.StatusBadGateway)
+		return
+	}
+	var ur UploadResponse
+	err = json.NewDecoder(resp.Body).Decode(&ur)
+	if err != nil || len(ur.ID) == 0 {
+		http.Error(w, fmt.Sprintf("Bad upload response from %v", destination), http.StatusBadGateway)
+		return
+	}
+
+	out, err := json.Marshal(&CopyResponse{ID: ur.ID})
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ArchiveTTLHeader asks the server to delete an uploaded
+	// archive this many seconds after the upload.
+	ArchiveTTLHeader = "X-Archive-Ttl"
+
+	// expiryReapInterval is how often expired archives are
+	// deleted.
+	expiryReapInterval = time.Minute
+)
+
+// expiryIndex records when archives uploaded with a TTL expire. The
+// local backend has no per-item metadata, so it's kept in a JSON file
+// next to the container. Archives without an entry never expire.
+type expiryIndex struct {
+	sync.Mutex
+	path    string
+	expires map[string]time.Time
+}
+
+func loadExpiryIndex(path string) (*expiryIndex, error) {
+	x := &expiryIndex{path: path, expires: make(map[string]time.Time)}
+	_, err := readJSONFile(path, &x.expires)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// save writes the index. It must be called with the index locked.
+func (x *expiryIndex) save() error {
+	return writeJSONFile(x.path, x.expires)
+}
+
+// stored records that an archive was stored, expiring at expires, or
+// never if expires is zero. Archives can be stored more than once by
+// conditional uploads; they then live as long as the longest-lived
+// upload, so an upload without a TTL makes them permanent.
+func (x *expiryIndex) stored(id string, expires time.Time, isNew bool) error {
+	x.Lock()
+	defer x.Unlock()
+	current, hasExpiry := x.expires[id]
+	switch {
+	case expires.IsZero():
+		if !hasExpiry {
+			return nil
+		}
+		delete(x.expires, id)
+	case isNew || (hasExpiry && expires.After(current)):
+		x.expires[id] = expires
+	default:
+		return nil
+	}
+	return x.save()
+}
+
+// isExpired returns true if an archive expired at or before now.
+func (x *expiryIndex) isExpired(id string, now time.Time) bool {
+	x.Lock()
+	defer x.Unlock()
+	expires, ok := x.expires[id]
+	return ok && !expires.After(now)
+}
+
+func (x *expiryIndex) remove(id string) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, ok := x.expires[id]; !ok {
+		return nil
+	}
+	delete(x.expires, id)
+	return x.save()
+}
+
+// parseArchiveTTL returns the expiry time of an upload with the given
+// ArchiveTTLHeader value, or zero if it is empty.
+func parseArchiveTTL(value string, now time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}, errors.New("bad " + ArchiveTTLHeader + " header, need a positive number of seconds")
+	}
+	return now.Add(time.Duration(seconds) * time.Second), nil
+}
+
+// reapExpired deletes the archives that expired at or before now.
+func (ss *StorageService) reapExpired(now time.Time) {
+	ss.expiry.Lock()
+	var expired []string
+	for id, expires := range ss.expiry.expires {
+		if !expires.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	ss.expiry.Unlock()
+
+	for _, id := range expired {
+		// a conditional upload may have extended it since
+		if !ss.expiry.isExpired(id, now) {
+			continue
+		}
+		err := ss.backend.Delete(id)
+		if err != nil && err != ErrNotFound {
+			log.Printf("Error deleting expired archive %v: %v", id, err)
+			continue
+		}
+		log.Printf("Deleted expired archive %v", id)
+		err = ss.expiry.remove(id)
+		if err != nil {
+			log.Printf("Error updating archive expiry index: %v", err)
+		}
+		err = ss.warm.remove(id)
+		if err != nil {
+			log.Printf("Error updating warm archive index: %v", err)
+		}
+		err = ss.names.remove(id)
+		if err != nil {
+			log.Printf("Error updating archive name index: %v", err)
+		}
+		err = ss.tags.remove(id)
+		if err != nil {
+			log.Printf("Error updating archive tag index: %v", err)
+		}
+		err = ss.uploads.remove(id)
+		if err != nil {
+			log.Printf("Error updating archive upload index: %v", err)
+		}
+	}
+}
+
+// runReaper deletes expired archives, and abandoned upload sessions,
+// every interval.
+func (ss *StorageService) runReaper(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		ss.reapExpired(now)
+		ss.sessions.reap(now.Add(-uploadSessionTTL))
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/graymeta/stow"
+	_ "github.com/graymeta/stow/local"
+)
+
+// filesystemBackend stores archives as files in a directory, using
+// stow's local backend. It's the reference Backend implementation.
+type filesystemBackend struct {
+	location  stow.Location
+	container stow.Container
+}
+
+func init() {
+	RegisterBackend(StorageTypeLocal, makeFilesystemBackend)
+}
+
+// makeFilesystemBackend stores archives in the directory
+// config.Container under config.Path, creating it if needed.
+func makeFilesystemBackend(config BackendConfig) (Backend, error) {
+	cfg := stow.ConfigMap{"path": config.Path}
+	loc, err := stow.Dial("local", cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	con, err := loc.CreateContainer(config.Container)
+	if os.IsExist(err) {
+		var cons []stow.Container
+		var cursor string
+
+		// use location.Containers to find containers that match the prefix (container name)
+		cons, cursor, err = loc.Containers(config.Container, stow.CursorStart, 1)
+		if err == nil {
+			if !stow.IsCursorEnd(cursor) {
+				// Should only have one storage container
+				err = errors.New("Found more than one matched storage containers")
+			} else {
+				con = cons[0]
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &filesystemBackend{location: loc, container: con}, nil
+}
+
+// notFound maps the errors of missing items to ErrNotFound.
+func notFound(err error) error {
+	if err == stow.ErrNotFound || os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (fb *filesystemBackend) Put(name string, r io.Reader, size int64) (string, error) {
+	item, err := fb.container.Put(name, r, size, nil)
+	if err != nil {
+		fb.container.RemoveItem(name)
+		return "", err
+	}
+	return item.ID(), nil
+}
+
+func (fb *filesystemBackend) Get(id string) (io.ReadCloser, error) {
+	item, err := fb.container.Item(id)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	f, err := item.Open()
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return f, nil
+}
+
+func (fb *filesystemBackend) Delete(id string) error {
+	_, err := fb.container.Item(id)
+	if err != nil {
+		return notFound(err)
+	}
+	return notFound(fb.container.RemoveItem(id))
+}
+
+func (fb *filesystemBackend) Stat(id string) (*ObjectInfo, error) {
+	item, err := fb.container.Item(id)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return itemInfo(item)
+}
+
+func (fb *filesystemBackend) List(prefix string, cursor string, count int) ([]ObjectInfo, string, error) {
+	items, next, err := fb.container.Items(prefix, cursor, count)
+	if err != nil {
+		return nil, "", err
+	}
+	infos := make([]ObjectInfo, 0, len(items))
+	for _, item := range items {
+		info, err := itemInfo(item)
+		if err == ErrNotFound {
+			// deleted while listing
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		infos = append(infos, *info)
+	}
+	return infos, next, nil
+}
+
+func itemInfo(item stow.Item) (*ObjectInfo, error) {
+	size, err := item.Size()
+	if err != nil {
+		return nil, notFound(err)
+	}
+	modified, err := item.LastMod()
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &ObjectInfo{ID: item.ID(), Size: size, LastModified: modified}, nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// The local backend has no per-item metadata, so the indexes of
+// archive expiry, names, tags, uploads, scans and the warm list, and
+// the state of upload sessions, are each kept in a JSON file next to
+// the container.
+
+// readJSONFile decodes the JSON file at path into v. It returns false,
+// leaving v as it is, if the file doesn't exist.
+func readJSONFile(path string, v interface{}) (bool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(contents, v)
+}
+
+// writeJSONFile replaces the file at path with v encoded as JSON. The
+// file is written next to it first and renamed, so a crash leaves the
+// old contents or the new ones, not a mix.
+func writeJSONFile(path string, v interface{}) error {
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, contents, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"errors"
+	"mime"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// ArchiveNameHeader gives the file name an uploaded archive
+	// is downloaded as, sent back in a Content-Disposition header.
+	ArchiveNameHeader = "X-Archive-Name"
+
+	// ArchiveNameMetadata is the upload metadata key clients send
+	// as ArchiveNameHeader.
+	ArchiveNameMetadata = "name"
+
+	maxArchiveNameLength = 255
+)
+
+// nameIndex records the download names of archives, kept in a JSON
+// file next to the container like the expiry index. Archives stored
+// by conditional uploads are named by the latest upload.
+type nameIndex struct {
+	sync.Mutex
+	path  string
+	names map[string]string
+}
+
+func loadNameIndex(path string) (*nameIndex, error) {
+	x := &nameIndex{path: path, names: make(map[string]string)}
+	_, err := readJSONFile(path, &x.names)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// save writes the index. It must be called with the index locked.
+func (x *nameIndex) save() error {
+	return writeJSONFile(x.path, x.names)
+}
+
+func (x *nameIndex) set(id string, name string) error {
+	x.Lock()
+	defer x.Unlock()
+	if x.names[id] == name {
+		return nil
+	}
+	x.names[id] = name
+	return x.save()
+}
+
+func (x *nameIndex) get(id string) string {
+	x.Lock()
+	defer x.Unlock()
+	return x.names[id]
+}
+
+func (x *nameIndex) remove(id string) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, ok := x.names[id]; !ok {
+		return nil
+	}
+	delete(x.names, id)
+	return x.save()
+}
+
+// cleanArchiveName validates an ArchiveNameHeader value: a file name
+// without directories or control characters.
+func cleanArchiveName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 || len(name) > maxArchiveNameLength {
+		return "", errors.New("bad " + ArchiveNameHeader + " header, need a file name of at most 255 bytes")
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", errors.New("bad " + ArchiveNameHeader + " header, need a file name without directories")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", errors.New("bad " + ArchiveNameHeader + " header, control characters aren't allowed")
+		}
+	}
+	return name, nil
+}
+
+// contentDisposition returns the Content-Disposition header value of
+// a download named name.
+func contentDisposition(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
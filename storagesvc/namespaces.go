@@ -0,0 +1,196 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Archives can be partitioned by the namespace of the packages they
+// belong to, under the prefix NamespacePrefix(namespace). Content
+// addressed IDs include the prefix, so identical archives of two
+// namespaces are stored twice rather than shared, and a conditional
+// upload can't tell one tenant whether another stored some content.
+//
+// Clients partition their uploads by prefixing them themselves. With
+// STORAGE_OPT_NAMESPACE_ISOLATION=strict, the service enforces it, and
+// a request's namespace is that of the bearer token it's authorized
+// with, from the file STORAGE_OPT_NAMESPACE_TOKENS, rather than what
+// it says: requests without a known token are refused, uploads are
+// stored in the token's partition whatever prefix they ask for, and
+// every other request only sees and changes archives of it. A
+// NamespaceHeader that isn't the token's namespace is refused. Tokens
+// of the namespace "*" are for the cluster's own components, such as
+// fetchers and builders: they may name any namespace with the header,
+// and without one reach every partition. Uploads to pre-signed URLs
+// need no token, the controller having signed them for a partition.
+
+const (
+	// NamespaceHeader carries the namespace of the package an
+	// archive is stored or read for.
+	NamespaceHeader = "X-Fission-Namespace"
+
+	// NamespaceIsolationOption is the backend option that, set to
+	// "strict", enforces per-namespace partitions.
+	NamespaceIsolationOption = "namespace_isolation"
+
+	// NamespaceTokensOption is the backend option naming the file
+	// of the tokens of each namespace, one "<namespace> <token>"
+	// per line, that strict isolation needs.
+	NamespaceTokensOption = "namespace_tokens"
+
+	// allNamespaces is the namespace of the cluster's tokens.
+	allNamespaces = "*"
+)
+
+// namespaceRegex matches Kubernetes namespace names.
+var namespaceRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// NamespacePrefix returns the archive prefix of a namespace's
+// partition.
+func NamespacePrefix(namespace string) string {
+	return "ns/" + namespace + "/"
+}
+
+// strictNamespaces returns true if the service enforces namespace
+// partitions.
+func (ss *StorageService) strictNamespaces() bool {
+	return ss.config.options[NamespaceIsolationOption] == "strict"
+}
+
+// loadNamespaceTokens reads a file of namespace tokens, returning
+// the namespace of each token.
+func loadNamespaceTokens(path string) (map[string]string, error) {
+	if len(path) == 0 {
+		return nil, errors.New("strict namespace isolation needs STORAGE_OPT_NAMESPACE_TOKENS, a file of namespace tokens")
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string)
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || (fields[0] != allNamespaces && !validNamespace(fields[0])) {
+			return nil, fmt.Errorf("%v:%v: expected \"<namespace> <token>\"", path, i+1)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	return tokens, nil
+}
+
+func validNamespace(namespace string) bool {
+	return len(namespace) <= 63 && namespaceRegex.MatchString(namespace)
+}
+
+// requestNamespace returns the namespace a request is authorized
+// for by its bearer token, and "" for a cluster token that doesn't
+// name one.
+func (ss *StorageService) requestNamespace(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", errors.New("this storage service needs a namespace token")
+	}
+	namespace, ok := ss.namespaceTokens[strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))]
+	if !ok {
+		return "", errors.New("unknown namespace token")
+	}
+	asked := r.Header.Get(NamespaceHeader)
+	if len(asked) > 0 && !validNamespace(asked) {
+		return "", errors.New("invalid " + NamespaceHeader + " header")
+	}
+	if namespace == allNamespaces {
+		return asked, nil
+	}
+	if len(asked) > 0 && asked != namespace {
+		return "", fmt.Errorf("the token isn't for namespace %v", asked)
+	}
+	return namespace, nil
+}
+
+// namespaceHandler refuses requests without a namespace token when
+// isolation is strict, and otherwise sets NamespaceHeader to the
+// namespace of the token for the handlers, so they only see what it's
+// authorized for.
+func (ss *StorageService) namespaceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ss.strictNamespaces() && r.URL.Path != "/v1/capabilities" && r.URL.Path != "/v1/presigned" {
+			namespace, err := ss.requestNamespace(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if len(namespace) > 0 {
+				r.Header.Set(NamespaceHeader, namespace)
+			} else {
+				r.Header.Del(NamespaceHeader)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// partitionPrefix returns the prefix an upload is stored under: with
+// strict isolation, the prefix asked for within the partition of the
+// request's namespace, which must be given.
+func (ss *StorageService) partitionPrefix(r *http.Request, prefix string) (string, error) {
+	if !ss.strictNamespaces() {
+		return prefix, nil
+	}
+	namespace := r.Header.Get(NamespaceHeader)
+	if len(namespace) == 0 {
+		return "", errors.New("uploads need a " + NamespaceHeader + " header on this storage service")
+	}
+	partition := NamespacePrefix(namespace)
+	if strings.HasPrefix(prefix, partition) {
+		return prefix, nil
+	}
+	return cleanPrefix(partition + prefix)
+}
+
+// CheckPartitionPrefix returns an error if prefix is in the partition
+// of a namespace other than namespace, for services signing uploads
+// on behalf of a namespace's clients, such as the controller.
+func CheckPartitionPrefix(namespace string, prefix string) error {
+	if !strings.HasPrefix(prefix, "ns/") {
+		return nil
+	}
+	if len(namespace) == 0 || !strings.HasPrefix(prefix, NamespacePrefix(namespace)) {
+		return fmt.Errorf("prefix %v is in another namespace's partition", prefix)
+	}
+	return nil
+}
+
+// inPartition returns true if a request may see the archive with the
+// given ID: always, unless isolation is strict and the request has a
+// namespace, in which case the ID must be in its partition.
+func (ss *StorageService) inPartition(r *http.Request, id string) bool {
+	namespace := r.Header.Get(NamespaceHeader)
+	if !ss.strictNamespaces() || len(namespace) == 0 {
+		return true
+	}
+	return strings.HasPrefix(id, NamespacePrefix(namespace))
+}
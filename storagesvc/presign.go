@@ -0,0 +1,220 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fission/fission"
+)
+
+// The controller can hand out pre-signed upload URLs, so that large
+// archives are PUT to the storage service directly instead of through
+// the controller's proxy. A URL is signed with a key the controller
+// and the storage service share, and allows one archive, of a given
+// size and SHA256 checksum, to be stored under its content ID until
+// the URL expires. The upload's name and tags are sent with the PUT,
+// as with other uploads.
+
+const (
+	// PresignKeyOption is the backend option,
+	// STORAGE_OPT_PRESIGN_KEY in the storage service's
+	// environment, holding the key pre-signed upload URLs are
+	// signed with. Without it, the service accepts none.
+	PresignKeyOption = "presign_key"
+
+	// UploadErrorPresignExpired means a pre-signed upload URL
+	// expired before it was used; a new one should be requested.
+	UploadErrorPresignExpired = "presign-expired"
+)
+
+type (
+	// PresignRequest asks the controller for a pre-signed URL to
+	// upload an archive to. A prefix in a namespace's partition
+	// must be in Namespace's.
+	PresignRequest struct {
+		Namespace string           `json:"namespace,omitempty"`
+		Prefix    string           `json:"prefix,omitempty"`
+		Checksum  fission.Checksum `json:"checksum"`
+		Size      int64            `json:"size"`
+	}
+
+	// PresignResponse is a pre-signed upload URL, and the ID the
+	// archive uploaded to it is stored under.
+	PresignResponse struct {
+		URL     string    `json:"url"`
+		ID      string    `json:"id"`
+		Expires time.Time `json:"expires"`
+	}
+
+	// RegisterUploadRequest tells the controller an archive was
+	// uploaded to a pre-signed URL.
+	RegisterUploadRequest struct {
+		ID       string           `json:"id"`
+		Checksum fission.Checksum `json:"checksum"`
+	}
+
+	// RegisterUploadResponse confirms the size of an archive
+	// uploaded to a pre-signed URL, as stored.
+	RegisterUploadResponse struct {
+		ID   string `json:"id"`
+		Size int64  `json:"size"`
+	}
+)
+
+// presignSignature is the hex HMAC-SHA256 of a pre-signed upload's
+// parameters.
+func presignSignature(key string, id string, size int64, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "PUT\n%v\n%v\n%v", id, size, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PresignUpload returns a URL of the storage service at storageUrl
+// that an archive of the given size and SHA256 checksum can be PUT to
+// until expires, and the ID it will be stored under.
+func PresignUpload(storageUrl string, key string, prefix string, checksum fission.Checksum, size int64, expires time.Time) (string, string, error) {
+	if checksum.Type != fission.ChecksumTypeSHA256 || !sha256HexRegex.MatchString(checksum.HexSum()) {
+		return "", "", fmt.Errorf("pre-signed uploads need a sha256 checksum, not '%v'", checksum.Type)
+	}
+	prefix, err := cleanPrefix(prefix)
+	if err != nil {
+		return "", "", err
+	}
+	id := ContentID(prefix, checksum.HexSum())
+	q := url.Values{}
+	q.Set("id", id)
+	q.Set("size", strconv.FormatInt(size, 10))
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("signature", presignSignature(key, id, size, expires.Unix()))
+	return strings.TrimSuffix(storageUrl, "/") + "/v1/presigned?" + q.Encode(), id, nil
+}
+
+// presignedUploadHandler stores the body of a PUT to a pre-signed
+// upload URL. The ID is the content ID of the archive's checksum, so
+// the body must hash to it: it's staged in a local file until it's
+// verified, and only then stored under the ID, so a bad upload never
+// replaces a good archive. Archives already stored aren't sent again.
+func (ss *StorageService) presignedUploadHandler(w http.ResponseWriter, r *http.Request) {
+	key := ss.config.options[PresignKeyOption]
+	if len(key) == 0 {
+		http.Error(w, "pre-signed uploads aren't enabled on this storage service", http.StatusNotImplemented)
+		return
+	}
+	q := r.URL.Query()
+	id := q.Get("id")
+	size, err1 := strconv.ParseInt(q.Get("size"), 10, 64)
+	expires, err2 := strconv.ParseInt(q.Get("expires"), 10, 64)
+	i := strings.LastIndex(id, contentIdPrefix)
+	if err1 != nil || err2 != nil || i < 0 || !sha256HexRegex.MatchString(id[i+len(contentIdPrefix):]) {
+		http.Error(w, "bad pre-signed upload URL", 400)
+		return
+	}
+	if _, err := cleanPrefix(id[:i]); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if ss.strictNamespaces() && !strings.HasPrefix(id, "ns/") {
+		// the controller signs the prefix the client asked for,
+		// so it must be a partition's
+		http.Error(w, "uploads must be to a namespace's partition on this storage service", 400)
+		return
+	}
+	if !hmac.Equal([]byte(q.Get("signature")), []byte(presignSignature(key, id, size, expires))) {
+		http.Error(w, "bad pre-signed upload URL signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		w.Header().Set(UploadErrorHeader, UploadErrorPresignExpired)
+		http.Error(w, "pre-signed upload URL expired", http.StatusForbidden)
+		return
+	}
+	if r.ContentLength != size {
+		http.Error(w, fmt.Sprintf("pre-signed upload URL is for %v bytes, not %v", size, r.ContentLength), 400)
+		return
+	}
+	var name string
+	var tags []string
+	var err error
+	if value := r.Header.Get(ArchiveNameHeader); len(value) > 0 {
+		name, err = cleanArchiveName(value)
+	}
+	if err == nil {
+		tags, err = parseArchiveTags(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	isNew := !ss.contentStored(id)
+	if isNew {
+		log.Printf("Handling pre-signed upload for %v (request %v)", id, r.Header.Get(fission.RequestIdHeader))
+		_, err := ss.storeContent(id, r.Body, size, id[i+len(contentIdPrefix):], nil)
+		if err == errContentChecksumMismatch {
+			log.Printf("Checksum mismatch in pre-signed upload of %v", id)
+			w.Header().Set(UploadErrorHeader, UploadErrorChecksumMismatch)
+			http.Error(w, "uploaded file doesn't match the checksum it was signed for", 400)
+			return
+		}
+		if err != nil {
+			log.Printf("Error saving pre-signed upload: '%v'", err)
+			http.Error(w, "Error saving uploaded file", 400)
+			return
+		}
+	}
+	// pre-signed uploads don't expire
+	err = ss.expiry.stored(id, time.Time{}, isNew)
+	if err != nil {
+		log.Printf("Error updating archive expiry index: %v", err)
+		http.Error(w, "Error updating archive expiry", 500)
+		return
+	}
+	if len(name) > 0 {
+		err = ss.names.set(id, name)
+		if err != nil {
+			log.Printf("Error updating archive name index: %v", err)
+		}
+	}
+	ss.tagged(id, tags)
+	err = ss.uploads.uploaded(id, isNew)
+	if err != nil {
+		log.Printf("Error updating archive upload index: %v", err)
+	}
+	if isNew {
+		ss.scanUploaded(id)
+	}
+
+	sum := fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: id[i+len(contentIdPrefix):]}
+	resp, err := json.Marshal(&UploadResponse{ID: id, Checksum: &sum})
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
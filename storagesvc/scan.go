@@ -0,0 +1,318 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The storage service can run each uploaded archive through a
+// malware scanner before serving it. STORAGE_OPT_SCAN_COMMAND is the
+// scanner's command line, such as "clamdscan --no-summary -"; it is
+// given the archive on stdin, and exits 0 if it is clean and 1 if it
+// is infected, as ClamAV does. Any other exit is a scanner error: the
+// scan is retried after STORAGE_OPT_SCAN_RETRY, 30s by default,
+// doubling each time, and the archive stays pending until a scan
+// completes or scanAttempts have failed.
+//
+// Until its scan completes, an archive can't be downloaded or copied;
+// infected archives are deleted. Archives stored before scanning was
+// enabled have no scan, and are served as before. The verdict of an
+// archive's scan is at GET /v1/scan?id=<id>.
+
+const (
+	// ScanCommandOption is the backend option holding the
+	// scanner's command line. Without it, uploads aren't scanned.
+	ScanCommandOption = "scan_command"
+
+	// ScanRetryOption is the backend option holding how long to
+	// wait before the first retry of a failed scan, as a duration.
+	ScanRetryOption = "scan_retry"
+
+	// ScanStatusHeader carries the scan status of an archive that
+	// can't be downloaded because of it.
+	ScanStatusHeader = "X-Scan-Status"
+
+	// scanTimeout bounds the scan of one archive.
+	scanTimeout = 10 * time.Minute
+
+	// scanConcurrency is how many archives are scanned at once.
+	scanConcurrency = 2
+
+	// scanAttempts is how many times the scan of an archive is
+	// tried before it's left failed.
+	scanAttempts = 6
+
+	// defaultScanRetry is the wait before the first retry of a
+	// failed scan, without ScanRetryOption.
+	defaultScanRetry = 30 * time.Second
+)
+
+const (
+	ScanStatusPending  ScanStatus = "pending"
+	ScanStatusClean    ScanStatus = "clean"
+	ScanStatusInfected ScanStatus = "infected"
+	ScanStatusError    ScanStatus = "error"
+)
+
+type (
+	// ScanStatus is the state of an archive's malware scan.
+	ScanStatus string
+
+	// ScanResult is the verdict of an archive's malware scan.
+	// Detail is the scanner's report of an infected archive, or
+	// why the scan failed. Failures counts the failed attempts of
+	// a scan being retried or left failed.
+	ScanResult struct {
+		ID       string     `json:"id"`
+		Status   ScanStatus `json:"status"`
+		Detail   string     `json:"detail,omitempty"`
+		Scanned  time.Time  `json:"scanned,omitempty"`
+		Failures int        `json:"failures,omitempty"`
+	}
+)
+
+// scanIndex holds the scan results of archives, kept in a JSON file
+// next to the container like the expiry index.
+type scanIndex struct {
+	sync.Mutex
+	path    string
+	results map[string]ScanResult
+}
+
+func loadScanIndex(path string) (*scanIndex, error) {
+	x := &scanIndex{path: path, results: make(map[string]ScanResult)}
+	_, err := readJSONFile(path, &x.results)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// save writes the index. It must be called with the index locked.
+func (x *scanIndex) save() error {
+	return writeJSONFile(x.path, x.results)
+}
+
+func (x *scanIndex) set(result ScanResult) error {
+	x.Lock()
+	defer x.Unlock()
+	x.results[result.ID] = result
+	return x.save()
+}
+
+func (x *scanIndex) get(id string) (ScanResult, bool) {
+	x.Lock()
+	defer x.Unlock()
+	result, ok := x.results[id]
+	return result, ok
+}
+
+func (x *scanIndex) remove(id string) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, ok := x.results[id]; !ok {
+		return nil
+	}
+	delete(x.results, id)
+	return x.save()
+}
+
+// unfinished returns the IDs of archives whose scans didn't complete,
+// such as those interrupted by a restart.
+func (x *scanIndex) unfinished() []string {
+	x.Lock()
+	defer x.Unlock()
+	var ids []string
+	for id, result := range x.results {
+		if result.Status == ScanStatusPending || result.Status == ScanStatusError {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// scanCommand returns the scanner's command line, or nil if uploads
+// aren't scanned.
+func (ss *StorageService) scanCommand() []string {
+	return strings.Fields(ss.config.options[ScanCommandOption])
+}
+
+// scanRetry returns the wait before the first retry of a failed scan.
+func (ss *StorageService) scanRetry() time.Duration {
+	d, err := time.ParseDuration(ss.config.options[ScanRetryOption])
+	if err != nil || d <= 0 {
+		return defaultScanRetry
+	}
+	return d
+}
+
+// scanUploaded marks a newly stored archive pending and scans it in
+// the background, if uploads are scanned.
+func (ss *StorageService) scanUploaded(id string) {
+	if len(ss.scanCommand()) == 0 {
+		return
+	}
+	err := ss.scans.set(ScanResult{ID: id, Status: ScanStatusPending})
+	if err != nil {
+		log.Printf("Error updating archive scan index: %v", err)
+	}
+	go ss.scan(id)
+}
+
+// scan runs the scanner on an archive and records the verdict,
+// deleting the archive if it is infected. A failed scan is retried
+// later, with the archive left pending, until it has failed
+// scanAttempts times.
+func (ss *StorageService) scan(id string) {
+	ss.scanSlots <- struct{}{}
+	defer func() { <-ss.scanSlots }()
+
+	previous, _ := ss.scans.get(id)
+	result := ScanResult{ID: id}
+	defer func() {
+		if len(result.Status) == 0 {
+			return
+		}
+		result.Scanned = time.Now()
+		if result.Status == ScanStatusError {
+			result.Failures = previous.Failures + 1
+			if result.Failures < scanAttempts {
+				result.Status = ScanStatusPending
+			}
+		}
+		if err := ss.scans.set(result); err != nil {
+			log.Printf("Error updating archive scan index: %v", err)
+		}
+		if result.Status == ScanStatusPending {
+			retry := ss.scanRetry() << uint(result.Failures-1)
+			log.Printf("Retrying the scan of item id '%v' in %v", id, retry)
+			time.AfterFunc(retry, func() { ss.scan(id) })
+		}
+	}()
+
+	f, err := ss.backend.Get(id)
+	if err == ErrNotFound {
+		// deleted before it was scanned
+		if err := ss.scans.remove(id); err != nil {
+			log.Printf("Error updating archive scan index: %v", err)
+		}
+		result.Status = ""
+		return
+	}
+	if err != nil {
+		result.Status = ScanStatusError
+		result.Detail = "can't read the archive"
+		log.Printf("Error getting item id '%v' to scan: %v", id, err)
+		return
+	}
+	defer f.Close()
+
+	command := ss.scanCommand()
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = f
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	report := strings.TrimSpace(out.String())
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil && exitErr.ExitCode() == 1 {
+		result.Status = ScanStatusInfected
+		result.Detail = report
+		log.Printf("Malware scan found %v infected, deleting it: %v", id, report)
+		if err := ss.backend.Delete(id); err != nil && err != ErrNotFound {
+			log.Printf("Error deleting infected item id '%v': %v", id, err)
+		}
+		return
+	}
+	if err != nil {
+		result.Status = ScanStatusError
+		result.Detail = "scanner failed"
+		log.Printf("Error scanning item id '%v': %v: %v", id, err, report)
+		return
+	}
+	result.Status = ScanStatusClean
+}
+
+// rescanUnfinished scans again the archives whose scans didn't
+// complete when the service last ran, or failed.
+func (ss *StorageService) rescanUnfinished() {
+	if len(ss.scanCommand()) == 0 {
+		return
+	}
+	for _, id := range ss.scans.unfinished() {
+		go ss.scan(id)
+	}
+}
+
+// scanBlocked returns the scan status that keeps an archive from being
+// served, or "" if it can be: it was found clean, or was stored
+// without a scan.
+func (ss *StorageService) scanBlocked(id string) ScanStatus {
+	result, ok := ss.scans.get(id)
+	if !ok || result.Status == ScanStatusClean {
+		return ""
+	}
+	return result.Status
+}
+
+// scanBlockedError answers a request for an archive that isn't served
+// because of its scan status.
+func scanBlockedError(w http.ResponseWriter, status ScanStatus) {
+	w.Header().Set(ScanStatusHeader, string(status))
+	switch status {
+	case ScanStatusInfected:
+		http.Error(w, "archive failed its malware scan and was deleted", http.StatusGone)
+	case ScanStatusPending:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "archive is being scanned for malware", http.StatusLocked)
+	default:
+		http.Error(w, "archive couldn't be scanned for malware", http.StatusServiceUnavailable)
+	}
+}
+
+// scanHandler returns the scan result of the archive given by the id
+// query parameter, 404 if it has none.
+func (ss *StorageService) scanHandler(w http.ResponseWriter, r *http.Request) {
+	fileId, err := ss.getIdFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	result, ok := ss.scans.get(fileId)
+	if !ok || !ss.inPartition(r, fileId) {
+		http.Error(w, "no scan of the archive", 404)
+		return
+	}
+	resp, err := json.Marshal(&result)
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
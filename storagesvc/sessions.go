@@ -0,0 +1,463 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/fission/fission"
+)
+
+// UploadSession is the state of a resumable upload, returned by the
+// /v1/upload-sessions endpoints. Its content is sent in ChunkSize
+// chunks, in order; Offset is how much of it was received, and Chunks
+// the hex SHA256 digests of the chunks received, from which the
+// server combines the archive's ChecksumTypeSHA256Tree checksum
+// without reading it again.
+type UploadSession struct {
+	ID        string   `json:"id"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunkSize"`
+	Offset    int64    `json:"offset"`
+	Chunks    []string `json:"chunks"`
+}
+
+// uploadSessionTTL is how long an upload session is kept after its
+// last chunk arrived.
+const uploadSessionTTL = 24 * time.Hour
+
+// sessionIdRegex matches upload session IDs, which name files.
+var sessionIdRegex = regexp.MustCompile(`^[0-9a-f-]{36}$`)
+
+type (
+	// sessionState is an upload session as saved, along with the
+	// upload options given when it was created.
+	sessionState struct {
+		UploadSession
+		Prefix  string    `json:"prefix"`
+		Name    string    `json:"name,omitempty"`
+		Tags    []string  `json:"tags,omitempty"`
+		TTL     string    `json:"ttl,omitempty"`
+		Updated time.Time `json:"updated"`
+	}
+
+	// sessionStore keeps upload sessions in a local directory, each
+	// as a JSON state file and a data file holding the chunks
+	// received, until the upload completes and the data is stored
+	// in the backend.
+	sessionStore struct {
+		sync.Mutex
+		dir string
+		// busy sessions are receiving a chunk or completing
+		busy map[string]bool
+	}
+)
+
+func makeSessionStore(dir string) (*sessionStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionStore{dir: dir, busy: make(map[string]bool)}, nil
+}
+
+func (s *sessionStore) statePath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *sessionStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".data")
+}
+
+// acquire marks a session busy. It returns false if it already is.
+func (s *sessionStore) acquire(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+func (s *sessionStore) release(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.busy, id)
+}
+
+func (s *sessionStore) load(id string) (*sessionState, error) {
+	var state sessionState
+	ok, err := readJSONFile(s.statePath(id), &state)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &state, nil
+}
+
+func (s *sessionStore) save(state *sessionState) error {
+	return writeJSONFile(s.statePath(state.ID), state)
+}
+
+func (s *sessionStore) remove(id string) {
+	os.Remove(s.statePath(id))
+	os.Remove(s.dataPath(id))
+}
+
+// reap removes the sessions not updated since before.
+func (s *sessionStore) reap(before time.Time) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".json")
+		if !s.acquire(id) {
+			continue
+		}
+		state, err := s.load(id)
+		if err == nil && state.Updated.Before(before) {
+			log.Printf("Deleted abandoned upload session %v", id)
+			s.remove(id)
+		}
+		s.release(id)
+	}
+}
+
+// sessionIdFromRequest returns the session ID query param.
+func sessionIdFromRequest(r *http.Request) (string, error) {
+	id := r.URL.Query().Get("id")
+	if !sessionIdRegex.MatchString(id) {
+		return "", errors.New("Missing or invalid `id' query param")
+	}
+	return id, nil
+}
+
+// loadSession loads the session a request is for, answering the
+// request itself if that fails. Sessions of another namespace's
+// partition aren't found.
+func (ss *StorageService) loadSession(w http.ResponseWriter, r *http.Request) (*sessionState, bool) {
+	id, err := sessionIdFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil, false
+	}
+	state, err := ss.sessions.load(id)
+	if err == nil && !ss.inPartition(r, state.Prefix) {
+		err = ErrNotFound
+	}
+	if err == ErrNotFound {
+		http.Error(w, "Upload session not found", 404)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error loading upload session %v: %v", id, err)
+		http.Error(w, "Error loading upload session", 500)
+		return nil, false
+	}
+	return state, true
+}
+
+func writeSession(w http.ResponseWriter, status int, state *sessionState) {
+	resp, err := json.Marshal(&state.UploadSession)
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+// sessionCreateHandler starts a resumable upload of X-File-Size
+// bytes, with the same upload options as uploadHandler.
+func (ss *StorageService) sessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	// the TTL counts from the upload's completion
+	prefix, _, name, err := parseUploadHeaders(r)
+	if err == nil {
+		prefix, err = ss.partitionPrefix(r, prefix)
+	}
+	var tags []string
+	if err == nil {
+		tags, err = parseArchiveTags(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("X-File-Size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "missing or bad X-File-Size header", 400)
+		return
+	}
+
+	state := &sessionState{
+		UploadSession: UploadSession{
+			ID:        uuid.NewV4().String(),
+			Size:      size,
+			ChunkSize: fission.TreeHashChunkSize,
+			Chunks:    []string{},
+		},
+		Prefix:  prefix,
+		Name:    name,
+		Tags:    tags,
+		TTL:     r.Header.Get(ArchiveTTLHeader),
+		Updated: time.Now(),
+	}
+	err = ss.sessions.save(state)
+	if err != nil {
+		log.Printf("Error saving upload session: %v", err)
+		http.Error(w, "Error saving upload session", 500)
+		return
+	}
+	log.Printf("Started upload session %v for %v bytes", state.ID, size)
+	writeSession(w, http.StatusOK, state)
+}
+
+func (ss *StorageService) sessionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	state, ok := ss.loadSession(w, r)
+	if !ok {
+		return
+	}
+	writeSession(w, http.StatusOK, state)
+}
+
+// sessionChunkHandler appends the chunk at the "offset" query param
+// to a session. The offset must be the session's, so chunks arrive in
+// order; others get 409 Conflict with the session's state, to resume
+// from, and while another request is at the session, 503 to retry. A
+// chunk that doesn't arrive whole is discarded.
+func (ss *StorageService) sessionChunkHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := sessionIdFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !ss.sessions.acquire(id) {
+		http.Error(w, "Upload session is busy with another request", http.StatusServiceUnavailable)
+		return
+	}
+	defer ss.sessions.release(id)
+
+	state, ok := ss.loadSession(w, r)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or bad `offset' query param", 400)
+		return
+	}
+	if offset != state.Offset {
+		writeSession(w, http.StatusConflict, state)
+		return
+	}
+	expected := state.Size - state.Offset
+	if expected > state.ChunkSize {
+		expected = state.ChunkSize
+	}
+	if expected <= 0 {
+		http.Error(w, "Upload session already received all its content", 400)
+		return
+	}
+
+	f, err := os.OpenFile(ss.sessions.dataPath(id), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Error opening upload session data %v: %v", id, err)
+		http.Error(w, "Error saving chunk", 500)
+		return
+	}
+	defer f.Close()
+	// drop what's left of chunks that didn't arrive whole
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("Error preparing upload session data %v: %v", id, err)
+		http.Error(w, "Error saving chunk", 500)
+		return
+	}
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hasher), io.LimitReader(r.Body, expected+1))
+	if err != nil || n != expected {
+		f.Truncate(offset)
+		if err != nil {
+			log.Printf("Error receiving chunk of upload session %v: %v", id, err)
+			http.Error(w, "Error receiving chunk", 400)
+		} else {
+			http.Error(w, fmt.Sprintf("chunk at offset %v must be %v bytes", offset, expected), 400)
+		}
+		return
+	}
+
+	state.Chunks = append(state.Chunks, hex.EncodeToString(hasher.Sum(nil)))
+	state.Offset += n
+	state.Updated = time.Now()
+	err = ss.sessions.save(state)
+	if err != nil {
+		f.Truncate(offset)
+		log.Printf("Error saving upload session %v: %v", id, err)
+		http.Error(w, "Error saving upload session", 500)
+		return
+	}
+	writeSession(w, http.StatusOK, state)
+}
+
+// sessionCompleteHandler stores the content of a session that
+// received all of it, and removes the session. If the request has an
+// UploadChecksumHeader, it must be the ChecksumTypeSHA256Tree
+// checksum combined from the session's chunks.
+func (ss *StorageService) sessionCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := sessionIdFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !ss.sessions.acquire(id) {
+		http.Error(w, "Upload session is busy with another request", http.StatusServiceUnavailable)
+		return
+	}
+	defer ss.sessions.release(id)
+
+	state, ok := ss.loadSession(w, r)
+	if !ok {
+		return
+	}
+	if state.Offset != state.Size {
+		writeSession(w, http.StatusConflict, state)
+		return
+	}
+
+	checksum, err := fission.TreeHashOf(fission.TreeHashState{Chunks: state.Chunks})
+	if err != nil {
+		log.Printf("Error combining checksum of upload session %v: %v", id, err)
+		http.Error(w, "Error combining checksum", 500)
+		return
+	}
+	if value := r.Header.Get(UploadChecksumHeader); len(value) > 0 {
+		verify, err := parseUploadChecksum(value)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if verify.Type != fission.ChecksumTypeSHA256Tree {
+			http.Error(w, fmt.Sprintf("upload sessions are verified against %v checksums", fission.ChecksumTypeSHA256Tree), 400)
+			return
+		}
+		if !checksum.Equal(*verify) {
+			ss.sessions.remove(id)
+			log.Printf("Checksum mismatch in upload session %v", id)
+			w.Header().Set(UploadErrorHeader, UploadErrorChecksumMismatch)
+			http.Error(w, fmt.Sprintf("uploaded file doesn't match %v", UploadChecksumHeader), 400)
+			return
+		}
+	}
+
+	expires, err := parseArchiveTTL(state.TTL, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var data io.Reader = strings.NewReader("")
+	if state.Size > 0 {
+		f, err := os.Open(ss.sessions.dataPath(id))
+		if err != nil {
+			log.Printf("Error opening upload session data %v: %v", id, err)
+			http.Error(w, "Error saving uploaded file", 500)
+			return
+		}
+		defer f.Close()
+		data = f
+	}
+	fileId, err := ss.backend.Put(state.Prefix+uuid.NewV4().String(), data, state.Size)
+	if err != nil {
+		log.Printf("Error saving uploaded file: '%v'", err)
+		http.Error(w, "Error saving uploaded file", 500)
+		return
+	}
+
+	err = ss.expiry.stored(fileId, expires, true)
+	if err != nil {
+		ss.backend.Delete(fileId)
+		log.Printf("Error updating archive expiry index: %v", err)
+		http.Error(w, "Error updating archive expiry", 500)
+		return
+	}
+	if len(state.Name) > 0 {
+		err = ss.names.set(fileId, state.Name)
+		if err != nil {
+			log.Printf("Error updating archive name index: %v", err)
+		}
+	}
+	ss.tagged(fileId, state.Tags)
+	err = ss.uploads.uploaded(fileId, true)
+	if err != nil {
+		log.Printf("Error updating archive upload index: %v", err)
+	}
+	ss.scanUploaded(fileId)
+	ss.sessions.remove(id)
+	log.Printf("Completed upload session %v as %v", id, fileId)
+
+	resp, err := json.Marshal(&UploadResponse{ID: fileId, Checksum: &checksum})
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// sessionAbortHandler discards a session and the chunks it received.
+func (ss *StorageService) sessionAbortHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := sessionIdFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !ss.sessions.acquire(id) {
+		http.Error(w, "Upload session is busy with another request", http.StatusServiceUnavailable)
+		return
+	}
+	defer ss.sessions.release(id)
+
+	if _, ok := ss.loadSession(w, r); !ok {
+		return
+	}
+	ss.sessions.remove(id)
+	w.WriteHeader(http.StatusOK)
+}
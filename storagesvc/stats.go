@@ -0,0 +1,161 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// ArchiveStats describes a stored archive. Uploads is how many
+	// uploads it was stored by: conditional uploads of content
+	// that's already stored count without storing it again.
+	// Modified is when it was last stored.
+	ArchiveStats struct {
+		ID       string    `json:"id"`
+		Size     int64     `json:"size"`
+		Uploads  int       `json:"uploads"`
+		Modified time.Time `json:"modified"`
+	}
+
+	// StorageStats answers GET /v1/stats. LogicalBytes is the size
+	// of all uploads, Bytes what's actually stored; the difference
+	// is saved by deduplication.
+	StorageStats struct {
+		Archives       int            `json:"archives"`
+		Bytes          int64          `json:"bytes"`
+		Uploads        int            `json:"uploads"`
+		LogicalBytes   int64          `json:"logicalBytes"`
+		DedupedUploads int            `json:"dedupedUploads"`
+		Items          []ArchiveStats `json:"items"`
+	}
+)
+
+// statsPageSize is how many items are listed from the backend at a
+// time when computing stats.
+const statsPageSize = 1000
+
+// uploadIndex counts the uploads of each archive, kept in a JSON file
+// next to the container like the expiry index. Archives stored before
+// the index existed have no entry, and count as uploaded once.
+type uploadIndex struct {
+	sync.Mutex
+	path   string
+	counts map[string]int
+}
+
+func loadUploadIndex(path string) (*uploadIndex, error) {
+	x := &uploadIndex{path: path, counts: make(map[string]int)}
+	_, err := readJSONFile(path, &x.counts)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// save writes the index. It must be called with the index locked.
+func (x *uploadIndex) save() error {
+	return writeJSONFile(x.path, x.counts)
+}
+
+// uploaded counts an upload of an archive; isNew is true if it was
+// stored by this upload rather than found already stored.
+func (x *uploadIndex) uploaded(id string, isNew bool) error {
+	x.Lock()
+	defer x.Unlock()
+	switch {
+	case isNew:
+		x.counts[id] = 1
+	case x.counts[id] == 0:
+		// stored before uploads were counted
+		x.counts[id] = 2
+	default:
+		x.counts[id]++
+	}
+	return x.save()
+}
+
+func (x *uploadIndex) get(id string) int {
+	x.Lock()
+	defer x.Unlock()
+	if n := x.counts[id]; n > 0 {
+		return n
+	}
+	return 1
+}
+
+func (x *uploadIndex) remove(id string) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, ok := x.counts[id]; !ok {
+		return nil
+	}
+	delete(x.counts, id)
+	return x.save()
+}
+
+// statsHandler returns the size and upload count of each stored
+// archive, as StorageStats. Expired archives not reaped yet, and those
+// outside the request's partition, are left out.
+func (ss *StorageService) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := &StorageStats{Items: []ArchiveStats{}}
+	now := time.Now()
+	cursor := ""
+	for {
+		items, next, err := ss.backend.List("", cursor, statsPageSize)
+		if err != nil {
+			log.Printf("Error listing items: %v", err)
+			http.Error(w, "Error listing items", 500)
+			return
+		}
+		for _, item := range items {
+			if ss.expiry.isExpired(item.ID, now) || !ss.inPartition(r, item.ID) {
+				continue
+			}
+			a := ArchiveStats{
+				ID:       item.ID,
+				Size:     item.Size,
+				Uploads:  ss.uploads.get(item.ID),
+				Modified: item.LastModified,
+			}
+			stats.Items = append(stats.Items, a)
+			stats.Archives++
+			stats.Bytes += a.Size
+			stats.Uploads += a.Uploads
+			stats.LogicalBytes += a.Size * int64(a.Uploads)
+			stats.DedupedUploads += a.Uploads - 1
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	sort.Slice(stats.Items, func(i, j int) bool { return stats.Items[i].ID < stats.Items[j].ID })
+
+	resp, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -17,20 +17,31 @@ limitations under the License.
 package storagesvc
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/graymeta/stow"
-	_ "github.com/graymeta/stow/local"
 	"github.com/satori/go.uuid"
+
+	"github.com/fission/fission"
 )
 
 type (
@@ -39,18 +50,70 @@ type (
 		storageType   StorageType
 		localPath     string
 		containerName string
-		// other stuff, such as google or s3 credentials, bucket names etc
+		// backend specific settings, such as google or s3
+		// credentials
+		options map[string]string
 	}
 
 	StorageService struct {
-		config    storageConfig
-		location  stow.Location
-		container stow.Container
-		port      int
+		config   storageConfig
+		backend  Backend
+		port     int
+		expiry   *expiryIndex
+		warm     *warmIndex
+		names    *nameIndex
+		tags     *tagIndex
+		uploads  *uploadIndex
+		sessions *sessionStore
+
+		// scans holds malware scan results, and scanSlots bounds
+		// how many scans run at once.
+		scans     *scanIndex
+		scanSlots chan struct{}
+
+		// namespaceTokens holds the namespace of each token, with
+		// strict namespace isolation.
+		namespaceTokens map[string]string
+
+		// contentLocks serialize stores under the same content ID,
+		// by lockContent.
+		contentLocks [64]sync.Mutex
 	}
 
 	UploadResponse struct {
 		ID string `json:"id"`
+
+		// Checksum is the checksum of a resumable upload's
+		// content, combined from its chunks' checksums.
+		Checksum *fission.Checksum `json:"checksum,omitempty"`
+	}
+
+	// Capabilities describes optional features of the storage
+	// service, returned by GET /v1/capabilities.
+	Capabilities struct {
+		// ChecksumTypes are the checksum types the service can
+		// verify uploads against, cheapest first.
+		ChecksumTypes []fission.ChecksumType `json:"checksumTypes"`
+
+		// Copy is true if the service can copy archives to
+		// other storage services, with POST /v1/copy.
+		Copy bool `json:"copy,omitempty"`
+
+		// TransferCompression is true if the service decodes
+		// upload bodies sent with Content-Encoding: gzip.
+		TransferCompression bool `json:"transferCompression,omitempty"`
+
+		// NamespaceIsolation is true if the service enforces
+		// per-namespace partitions of archives.
+		NamespaceIsolation bool `json:"namespaceIsolation,omitempty"`
+
+		// Scan is true if the service scans uploads for malware
+		// before serving them, with results at GET /v1/scan.
+		Scan bool `json:"scan,omitempty"`
+
+		// Tags is true if the service records the tags uploads
+		// give archives, which GET /v1/tags looks up.
+		Tags bool `json:"tags,omitempty"`
 	}
 )
 
@@ -58,8 +121,325 @@ const (
 	StorageTypeLocal StorageType = "local"
 )
 
+const (
+	// APIVersionHeader carries the storage API version a client
+	// requests, and the version the server answered with.
+	APIVersionHeader = "X-Fission-Storage-Api-Version"
+
+	// APIVersion is the latest storage API version.
+	APIVersion = 1
+
+	// UploadChecksumHeader asks the server to verify an upload
+	// against a checksum, given as "<type>:<hex sum>". Uploads
+	// that don't match are discarded.
+	UploadChecksumHeader = "X-Upload-Checksum"
+
+	// UploadErrorHeader classifies rejected uploads for clients;
+	// UploadErrorChecksumMismatch means the uploaded bytes didn't
+	// match UploadChecksumHeader or the If-None-Match checksum.
+	UploadErrorHeader           = "X-Upload-Error"
+	UploadErrorChecksumMismatch = "checksum-mismatch"
+)
+
+// supportedAPIVersions lists the API versions this server can serve.
+var supportedAPIVersions = map[int]bool{1: true}
+
+// versionHandler rejects requests for an API version the server
+// doesn't support, so that clients fail clearly instead of
+// misreading responses. Requests without a version get the latest.
+func versionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := APIVersion
+		if v := r.Header.Get(APIVersionHeader); len(v) > 0 {
+			var err error
+			version, err = strconv.Atoi(v)
+			if err != nil || !supportedAPIVersions[version] {
+				msg := fmt.Sprintf("unsupported storage API version '%v', latest supported is %v", v, APIVersion)
+				http.Error(w, msg, http.StatusNotAcceptable)
+				return
+			}
+		}
+		w.Header().Set(APIVersionHeader, strconv.Itoa(version))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validPrefixRegex restricts archive ID prefixes to a safe set of
+// characters; path traversal is checked separately.
+var validPrefixRegex = regexp.MustCompile(`^[a-zA-Z0-9._/-]*$`)
+
+// cleanPrefix validates an archive ID prefix such as "env/python/" and
+// returns it normalized with a trailing slash. An empty prefix is
+// valid.
+func cleanPrefix(prefix string) (string, error) {
+	if len(prefix) == 0 {
+		return "", nil
+	}
+	if !validPrefixRegex.MatchString(prefix) || strings.HasPrefix(prefix, "/") {
+		return "", errors.New("invalid archive prefix")
+	}
+	for _, elem := range strings.Split(prefix, "/") {
+		if elem == ".." {
+			return "", errors.New("archive prefix must not contain '..'")
+		}
+	}
+	p := path.Clean(prefix)
+	if p == "." {
+		return "", nil
+	}
+	return p + "/", nil
+}
+
 // Handle multipart file uploads.
+// contentIdPrefix starts the names of content addressed items, which
+// are stored by conditional uploads.
+const contentIdPrefix = "sha256-"
+
+// ContentID returns the ID under which a conditional upload of
+// content with the given hex SHA256 sum is stored.
+func ContentID(prefix string, sum string) string {
+	return prefix + contentIdPrefix + sum
+}
+
+var sha256HexRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// conditionalSum returns the sha256 checksum from an If-None-Match
+// header, such as `"<hex sum>"`, or "" if the header is missing or
+// isn't a sha256 checksum.
+func conditionalSum(r *http.Request) string {
+	sum := strings.ToLower(strings.Trim(r.Header.Get("If-None-Match"), `"`))
+	if !sha256HexRegex.MatchString(sum) {
+		return ""
+	}
+	return sum
+}
+
+// lockContent locks the content ID id against other stores under it,
+// and returns the function unlocking it.
+func (ss *StorageService) lockContent(id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	l := &ss.contentLocks[h.Sum32()%uint32(len(ss.contentLocks))]
+	l.Lock()
+	return l.Unlock
+}
+
+// contentStored is true if the content ID id holds an archive that can
+// be served, so an upload of its content needn't be sent: it's stored,
+// hasn't expired, and isn't waiting for or failing its malware scan.
+func (ss *StorageService) contentStored(id string) bool {
+	if _, err := ss.backend.Stat(id); err != nil {
+		return false
+	}
+	return !ss.expiry.isExpired(id, time.Now()) && len(ss.scanBlocked(id)) == 0
+}
+
+var (
+	// errContentChecksumMismatch means a staged upload didn't hash
+	// to the content ID it's for.
+	errContentChecksumMismatch = errors.New("checksum mismatch")
+
+	// errVerifyChecksumMismatch means a staged upload didn't match
+	// its UploadChecksumHeader.
+	errVerifyChecksumMismatch = errors.New("upload checksum mismatch")
+)
+
+// stageUpload writes size bytes of an upload to a content ID to a file
+// next to the upload sessions, checking that they hash to sha256Sum,
+// and to verify if it's set. It returns the file, open at its start,
+// which the caller closes and removes; a bad upload is removed at
+// once. Content IDs are only ever stored from staged uploads, so a bad
+// or partial body never replaces, or is served as, a good archive.
+func (ss *StorageService) stageUpload(body io.Reader, size int64, sha256Sum string, verify *fission.Checksum) (*os.File, error) {
+	f, err := ioutil.TempFile(ss.sessions.dir, "staged-")
+	if err != nil {
+		return nil, err
+	}
+	hasher := sha256.New()
+	var sink io.Writer = io.MultiWriter(f, hasher)
+	var verifier hash.Hash
+	if verify != nil {
+		verifier, _ = fission.NewChecksumHash(verify.Type)
+		sink = io.MultiWriter(sink, verifier)
+	}
+	n, err := io.Copy(sink, io.LimitReader(body, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("upload ended after %v of %v bytes", n, size)
+	}
+	if err == nil && verify != nil && !fission.MakeChecksum(verify.Type, verifier.Sum(nil)).Equal(*verify) {
+		err = errVerifyChecksumMismatch
+	}
+	if err == nil && hex.EncodeToString(hasher.Sum(nil)) != sha256Sum {
+		err = errContentChecksumMismatch
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseUploadChecksum parses an UploadChecksumHeader value.
+func parseUploadChecksum(value string) (*fission.Checksum, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("bad %v '%v', should be <type>:<hex sum>", UploadChecksumHeader, value)
+	}
+	c := fission.Checksum{Type: fission.ChecksumType(parts[0]), Sum: parts[1]}
+	if _, err := fission.NewChecksumHash(c.Type); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (ss *StorageService) capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	resp, err := json.Marshal(&Capabilities{
+		ChecksumTypes:       fission.ChecksumTypesByPreference,
+		Copy:                len(copyDestinations(ss.config.options)) > 0,
+		TransferCompression: ss.transferCompression(),
+		NamespaceIsolation:  ss.strictNamespaces(),
+		Scan:                len(ss.scanCommand()) > 0,
+		Tags:                true,
+	})
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// parseUploadHeaders returns the archive prefix, expiry and download
+// name an upload asks for.
+func parseUploadHeaders(r *http.Request) (string, time.Time, string, error) {
+	// An optional prefix namespaces the stored archive, e.g. by
+	// project or environment.
+	prefix, err := cleanPrefix(r.Header.Get("X-Archive-Prefix"))
+	if err != nil {
+		log.Printf("Bad X-Archive-Prefix '%v': %v", r.Header.Get("X-Archive-Prefix"), err)
+		return "", time.Time{}, "", err
+	}
+	expires, err := parseArchiveTTL(r.Header.Get(ArchiveTTLHeader), time.Now())
+	if err != nil {
+		return "", time.Time{}, "", err
+	}
+	var name string
+	if value := r.Header.Get(ArchiveNameHeader); len(value) > 0 {
+		name, err = cleanArchiveName(value)
+		if err != nil {
+			return "", time.Time{}, "", err
+		}
+	}
+	return prefix, expires, name, nil
+}
+
+// storeUpload stores an upload under a new, unique name, checking it
+// against verify if it's set.
+func (ss *StorageService) storeUpload(name string, body io.Reader, size int64, verify *fission.Checksum) (string, error) {
+	var verifier hash.Hash
+	if verify != nil {
+		verifier, _ = fission.NewChecksumHash(verify.Type)
+		body = io.TeeReader(body, verifier)
+	}
+	// backends don't leave a partial file behind if this fails,
+	// e.g. if the client went away mid-upload
+	id, err := ss.backend.Put(name, body, size)
+	if err != nil {
+		return "", err
+	}
+	if verify != nil && !fission.MakeChecksum(verify.Type, verifier.Sum(nil)).Equal(*verify) {
+		// nothing else is stored under a new name
+		ss.backend.Delete(id)
+		return "", errVerifyChecksumMismatch
+	}
+	return id, nil
+}
+
+// storeContent stores an upload under the content ID id of its
+// sha256Sum. It's staged and checked first, so what's stored under id
+// is never replaced by, or deleted for, a bad upload.
+func (ss *StorageService) storeContent(id string, body io.Reader, size int64, sha256Sum string, verify *fission.Checksum) (string, error) {
+	staged, err := ss.stageUpload(body, size, sha256Sum, verify)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	unlock := ss.lockContent(id)
+	defer unlock()
+	return ss.backend.Put(id, staged, size)
+}
+
 func (ss *StorageService) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	prefix, expires, name, err := parseUploadHeaders(r)
+	if err == nil {
+		prefix, err = ss.partitionPrefix(r, prefix)
+	}
+	var tags []string
+	if err == nil {
+		tags, err = parseArchiveTags(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// This is not the item ID (that's returned by Put)
+	// should we just use handler.Filename? what are the constraints here?
+	uploadName := prefix + uuid.NewV4().String()
+
+	// Conditional uploads are stored under their checksum, so we
+	// can tell the client the content is already stored before
+	// it sends the body (it waits, with Expect: 100-continue).
+	// Content still being scanned, or that couldn't be, is
+	// uploaded again, and scanned again.
+	sum := conditionalSum(r)
+	if len(sum) > 0 {
+		uploadName = ContentID(prefix, sum)
+		if ss.contentStored(uploadName) {
+			err = ss.expiry.stored(uploadName, expires, false)
+			if err != nil {
+				log.Printf("Error updating archive expiry index: %v", err)
+				http.Error(w, "Error updating archive expiry", 500)
+				return
+			}
+			if len(name) > 0 {
+				err = ss.names.set(uploadName, name)
+				if err != nil {
+					log.Printf("Error updating archive name index: %v", err)
+				}
+			}
+			ss.tagged(uploadName, tags)
+			err = ss.uploads.uploaded(uploadName, false)
+			if err != nil {
+				log.Printf("Error updating archive upload index: %v", err)
+			}
+			w.Header().Set("X-Archive-Id", uploadName)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	var verify *fission.Checksum
+	if value := r.Header.Get(UploadChecksumHeader); len(value) > 0 {
+		verify, err = parseUploadChecksum(value)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	err = ss.decodeUploadBody(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error decoding upload: %v", err), http.StatusUnsupportedMediaType)
+		return
+	}
+
 	// handle upload
 	r.ParseMultipartForm(0)
 	file, handler, err := r.FormFile("uploadfile")
@@ -69,7 +449,7 @@ func (ss *StorageService) uploadHandler(w http.ResponseWriter, r *http.Request)
 	}
 	defer file.Close()
 
-	// stow wants the file size, but that's different from the
+	// backends want the file size, but that's different from the
 	// content length, the content length being the size of the
 	// encoded file in the HTTP request. So we require an
 	// "X-File-Size" header in bytes.
@@ -90,25 +470,61 @@ func (ss *StorageService) uploadHandler(w http.ResponseWriter, r *http.Request)
 
 	// TODO: allow headers to add more metadata (e.g. environment
 	// and function metadata)
-	log.Printf("Handling upload for %v", handler.Filename)
+	log.Printf("Handling upload for %v (request %v)", handler.Filename, r.Header.Get(fission.RequestIdHeader))
 	//fileMetadata := make(map[string]interface{})
 	//fileMetadata["filename"] = handler.Filename
 
-	// This is not the item ID (that's returned by Put)
-	// should we just use handler.Filename? what are the constraints here?
-	uploadName := uuid.NewV4().String()
-
-	// save the file to the storage backend
-	item, err := ss.container.Put(uploadName, file, int64(fileSize), nil)
-	if err != nil {
+	var id string
+	if len(sum) > 0 {
+		id, err = ss.storeContent(uploadName, file, int64(fileSize), sum, verify)
+	} else {
+		id, err = ss.storeUpload(uploadName, file, int64(fileSize), verify)
+	}
+	switch err {
+	case nil:
+	case errVerifyChecksumMismatch:
+		log.Printf("%v checksum mismatch in upload of %v", verify.Type, uploadName)
+		w.Header().Set(UploadErrorHeader, UploadErrorChecksumMismatch)
+		http.Error(w, fmt.Sprintf("uploaded file doesn't match %v", UploadChecksumHeader), 400)
+		return
+	case errContentChecksumMismatch:
+		log.Printf("Checksum mismatch in conditional upload of %v", uploadName)
+		w.Header().Set(UploadErrorHeader, UploadErrorChecksumMismatch)
+		http.Error(w, "uploaded file doesn't match If-None-Match checksum", 400)
+		return
+	default:
 		log.Printf("Error saving uploaded file: '%v'", err)
 		http.Error(w, "Error saving uploaded file", 400)
 		return
 	}
 
+	err = ss.expiry.stored(id, expires, true)
+	if err != nil {
+		// a content ID holds what its name says, and may be
+		// referred to by other uploads
+		if len(sum) == 0 {
+			ss.backend.Delete(id)
+		}
+		log.Printf("Error updating archive expiry index: %v", err)
+		http.Error(w, "Error updating archive expiry", 500)
+		return
+	}
+	if len(name) > 0 {
+		err = ss.names.set(id, name)
+		if err != nil {
+			log.Printf("Error updating archive name index: %v", err)
+		}
+	}
+	ss.tagged(id, tags)
+	err = ss.uploads.uploaded(id, true)
+	if err != nil {
+		log.Printf("Error updating archive upload index: %v", err)
+	}
+	ss.scanUploaded(id)
+
 	// respond with an ID that can be used to retrieve the file
 	ur := &UploadResponse{
-		ID: item.ID(),
+		ID: id,
 	}
 	resp, err := json.Marshal(ur)
 	if err != nil {
@@ -124,6 +540,11 @@ func (ss *StorageService) getIdFromRequest(r *http.Request) (string, error) {
 	if !ok || len(ids) == 0 {
 		return "", errors.New("Missing `id' query param")
 	}
+	for _, elem := range strings.Split(ids[0], "/") {
+		if elem == ".." {
+			return "", errors.New("Invalid `id' query param")
+		}
+	}
 	return ids[0], nil
 }
 
@@ -134,13 +555,41 @@ func (ss *StorageService) deleteHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), 400)
 		return
 	}
+	if !ss.inPartition(r, fileId) {
+		http.Error(w, "Error deleting item: not found", 404)
+		return
+	}
 
-	err = ss.container.RemoveItem(fileId)
+	err = ss.backend.Delete(fileId)
 	if err != nil {
 		msg := fmt.Sprintf("Error deleting item: %v", err)
 		http.Error(w, msg, 500)
 		return
 	}
+	err = ss.expiry.remove(fileId)
+	if err != nil {
+		log.Printf("Error updating archive expiry index: %v", err)
+	}
+	err = ss.warm.remove(fileId)
+	if err != nil {
+		log.Printf("Error updating warm archive index: %v", err)
+	}
+	err = ss.names.remove(fileId)
+	if err != nil {
+		log.Printf("Error updating archive name index: %v", err)
+	}
+	err = ss.tags.remove(fileId)
+	if err != nil {
+		log.Printf("Error updating archive tag index: %v", err)
+	}
+	err = ss.uploads.remove(fileId)
+	if err != nil {
+		log.Printf("Error updating archive upload index: %v", err)
+	}
+	err = ss.scans.remove(fileId)
+	if err != nil {
+		log.Printf("Error updating archive scan index: %v", err)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -152,35 +601,131 @@ func (ss *StorageService) downloadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Get the file (called "item" in stow's jargon), open it,
-	// stream it to response
+	// Get the file, stream it to response
 
-	item, err := ss.container.Item(fileId)
+	var f io.ReadCloser
+	if ss.expiry.isExpired(fileId, time.Now()) || !ss.inPartition(r, fileId) {
+		err = ErrNotFound
+	} else if status := ss.scanBlocked(fileId); len(status) > 0 {
+		scanBlockedError(w, status)
+		return
+	} else {
+		f, err = ss.backend.Get(fileId)
+	}
 	if err != nil {
 		log.Printf("Error getting item id '%v': %v", fileId, err)
-		if err == stow.ErrNotFound {
+		if err == ErrNotFound {
 			http.Error(w, "Error retrieving item: not found", 404)
 		} else {
 			http.Error(w, "Error retrieving item", 400)
 		}
 		return
 	}
+	defer f.Close()
 
-	f, err := item.Open()
+	if name := ss.names.get(fileId); len(name) > 0 {
+		w.Header().Set("Content-Disposition", contentDisposition(name))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if offset, length, ok := byteRange(r.Header.Get("Range")); ok && (offset > 0 || length >= 0) {
+		// a resumed download, or a sampled range
+		info, err := ss.backend.Stat(fileId)
+		if err != nil {
+			log.Printf("Error getting size of item id '%v': %v", fileId, err)
+			http.Error(w, "Error retrieving item", 400)
+			return
+		}
+		if offset >= info.Size {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%v", info.Size))
+			http.Error(w, "Range starts past the end of the item", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if seeker, ok := f.(io.Seeker); ok {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, f, offset)
+		}
+		if err != nil {
+			log.Printf("Error skipping to offset %v of item id '%v': %v", offset, fileId, err)
+			http.Error(w, "Error retrieving item", 500)
+			return
+		}
+		if length < 0 || offset+length > info.Size {
+			length = info.Size - offset
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", offset, offset+length-1, info.Size))
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err = io.CopyN(w, f, length)
+	} else {
+		out, contents, closeOut := ss.gzipWriter(w, r, f)
+		_, err = io.Copy(out, contents)
+		if err == nil {
+			err = closeOut()
+		}
+	}
 	if err != nil {
-		log.Printf("Error opening item %v: %v", fileId, err)
-		// TODO better http errors based on err
-		http.Error(w, "Error opening item", 400)
+		log.Printf("Error writing response: %v", err)
+		http.Error(w, "Error writing response", 500)
 		return
 	}
-	defer f.Close()
+}
+
+// byteRange parses a Range header asking for the rest of an item from
+// an offset, "bytes=<offset>-", as resumed downloads send, or for a
+// single range, "bytes=<first>-<last>", as sampled verification
+// sends. The length is -1 for the rest of the item. Other ranges, such
+// as several at once or suffixes, aren't supported, and are answered
+// with the whole item.
+func byteRange(header string) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+	bounds := strings.SplitN(header[len("bytes="):], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	offset, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, false
+	}
+	if len(bounds[1]) == 0 {
+		return offset, -1, true
+	}
+	last, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || last < offset {
+		return 0, 0, false
+	}
+	return offset, last - offset + 1, true
+}
 
-	_, err = io.Copy(w, f)
+// headHandler reports the size of an item without sending its
+// contents.
+func (ss *StorageService) headHandler(w http.ResponseWriter, r *http.Request) {
+	fileId, err := ss.getIdFromRequest(r)
 	if err != nil {
-		log.Printf("Error writing response: %v", err)
-		http.Error(w, "Error writing response", 500)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if status := ss.scanBlocked(fileId); len(status) > 0 && ss.inPartition(r, fileId) {
+		scanBlockedError(w, status)
 		return
 	}
+	info, err := ss.backend.Stat(fileId)
+	if err == nil && (ss.expiry.isExpired(fileId, time.Now()) || !ss.inPartition(r, fileId)) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			http.Error(w, "Error retrieving item: not found", 404)
+		} else {
+			http.Error(w, "Error retrieving item", 400)
+		}
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
 }
 
 func MakeStorageService(sc *storageConfig) (*StorageService, error) {
@@ -188,64 +733,110 @@ func MakeStorageService(sc *storageConfig) (*StorageService, error) {
 		config: *sc,
 	}
 
-	if sc.storageType != StorageTypeLocal {
-		return nil, errors.New("Storage types other than 'local' are not implemented")
-	}
-
-	cfg := stow.ConfigMap{"path": sc.localPath}
-	loc, err := stow.Dial("local", cfg)
+	backend, err := MakeBackend(sc.storageType, BackendConfig{
+		Path:      sc.localPath,
+		Container: sc.containerName,
+		Options:   sc.options,
+	})
 	if err != nil {
 		log.Printf("Error initializing storage: %v", err)
 		return nil, err
 	}
-	ss.location = loc
-
-	con, err := loc.CreateContainer(sc.containerName)
-	if os.IsExist(err) {
-		var cons []stow.Container
-		var cursor string
+	ss.backend = backend
 
-		// use location.Containers to find containers that match the prefix (container name)
-		cons, cursor, err = loc.Containers(sc.containerName, stow.CursorStart, 1)
-		if err == nil {
-			if !stow.IsCursorEnd(cursor) {
-				// Should only have one storage container
-				err = errors.New("Found more than one matched storage containers")
-			} else {
-				con = cons[0]
-			}
-		}
+	// the indexes are kept locally whatever the backend
+	ss.expiry, err = loadExpiryIndex(filepath.Join(sc.localPath, "."+sc.containerName+"-expiry.json"))
+	if err != nil {
+		log.Printf("Error reading archive expiry index: %v", err)
+		return nil, err
 	}
+	ss.warm, err = loadWarmIndex(filepath.Join(sc.localPath, "."+sc.containerName+"-warm.json"))
 	if err != nil {
-		log.Printf("Error initializing storage: %v", err)
+		log.Printf("Error reading warm archive index: %v", err)
+		return nil, err
+	}
+	ss.names, err = loadNameIndex(filepath.Join(sc.localPath, "."+sc.containerName+"-names.json"))
+	if err != nil {
+		log.Printf("Error reading archive name index: %v", err)
+		return nil, err
+	}
+	ss.tags, err = loadTagIndex(filepath.Join(sc.localPath, "."+sc.containerName+"-tags.json"))
+	if err != nil {
+		log.Printf("Error reading archive tag index: %v", err)
+		return nil, err
+	}
+	ss.uploads, err = loadUploadIndex(filepath.Join(sc.localPath, "."+sc.containerName+"-uploads.json"))
+	if err != nil {
+		log.Printf("Error reading archive upload index: %v", err)
 		return nil, err
 	}
-	ss.container = con
+	ss.sessions, err = makeSessionStore(filepath.Join(sc.localPath, "."+sc.containerName+"-sessions"))
+	if err != nil {
+		log.Printf("Error initializing upload sessions: %v", err)
+		return nil, err
+	}
+	ss.scans, err = loadScanIndex(filepath.Join(sc.localPath, "."+sc.containerName+"-scans.json"))
+	if err != nil {
+		log.Printf("Error reading archive scan index: %v", err)
+		return nil, err
+	}
+	ss.scanSlots = make(chan struct{}, scanConcurrency)
+	if ss.strictNamespaces() {
+		ss.namespaceTokens, err = loadNamespaceTokens(sc.options[NamespaceTokensOption])
+		if err != nil {
+			log.Printf("Error reading namespace tokens: %v", err)
+			return nil, err
+		}
+	}
 
 	return ss, nil
 }
 
 func (ss *StorageService) Start(port int) {
 	r := mux.NewRouter()
+	r.HandleFunc("/v1/capabilities", ss.capabilitiesHandler).Methods("GET")
 	r.HandleFunc("/v1/archive", ss.uploadHandler).Methods("POST")
 	r.HandleFunc("/v1/archive", ss.downloadHandler).Methods("GET")
+	r.HandleFunc("/v1/archive", ss.headHandler).Methods("HEAD")
 	r.HandleFunc("/v1/archive", ss.deleteHandler).Methods("DELETE")
+	r.HandleFunc("/v1/warm", ss.warmHandler).Methods("POST")
+	r.HandleFunc("/v1/warm", ss.warmListHandler).Methods("GET")
+	r.HandleFunc("/v1/stats", ss.statsHandler).Methods("GET")
+	r.HandleFunc("/v1/copy", ss.copyHandler).Methods("POST")
+	r.HandleFunc("/v1/scan", ss.scanHandler).Methods("GET")
+	r.HandleFunc("/v1/tags", ss.tagsHandler).Methods("GET")
+	r.HandleFunc("/v1/presigned", ss.presignedUploadHandler).Methods("PUT")
+	r.HandleFunc("/v1/upload-sessions", ss.sessionCreateHandler).Methods("POST")
+	r.HandleFunc("/v1/upload-sessions", ss.sessionStatusHandler).Methods("GET")
+	r.HandleFunc("/v1/upload-sessions", ss.sessionChunkHandler).Methods("PUT")
+	r.HandleFunc("/v1/upload-sessions", ss.sessionAbortHandler).Methods("DELETE")
+	r.HandleFunc("/v1/upload-sessions/complete", ss.sessionCompleteHandler).Methods("POST")
 
 	address := fmt.Sprintf(":%v", port)
-	log.Fatal(http.ListenAndServe(address, handlers.LoggingHandler(os.Stdout, r)))
+	log.Fatal(http.ListenAndServe(address, handlers.LoggingHandler(os.Stdout, versionHandler(ss.namespaceHandler(r)))))
 }
 
 func RunStorageService(storageType StorageType, storagePath string, containerName string, port int) *StorageService {
+	return RunStorageServiceWithOptions(storageType, storagePath, containerName, port, nil)
+}
+
+// RunStorageServiceWithOptions runs the storage service on a backend
+// that needs settings of its own, such as credentials.
+func RunStorageServiceWithOptions(storageType StorageType, storagePath string, containerName string, port int, options map[string]string) *StorageService {
 	// storage
 	ss, err := MakeStorageService(&storageConfig{
 		storageType:   storageType,
 		localPath:     storagePath,
 		containerName: containerName,
+		options:       options,
 	})
 	if err != nil {
 		log.Panicf("Error initializing storage: %v", err)
 	}
 
+	go ss.runReaper(expiryReapInterval)
+	ss.rescanUnfinished()
+
 	// http handlers
 	go ss.Start(port)
 
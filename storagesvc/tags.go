@@ -0,0 +1,231 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploads can tag archives with key=value metadata, such as the git
+// commit they were built from, and the archives holding given tags
+// can be looked up later. An archive stored by several conditional
+// uploads holds the tags of all of them.
+
+const (
+	// ArchiveTagHeader tags an uploaded archive with a key=value
+	// pair; it may be repeated.
+	ArchiveTagHeader = "X-Archive-Tag"
+
+	// ArchiveTagMetadataPrefix marks the upload metadata keys
+	// clients send as ArchiveTagHeader: "tag:git-sha" tags the
+	// archive git-sha=<value>.
+	ArchiveTagMetadataPrefix = "tag:"
+
+	maxArchiveTags        = 16
+	maxArchiveTagValueLen = 255
+)
+
+// tagKeyRegex matches tag keys, which are like Kubernetes label keys
+// without the prefix.
+var tagKeyRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?$`)
+
+// TaggedArchive is a stored archive holding the tags searched for,
+// and all its tags.
+type TaggedArchive struct {
+	ID   string   `json:"id"`
+	Size int64    `json:"size"`
+	Tags []string `json:"tags"`
+}
+
+// tagIndex records the tags of archives, kept in a JSON file next to
+// the container like the name index.
+type tagIndex struct {
+	sync.Mutex
+	path string
+	tags map[string][]string
+}
+
+func loadTagIndex(path string) (*tagIndex, error) {
+	x := &tagIndex{path: path, tags: make(map[string][]string)}
+	_, err := readJSONFile(path, &x.tags)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// save writes the index. It must be called with the index locked.
+func (x *tagIndex) save() error {
+	return writeJSONFile(x.path, x.tags)
+}
+
+// add records tags of an archive, keeping those it already has.
+func (x *tagIndex) add(id string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	x.Lock()
+	defer x.Unlock()
+	have := make(map[string]bool)
+	for _, t := range x.tags[id] {
+		have[t] = true
+	}
+	changed := false
+	for _, t := range tags {
+		if !have[t] {
+			have[t] = true
+			x.tags[id] = append(x.tags[id], t)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	sort.Strings(x.tags[id])
+	return x.save()
+}
+
+// find returns the archives holding every one of tags, with all their
+// tags.
+func (x *tagIndex) find(tags []string) map[string][]string {
+	x.Lock()
+	defer x.Unlock()
+	found := make(map[string][]string)
+	for id, have := range x.tags {
+		if hasTags(have, tags) {
+			found[id] = append([]string{}, have...)
+		}
+	}
+	return found
+}
+
+func hasTags(have []string, want []string) bool {
+	for _, w := range want {
+		i := sort.SearchStrings(have, w)
+		if i == len(have) || have[i] != w {
+			return false
+		}
+	}
+	return true
+}
+
+func (x *tagIndex) remove(id string) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, ok := x.tags[id]; !ok {
+		return nil
+	}
+	delete(x.tags, id)
+	return x.save()
+}
+
+// cleanArchiveTag validates a key=value tag.
+func cleanArchiveTag(tag string) (string, error) {
+	i := strings.Index(tag, "=")
+	if i < 0 {
+		return "", fmt.Errorf("bad archive tag '%v', need key=value", tag)
+	}
+	key, value := tag[:i], tag[i+1:]
+	if !tagKeyRegex.MatchString(key) {
+		return "", fmt.Errorf("bad archive tag key '%v'", key)
+	}
+	if len(value) > maxArchiveTagValueLen {
+		return "", fmt.Errorf("archive tag %v has a value of more than %v bytes", key, maxArchiveTagValueLen)
+	}
+	for _, r := range value {
+		if r < ' ' || r == 0x7f {
+			return "", fmt.Errorf("archive tag %v: control characters aren't allowed", key)
+		}
+	}
+	return key + "=" + value, nil
+}
+
+// parseArchiveTags returns the tags an upload asks for.
+func parseArchiveTags(r *http.Request) ([]string, error) {
+	values := r.Header[http.CanonicalHeaderKey(ArchiveTagHeader)]
+	if len(values) > maxArchiveTags {
+		return nil, fmt.Errorf("at most %v %v headers are allowed", maxArchiveTags, ArchiveTagHeader)
+	}
+	var tags []string
+	for _, v := range values {
+		tag, err := cleanArchiveTag(v)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// tagged records the tags of an upload, if it has any.
+func (ss *StorageService) tagged(id string, tags []string) {
+	err := ss.tags.add(id, tags)
+	if err != nil {
+		log.Printf("Error updating archive tag index: %v", err)
+	}
+}
+
+// tagsHandler returns the archives holding every tag given as a tag
+// query parameter, as TaggedArchives sorted by ID. Expired archives
+// and, with strict isolation, those of other namespaces are left out.
+func (ss *StorageService) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	var want []string
+	for _, v := range r.URL.Query()["tag"] {
+		tag, err := cleanArchiveTag(v)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		want = append(want, tag)
+	}
+	if len(want) == 0 {
+		http.Error(w, "need at least one tag to find", 400)
+		return
+	}
+	sort.Strings(want)
+
+	archives := []TaggedArchive{}
+	now := time.Now()
+	for id, tags := range ss.tags.find(want) {
+		if ss.expiry.isExpired(id, now) || !ss.inPartition(r, id) {
+			continue
+		}
+		info, err := ss.backend.Stat(id)
+		if err != nil {
+			// deleted behind the index's back
+			continue
+		}
+		archives = append(archives, TaggedArchive{ID: id, Size: info.Size, Tags: tags})
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].ID < archives[j].ID })
+
+	resp, err := json.Marshal(archives)
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Archives can be gzipped on the wire, with Content-Encoding, to save
+// bandwidth on slow links; what's stored, and its checksum, are the
+// same either way. Clients gzip upload bodies if the service's
+// capabilities say it decodes them, and ask for gzipped downloads with
+// Accept-Encoding. Content that's already compressed isn't gzipped
+// again, by either side.
+
+// TransferCompressionOption is the backend option,
+// STORAGE_OPT_TRANSFER_COMPRESSION in the storage service's
+// environment, that turns transfer compression off when "false".
+const TransferCompressionOption = "transfer_compression"
+
+// errUnsupportedEncoding means an upload's Content-Encoding isn't one
+// the service decodes.
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// SniffSize is how many bytes of content IsCompressed needs.
+const SniffSize = 512
+
+// IsCompressed returns true if content starting with head is already
+// compressed, so compressing it again would waste CPU for little
+// gain: gzip, zstd, xz and bzip2 streams, and zip files whose first
+// entry is compressed.
+func IsCompressed(head []byte) bool {
+	for _, magic := range [][]byte{
+		{0x1f, 0x8b},                     // gzip
+		{0x28, 0xb5, 0x2f, 0xfd},         // zstd
+		{0xfd, '7', 'z', 'X', 'Z', 0x00}, // xz
+		{'B', 'Z', 'h'},                  // bzip2
+	} {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) && len(head) >= 10 {
+		// the compression method of the first local file
+		// header; 0 is stored
+		return binary.LittleEndian.Uint16(head[8:10]) != 0
+	}
+	return false
+}
+
+// acceptsGzip returns true if a request's Accept-Encoding allows a
+// gzipped response.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[len("q="):], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// transferCompression returns true if the service compresses
+// transfers.
+func (ss *StorageService) transferCompression() bool {
+	return ss.config.options[TransferCompressionOption] != "false"
+}
+
+// decodeUploadBody replaces the body of an upload sent with
+// Content-Encoding: gzip by its decoded contents.
+func (ss *StorageService) decodeUploadBody(r *http.Request) error {
+	encoding := r.Header.Get("Content-Encoding")
+	if len(encoding) == 0 || strings.EqualFold(encoding, "identity") {
+		return nil
+	}
+	if !strings.EqualFold(encoding, "gzip") || !ss.transferCompression() {
+		return errUnsupportedEncoding
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{gz, r.Body}
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	return nil
+}
+
+// gzipWriter returns the writer the contents of a download are
+// written to: w itself, or if the client accepts gzip and the
+// contents, which start at f, aren't compressed already, a gzip
+// writer that must be closed once they're written. The returned
+// reader reads the contents from the start.
+func (ss *StorageService) gzipWriter(w http.ResponseWriter, r *http.Request, f io.Reader) (io.Writer, io.Reader, func() error) {
+	none := func() error { return nil }
+	if !ss.transferCompression() || !acceptsGzip(r) {
+		return w, f, none
+	}
+	br := bufio.NewReaderSize(f, SniffSize)
+	head, _ := br.Peek(SniffSize)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if IsCompressed(head) {
+		return w, br, none
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	return gz, br, gz.Close
+}
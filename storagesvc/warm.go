@@ -0,0 +1,163 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storagesvc
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fission/fission"
+)
+
+type (
+	// WarmArchive is an archive that builders keep in their local
+	// cache, so that builds using it don't download it each time.
+	WarmArchive struct {
+		ID       string           `json:"id"`
+		Checksum fission.Checksum `json:"checksum"`
+		Size     int64            `json:"size"`
+	}
+
+	// WarmResponse answers POST /v1/warm. AlreadyWarm is true if
+	// the archive was on the warm list already.
+	WarmResponse struct {
+		Archive     WarmArchive `json:"archive"`
+		AlreadyWarm bool        `json:"alreadyWarm"`
+	}
+)
+
+// warmIndex is the list of warm archives, kept in a JSON file next to
+// the container like the expiry index.
+type warmIndex struct {
+	sync.Mutex
+	path     string
+	archives map[string]WarmArchive
+}
+
+func loadWarmIndex(path string) (*warmIndex, error) {
+	x := &warmIndex{path: path, archives: make(map[string]WarmArchive)}
+	_, err := readJSONFile(path, &x.archives)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// save writes the index. It must be called with the index locked.
+func (x *warmIndex) save() error {
+	return writeJSONFile(x.path, x.archives)
+}
+
+// add puts an archive on the warm list. It returns false if it was
+// there already with the same checksum.
+func (x *warmIndex) add(a WarmArchive) (bool, error) {
+	x.Lock()
+	defer x.Unlock()
+	if current, ok := x.archives[a.ID]; ok && current.Checksum.Equal(a.Checksum) {
+		return false, nil
+	}
+	x.archives[a.ID] = a
+	return true, x.save()
+}
+
+func (x *warmIndex) remove(id string) error {
+	x.Lock()
+	defer x.Unlock()
+	if _, ok := x.archives[id]; !ok {
+		return nil
+	}
+	delete(x.archives, id)
+	return x.save()
+}
+
+// list returns the warm archives, ordered by ID.
+func (x *warmIndex) list() []WarmArchive {
+	x.Lock()
+	defer x.Unlock()
+	archives := make([]WarmArchive, 0, len(x.archives))
+	for _, a := range x.archives {
+		archives = append(archives, a)
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].ID < archives[j].ID })
+	return archives
+}
+
+// warmHandler puts the archive given in the request body, by ID and
+// checksum, on the warm list. Its size is filled in from the stored
+// item. Builders verify the checksum when they cache it.
+func (ss *StorageService) warmHandler(w http.ResponseWriter, r *http.Request) {
+	var a WarmArchive
+	err := json.NewDecoder(r.Body).Decode(&a)
+	if err != nil || len(a.ID) == 0 {
+		http.Error(w, "need the id and checksum of an archive", 400)
+		return
+	}
+	if _, err := fission.NewChecksumHash(a.Checksum.Type); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	info, err := ss.backend.Stat(a.ID)
+	if err == nil && (ss.expiry.isExpired(a.ID, time.Now()) || !ss.inPartition(r, a.ID)) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			http.Error(w, "Error retrieving item: not found", 404)
+		} else {
+			http.Error(w, "Error retrieving item", 400)
+		}
+		return
+	}
+	a.Size = info.Size
+
+	added, err := ss.warm.add(a)
+	if err != nil {
+		log.Printf("Error updating warm archive index: %v", err)
+		http.Error(w, "Error updating warm archives", 500)
+		return
+	}
+	resp, err := json.Marshal(&WarmResponse{Archive: a, AlreadyWarm: !added})
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// warmListHandler returns the warm list, as a JSON list of
+// WarmArchive, of the archives in the request's partition.
+func (ss *StorageService) warmListHandler(w http.ResponseWriter, r *http.Request) {
+	archives := []WarmArchive{}
+	for _, a := range ss.warm.list() {
+		if ss.inPartition(r, a.ID) {
+			archives = append(archives, a)
+		}
+	}
+	resp, err := json.Marshal(archives)
+	if err != nil {
+		http.Error(w, "Error marshaling response", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// StructureEntry is a file of an archive as its structure fingerprint
+// sees it: a relative, slash separated path and a mode.
+type StructureEntry struct {
+	Path string
+	Mode os.FileMode
+}
+
+// ArchiveStructure returns the structure fingerprint of an archive's
+// files: the hex SHA256 of their sorted paths and permission bits,
+// whatever their contents. Archives with the same files laid out
+// differently have different fingerprints, even if a checksum over
+// their contents alone would match.
+func ArchiveStructure(entries []StructureEntry) string {
+	sorted := make([]StructureEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	h := sha256.New()
+	for _, e := range sorted {
+		fmt.Fprintf(h, "%v\x00%o\n", e.Path, e.Mode.Perm())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
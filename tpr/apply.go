@@ -0,0 +1,152 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tpr
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+)
+
+// PackageApplyRetries bounds how many times applying a package starts
+// over after losing a race with another writer of the package.
+const PackageApplyRetries = 5
+
+// PackageApplier applies packages to where they're kept: the package
+// TPRs in the controller, or the controller's package API for clients
+// of controllers without apply support. Applying creates a package if
+// it doesn't exist, updates it if its contents or metadata differ, and
+// leaves it alone otherwise, so applying the same package again
+// changes nothing. Labels and annotations are added to those of an
+// existing package; its status is replaced only if the spec changes.
+//
+// The applier is recorded in fission.PackageFieldManagerAnnotation;
+// applying a package last applied by another manager is an
+// ErrorNameExists error, unless forced.
+type PackageApplier struct {
+	// Get reads a package, failing with an error IsNotFound
+	// matches if there is none.
+	Get func(name string) (*Package, error)
+
+	// Create and Update write a package, failing with an error
+	// IsConflict matches if another writer got in first. Update
+	// is told whether the spec changes.
+	Create func(pkg *Package) (*metav1.ObjectMeta, error)
+	Update func(pkg *Package, specChanged bool) (*metav1.ObjectMeta, error)
+
+	IsNotFound func(err error) bool
+	IsConflict func(err error) bool
+}
+
+// Apply applies f on behalf of manager, starting over if another
+// writer changes the package in between.
+func (pa *PackageApplier) Apply(f *Package, manager string, force bool) (*fission.PackageApplyResult, error) {
+	applied := *f
+	applied.Metadata.Annotations = make(map[string]string, len(f.Metadata.Annotations)+1)
+	for k, v := range f.Metadata.Annotations {
+		applied.Metadata.Annotations[k] = v
+	}
+	applied.Metadata.Annotations[fission.PackageFieldManagerAnnotation] = manager
+
+	for attempt := 0; ; attempt++ {
+		result, raced, err := pa.apply(&applied, manager, force)
+		if raced && attempt < PackageApplyRetries {
+			continue
+		}
+		return result, err
+	}
+}
+
+// apply applies a package once, returning whether it failed for losing
+// a race with another writer.
+func (pa *PackageApplier) apply(applied *Package, manager string, force bool) (*fission.PackageApplyResult, bool, error) {
+	existing, err := pa.Get(applied.Metadata.Name)
+	if err != nil && pa.IsNotFound(err) {
+		created := *applied
+		created.Metadata.ResourceVersion = ""
+		created.Metadata.Annotations = make(map[string]string, len(applied.Metadata.Annotations))
+		for k, v := range applied.Metadata.Annotations {
+			created.Metadata.Annotations[k] = v
+		}
+		m, err := pa.Create(&created)
+		if err != nil {
+			return nil, pa.IsConflict(err), err
+		}
+		return &fission.PackageApplyResult{Metadata: m, Outcome: fission.PackageApplyCreated}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	owner := existing.Metadata.Annotations[fission.PackageFieldManagerAnnotation]
+	if len(owner) > 0 && owner != manager && !force {
+		return nil, false, fission.MakeError(fission.ErrorNameExists,
+			fmt.Sprintf("Package %v is managed by %v", applied.Metadata.Name, owner))
+	}
+	specChanged := !fission.PackageSpecContentEqual(&existing.Spec, &applied.Spec)
+	if !specChanged && !metadataChanged(&existing.Metadata, &applied.Metadata) {
+		return &fission.PackageApplyResult{Metadata: &existing.Metadata, Outcome: fission.PackageApplyUnchanged}, false, nil
+	}
+	// only the labels of an immutable package may change, as
+	// CheckPackageMutable has it
+	if fission.PackageImmutable(existing.Metadata.Annotations) &&
+		(specChanged || mapChanged(existing.Metadata.Annotations, applied.Metadata.Annotations)) {
+		return nil, false, fission.ImmutablePackageError(applied.Metadata.Name)
+	}
+
+	if existing.Metadata.Labels == nil {
+		existing.Metadata.Labels = make(map[string]string)
+	}
+	for k, v := range applied.Metadata.Labels {
+		existing.Metadata.Labels[k] = v
+	}
+	if existing.Metadata.Annotations == nil {
+		existing.Metadata.Annotations = make(map[string]string)
+	}
+	for k, v := range applied.Metadata.Annotations {
+		existing.Metadata.Annotations[k] = v
+	}
+	if specChanged {
+		existing.Spec = applied.Spec
+		existing.Status = applied.Status
+	}
+
+	m, err := pa.Update(existing, specChanged)
+	if err != nil {
+		return nil, pa.IsConflict(err), err
+	}
+	return &fission.PackageApplyResult{Metadata: m, Outcome: fission.PackageApplyUpdated}, false, nil
+}
+
+// metadataChanged says whether applying the labels and annotations of
+// applied would change those of existing.
+func metadataChanged(existing, applied *metav1.ObjectMeta) bool {
+	return mapChanged(existing.Labels, applied.Labels) || mapChanged(existing.Annotations, applied.Annotations)
+}
+
+// mapChanged says whether setting the entries of applied in existing
+// would change it.
+func mapChanged(existing, applied map[string]string) bool {
+	for k, v := range applied {
+		if cur, ok := existing[k]; !ok || cur != v {
+			return true
+		}
+	}
+	return false
+}
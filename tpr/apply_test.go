@@ -0,0 +1,116 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tpr
+
+import (
+	"errors"
+	"log"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+)
+
+var (
+	errTestNotFound = errors.New("not found")
+	errTestConflict = errors.New("conflict")
+)
+
+// testApplier applies to a single package held in memory, failing the
+// next conflicts writes as if another writer got in first.
+func testApplier(stored **Package, conflicts *int, writes *int) *PackageApplier {
+	write := func(pkg *Package) (*metav1.ObjectMeta, error) {
+		if *conflicts > 0 {
+			*conflicts--
+			return nil, errTestConflict
+		}
+		*writes++
+		p := *pkg
+		*stored = &p
+		return &p.Metadata, nil
+	}
+	return &PackageApplier{
+		Get: func(name string) (*Package, error) {
+			if *stored == nil {
+				return nil, errTestNotFound
+			}
+			p := **stored
+			return &p, nil
+		},
+		Create:     write,
+		Update:     func(pkg *Package, specChanged bool) (*metav1.ObjectMeta, error) { return write(pkg) },
+		IsNotFound: func(err error) bool { return err == errTestNotFound },
+		IsConflict: func(err error) bool { return err == errTestConflict },
+	}
+}
+
+func TestPackageApply(t *testing.T) {
+	var stored *Package
+	conflicts, writes := 0, 0
+	pa := testApplier(&stored, &conflicts, &writes)
+
+	sum := fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: "aa"}
+	pkg := &Package{
+		Metadata: metav1.ObjectMeta{Name: "hello", Namespace: "default"},
+		Spec: fission.PackageSpec{
+			Environment: fission.EnvironmentReference{Name: "nodejs", Namespace: "default"},
+			Source:      fission.Archive{Type: fission.ArchiveTypeUrl, URL: "http://storage/a", Checksum: sum},
+		},
+		Status: fission.PackageStatus{BuildStatus: fission.BuildStatusPending},
+	}
+
+	// a race on create is retried
+	conflicts = 1
+	result, err := pa.Apply(pkg, "ci", false)
+	panicIf(err)
+	if result.Outcome != fission.PackageApplyCreated || writes != 1 {
+		log.Panicf("Expected the package to be created once, got %v after %v writes", result.Outcome, writes)
+	}
+
+	// the build writes the deployment archive
+	stored.Spec.Deployment = fission.Archive{Type: fission.ArchiveTypeUrl, URL: "http://storage/built"}
+	stored.Status.BuildStatus = fission.BuildStatusSucceeded
+
+	// the same source uploaded again under another URL is unchanged
+	again := *pkg
+	again.Spec.Source.URL = "http://storage/b"
+	result, err = pa.Apply(&again, "ci", false)
+	panicIf(err)
+	if result.Outcome != fission.PackageApplyUnchanged || writes != 1 {
+		log.Panicf("Expected an unchanged source not to update the package, got %v", result.Outcome)
+	}
+	if stored.Status.BuildStatus != fission.BuildStatusSucceeded {
+		log.Panicf("Expected the build status to be kept, got %v", stored.Status.BuildStatus)
+	}
+
+	// another manager may not take the package over, and isn't retried
+	conflicts = 0
+	_, err = pa.Apply(pkg, "someone-else", false)
+	if fe, ok := err.(fission.Error); !ok || fe.Code != fission.ErrorNameExists {
+		log.Panicf("Expected a package of another manager to conflict, got %v", err)
+	}
+
+	// changed contents update the package, resetting its status
+	changed := *pkg
+	changed.Spec.Source.Checksum = fission.Checksum{Type: fission.ChecksumTypeSHA256, Sum: "bb"}
+	result, err = pa.Apply(&changed, "ci", false)
+	panicIf(err)
+	if result.Outcome != fission.PackageApplyUpdated || stored.Status.BuildStatus != fission.BuildStatusPending {
+		log.Panicf("Expected a changed source to be updated and rebuilt, got %v, %v", result.Outcome, stored.Status.BuildStatus)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tpr
+
+import (
+	"reflect"
+
+	"github.com/fission/fission"
+)
+
+// CheckPackageMutable refuses to update existing to updated if
+// existing is immutable (see fission.PackageImmutableAnnotation) and
+// the update changes its spec or status, or keeps it immutable while
+// changing its annotations. An update that removes the annotation,
+// changing neither spec nor status, unlocks the package; one that
+// only changes its labels, such as a retag, is allowed.
+func CheckPackageMutable(existing, updated *Package) error {
+	if !fission.PackageImmutable(existing.Metadata.Annotations) {
+		return nil
+	}
+	if !reflect.DeepEqual(existing.Spec, updated.Spec) || !reflect.DeepEqual(existing.Status, updated.Status) {
+		return fission.ImmutablePackageError(updated.Metadata.Name)
+	}
+	if fission.PackageImmutable(updated.Metadata.Annotations) &&
+		(len(existing.Metadata.Annotations) != len(updated.Metadata.Annotations) ||
+			mapChanged(existing.Metadata.Annotations, updated.Metadata.Annotations)) {
+		return fission.ImmutablePackageError(updated.Metadata.Name)
+	}
+	return nil
+}
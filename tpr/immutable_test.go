@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tpr
+
+import (
+	"log"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+)
+
+func immutablePackage() *Package {
+	return &Package{
+		Metadata: metav1.ObjectMeta{
+			Name:        "hello",
+			Namespace:   "default",
+			Labels:      map[string]string{fission.PackageTagLabel: "v1"},
+			Annotations: map[string]string{fission.PackageImmutableAnnotation: "true"},
+		},
+		Spec: fission.PackageSpec{
+			Environment: fission.EnvironmentReference{Name: "nodejs", Namespace: "default"},
+			Deployment:  fission.Archive{Type: fission.ArchiveTypeLiteral, Literal: []byte("hello")},
+		},
+		Status: fission.PackageStatus{BuildStatus: fission.BuildStatusSucceeded},
+	}
+}
+
+func TestCheckPackageMutable(t *testing.T) {
+	existing := immutablePackage()
+
+	retagged := immutablePackage()
+	retagged.Metadata.Labels[fission.PackageTagLabel] = "v2"
+	panicIf(CheckPackageMutable(existing, retagged))
+
+	unlocked := immutablePackage()
+	unlocked.Metadata.Annotations = nil
+	panicIf(CheckPackageMutable(existing, unlocked))
+
+	changed := immutablePackage()
+	changed.Spec.Deployment.Literal = []byte("jello")
+	rebuilt := immutablePackage()
+	rebuilt.Status.BuildStatus = fission.BuildStatusPending
+	annotated := immutablePackage()
+	annotated.Metadata.Annotations["owner"] = "someone"
+	unlockedChanged := immutablePackage()
+	unlockedChanged.Metadata.Annotations = nil
+	unlockedChanged.Spec.Deployment.Literal = []byte("jello")
+	for name, updated := range map[string]*Package{
+		"spec": changed, "status": rebuilt, "annotations": annotated, "unlocked spec": unlockedChanged,
+	} {
+		if CheckPackageMutable(existing, updated) == nil {
+			log.Panicf("Expected a change of the %v of an immutable package to be refused", name)
+		}
+	}
+
+	var stored *Package
+	conflicts, writes := 0, 0
+	pa := testApplier(&stored, &conflicts, &writes)
+	stored = immutablePackage()
+	if _, err := pa.Apply(changed, "ci", false); err == nil {
+		log.Panicf("Expected applying a changed spec to an immutable package to fail")
+	}
+	if writes != 0 {
+		log.Panicf("Expected an immutable package not to be written, got %v writes", writes)
+	}
+}
@@ -17,10 +17,14 @@ limitations under the License.
 package tpr
 
 import (
+	"fmt"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+
+	"github.com/fission/fission"
 )
 
 type (
@@ -118,3 +122,47 @@ func (c *packageClient) Watch(opts metav1.ListOptions) (watch.Interface, error)
 		VersionedParams(&opts, scheme.ParameterCodec).
 		Watch()
 }
+
+// IsBuildFinished returns true if a build with the given status has
+// succeeded, failed or was canceled, so the status won't change again
+// by itself.
+func IsBuildFinished(status fission.BuildStatus) bool {
+	return status == fission.BuildStatusSucceeded || status == fission.BuildStatusFailed ||
+		status == fission.BuildStatusCanceled
+}
+
+// MaxPackageAliasDepth bounds the chain of aliases followed to find
+// the package an alias points at.
+const MaxPackageAliasDepth = 8
+
+// ResolvePackageAlias follows a package's AliasOf chain, getting each
+// package with get, and returns the first package that isn't an
+// alias. It fails on cycles and on chains longer than
+// MaxPackageAliasDepth.
+func ResolvePackageAlias(pkg *Package, get func(namespace string, name string) (*Package, error)) (*Package, error) {
+	seen := map[string]bool{pkg.Metadata.Namespace + "/" + pkg.Metadata.Name: true}
+	for depth := 0; pkg.Spec.AliasOf != nil; depth++ {
+		if depth == MaxPackageAliasDepth {
+			return nil, fission.MakeError(fission.ErrorInvalidArgument,
+				fmt.Sprintf("package alias chain from %v is longer than %v", pkg.Metadata.Name, MaxPackageAliasDepth))
+		}
+		ref := pkg.Spec.AliasOf
+		ns := ref.Namespace
+		if len(ns) == 0 {
+			ns = pkg.Metadata.Namespace
+		}
+		key := ns + "/" + ref.Name
+		if seen[key] {
+			return nil, fission.MakeError(fission.ErrorInvalidArgument,
+				fmt.Sprintf("package alias cycle through %v", ref.Name))
+		}
+		seen[key] = true
+
+		target, err := get(ns, ref.Name)
+		if err != nil {
+			return nil, err
+		}
+		pkg = target
+	}
+	return pkg, nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ArchiveTransform rewrites one file of an archive before it is
+// uploaded, e.g. to minify it. path is the file's slash separated
+// path within the archive. Returning nil contents and a nil error
+// drops the file from the archive.
+type ArchiveTransform func(path string, contents []byte) ([]byte, error)
+
+var (
+	archiveTransformsLock sync.RWMutex
+	archiveTransforms     = make(map[string]ArchiveTransform)
+)
+
+func init() {
+	RegisterArchiveTransform("minify-json", minifyJson)
+	RegisterArchiveTransform("strip-sourcemaps", stripSourceMaps)
+	RegisterArchiveTransform(NormalizeEOLTransform, normalizeEOL)
+}
+
+// NormalizeEOLTransform is the name of the transform converting CRLF
+// line endings of text files to LF.
+const NormalizeEOLTransform = "normalize-eol"
+
+// RegisterArchiveTransform makes a transform available by name, for
+// the CLI's --transform flag. Registering a name again replaces the
+// previous transform.
+func RegisterArchiveTransform(name string, t ArchiveTransform) {
+	archiveTransformsLock.Lock()
+	defer archiveTransformsLock.Unlock()
+	archiveTransforms[name] = t
+}
+
+// GetArchiveTransform returns the transform registered under name.
+func GetArchiveTransform(name string) (ArchiveTransform, bool) {
+	archiveTransformsLock.RLock()
+	defer archiveTransformsLock.RUnlock()
+	t, ok := archiveTransforms[name]
+	return t, ok
+}
+
+// ArchiveTransformNames returns the sorted names of all registered
+// transforms.
+func ArchiveTransformNames() []string {
+	archiveTransformsLock.RLock()
+	defer archiveTransformsLock.RUnlock()
+	names := make([]string, 0, len(archiveTransforms))
+	for name := range archiveTransforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// minifyJson removes insignificant whitespace from .json files.
+func minifyJson(path string, contents []byte) ([]byte, error) {
+	if !strings.HasSuffix(path, ".json") {
+		return contents, nil
+	}
+	var buf bytes.Buffer
+	err := json.Compact(&buf, contents)
+	if err != nil {
+		return nil, MakeError(ErrorInvalidArgument, "Invalid JSON in "+path+": "+err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+// stripSourceMaps drops JavaScript and CSS source maps.
+func stripSourceMaps(path string, contents []byte) ([]byte, error) {
+	if strings.HasSuffix(path, ".js.map") || strings.HasSuffix(path, ".css.map") {
+		return nil, nil
+	}
+	return contents, nil
+}
+
+// eolSniffLength is how much of a file with an unknown extension is
+// looked at to tell whether it's text.
+const eolSniffLength = 8000
+
+var (
+	// textExtensions are always normalized by normalizeEOL.
+	textExtensions = map[string]bool{
+		".c": true, ".cfg": true, ".conf": true, ".cpp": true, ".cs": true, ".css": true,
+		".csv": true, ".go": true, ".gradle": true, ".h": true, ".html": true, ".ini": true,
+		".java": true, ".js": true, ".json": true, ".md": true, ".mod": true, ".php": true,
+		".properties": true, ".py": true, ".rb": true, ".rs": true, ".sh": true, ".sql": true,
+		".sum": true, ".toml": true, ".ts": true, ".txt": true, ".xml": true, ".yaml": true,
+		".yml": true,
+	}
+
+	// keepEOLExtensions are never normalized by normalizeEOL, even
+	// if they look like text: binaries, and Windows scripts, which
+	// need CRLF.
+	keepEOLExtensions = map[string]bool{
+		".7z": true, ".bat": true, ".cmd": true, ".bin": true, ".class": true, ".dll": true, ".exe": true, ".gif": true,
+		".gz": true, ".ico": true, ".jar": true, ".jpeg": true, ".jpg": true, ".pdf": true,
+		".png": true, ".pyc": true, ".so": true, ".tar": true, ".tgz": true, ".war": true,
+		".wasm": true, ".woff": true, ".woff2": true, ".zip": true, ".zst": true,
+	}
+)
+
+// isTextFile tells whether a file is text, by its extension, or else
+// by its first bytes: text has no NUL bytes and is valid UTF-8.
+func isTextFile(path string, contents []byte) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	if keepEOLExtensions[ext] {
+		return false
+	}
+	if textExtensions[ext] {
+		return true
+	}
+	head := contents
+	if len(head) > eolSniffLength {
+		head = head[:eolSniffLength]
+		// don't split a multi-byte character
+		for i := 0; i < utf8.UTFMax && !utf8.Valid(head); i++ {
+			head = head[:len(head)-1]
+		}
+	}
+	return bytes.IndexByte(head, 0) < 0 && utf8.Valid(head)
+}
+
+// normalizeEOL converts the CRLF line endings of text files to LF, so
+// that sources written on Windows build on Linux builders. Binary
+// files, and Windows batch files, are left as they are. Lone CRs are
+// kept.
+func normalizeEOL(path string, contents []byte) ([]byte, error) {
+	if !bytes.Contains(contents, []byte("\r\n")) || !isTextFile(path, contents) {
+		return contents, nil
+	}
+	return bytes.ReplaceAll(contents, []byte("\r\n"), []byte("\n")), nil
+}
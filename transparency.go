@@ -0,0 +1,156 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// An archive's checksum can be recorded in a transparency log, an
+// append-only Merkle tree in the style of RFC 6962 such as Rekor. The
+// log answers with an inclusion proof: the hashes linking the entry
+// to the tree's root, which can be checked without trusting whoever
+// stored the package.
+
+// TransparencyEntryKind is the kind of the entries logged for
+// archives.
+const TransparencyEntryKind = "fission-archive"
+
+// ErrInvalidInclusionProof means a transparency log entry isn't
+// proven to be in the log, or isn't for the archive it is recorded
+// on.
+var ErrInvalidInclusionProof = errors.New("invalid inclusion proof")
+
+type (
+	// TransparencyEntry is an archive's entry in a transparency
+	// log, as returned by the log.
+	TransparencyEntry struct {
+		// Log is the URL of the log.
+		Log string `json:"log"`
+
+		// UUID identifies the entry in the log.
+		UUID string `json:"uuid"`
+
+		LogIndex       int64 `json:"logIndex"`
+		IntegratedTime int64 `json:"integratedTime"`
+
+		// Body is the base64 entry as logged, a
+		// TransparencyEntryBody.
+		Body string `json:"body"`
+
+		InclusionProof InclusionProof `json:"inclusionProof"`
+	}
+
+	// InclusionProof proves an entry is in a log's Merkle tree of
+	// TreeSize entries with the given root. Hashes are hex.
+	InclusionProof struct {
+		LogIndex int64    `json:"logIndex"`
+		TreeSize int64    `json:"treeSize"`
+		RootHash string   `json:"rootHash"`
+		Hashes   []string `json:"hashes"`
+	}
+
+	// TransparencyEntryBody is what is logged for an archive: its
+	// hex SHA256 sum, and the name it was created from.
+	TransparencyEntryBody struct {
+		Kind   string `json:"kind"`
+		Name   string `json:"name,omitempty"`
+		SHA256 string `json:"sha256"`
+	}
+)
+
+// transparencyLeafHash is the RFC 6962 hash of a leaf of the tree.
+func transparencyLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// transparencyNodeHash is the RFC 6962 hash of an interior node.
+func transparencyNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// VerifyInclusion checks that leaf, the data of an entry, is at the
+// proof's index of the tree with the proof's root, following RFC 9162
+// section 2.1.3.2.
+func (proof *InclusionProof) VerifyInclusion(leaf []byte) error {
+	if proof.LogIndex < 0 || proof.LogIndex >= proof.TreeSize {
+		return fmt.Errorf("%w: index %v isn't in a tree of %v entries", ErrInvalidInclusionProof, proof.LogIndex, proof.TreeSize)
+	}
+	root, err := hex.DecodeString(proof.RootHash)
+	if err != nil {
+		return fmt.Errorf("%w: root hash: %v", ErrInvalidInclusionProof, err)
+	}
+
+	fn, sn := proof.LogIndex, proof.TreeSize-1
+	r := transparencyLeafHash(leaf)
+	for _, s := range proof.Hashes {
+		p, err := hex.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("%w: hash: %v", ErrInvalidInclusionProof, err)
+		}
+		if sn == 0 {
+			return fmt.Errorf("%w: too many hashes", ErrInvalidInclusionProof)
+		}
+		if fn&1 == 1 || fn == sn {
+			r = transparencyNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = transparencyNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return fmt.Errorf("%w: hashes don't lead to root %v", ErrInvalidInclusionProof, proof.RootHash)
+	}
+	return nil
+}
+
+// Verify checks that the entry is for an archive with the given hex
+// SHA256 sum, and that its inclusion proof holds.
+func (entry *TransparencyEntry) Verify(sha256Sum string) error {
+	data, err := base64.StdEncoding.DecodeString(entry.Body)
+	if err != nil {
+		return fmt.Errorf("%w: body: %v", ErrInvalidInclusionProof, err)
+	}
+	var body TransparencyEntryBody
+	err = json.Unmarshal(data, &body)
+	if err != nil {
+		return fmt.Errorf("%w: body: %v", ErrInvalidInclusionProof, err)
+	}
+	if body.Kind != TransparencyEntryKind || !strings.EqualFold(body.SHA256, sha256Sum) {
+		return fmt.Errorf("%w: entry %v is for %v %v, not sha256 %v", ErrInvalidInclusionProof, entry.UUID, body.Kind, body.SHA256, sha256Sum)
+	}
+	return entry.InclusionProof.VerifyInclusion(data)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2017 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fission
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+)
+
+// TreeHashChunkSize is the size of the chunks hashed separately by
+// TreeHash. It's part of the checksum's definition, so it can't
+// change.
+const TreeHashChunkSize = 4 * 1024 * 1024
+
+type (
+	// TreeHash computes ChecksumTypeSHA256Tree checksums: the
+	// SHA256 of the concatenated SHA256 digests of the content's
+	// TreeHashChunkSize chunks, the last of which may be shorter.
+	// Since completed chunks are only kept as digests, the hash of
+	// a partly sent archive can be saved with State and resumed
+	// with ResumeTreeHash without reading those chunks again.
+	TreeHash struct {
+		chunks  [][]byte
+		current hash.Hash
+		n       int
+	}
+
+	// TreeHashState is the state of a TreeHash at a chunk
+	// boundary: the hex digests of the chunks hashed so far.
+	TreeHashState struct {
+		Chunks []string `json:"chunks"`
+	}
+)
+
+// NewTreeHash returns a TreeHash of no content.
+func NewTreeHash() *TreeHash {
+	return &TreeHash{current: sha256.New()}
+}
+
+// ResumeTreeHash returns a TreeHash that continues from a saved
+// state, as if the chunks it was saved after had been written to it.
+func ResumeTreeHash(state TreeHashState) (*TreeHash, error) {
+	h := NewTreeHash()
+	for _, c := range state.Chunks {
+		digest, err := hex.DecodeString(c)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, MakeError(ErrorInvalidArgument, "Invalid tree hash chunk digest '"+c+"'")
+		}
+		h.chunks = append(h.chunks, digest)
+	}
+	return h, nil
+}
+
+// TreeHashOf combines chunk digests, as TreeHashState holds them,
+// into a ChecksumTypeSHA256Tree checksum.
+func TreeHashOf(state TreeHashState) (Checksum, error) {
+	h, err := ResumeTreeHash(state)
+	if err != nil {
+		return Checksum{}, err
+	}
+	return MakeChecksum(ChecksumTypeSHA256Tree, h.Sum(nil)), nil
+}
+
+func (h *TreeHash) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := TreeHashChunkSize - h.n
+		if n > len(p) {
+			n = len(p)
+		}
+		h.current.Write(p[:n])
+		h.n += n
+		p = p[n:]
+		if h.n == TreeHashChunkSize {
+			h.chunks = append(h.chunks, h.current.Sum(nil))
+			h.current.Reset()
+			h.n = 0
+		}
+	}
+	return written, nil
+}
+
+// Sum appends the checksum of what was written so far to b. It
+// doesn't change the hash's state.
+func (h *TreeHash) Sum(b []byte) []byte {
+	root := sha256.New()
+	for _, c := range h.chunks {
+		root.Write(c)
+	}
+	if h.n > 0 {
+		root.Write(h.current.Sum(nil))
+	}
+	return root.Sum(b)
+}
+
+func (h *TreeHash) Reset() {
+	h.chunks = nil
+	h.current.Reset()
+	h.n = 0
+}
+
+func (h *TreeHash) Size() int {
+	return sha256.Size
+}
+
+func (h *TreeHash) BlockSize() int {
+	return h.current.BlockSize()
+}
+
+// State returns the digests of the completed chunks. The bytes of an
+// incomplete chunk aren't part of it; a resumed hash must be written
+// to again from the end of the last completed chunk.
+func (h *TreeHash) State() TreeHashState {
+	state := TreeHashState{Chunks: make([]string, len(h.chunks))}
+	for i, c := range h.chunks {
+		state.Chunks[i] = hex.EncodeToString(c)
+	}
+	return state
+}
+
+// treeHashMagic starts a TreeHash's binary state.
+const treeHashMagic = "fth\x01"
+
+// MarshalBinary saves the full state of the hash, including an
+// incomplete chunk, unlike State. Like the standard library's hashes,
+// a TreeHash can then be resumed mid-chunk with UnmarshalBinary.
+func (h *TreeHash) MarshalBinary() ([]byte, error) {
+	current, err := h.current.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(treeHashMagic)+8+len(h.chunks)*sha256.Size+len(current))
+	b = append(b, treeHashMagic...)
+	b = appendUint32(b, uint32(len(h.chunks)))
+	for _, c := range h.chunks {
+		b = append(b, c...)
+	}
+	b = appendUint32(b, uint32(h.n))
+	return append(b, current...), nil
+}
+
+// UnmarshalBinary restores a state saved by MarshalBinary.
+func (h *TreeHash) UnmarshalBinary(b []byte) error {
+	invalid := MakeError(ErrorInvalidArgument, "Invalid tree hash state")
+	if len(b) < len(treeHashMagic)+4 || string(b[:len(treeHashMagic)]) != treeHashMagic {
+		return invalid
+	}
+	b = b[len(treeHashMagic):]
+	count := int(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	if count < 0 || len(b) < count*sha256.Size+4 {
+		return invalid
+	}
+	chunks := make([][]byte, count)
+	for i := range chunks {
+		chunks[i] = append([]byte(nil), b[:sha256.Size]...)
+		b = b[sha256.Size:]
+	}
+	n := int(binary.BigEndian.Uint32(b))
+	if n >= TreeHashChunkSize {
+		return invalid
+	}
+	current := sha256.New()
+	err := current.(encoding.BinaryUnmarshaler).UnmarshalBinary(b[4:])
+	if err != nil {
+		return invalid
+	}
+	h.chunks, h.current, h.n = chunks, current, n
+	return nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -32,7 +32,7 @@ type (
 	// Checksum of package contents when the contents are stored
 	// outside the Package struct. Type is the checksum algorithm;
 	// "sha256" is the only currently supported one. Sum is hex
-	// encoded.
+	// encoded; see Base64Sum for backends that use base64.
 	Checksum struct {
 		Type ChecksumType `json:"type"`
 		Sum  string       `json:"sum"`
@@ -43,6 +43,18 @@ type (
 	// externally.
 	ArchiveType string
 
+	// ArchiveCompression is the codec an uploaded archive was
+	// compressed with, such as gzip.
+	ArchiveCompression string
+
+	// ArchivePacking says how several files were packed into one
+	// literal archive.
+	ArchivePacking string
+
+	// ArchiveHint describes what an archive contains, from the
+	// well-known files found at its root when it was packed.
+	ArchiveHint string
+
 	// Package contains or references a collection of source or
 	// binary files.
 	Archive struct {
@@ -56,9 +68,110 @@ type (
 		// URL references a package.
 		URL string `json:"url"`
 
+		// Mirrors are URLs of identical copies of the contents
+		// at URL, such as in other regions, in the order they
+		// were uploaded. Fetchers download from whichever of URL
+		// and Mirrors answers fastest, and fall back to the
+		// others when it can't be fetched. Ignored for literals.
+		Mirrors []string `json:"mirrors,omitempty"`
+
+		// Parts are the URLs of the consecutive pieces of an
+		// archive too large for a single storage object, in
+		// order. When set, URL and Mirrors are empty and the
+		// contents are the concatenation of the parts.
+		Parts []string `json:"parts,omitempty"`
+
+		// Chunks are the checksums and sizes of the parts of an
+		// archive split at content-defined boundaries, one per
+		// part, so that pieces shared with other archives are
+		// stored once. Fetchers verify each part against its
+		// chunk as it arrives. Empty for archives split at fixed
+		// sizes.
+		Chunks []ArchiveChunk `json:"chunks,omitempty"`
+
 		// Checksum ensures the integrity of packages
-		// refereced by URL. Ignored for literals.
+		// refereced by URL, or of the concatenated parts. For
+		// literals it covers Literal; literals stored before
+		// they were checksummed have none.
 		Checksum Checksum `json:"checksum"`
+
+		// ServerChecksum is the checksum the storage service
+		// verified when the archive was uploaded, in the
+		// cheapest algorithm both it and the client support.
+		// Checksum is still what fetchers verify.
+		ServerChecksum *Checksum `json:"serverChecksum,omitempty"`
+
+		// Compression of the contents referenced by URL; the
+		// checksum is over the compressed bytes. Empty means
+		// uncompressed. Ignored for literals.
+		Compression ArchiveCompression `json:"compression,omitempty"`
+
+		// Packing is set on literals holding several files,
+		// which fetchers unpack into a directory. Empty means
+		// the literal is a single file or a zip.
+		Packing ArchivePacking `json:"packing,omitempty"`
+
+		// GitTree is the SHA of the git tree the archive was
+		// made from, if it was made from a clean git checkout.
+		// Archives with the same GitTree and Compression hold
+		// the same files.
+		GitTree string `json:"gitTree,omitempty"`
+
+		// Hints describe the archive's contents, so that
+		// builders can pick default build steps. They are
+		// metadata only, and may be missing.
+		Hints []ArchiveHint `json:"hints,omitempty"`
+
+		// Structure is the ArchiveStructure fingerprint of the
+		// directory the archive was packed from, telling apart
+		// archives of the same files in different layouts. It
+		// is only set for directories.
+		Structure string `json:"structure,omitempty"`
+
+		// Transparency is the archive's entry in a transparency
+		// log, with its inclusion proof, if its checksum was
+		// logged when it was created.
+		Transparency *TransparencyEntry `json:"transparency,omitempty"`
+
+		// Manifest optionally references a JSON encoded
+		// ArchiveManifest describing the files in this
+		// archive. The manifest is always checksummed, even
+		// when it is a literal.
+		Manifest *Archive `json:"manifest,omitempty"`
+
+		// RangeManifest optionally references a JSON encoded
+		// ArchiveRangeManifest with checksums of fixed size
+		// ranges of the bytes referenced by URL, so that sampled
+		// ranges can be verified without downloading them all.
+		RangeManifest *Archive `json:"rangemanifest,omitempty"`
+	}
+
+	// ArchiveRangeManifest has the SHA256 checksum of each range
+	// of RangeSize bytes of a stored archive, the last of which
+	// may be shorter, and the archive's total size.
+	ArchiveRangeManifest struct {
+		Size      int64    `json:"size"`
+		RangeSize int64    `json:"rangesize"`
+		Checksums []string `json:"checksums"`
+	}
+
+	// ArchiveManifest lists the files contained in an archive.
+	ArchiveManifest struct {
+		Files []ArchiveManifestEntry `json:"files"`
+	}
+
+	// ArchiveManifestEntry describes one file in an archive. Path
+	// is relative to the archive root and uses forward slashes.
+	ArchiveManifestEntry struct {
+		Path     string   `json:"path"`
+		Size     int64    `json:"size"`
+		Checksum Checksum `json:"checksum"`
+	}
+
+	// ArchiveChunk describes one part of a chunked archive.
+	ArchiveChunk struct {
+		Checksum Checksum `json:"checksum"`
+		Size     int64    `json:"size"`
 	}
 
 	EnvironmentReference struct {
@@ -68,16 +181,131 @@ type (
 
 	BuildStatus string
 
+	// DeploymentPolicy decides between a package's given
+	// deployment archive and the output of building its source.
+	DeploymentPolicy string
+
 	PackageSpec struct {
 		Environment  EnvironmentReference `json:"environment"`
 		Source       Archive              `json:"source"`
 		Deployment   Archive              `json:"deployment"`
 		BuildCommand string               `json:"buildcmd"`
+		// BuildEnv is added to the build command's environment.
+		BuildEnv []BuildEnvVar `json:"buildenv,omitempty"`
+		// AliasOf makes the package an alias: a pointer to
+		// another package, whose archives are used instead of
+		// this package's. Retargeting the alias switches every
+		// function using it. The ResourceVersion is ignored.
+		AliasOf *PackageRef `json:"aliasOf,omitempty"`
+		// SBOM and Attestation are an optional software bill of
+		// materials and in-toto attestation supplied with the
+		// package. They are stored like archives, checksummed,
+		// and aren't interpreted except by "package verify" and
+		// builder managers that require attestations.
+		SBOM        *Archive `json:"sbom,omitempty"`
+		Attestation *Archive `json:"attestation,omitempty"`
+		// BuilderImage builds this package with the given
+		// image instead of the environment's builder, e.g. to
+		// try a new builder version on one package.
+		BuilderImage string `json:"builderImage,omitempty"`
+		// DeploymentPolicy says whether building the source
+		// overwrites the deployment archive, or is stored in
+		// BuiltDeployment, keeping a deployment archive given
+		// with the source; see DeploymentArchive.
+		DeploymentPolicy DeploymentPolicy `json:"deploymentPolicy,omitempty"`
+		BuiltDeployment  *Archive         `json:"builtDeployment,omitempty"`
+		// PreBuildCommands and PostBuildCommands are hooks the
+		// builder runs in order before and after BuildCommand,
+		// e.g. to fetch private dependencies or run tests. They
+		// are shell commands, run with "sh -c" in the build
+		// command's directory and environment, and the build
+		// fails if any of them fails.
+		PreBuildCommands  []string `json:"prebuildcmds,omitempty"`
+		PostBuildCommands []string `json:"postbuildcmds,omitempty"`
+		// BuildSecrets and BuildConfigMaps name secrets and
+		// configmaps of the package's namespace that the
+		// builder mounts read-only for the build command and
+		// hooks, e.g. for private registry credentials. They
+		// are never part of the built deployment archive.
+		BuildSecrets    []string `json:"buildsecrets,omitempty"`
+		BuildConfigMaps []string `json:"buildconfigmaps,omitempty"`
 		// In the future, we can have a debug build here too
 	}
+
+	// BuildEnvVar is an environment variable for a build. The
+	// value is either given literally, or read from a secret.
+	BuildEnvVar struct {
+		Name      string              `json:"name"`
+		Value     string              `json:"value,omitempty"`
+		SecretRef *SecretKeyReference `json:"secretRef,omitempty"`
+	}
+
+	// SecretKeyReference names a key of a secret in the package's
+	// namespace.
+	SecretKeyReference struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}
 	PackageStatus struct {
 		BuildStatus BuildStatus `json:"buildstatus"`
 		BuildLog    string      `json:"buildlog"` // output of the build (errors etc)
+
+		// BuildProgress is how far a running build has got, if
+		// its build command reports it.
+		BuildProgress *BuildProgress `json:"buildprogress,omitempty"`
+
+		// HookLogs are the outputs of a build's hooks, in the
+		// order they ran, up to one that failed.
+		HookLogs []BuildHookLog `json:"hooklogs,omitempty"`
+	}
+
+	// BuildHookLog is the output of a build hook: the kind of
+	// hook, "pre-build" or "post-build", and its command.
+	BuildHookLog struct {
+		Hook    string `json:"hook"`
+		Command string `json:"command"`
+		Log     string `json:"log"`
+		Failed  bool   `json:"failed,omitempty"`
+	}
+
+	// BuildProgress is the progress a build command reports: the
+	// phase it is in, such as "downloading deps", and how far it
+	// is through the build, from 0 to 100, or -1 if it only
+	// reports phases.
+	BuildProgress struct {
+		Phase   string `json:"phase,omitempty"`
+		Percent int    `json:"percent"`
+	}
+
+	// PackageBatchCreateResult is the outcome of creating one
+	// package of a batch. Metadata is set if it was created;
+	// otherwise Status is the HTTP status its own create request
+	// would have failed with, and Error the message.
+	PackageBatchCreateResult struct {
+		Metadata *metav1.ObjectMeta `json:"metadata,omitempty"`
+		Status   int                `json:"status,omitempty"`
+		Error    string             `json:"error,omitempty"`
+	}
+
+	// BuildRefCheck asks the controller whether the secrets and
+	// configmaps a package's build refers to exist. Missing, in
+	// the response, lists those that don't, as secret/<name> or
+	// configmap/<name>.
+	BuildRefCheck struct {
+		Namespace  string   `json:"namespace"`
+		Secrets    []string `json:"secrets,omitempty"`
+		ConfigMaps []string `json:"configmaps,omitempty"`
+		Missing    []string `json:"missing,omitempty"`
+	}
+
+	// PackageApplyOutcome says what applying a package did.
+	PackageApplyOutcome string
+
+	// PackageApplyResult is the response to applying a package:
+	// its metadata after the apply, and what the apply did.
+	PackageApplyResult struct {
+		Metadata *metav1.ObjectMeta  `json:"metadata"`
+		Outcome  PackageApplyOutcome `json:"outcome"`
 	}
 
 	PackageRef struct {
@@ -149,6 +377,13 @@ type (
 		// server listens for function requests. Optional;
 		// default 8888.
 		FunctionEndpointPort int32 `json:"functionendpointport"`
+
+		// Language and LanguageVersion declare the language
+		// runtime the image provides, such as python 3.9.
+		// Optional; packages are checked against them when
+		// created.
+		Language        string `json:"language,omitempty"`
+		LanguageVersion string `json:"languageversion,omitempty"`
 	}
 	Builder struct {
 		Image   string `json:"image"`
@@ -171,6 +406,43 @@ type (
 		// Optional
 		// Defaults to 'Single'
 		AllowedFunctionsPerContainer AllowedFunctionsPerContainer `json:"allowedFunctionsPerContainer"`
+
+		// ArchiveLayout is where the environment expects the
+		// files of packages' archives. Optional; packages are
+		// checked against it when created.
+		ArchiveLayout *ArchiveLayout `json:"archiveLayout,omitempty"`
+
+		// MaxPackageSize is the largest archive, in bytes, the
+		// environment's packages may have, such as for runtimes
+		// with little disk. Optional; archives are checked
+		// against it when packages are created.
+		MaxPackageSize int64 `json:"maxPackageSize,omitempty"`
+	}
+
+	// ArchiveLayout lists the files an environment expects in the
+	// source archives it builds and the deployment archives it
+	// runs.
+	ArchiveLayout struct {
+		Source     []ArchiveLayoutFile `json:"source,omitempty"`
+		Deployment []ArchiveLayoutFile `json:"deployment,omitempty"`
+	}
+
+	// ArchiveLayoutFile is a file an archive should have.
+	ArchiveLayoutFile struct {
+		// Path is a slash separated glob matched against the
+		// paths in the archive, such as "requirements.txt" or
+		// "src/*.py"; a glob without slashes only matches files
+		// at the top of the archive.
+		Path string `json:"path"`
+
+		// Role describes the file for messages, such as
+		// "handler", "dependencies" or "config".
+		Role string `json:"role,omitempty"`
+
+		// Required files are warned about when missing, and
+		// fail with --strict-layout; others are only reported
+		// with --verbose.
+		Required bool `json:"required,omitempty"`
 	}
 
 	AllowedFunctionsPerContainer string
@@ -246,8 +518,17 @@ type (
 	}
 )
 
+// MaxPackageBatchSize is the most packages a batch create request
+// may hold.
+const MaxPackageBatchSize = 100
+
 const (
 	ChecksumTypeSHA256 ChecksumType = "sha256"
+	ChecksumTypeCRC32C ChecksumType = "crc32c"
+
+	// ChecksumTypeSHA256Tree is the SHA256 of the SHA256s of
+	// TreeHashChunkSize chunks; see TreeHash.
+	ChecksumTypeSHA256Tree ChecksumType = "sha256-tree"
 )
 
 const (
@@ -259,13 +540,89 @@ const (
 	ArchiveTypeUrl ArchiveType = "url"
 )
 
+const (
+	ArchiveCompressionNone ArchiveCompression = ""
+	ArchiveCompressionGzip ArchiveCompression = "gzip"
+	ArchiveCompressionZstd ArchiveCompression = "zstd"
+)
+
+const (
+	ArchivePackingNone ArchivePacking = ""
+
+	// ArchivePackingTar is a tar of files without directories.
+	ArchivePackingTar ArchivePacking = "tar"
+)
+
+// Archive hints, and the file at the archive root that gives each;
+// see ArchiveHintFiles.
+const (
+	ArchiveHintPipRequirements ArchiveHint = "pip-requirements" // requirements.txt
+	ArchiveHintNpmPackage      ArchiveHint = "npm-package"      // package.json
+	ArchiveHintGoModule        ArchiveHint = "go-module"        // go.mod
+	ArchiveHintMavenProject    ArchiveHint = "maven-project"    // pom.xml
+	ArchiveHintBundlerGemfile  ArchiveHint = "bundler-gemfile"  // Gemfile
+	ArchiveHintComposerPackage ArchiveHint = "composer-package" // composer.json
+)
+
 const (
 	BuildStatusPending   = "pending"
 	BuildStatusRunning   = "running"
 	BuildStatusSucceeded = "succeeded"
 	BuildStatusFailed    = "failed"
+
+	// BuildStatusAwaitingUpload is the status of packages declared
+	// before their archives exist. They are neither built nor
+	// fetchable until their archives are committed.
+	BuildStatusAwaitingUpload = "awaiting-upload"
+
+	// BuildStatusCanceled is the status of packages whose build was
+	// stopped on request, e.g. by "fission package cancel-build".
+	BuildStatusCanceled = "canceled"
+)
+
+const (
+	// DeploymentPolicyOverwrite has the build output replace the
+	// deployment archive; it's the default.
+	DeploymentPolicyOverwrite DeploymentPolicy = ""
+
+	// DeploymentPolicyPreferBuild keeps the given deployment
+	// archive, used until the source is built.
+	DeploymentPolicyPreferBuild DeploymentPolicy = "prefer-build"
+
+	// DeploymentPolicyPreferExplicit keeps the given deployment
+	// archive and always uses it, the build output being used
+	// only by packages without one.
+	DeploymentPolicyPreferExplicit DeploymentPolicy = "prefer-explicit"
 )
 
+const (
+	PackageApplyCreated   PackageApplyOutcome = "created"
+	PackageApplyUpdated   PackageApplyOutcome = "updated"
+	PackageApplyUnchanged PackageApplyOutcome = "unchanged"
+)
+
+// PackageFieldManagerAnnotation records the field manager that last
+// applied a package, which owns its spec.
+const PackageFieldManagerAnnotation = "fission.io/field-manager"
+
+// PackageImmutableAnnotation, set to "true", marks a released package
+// whose spec and build status must not change. Removing it unlocks
+// the package.
+const PackageImmutableAnnotation = "fission.io/immutable"
+
+// PackageRequestIdAnnotation records the request ID of the request
+// that last created or updated a package, so that its build can be
+// traced back to the command that asked for it.
+const PackageRequestIdAnnotation = "fission.io/request-id"
+
+// RequestIdHeader carries the ID correlating the requests of one CLI
+// command in controller, builder and storage logs.
+const RequestIdHeader = "X-Request-Id"
+
+// PackageTagLabel is a human-facing name of a package, unique in its
+// namespace, that can be changed without recreating the package.
+const PackageTagLabel = "fission.io/tag"
+
 const (
 	AllowedFunctionsPerContainerSingle   = "single"
 	AllowedFunctionsPerContainerInfinite = "infinite"